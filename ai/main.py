@@ -7,6 +7,7 @@ import io
 from PIL import Image
 import numpy as np
 from typing import Optional, List, Dict, Any
+from functools import lru_cache
 import logging
 
 # Configure logging
@@ -63,6 +64,18 @@ class InpaintRequest(BaseModel):
 class InpaintResponse(BaseModel):
     image_data: str
 
+class TranslateRequest(BaseModel):
+    texts: List[str]
+    target_language: str
+    source_language: Optional[str] = None  # detected per text when omitted
+
+class Translation(BaseModel):
+    source_language: str
+    text: str
+
+class TranslateResponse(BaseModel):
+    translations: List[Translation]
+
 @app.get("/")
 async def root():
     return {"message": "CanvasAI AI Services", "version": "1.0.0"}
@@ -234,5 +247,62 @@ async def search_assets(query: str, limit: int = 10):
         logger.error(f"Error searching assets: {str(e)}")
         raise HTTPException(status_code=500, detail=str(e))
 
+# Translation models are loaded on first use, since most deployments never
+# translate and the models take a while to load
+LANGUAGE_DETECTION_MODEL = "papluca/xlm-roberta-base-language-detection"
+TRANSLATION_MODEL = "facebook/m2m100_418M"
+
+@lru_cache(maxsize=1)
+def language_detector():
+    from transformers import pipeline
+    return pipeline("text-classification", model=LANGUAGE_DETECTION_MODEL)
+
+@lru_cache(maxsize=1)
+def translator():
+    from transformers import M2M100ForConditionalGeneration, M2M100Tokenizer
+    tokenizer = M2M100Tokenizer.from_pretrained(TRANSLATION_MODEL)
+    model = M2M100ForConditionalGeneration.from_pretrained(TRANSLATION_MODEL)
+    return tokenizer, model
+
+def base_language(tag: str) -> str:
+    """Reduce a language tag such as pt-BR to the model's code (pt)"""
+    return tag.split("-")[0].split("_")[0].lower()
+
+@app.post("/ai/translate", response_model=TranslateResponse)
+async def translate(request: TranslateRequest):
+    """Translate texts, detecting each one's language unless it is given"""
+    try:
+        logger.info(f"Translating {len(request.texts)} texts to {request.target_language}")
+
+        tokenizer, model = translator()
+        target = base_language(request.target_language)
+        if target not in tokenizer.lang_code_to_id:
+            raise HTTPException(status_code=400, detail=f"Unsupported target language: {request.target_language}")
+
+        translations = []
+        for text in request.texts:
+            if request.source_language:
+                source = base_language(request.source_language)
+            else:
+                source = base_language(language_detector()(text[:512])[0]["label"])
+
+            if source == target or source not in tokenizer.lang_code_to_id:
+                translations.append(Translation(source_language=source, text=text))
+                continue
+
+            tokenizer.src_lang = source
+            encoded = tokenizer(text, return_tensors="pt", truncation=True)
+            generated = model.generate(**encoded, forced_bos_token_id=tokenizer.get_lang_id(target))
+            translated = tokenizer.batch_decode(generated, skip_special_tokens=True)[0]
+            translations.append(Translation(source_language=source, text=translated))
+
+        return TranslateResponse(translations=translations)
+
+    except HTTPException:
+        raise
+    except Exception as e:
+        logger.error(f"Error translating: {str(e)}")
+        raise HTTPException(status_code=500, detail=str(e))
+
 if __name__ == "__main__":
     uvicorn.run(app, host="0.0.0.0", port=8000)
@@ -0,0 +1,409 @@
+// Package asset stores uploaded files (images, fonts, video) in object
+// storage and tracks their metadata and ownership.
+package asset
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+
+	"canvasai/canvasrefs"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Asset represents a stored file
+type Asset struct {
+	ID               string    `json:"id"`
+	ProjectID        *string   `json:"projectId,omitempty"`
+	UserID           string    `json:"userId"`
+	Filename         string    `json:"filename"`
+	OriginalFilename string    `json:"originalFilename"`
+	MimeType         string    `json:"mimeType"`
+	FileSize         int64     `json:"fileSize"`
+	URL              string    `json:"url"`
+	Width            *int      `json:"width,omitempty"`
+	Height           *int      `json:"height,omitempty"`
+	AltText          string    `json:"altText,omitempty"`
+	Checksum         string    `json:"checksum"`
+	Blurhash         string    `json:"blurhash,omitempty"`     // placeholder for raster images
+	ColorProfile     string    `json:"colorProfile,omitempty"` // embedded ICC profile; untagged images are sRGB
+	Version          int       `json:"version"`                // incremented each time the file is replaced
+	CreatedAt        time.Time `json:"createdAt"`
+	// Deduped is set when Store returned an existing asset instead of
+	// storing another copy (see StoreRequest.Dedupe)
+	Deduped bool `json:"deduped,omitempty"`
+}
+
+// StoreRequest represents an internal request to persist file contents
+type StoreRequest struct {
+	UserID    string `json:"userId"`
+	ProjectID string `json:"projectId,omitempty"`
+	Filename  string `json:"filename"`
+	MimeType  string `json:"mimeType"`
+	Data      []byte `json:"data"`
+	Width     *int   `json:"width,omitempty"`
+	Height    *int   `json:"height,omitempty"`
+	AltText   string `json:"altText,omitempty"`
+	// Public makes the asset viewable by any signed-in user (e.g. avatars)
+	Public bool `json:"public,omitempty"`
+	// Dedupe returns an existing asset of the same project with identical
+	// contents instead of storing another copy
+	Dedupe bool `json:"dedupe,omitempty"`
+	// RetainUntil locks the asset: until then its file cannot be replaced
+	// and the asset cannot be deleted (e.g. compliance snapshots)
+	RetainUntil *time.Time `json:"retainUntil,omitempty"`
+}
+
+// MaxAssetSize is the largest file the asset service accepts
+const MaxAssetSize = 50 << 20
+
+// maxBlurhashPixels bounds the images decoded to compute a placeholder
+const maxBlurhashPixels = 40_000_000
+
+// Assets live alongside projects so usage tracking can join against them.
+var db = sqldb.Named("project")
+
+func init() {
+	permissions.RegisterResolver(permissions.TypeAsset, assetRole)
+}
+
+// Store uploads file contents for a user and records the asset. It is used
+// by other services that receive files (imports, avatars, extraction).
+//
+//encore:api private method=POST path=/assets/internal/store
+func Store(ctx context.Context, req *StoreRequest) (*Asset, error) {
+	if req.UserID == "" || strings.TrimSpace(req.Filename) == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "User and filename are required",
+		}
+	}
+	if len(req.Data) == 0 || len(req.Data) > MaxAssetSize {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Asset must be between 1 byte and 50MB",
+		}
+	}
+
+	mimeType := req.MimeType
+	if mimeType == "" {
+		mimeType = http.DetectContentType(req.Data)
+	}
+	sum := sha256.Sum256(req.Data)
+	checksum := hex.EncodeToString(sum[:])
+
+	if req.Dedupe && req.ProjectID != "" {
+		var existingID string
+		err := db.QueryRow(ctx, `
+			SELECT id FROM assets
+			WHERE project_id = $1 AND checksum = $2 AND mime_type = $3 AND NOT COALESCE(is_public, FALSE)
+			ORDER BY created_at LIMIT 1
+		`, req.ProjectID, checksum, mimeType).Scan(&existingID)
+		if err == nil {
+			if existing, _, err := getAsset(ctx, existingID); err == nil {
+				existing.Deduped = true
+				return existing, nil
+			}
+		} else if err != sql.ErrNoRows {
+			reqctx.Logger(ctx).Warn("failed to look up duplicate asset", "error", err)
+		}
+	}
+
+	a := &Asset{
+		ID:               newID(),
+		UserID:           req.UserID,
+		Filename:         req.Filename,
+		OriginalFilename: req.Filename,
+		MimeType:         mimeType,
+		FileSize:         int64(len(req.Data)),
+		Width:            req.Width,
+		Height:           req.Height,
+		AltText:          req.AltText,
+		Checksum:         checksum,
+		Version:          1,
+		CreatedAt:        time.Now(),
+	}
+	describeImage(a, req.Data)
+	if req.ProjectID != "" {
+		a.ProjectID = &req.ProjectID
+	}
+	key := objectPath(req.UserID, req.Filename)
+
+	if err := putObject(ctx, key, mimeType, req.Data); err != nil {
+		reqctx.Logger(ctx).Error("failed to upload asset", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to store asset",
+		}
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO assets (id, project_id, user_id, filename, original_filename, mime_type, file_size, file_path, width, height, alt_text, checksum, blurhash, is_public, created_at, org_id, color_profile, retain_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''), $14, $15,
+			(SELECT org_id FROM projects WHERE id = $2), NULLIF($16, ''), $17)
+	`, a.ID, a.ProjectID, a.UserID, a.Filename, a.OriginalFilename, a.MimeType, a.FileSize, key, a.Width, a.Height, a.AltText, a.Checksum, a.Blurhash, req.Public, a.CreatedAt, a.ColorProfile, req.RetainUntil)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record asset", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to store asset",
+		}
+	}
+
+	a.URL = canvasrefs.AssetURL(a.ID)
+	return a, nil
+}
+
+// AssetData is an asset together with its file contents
+type AssetData struct {
+	Asset *Asset `json:"asset"`
+	Data  []byte `json:"data"`
+}
+
+// Read returns an asset's contents for services that process files
+// server-side, such as the export renderer.
+//
+//encore:api private method=GET path=/assets/internal/:id/data
+func Read(ctx context.Context, id string) (*AssetData, error) {
+	a, key, err := getAsset(ctx, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+	data, err := getObject(ctx, key)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read asset", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to read asset",
+		}
+	}
+	return &AssetData{Asset: a, Data: data}, nil
+}
+
+// Delete removes an asset and its stored files, including previous
+// versions, keeping files another asset still shares. It is used by
+// services that own generated files, such as export retention. Assets
+// under a retention lock cannot be deleted until it expires.
+//
+//encore:api private method=DELETE path=/assets/internal/:id
+func Delete(ctx context.Context, id string) error {
+	_, key, err := getAsset(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	var locked bool
+	if err == nil {
+		locked, err = retained(ctx, id)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset", "asset_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete asset",
+		}
+	}
+	if locked {
+		return errRetained
+	}
+	keys, err := versionKeys(ctx, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset versions", "asset_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete asset",
+		}
+	}
+	for _, k := range append(keys, key) {
+		shared, err := objectShared(ctx, k, id)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to check asset object use", "asset_id", id, "error", err)
+			return &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to delete asset",
+			}
+		}
+		if shared {
+			continue
+		}
+		if err := removeObject(ctx, k); err != nil {
+			reqctx.Logger(ctx).Error("failed to remove asset object", "asset_id", id, "error", err)
+			return &errs.Error{
+				Code:    errs.Unavailable,
+				Message: "Failed to delete asset",
+			}
+		}
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM assets WHERE id = $1`, id); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete asset", "asset_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete asset",
+		}
+	}
+	return nil
+}
+
+//encore:api auth method=GET path=/assets/:id
+func GetAsset(ctx context.Context, id string) (*Asset, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetView); err != nil {
+		return nil, err
+	}
+
+	a, _, err := getAsset(ctx, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+	return a, nil
+}
+
+// Content redirects to a short-lived signed URL for the asset's file.
+//
+//encore:api auth raw method=GET path=/assets/:id/content
+func Content(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := encore.CurrentRequest().PathParams.Get("id")
+
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetView); err != nil {
+		http.Error(w, "access denied to this asset", http.StatusForbidden)
+		return
+	}
+
+	_, key, err := getAsset(ctx, id)
+	if err != nil {
+		http.Error(w, "asset not found", http.StatusNotFound)
+		return
+	}
+
+	signed, err := presignedGetURL(ctx, key, 15*time.Minute)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to sign asset url", "asset_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, signed.String(), http.StatusFound)
+}
+
+func getAsset(ctx context.Context, id string) (*Asset, string, error) {
+	var a Asset
+	var key string
+	var projectID, altText sql.NullString
+	err := db.QueryRow(ctx, `
+		SELECT id, project_id, user_id, filename, original_filename, mime_type, file_size, file_path, width, height, alt_text, COALESCE(checksum, ''), COALESCE(blurhash, ''), COALESCE(color_profile, ''), version, created_at
+		FROM assets WHERE id = $1
+	`, id).Scan(&a.ID, &projectID, &a.UserID, &a.Filename, &a.OriginalFilename, &a.MimeType, &a.FileSize, &key, &a.Width, &a.Height, &altText, &a.Checksum, &a.Blurhash, &a.ColorProfile, &a.Version, &a.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if projectID.Valid {
+		a.ProjectID = &projectID.String
+	}
+	a.AltText = altText.String
+	a.URL = canvasrefs.AssetURL(a.ID)
+	return &a, key, nil
+}
+
+var errRetained = &errs.Error{
+	Code:    errs.FailedPrecondition,
+	Message: "Asset is under a retention lock",
+}
+
+// retained reports whether an asset's retention lock is in force.
+func retained(ctx context.Context, id string) (bool, error) {
+	var locked bool
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(retain_until > NOW(), FALSE) FROM assets WHERE id = $1
+	`, id).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return locked, err
+}
+
+// describeImage fills in the dimensions, color profile and BlurHash of
+// raster images. Other files, and images too large to decode cheaply, are
+// left as they are.
+func describeImage(a *Asset, data []byte) {
+	if !strings.HasPrefix(a.MimeType, "image/") {
+		return
+	}
+	if icc, ok := render.EmbeddedProfile(data); ok {
+		a.ColorProfile = profileName(icc)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > maxBlurhashPixels {
+		return
+	}
+	if a.Width == nil || a.Height == nil {
+		a.Width, a.Height = &cfg.Width, &cfg.Height
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	a.Blurhash = render.Blurhash(img, 4, 3)
+}
+
+// assetRole gives the uploader full control of an asset and otherwise
+// inherits the user's role on the project the asset belongs to. Public
+// assets can be viewed by anyone, and workspace assets by the workspace's
+// admins and members.
+func assetRole(ctx context.Context, assetID, userID string) (permissions.Role, error) {
+	var ownerID string
+	var projectID sql.NullString
+	var public, orgMember bool
+	err := db.QueryRow(ctx, `
+		SELECT a.user_id, a.project_id, COALESCE(a.is_public, FALSE), m.user_id IS NOT NULL
+		FROM assets a
+		LEFT JOIN organization_members m ON m.org_id = a.org_id AND m.user_id = $2 AND m.role IN ('admin', 'member')
+		WHERE a.id = $1
+	`, assetID, userID).Scan(&ownerID, &projectID, &public, &orgMember)
+	if err == sql.ErrNoRows {
+		return permissions.RoleNone, nil
+	} else if err != nil {
+		return permissions.RoleNone, err
+	}
+	if ownerID == userID {
+		return permissions.RoleOwner, nil
+	}
+
+	fallback := permissions.RoleNone
+	if public || orgMember {
+		fallback = permissions.RoleViewer
+	}
+	if !projectID.Valid {
+		return fallback, nil
+	}
+
+	role, err := projectaccess.Role(ctx, projectID.String, userID)
+	if err != nil {
+		return permissions.RoleNone, err
+	}
+	return projectaccess.Stronger(role, fallback), nil
+}
+
+func newID() string {
+	return uuid.New().String()
+}
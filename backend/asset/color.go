@@ -0,0 +1,164 @@
+package asset
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Images from cameras and print workflows often carry a wide-gamut or
+// vendor profile (Adobe RGB, ProPhoto). Exports convert them on the fly, but
+// the editor shows raw pixel values, so such images look washed out or
+// oversaturated next to the rest of the design. ConvertColor bakes the
+// conversion into a new asset the design can use instead.
+
+// ConvertColorRequest represents a color conversion request
+type ConvertColorRequest struct {
+	// Target is the color space to convert to: srgb (default) or display-p3
+	Target string `json:"target,omitempty"`
+}
+
+// ConvertColor converts an image asset from its embedded profile to a
+// working color space and stores the result as a new asset tagged with the
+// target profile. The original is kept. Images already in the target space
+// are returned unchanged.
+//
+//encore:api auth method=POST path=/assets/:id/convert-color
+func ConvertColor(ctx context.Context, id string, req *ConvertColorRequest) (*Asset, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetUpload); err != nil {
+		return nil, err
+	}
+	target := render.SRGB
+	switch render.ColorSpace(req.Target) {
+	case "", render.SRGB:
+	case render.DisplayP3:
+		target = render.DisplayP3
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Target must be srgb or display-p3",
+		}
+	}
+
+	a, key, err := getAsset(ctx, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+	if a.MimeType != "image/png" && a.MimeType != "image/jpeg" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Only PNG and JPEG images can be converted",
+		}
+	}
+	data, err := getObject(ctx, key)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read asset", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to read asset",
+		}
+	}
+
+	source := render.SRGB.Profile()
+	if icc, ok := render.EmbeddedProfile(data); ok {
+		if source, err = render.ParseICC(icc); err != nil {
+			msg := "Embedded color profile is invalid"
+			if errors.Is(err, render.ErrUnsupportedProfile) {
+				msg = "Only RGB matrix color profiles can be converted"
+			}
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: msg,
+			}
+		}
+	}
+	if source.Space() == target {
+		return a, nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil && cfg.Width*cfg.Height > maxBlurhashPixels {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Image is too large to convert",
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Image could not be decoded",
+		}
+	}
+	converted := render.ConvertImage(img, source, target.Profile())
+
+	var out bytes.Buffer
+	if a.MimeType == "image/jpeg" {
+		err = jpeg.Encode(&out, converted, &jpeg.Options{Quality: 92})
+	} else {
+		err = png.Encode(&out, converted)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to encode converted image", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to convert asset",
+		}
+	}
+	tagged, err := render.EmbedProfile(out.Bytes(), target.ICC(), target.Profile().Description)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to tag converted image", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to convert asset",
+		}
+	}
+
+	ext := path.Ext(a.OriginalFilename)
+	storeReq := &StoreRequest{
+		UserID:   auth.UserID(),
+		Filename: strings.TrimSuffix(a.OriginalFilename, ext) + "-" + string(target) + ext,
+		MimeType: a.MimeType,
+		Data:     tagged,
+		AltText:  a.AltText,
+	}
+	if a.ProjectID != nil {
+		storeReq.ProjectID = *a.ProjectID
+	}
+	stored, err := Store(ctx, storeReq)
+	if err != nil {
+		return nil, err
+	}
+	reqctx.Logger(ctx).Info("asset color converted", "asset_id", id, "converted_id", stored.ID, "from", source.Description, "to", target)
+	return stored, nil
+}
+
+// profileName describes an embedded profile for the asset listing.
+func profileName(icc []byte) string {
+	p, err := render.ParseICC(icc)
+	if err != nil {
+		return "unsupported profile"
+	}
+	if p.Description == "" {
+		return "unnamed profile"
+	}
+	if len(p.Description) > 200 {
+		return p.Description[:200]
+	}
+	return p.Description
+}
@@ -0,0 +1,126 @@
+package asset
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"encore.dev/pubsub"
+
+	"canvasai/realtime"
+	"canvasai/reqctx"
+)
+
+// A shared asset such as a brand logo can be used by any number of
+// projects, so replacing it only queues an AssetUpdate; propagateUpdate
+// finds the projects through the projects.asset_refs usage index and tells
+// their editors. Live projects already show the new file, since their canvas
+// references the asset by ID. Projects that froze the asset are told too,
+// with the version they keep showing, so editors can offer to follow the
+// update.
+
+// AssetUpdate asks the propagation job to notify the projects using an asset
+type AssetUpdate struct {
+	AssetID string          `json:"assetId"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// AssetUpdates is the queue of replaced assets waiting to be propagated.
+var AssetUpdates = pubsub.NewTopic[*AssetUpdate]("asset-updates", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(AssetUpdates, "propagate-asset-update", pubsub.SubscriptionConfig[*AssetUpdate]{
+	Handler: propagateUpdate,
+	RetryPolicy: &pubsub.RetryPolicy{
+		MinBackoff: 10 * time.Second,
+		MaxBackoff: 10 * time.Minute,
+		MaxRetries: 5,
+	},
+})
+
+// queueUpdate queues the asset.updated realtime event payload for every
+// project using the asset.
+func queueUpdate(ctx context.Context, assetID string, payload map[string]any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = AssetUpdates.Publish(ctx, &AssetUpdate{AssetID: assetID, Payload: raw})
+	return err
+}
+
+func propagateUpdate(ctx context.Context, u *AssetUpdate) error {
+	log := reqctx.Logger(ctx)
+	var payload map[string]any
+	if err := json.Unmarshal(u.Payload, &payload); err != nil {
+		// Retrying cannot fix a malformed message.
+		log.Error("dropping malformed asset update", "asset_id", u.AssetID, "error", err)
+		return nil
+	}
+	uses, err := projectsUsing(ctx, u.AssetID)
+	if err != nil {
+		log.Error("failed to find projects using asset", "asset_id", u.AssetID, "error", err)
+		return err
+	}
+
+	live, frozen := 0, 0
+	for _, use := range uses {
+		if use.frozenVersion > 0 {
+			payload["frozen"] = true
+			payload["frozenVersion"] = use.frozenVersion
+			frozen++
+		} else {
+			delete(payload, "frozen")
+			delete(payload, "frozenVersion")
+			live++
+		}
+		if err := realtime.Publish(ctx, use.projectID, realtime.EventAssetUpdated, payload); err != nil {
+			log.Error("failed to publish asset update", "asset_id", u.AssetID, "project_id", use.projectID, "error", err)
+		}
+	}
+	log.Info("asset update propagated", "asset_id", u.AssetID, "live_projects", live, "frozen_projects", frozen)
+	return nil
+}
+
+// projectUse is a project whose canvas references an asset
+type projectUse struct {
+	projectID string
+	// frozenVersion is the version the project froze the asset at, or zero
+	// when it follows the current file
+	frozenVersion int
+}
+
+// projectsUsing returns the asset's project and the projects whose canvas
+// references it according to the usage index. Projects last saved before
+// the index existed are found by scanning the canvas of the owner's and
+// workspace's projects.
+func projectsUsing(ctx context.Context, assetID string) ([]projectUse, error) {
+	referenced := `$.*[*] ? (@ == ` + strconv.Quote(assetID) + `)`
+	rows, err := db.Query(ctx, `
+		SELECT u.id, COALESCE(l.frozen_version, 0) FROM (
+			SELECT id FROM projects WHERE asset_refs @? $2::jsonpath
+			UNION
+			SELECT project_id FROM assets WHERE id = $1 AND project_id IS NOT NULL
+			UNION
+			SELECT p.id FROM projects p
+			JOIN assets a ON a.id = $1 AND (p.owner_id = a.user_id OR p.org_id = a.org_id)
+			WHERE p.asset_refs IS NULL AND p.canvas_data::text LIKE '%' || a.id::text || '%'
+		) u
+		LEFT JOIN project_asset_links l ON l.project_id = u.id AND l.asset_id = $1
+	`, assetID, referenced)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uses []projectUse
+	for rows.Next() {
+		var use projectUse
+		if err := rows.Scan(&use.projectID, &use.frozenVersion); err != nil {
+			return nil, err
+		}
+		uses = append(uses, use)
+	}
+	return uses, rows.Err()
+}
@@ -0,0 +1,487 @@
+package asset
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/cron"
+
+	"canvasai/canvasrefs"
+	"canvasai/notification"
+	"canvasai/outbound"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// Assets can be imported from a URL, such as a brand portal that hosts the
+// canonical logo. The backend stores a copy and records the source; a
+// revalidation job checks the source periodically with conditional
+// requests and, when the upstream file changed, flags the asset and
+// notifies its owner. Refreshing pulls the new file in as a new version of
+// the asset, so linked projects pick it up (see versions.go). Nothing is
+// replaced without someone asking.
+
+// SourceRevalidation configures how often imported assets are checked
+type SourceRevalidation struct {
+	// Hours between checks of a source. Zero uses the default.
+	Hours int `json:"hours"`
+}
+
+var sourceCfg struct {
+	SourceRevalidation SourceRevalidation
+}
+
+var _ = config.Load(context.Background(), &sourceCfg)
+
+const (
+	defaultRevalidationHours = 24
+	revalidationBatchSize    = 100
+	maxSourceURLLength       = 2048
+)
+
+// importableTypes are the top-level media types that can be imported.
+var importableTypes = map[string]bool{
+	"image": true,
+	"font":  true,
+	"video": true,
+}
+
+// importClient fetches sources; they are arbitrary third-party URLs.
+var importClient = outbound.NewClient(outbound.Policy{
+	Timeout:          30 * time.Second,
+	MaxResponseBytes: MaxAssetSize,
+	RateLimit:        ratelimit.Limit{Requests: 10, Per: time.Second},
+})
+
+// ImportAssetRequest represents the import asset request
+type ImportAssetRequest struct {
+	URL string `json:"url"`
+	// ProjectID adds the asset to a project the caller can edit
+	ProjectID string `json:"projectId,omitempty"`
+	// Filename defaults to the last segment of the URL path
+	Filename string `json:"filename,omitempty"`
+	AltText  string `json:"altText,omitempty"`
+}
+
+// AssetSource describes where an imported asset came from
+type AssetSource struct {
+	AssetID string `json:"assetId"`
+	URL     string `json:"url"`
+	// UpdateAvailable is set when the upstream file differs from the one
+	// last fetched; refresh the asset to pull it in
+	UpdateAvailable bool `json:"updateAvailable"`
+	// Failures counts consecutive checks that could not reach the source
+	Failures    int        `json:"failures,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	CheckedAt   time.Time  `json:"checkedAt"`
+	ChangedAt   *time.Time `json:"changedAt,omitempty"`
+	RefreshedAt *time.Time `json:"refreshedAt,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+// ImportAssetResponse represents the import asset response
+type ImportAssetResponse struct {
+	Asset  *Asset       `json:"asset"`
+	Source *AssetSource `json:"source"`
+}
+
+// RefreshAssetResponse represents the refresh asset source response
+type RefreshAssetResponse struct {
+	Asset *Asset `json:"asset"`
+	// Updated is false when the source still serves the file the asset has
+	Updated bool         `json:"updated"`
+	Source  *AssetSource `json:"source"`
+}
+
+// ImportAsset fetches a file from a public URL and stores a copy as an
+// asset that remembers its source.
+//
+//encore:api auth method=POST path=/assets/import
+func ImportAsset(ctx context.Context, req *ImportAssetRequest) (*ImportAssetResponse, error) {
+	userID := auth.UserID()
+	if req.ProjectID != "" {
+		if err := projectaccess.RequireRole(ctx, req.ProjectID, permissions.RoleEditor); err != nil {
+			return nil, err
+		}
+	}
+	rawURL := strings.TrimSpace(req.URL)
+	if len(rawURL) > maxSourceURLLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "URL is too long",
+		}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "A valid http or https URL is required",
+		}
+	}
+
+	fetched, err := fetchSource(ctx, rawURL, "", "")
+	if err != nil {
+		return nil, sourceError(ctx, rawURL, err)
+	}
+	filename := strings.TrimSpace(req.Filename)
+	if filename == "" {
+		filename = path.Base(u.Path)
+	}
+	if filename == "" || filename == "/" || filename == "." {
+		filename = "imported"
+	}
+	if len(filename) > maxReplacementFilename {
+		filename = filename[:maxReplacementFilename]
+	}
+
+	a, err := Store(ctx, &StoreRequest{
+		UserID:    userID,
+		ProjectID: req.ProjectID,
+		Filename:  filename,
+		MimeType:  fetched.mimeType,
+		Data:      fetched.data,
+		AltText:   req.AltText,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO asset_sources (asset_id, url, etag, last_modified, checksum)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5)
+	`, a.ID, rawURL, fetched.etag, fetched.lastModified, fetched.checksum)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record asset source", "asset_id", a.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to import asset",
+		}
+	}
+
+	source, err := getSource(ctx, a.ID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset source", "asset_id", a.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to import asset",
+		}
+	}
+	reqctx.Logger(ctx).Info("asset imported", "asset_id", a.ID, "host", u.Hostname(), "bytes", len(fetched.data))
+	return &ImportAssetResponse{Asset: a, Source: source}, nil
+}
+
+// GetAssetSource returns where an imported asset came from and whether the
+// source has changed since.
+//
+//encore:api auth method=GET path=/assets/:id/source
+func GetAssetSource(ctx context.Context, id string) (*AssetSource, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetView); err != nil {
+		return nil, err
+	}
+	source, err := getSource(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset was not imported from a URL",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset source", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load asset source",
+		}
+	}
+	return source, nil
+}
+
+// RefreshAsset fetches an imported asset's source again and, if the file
+// changed, stores it as a new version of the asset.
+//
+//encore:api auth method=POST path=/assets/:id/source/refresh
+func RefreshAsset(ctx context.Context, id string) (*RefreshAssetResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetUpload); err != nil {
+		return nil, err
+	}
+	source, err := getSource(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset was not imported from a URL",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset source", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to refresh asset",
+		}
+	}
+	a, _, err := getAsset(ctx, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+
+	fetched, err := fetchSource(ctx, source.URL, "", "")
+	if err != nil {
+		recordCheckFailure(ctx, id, err)
+		return nil, sourceError(ctx, source.URL, err)
+	}
+	resp := &RefreshAssetResponse{Asset: a}
+	var current string
+	if err := db.QueryRow(ctx, `SELECT checksum FROM asset_sources WHERE asset_id = $1`, id).Scan(&current); err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset source", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to refresh asset",
+		}
+	}
+	if fetched.checksum != current {
+		if resp.Asset, err = replace(ctx, a, fetched.data, fetched.mimeType, a.OriginalFilename, 0); err != nil {
+			return nil, err
+		}
+		resp.Updated = true
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE asset_sources
+		SET etag = NULLIF($2, ''), last_modified = NULLIF($3, ''), checksum = $4,
+			update_available = FALSE, upstream_checksum = NULL, failures = 0, last_error = NULL,
+			checked_at = NOW(), refreshed_at = CASE WHEN $5 THEN NOW() ELSE refreshed_at END
+		WHERE asset_id = $1
+	`, id, fetched.etag, fetched.lastModified, fetched.checksum, resp.Updated)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update asset source", "asset_id", id, "error", err)
+	}
+	if resp.Source, err = getSource(ctx, id); err != nil {
+		reqctx.Logger(ctx).Warn("failed to reload asset source", "asset_id", id, "error", err)
+		resp.Source = source
+	}
+	return resp, nil
+}
+
+// Check imported assets' sources for upstream changes every hour; each
+// source is checked once per SourceRevalidation.Hours.
+var _ = cron.NewJob("revalidate-asset-sources", cron.JobConfig{
+	Title:    "Check imported assets for upstream changes",
+	Every:    1 * cron.Hour,
+	Endpoint: RevalidateAssetSources,
+})
+
+//encore:api private
+func RevalidateAssetSources(ctx context.Context) error {
+	hours := sourceCfg.SourceRevalidation.Hours
+	if hours <= 0 {
+		hours = defaultRevalidationHours
+	}
+	rows, err := db.Query(ctx, `
+		SELECT s.asset_id, s.url, COALESCE(s.etag, ''), COALESCE(s.last_modified, ''), s.checksum,
+			COALESCE(s.upstream_checksum, ''), a.user_id, a.original_filename
+		FROM asset_sources s
+		JOIN assets a ON a.id = s.asset_id
+		WHERE s.checked_at < NOW() - $1 * INTERVAL '1 hour'
+		ORDER BY s.checked_at
+		LIMIT $2
+	`, hours, revalidationBatchSize)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find asset sources to check", "error", err)
+		return err
+	}
+	type due struct {
+		assetID, url, etag, lastModified, checksum, upstream, ownerID, filename string
+	}
+	var sources []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.assetID, &d.url, &d.etag, &d.lastModified, &d.checksum, &d.upstream, &d.ownerID, &d.filename); err != nil {
+			rows.Close()
+			return err
+		}
+		sources = append(sources, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, d := range sources {
+		fetched, err := fetchSource(ctx, d.url, d.etag, d.lastModified)
+		if err != nil {
+			recordCheckFailure(ctx, d.assetID, err)
+			continue
+		}
+		if fetched.notModified || fetched.checksum == d.checksum {
+			_, err = db.Exec(ctx, `
+				UPDATE asset_sources
+				SET update_available = FALSE, upstream_checksum = NULL, failures = 0, last_error = NULL, checked_at = NOW()
+				WHERE asset_id = $1
+			`, d.assetID)
+		} else {
+			_, err = db.Exec(ctx, `
+				UPDATE asset_sources
+				SET update_available = TRUE, upstream_checksum = $2, failures = 0, last_error = NULL, checked_at = NOW(),
+					changed_at = CASE WHEN upstream_checksum IS DISTINCT FROM $2 THEN NOW() ELSE changed_at END
+				WHERE asset_id = $1
+			`, d.assetID, fetched.checksum)
+		}
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to update asset source", "asset_id", d.assetID, "error", err)
+			continue
+		}
+		// Notify once per upstream file, not on every check.
+		if !fetched.notModified && fetched.checksum != d.checksum && fetched.checksum != d.upstream {
+			changed++
+			notifySourceChanged(ctx, d.ownerID, d.assetID, d.url, d.filename)
+		}
+	}
+	reqctx.Logger(ctx).Info("asset sources revalidated", "checked", len(sources), "changed", changed)
+	return nil
+}
+
+// fetchedSource is a response from an asset's source
+type fetchedSource struct {
+	notModified  bool
+	data         []byte
+	mimeType     string
+	checksum     string
+	etag         string
+	lastModified string
+}
+
+var errNotImportable = errors.New("source is not an importable file type")
+
+// fetchSource downloads rawURL, conditionally when etag or lastModified
+// are set.
+func fetchSource(ctx context.Context, rawURL, etag, lastModified string) (*fetchedSource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "CanvasAI-AssetImport/1.0")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := importClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return &fetchedSource{notModified: true}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("source returned HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("source returned an empty file")
+	}
+
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	if kind, _, _ := strings.Cut(mimeType, "/"); !importableTypes[kind] {
+		return nil, fmt.Errorf("%w: %s", errNotImportable, mimeType)
+	}
+	sum := sha256.Sum256(data)
+	return &fetchedSource{
+		data:         data,
+		mimeType:     mimeType,
+		checksum:     hex.EncodeToString(sum[:]),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// sourceError maps a failed fetch to the error returned to the caller.
+func sourceError(ctx context.Context, rawURL string, err error) error {
+	switch {
+	case errors.Is(err, outbound.ErrBlockedAddress), errors.Is(err, outbound.ErrHostNotAllowed):
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "URL is not allowed",
+		}
+	case errors.Is(err, outbound.ErrResponseTooLarge):
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Asset must be at most 50MB",
+		}
+	case errors.Is(err, errNotImportable):
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "URL must point to an image, font or video",
+		}
+	}
+	reqctx.Logger(ctx).Warn("failed to fetch asset source", "url", rawURL, "error", err)
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "Could not fetch the URL: " + err.Error(),
+	}
+}
+
+// recordCheckFailure notes a source that could not be fetched. The asset
+// keeps its copy; the failure is shown on the source.
+func recordCheckFailure(ctx context.Context, assetID string, fetchErr error) {
+	_, err := db.Exec(ctx, `
+		UPDATE asset_sources SET failures = failures + 1, last_error = $2, checked_at = NOW()
+		WHERE asset_id = $1
+	`, assetID, fetchErr.Error())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record asset source failure", "asset_id", assetID, "error", err)
+	}
+}
+
+func notifySourceChanged(ctx context.Context, ownerID, assetID, sourceURL, filename string) {
+	data, _ := json.Marshal(map[string]string{"assetId": assetID, "url": sourceURL})
+	err := notification.Send(ctx, &notification.Message{
+		UserID: ownerID,
+		Kind:   "asset.source.changed",
+		Title:  "An imported asset changed at its source",
+		Body:   fmt.Sprintf("%s has a newer version. Refresh it to use the new file.", filename),
+		Link:   canvasrefs.AssetURL(assetID),
+		Data:   data,
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to send asset source notification", "asset_id", assetID, "error", err)
+	}
+}
+
+func getSource(ctx context.Context, assetID string) (*AssetSource, error) {
+	s := &AssetSource{AssetID: assetID}
+	var lastError sql.NullString
+	err := db.QueryRow(ctx, `
+		SELECT url, update_available, failures, last_error, checked_at, changed_at, refreshed_at, created_at
+		FROM asset_sources WHERE asset_id = $1
+	`, assetID).Scan(&s.URL, &s.UpdateAvailable, &s.Failures, &lastError, &s.CheckedAt, &s.ChangedAt, &s.RefreshedAt, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	s.LastError = lastError.String
+	return s, nil
+}
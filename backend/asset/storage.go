@@ -0,0 +1,125 @@
+package asset
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"canvasai/faults"
+)
+
+var secrets struct {
+	MinioAccessKey string
+	MinioSecretKey string
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+var cfg struct {
+	MinioEndpoint string // host:port of the S3-compatible store
+	MinioUseSSL   bool
+	AssetBucket   string
+}
+
+var _ = config.Load(context.Background(), &cfg)
+
+const defaultBucket = "canvasai-assets"
+
+var store struct {
+	once   sync.Once
+	client *minio.Client
+	err    error
+}
+
+// storage returns the object store client for a call about to be made,
+// failing it instead when a storage fault is injected (see faults).
+func storage(ctx context.Context) (*minio.Client, error) {
+	if err := faults.Inject(ctx, faults.Storage); err != nil {
+		return nil, err
+	}
+	store.once.Do(func() {
+		store.client, store.err = minio.New(cfg.MinioEndpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(secrets.MinioAccessKey, secrets.MinioSecretKey, ""),
+			Secure: cfg.MinioUseSSL,
+		})
+	})
+	return store.client, store.err
+}
+
+func bucket() string {
+	if cfg.AssetBucket != "" {
+		return cfg.AssetBucket
+	}
+	return defaultBucket
+}
+
+// objectPath mirrors generate_asset_path in the assets migration.
+func objectPath(userID, filename string) string {
+	ext := strings.ToLower(path.Ext(filename))
+	return "uploads/" + userID + "/" + time.Now().Format("2006/01") + "/" + strings.ReplaceAll(newID(), "-", "") + ext
+}
+
+func putObject(ctx context.Context, key, contentType string, data []byte) error {
+	client, err := storage(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObject(ctx, bucket(), key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	return err
+}
+
+func presignedGetURL(ctx context.Context, key string, expiry time.Duration) (*url.URL, error) {
+	client, err := storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.PresignedGetObject(ctx, bucket(), key, expiry, nil)
+}
+
+func presignedPutURL(ctx context.Context, key string, expiry time.Duration) (*url.URL, error) {
+	client, err := storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.PresignedPutObject(ctx, bucket(), key, expiry)
+}
+
+func statObject(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	client, err := storage(ctx)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return client.StatObject(ctx, bucket(), key, minio.StatObjectOptions{})
+}
+
+func removeObject(ctx context.Context, key string) error {
+	client, err := storage(ctx)
+	if err != nil {
+		return err
+	}
+	return client.RemoveObject(ctx, bucket(), key, minio.RemoveObjectOptions{})
+}
+
+func getObject(ctx context.Context, key string) ([]byte, error) {
+	client, err := storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.GetObject(ctx, bucket(), key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(io.LimitReader(obj, MaxAssetSize+1))
+}
@@ -0,0 +1,130 @@
+package asset
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"encore.dev/beta/errs"
+	"github.com/google/uuid"
+
+	"canvasai/reqctx"
+)
+
+// Direct uploads let clients PUT a file straight to object storage through a
+// presigned URL instead of streaming it through the API. The file lands in a
+// staging area keyed by user and upload ID; the service that requested the
+// upload then consumes it, which validates its size and removes it from
+// staging.
+
+// uploadExpiry is how long a presigned upload URL stays valid.
+const uploadExpiry = 15 * time.Minute
+
+// CreateUploadRequest represents an internal request for a direct upload URL
+type CreateUploadRequest struct {
+	UserID string `json:"userId"`
+}
+
+// Upload is a presigned URL a client can PUT a file to
+type Upload struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ConsumeUploadRequest represents an internal request to claim an upload
+type ConsumeUploadRequest struct {
+	UserID   string `json:"userId"`
+	UploadID string `json:"uploadId"`
+	MaxBytes int64  `json:"maxBytes"`
+}
+
+// UploadData is the contents of a consumed upload
+type UploadData struct {
+	Data        []byte `json:"data"`
+	ContentType string `json:"contentType"` // sniffed from the data
+}
+
+// CreateUpload issues a presigned URL for a direct upload.
+//
+//encore:api private method=POST path=/assets/internal/uploads
+func CreateUpload(ctx context.Context, req *CreateUploadRequest) (*Upload, error) {
+	if req.UserID == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "User is required",
+		}
+	}
+
+	id := uuid.New().String()
+	signed, err := presignedPutURL(ctx, stagingPath(req.UserID, id), uploadExpiry)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to sign upload url", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to create upload",
+		}
+	}
+	return &Upload{
+		ID:        id,
+		URL:       signed.String(),
+		ExpiresAt: time.Now().Add(uploadExpiry),
+	}, nil
+}
+
+// ConsumeUpload reads a completed upload and removes it from staging.
+// Uploads larger than MaxBytes are rejected (and removed) without being read.
+//
+//encore:api private method=POST path=/assets/internal/uploads/consume
+func ConsumeUpload(ctx context.Context, req *ConsumeUploadRequest) (*UploadData, error) {
+	if _, err := uuid.Parse(req.UploadID); err != nil || req.UserID == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid upload",
+		}
+	}
+	maxBytes := req.MaxBytes
+	if maxBytes <= 0 || maxBytes > MaxAssetSize {
+		maxBytes = MaxAssetSize
+	}
+
+	key := stagingPath(req.UserID, req.UploadID)
+	info, err := statObject(ctx, key)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Upload not found",
+		}
+	}
+	defer func() {
+		if err := removeObject(ctx, key); err != nil {
+			reqctx.Logger(ctx).Error("failed to remove staged upload", "upload_id", req.UploadID, "error", err)
+		}
+	}()
+	if info.Size <= 0 || info.Size > maxBytes {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Upload is empty or too large",
+		}
+	}
+
+	data, err := getObject(ctx, key)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read upload", "upload_id", req.UploadID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to read upload",
+		}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Upload is empty or too large",
+		}
+	}
+	return &UploadData{Data: data, ContentType: http.DetectContentType(data)}, nil
+}
+
+func stagingPath(userID, uploadID string) string {
+	return "staging/" + userID + "/" + uploadID
+}
@@ -0,0 +1,589 @@
+package asset
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/cron"
+
+	"canvasai/canvasrefs"
+	"canvasai/permissions"
+	"canvasai/reqctx"
+	"canvasai/webhook"
+)
+
+// Replacing an asset's file keeps the asset ID, so every design that uses
+// it picks up the new file, and keeps the old file as a numbered version
+// that can be restored. Restoring copies the old file into a new version
+// rather than rewinding, so history only grows. Previous versions are
+// purged once there are too many of them or they are too old; their entries
+// stay in the history without a file.
+//
+// Projects follow the current file unless they freeze the asset at a
+// version (see project/links.go), which points their canvas at
+// VersionContent. Editors learn about a replacement from an asset.updated
+// realtime event that the propagation job (propagate.go) sends to every
+// project using the asset. Versions a project has frozen are never purged.
+
+// AssetVersionRetention configures how long previous versions are kept
+type AssetVersionRetention struct {
+	// Keep is the number of previous versions kept per asset. Zero uses the default.
+	Keep int `json:"keep"`
+	// Days a previous version is kept after it was replaced. Zero uses the default.
+	Days int `json:"days"`
+}
+
+var versionCfg struct {
+	VersionRetention AssetVersionRetention
+}
+
+var _ = config.Load(context.Background(), &versionCfg)
+
+const (
+	defaultVersionsKept    = 20
+	defaultVersionDays     = 90
+	versionPurgeBatchSize  = 500
+	maxReplacementFilename = 255
+)
+
+// AssetVersion is a file an asset has had
+type AssetVersion struct {
+	Version    int        `json:"version"`
+	Current    bool       `json:"current"`
+	Filename   string     `json:"filename"`
+	MimeType   string     `json:"mimeType"`
+	FileSize   int64      `json:"fileSize"`
+	Width      *int       `json:"width,omitempty"`
+	Height     *int       `json:"height,omitempty"`
+	Checksum   string     `json:"checksum"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ReplacedAt *time.Time `json:"replacedAt,omitempty"`
+	ReplacedBy *string    `json:"replacedBy,omitempty"`
+	Purged     bool       `json:"purged,omitempty"` // the file is gone and cannot be restored
+}
+
+// ListAssetVersionsResponse represents the list asset versions response
+type ListAssetVersionsResponse struct {
+	Versions []AssetVersion `json:"versions"`
+}
+
+// AssetUploadResponse carries a presigned URL for a replacement file
+type AssetUploadResponse struct {
+	UploadID  string    `json:"uploadId"`
+	UploadURL string    `json:"uploadUrl"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	MaxBytes  int64     `json:"maxBytes"`
+}
+
+// ReplaceAssetRequest represents the replace asset request
+type ReplaceAssetRequest struct {
+	UploadID string `json:"uploadId"`
+	// Filename of the new file; defaults to the current one
+	Filename string `json:"filename,omitempty"`
+}
+
+// CreateAssetUpload issues a presigned URL to upload a replacement file to.
+//
+//encore:api auth method=POST path=/assets/:id/uploads
+func CreateAssetUpload(ctx context.Context, id string) (*AssetUploadResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetUpload); err != nil {
+		return nil, err
+	}
+	upload, err := CreateUpload(ctx, &CreateUploadRequest{UserID: auth.UserID()})
+	if err != nil {
+		return nil, err
+	}
+	return &AssetUploadResponse{
+		UploadID:  upload.ID,
+		UploadURL: upload.URL,
+		ExpiresAt: upload.ExpiresAt,
+		MaxBytes:  MaxAssetSize,
+	}, nil
+}
+
+// ReplaceAsset replaces an asset's file with a completed upload. The
+// previous file is kept as a version. The new file must be of the same kind
+// (an image for an image, and so on) so designs using the asset still work.
+//
+//encore:api auth method=PUT path=/assets/:id
+func ReplaceAsset(ctx context.Context, id string, req *ReplaceAssetRequest) (*Asset, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetUpload); err != nil {
+		return nil, err
+	}
+	if len(req.Filename) > maxReplacementFilename {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Filename must be at most 255 characters",
+		}
+	}
+	a, _, err := getAsset(ctx, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+	upload, err := ConsumeUpload(ctx, &ConsumeUploadRequest{
+		UserID:   auth.UserID(),
+		UploadID: req.UploadID,
+		MaxBytes: MaxAssetSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	filename := strings.TrimSpace(req.Filename)
+	if filename == "" {
+		filename = a.OriginalFilename
+	}
+	return replace(ctx, a, upload.Data, upload.ContentType, filename, 0)
+}
+
+// ListAssetVersions lists an asset's versions, newest first.
+//
+//encore:api auth method=GET path=/assets/:id/versions
+func ListAssetVersions(ctx context.Context, id string) (*ListAssetVersionsResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetView); err != nil {
+		return nil, err
+	}
+
+	current := AssetVersion{Current: true}
+	err := db.QueryRow(ctx, `
+		SELECT version, original_filename, mime_type, file_size, width, height, COALESCE(checksum, ''), COALESCE(version_created_at, created_at)
+		FROM assets WHERE id = $1
+	`, id).Scan(&current.Version, &current.Filename, &current.MimeType, &current.FileSize, &current.Width, &current.Height, &current.Checksum, &current.CreatedAt)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT version, filename, mime_type, file_size, width, height, COALESCE(checksum, ''), created_at, replaced_at, replaced_by, purged_at IS NOT NULL
+		FROM asset_versions WHERE asset_id = $1
+		ORDER BY version DESC
+	`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list asset versions", "asset_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list asset versions",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListAssetVersionsResponse{Versions: []AssetVersion{current}}
+	for rows.Next() {
+		var v AssetVersion
+		var replacedAt time.Time
+		var replacedBy sql.NullString
+		if err := rows.Scan(&v.Version, &v.Filename, &v.MimeType, &v.FileSize, &v.Width, &v.Height, &v.Checksum, &v.CreatedAt, &replacedAt, &replacedBy, &v.Purged); err != nil {
+			reqctx.Logger(ctx).Error("failed to scan asset version", "asset_id", id, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to list asset versions",
+			}
+		}
+		v.ReplacedAt = &replacedAt
+		if replacedBy.Valid {
+			v.ReplacedBy = &replacedBy.String
+		}
+		resp.Versions = append(resp.Versions, v)
+	}
+	return resp, nil
+}
+
+// RestoreAssetVersion makes a previous version's file current again. The
+// restored file becomes a new version; the one it replaces is kept.
+//
+//encore:api auth method=POST path=/assets/:id/versions/:version/restore
+func RestoreAssetVersion(ctx context.Context, id string, version int) (*Asset, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetUpload); err != nil {
+		return nil, err
+	}
+	a, _, err := getAsset(ctx, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+
+	var filename, mimeType, key string
+	var purged bool
+	err = db.QueryRow(ctx, `
+		SELECT filename, mime_type, file_path, purged_at IS NOT NULL
+		FROM asset_versions WHERE asset_id = $1 AND version = $2
+	`, id, version).Scan(&filename, &mimeType, &key, &purged)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Version not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset version", "asset_id", id, "version", version, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to restore version",
+		}
+	}
+	if purged {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "This version's file has been deleted by the retention policy",
+		}
+	}
+
+	data, err := getObject(ctx, key)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read asset version", "asset_id", id, "version", version, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to restore version",
+		}
+	}
+	return replace(ctx, a, data, mimeType, filename, version)
+}
+
+// VersionContent redirects to a short-lived signed URL for one version of
+// an asset's file, current or previous. Projects that froze an asset
+// reference it through this URL.
+//
+//encore:api auth raw method=GET path=/assets/:id/versions/:version/content
+func VersionContent(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := encore.CurrentRequest().PathParams.Get("id")
+	version, err := strconv.Atoi(encore.CurrentRequest().PathParams.Get("version"))
+	if err != nil {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+
+	if err := permissions.Authorize(ctx, permissions.Asset(id), permissions.AssetView); err != nil {
+		http.Error(w, "access denied to this asset", http.StatusForbidden)
+		return
+	}
+
+	key, err := versionFile(ctx, id, version)
+	if err == sql.ErrNoRows {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset version", "asset_id", id, "version", version, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	signed, err := presignedGetURL(ctx, key, 15*time.Minute)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to sign asset url", "asset_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, signed.String(), http.StatusFound)
+}
+
+// ReadVersion returns the contents of one version of an asset, for
+// renderers drawing documents that froze it. Asset describes the current
+// version.
+//
+//encore:api private method=GET path=/assets/internal/:id/versions/:version/data
+func ReadVersion(ctx context.Context, id string, version int) (*AssetData, error) {
+	a, _, err := getAsset(ctx, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	}
+	key, err := versionFile(ctx, id, version)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Version not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset version", "asset_id", id, "version", version, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to read asset",
+		}
+	}
+	data, err := getObject(ctx, key)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read asset", "asset_id", id, "version", version, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to read asset",
+		}
+	}
+	return &AssetData{Asset: a, Data: data}, nil
+}
+
+// versionFile returns the stored file of an asset version that has not been
+// purged, whether it is current or previous.
+func versionFile(ctx context.Context, assetID string, version int) (string, error) {
+	var key string
+	err := db.QueryRow(ctx, `
+		SELECT file_path FROM assets WHERE id = $1 AND version = $2
+		UNION ALL
+		SELECT file_path FROM asset_versions WHERE asset_id = $1 AND version = $2 AND purged_at IS NULL
+	`, assetID, version).Scan(&key)
+	return key, err
+}
+
+// replace stores data as the asset's new file and moves the current one
+// into its history. restoredFrom is the version being restored, if any.
+func replace(ctx context.Context, a *Asset, data []byte, mimeType, filename string, restoredFrom int) (*Asset, error) {
+	kind, _, _ := strings.Cut(a.MimeType, "/")
+	if newKind, _, _ := strings.Cut(mimeType, "/"); newKind != kind {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Replacement must be a file of type " + kind,
+		}
+	}
+	if locked, err := retained(ctx, a.ID); err != nil {
+		reqctx.Logger(ctx).Error("failed to check asset retention", "asset_id", a.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to replace asset",
+		}
+	} else if locked {
+		return nil, errRetained
+	}
+
+	next := &Asset{MimeType: mimeType}
+	describeImage(next, data)
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	key := objectPath(a.UserID, filename)
+	if err := putObject(ctx, key, mimeType, data); err != nil {
+		reqctx.Logger(ctx).Error("failed to upload asset", "asset_id", a.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to store asset",
+		}
+	}
+
+	previous := a.Version
+	if err := swapFile(ctx, a.ID, previous, key, filename, mimeType, int64(len(data)), next, checksum); err != nil {
+		if rmErr := removeObject(ctx, key); rmErr != nil {
+			reqctx.Logger(ctx).Warn("failed to remove unused asset object", "key", key, "error", rmErr)
+		}
+		if err == errVersionConflict {
+			return nil, &errs.Error{
+				Code:    errs.Aborted,
+				Message: "The asset was replaced by someone else, try again",
+			}
+		}
+		reqctx.Logger(ctx).Error("failed to replace asset", "asset_id", a.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to replace asset",
+		}
+	}
+
+	updated, _, err := getAsset(ctx, a.ID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to reload asset", "asset_id", a.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to replace asset",
+		}
+	}
+	reqctx.Logger(ctx).Info("asset replaced", "asset_id", a.ID, "version", updated.Version, "restored_from", restoredFrom)
+	announceUpdate(ctx, updated, previous, restoredFrom)
+	return updated, nil
+}
+
+var errVersionConflict = errors.New("asset version changed")
+
+// swapFile records the current file as a version and points the asset at
+// the new one, provided nobody replaced it since version was read.
+func swapFile(ctx context.Context, assetID string, version int, key, filename, mimeType string, size int64, described *Asset, checksum string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(ctx, `
+		INSERT INTO asset_versions (asset_id, version, filename, mime_type, file_size, file_path, width, height, checksum, blurhash, color_profile, created_at, replaced_by)
+		SELECT id, version, original_filename, mime_type, file_size, file_path, width, height, checksum, blurhash, color_profile, COALESCE(version_created_at, created_at), $3
+		FROM assets WHERE id = $1 AND version = $2
+	`, assetID, version, auth.UserID())
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return errVersionConflict
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE assets
+		SET original_filename = $3, mime_type = $4, file_size = $5, file_path = $6, width = $7, height = $8,
+			checksum = $9, blurhash = NULLIF($10, ''), color_profile = NULLIF($11, ''),
+			version = version + 1, version_created_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND version = $2
+	`, assetID, version, filename, mimeType, size, key, described.Width, described.Height, checksum, described.Blurhash, described.ColorProfile)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// announceUpdate queues the asset.updated realtime events for the projects
+// using an asset and notifies webhooks. Failures are logged: the
+// replacement has already happened.
+func announceUpdate(ctx context.Context, a *Asset, previous, restoredFrom int) {
+	log := reqctx.Logger(ctx)
+	payload := map[string]any{
+		"assetId":         a.ID,
+		"version":         a.Version,
+		"previousVersion": previous,
+		"checksum":        a.Checksum,
+		"url":             canvasrefs.AssetURL(a.ID),
+		"updatedBy":       auth.UserID(),
+	}
+	if restoredFrom > 0 {
+		payload["restoredFrom"] = restoredFrom
+	}
+
+	if err := queueUpdate(ctx, a.ID, payload); err != nil {
+		log.Error("failed to queue asset update", "asset_id", a.ID, "error", err)
+	}
+
+	e := &webhook.Event{Type: webhook.EventAssetUpdated}
+	if a.ProjectID != nil {
+		e.ProjectID = *a.ProjectID
+		payload["projectId"] = *a.ProjectID
+	} else if err := db.QueryRow(ctx, `SELECT COALESCE(org_id::text, '') FROM assets WHERE id = $1`, a.ID).Scan(&e.OrgID); err != nil || e.OrgID == "" {
+		// Personal assets outside a project have no webhooks to notify.
+		return
+	}
+	if err := webhook.Emit(ctx, e, payload); err != nil {
+		log.Error("failed to emit webhook event", "asset_id", a.ID, "error", err)
+	}
+}
+
+// versionKeys returns the stored files of an asset's unpurged versions.
+func versionKeys(ctx context.Context, assetID string) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT file_path FROM asset_versions WHERE asset_id = $1 AND purged_at IS NULL
+	`, assetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// objectShared reports whether a stored file is still used by anything
+// other than removing, the asset or asset version whose file is about to be
+// removed. Copying a project shares the files of the copied assets instead
+// of duplicating them, so a file is only removed once nothing uses it.
+func objectShared(ctx context.Context, key, removing string) (bool, error) {
+	var shared bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM assets WHERE file_path = $1 AND id::text <> $2
+		) OR EXISTS (
+			SELECT 1 FROM asset_versions
+			WHERE file_path = $1 AND purged_at IS NULL AND id::text <> $2 AND asset_id::text <> $2
+		)
+	`, key, removing).Scan(&shared)
+	return shared, err
+}
+
+// Purge previous versions past retention once a day.
+var _ = cron.NewJob("purge-asset-versions", cron.JobConfig{
+	Title:    "Delete previous asset versions past their retention",
+	Every:    24 * cron.Hour,
+	Endpoint: PurgeAssetVersions,
+})
+
+//encore:api private
+func PurgeAssetVersions(ctx context.Context) error {
+	keep, days := versionCfg.VersionRetention.Keep, versionCfg.VersionRetention.Days
+	if keep <= 0 {
+		keep = defaultVersionsKept
+	}
+	if days <= 0 {
+		days = defaultVersionDays
+	}
+	rows, err := db.Query(ctx, `
+		SELECT id, file_path FROM (
+			SELECT id, asset_id, version, file_path, replaced_at,
+				row_number() OVER (PARTITION BY asset_id ORDER BY version DESC) AS rank
+			FROM asset_versions
+			WHERE purged_at IS NULL
+		) v
+		WHERE (rank > $1 OR replaced_at < NOW() - $2 * INTERVAL '1 day')
+			-- Versions a project has frozen stay until it unfreezes them
+			AND NOT EXISTS (
+				SELECT 1 FROM project_asset_links l
+				WHERE l.asset_id = v.asset_id AND l.frozen_version = v.version
+			)
+		ORDER BY replaced_at
+		LIMIT $3
+	`, keep, days, versionPurgeBatchSize)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find expired asset versions", "error", err)
+		return err
+	}
+	type candidate struct{ id, key string }
+	var expired []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.key); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	purged := 0
+	for _, c := range expired {
+		shared, err := objectShared(ctx, c.key, c.id)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to check asset version object use", "version_id", c.id, "error", err)
+			continue
+		}
+		// The file of a copied asset stays in storage while the copy uses it.
+		if !shared {
+			if err := removeObject(ctx, c.key); err != nil {
+				reqctx.Logger(ctx).Error("failed to remove asset version object", "version_id", c.id, "error", err)
+				continue
+			}
+		}
+		if _, err := db.Exec(ctx, `UPDATE asset_versions SET purged_at = NOW() WHERE id = $1`, c.id); err != nil {
+			reqctx.Logger(ctx).Error("failed to mark asset version purged", "version_id", c.id, "error", err)
+			continue
+		}
+		purged++
+	}
+	reqctx.Logger(ctx).Info("purged asset versions", "count", purged)
+	return nil
+}
@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev"
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Personal access tokens let people script against their own account. A key
+// is presented as a bearer token like any other; AuthHandler recognizes it
+// by its prefix. Keys carry OAuth scopes and are confined by the TokenScopes
+// middleware exactly like third-party tokens, optionally to a list of
+// projects, and always expire. Owners are emailed a week before a key
+// expires.
+
+const (
+	apiKeyPrefix = "cai_"
+
+	defaultAPIKeyLifetime = 90 * 24 * time.Hour
+	maxAPIKeyLifetime     = 365 * 24 * time.Hour
+	maxAPIKeyProjects     = 50
+
+	// apiKeyExpiryNotice is how far ahead owners are warned of expiry
+	apiKeyExpiryNotice = 7 * 24 * time.Hour
+	// lastUsedResolution bounds how often last-used tracking writes
+	lastUsedResolution = time.Minute
+)
+
+// APIKey is a personal access token, without its secret
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	// ProjectIDs limits the key to these projects; empty allows every
+	// project the user can access
+	ProjectIDs []string   `json:"projectIds,omitempty"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIP string     `json:"lastUsedIp,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// CreateAPIKeyRequest represents the create API key request
+type CreateAPIKeyRequest struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	ProjectIDs []string `json:"projectIds,omitempty"`
+	// ExpiresAt defaults to 90 days from now and may be at most a year out
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// CreateAPIKeyResponse carries the new key's secret, shown only once
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// ListAPIKeysResponse represents the list API keys response
+type ListAPIKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+//encore:api auth method=POST path=/auth/api-keys
+func CreateAPIKey(ctx context.Context, req *CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 255 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "name must be between 1 and 255 characters"}
+	}
+	if len(req.Scopes) == 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "at least one scope is required"}
+	}
+	for _, s := range req.Scopes {
+		if _, ok := scopeDescriptions[s]; !ok {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "unknown scope " + s}
+		}
+	}
+	if len(req.ProjectIDs) > maxAPIKeyProjects {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("a key can be limited to at most %d projects", maxAPIKeyProjects)}
+	}
+	for _, id := range req.ProjectIDs {
+		if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+			return nil, err
+		}
+	}
+	expiresAt := time.Now().Add(defaultAPIKeyLifetime)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+		if !expiresAt.After(time.Now()) || expiresAt.After(time.Now().Add(maxAPIKeyLifetime)) {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "expiry must be in the future and at most a year away"}
+		}
+	}
+
+	secret, err := newSecretToken()
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	token := apiKeyPrefix + secret
+
+	var projectIDs any
+	if len(req.ProjectIDs) > 0 {
+		projectIDs = req.ProjectIDs
+	}
+	resp := &CreateAPIKeyResponse{
+		APIKey: APIKey{
+			Name:       name,
+			Prefix:     token[:len(apiKeyPrefix)+8],
+			Scopes:     req.Scopes,
+			ProjectIDs: req.ProjectIDs,
+			ExpiresAt:  expiresAt,
+		},
+		Key: token,
+	}
+	err = authdb.QueryRow(ctx, `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, project_ids, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6::uuid[], $7)
+		RETURNING id, created_at
+	`, userID, name, resp.Prefix, hashSecretToken(token), req.Scopes, projectIDs, expiresAt).Scan(&resp.ID, &resp.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create api key", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditAPIKeyCreate, userID, "", true, map[string]string{"keyId": resp.ID, "scope": strings.Join(req.Scopes, " ")})
+	return resp, nil
+}
+
+//encore:api auth method=GET path=/auth/api-keys
+func ListAPIKeys(ctx context.Context) (*ListAPIKeysResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT id, name, prefix, scopes, COALESCE(project_ids::text[], '{}'), expires_at, last_used_at, COALESCE(last_used_ip, ''), created_at
+		FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list api keys", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	resp := &ListAPIKeysResponse{Keys: []APIKey{}}
+	for rows.Next() {
+		var k APIKey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scopes, &k.ProjectIDs, &k.ExpiresAt, &lastUsed, &k.LastUsedIP, &k.CreatedAt); err != nil {
+			continue
+		}
+		if lastUsed.Valid {
+			k.LastUsedAt = &lastUsed.Time
+		}
+		resp.Keys = append(resp.Keys, k)
+	}
+	return resp, nil
+}
+
+// RevokeAPIKey stops a key from working immediately.
+//
+//encore:api auth method=DELETE path=/auth/api-keys/:id
+func RevokeAPIKey(ctx context.Context, id string) error {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	result, err := authdb.Exec(ctx, `
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to revoke api key", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{Code: errs.NotFound, Message: "api key not found"}
+	}
+
+	recordAuthEvent(ctx, AuditAPIKeyRevoke, userID, "", true, map[string]string{"keyId": id})
+	return nil
+}
+
+// APIKeyGrant is what a presented key allows
+type APIKeyGrant struct {
+	ID         string   `json:"id"`
+	UserID     string   `json:"userId"`
+	Email      string   `json:"email"`
+	Scopes     []string `json:"scopes"`
+	ProjectIDs []string `json:"projectIds,omitempty"`
+	// RequestsPerMinute is the key's own rate limit, set by an admin; zero
+	// shares its owner's
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"`
+}
+
+// lookupAPIKey returns the live key matching token. Keys of deactivated
+// accounts stop working along with their sessions.
+func lookupAPIKey(ctx context.Context, token string) (*APIKeyGrant, error) {
+	var g APIKeyGrant
+	err := authdb.QueryRow(ctx, `
+		SELECT k.id, k.user_id, u.email, k.scopes, COALESCE(k.project_ids::text[], '{}'), COALESCE(o.requests_per_minute, 0)
+		FROM api_keys k
+		JOIN users u ON u.id = k.user_id
+		LEFT JOIN api_key_rate_limit_overrides o ON o.api_key_id = k.id
+		WHERE k.key_hash = $1 AND k.revoked_at IS NULL AND k.expires_at > NOW() AND u.deactivated_at IS NULL
+	`, hashSecretToken(token)).Scan(&g.ID, &g.UserID, &g.Email, &g.Scopes, &g.ProjectIDs, &g.RequestsPerMinute)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// touchAPIKey records that a key was used, at most once per
+// lastUsedResolution.
+func touchAPIKey(ctx context.Context, id string) {
+	_, err := authdb.Exec(ctx, `
+		UPDATE api_keys SET last_used_at = NOW(), last_used_ip = NULLIF($2, '')
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - $3 * INTERVAL '1 second')
+	`, id, reqctx.From(ctx).IP, int(lastUsedResolution.Seconds()))
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to record api key use", "key_id", id, "error", err)
+	}
+}
+
+// checkAPIKeyAccess confines a key to the endpoints its scopes allow.
+// Project-limited keys may only call endpoints in projectEndpoints; which
+// project a call acts on is checked where the endpoint resolves it, through
+// the context apiKeyContext returns.
+func checkAPIKeyAccess(g *APIKeyGrant, req *encore.Request) error {
+	required, ok := endpointScopes[req.Service+"."+req.Endpoint]
+	if !ok {
+		return &errs.Error{Code: errs.PermissionDenied, Message: "this endpoint is not available to api keys"}
+	}
+	if !containsString(g.Scopes, required) {
+		return &errs.Error{Code: errs.PermissionDenied, Message: "api key is missing the " + required + " scope"}
+	}
+	if len(g.ProjectIDs) > 0 && !projectEndpoints[req.Service+"."+req.Endpoint] {
+		return &errs.Error{Code: errs.PermissionDenied, Message: "api key is limited to specific projects"}
+	}
+	return nil
+}
+
+// apiKeyContext confines the permission checks of a call made with a
+// project-limited key to the key's projects.
+func apiKeyContext(ctx context.Context, g *APIKeyGrant) context.Context {
+	if len(g.ProjectIDs) == 0 {
+		return ctx
+	}
+	return permissions.WithProjects(ctx, g.ProjectIDs)
+}
+
+// Warn owners of keys about to expire once a day.
+var _ = cron.NewJob("notify-expiring-api-keys", cron.JobConfig{
+	Title:    "Email owners of API keys that expire within a week",
+	Every:    24 * cron.Hour,
+	Endpoint: NotifyExpiringAPIKeys,
+})
+
+//encore:api private
+func NotifyExpiringAPIKeys(ctx context.Context) error {
+	rows, err := authdb.Query(ctx, `
+		UPDATE api_keys k SET expiry_notified_at = NOW()
+		FROM users u
+		WHERE u.id = k.user_id AND k.revoked_at IS NULL AND k.expiry_notified_at IS NULL
+			AND k.expires_at > NOW() AND k.expires_at < NOW() + $1 * INTERVAL '1 second'
+			AND u.deactivated_at IS NULL
+		RETURNING u.email, k.name, k.prefix, k.expires_at
+	`, int(apiKeyExpiryNotice.Seconds()))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find expiring api keys", "error", err)
+		return err
+	}
+
+	type expiring struct {
+		email, name, prefix string
+		expiresAt           time.Time
+	}
+	var keys []expiring
+	for rows.Next() {
+		var k expiring
+		if err := rows.Scan(&k.email, &k.name, &k.prefix, &k.expiresAt); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	rows.Close()
+
+	for _, k := range keys {
+		body := fmt.Sprintf("Your CanvasAI API key %q (%s…) expires on %s.\n\n"+
+			"Scripts using it will stop working then. Create a replacement here:\n%s\n",
+			k.name, k.prefix, k.expiresAt.UTC().Format("January 2, 2006"), frontendLink("/account/api-keys"))
+		if err := sendEmail(ctx, k.email, "Your CanvasAI API key expires soon", body); err != nil {
+			reqctx.Logger(ctx).Error("failed to send api key expiry notice", "error", err)
+		}
+	}
+	reqctx.Logger(ctx).Info("notified owners of expiring api keys", "count", len(keys))
+	return nil
+}
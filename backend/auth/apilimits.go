@@ -0,0 +1,354 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/middleware"
+
+	"canvasai/permissions"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// Authenticated API calls are rate limited per user, with the limit set by
+// the user's plan unless an admin has overridden it. Admins can also give an
+// API key a limit of its own, counted separately from its owner's other
+// calls. Internal services
+// calling with machine tokens get one bucket per service. Every such
+// response reports the caller's state in X-RateLimit-* headers. Like the
+// rest of the ratelimit package the buckets are per instance.
+
+// APIRateLimits sets the requests per minute allowed on each plan. Zero uses
+// the default.
+type APIRateLimits struct {
+	Free int `json:"free"`
+	Pro  int `json:"pro"`
+	Team int `json:"team"`
+	// Service applies to each internal service using machine tokens
+	Service int `json:"service"`
+}
+
+var rateLimitCfg struct {
+	APIRateLimits APIRateLimits
+}
+
+var _ = config.Load(context.Background(), &rateLimitCfg)
+
+const (
+	defaultFreeRateLimit    = 120
+	defaultProRateLimit     = 600
+	defaultTeamRateLimit    = 1200
+	defaultServiceRateLimit = 6000
+
+	// rateLimitCacheTTL is how long a user's limit is reused before the
+	// plan and override are looked up again.
+	rateLimitCacheTTL = time.Minute
+	maxCachedLimits   = 4096
+)
+
+// APIRateLimit is a user's effective API rate limit
+type APIRateLimit struct {
+	UserID            string `json:"user_id"`
+	Plan              string `json:"plan"`
+	RequestsPerMinute int    `json:"requests_per_minute"`
+	Override          bool   `json:"override"`
+}
+
+// APIKeyRateLimit is an API key's effective rate limit
+type APIKeyRateLimit struct {
+	KeyID             string `json:"key_id"`
+	UserID            string `json:"user_id"`
+	RequestsPerMinute int    `json:"requests_per_minute"`
+	// Override is set when the key has a limit of its own rather than
+	// sharing its owner's
+	Override bool `json:"override"`
+}
+
+// SetAPIRateLimitRequest represents the set rate limit override request
+type SetAPIRateLimitRequest struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+type cachedLimit struct {
+	perMinute int
+	expires   time.Time
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[int]*ratelimit.Limiter{} // by requests per minute
+	userLimits = map[string]cachedLimit{}
+)
+
+// APIRateLimit counts each call made with a user token, OAuth token or API
+// key against the user's limit, or the key's own, and reports the result in
+// the response headers.
+//
+//encore:middleware global target=all
+func APIRateLimit(req middleware.Request, next middleware.Next) middleware.Response {
+	user := requestToken(req.Data())
+	if user == nil {
+		return next(req)
+	}
+
+	bucket, perMinute := user.ID, serviceRateLimit()
+	if key := user.APIKey; key != nil && key.RequestsPerMinute > 0 {
+		// A key with a limit of its own does not share its owner's bucket.
+		bucket, perMinute = "apikey:"+key.ID, key.RequestsPerMinute
+	} else if _, ok := serviceName(user.ID); !ok {
+		var err error
+		perMinute, err = userRateLimit(req.Context(), user.ID)
+		if err != nil {
+			// Never turn a database hiccup into an outage.
+			reqctx.Logger(req.Context()).Warn("failed to load api rate limit", "user_id", user.ID, "error", err)
+			return next(req)
+		}
+	}
+	st := limiterFor(perMinute).Take(bucket)
+
+	var resp middleware.Response
+	if st.Allowed {
+		resp = next(req)
+	} else {
+		resp = middleware.Response{Err: &errs.Error{Code: errs.ResourceExhausted, Message: "rate limit exceeded"}}
+		resp.Header().Set("Retry-After", strconv.Itoa(int(st.RetryAfter.Seconds())+1))
+	}
+	resp.Header().Set("X-RateLimit-Limit", strconv.Itoa(st.Limit))
+	resp.Header().Set("X-RateLimit-Remaining", strconv.Itoa(st.Remaining))
+	resp.Header().Set("X-RateLimit-Reset", strconv.FormatInt(st.Reset.Unix(), 10))
+	return resp
+}
+
+//encore:api auth method=GET path=/admin/rate-limits/:userID
+func GetAPIRateLimit(ctx context.Context, userID string) (*APIRateLimit, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	return loadAPIRateLimit(ctx, userID)
+}
+
+// SetAPIRateLimit overrides a user's plan limit.
+//
+//encore:api auth method=PUT path=/admin/rate-limits/:userID
+func SetAPIRateLimit(ctx context.Context, userID string, req *SetAPIRateLimitRequest) (*APIRateLimit, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	if req.RequestsPerMinute <= 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "requests_per_minute must be positive"}
+	}
+
+	_, err := authdb.Exec(ctx, `
+		INSERT INTO api_rate_limit_overrides (user_id, requests_per_minute, set_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET requests_per_minute = EXCLUDED.requests_per_minute, set_by = EXCLUDED.set_by, updated_at = NOW()
+	`, userID, req.RequestsPerMinute, encoreauth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to set api rate limit", "user_id", userID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	forgetRateLimit(userID)
+	reqctx.Logger(ctx).Info("api rate limit override set", "user_id", userID, "requests_per_minute", req.RequestsPerMinute)
+	return loadAPIRateLimit(ctx, userID)
+}
+
+// DeleteAPIRateLimit removes an override, restoring the plan limit.
+//
+//encore:api auth method=DELETE path=/admin/rate-limits/:userID
+func DeleteAPIRateLimit(ctx context.Context, userID string) (*APIRateLimit, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	if _, err := authdb.Exec(ctx, `DELETE FROM api_rate_limit_overrides WHERE user_id = $1`, userID); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete api rate limit", "user_id", userID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	forgetRateLimit(userID)
+	return loadAPIRateLimit(ctx, userID)
+}
+
+//encore:api auth method=GET path=/admin/api-keys/:keyID/rate-limit
+func GetAPIKeyRateLimit(ctx context.Context, keyID string) (*APIKeyRateLimit, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	return loadAPIKeyRateLimit(ctx, keyID)
+}
+
+// SetAPIKeyRateLimit gives an API key a limit of its own.
+//
+//encore:api auth method=PUT path=/admin/api-keys/:keyID/rate-limit
+func SetAPIKeyRateLimit(ctx context.Context, keyID string, req *SetAPIRateLimitRequest) (*APIKeyRateLimit, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	if req.RequestsPerMinute <= 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "requests_per_minute must be positive"}
+	}
+
+	_, err := authdb.Exec(ctx, `
+		INSERT INTO api_key_rate_limit_overrides (api_key_id, requests_per_minute, set_by)
+		SELECT id, $2, $3 FROM api_keys WHERE id = $1
+		ON CONFLICT (api_key_id) DO UPDATE
+		SET requests_per_minute = EXCLUDED.requests_per_minute, set_by = EXCLUDED.set_by, updated_at = NOW()
+	`, keyID, req.RequestsPerMinute, encoreauth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to set api key rate limit", "key_id", keyID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	reqctx.Logger(ctx).Info("api key rate limit override set", "key_id", keyID, "requests_per_minute", req.RequestsPerMinute)
+	return loadAPIKeyRateLimit(ctx, keyID)
+}
+
+// DeleteAPIKeyRateLimit removes a key's own limit, so it shares its owner's
+// again.
+//
+//encore:api auth method=DELETE path=/admin/api-keys/:keyID/rate-limit
+func DeleteAPIKeyRateLimit(ctx context.Context, keyID string) (*APIKeyRateLimit, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	if _, err := authdb.Exec(ctx, `DELETE FROM api_key_rate_limit_overrides WHERE api_key_id = $1`, keyID); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete api key rate limit", "key_id", keyID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	return loadAPIKeyRateLimit(ctx, keyID)
+}
+
+func loadAPIRateLimit(ctx context.Context, userID string) (*APIRateLimit, error) {
+	limit := &APIRateLimit{UserID: userID}
+	var err error
+	limit.Plan, limit.RequestsPerMinute, limit.Override, err = queryRateLimit(ctx, userID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load api rate limit", "user_id", userID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	return limit, nil
+}
+
+func loadAPIKeyRateLimit(ctx context.Context, keyID string) (*APIKeyRateLimit, error) {
+	limit := &APIKeyRateLimit{KeyID: keyID}
+	var override sql.NullInt64
+	err := authdb.QueryRow(ctx, `
+		SELECT k.user_id, o.requests_per_minute
+		FROM api_keys k
+		LEFT JOIN api_key_rate_limit_overrides o ON o.api_key_id = k.id
+		WHERE k.id = $1
+	`, keyID).Scan(&limit.UserID, &override)
+	if err == nil && !override.Valid {
+		_, limit.RequestsPerMinute, _, err = queryRateLimit(ctx, limit.UserID)
+	}
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "api key not found"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load api key rate limit", "key_id", keyID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if override.Valid {
+		limit.RequestsPerMinute, limit.Override = int(override.Int64), true
+	}
+	return limit, nil
+}
+
+// userRateLimit returns the requests per minute allowed for userID, cached
+// for rateLimitCacheTTL.
+func userRateLimit(ctx context.Context, userID string) (int, error) {
+	now := time.Now()
+	limitersMu.Lock()
+	cached, ok := userLimits[userID]
+	limitersMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.perMinute, nil
+	}
+
+	_, perMinute, _, err := queryRateLimit(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	limitersMu.Lock()
+	if len(userLimits) >= maxCachedLimits {
+		userLimits = map[string]cachedLimit{}
+	}
+	userLimits[userID] = cachedLimit{perMinute: perMinute, expires: now.Add(rateLimitCacheTTL)}
+	limitersMu.Unlock()
+	return perMinute, nil
+}
+
+// queryRateLimit returns a user's plan and effective limit, and whether
+// the limit comes from an override.
+func queryRateLimit(ctx context.Context, userID string) (string, int, bool, error) {
+	var plan string
+	var override sql.NullInt64
+	err := authdb.QueryRow(ctx, `
+		SELECT u.plan, o.requests_per_minute
+		FROM users u
+		LEFT JOIN api_rate_limit_overrides o ON o.user_id = u.id
+		WHERE u.id = $1
+	`, userID).Scan(&plan, &override)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if override.Valid {
+		return plan, int(override.Int64), true, nil
+	}
+	return plan, planRateLimit(plan), false, nil
+}
+
+// limiterFor returns the shared limiter for a requests-per-minute tier.
+func limiterFor(perMinute int) *ratelimit.Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[perMinute]
+	if !ok {
+		l = ratelimit.New(ratelimit.Limit{Requests: perMinute, Per: time.Minute})
+		limiters[perMinute] = l
+	}
+	return l
+}
+
+func forgetRateLimit(userID string) {
+	limitersMu.Lock()
+	delete(userLimits, userID)
+	limitersMu.Unlock()
+}
+
+func serviceRateLimit() int {
+	if limit := rateLimitCfg.APIRateLimits.Service; limit > 0 {
+		return limit
+	}
+	return defaultServiceRateLimit
+}
+
+func planRateLimit(plan string) int {
+	limits := rateLimitCfg.APIRateLimits
+	switch plan {
+	case "pro":
+		if limits.Pro > 0 {
+			return limits.Pro
+		}
+		return defaultProRateLimit
+	case "team":
+		if limits.Team > 0 {
+			return limits.Team
+		}
+		return defaultTeamRateLimit
+	default:
+		if limits.Free > 0 {
+			return limits.Free
+		}
+		return defaultFreeRateLimit
+	}
+}
@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Security events recorded in the auth audit log
+const (
+	AuditSignup         = "signup"
+	AuditLoginSuccess   = "login.success"
+	AuditLoginFailure   = "login.failure"
+	AuditSSOLogin       = "sso.login"
+	AuditTokenRefresh   = "token.refresh"
+	AuditPasswordChange = "password.change"
+	AuditTwoFAEnable    = "2fa.enable"
+	AuditTwoFADisable   = "2fa.disable"
+	AuditAPIKeyCreate   = "api_key.create"
+	AuditAPIKeyRevoke   = "api_key.revoke"
+	AuditGuestCreate    = "guest.create"
+	AuditGuestUpgrade   = "guest.upgrade"
+
+	AuditEmailChangeRequest = "email_change.request"
+	AuditEmailChangeCancel  = "email_change.cancel"
+	AuditEmailChange        = "email.change"
+
+	AuditSuspiciousLogin = "login.suspicious"
+	AuditAccountSecured  = "account.secure"
+	AuditPasswordReset   = "password.reset"
+
+	AuditOAuthAppCreate = "oauth_app.create"
+	AuditOAuthAuthorize = "oauth.authorize"
+	AuditOAuthRevoke    = "oauth.revoke"
+
+	AuditAccountDeactivate = "account.deactivate"
+	AuditAccountReactivate = "account.reactivate"
+
+	AuditImpersonationStart   = "impersonation.start"
+	AuditImpersonationEnd     = "impersonation.end"
+	AuditImpersonatedMutation = "impersonation.mutation"
+
+	AuditIdentityLogin  = "identity.login"
+	AuditIdentityLink   = "identity.link"
+	AuditIdentityUnlink = "identity.unlink"
+
+	AuditScopedTokenCreate = "scoped_token.create"
+
+	AuditLogout = "logout"
+)
+
+// AuditEvent is a single entry in the auth audit log
+type AuditEvent struct {
+	ID        string            `json:"id"`
+	UserID    *string           `json:"userId,omitempty"`
+	Email     string            `json:"email,omitempty"`
+	Event     string            `json:"event"`
+	Success   bool              `json:"success"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// ListAuditRequest represents the self-service audit log request
+type ListAuditRequest struct {
+	Event  string    `query:"event"`
+	Since  time.Time `query:"since"`
+	Until  time.Time `query:"until"`
+	Limit  int       `query:"limit"`
+	Offset int       `query:"offset"`
+}
+
+// AdminListAuditRequest represents the admin audit log request
+type AdminListAuditRequest struct {
+	UserID  string    `query:"userId"`
+	Email   string    `query:"email"`
+	Event   string    `query:"event"`
+	Success string    `query:"success"` // "true", "false" or empty for both
+	IP      string    `query:"ip"`
+	Since   time.Time `query:"since"`
+	Until   time.Time `query:"until"`
+	Limit   int       `query:"limit"`
+	Offset  int       `query:"offset"`
+}
+
+// ListAuditResponse represents a page of audit events
+type ListAuditResponse struct {
+	Events []AuditEvent `json:"events"`
+	Total  int          `json:"total"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+}
+
+// recordAuthEvent appends an event to the audit log. Failures are logged
+// rather than returned so auditing never blocks a sign-in.
+func recordAuthEvent(ctx context.Context, event string, userID, email string, success bool, extra map[string]string) {
+	info := reqctx.From(ctx)
+	meta := info.AuditMetadata()
+	for k, v := range extra {
+		meta[k] = v
+	}
+	metaJSON, _ := json.Marshal(meta)
+
+	var uid any
+	if userID != "" {
+		uid = userID
+	}
+	_, err := authdb.Exec(ctx, `
+		INSERT INTO auth_audit (user_id, email, event, success, ip_address, user_agent, metadata)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7)
+	`, uid, email, event, success, info.IP, info.UserAgent, metaJSON)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record auth event", "event", event, "error", err)
+	}
+}
+
+//encore:api auth method=GET path=/auth/audit
+func ListAuditEvents(ctx context.Context, req *ListAuditRequest) (*ListAuditResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	return queryAuditEvents(ctx, &AdminListAuditRequest{
+		UserID: userID,
+		Event:  req.Event,
+		Since:  req.Since,
+		Until:  req.Until,
+		Limit:  req.Limit,
+		Offset: req.Offset,
+	})
+}
+
+//encore:api auth method=GET path=/admin/auth/audit
+func AdminListAuditEvents(ctx context.Context, req *AdminListAuditRequest) (*ListAuditResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	if req.Success != "" && req.Success != "true" && req.Success != "false" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "success must be true or false"}
+	}
+	return queryAuditEvents(ctx, req)
+}
+
+func queryAuditEvents(ctx context.Context, req *AdminListAuditRequest) (*ListAuditResponse, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	var since, until any
+	if !req.Since.IsZero() {
+		since = req.Since
+	}
+	if !req.Until.IsZero() {
+		until = req.Until
+	}
+	var success any
+	if req.Success != "" {
+		success = req.Success == "true"
+	}
+
+	const filter = `
+		WHERE ($1 = '' OR user_id::text = $1)
+			AND ($2 = '' OR lower(email) = lower($2))
+			AND ($3 = '' OR event = $3)
+			AND ($4::boolean IS NULL OR success = $4)
+			AND ($5 = '' OR ip_address = $5)
+			AND ($6::timestamp IS NULL OR created_at >= $6)
+			AND ($7::timestamp IS NULL OR created_at < $7)
+	`
+	args := []any{req.UserID, req.Email, req.Event, success, req.IP, since, until}
+
+	resp := &ListAuditResponse{Events: []AuditEvent{}, Limit: limit, Offset: offset}
+	if err := authdb.QueryRow(ctx, `SELECT COUNT(*) FROM auth_audit`+filter, args...).Scan(&resp.Total); err != nil {
+		reqctx.Logger(ctx).Error("failed to count audit events", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT id, user_id, COALESCE(email, ''), event, success, COALESCE(ip_address, ''), COALESCE(user_agent, ''), metadata, created_at
+		FROM auth_audit`+filter+`
+		ORDER BY created_at DESC
+		LIMIT $8 OFFSET $9
+	`, append(args, limit, offset)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list audit events", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		var uid sql.NullString
+		var meta []byte
+		if err := rows.Scan(&e.ID, &uid, &e.Email, &e.Event, &e.Success, &e.IP, &e.UserAgent, &meta, &e.CreatedAt); err != nil {
+			continue
+		}
+		if uid.Valid {
+			e.UserID = &uid.String
+		}
+		if len(meta) > 0 {
+			_ = json.Unmarshal(meta, &e.Metadata)
+		}
+		resp.Events = append(resp.Events, e)
+	}
+	return resp, nil
+}
+
+// loginEvents are the audit events shown in a user's login history
+var loginEvents = []string{AuditLoginSuccess, AuditLoginFailure, AuditSSOLogin, AuditIdentityLogin, AuditImpersonationStart}
+
+// LoginHistoryRequest represents the login history request
+type LoginHistoryRequest struct {
+	Limit  int `query:"limit"`
+	Offset int `query:"offset"`
+}
+
+// LoginAttempt is one sign-in to the caller's account
+type LoginAttempt struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Success bool      `json:"success"`
+	IP      string    `json:"ip,omitempty"`
+	Country string    `json:"country,omitempty"`
+	Device  string    `json:"device"`
+	// Reason explains failures, e.g. bad_password
+	Reason string `json:"reason,omitempty"`
+}
+
+// LoginHistoryResponse represents a page of the login history
+type LoginHistoryResponse struct {
+	Attempts []LoginAttempt `json:"attempts"`
+	Total    int            `json:"total"`
+	Limit    int            `json:"limit"`
+	Offset   int            `json:"offset"`
+}
+
+// GetLoginHistory lists recent sign-ins to the caller's account, newest
+// first, including failed attempts and staff impersonation.
+//
+//encore:api auth method=GET path=/auth/login-history
+func GetLoginHistory(ctx context.Context, req *LoginHistoryRequest) (*LoginHistoryResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	resp := &LoginHistoryResponse{Attempts: []LoginAttempt{}, Limit: limit, Offset: offset}
+	err := authdb.QueryRow(ctx, `
+		SELECT COUNT(*) FROM auth_audit WHERE user_id = $1 AND event = ANY($2)
+	`, userID, loginEvents).Scan(&resp.Total)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to count login history", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT event, success, COALESCE(ip_address, ''), COALESCE(user_agent, ''), metadata, created_at
+		FROM auth_audit
+		WHERE user_id = $1 AND event = ANY($2)
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4
+	`, userID, loginEvents, limit, offset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list login history", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a LoginAttempt
+		var userAgent string
+		var meta []byte
+		if err := rows.Scan(&a.Event, &a.Success, &a.IP, &userAgent, &meta, &a.Time); err != nil {
+			continue
+		}
+		a.Device = describeDevice(userAgent)
+		var m map[string]string
+		if len(meta) > 0 && json.Unmarshal(meta, &m) == nil {
+			a.Country = m["country"]
+			if !a.Success {
+				a.Reason = m["reason"]
+			}
+		}
+		resp.Attempts = append(resp.Attempts, a)
+	}
+	return resp, nil
+}
@@ -5,20 +5,23 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
-	"encore.dev/config"
+	"encore.dev"
 	encoreauth "encore.dev/beta/auth"
 	"encore.dev/beta/errs"
-	"encore.dev/rlog"
+	"encore.dev/config"
 	"encore.dev/storage/sqldb"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"canvasai/reqctx"
 )
 
 // User represents a user in the system
@@ -27,15 +30,46 @@ type User struct {
 	Email     string    `json:"email"`
 	Name      string    `json:"name"`
 	Avatar    *string   `json:"avatar,omitempty"`
+	IsGuest   bool      `json:"is_guest,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// AvatarVariants maps pixel sizes ("32", "64", "256") to resized avatars
+	AvatarVariants map[string]string `json:"avatar_variants,omitempty"`
+
+	// Discoverable lists the user's public projects in the gallery
+	Discoverable bool `json:"discoverable"`
+
+	// TokenVersion is embedded in issued tokens; bumping it revokes them
+	TokenVersion int `json:"-"`
+
+	// Deactivated accounts cannot sign in, see deactivation.go
+	Deactivated bool `json:"-"`
 }
 
 // UserClaims represents JWT claims for user authentication
 type UserClaims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
-	Name   string `json:"name"`
+	UserID  string `json:"user_id"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Guest   bool   `json:"guest,omitempty"` // limited account, see guest.go
+	Version int    `json:"ver,omitempty"`   // must match users.token_version
+
+	// Set on OAuth access tokens only, see oauth.go
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+
+	// Restricts the token to these scopes. Set on OAuth access tokens and
+	// scoped tokens, see scopedtokens.go; absent on full session tokens.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Set on impersonation tokens only: the staff admin acting as the user,
+	// see impersonation.go
+	Impersonator string `json:"imp,omitempty"`
+
+	// Set on machine tokens only: the internal service calling, see
+	// machine.go. UserID is then "service:" and the service name.
+	Service string `json:"svc,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -44,6 +78,8 @@ type SignupRequest struct {
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// InviteToken joins the project the person was invited to by email
+	InviteToken string `json:"inviteToken,omitempty"`
 }
 
 // LoginRequest represents the login request payload
@@ -60,24 +96,37 @@ type AuthResponse struct {
 
 // UpdateProfileRequest represents the profile update request
 type UpdateProfileRequest struct {
-	Name   *string `json:"name,omitempty"`
-	Avatar *string `json:"avatar,omitempty"`
+	Name         *string `json:"name,omitempty"`
+	Avatar       *string `json:"avatar,omitempty"`
+	Discoverable *bool   `json:"discoverable,omitempty"`
 }
 
 var (
-	ErrUserExists       = errors.New("user already exists")
+	ErrUserExists         = errors.New("user already exists")
 	ErrInvalidCredentials = errors.New("invalid credentials")
-	ErrUserNotFound     = errors.New("user not found")
-	ErrInvalidToken     = errors.New("invalid token")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidToken       = errors.New("invalid token")
 )
 
 var secrets struct {
-	JWTSecret string
+	JWTSecret           string
+	JWTSigningKeys      string // JSON keyring for rotation, see keys.go
+	SAMLCertificate     string // PEM-encoded service provider certificate
+	SAMLPrivateKey      string // PEM-encoded service provider RSA key
+	SMTPPassword        string // Password for mailCfg.SMTP.Username
+	ChallengeSecret     string // hCaptcha/Turnstile secret, or proof-of-work signing key, see challenge.go
+	ServiceTokenSecrets string // JSON object of internal service name to secret, see machine.go
 }
 
 var _ = config.Load(context.Background(), &secrets)
 
-var authdb = sqldb.NewDatabase("auth", sqldb.DatabaseConfig{ Migrations: "../migrations" })
+var cfg struct {
+	FrontendURL string // Base URL of the web app, used for redirects and emailed links
+}
+
+var _ = config.Load(context.Background(), &cfg)
+
+var authdb = sqldb.NewDatabase("auth", sqldb.DatabaseConfig{Migrations: "../migrations"})
 
 //encore:api public method=POST path=/auth/signup
 func Signup(ctx context.Context, req *SignupRequest) (*AuthResponse, error) {
@@ -85,11 +134,17 @@ func Signup(ctx context.Context, req *SignupRequest) (*AuthResponse, error) {
 	if err := validateSignupRequest(req); err != nil {
 		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
 	}
+	if err := requireChallenge(ctx); err != nil {
+		return nil, err
+	}
+	if err := checkPassword(ctx, req.Password, req.Email, req.Name); err != nil {
+		return nil, err
+	}
 
 	// Check if user already exists
 	existingUser, err := getUserByEmail(ctx, req.Email)
 	if err != nil && err != ErrUserNotFound {
-		rlog.Error("failed to check existing user", "error", err)
+		reqctx.Logger(ctx).Error("failed to check existing user", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 	if existingUser != nil {
@@ -99,7 +154,7 @@ func Signup(ctx context.Context, req *SignupRequest) (*AuthResponse, error) {
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		rlog.Error("failed to hash password", "error", err)
+		reqctx.Logger(ctx).Error("failed to hash password", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
@@ -110,20 +165,27 @@ func Signup(ctx context.Context, req *SignupRequest) (*AuthResponse, error) {
 		Name:      strings.TrimSpace(req.Name),
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+
+		Discoverable: true,
 	}
 
 	if err := createUser(ctx, user, string(hashedPassword)); err != nil {
-		rlog.Error("failed to create user", "error", err)
+		reqctx.Logger(ctx).Error("failed to create user", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
 	// Generate JWT token
 	token, err := generateJWTToken(user)
 	if err != nil {
-		rlog.Error("failed to generate token", "error", err)
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
+	recordAuthEvent(ctx, AuditSignup, user.ID, user.Email, true, nil)
+	if _, err := Signups.Publish(ctx, &SignupEvent{UserID: user.ID, Email: user.Email, InviteToken: req.InviteToken}); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish signup", "error", err)
+	}
+
 	return &AuthResponse{
 		User:  *user,
 		Token: token,
@@ -141,31 +203,40 @@ func Login(ctx context.Context, req *LoginRequest) (*AuthResponse, error) {
 	user, err := getUserByEmail(ctx, req.Email)
 	if err != nil {
 		if err == ErrUserNotFound {
+			recordAuthEvent(ctx, AuditLoginFailure, "", req.Email, false, map[string]string{"reason": "unknown_email"})
 			return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid credentials"}
 		}
-		rlog.Error("failed to get user", "error", err)
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
 	// Get user password hash
 	hashedPassword, err := getUserPasswordHash(ctx, user.ID)
 	if err != nil {
-		rlog.Error("failed to get user password", "error", err)
+		reqctx.Logger(ctx).Error("failed to get user password", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)); err != nil {
+		recordAuthEvent(ctx, AuditLoginFailure, user.ID, user.Email, false, map[string]string{"reason": "bad_password"})
 		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid credentials"}
 	}
+	if user.Deactivated {
+		recordAuthEvent(ctx, AuditLoginFailure, user.ID, user.Email, false, map[string]string{"reason": "deactivated"})
+		return nil, errAccountDeactivated
+	}
 
 	// Generate JWT token
 	token, err := generateJWTToken(user)
 	if err != nil {
-		rlog.Error("failed to generate token", "error", err)
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
+	recordAuthEvent(ctx, AuditLoginSuccess, user.ID, user.Email, true, nil)
+	checkLoginFingerprint(ctx, user)
+
 	return &AuthResponse{
 		User:  *user,
 		Token: token,
@@ -184,7 +255,7 @@ func GetProfile(ctx context.Context) (*User, error) {
 		if err == ErrUserNotFound {
 			return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
 		}
-		rlog.Error("failed to get user", "error", err)
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
@@ -203,7 +274,7 @@ func UpdateProfile(ctx context.Context, req *UpdateProfileRequest) (*User, error
 		if err == ErrUserNotFound {
 			return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
 		}
-		rlog.Error("failed to get user", "error", err)
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
@@ -212,12 +283,23 @@ func UpdateProfile(ctx context.Context, req *UpdateProfileRequest) (*User, error
 		user.Name = strings.TrimSpace(*req.Name)
 	}
 	if req.Avatar != nil {
-		user.Avatar = req.Avatar
+		// Avatars are uploaded through POST /auth/avatar; the profile can
+		// only clear them or keep the current one.
+		switch {
+		case *req.Avatar == "":
+			user.Avatar = nil
+			user.AvatarVariants = nil
+		case user.Avatar == nil || *req.Avatar != *user.Avatar:
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "upload avatars with POST /auth/avatar"}
+		}
+	}
+	if req.Discoverable != nil {
+		user.Discoverable = *req.Discoverable
 	}
 	user.UpdatedAt = time.Now()
 
 	if err := updateUser(user); err != nil {
-		rlog.Error("failed to update user", "error", err)
+		reqctx.Logger(ctx).Error("failed to update user", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
@@ -233,19 +315,31 @@ func RefreshToken(ctx context.Context) (*AuthResponse, error) {
 	}
 
 	tokenString := strings.TrimPrefix(authHeader.(string), "Bearer ")
-	
-	// Parse and validate token
-	token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secrets.JWTSecret), nil
-	})
 
-	if err != nil || !token.Valid {
-		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid token"}
+	// Parse and validate token
+	claims, err := parseUserToken(tokenString)
+	if err == nil && claims.ClientID != "" {
+		// OAuth access tokens are renewed through /oauth/token and must
+		// never be traded for an unscoped session token.
+		err = ErrInvalidToken
 	}
-
-	claims, ok := token.Claims.(*UserClaims)
-	if !ok {
-		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid token claims"}
+	if err == nil && claims.Impersonator != "" {
+		// Impersonation sessions end when their token expires.
+		err = ErrInvalidToken
+	}
+	if err == nil && len(claims.Scopes) > 0 {
+		// Scoped tokens are not renewable, and would otherwise come back
+		// with full access.
+		err = ErrInvalidToken
+	}
+	if err == nil {
+		err = checkTokenVersion(ctx, claims)
+	}
+	if err == nil {
+		err = checkRevoked(ctx, claims)
+	}
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid token"}
 	}
 
 	// Get fresh user data
@@ -254,17 +348,19 @@ func RefreshToken(ctx context.Context) (*AuthResponse, error) {
 		if err == ErrUserNotFound {
 			return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
 		}
-		rlog.Error("failed to get user", "error", err)
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
 	// Generate new token
 	newToken, err := generateJWTToken(user)
 	if err != nil {
-		rlog.Error("failed to generate token", "error", err)
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
 		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
 	}
 
+	recordAuthEvent(ctx, AuditTokenRefresh, user.ID, user.Email, true, nil)
+
 	return &AuthResponse{
 		User:  *user,
 		Token: newToken,
@@ -289,9 +385,6 @@ func validateSignupRequest(req *SignupRequest) error {
 	if req.Password == "" {
 		return errors.New("password is required")
 	}
-	if len(req.Password) < 6 {
-		return errors.New("password must be at least 6 characters")
-	}
 	return nil
 }
 
@@ -312,20 +405,22 @@ func isValidEmail(email string) bool {
 
 func generateJWTToken(user *User) (string, error) {
 	claims := UserClaims{
-		UserID: user.ID,
-		Email:  user.Email,
-		Name:   user.Name,
+		UserID:  user.ID,
+		Email:   user.Email,
+		Name:    user.Name,
+		Guest:   user.IsGuest,
+		Version: user.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    "canvasai",
 			Subject:   user.ID,
+			ID:        uuid.New().String(), // lets the token be revoked on logout
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secrets.JWTSecret))
+	return signToken(claims)
 }
 
 // Database operations using Postgres via Encore sqldb
@@ -334,27 +429,34 @@ func createUser(ctx context.Context, user *User, hashedPassword string) error {
 	return err
 }
 
+const userColumns = `id, email, name, avatar, avatar_variants, is_guest, discoverable, token_version, deactivated_at IS NOT NULL, created_at, updated_at`
+
 func getUserByEmail(ctx context.Context, email string) (*User, error) {
-	row := authdb.QueryRow(ctx, `SELECT id, email, name, avatar, created_at, updated_at FROM users WHERE lower(email)=lower($1)`, strings.ToLower(email))
-	var u User
-	var avatar sql.NullString
-	if err := row.Scan(&u.ID, &u.Email, &u.Name, &avatar, &u.CreatedAt, &u.UpdatedAt); err != nil {
-		if err == sql.ErrNoRows { return nil, ErrUserNotFound }
-		return nil, err
-	}
-	if avatar.Valid { u.Avatar = &avatar.String }
-	return &u, nil
+	return scanUser(authdb.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE lower(email)=lower($1)`, strings.ToLower(email)))
 }
 
 func getUserByID(ctx context.Context, id string) (*User, error) {
-	row := authdb.QueryRow(ctx, `SELECT id, email, name, avatar, created_at, updated_at FROM users WHERE id=$1`, id)
+	return scanUser(authdb.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id=$1`, id))
+}
+
+func scanUser(row *sqldb.Row) (*User, error) {
 	var u User
 	var avatar sql.NullString
-	if err := row.Scan(&u.ID, &u.Email, &u.Name, &avatar, &u.CreatedAt, &u.UpdatedAt); err != nil {
-		if err == sql.ErrNoRows { return nil, ErrUserNotFound }
+	var variants []byte
+	if err := row.Scan(&u.ID, &u.Email, &u.Name, &avatar, &variants, &u.IsGuest, &u.Discoverable, &u.TokenVersion, &u.Deactivated, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
-	if avatar.Valid { u.Avatar = &avatar.String }
+	if avatar.Valid {
+		u.Avatar = &avatar.String
+	}
+	if len(variants) > 0 {
+		if err := json.Unmarshal(variants, &u.AvatarVariants); err != nil {
+			return nil, fmt.Errorf("decode avatar variants of user %s: %w", u.ID, err)
+		}
+	}
 	return &u, nil
 }
 
@@ -362,35 +464,93 @@ func getUserPasswordHash(ctx context.Context, userID string) (string, error) {
 	row := authdb.QueryRow(ctx, `SELECT password_hash FROM users WHERE id=$1`, userID)
 	var hash string
 	if err := row.Scan(&hash); err != nil {
-		if err == sql.ErrNoRows { return "", ErrUserNotFound }
+		if err == sql.ErrNoRows {
+			return "", ErrUserNotFound
+		}
 		return "", err
 	}
 	return hash, nil
 }
 
 func updateUser(user *User) error {
-	_, err := authdb.Exec(context.Background(), `UPDATE users SET name=$1, avatar=$2, updated_at=$3 WHERE id=$4`, user.Name, user.Avatar, time.Now(), user.ID)
+	var variants []byte
+	if user.AvatarVariants != nil {
+		variants, _ = json.Marshal(user.AvatarVariants)
+	}
+	_, err := authdb.Exec(context.Background(), `UPDATE users SET name=$1, avatar=$2, avatar_variants=$3, discoverable=$4, updated_at=$5 WHERE id=$6`, user.Name, user.Avatar, variants, user.Discoverable, time.Now(), user.ID)
 	return err
 }
 
+// UserData is the auth data of a request. Besides who is calling it keeps
+// what the bearer token was resolved to, so middleware reads it with
+// requestToken instead of verifying the token again.
+type UserData struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	// Claims are the verified claims of a JWT; nil for API keys
+	Claims *UserClaims `json:"claims,omitempty"`
+	// APIKey is the API key presented; nil for JWTs
+	APIKey *APIKeyGrant `json:"apiKey,omitempty"`
+}
+
 // Auth handler for Encore
-func AuthHandler(ctx context.Context, token string) (encoreauth.UID, *encoreauth.UserData, error) {
-	// Parse JWT token
-	parsedToken, err := jwt.ParseWithClaims(token, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secrets.JWTSecret), nil
-	})
+func AuthHandler(ctx context.Context, token string) (encoreauth.UID, *UserData, error) {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := lookupAPIKey(ctx, token)
+		if err != nil {
+			return "", nil, err
+		}
+		touchAPIKey(ctx, key.ID)
+		return encoreauth.UID(key.UserID), &UserData{
+			ID:     key.UserID,
+			Email:  key.Email,
+			APIKey: key,
+		}, nil
+	}
 
-	if err != nil || !parsedToken.Valid {
+	// Parse JWT token
+	claims, err := parseUserToken(token)
+	if err != nil {
 		return "", nil, err
 	}
-
-	claims, ok := parsedToken.Claims.(*UserClaims)
-	if !ok {
-		return "", nil, errors.New("invalid token claims")
+	if claims.Service != "" {
+		if err := checkServiceToken(claims); err != nil {
+			return "", nil, err
+		}
+		return encoreauth.UID(claims.UserID), &UserData{ID: claims.UserID, Claims: claims}, nil
+	}
+	if err := checkTokenVersion(ctx, claims); err != nil {
+		return "", nil, err
+	}
+	if err := checkRevoked(ctx, claims); err != nil {
+		return "", nil, err
+	}
+	if claims.ClientID != "" {
+		if err := checkOAuthToken(ctx, claims); err != nil {
+			return "", nil, err
+		}
+	}
+	if claims.Impersonator != "" {
+		if err := checkImpersonation(ctx, claims); err != nil {
+			return "", nil, err
+		}
 	}
 
-	return encoreauth.UID(claims.UserID), &encoreauth.UserData{
-		ID:    claims.UserID,
-		Email: claims.Email,
+	return encoreauth.UID(claims.UserID), &UserData{
+		ID:     claims.UserID,
+		Email:  claims.Email,
+		Claims: claims,
 	}, nil
 }
+
+// requestToken returns what AuthHandler resolved the bearer token of an
+// incoming request to, or nil when it has none or it was rejected. Calls
+// between services carry the caller's auth data but no token, so they get
+// nil too and are not checked or counted twice.
+func requestToken(req *encore.Request) *UserData {
+	if req == nil || req.Headers == nil || req.Headers.Get("Authorization") == "" {
+		return nil
+	}
+	data, _ := encoreauth.Data().(*UserData)
+	return data
+}
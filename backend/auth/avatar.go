@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"strconv"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Avatars are uploaded straight to object storage through a presigned URL,
+// then finalised: the image is validated, cropped to a square and stored
+// through the asset service as public PNG variants.
+
+const (
+	maxAvatarBytes     = 5 << 20
+	maxAvatarDimension = 4096
+)
+
+// avatarSizes are the square variants generated for every avatar; the
+// last is the canonical avatar.
+var avatarSizes = []int{32, 64, 256}
+
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// AvatarUploadResponse represents the avatar upload URL response
+type AvatarUploadResponse struct {
+	UploadID  string    `json:"uploadId"`
+	UploadURL string    `json:"uploadUrl"` // PUT the image here
+	ExpiresAt time.Time `json:"expiresAt"`
+	MaxBytes  int       `json:"maxBytes"`
+}
+
+// SetAvatarRequest represents the set avatar request
+type SetAvatarRequest struct {
+	UploadID string `json:"uploadId"`
+}
+
+//encore:api auth method=POST path=/auth/avatar/uploads
+func CreateAvatarUpload(ctx context.Context) (*AvatarUploadResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	upload, err := asset.CreateUpload(ctx, &asset.CreateUploadRequest{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	return &AvatarUploadResponse{
+		UploadID:  upload.ID,
+		UploadURL: upload.URL,
+		ExpiresAt: upload.ExpiresAt,
+		MaxBytes:  maxAvatarBytes,
+	}, nil
+}
+
+// SetAvatar turns a completed upload into the user's avatar.
+//
+//encore:api auth method=POST path=/auth/avatar
+func SetAvatar(ctx context.Context, req *SetAvatarRequest) (*User, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	upload, err := asset.ConsumeUpload(ctx, &asset.ConsumeUploadRequest{
+		UserID:   userID,
+		UploadID: req.UploadID,
+		MaxBytes: maxAvatarBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !avatarTypes[upload.ContentType] {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "avatar must be a PNG, JPEG or GIF image"}
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(upload.Data))
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "avatar image could not be read"}
+	}
+	if cfg.Width > maxAvatarDimension || cfg.Height > maxAvatarDimension {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "avatar must be at most 4096x4096 pixels"}
+	}
+	img, _, err := image.Decode(bytes.NewReader(upload.Data))
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "avatar image could not be read"}
+	}
+
+	variants := map[string]string{}
+	var canonical string
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, render.Thumbnail(img, size)); err != nil {
+			reqctx.Logger(ctx).Error("failed to encode avatar", "error", err)
+			return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+		w, h := size, size
+		stored, err := asset.Store(ctx, &asset.StoreRequest{
+			UserID:   userID,
+			Filename: "avatar-" + strconv.Itoa(size) + ".png",
+			MimeType: "image/png",
+			Data:     buf.Bytes(),
+			Width:    &w,
+			Height:   &h,
+			AltText:  "Avatar",
+			Public:   true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		canonical = canvasrefs.AssetURL(stored.ID)
+		variants[strconv.Itoa(size)] = canonical
+	}
+
+	variantsJSON, _ := json.Marshal(variants)
+	if _, err := authdb.Exec(ctx, `
+		UPDATE users SET avatar = $2, avatar_variants = $3, updated_at = NOW() WHERE id = $1
+	`, userID, canonical, variantsJSON); err != nil {
+		reqctx.Logger(ctx).Error("failed to update avatar", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	return user, nil
+}
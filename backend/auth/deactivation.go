@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"golang.org/x/crypto/bcrypt"
+
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// Deactivating an account signs the user out everywhere, disconnects OAuth
+// apps and blocks sign-in, but keeps every project and asset. The user is
+// hidden from collaborator search and lists, and the projects they own turn
+// read-only for collaborators with their share links paused (enforced by
+// the project service). Following the emailed reactivation link restores
+// everything.
+
+const reactivationLifetime = 30 * 24 * time.Hour
+
+var errAccountDeactivated = &errs.Error{
+	Code:    errs.FailedPrecondition,
+	Message: "account is deactivated; use the link we emailed you, or request a new one, to reactivate it",
+}
+
+var reactivationLimiter = ratelimit.New(ratelimit.Limit{Requests: 3, Per: time.Hour})
+
+// DeactivateAccountRequest represents the deactivation request payload
+type DeactivateAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// RequestReactivationRequest asks for a new reactivation link
+type RequestReactivationRequest struct {
+	Email string `json:"email"`
+}
+
+// ReactivateAccountRequest carries the token from a reactivation link
+type ReactivateAccountRequest struct {
+	Token string `json:"token"`
+}
+
+//encore:api auth method=POST path=/auth/deactivate
+func DeactivateAccount(ctx context.Context, req *DeactivateAccountRequest) error {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return &errs.Error{Code: errs.NotFound, Message: "user not found"}
+		}
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if user.IsGuest {
+		return &errs.Error{Code: errs.FailedPrecondition, Message: "guest accounts cannot be deactivated"}
+	}
+
+	hashedPassword, err := getUserPasswordHash(ctx, user.ID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get user password", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)); err != nil {
+		recordAuthEvent(ctx, AuditAccountDeactivate, user.ID, user.Email, false, map[string]string{"reason": "bad_password"})
+		return &errs.Error{Code: errs.PermissionDenied, Message: "password is incorrect"}
+	}
+
+	token, err := newSecretToken()
+	if err != nil {
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	tx, err := authdb.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(ctx, `
+		UPDATE users
+		SET deactivated_at = NOW(), token_version = token_version + 1,
+			reactivation_token = $2, reactivation_token_expires_at = $3, updated_at = NOW()
+		WHERE id = $1 AND deactivated_at IS NULL
+	`, user.ID, hashSecretToken(token), time.Now().Add(reactivationLifetime))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to deactivate account", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if result.RowsAffected() == 0 {
+		return errAccountDeactivated
+	}
+	if _, err := tx.Exec(ctx, `UPDATE oauth_grants SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, user.ID); err != nil {
+		reqctx.Logger(ctx).Error("failed to revoke oauth grants", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := tx.Commit(); err != nil {
+		reqctx.Logger(ctx).Error("failed to commit deactivation", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditAccountDeactivate, user.ID, user.Email, true, nil)
+	if err := sendReactivationEmail(ctx, user, token); err != nil {
+		reqctx.Logger(ctx).Error("failed to send reactivation email", "error", err)
+	}
+	return nil
+}
+
+// RequestReactivation emails a fresh reactivation link to a deactivated
+// account. It succeeds whether or not the address belongs to one, so it
+// cannot be used to probe for accounts.
+//
+//encore:api public method=POST path=/auth/reactivate/request
+func RequestReactivation(ctx context.Context, req *RequestReactivationRequest) error {
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !isValidEmail(email) {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "invalid email format"}
+	}
+	if err := requireChallenge(ctx); err != nil {
+		return err
+	}
+	if !reactivationLimiter.Allow(email) {
+		return &errs.Error{Code: errs.ResourceExhausted, Message: "too many requests, try again later"}
+	}
+
+	user, err := getUserByEmail(ctx, email)
+	if err == ErrUserNotFound || (err == nil && !user.Deactivated) {
+		return nil
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	token, err := newSecretToken()
+	if err != nil {
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	_, err = authdb.Exec(ctx, `
+		UPDATE users SET reactivation_token = $2, reactivation_token_expires_at = $3
+		WHERE id = $1 AND deactivated_at IS NOT NULL
+	`, user.ID, hashSecretToken(token), time.Now().Add(reactivationLifetime))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to store reactivation token", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := sendReactivationEmail(ctx, user, token); err != nil {
+		reqctx.Logger(ctx).Error("failed to send reactivation email", "error", err)
+		return &errs.Error{Code: errs.Unavailable, Message: "failed to send email, try again later"}
+	}
+	return nil
+}
+
+// ReactivateAccount restores a deactivated account from its emailed link
+// and signs the user in.
+//
+//encore:api public method=POST path=/auth/reactivate
+func ReactivateAccount(ctx context.Context, req *ReactivateAccountRequest) (*AuthResponse, error) {
+	var userID string
+	err := authdb.QueryRow(ctx, `
+		UPDATE users
+		SET deactivated_at = NULL, reactivation_token = NULL, reactivation_token_expires_at = NULL, updated_at = NOW()
+		WHERE reactivation_token = $1 AND reactivation_token_expires_at > NOW() AND deactivated_at IS NOT NULL
+		RETURNING id
+	`, hashSecretToken(req.Token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "reactivation link is invalid or has expired"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to reactivate account", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	token, err := generateJWTToken(user)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditAccountReactivate, user.ID, user.Email, true, nil)
+	checkLoginFingerprint(ctx, user)
+
+	return &AuthResponse{
+		User:  *user,
+		Token: token,
+	}, nil
+}
+
+func sendReactivationEmail(ctx context.Context, user *User, token string) error {
+	body := fmt.Sprintf(`Hi %s,
+
+Your CanvasAI account has been deactivated. Your projects and files are kept safe, but you can't sign in and collaborators can only view the projects you own.
+
+To reactivate your account, follow this link:
+%s
+
+This link expires in 30 days. You can request a new one from the sign-in page at any time.
+`, user.Name, frontendLink("/account/reactivate?token="+url.QueryEscape(token)))
+
+	return sendEmail(ctx, user.Email, "Your CanvasAI account is deactivated", body)
+}
@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"golang.org/x/crypto/bcrypt"
+
+	"canvasai/reqctx"
+)
+
+// Changing the account email sends a link to both the current and the new
+// address. The change is applied only once both links have been followed,
+// so neither a hijacked session nor a typo can move the account on its own.
+// Applying it signs the user out everywhere.
+
+const emailChangeLifetime = 24 * time.Hour
+
+// Email change states
+const (
+	EmailChangePending   = "pending"
+	EmailChangeCompleted = "completed"
+	EmailChangeCancelled = "cancelled"
+)
+
+// ChangeEmailRequest represents the email change request payload
+type ChangeEmailRequest struct {
+	NewEmail string `json:"newEmail"`
+	Password string `json:"password"`
+}
+
+// ChangeEmailResponse represents the email change response
+type ChangeEmailResponse struct {
+	NewEmail  string    `json:"newEmail"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// EmailChangeTokenRequest carries a token from a confirmation link
+type EmailChangeTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// EmailChangeStatus reports the progress of an email change
+type EmailChangeStatus struct {
+	Status       string `json:"status"`
+	OldConfirmed bool   `json:"oldConfirmed"`
+	NewConfirmed bool   `json:"newConfirmed"`
+	Email        string `json:"email"`
+}
+
+//encore:api auth method=POST path=/auth/email/change
+func ChangeEmail(ctx context.Context, req *ChangeEmailRequest) (*ChangeEmailResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	newEmail := strings.ToLower(strings.TrimSpace(req.NewEmail))
+	if !isValidEmail(newEmail) || strings.HasSuffix(newEmail, "@"+guestEmailDomain) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "invalid email format"}
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
+		}
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if user.IsGuest {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "guest accounts must be upgraded first"}
+	}
+	if newEmail == strings.ToLower(user.Email) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "new email must be different"}
+	}
+
+	hashedPassword, err := getUserPasswordHash(ctx, user.ID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get user password", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)); err != nil {
+		recordAuthEvent(ctx, AuditEmailChangeRequest, user.ID, user.Email, false, map[string]string{"reason": "bad_password"})
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "password is incorrect"}
+	}
+
+	existingUser, err := getUserByEmail(ctx, newEmail)
+	if err != nil && err != ErrUserNotFound {
+		reqctx.Logger(ctx).Error("failed to check existing user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if existingUser != nil {
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: "email is already in use"}
+	}
+
+	oldToken, err := newSecretToken()
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	newToken, err := newSecretToken()
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	tx, err := authdb.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer tx.Rollback()
+
+	// Only the latest request counts
+	if _, err := tx.Exec(ctx, `
+		UPDATE email_change_requests SET cancelled_at = NOW()
+		WHERE user_id = $1 AND completed_at IS NULL AND cancelled_at IS NULL
+	`, user.ID); err != nil {
+		reqctx.Logger(ctx).Error("failed to cancel pending email changes", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	expiresAt := time.Now().Add(emailChangeLifetime)
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO email_change_requests (user_id, old_email, new_email, old_token_hash, new_token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, user.ID, user.Email, newEmail, hashSecretToken(oldToken), hashSecretToken(newToken), expiresAt); err != nil {
+		reqctx.Logger(ctx).Error("failed to create email change", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := tx.Commit(); err != nil {
+		reqctx.Logger(ctx).Error("failed to commit email change", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	oldBody := fmt.Sprintf(`Hi %s,
+
+Someone asked to change the email address on your CanvasAI account to %s.
+
+If this was you, confirm the change:
+%s
+
+If it wasn't, cancel it and change your password:
+%s
+
+The change only happens after both the current and the new address confirm it.
+These links expire in 24 hours.
+`, user.Name, newEmail, emailChangeLink("confirm", oldToken), emailChangeLink("cancel", oldToken))
+	newBody := fmt.Sprintf(`Hi %s,
+
+Confirm that you want to use this address for your CanvasAI account:
+%s
+
+The change also needs to be confirmed from %s. This link expires in 24 hours.
+`, user.Name, emailChangeLink("confirm", newToken), user.Email)
+
+	if err := sendEmail(ctx, user.Email, "Confirm your email change", oldBody); err != nil {
+		reqctx.Logger(ctx).Error("failed to send email change notice", "error", err)
+		return nil, &errs.Error{Code: errs.Unavailable, Message: "failed to send confirmation email"}
+	}
+	if err := sendEmail(ctx, newEmail, "Confirm your new email address", newBody); err != nil {
+		reqctx.Logger(ctx).Error("failed to send email change confirmation", "error", err)
+		return nil, &errs.Error{Code: errs.Unavailable, Message: "failed to send confirmation email"}
+	}
+
+	recordAuthEvent(ctx, AuditEmailChangeRequest, user.ID, user.Email, true, map[string]string{"new_email": newEmail})
+
+	return &ChangeEmailResponse{
+		NewEmail:  newEmail,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// ConfirmEmailChange records a confirmation from either address and applies
+// the change once both have confirmed.
+//
+//encore:api public method=POST path=/auth/email/confirm
+func ConfirmEmailChange(ctx context.Context, req *EmailChangeTokenRequest) (*EmailChangeStatus, error) {
+	hash := hashSecretToken(req.Token)
+
+	tx, err := authdb.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer tx.Rollback()
+
+	var id, userID, oldEmail, newEmail, oldHash string
+	var oldConfirmed, newConfirmed sql.NullTime
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, old_email, new_email, old_token_hash, old_confirmed_at, new_confirmed_at
+		FROM email_change_requests
+		WHERE (old_token_hash = $1 OR new_token_hash = $1)
+			AND completed_at IS NULL AND cancelled_at IS NULL AND expires_at > NOW()
+		FOR UPDATE
+	`, hash).Scan(&id, &userID, &oldEmail, &newEmail, &oldHash, &oldConfirmed, &newConfirmed)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "confirmation link is invalid or has expired"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get email change", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	column := "new_confirmed_at"
+	if hash == oldHash {
+		column = "old_confirmed_at"
+		oldConfirmed.Valid = true
+	} else {
+		newConfirmed.Valid = true
+	}
+	if _, err := tx.Exec(ctx, `UPDATE email_change_requests SET `+column+` = COALESCE(`+column+`, NOW()) WHERE id = $1`, id); err != nil {
+		reqctx.Logger(ctx).Error("failed to confirm email change", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	status := &EmailChangeStatus{
+		Status:       EmailChangePending,
+		OldConfirmed: oldConfirmed.Valid,
+		NewConfirmed: newConfirmed.Valid,
+		Email:        oldEmail,
+	}
+	if status.OldConfirmed && status.NewConfirmed {
+		// The address was free when requested but may have been taken since;
+		// the unique index on users.email is the final check.
+		result, err := tx.Exec(ctx, `
+			UPDATE users
+			SET email = $2, email_verified = TRUE, email_verified_at = NOW(),
+				token_version = token_version + 1, updated_at = NOW()
+			WHERE id = $1 AND lower(email) = lower($3)
+		`, userID, newEmail, oldEmail)
+		if err != nil {
+			if existing, _ := getUserByEmail(ctx, newEmail); existing != nil {
+				return nil, &errs.Error{Code: errs.AlreadyExists, Message: "email is already in use"}
+			}
+			reqctx.Logger(ctx).Error("failed to change email", "error", err)
+			return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+		if result.RowsAffected() == 0 {
+			return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "account email has changed since this request"}
+		}
+		if _, err := tx.Exec(ctx, `UPDATE email_change_requests SET completed_at = NOW() WHERE id = $1`, id); err != nil {
+			reqctx.Logger(ctx).Error("failed to complete email change", "error", err)
+			return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+		status.Status = EmailChangeCompleted
+		status.Email = newEmail
+	}
+
+	if err := tx.Commit(); err != nil {
+		reqctx.Logger(ctx).Error("failed to commit email change", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	if status.Status == EmailChangeCompleted {
+		recordAuthEvent(ctx, AuditEmailChange, userID, newEmail, true, map[string]string{"old_email": oldEmail})
+	}
+	return status, nil
+}
+
+// CancelEmailChange lets the current address reject a pending change.
+//
+//encore:api public method=POST path=/auth/email/cancel
+func CancelEmailChange(ctx context.Context, req *EmailChangeTokenRequest) (*EmailChangeStatus, error) {
+	var userID, oldEmail string
+	err := authdb.QueryRow(ctx, `
+		UPDATE email_change_requests SET cancelled_at = NOW()
+		WHERE old_token_hash = $1 AND completed_at IS NULL AND cancelled_at IS NULL
+		RETURNING user_id, old_email
+	`, hashSecretToken(req.Token)).Scan(&userID, &oldEmail)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "confirmation link is invalid or has expired"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to cancel email change", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditEmailChangeCancel, userID, oldEmail, true, nil)
+	return &EmailChangeStatus{Status: EmailChangeCancelled, Email: oldEmail}, nil
+}
+
+func newSecretToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func emailChangeLink(action, token string) string {
+	return frontendLink("/account/email/" + action + "?token=" + url.QueryEscape(token))
+}
@@ -0,0 +1,18 @@
+package auth
+
+import (
+	"encore.dev/pubsub"
+)
+
+// SignupEvent is published when someone creates an account
+type SignupEvent struct {
+	UserID string `json:"userId"`
+	Email  string `json:"email"`
+	// InviteToken is the project invite the account was created from, if any
+	InviteToken string `json:"inviteToken,omitempty"`
+}
+
+// Signups is the topic new accounts are announced on.
+var Signups = pubsub.NewTopic[*SignupEvent]("user-signups", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"canvasai/reqctx"
+)
+
+// Guest accounts are ephemeral users that can try the editor without signing
+// up. They carry a placeholder email that can never log in, are limited to a
+// single private project (enforced by the project service) and are purged
+// once they expire unless upgraded to a full account.
+
+const (
+	guestLifetime    = 7 * 24 * time.Hour
+	guestEmailDomain = "guest.invalid"
+)
+
+// UpgradeGuestRequest represents the guest upgrade request payload
+type UpgradeGuestRequest struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+//encore:api public method=POST path=/auth/guest
+func CreateGuest(ctx context.Context) (*AuthResponse, error) {
+	if err := requireChallenge(ctx); err != nil {
+		return nil, err
+	}
+	hashedPassword, err := randomPasswordHash()
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to hash password", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	id := uuid.New().String()
+	now := time.Now()
+	user := &User{
+		ID:        id,
+		Email:     "guest-" + id + "@" + guestEmailDomain,
+		Name:      "Guest",
+		IsGuest:   true,
+		CreatedAt: now,
+		UpdatedAt: now,
+
+		Discoverable: true,
+	}
+	_, err = authdb.Exec(ctx, `
+		INSERT INTO users (id, email, name, password_hash, is_guest, guest_expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, TRUE, $5, $6, $7)
+	`, user.ID, user.Email, user.Name, hashedPassword, now.Add(guestLifetime), user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create guest", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	token, err := generateJWTToken(user)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditGuestCreate, user.ID, "", true, nil)
+
+	return &AuthResponse{
+		User:  *user,
+		Token: token,
+	}, nil
+}
+
+// UpgradeGuest converts the calling guest into a full account. The user row
+// is updated in place, so projects and assets the guest created stay theirs.
+//
+//encore:api auth method=POST path=/auth/guest/upgrade
+func UpgradeGuest(ctx context.Context, req *UpgradeGuestRequest) (*AuthResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	signup := &SignupRequest{Name: req.Name, Email: req.Email, Password: req.Password}
+	if err := validateSignupRequest(signup); err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	if strings.HasSuffix(strings.ToLower(req.Email), "@"+guestEmailDomain) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "invalid email format"}
+	}
+	if err := checkPassword(ctx, req.Password, req.Email, req.Name); err != nil {
+		return nil, err
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
+		}
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if !user.IsGuest {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "account is not a guest account"}
+	}
+
+	existingUser, err := getUserByEmail(ctx, req.Email)
+	if err != nil && err != ErrUserNotFound {
+		reqctx.Logger(ctx).Error("failed to check existing user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if existingUser != nil {
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: "user already exists"}
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to hash password", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	user.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	user.Name = strings.TrimSpace(req.Name)
+	user.IsGuest = false
+	user.UpdatedAt = time.Now()
+	result, err := authdb.Exec(ctx, `
+		UPDATE users
+		SET email = $2, name = $3, password_hash = $4, is_guest = FALSE, guest_expires_at = NULL, updated_at = $5
+		WHERE id = $1 AND is_guest
+	`, user.ID, user.Email, user.Name, string(hashedPassword), user.UpdatedAt)
+	if err != nil {
+		// The unique index on email catches a signup racing the upgrade.
+		reqctx.Logger(ctx).Error("failed to upgrade guest", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if result.RowsAffected() == 0 {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "account is not a guest account"}
+	}
+
+	token, err := generateJWTToken(user)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditGuestUpgrade, user.ID, user.Email, true, nil)
+
+	return &AuthResponse{
+		User:  *user,
+		Token: token,
+	}, nil
+}
+
+// Purge expired guests daily. Their projects and assets go with them.
+var _ = cron.NewJob("purge-expired-guests", cron.JobConfig{
+	Title:    "Delete expired guest accounts",
+	Every:    24 * cron.Hour,
+	Endpoint: PurgeExpiredGuests,
+})
+
+//encore:api private
+func PurgeExpiredGuests(ctx context.Context) error {
+	result, err := authdb.Exec(ctx, `
+		DELETE FROM users WHERE is_guest AND guest_expires_at < NOW()
+	`)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to purge expired guests", "error", err)
+		return err
+	}
+	reqctx.Logger(ctx).Info("purged expired guests", "count", result.RowsAffected())
+	return nil
+}
@@ -0,0 +1,399 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"github.com/google/uuid"
+
+	"canvasai/outbound"
+	"canvasai/reqctx"
+)
+
+// Users can sign in with external identity providers as well as a
+// password. Each provider account is an identity linked to exactly one
+// user. The first sign-in with an identity that is not linked yet attaches
+// it to the account with the same email, provided the provider has
+// verified that email, so people do not end up with duplicate accounts.
+
+// Identity providers
+const (
+	ProviderGoogle = "google"
+)
+
+// IdentityProviders configures the external identity providers
+type IdentityProviders struct {
+	// GoogleClientID is the OAuth client ID Google ID tokens must be issued to
+	GoogleClientID string
+}
+
+var identityCfg struct {
+	Identity IdentityProviders
+}
+
+var _ = config.Load(context.Background(), &identityCfg)
+
+// Identity is an external account linked to a user
+type Identity struct {
+	ID          string     `json:"id"`
+	Provider    string     `json:"provider"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// IdentityRequest carries a token proving control of a provider account
+type IdentityRequest struct {
+	Provider string `json:"provider"`
+	// IDToken is the provider's signed ID token (an OpenID Connect JWT)
+	IDToken string `json:"id_token"`
+}
+
+// ListIdentitiesResponse represents the list identities response
+type ListIdentitiesResponse struct {
+	Identities []Identity `json:"identities"`
+}
+
+// externalIdentity is what a provider asserts about the signed-in account
+type externalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// identityVerifier validates a provider's ID token
+type identityVerifier func(ctx context.Context, idToken string) (*externalIdentity, error)
+
+var identityVerifiers = map[string]identityVerifier{
+	ProviderGoogle: verifyGoogleIDToken,
+}
+
+// IdentityLogin signs in with a provider account, attaching it to the
+// account with the same verified email or creating a new account.
+//
+//encore:api public method=POST path=/auth/identities/login
+func IdentityLogin(ctx context.Context, req *IdentityRequest) (*AuthResponse, error) {
+	ext, err := verifyIdentity(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := resolveIdentityUser(ctx, ext)
+	if err != nil {
+		return nil, err
+	}
+	if user.Deactivated {
+		recordAuthEvent(ctx, AuditLoginFailure, user.ID, user.Email, false, map[string]string{"reason": "deactivated", "provider": ext.Provider})
+		return nil, errAccountDeactivated
+	}
+
+	token, err := generateJWTToken(user)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditIdentityLogin, user.ID, user.Email, true, map[string]string{"provider": ext.Provider})
+	checkLoginFingerprint(ctx, user)
+
+	return &AuthResponse{
+		User:  *user,
+		Token: token,
+	}, nil
+}
+
+//encore:api auth method=GET path=/auth/identities
+func ListIdentities(ctx context.Context) (*ListIdentitiesResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT id, provider, COALESCE(email, ''), created_at, last_login_at
+		FROM user_identities WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list identities", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	resp := &ListIdentitiesResponse{Identities: []Identity{}}
+	for rows.Next() {
+		var i Identity
+		var lastLogin sql.NullTime
+		if err := rows.Scan(&i.ID, &i.Provider, &i.Email, &i.CreatedAt, &lastLogin); err != nil {
+			continue
+		}
+		if lastLogin.Valid {
+			i.LastLoginAt = &lastLogin.Time
+		}
+		resp.Identities = append(resp.Identities, i)
+	}
+	return resp, nil
+}
+
+// LinkIdentity links a provider account to the caller's account.
+//
+//encore:api auth method=POST path=/auth/identities/link
+func LinkIdentity(ctx context.Context, req *IdentityRequest) (*Identity, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	ext, err := verifyIdentity(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := linkIdentity(ctx, userID, ext)
+	if err == sql.ErrNoRows {
+		var ownerID string
+		if err := authdb.QueryRow(ctx, `
+			SELECT user_id FROM user_identities WHERE provider = $1 AND provider_user_id = $2
+		`, ext.Provider, ext.Subject).Scan(&ownerID); err == nil && ownerID == userID {
+			return nil, &errs.Error{Code: errs.AlreadyExists, Message: "identity is already linked to your account"}
+		}
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: "identity is linked to another account"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to link identity", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditIdentityLink, userID, "", true, map[string]string{"provider": ext.Provider, "identityId": identity.ID})
+	return identity, nil
+}
+
+// UnlinkIdentity removes a linked provider account. The user can still
+// sign in with their password or any other linked identity.
+//
+//encore:api auth method=DELETE path=/auth/identities/:id
+func UnlinkIdentity(ctx context.Context, id string) error {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	var provider string
+	err := authdb.QueryRow(ctx, `
+		DELETE FROM user_identities WHERE id = $1 AND user_id = $2
+		RETURNING provider
+	`, id, userID).Scan(&provider)
+	if err == sql.ErrNoRows {
+		return &errs.Error{Code: errs.NotFound, Message: "identity not found"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to unlink identity", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditIdentityUnlink, userID, "", true, map[string]string{"provider": provider, "identityId": id})
+	return nil
+}
+
+// Helper functions
+
+func verifyIdentity(ctx context.Context, req *IdentityRequest) (*externalIdentity, error) {
+	verify, ok := identityVerifiers[req.Provider]
+	if !ok {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "unsupported identity provider"}
+	}
+	if req.IDToken == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "id_token is required"}
+	}
+	ext, err := verify(ctx, req.IDToken)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("rejected identity token", "provider", req.Provider, "error", err)
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid identity token"}
+	}
+	ext.Provider = req.Provider
+	ext.Email = strings.ToLower(strings.TrimSpace(ext.Email))
+	return ext, nil
+}
+
+// resolveIdentityUser returns the user an identity signs in as. Unknown
+// identities attach to the account with the same email when the provider
+// verified it, and otherwise get a new account.
+func resolveIdentityUser(ctx context.Context, ext *externalIdentity) (*User, error) {
+	var userID string
+	err := authdb.QueryRow(ctx, `
+		UPDATE user_identities SET last_login_at = NOW()
+		WHERE provider = $1 AND provider_user_id = $2
+		RETURNING user_id
+	`, ext.Provider, ext.Subject).Scan(&userID)
+	if err == nil {
+		user, err := getUserByID(ctx, userID)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to get user", "error", err)
+			return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+		return user, nil
+	}
+	if err != sql.ErrNoRows {
+		reqctx.Logger(ctx).Error("failed to look up identity", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	if !isValidEmail(ext.Email) {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "identity provider did not share an email address"}
+	}
+	user, err := getUserByEmail(ctx, ext.Email)
+	if err != nil && err != ErrUserNotFound {
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	merged := user != nil
+	if merged && !ext.EmailVerified {
+		// Without a verified email anyone could claim the account.
+		recordAuthEvent(ctx, AuditLoginFailure, user.ID, user.Email, false, map[string]string{"reason": "unverified_identity_email", "provider": ext.Provider})
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "an account with this email already exists; sign in and link this identity from your settings"}
+	}
+
+	if user == nil {
+		if user, err = createIdentityUser(ctx, ext); err != nil {
+			reqctx.Logger(ctx).Error("failed to create user", "error", err)
+			return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+		recordAuthEvent(ctx, AuditSignup, user.ID, user.Email, true, map[string]string{"provider": ext.Provider})
+	}
+
+	identity, err := linkIdentity(ctx, user.ID, ext)
+	if err == sql.ErrNoRows {
+		// Linked by a concurrent sign-in; use whichever account won.
+		return resolveIdentityUser(ctx, ext)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to link identity", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if merged {
+		recordAuthEvent(ctx, AuditIdentityLink, user.ID, user.Email, true, map[string]string{"provider": ext.Provider, "identityId": identity.ID, "merged": "true"})
+	}
+	return user, nil
+}
+
+// linkIdentity records ext for userID. It returns sql.ErrNoRows when the
+// identity is already linked.
+func linkIdentity(ctx context.Context, userID string, ext *externalIdentity) (*Identity, error) {
+	identity := &Identity{Provider: ext.Provider, Email: ext.Email}
+	now := time.Now()
+	err := authdb.QueryRow(ctx, `
+		INSERT INTO user_identities (user_id, provider, provider_user_id, email, last_login_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		ON CONFLICT (provider, provider_user_id) DO NOTHING
+		RETURNING id, created_at
+	`, userID, ext.Provider, ext.Subject, ext.Email, now).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	identity.LastLoginAt = &now
+	return identity, nil
+}
+
+func createIdentityUser(ctx context.Context, ext *externalIdentity) (*User, error) {
+	name := strings.TrimSpace(ext.Name)
+	if name == "" {
+		name = strings.Split(ext.Email, "@")[0]
+	}
+	user := &User{
+		ID:        uuid.New().String(),
+		Email:     ext.Email,
+		Name:      name,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+
+		Discoverable: true,
+	}
+	if ext.Picture != "" {
+		user.Avatar = &ext.Picture
+	}
+
+	// Identity users sign in through their provider; store an unusable hash.
+	hashedPassword, err := randomPasswordHash()
+	if err != nil {
+		return nil, err
+	}
+	if err := createUser(ctx, user, hashedPassword); err != nil {
+		return nil, err
+	}
+	if ext.EmailVerified {
+		if _, err := authdb.Exec(ctx, `
+			UPDATE users SET email_verified = TRUE, email_verified_at = NOW() WHERE id = $1
+		`, user.ID); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+var googleClient = outbound.NewClient(outbound.Policy{
+	Timeout:          5 * time.Second,
+	MaxResponseBytes: 64 << 10,
+	AllowedHosts:     []string{"oauth2.googleapis.com"},
+})
+
+// verifyGoogleIDToken validates a Google ID token with Google's tokeninfo
+// endpoint and checks it was issued to our client.
+func verifyGoogleIDToken(ctx context.Context, idToken string) (*externalIdentity, error) {
+	clientID := identityCfg.Identity.GoogleClientID
+	if clientID == "" {
+		return nil, fmt.Errorf("google sign-in is not configured")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"https://oauth2.googleapis.com/tokeninfo?id_token="+url.QueryEscape(idToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := googleClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo returned %s", resp.Status)
+	}
+
+	var info struct {
+		Issuer        string `json:"iss"`
+		Audience      string `json:"aud"`
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified string `json:"email_verified"`
+		Name          string `json:"name"`
+		Picture       string `json:"picture"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if info.Audience != clientID {
+		return nil, fmt.Errorf("token issued to another client")
+	}
+	if info.Issuer != "accounts.google.com" && info.Issuer != "https://accounts.google.com" {
+		return nil, fmt.Errorf("unexpected issuer %q", info.Issuer)
+	}
+	if info.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	return &externalIdentity{
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified == "true",
+		Name:          info.Name,
+		Picture:       info.Picture,
+	}, nil
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"encore.dev"
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"github.com/golang-jwt/jwt/v5"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Support staff can sign in as a user to reproduce a problem. The token
+// they get is an ordinary user token that also names the admin (the "imp"
+// claim) and the impersonation session it belongs to. Sessions are short,
+// cannot be refreshed and can be ended early. Every call made under
+// impersonation carries the admin in its request metadata, so auth audit
+// entries are watermarked, and every mutation is recorded on its own.
+
+const impersonationLifetime = 15 * time.Minute
+
+var errImpersonationBlocked = &errs.Error{
+	Code:    errs.PermissionDenied,
+	Message: "not available while impersonating a user",
+}
+
+// impersonationBlocked lists the endpoints an impersonating admin may not
+// call: anything that changes how the user signs in or starts another
+// impersonation.
+var impersonationBlocked = map[string]bool{
+	"auth.ChangePassword":       true,
+	"auth.ChangeEmail":          true,
+	"auth.ConfirmEmailChange":   true,
+	"auth.CancelEmailChange":    true,
+	"auth.DeactivateAccount":    true,
+	"auth.SecureAccount":        true,
+	"auth.ApproveAuthorization": true,
+	"auth.CreateOAuthApp":       true,
+	"auth.CreateAPIKey":         true,
+	"auth.CreateScopedToken":    true,
+	"auth.LinkIdentity":         true,
+	"auth.UnlinkIdentity":       true,
+	"auth.ImpersonateUser":      true,
+}
+
+// ImpersonateRequest represents the impersonation request payload
+type ImpersonateRequest struct {
+	// Reason is kept with the session, e.g. a support ticket reference
+	Reason string `json:"reason"`
+}
+
+// ImpersonateResponse carries the impersonation token
+type ImpersonateResponse struct {
+	SessionID string    `json:"session_id"`
+	User      User      `json:"user"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ImpersonateUser issues a short-lived token that acts as userID.
+//
+//encore:api auth method=POST path=/admin/impersonate/:userID
+func ImpersonateUser(ctx context.Context, userID string, req *ImpersonateRequest) (*ImpersonateResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return nil, err
+	}
+	adminID := encoreauth.UserID()
+
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" || len(reason) > 500 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "a reason of at most 500 characters is required"}
+	}
+	if userID == adminID {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "cannot impersonate yourself"}
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
+		}
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if user.Deactivated {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "account is deactivated"}
+	}
+	admin, err := permissions.IsPlatformAdmin(ctx, authdb, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check platform role", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if admin {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "admins cannot be impersonated"}
+	}
+
+	now := time.Now()
+	resp := &ImpersonateResponse{User: *user, ExpiresAt: now.Add(impersonationLifetime)}
+	err = authdb.QueryRow(ctx, `
+		INSERT INTO impersonation_sessions (admin_id, user_id, reason, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, adminID, userID, reason, resp.ExpiresAt).Scan(&resp.SessionID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create impersonation session", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	resp.Token, err = signToken(UserClaims{
+		UserID:       user.ID,
+		Email:        user.Email,
+		Name:         user.Name,
+		Guest:        user.IsGuest,
+		Version:      user.TokenVersion,
+		Impersonator: adminID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        resp.SessionID,
+			ExpiresAt: jwt.NewNumericDate(resp.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "canvasai",
+			Subject:   user.ID,
+		},
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	// Recorded against both accounts so the user sees it in their own log.
+	recordAuthEvent(ctx, AuditImpersonationStart, adminID, "", true, map[string]string{"sessionId": resp.SessionID, "targetUserId": userID, "reason": reason})
+	recordAuthEvent(ctx, AuditImpersonationStart, userID, user.Email, true, map[string]string{"sessionId": resp.SessionID, "adminId": adminID, "reason": reason})
+	reqctx.Logger(ctx).Info("impersonation started", "session_id", resp.SessionID, "target_user_id", userID)
+	return resp, nil
+}
+
+// EndImpersonation ends the caller's open impersonation sessions for userID
+// ahead of their expiry.
+//
+//encore:api auth method=DELETE path=/admin/impersonate/:userID
+func EndImpersonation(ctx context.Context, userID string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, authdb); err != nil {
+		return err
+	}
+	adminID := encoreauth.UserID()
+
+	result, err := authdb.Exec(ctx, `
+		UPDATE impersonation_sessions SET ended_at = NOW()
+		WHERE admin_id = $1 AND user_id = $2 AND ended_at IS NULL AND expires_at > NOW()
+	`, adminID, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to end impersonation", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{Code: errs.NotFound, Message: "no active impersonation session"}
+	}
+
+	recordAuthEvent(ctx, AuditImpersonationEnd, userID, "", true, map[string]string{"adminId": adminID})
+	return nil
+}
+
+// checkImpersonation rejects impersonation tokens whose session was ended,
+// expired or was started by someone who is no longer an admin.
+func checkImpersonation(ctx context.Context, claims *UserClaims) error {
+	var active bool
+	err := authdb.QueryRow(ctx, `
+		SELECT s.ended_at IS NULL AND s.expires_at > NOW() AND a.role = 'admin'
+		FROM impersonation_sessions s
+		JOIN users a ON a.id = s.admin_id
+		WHERE s.id = $1 AND s.user_id = $2 AND s.admin_id = $3
+	`, claims.ID, claims.UserID, claims.Impersonator).Scan(&active)
+	if err == sql.ErrNoRows {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// impersonationClaims returns the claims of the request's token when it is
+// an impersonation token, or nil for any other request.
+func impersonationClaims(req *encore.Request) *UserClaims {
+	user := requestToken(req)
+	if user == nil || user.Claims == nil || user.Claims.Impersonator == "" {
+		return nil
+	}
+	return user.Claims
+}
+
+// auditImpersonatedCall records a call made under impersonation that may
+// have changed something. Reads are only tagged in the logs.
+func auditImpersonatedCall(ctx context.Context, req *encore.Request, userID string, callErr error) {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	recordAuthEvent(ctx, AuditImpersonatedMutation, userID, "", callErr == nil, map[string]string{
+		"endpoint": req.Service + "." + req.Endpoint,
+		"method":   req.Method,
+		"path":     req.Path,
+	})
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyKeyID identifies tokens signed with the original JWTSecret, which
+// carry no kid header.
+const legacyKeyID = "legacy"
+
+// signingKeyConfig is one entry of the JWTSigningKeys secret. The secret is a
+// JSON array; the first entry signs new tokens and later entries are only
+// accepted for verification until their NotAfter time, which bounds the
+// rotation window.
+type signingKeyConfig struct {
+	KeyID    string     `json:"kid"`
+	Alg      string     `json:"alg"` // HS256 or RS256
+	Key      string     `json:"key"` // HMAC secret or PEM-encoded RSA private key
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+}
+
+// signingKey is a parsed signing key
+type signingKey struct {
+	id       string
+	method   jwt.SigningMethod
+	sign     any
+	verify   any
+	notAfter *time.Time
+}
+
+// JWK is a JSON Web Key as published in the JWKS document
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// JWKS is the public key set other services use to verify tokens
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var (
+	keyringOnce sync.Once
+	keyring     []*signingKey
+	keyringErr  error
+)
+
+// keys returns the configured signing keys, active key first. When no
+// JWTSigningKeys secret is set the legacy JWTSecret is the only key.
+func keys() ([]*signingKey, error) {
+	keyringOnce.Do(func() {
+		keyring, keyringErr = loadSigningKeys()
+	})
+	return keyring, keyringErr
+}
+
+func loadSigningKeys() ([]*signingKey, error) {
+	var ring []*signingKey
+	if secrets.JWTSigningKeys != "" {
+		var configs []signingKeyConfig
+		if err := json.Unmarshal([]byte(secrets.JWTSigningKeys), &configs); err != nil {
+			return nil, fmt.Errorf("parse JWTSigningKeys: %w", err)
+		}
+		for _, c := range configs {
+			k, err := parseSigningKey(c)
+			if err != nil {
+				return nil, fmt.Errorf("signing key %q: %w", c.KeyID, err)
+			}
+			ring = append(ring, k)
+		}
+	}
+	if secrets.JWTSecret != "" {
+		// Keep accepting tokens issued before rotation was configured.
+		secret := []byte(secrets.JWTSecret)
+		ring = append(ring, &signingKey{id: legacyKeyID, method: jwt.SigningMethodHS256, sign: secret, verify: secret})
+	}
+	if len(ring) == 0 {
+		return nil, errors.New("no JWT signing keys configured")
+	}
+	return ring, nil
+}
+
+func parseSigningKey(c signingKeyConfig) (*signingKey, error) {
+	if c.KeyID == "" || c.KeyID == legacyKeyID {
+		return nil, errors.New("kid is required and must not be \"legacy\"")
+	}
+	k := &signingKey{id: c.KeyID, notAfter: c.NotAfter}
+	switch c.Alg {
+	case "HS256":
+		if len(c.Key) < 32 {
+			return nil, errors.New("HS256 keys must be at least 32 bytes")
+		}
+		k.method = jwt.SigningMethodHS256
+		k.sign, k.verify = []byte(c.Key), []byte(c.Key)
+	case "RS256":
+		block, _ := pem.Decode([]byte(c.Key))
+		if block == nil {
+			return nil, errors.New("invalid PEM private key")
+		}
+		priv, err := parseRSAPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		k.method = jwt.SigningMethodRS256
+		k.sign, k.verify = priv, &priv.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", c.Alg)
+	}
+	return k, nil
+}
+
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not RSA")
+	}
+	return key, nil
+}
+
+// signToken signs claims with the active key and stamps its kid.
+func signToken(claims jwt.Claims) (string, error) {
+	ring, err := keys()
+	if err != nil {
+		return "", err
+	}
+	active := ring[0]
+	token := jwt.NewWithClaims(active.method, claims)
+	if active.id != legacyKeyID {
+		token.Header["kid"] = active.id
+	}
+	return token.SignedString(active.sign)
+}
+
+// verificationKey selects the key a token claims to be signed with. The
+// algorithm must match the key's so an RS256 public key can never be used
+// as an HMAC secret.
+func verificationKey(token *jwt.Token) (any, error) {
+	ring, err := keys()
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKeyID
+	}
+	for _, k := range ring {
+		if k.id != kid {
+			continue
+		}
+		if token.Method == nil || token.Method.Alg() != k.method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		if k.notAfter != nil && time.Now().After(*k.notAfter) {
+			return nil, errors.New("signing key has been retired")
+		}
+		return k.verify, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// parseUserToken validates a user token against the current keyring.
+func parseUserToken(tokenString string) (*UserClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, verificationKey,
+		jwt.WithValidMethods([]string{"HS256", "RS256"}))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(*UserClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// JWKS publishes the RS256 public keys so other services can verify tokens
+// without sharing a secret. HMAC keys are never published.
+//
+//encore:api public raw method=GET path=/.well-known/jwks.json
+func JWKSHandler(w http.ResponseWriter, req *http.Request) {
+	ring, err := keys()
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range ring {
+		pub, ok := k.verify.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: "RS256",
+			KeyID:     k.id,
+			N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_ = json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+
+	"canvasai/reqctx"
+)
+
+// Logout revokes the token the request was made with, so it is rejected even
+// if a copy of it was stolen. The user's other sessions stay signed in;
+// changing the password or securing the account ends all of them. Tokens
+// issued before tokens carried an ID cannot be revoked one by one and stay
+// valid until they expire.
+//
+//encore:api auth method=POST path=/auth/logout
+func Logout(ctx context.Context) error {
+	var token string
+	if req := encore.CurrentRequest(); req != nil && req.Headers != nil {
+		token = strings.TrimPrefix(req.Headers.Get("Authorization"), "Bearer ")
+	}
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "api keys are revoked with DELETE /auth/api-keys/:id"}
+	}
+	claims, err := parseUserToken(token)
+	if err != nil {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "invalid token"}
+	}
+
+	if claims.ID != "" {
+		expiresAt := time.Now().Add(24 * time.Hour)
+		if claims.ExpiresAt != nil {
+			expiresAt = claims.ExpiresAt.Time
+		}
+		_, err = authdb.Exec(ctx, `
+			INSERT INTO revoked_tokens (jti, user_id, expires_at) VALUES ($1, $2, $3)
+			ON CONFLICT (jti) DO NOTHING
+		`, claims.ID, claims.UserID, expiresAt)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to revoke token", "error", err)
+			return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+	}
+
+	recordAuthEvent(ctx, AuditLogout, claims.UserID, claims.Email, true, nil)
+	return nil
+}
+
+// checkRevoked rejects tokens that were logged out.
+func checkRevoked(ctx context.Context, claims *UserClaims) error {
+	if claims.ID == "" {
+		return nil
+	}
+	var revoked bool
+	err := authdb.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)`, claims.ID).Scan(&revoked)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Forget revocations once the tokens they cover have expired.
+var _ = cron.NewJob("purge-revoked-tokens", cron.JobConfig{
+	Title:    "Delete revocations of expired tokens",
+	Every:    1 * cron.Hour,
+	Endpoint: PurgeRevokedTokens,
+})
+
+//encore:api private
+func PurgeRevokedTokens(ctx context.Context) error {
+	result, err := authdb.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at < NOW()`)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to purge revoked tokens", "error", err)
+		return err
+	}
+	reqctx.Logger(ctx).Info("purged revoked tokens", "count", result.RowsAffected())
+	return nil
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Internal services (the Python AI service, render workers) call the API
+// with machine tokens: short-lived JWTs that name a service instead of a
+// user. A service trades its deployment secret for one at
+// /auth/service-tokens. AuthHandler gives the token the user ID
+// "service:<name>", which permissions treats as read access to any project
+// or asset; TokenScopes confines it to serviceEndpoints and the scopes the
+// service was granted, so it never reaches account endpoints.
+
+const serviceTokenLifetime = time.Hour
+
+// ScopeEventsWrite lets a service report wide events (see wideevent). Only
+// machine tokens can hold it.
+const ScopeEventsWrite = "events:write"
+
+// machineServices lists the services that may obtain machine tokens and
+// the scopes they may be granted.
+var machineServices = map[string][]string{
+	"ai":     {ScopeAssetsRead, ScopeEventsWrite},
+	"render": {ScopeProjectsRead, ScopeAssetsRead},
+}
+
+// serviceEndpoints are the endpoints machine tokens may call, subject to
+// the scope endpointScopes requires.
+var serviceEndpoints = map[string]bool{
+	"project.GetProject":    true,
+	"asset.GetAsset":        true,
+	"asset.Content":         true,
+	"wideevent.RecordEvent": true,
+}
+
+// IssueServiceTokenRequest represents the machine token request
+type IssueServiceTokenRequest struct {
+	Service string `json:"service"`
+	Secret  string `json:"secret"`
+	// Scopes narrows the token to some of the service's scopes (default all)
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// ServiceTokenResponse carries a machine token
+type ServiceTokenResponse struct {
+	Token     string    `json:"token"`
+	Service   string    `json:"service"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueServiceToken issues a machine token to an internal service that
+// presents its secret from the ServiceTokenSecrets deployment secret.
+// Services request a new token before the old one expires; machine tokens
+// cannot be refreshed or revoked.
+//
+//encore:api public method=POST path=/auth/service-tokens
+func IssueServiceToken(ctx context.Context, req *IssueServiceTokenRequest) (*ServiceTokenResponse, error) {
+	secret, ok := serviceSecret(req.Service)
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(req.Secret)) != 1 {
+		reqctx.Logger(ctx).Warn("service token request rejected", "service", req.Service)
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid service credentials"}
+	}
+	scopes := machineServices[req.Service]
+	if len(req.Scopes) > 0 {
+		for _, s := range req.Scopes {
+			if !containsString(scopes, s) {
+				return nil, &errs.Error{Code: errs.InvalidArgument, Message: "scope " + s + " is not available to " + req.Service}
+			}
+		}
+		scopes = req.Scopes
+	}
+
+	now := time.Now()
+	principal := permissions.ServicePrefix + req.Service
+	resp := &ServiceTokenResponse{Service: req.Service, Scopes: scopes, ExpiresAt: now.Add(serviceTokenLifetime)}
+	var err error
+	resp.Token, err = signToken(UserClaims{
+		UserID:  principal,
+		Service: req.Service,
+		Scopes:  scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(resp.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "canvasai",
+			Subject:   principal,
+			ID:        uuid.New().String(),
+		},
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	reqctx.Logger(ctx).Info("service token issued", "service", req.Service, "scopes", strings.Join(scopes, " "))
+	return resp, nil
+}
+
+// serviceSecret returns a service's issuance secret. ServiceTokenSecrets is
+// a JSON object mapping service names to secrets; services missing from it
+// cannot obtain tokens.
+func serviceSecret(service string) (string, bool) {
+	if _, ok := machineServices[service]; !ok || secrets.ServiceTokenSecrets == "" {
+		return "", false
+	}
+	var byService map[string]string
+	if err := json.Unmarshal([]byte(secrets.ServiceTokenSecrets), &byService); err != nil {
+		return "", false
+	}
+	secret := byService[service]
+	return secret, secret != ""
+}
+
+// checkServiceToken rejects machine tokens for services that were removed
+// or whose scopes were narrowed since the token was issued.
+func checkServiceToken(claims *UserClaims) error {
+	allowed, ok := machineServices[claims.Service]
+	if !ok || claims.UserID != permissions.ServicePrefix+claims.Service || len(claims.Scopes) == 0 {
+		return ErrInvalidToken
+	}
+	for _, s := range claims.Scopes {
+		if !containsString(allowed, s) {
+			return ErrInvalidToken
+		}
+	}
+	return nil
+}
+
+// serviceName returns the service a principal ID names, if it is one.
+func serviceName(userID string) (string, bool) {
+	return strings.CutPrefix(userID, permissions.ServicePrefix)
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/config"
+
+	"canvasai/reqctx"
+)
+
+// mailCfg configures outgoing transactional email. When Host is empty
+// messages are logged instead of sent, which is the local development setup.
+var mailCfg struct {
+	SMTP struct {
+		Host     string
+		Port     int // defaults to 587
+		Username string
+		From     string // e.g. "CanvasAI <no-reply@canvasai.com>"
+	}
+}
+
+var _ = config.Load(context.Background(), &mailCfg)
+
+// sendEmail delivers a plain-text email.
+func sendEmail(ctx context.Context, to, subject, body string) error {
+	c := mailCfg.SMTP
+	if c.Host == "" {
+		reqctx.Logger(ctx).Warn("smtp not configured, email not sent", "to", to, "subject", subject)
+		return nil
+	}
+	port := c.Port
+	if port == 0 {
+		port = 587
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, secrets.SMTPPassword, c.Host)
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	if err := smtp.SendMail(addr, auth, envelopeAddress(c.From), []string{to}, []byte(msg.String())); err != nil {
+		return fmt.Errorf("send email: %w", err)
+	}
+	return nil
+}
+
+// envelopeAddress extracts the bare address from a "Name <addr>" header.
+func envelopeAddress(from string) string {
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return from
+}
+
+// frontendLink builds a link into the web app.
+func frontendLink(path string) string {
+	return strings.TrimRight(cfg.FrontendURL, "/") + path
+}
+
+// SendEmailRequest is an internal request to send a transactional email
+type SendEmailRequest struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	// Body is plain text. Each "{link}" in it is replaced with the web app
+	// URL for LinkPath.
+	Body     string `json:"body"`
+	LinkPath string `json:"linkPath,omitempty"`
+}
+
+// SendEmail sends a transactional email on behalf of another service, so
+// mail settings and web app links live in one place.
+//
+//encore:api private method=POST path=/auth/internal/email
+func SendEmail(ctx context.Context, req *SendEmailRequest) error {
+	body := req.Body
+	if req.LinkPath != "" {
+		body = strings.ReplaceAll(body, "{link}", frontendLink(req.LinkPath))
+	}
+	return sendEmail(ctx, req.To, req.Subject, body)
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"encore.dev/middleware"
+
+	"canvasai/reqctx"
+)
+
+// RequestContext attaches request metadata to every API call so downstream
+// services and log lines share the same request ID. Calls made with an
+// impersonation token are tagged with the acting admin and audited; calls
+// made with a machine token are tagged with the calling service.
+//
+//encore:middleware global target=all
+func RequestContext(req middleware.Request, next middleware.Next) middleware.Response {
+	info := reqctx.FromRequest(req.Data())
+	imp := impersonationClaims(req.Data())
+	if imp != nil {
+		if impersonationBlocked[req.Data().Service+"."+req.Data().Endpoint] {
+			return middleware.Response{Err: errImpersonationBlocked}
+		}
+		info.ImpersonatorID = imp.Impersonator
+	}
+	if name, ok := serviceName(info.UserID); ok {
+		info.Service = name
+	}
+	ctx := reqctx.With(req.Context(), info)
+	resp := next(req.WithContext(ctx))
+	if imp != nil {
+		auditImpersonatedCall(ctx, req.Data(), imp.UserID, resp.Err)
+	}
+	resp.Header().Set(reqctx.HeaderRequestID, info.RequestID)
+	return resp
+}
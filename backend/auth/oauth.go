@@ -0,0 +1,674 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/middleware"
+
+	"canvasai/reqctx"
+)
+
+// CanvasAI acts as an OAuth2 provider so plugins and integrations can work
+// on a user's behalf. Apps use the authorization code flow with PKCE: the
+// web app fetches consent screen data from GET /oauth/authorize, posts the
+// user's decision back and follows the returned redirect. The app then
+// trades the code for an access/refresh token pair at /oauth/token (see
+// oauthtoken.go).
+//
+// Access tokens are regular user JWTs carrying a scope and client_id, so
+// AuthHandler accepts them everywhere. The TokenScopes middleware then only
+// lets them reach endpoints listed in endpointScopes, and only when the
+// token was granted the scope that endpoint requires.
+
+const oauthCodeLifetime = 10 * time.Minute
+
+// Scopes third-party apps can request
+const (
+	ScopeProfileRead   = "profile:read"
+	ScopeProjectsRead  = "projects:read"
+	ScopeProjectsWrite = "projects:write"
+	ScopeAssetsRead    = "assets:read"
+	ScopeCommentsWrite = "comments:write"
+)
+
+// scopeDescriptions are shown to the user on the consent screen
+var scopeDescriptions = map[string]string{
+	ScopeProfileRead:   "See your name, email address and avatar",
+	ScopeProjectsRead:  "See and export your projects",
+	ScopeProjectsWrite: "Create, import and edit your projects",
+	ScopeAssetsRead:    "See images and files in your projects",
+	ScopeCommentsWrite: "Add, resolve and reopen comments",
+}
+
+// endpointScopes lists the endpoints OAuth access tokens may call and the
+// scope each requires. Anything not listed, including all account and
+// OAuth management endpoints, is off limits to third-party apps.
+var endpointScopes = map[string]string{
+	"auth.GetProfile": ScopeProfileRead,
+
+	"project.ListProjects":        ScopeProjectsRead,
+	"project.SearchProjects":      ScopeProjectsRead,
+	"project.GetProject":          ScopeProjectsRead,
+	"project.AnalyzeProjectSize":  ScopeProjectsRead,
+	"project.GetPrefetchManifest": ScopeProjectsRead,
+	"project.ListLinkedAssets":    ScopeProjectsRead,
+	"project.ListProjectVersions": ScopeProjectsRead,
+	"project.GetProjectVersion":   ScopeProjectsRead,
+	"project.ResolveSlug":         ScopeProjectsRead,
+	"export.CreateExport":         ScopeProjectsRead,
+	"export.ListExports":          ScopeProjectsRead,
+	"export.GetExport":            ScopeProjectsRead,
+
+	"project.CreateProject":         ScopeProjectsWrite,
+	"project.UpdateProject":         ScopeProjectsWrite,
+	"project.ImportProject":         ScopeProjectsWrite,
+	"project.DuplicateProject":      ScopeProjectsWrite,
+	"project.ForkProject":           ScopeProjectsWrite,
+	"project.RenameSlug":            ScopeProjectsWrite,
+	"project.SetAssetLink":          ScopeProjectsWrite,
+	"project.CreateProjectVersion":  ScopeProjectsWrite,
+	"project.RestoreProjectVersion": ScopeProjectsWrite,
+
+	"asset.GetAsset": ScopeAssetsRead,
+	"asset.Content":  ScopeAssetsRead,
+
+	"comment.CreateComment":  ScopeCommentsWrite,
+	"comment.ResolveComment": ScopeCommentsWrite,
+	"comment.ReopenComment":  ScopeCommentsWrite,
+
+	"wideevent.RecordEvent": ScopeEventsWrite,
+}
+
+// projectEndpoints are the endpoints in endpointScopes that act on a single
+// project and authorize it, so project-limited API keys may call them.
+var projectEndpoints = map[string]bool{
+	"project.GetProject":            true,
+	"project.AnalyzeProjectSize":    true,
+	"project.GetPrefetchManifest":   true,
+	"project.ListLinkedAssets":      true,
+	"project.ListProjectVersions":   true,
+	"project.GetProjectVersion":     true,
+	"project.ResolveSlug":           true,
+	"export.CreateExport":           true,
+	"export.ListExports":            true,
+	"project.UpdateProject":         true,
+	"project.DuplicateProject":      true,
+	"project.RenameSlug":            true,
+	"project.SetAssetLink":          true,
+	"project.CreateProjectVersion":  true,
+	"project.RestoreProjectVersion": true,
+	"comment.CreateComment":         true,
+	"comment.ResolveComment":        true,
+	"comment.ReopenComment":         true,
+}
+
+// OAuthApp is a third-party app registered to use CanvasAI's API
+type OAuthApp struct {
+	ID           string    `json:"id"`
+	ClientID     string    `json:"clientId"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description,omitempty"`
+	HomepageURL  string    `json:"homepageUrl,omitempty"`
+	LogoURL      string    `json:"logoUrl,omitempty"`
+	RedirectURIs []string  `json:"redirectUris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"` // has a client secret
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// CreateOAuthAppRequest represents the app registration payload
+type CreateOAuthAppRequest struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	HomepageURL  string   `json:"homepageUrl,omitempty"`
+	LogoURL      string   `json:"logoUrl,omitempty"`
+	RedirectURIs []string `json:"redirectUris"`
+	Scopes       []string `json:"scopes"`
+	// Confidential apps get a client secret. Apps that cannot keep one,
+	// such as desktop plugins, rely on PKCE alone.
+	Confidential bool `json:"confidential"`
+}
+
+// CreateOAuthAppResponse represents the app registration response
+type CreateOAuthAppResponse struct {
+	App OAuthApp `json:"app"`
+	// ClientSecret is only returned on creation
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+// ListOAuthAppsResponse represents the list apps response
+type ListOAuthAppsResponse struct {
+	Apps []OAuthApp `json:"apps"`
+}
+
+// AuthorizeParams are the OAuth2 authorization request parameters
+type AuthorizeParams struct {
+	ResponseType        string `query:"response_type"`
+	ClientID            string `query:"client_id"`
+	RedirectURI         string `query:"redirect_uri"`
+	Scope               string `query:"scope"`
+	State               string `query:"state"`
+	CodeChallenge       string `query:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method"`
+}
+
+// ScopeInfo describes a scope on the consent screen
+type ScopeInfo struct {
+	Scope       string `json:"scope"`
+	Description string `json:"description"`
+}
+
+// OAuthAppInfo is the public part of an app shown to users
+type OAuthAppInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	HomepageURL string `json:"homepageUrl,omitempty"`
+	LogoURL     string `json:"logoUrl,omitempty"`
+}
+
+// ConsentResponse is the data the consent screen renders
+type ConsentResponse struct {
+	App    OAuthAppInfo `json:"app"`
+	Scopes []ScopeInfo  `json:"scopes"`
+	// AlreadyGranted is set when the user has previously approved all
+	// requested scopes, so the web app may skip the prompt.
+	AlreadyGranted bool `json:"alreadyGranted"`
+}
+
+// ApproveAuthorizationRequest carries the user's consent decision
+type ApproveAuthorizationRequest struct {
+	ResponseType        string `json:"responseType"`
+	ClientID            string `json:"clientId"`
+	RedirectURI         string `json:"redirectUri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"codeChallenge"`
+	CodeChallengeMethod string `json:"codeChallengeMethod"`
+	Approve             bool   `json:"approve"`
+}
+
+// ApproveAuthorizationResponse tells the web app where to send the user
+type ApproveAuthorizationResponse struct {
+	RedirectURL string `json:"redirectUrl"`
+}
+
+// OAuthGrant is an app the user has authorized
+type OAuthGrant struct {
+	ID        string       `json:"id"`
+	ClientID  string       `json:"clientId"`
+	App       OAuthAppInfo `json:"app"`
+	Scopes    []string     `json:"scopes"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// ListOAuthGrantsResponse represents the authorized apps list
+type ListOAuthGrantsResponse struct {
+	Grants []OAuthGrant `json:"grants"`
+}
+
+//encore:api auth method=POST path=/oauth/apps
+func CreateOAuthApp(ctx context.Context, req *CreateOAuthAppRequest) (*CreateOAuthAppResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "name is required"}
+	}
+	if len(req.RedirectURIs) == 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "at least one redirect URI is required"}
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "redirect URIs must be https, or http on localhost, without a fragment: " + uri}
+		}
+	}
+	for _, link := range []string{req.HomepageURL, req.LogoURL} {
+		if link != "" && !validHTTPSURL(link) {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "homepage and logo URLs must be https: " + link}
+		}
+	}
+	if len(req.Scopes) == 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "at least one scope is required"}
+	}
+	for _, s := range req.Scopes {
+		if _, ok := scopeDescriptions[s]; !ok {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "unknown scope " + s}
+		}
+	}
+
+	clientID, err := newSecretToken()
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	clientID = clientID[:32]
+	var secret string
+	var secretHash any
+	if req.Confidential {
+		if secret, err = newSecretToken(); err != nil {
+			return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+		secretHash = hashSecretToken(secret)
+	}
+
+	app := OAuthApp{
+		ClientID:     clientID,
+		Name:         name,
+		Description:  strings.TrimSpace(req.Description),
+		HomepageURL:  req.HomepageURL,
+		LogoURL:      req.LogoURL,
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+		Confidential: req.Confidential,
+	}
+	err = authdb.QueryRow(ctx, `
+		INSERT INTO oauth_apps (client_id, client_secret_hash, name, description, homepage_url, logo_url, redirect_uris, scopes, owner_id)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7, $8, $9)
+		RETURNING id, created_at
+	`, app.ClientID, secretHash, app.Name, app.Description, app.HomepageURL, app.LogoURL, app.RedirectURIs, app.Scopes, userID).Scan(&app.ID, &app.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create oauth app", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditOAuthAppCreate, userID, "", true, map[string]string{"clientId": app.ClientID})
+
+	return &CreateOAuthAppResponse{App: app, ClientSecret: secret}, nil
+}
+
+//encore:api auth method=GET path=/oauth/apps
+func ListOAuthApps(ctx context.Context) (*ListOAuthAppsResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT `+oauthAppColumns+` FROM oauth_apps WHERE owner_id = $1 ORDER BY created_at
+	`, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list oauth apps", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	resp := &ListOAuthAppsResponse{Apps: []OAuthApp{}}
+	for rows.Next() {
+		app, err := scanOAuthApp(rows)
+		if err != nil {
+			continue
+		}
+		resp.Apps = append(resp.Apps, *app)
+	}
+	return resp, nil
+}
+
+// DeleteOAuthApp removes an app along with every grant and token issued to
+// it.
+//
+//encore:api auth method=DELETE path=/oauth/apps/:id
+func DeleteOAuthApp(ctx context.Context, id string) error {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	result, err := authdb.Exec(ctx, `DELETE FROM oauth_apps WHERE id = $1 AND owner_id = $2`, id, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete oauth app", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{Code: errs.NotFound, Message: "app not found"}
+	}
+	return nil
+}
+
+// GetConsent validates an authorization request and returns what the
+// consent screen needs to show. Errors here must be displayed to the user
+// rather than redirected, since the redirect URI may not be trustworthy.
+//
+//encore:api auth method=GET path=/oauth/authorize
+func GetConsent(ctx context.Context, params *AuthorizeParams) (*ConsentResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	app, scopes, err := validateAuthorizeParams(ctx, userID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var granted bool
+	err = authdb.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM oauth_grants
+			WHERE app_id = $1 AND user_id = $2 AND revoked_at IS NULL AND scopes @> $3
+		)
+	`, app.ID, userID, scopes).Scan(&granted)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check oauth grants", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	resp := &ConsentResponse{App: app.info(), AlreadyGranted: granted}
+	for _, s := range scopes {
+		resp.Scopes = append(resp.Scopes, ScopeInfo{Scope: s, Description: scopeDescriptions[s]})
+	}
+	return resp, nil
+}
+
+// ApproveAuthorization records the user's decision and returns the app
+// redirect carrying either an authorization code or access_denied.
+//
+//encore:api auth method=POST path=/oauth/authorize
+func ApproveAuthorization(ctx context.Context, req *ApproveAuthorizationRequest) (*ApproveAuthorizationResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	params := &AuthorizeParams{
+		ResponseType:        req.ResponseType,
+		ClientID:            req.ClientID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		State:               req.State,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+	}
+	app, scopes, err := validateAuthorizeParams(ctx, userID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	if !req.Approve {
+		query.Set("error", "access_denied")
+		return &ApproveAuthorizationResponse{RedirectURL: withQuery(req.RedirectURI, query)}, nil
+	}
+
+	code, err := newSecretToken()
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	_, err = authdb.Exec(ctx, `
+		INSERT INTO oauth_authorization_codes (code_hash, app_id, user_id, redirect_uri, scopes, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, hashSecretToken(code), app.ID, userID, req.RedirectURI, scopes, req.CodeChallenge, time.Now().Add(oauthCodeLifetime))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create authorization code", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditOAuthAuthorize, userID, "", true, map[string]string{
+		"clientId": app.ClientID,
+		"scope":    strings.Join(scopes, " "),
+	})
+
+	query.Set("code", code)
+	return &ApproveAuthorizationResponse{RedirectURL: withQuery(req.RedirectURI, query)}, nil
+}
+
+//encore:api auth method=GET path=/oauth/grants
+func ListOAuthGrants(ctx context.Context) (*ListOAuthGrantsResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT g.id, a.client_id, a.name, COALESCE(a.description, ''), COALESCE(a.homepage_url, ''), COALESCE(a.logo_url, ''), g.scopes, g.created_at
+		FROM oauth_grants g
+		JOIN oauth_apps a ON a.id = g.app_id
+		WHERE g.user_id = $1 AND g.revoked_at IS NULL
+		ORDER BY g.created_at DESC
+	`, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list oauth grants", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	resp := &ListOAuthGrantsResponse{Grants: []OAuthGrant{}}
+	for rows.Next() {
+		var g OAuthGrant
+		if err := rows.Scan(&g.ID, &g.ClientID, &g.App.Name, &g.App.Description, &g.App.HomepageURL, &g.App.LogoURL, &g.Scopes, &g.CreatedAt); err != nil {
+			continue
+		}
+		resp.Grants = append(resp.Grants, g)
+	}
+	return resp, nil
+}
+
+// RevokeOAuthGrant disconnects an app. Every token issued under the grant
+// stops working immediately.
+//
+//encore:api auth method=DELETE path=/oauth/grants/:id
+func RevokeOAuthGrant(ctx context.Context, id string) error {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	result, err := authdb.Exec(ctx, `
+		UPDATE oauth_grants SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to revoke oauth grant", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{Code: errs.NotFound, Message: "grant not found"}
+	}
+
+	recordAuthEvent(ctx, AuditOAuthRevoke, userID, "", true, map[string]string{"grantId": id})
+	return nil
+}
+
+// TokenScopes confines OAuth access tokens, scoped tokens, machine tokens
+// and API keys to the endpoints and scopes in endpointScopes. Full session
+// tokens pass through untouched.
+//
+//encore:middleware global target=all
+func TokenScopes(req middleware.Request, next middleware.Next) middleware.Response {
+	data := req.Data()
+	user := requestToken(data)
+	if user == nil {
+		return next(req)
+	}
+	if user.APIKey != nil {
+		if err := checkAPIKeyAccess(user.APIKey, data); err != nil {
+			return middleware.Response{Err: err}
+		}
+		return next(req.WithContext(apiKeyContext(req.Context(), user.APIKey)))
+	}
+	claims := user.Claims
+	if claims == nil {
+		return next(req)
+	}
+	granted, restricted := claims.grantedScopes()
+	if !restricted {
+		return next(req)
+	}
+
+	if claims.Service != "" && !serviceEndpoints[data.Service+"."+data.Endpoint] {
+		return middleware.Response{Err: &errs.Error{Code: errs.PermissionDenied, Message: "this endpoint is not available to service tokens"}}
+	}
+	if data.Service == "auth" && data.Endpoint == "Logout" {
+		// Any token may revoke itself.
+		return next(req)
+	}
+	required, ok := endpointScopes[data.Service+"."+data.Endpoint]
+	if !ok {
+		msg := "this endpoint is not available to scoped tokens"
+		if claims.ClientID != "" {
+			msg = "this endpoint is not available to third-party apps"
+		}
+		return middleware.Response{Err: &errs.Error{Code: errs.PermissionDenied, Message: msg}}
+	}
+	if !containsString(granted, required) {
+		return middleware.Response{Err: &errs.Error{Code: errs.PermissionDenied, Message: "access token is missing the " + required + " scope"}}
+	}
+	return next(req)
+}
+
+// checkOAuthToken rejects OAuth access tokens that were revoked, directly or
+// through their grant.
+func checkOAuthToken(ctx context.Context, claims *UserClaims) error {
+	var active bool
+	err := authdb.QueryRow(ctx, `
+		SELECT t.revoked_at IS NULL AND g.revoked_at IS NULL
+		FROM oauth_tokens t
+		JOIN oauth_grants g ON g.id = t.grant_id
+		WHERE t.id = $1 AND g.user_id = $2
+	`, claims.ID, claims.UserID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// validateAuthorizeParams checks an authorization request against the
+// registered app and returns the app and the requested scopes, defaulting
+// to everything the app registered for.
+func validateAuthorizeParams(ctx context.Context, userID string, p *AuthorizeParams) (*OAuthApp, []string, error) {
+	if p.ResponseType != "code" {
+		return nil, nil, &errs.Error{Code: errs.InvalidArgument, Message: "response_type must be code"}
+	}
+	if p.CodeChallengeMethod != "S256" {
+		return nil, nil, &errs.Error{Code: errs.InvalidArgument, Message: "code_challenge_method must be S256"}
+	}
+	if n := len(p.CodeChallenge); n < 43 || n > 128 {
+		return nil, nil, &errs.Error{Code: errs.InvalidArgument, Message: "code_challenge is invalid"}
+	}
+
+	app, err := getOAuthApp(ctx, p.ClientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, &errs.Error{Code: errs.NotFound, Message: "unknown client_id"}
+		}
+		reqctx.Logger(ctx).Error("failed to get oauth app", "error", err)
+		return nil, nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if !containsString(app.RedirectURIs, p.RedirectURI) {
+		return nil, nil, &errs.Error{Code: errs.InvalidArgument, Message: "redirect_uri is not registered for this app"}
+	}
+
+	scopes := app.Scopes
+	if p.Scope != "" {
+		scopes = strings.Fields(p.Scope)
+		for _, s := range scopes {
+			if !containsString(app.Scopes, s) {
+				return nil, nil, &errs.Error{Code: errs.InvalidArgument, Message: "scope " + s + " is not allowed for this app"}
+			}
+		}
+	}
+	sort.Strings(scopes)
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if user.IsGuest {
+		return nil, nil, &errs.Error{Code: errs.FailedPrecondition, Message: "guest accounts must be upgraded first"}
+	}
+	return app, scopes, nil
+}
+
+const oauthAppColumns = `id, client_id, client_secret_hash IS NOT NULL, name, COALESCE(description, ''), COALESCE(homepage_url, ''), COALESCE(logo_url, ''), redirect_uris, scopes, created_at`
+
+func getOAuthApp(ctx context.Context, clientID string) (*OAuthApp, error) {
+	return scanOAuthApp(authdb.QueryRow(ctx, `SELECT `+oauthAppColumns+` FROM oauth_apps WHERE client_id = $1`, clientID))
+}
+
+func scanOAuthApp(row interface{ Scan(...any) error }) (*OAuthApp, error) {
+	var a OAuthApp
+	if err := row.Scan(&a.ID, &a.ClientID, &a.Confidential, &a.Name, &a.Description, &a.HomepageURL, &a.LogoURL, &a.RedirectURIs, &a.Scopes, &a.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (a *OAuthApp) info() OAuthAppInfo {
+	return OAuthAppInfo{
+		Name:        a.Name,
+		Description: a.Description,
+		HomepageURL: a.HomepageURL,
+		LogoURL:     a.LogoURL,
+	}
+}
+
+// validRedirectURI accepts absolute https URIs, and plain http on loopback
+// for local development. Fragments are not allowed by RFC 6749.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+func validHTTPSURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+func withQuery(base string, query url.Values) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	q := u.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// verifyPKCE checks an S256 code verifier against its challenge.
+func verifyPKCE(verifier, challenge string) bool {
+	if n := len(verifier); n < 43 || n > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,430 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev/storage/sqldb"
+	"github.com/golang-jwt/jwt/v5"
+
+	"canvasai/reqctx"
+)
+
+// The token, introspection and revocation endpoints follow RFC 6749, 7662
+// and 7009: they take form-encoded bodies, authenticate the client with
+// HTTP Basic or client_id/client_secret form fields and answer with the
+// standard JSON error objects, so they are raw endpoints.
+
+const (
+	oauthAccessLifetime  = time.Hour
+	oauthRefreshLifetime = 30 * 24 * time.Hour
+)
+
+// OAuthTokenResponse is the RFC 6749 access token response
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// IntrospectionResponse is the RFC 7662 token introspection response
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+}
+
+// oauthError is an RFC 6749 error response
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+var errInvalidClient = errors.New("invalid client credentials")
+
+// OAuthToken exchanges an authorization code or a refresh token for a new
+// token pair. Refresh tokens rotate on every use; presenting one that was
+// already rotated revokes the whole grant, since it means the token leaked.
+//
+//encore:api public raw method=POST path=/oauth/token
+func OAuthToken(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	w.Header().Set("Cache-Control", "no-store")
+
+	app, err := authenticateClient(ctx, req)
+	if err != nil {
+		writeOAuthClientError(ctx, w, err)
+		return
+	}
+
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		exchangeAuthorizationCode(ctx, w, req, app)
+	case "refresh_token":
+		exchangeRefreshToken(ctx, w, req, app)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+	}
+}
+
+// OAuthIntrospect reports whether a token is active. Clients may only
+// introspect their own tokens; anything else reads as inactive.
+//
+//encore:api public raw method=POST path=/oauth/introspect
+func OAuthIntrospect(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	w.Header().Set("Cache-Control", "no-store")
+
+	app, err := authenticateClient(ctx, req)
+	if err != nil {
+		writeOAuthClientError(ctx, w, err)
+		return
+	}
+
+	resp := IntrospectionResponse{}
+	token := req.PostForm.Get("token")
+	if claims, err := parseUserToken(token); err == nil && claims.ClientID == app.ClientID {
+		if checkTokenVersion(ctx, claims) == nil && checkOAuthToken(ctx, claims) == nil {
+			resp = IntrospectionResponse{
+				Active:    true,
+				Scope:     claims.Scope,
+				ClientID:  claims.ClientID,
+				Username:  claims.Email,
+				TokenType: "access_token",
+				Exp:       claims.ExpiresAt.Unix(),
+				Iat:       claims.IssuedAt.Unix(),
+				Sub:       claims.UserID,
+			}
+		}
+	} else if token != "" {
+		var userID, email string
+		var scopes []string
+		var createdAt, expiresAt time.Time
+		err := authdb.QueryRow(ctx, `
+			SELECT g.user_id, u.email, g.scopes, t.created_at, t.refresh_expires_at
+			FROM oauth_tokens t
+			JOIN oauth_grants g ON g.id = t.grant_id
+			JOIN users u ON u.id = g.user_id
+			WHERE t.refresh_token_hash = $1 AND g.app_id = $2
+				AND t.revoked_at IS NULL AND g.revoked_at IS NULL AND t.refresh_expires_at > NOW()
+		`, hashSecretToken(token), app.ID).Scan(&userID, &email, &scopes, &createdAt, &expiresAt)
+		if err != nil && err != sql.ErrNoRows {
+			reqctx.Logger(ctx).Error("failed to introspect refresh token", "error", err)
+		}
+		if err == nil {
+			resp = IntrospectionResponse{
+				Active:    true,
+				Scope:     strings.Join(scopes, " "),
+				ClientID:  app.ClientID,
+				Username:  email,
+				TokenType: "refresh_token",
+				Exp:       expiresAt.Unix(),
+				Iat:       createdAt.Unix(),
+				Sub:       userID,
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// OAuthRevoke revokes a token. Revoking an access token also revokes the
+// refresh token issued with it; revoking a refresh token revokes the whole
+// grant, as RFC 7009 recommends. Unknown tokens are not an error.
+//
+//encore:api public raw method=POST path=/oauth/revoke
+func OAuthRevoke(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	app, err := authenticateClient(ctx, req)
+	if err != nil {
+		writeOAuthClientError(ctx, w, err)
+		return
+	}
+
+	token := req.PostForm.Get("token")
+	if claims, err := parseUserToken(token); err == nil && claims.ClientID == app.ClientID {
+		_, err = authdb.Exec(ctx, `UPDATE oauth_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, claims.ID)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to revoke oauth token", "error", err)
+			writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "")
+			return
+		}
+	} else if token != "" {
+		_, err = authdb.Exec(ctx, `
+			UPDATE oauth_grants g SET revoked_at = NOW()
+			FROM oauth_tokens t
+			WHERE t.grant_id = g.id AND t.refresh_token_hash = $1 AND g.app_id = $2 AND g.revoked_at IS NULL
+		`, hashSecretToken(token), app.ID)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to revoke oauth grant", "error", err)
+			writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func exchangeAuthorizationCode(ctx context.Context, w http.ResponseWriter, req *http.Request, app *OAuthApp) {
+	log := reqctx.Logger(ctx).With("client_id", app.ClientID)
+
+	var appID, userID, redirectURI, challenge string
+	var scopes []string
+	err := authdb.QueryRow(ctx, `
+		UPDATE oauth_authorization_codes SET used_at = NOW()
+		WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING app_id, user_id, redirect_uri, scopes, code_challenge
+	`, hashSecretToken(req.PostForm.Get("code"))).Scan(&appID, &userID, &redirectURI, &scopes, &challenge)
+	if err == sql.ErrNoRows {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "authorization code is invalid or has expired")
+		return
+	}
+	if err != nil {
+		log.Error("failed to use authorization code", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if appID != app.ID || redirectURI != req.PostForm.Get("redirect_uri") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "authorization code was not issued to this client and redirect_uri")
+		return
+	}
+	if !verifyPKCE(req.PostForm.Get("code_verifier"), challenge) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+
+	tx, err := authdb.Begin(ctx)
+	if err != nil {
+		log.Error("failed to begin transaction", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	defer tx.Rollback()
+
+	var grantID string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO oauth_grants (app_id, user_id, scopes) VALUES ($1, $2, $3) RETURNING id
+	`, app.ID, userID, scopes).Scan(&grantID)
+	if err != nil {
+		log.Error("failed to create oauth grant", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	resp, err := issueOAuthTokens(ctx, tx, app, grantID, userID, scopes)
+	if err != nil {
+		log.Error("failed to issue oauth tokens", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("failed to commit oauth grant", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	writeOAuthJSON(w, resp)
+}
+
+func exchangeRefreshToken(ctx context.Context, w http.ResponseWriter, req *http.Request, app *OAuthApp) {
+	log := reqctx.Logger(ctx).With("client_id", app.ClientID)
+
+	tx, err := authdb.Begin(ctx)
+	if err != nil {
+		log.Error("failed to begin transaction", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	defer tx.Rollback()
+
+	var tokenID, grantID, userID string
+	var scopes []string
+	var tokenRevoked, grantRevoked, expired bool
+	err = tx.QueryRow(ctx, `
+		SELECT t.id, g.id, g.user_id, g.scopes, t.revoked_at IS NOT NULL, g.revoked_at IS NOT NULL, t.refresh_expires_at <= NOW()
+		FROM oauth_tokens t
+		JOIN oauth_grants g ON g.id = t.grant_id
+		WHERE t.refresh_token_hash = $1 AND g.app_id = $2
+		FOR UPDATE OF t
+	`, hashSecretToken(req.PostForm.Get("refresh_token")), app.ID).Scan(&tokenID, &grantID, &userID, &scopes, &tokenRevoked, &grantRevoked, &expired)
+	if err == sql.ErrNoRows {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "refresh token is invalid")
+		return
+	}
+	if err != nil {
+		log.Error("failed to get refresh token", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if tokenRevoked && !grantRevoked {
+		// A rotated refresh token came back: assume it was stolen and cut
+		// off both whoever holds it and whoever holds its successor.
+		if _, err := tx.Exec(ctx, `UPDATE oauth_grants SET revoked_at = NOW() WHERE id = $1`, grantID); err != nil {
+			log.Error("failed to revoke oauth grant", "error", err)
+		} else if err := tx.Commit(); err != nil {
+			log.Error("failed to commit oauth grant revocation", "error", err)
+		}
+		log.Warn("refresh token reused, grant revoked", "grant_id", grantID)
+		recordAuthEvent(ctx, AuditOAuthRevoke, userID, "", true, map[string]string{"grantId": grantID, "reason": "refresh_token_reuse"})
+	}
+	if tokenRevoked || grantRevoked || expired {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "refresh token is invalid")
+		return
+	}
+
+	// Apps may narrow the scope of a refreshed token, never widen it.
+	if requested := req.PostForm.Get("scope"); requested != "" {
+		narrowed := strings.Fields(requested)
+		for _, s := range narrowed {
+			if !containsString(scopes, s) {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope "+s+" was not granted")
+				return
+			}
+		}
+		scopes = narrowed
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE oauth_tokens SET revoked_at = NOW() WHERE id = $1`, tokenID); err != nil {
+		log.Error("failed to rotate refresh token", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	resp, err := issueOAuthTokens(ctx, tx, app, grantID, userID, scopes)
+	if err != nil {
+		log.Error("failed to issue oauth tokens", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("failed to commit refresh token rotation", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	writeOAuthJSON(w, resp)
+}
+
+// issueOAuthTokens stores a new token pair under grantID and signs the
+// access token. The access token's jti is the oauth_tokens row ID, which is
+// how AuthHandler finds out whether it was revoked.
+func issueOAuthTokens(ctx context.Context, tx *sqldb.Tx, app *OAuthApp, grantID, userID string, scopes []string) (*OAuthTokenResponse, error) {
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := newSecretToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	accessExpiresAt := now.Add(oauthAccessLifetime)
+	var tokenID string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO oauth_tokens (grant_id, refresh_token_hash, access_expires_at, refresh_expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, grantID, hashSecretToken(refreshToken), accessExpiresAt, now.Add(oauthRefreshLifetime)).Scan(&tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := strings.Join(scopes, " ")
+	accessToken, err := signToken(UserClaims{
+		UserID:   user.ID,
+		Email:    user.Email,
+		Name:     user.Name,
+		Version:  user.TokenVersion,
+		Scope:    scope,
+		Scopes:   scopes,
+		ClientID: app.ClientID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			ExpiresAt: jwt.NewNumericDate(accessExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "canvasai",
+			Subject:   user.ID,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &OAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthAccessLifetime.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}, nil
+}
+
+// authenticateClient identifies the calling app from HTTP Basic credentials
+// or client_id/client_secret form fields. Public clients send only their
+// client_id and are held to PKCE instead.
+func authenticateClient(ctx context.Context, req *http.Request) (*OAuthApp, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, errInvalidClient
+	}
+	clientID, secret, basic := req.BasicAuth()
+	if !basic {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		return nil, errInvalidClient
+	}
+
+	var app OAuthApp
+	var secretHash sql.NullString
+	err := authdb.QueryRow(ctx, `SELECT `+oauthAppColumns+`, client_secret_hash FROM oauth_apps WHERE client_id = $1`, clientID).
+		Scan(&app.ID, &app.ClientID, &app.Confidential, &app.Name, &app.Description, &app.HomepageURL, &app.LogoURL, &app.RedirectURIs, &app.Scopes, &app.CreatedAt, &secretHash)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if secretHash.Valid {
+		if subtle.ConstantTimeCompare([]byte(hashSecretToken(secret)), []byte(secretHash.String)) != 1 {
+			return nil, errInvalidClient
+		}
+	} else if secret != "" {
+		return nil, errInvalidClient
+	}
+	return &app, nil
+}
+
+func writeOAuthClientError(ctx context.Context, w http.ResponseWriter, err error) {
+	if err == errInvalidClient {
+		w.Header().Set("WWW-Authenticate", `Basic realm="canvasai"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	reqctx.Logger(ctx).Error("failed to authenticate oauth client", "error", err)
+	writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(oauthError{Code: code, Description: description})
+}
+
+func writeOAuthJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"golang.org/x/crypto/bcrypt"
+
+	"canvasai/outbound"
+	"canvasai/reqctx"
+)
+
+// PasswordPolicy describes the rules new passwords must satisfy
+type PasswordPolicy struct {
+	MinLength     int  `json:"minLength"`
+	RequireUpper  bool `json:"requireUpper"`
+	RequireLower  bool `json:"requireLower"`
+	RequireDigit  bool `json:"requireDigit"`
+	RequireSymbol bool `json:"requireSymbol"`
+	// BreachCheck rejects passwords found in the HaveIBeenPwned corpus
+	BreachCheck bool `json:"breachCheck"`
+}
+
+// PolicyViolation is a single rule a password failed
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a rejected password failed
+type PasswordPolicyError struct {
+	Violations []PolicyViolation `json:"violations"`
+}
+
+// ErrDetails marks PasswordPolicyError as structured error details.
+func (*PasswordPolicyError) ErrDetails() {}
+
+// ChangePasswordRequest represents the change password request
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+var passwordCfg struct {
+	Policy PasswordPolicy
+}
+
+var _ = config.Load(context.Background(), &passwordCfg)
+
+const (
+	defaultPasswordMinLength = 8
+	maxPasswordLength        = 72 // bcrypt ignores anything longer
+	pwnedPasswordsURL        = "https://api.pwnedpasswords.com/range/"
+)
+
+// commonPasswords are rejected regardless of the breach check setting.
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "passw0rd": true,
+	"123456": true, "12345678": true, "123456789": true, "1234567890": true,
+	"qwerty": true, "qwerty123": true, "qwertyuiop": true, "abc123": true,
+	"111111": true, "000000": true, "iloveyou": true, "letmein": true,
+	"welcome": true, "welcome1": true, "admin": true, "admin123": true,
+	"monkey": true, "dragon": true, "football": true, "baseball": true,
+	"sunshine": true, "princess": true, "trustno1": true, "changeme": true,
+	"canvasai": true, "canvas123": true,
+}
+
+var pwnedClient = outbound.NewClient(outbound.Policy{
+	Timeout:          3 * time.Second,
+	MaxResponseBytes: 1 << 20,
+	AllowedHosts:     []string{"api.pwnedpasswords.com"},
+})
+
+// passwordPolicy returns the configured policy with defaults applied.
+func passwordPolicy() PasswordPolicy {
+	p := passwordCfg.Policy
+	if p.MinLength <= 0 {
+		p.MinLength = defaultPasswordMinLength
+	}
+	return p
+}
+
+//encore:api public method=GET path=/auth/password-policy
+func GetPasswordPolicy(ctx context.Context) (*PasswordPolicy, error) {
+	p := passwordPolicy()
+	return &p, nil
+}
+
+//encore:api auth method=POST path=/auth/password
+func ChangePassword(ctx context.Context, req *ChangePasswordRequest) error {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return &errs.Error{Code: errs.NotFound, Message: "user not found"}
+		}
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	hashedPassword, err := getUserPasswordHash(ctx, user.ID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get user password", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.CurrentPassword)); err != nil {
+		recordAuthEvent(ctx, AuditPasswordChange, user.ID, user.Email, false, map[string]string{"reason": "bad_password"})
+		return &errs.Error{Code: errs.PermissionDenied, Message: "current password is incorrect"}
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "new password must be different"}
+	}
+	if err := checkPassword(ctx, req.NewPassword, user.Email, user.Name); err != nil {
+		return err
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to hash password", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if _, err := authdb.Exec(ctx, `UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2`, string(newHash), user.ID); err != nil {
+		reqctx.Logger(ctx).Error("failed to update password", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditPasswordChange, user.ID, user.Email, true, nil)
+	return nil
+}
+
+// checkPassword validates a new password against the policy. It returns an
+// InvalidArgument error whose details list every failed rule.
+func checkPassword(ctx context.Context, password, email, name string) error {
+	violations := evaluatePassword(passwordPolicy(), password, email, name)
+
+	if len(violations) == 0 && passwordPolicy().BreachCheck {
+		count, err := pwnedCount(ctx, password)
+		if err != nil {
+			// Fail open: the breach corpus is advisory and must not block signups.
+			reqctx.Logger(ctx).Warn("password breach check unavailable", "error", err)
+		} else if count > 0 {
+			violations = append(violations, PolicyViolation{
+				Rule:    "breached",
+				Message: "password has appeared in a known data breach",
+			})
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: violations[0].Message,
+		Details: &PasswordPolicyError{Violations: violations},
+	}
+}
+
+func evaluatePassword(p PasswordPolicy, password, email, name string) []PolicyViolation {
+	var violations []PolicyViolation
+	add := func(rule, msg string) {
+		violations = append(violations, PolicyViolation{Rule: rule, Message: msg})
+	}
+
+	if len(password) < p.MinLength {
+		add("min_length", fmt.Sprintf("password must be at least %d characters", p.MinLength))
+	}
+	if len(password) > maxPasswordLength {
+		add("max_length", fmt.Sprintf("password must be at most %d characters", maxPasswordLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add("uppercase", "password must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		add("lowercase", "password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add("digit", "password must contain a number")
+	}
+	if p.RequireSymbol && !symbol {
+		add("symbol", "password must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	if commonPasswords[lowered] {
+		add("common", "password is too common")
+	}
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if len(local) >= 3 && strings.Contains(lowered, local) {
+		add("personal", "password must not contain your email address")
+	} else if n := strings.ToLower(strings.TrimSpace(name)); len(n) >= 3 && strings.Contains(lowered, n) {
+		add("personal", "password must not contain your name")
+	}
+	return violations
+}
+
+// pwnedCount looks a password up in the HaveIBeenPwned range API. Only the
+// first five hex characters of its SHA-1 leave the server (k-anonymity).
+func pwnedCount(ctx context.Context, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pwnedPasswordsURL+prefix, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Add-Padding", "true")
+	req.Header.Set("User-Agent", "CanvasAI-password-check")
+
+	resp, err := pwnedClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("pwned passwords returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		hash, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || hash != suffix {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	return 0, scanner.Err()
+}
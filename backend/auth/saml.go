@@ -0,0 +1,582 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+	"canvasai/webhook"
+)
+
+// SAMLAttributeMapping maps IdP assertion attribute names to User fields.
+// Empty fields fall back to common defaults (see defaultSAMLAttributes).
+type SAMLAttributeMapping struct {
+	Email  string `json:"email,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// SAMLConfig is an organization's SAML identity provider configuration
+type SAMLConfig struct {
+	OrgID            string               `json:"orgId"`
+	Domain           string               `json:"domain"`
+	IdPEntityID      string               `json:"idpEntityId"`
+	AttributeMapping SAMLAttributeMapping `json:"attributeMapping"`
+	Enabled          bool                 `json:"enabled"`
+	// DomainVerified is set once the organization proved it owns Domain.
+	// Until then nobody can sign in through the configuration, and
+	// VerificationRecord is the DNS TXT record that proves it.
+	DomainVerified     bool       `json:"domainVerified"`
+	VerificationRecord *DNSRecord `json:"verificationRecord,omitempty"`
+	SPEntityID         string     `json:"spEntityId"`
+	ACSURL             string     `json:"acsUrl"`
+	UpdatedAt          time.Time  `json:"updatedAt"`
+}
+
+// DNSRecord is a DNS TXT record to publish
+type DNSRecord struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ConfigureSAMLRequest represents the SAML configuration upload payload
+type ConfigureSAMLRequest struct {
+	Domain           string               `json:"domain"`
+	MetadataXML      string               `json:"metadataXml"`
+	AttributeMapping SAMLAttributeMapping `json:"attributeMapping"`
+	Enabled          *bool                `json:"enabled,omitempty"`
+}
+
+// SSOLoginRequest represents the SSO discovery request
+type SSOLoginRequest struct {
+	Email string `query:"email"`
+}
+
+// SSOLoginResponse tells the client where to send the user to authenticate
+type SSOLoginResponse struct {
+	RedirectURL string `json:"redirectUrl"`
+}
+
+var ErrSAMLNotConfigured = errors.New("saml not configured")
+
+// errSAMLAccountNotLinked refuses a single sign-on for an existing account
+// that is not a member of the organization
+var errSAMLAccountNotLinked = errors.New("account is not a member of the organization")
+
+var defaultSAMLAttributes = SAMLAttributeMapping{
+	Email:  "email",
+	Name:   "displayName",
+	Avatar: "picture",
+}
+
+const (
+	maxSAMLMetadataSize = 512 * 1024
+	// samlLoginTTL is how long the IdP has to answer a login request
+	samlLoginTTL = 10 * time.Minute
+	// samlVerificationPrefix names the TXT record proving domain ownership
+	samlVerificationPrefix = "_canvasai-verification."
+	samlVerificationValue  = "canvasai-domain-verification="
+)
+
+// samlEnabled selects configurations users can sign in through
+const samlEnabled = `enabled = TRUE AND domain_verified_at IS NOT NULL`
+
+//encore:api auth method=PUT path=/auth/sso/saml/:orgID
+func ConfigureSAML(ctx context.Context, orgID string, req *ConfigureSAMLRequest) (*SAMLConfig, error) {
+	if err := permissions.RequireOrgAdmin(ctx, authdb, orgID); err != nil {
+		return nil, err
+	}
+
+	domain := strings.ToLower(strings.TrimSpace(req.Domain))
+	if domain == "" || strings.Contains(domain, "@") || !strings.Contains(domain, ".") {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "a valid email domain is required"}
+	}
+	if len(req.MetadataXML) == 0 || len(req.MetadataXML) > maxSAMLMetadataSize {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "IdP metadata is required and must be under 512KB"}
+	}
+	entity, err := samlsp.ParseMetadata([]byte(req.MetadataXML))
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "invalid IdP metadata: " + err.Error()}
+	}
+
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+	mapping, err := json.Marshal(req.AttributeMapping)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "invalid attribute mapping"}
+	}
+	token, err := newSecretToken()
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate verification token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	// Changing the domain needs a new proof of ownership.
+	_, err = authdb.Exec(ctx, `
+		INSERT INTO saml_configs (org_id, domain, idp_entity_id, idp_metadata_xml, attribute_mapping, enabled, verification_token)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (org_id) DO UPDATE SET
+			domain = EXCLUDED.domain,
+			idp_entity_id = EXCLUDED.idp_entity_id,
+			idp_metadata_xml = EXCLUDED.idp_metadata_xml,
+			attribute_mapping = EXCLUDED.attribute_mapping,
+			enabled = EXCLUDED.enabled,
+			verification_token = CASE WHEN lower(saml_configs.domain) = EXCLUDED.domain
+				THEN saml_configs.verification_token ELSE EXCLUDED.verification_token END,
+			domain_verified_at = CASE WHEN lower(saml_configs.domain) = EXCLUDED.domain
+				THEN saml_configs.domain_verified_at END
+	`, orgID, domain, entity.EntityID, req.MetadataXML, mapping, enabled, token)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to save saml config", "org_id", orgID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	return GetSAMLConfig(ctx, orgID)
+}
+
+// VerifySAMLDomain checks the DNS TXT record proving the organization owns
+// its SAML domain. Single sign-on starts working once it is found.
+//
+//encore:api auth method=POST path=/auth/sso/saml/:orgID/verify-domain
+func VerifySAMLDomain(ctx context.Context, orgID string) (*SAMLConfig, error) {
+	c, err := GetSAMLConfig(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if c.DomainVerified {
+		return c, nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	records, err := net.DefaultResolver.LookupTXT(lookupCtx, c.VerificationRecord.Name)
+	found := false
+	for _, r := range records {
+		if strings.TrimSpace(r) == c.VerificationRecord.Value {
+			found = true
+		}
+	}
+	if !found {
+		reqctx.Logger(ctx).Info("saml domain verification record not found", "org_id", orgID, "domain", c.Domain, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "TXT record " + c.VerificationRecord.Name + " with value " + c.VerificationRecord.Value + " was not found; DNS changes can take a while to propagate",
+		}
+	}
+
+	_, err = authdb.Exec(ctx, `
+		UPDATE saml_configs SET domain_verified_at = NOW()
+		WHERE org_id = $1 AND lower(domain) = $2 AND domain_verified_at IS NULL
+	`, orgID, c.Domain)
+	if err != nil {
+		if strings.Contains(err.Error(), "idx_saml_configs_verified_domain") {
+			return nil, &errs.Error{Code: errs.AlreadyExists, Message: "domain is already bound to another organization"}
+		}
+		reqctx.Logger(ctx).Error("failed to verify saml domain", "org_id", orgID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	reqctx.Logger(ctx).Info("saml domain verified", "org_id", orgID, "domain", c.Domain)
+	return GetSAMLConfig(ctx, orgID)
+}
+
+//encore:api auth method=GET path=/auth/sso/saml/:orgID
+func GetSAMLConfig(ctx context.Context, orgID string) (*SAMLConfig, error) {
+	if err := permissions.RequireOrgAdmin(ctx, authdb, orgID); err != nil {
+		return nil, err
+	}
+
+	c, _, err := getSAMLConfig(ctx, `org_id = $1`, orgID)
+	if err != nil {
+		if err == ErrSAMLNotConfigured {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "saml is not configured for this organization"}
+		}
+		reqctx.Logger(ctx).Error("failed to get saml config", "org_id", orgID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	return c, nil
+}
+
+// StartSAMLLogin resolves the IdP for an email domain and returns the
+// redirect URL carrying the SAML AuthnRequest.
+//
+//encore:api public method=GET path=/auth/sso/login
+func StartSAMLLogin(ctx context.Context, req *SSOLoginRequest) (*SSOLoginResponse, error) {
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !isValidEmail(email) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "invalid email format"}
+	}
+
+	c, metadata, err := getSAMLConfig(ctx, `lower(domain) = $1 AND `+samlEnabled, emailDomain(email))
+	if err != nil {
+		if err == ErrSAMLNotConfigured {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "single sign-on is not available for this domain"}
+		}
+		reqctx.Logger(ctx).Error("failed to resolve saml config", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	sp, err := newServiceProvider(c.OrgID, metadata)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to build saml service provider", "org_id", c.OrgID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	authn, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create authn request", "org_id", c.OrgID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	// The request ID comes back as the relay state, so the ACS knows which
+	// request a response answers.
+	_, err = authdb.Exec(ctx, `DELETE FROM saml_login_requests WHERE expires_at < NOW()`)
+	if err == nil {
+		_, err = authdb.Exec(ctx, `
+			INSERT INTO saml_login_requests (id, org_id, expires_at) VALUES ($1, $2, $3)
+		`, authn.ID, c.OrgID, time.Now().Add(samlLoginTTL))
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record authn request", "org_id", c.OrgID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	redirect, err := authn.Redirect(authn.ID, sp)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create authn request", "org_id", c.OrgID, "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	return &SSOLoginResponse{RedirectURL: redirect.String()}, nil
+}
+
+// SAMLACS is the assertion consumer service the IdP posts responses to.
+// Only responses to a login request started by StartSAMLLogin are
+// accepted. Valid assertions JIT-provision new users into the
+// organization and redirect to the web app with a session token; existing
+// accounts must already be members of the organization.
+//
+//encore:api public raw method=POST path=/auth/sso/saml/:orgID/acs
+func SAMLACS(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	orgID := encore.CurrentRequest().PathParams.Get("orgID")
+	log := reqctx.Logger(ctx).With("org_id", orgID)
+
+	c, metadata, err := getSAMLConfig(ctx, `org_id = $1 AND `+samlEnabled, orgID)
+	if err != nil {
+		if err != ErrSAMLNotConfigured {
+			log.Error("failed to get saml config", "error", err)
+		}
+		http.Error(w, "single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	sp, err := newServiceProvider(orgID, metadata)
+	if err != nil {
+		log.Error("failed to build saml service provider", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "invalid SAML response", http.StatusBadRequest)
+		return
+	}
+	var requestID string
+	err = authdb.QueryRow(ctx, `
+		DELETE FROM saml_login_requests WHERE id = $1 AND org_id = $2 AND expires_at > NOW()
+		RETURNING id
+	`, req.PostForm.Get("RelayState"), orgID).Scan(&requestID)
+	if err == sql.ErrNoRows {
+		log.Warn("rejected saml response without a pending login request")
+		http.Error(w, "login request expired, please sign in again", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Error("failed to look up saml login request", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	assertion, err := sp.ParseResponse(req, []string{requestID})
+	if err != nil {
+		log.Warn("rejected saml response", "error", err)
+		http.Error(w, "invalid SAML response", http.StatusForbidden)
+		return
+	}
+
+	mapped := mapSAMLAttributes(assertion, c.AttributeMapping)
+	if !isValidEmail(mapped.Email) || emailDomain(mapped.Email) != c.Domain {
+		log.Warn("saml assertion email outside configured domain", "domain", c.Domain)
+		http.Error(w, "email is not part of this organization", http.StatusForbidden)
+		return
+	}
+
+	user, err := provisionSAMLUser(ctx, orgID, mapped)
+	if err == errSAMLAccountNotLinked {
+		recordAuthEvent(ctx, AuditLoginFailure, user.ID, user.Email, false, map[string]string{"reason": "sso_not_member", "orgId": orgID})
+		http.Error(w, "an account with this email already exists; ask an organization admin to add it to the organization", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Error("failed to provision saml user", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if user.Deactivated {
+		recordAuthEvent(ctx, AuditLoginFailure, user.ID, user.Email, false, map[string]string{"reason": "deactivated", "orgId": orgID})
+		http.Error(w, "account is deactivated", http.StatusForbidden)
+		return
+	}
+
+	token, err := generateJWTToken(user)
+	if err != nil {
+		log.Error("failed to generate token", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	recordAuthEvent(ctx, AuditSSOLogin, user.ID, user.Email, true, map[string]string{"orgId": orgID})
+	checkLoginFingerprint(ctx, user)
+	http.Redirect(w, req, strings.TrimRight(cfg.FrontendURL, "/")+"/sso/callback#token="+url.QueryEscape(token), http.StatusSeeOther)
+}
+
+// Helper functions
+
+func getSAMLConfig(ctx context.Context, where string, arg string) (*SAMLConfig, string, error) {
+	row := authdb.QueryRow(ctx, `
+		SELECT org_id, domain, idp_entity_id, idp_metadata_xml, attribute_mapping, enabled,
+			verification_token, domain_verified_at IS NOT NULL, updated_at
+		FROM saml_configs WHERE `+where, arg)
+	var c SAMLConfig
+	var metadata, token string
+	var mapping []byte
+	if err := row.Scan(&c.OrgID, &c.Domain, &c.IdPEntityID, &metadata, &mapping, &c.Enabled, &token, &c.DomainVerified, &c.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", ErrSAMLNotConfigured
+		}
+		return nil, "", err
+	}
+	if err := json.Unmarshal(mapping, &c.AttributeMapping); err != nil {
+		return nil, "", err
+	}
+	c.Domain = strings.ToLower(c.Domain)
+	if !c.DomainVerified {
+		c.VerificationRecord = &DNSRecord{Name: samlVerificationPrefix + c.Domain, Value: samlVerificationValue + token}
+	}
+	c.SPEntityID, c.ACSURL = spURLs(c.OrgID)
+	return &c, metadata, nil
+}
+
+func spURLs(orgID string) (entityID, acsURL string) {
+	base := encore.Meta().APIBaseURL
+	base.Path = "/auth/sso/saml/" + orgID
+	entityID = base.String()
+	base.Path += "/acs"
+	return entityID, base.String()
+}
+
+var spKeyPair struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+	err  error
+}
+
+func loadSPKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	spKeyPair.once.Do(func() {
+		keyBlock, _ := pem.Decode([]byte(secrets.SAMLPrivateKey))
+		certBlock, _ := pem.Decode([]byte(secrets.SAMLCertificate))
+		if keyBlock == nil || certBlock == nil {
+			spKeyPair.err = errors.New("saml service provider key pair is not configured")
+			return
+		}
+		key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			spKeyPair.err = err
+			return
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			spKeyPair.err = err
+			return
+		}
+		spKeyPair.key, spKeyPair.cert = key, cert
+	})
+	return spKeyPair.key, spKeyPair.cert, spKeyPair.err
+}
+
+func newServiceProvider(orgID, metadataXML string) (*saml.ServiceProvider, error) {
+	key, cert, err := loadSPKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	idp, err := samlsp.ParseMetadata([]byte(metadataXML))
+	if err != nil {
+		return nil, err
+	}
+
+	entityID, acs := spURLs(orgID)
+	acsURL, err := url.Parse(acs)
+	if err != nil {
+		return nil, err
+	}
+	metadataURL, err := url.Parse(entityID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saml.ServiceProvider{
+		EntityID:    entityID,
+		Key:         key,
+		Certificate: cert,
+		AcsURL:      *acsURL,
+		MetadataURL: *metadataURL,
+		IDPMetadata: idp,
+		// Responses must answer a request from StartSAMLLogin; an
+		// unsolicited response could sign in whoever the IdP names.
+		AllowIDPInitiated: false,
+	}, nil
+}
+
+func mapSAMLAttributes(assertion *saml.Assertion, mapping SAMLAttributeMapping) SAMLAttributeMapping {
+	if mapping.Email == "" {
+		mapping.Email = defaultSAMLAttributes.Email
+	}
+	if mapping.Name == "" {
+		mapping.Name = defaultSAMLAttributes.Name
+	}
+	if mapping.Avatar == "" {
+		mapping.Avatar = defaultSAMLAttributes.Avatar
+	}
+
+	values := map[string]string{}
+	for _, stmt := range assertion.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			if len(attr.Values) == 0 {
+				continue
+			}
+			values[attr.Name] = attr.Values[0].Value
+			if attr.FriendlyName != "" {
+				values[attr.FriendlyName] = attr.Values[0].Value
+			}
+		}
+	}
+
+	out := SAMLAttributeMapping{
+		Email:  values[mapping.Email],
+		Name:   values[mapping.Name],
+		Avatar: values[mapping.Avatar],
+	}
+	if out.Email == "" && assertion.Subject != nil && assertion.Subject.NameID != nil {
+		out.Email = assertion.Subject.NameID.Value
+	}
+	out.Email = strings.ToLower(strings.TrimSpace(out.Email))
+	out.Name = strings.TrimSpace(out.Name)
+	return out
+}
+
+// provisionSAMLUser returns the user for the asserted email, creating it
+// and adding it to the organization on first login. An existing account
+// is only returned if it is already a member of the organization;
+// otherwise it returns the account with errSAMLAccountNotLinked, since the
+// IdP does not prove the account's owner is the one signing in.
+func provisionSAMLUser(ctx context.Context, orgID string, attrs SAMLAttributeMapping) (*User, error) {
+	user, err := getUserByEmail(ctx, attrs.Email)
+	if err != nil && err != ErrUserNotFound {
+		return nil, err
+	}
+	if user != nil {
+		var member bool
+		err := authdb.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM organization_members WHERE org_id = $1 AND user_id = $2)
+		`, orgID, user.ID).Scan(&member)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			return user, errSAMLAccountNotLinked
+		}
+		return user, nil
+	}
+
+	name := attrs.Name
+	if name == "" {
+		name = strings.Split(attrs.Email, "@")[0]
+	}
+	user = &User{
+		ID:        uuid.New().String(),
+		Email:     attrs.Email,
+		Name:      name,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+
+		Discoverable: true,
+	}
+	if attrs.Avatar != "" {
+		user.Avatar = &attrs.Avatar
+	}
+
+	// SSO users never sign in with a password; store an unusable hash.
+	hashedPassword, err := randomPasswordHash()
+	if err != nil {
+		return nil, err
+	}
+	if err := createUser(ctx, user, hashedPassword); err != nil {
+		return nil, err
+	}
+
+	result, err := authdb.Exec(ctx, `
+		INSERT INTO organization_members (org_id, user_id, role, provisioned_by)
+		VALUES ($1, $2, 'member', 'saml')
+		ON CONFLICT (org_id, user_id) DO NOTHING
+	`, orgID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected() > 0 {
+		err := webhook.Emit(ctx, &webhook.Event{Type: webhook.EventMemberProvisioned, OrgID: orgID}, map[string]string{
+			"userId":        user.ID,
+			"email":         user.Email,
+			"provisionedBy": "saml",
+		})
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to emit webhook event", "org_id", orgID, "error", err)
+		}
+	}
+	return user, nil
+}
+
+func randomPasswordHash() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(buf)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func emailDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return strings.ToLower(email[i+1:])
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"canvasai/reqctx"
+)
+
+// Session tokens grant full access to the account. When a user hands a
+// token to a script or an embedded widget they can mint a scoped token
+// instead: a short-lived user JWT with a "scopes" claim, confined by the
+// TokenScopes middleware to the endpoints those scopes allow, exactly like
+// OAuth access tokens and API keys. Scoped tokens cannot be refreshed.
+
+const (
+	defaultScopedTokenLifetime = time.Hour
+	maxScopedTokenLifetime     = 24 * time.Hour
+)
+
+// CreateScopedTokenRequest represents the scoped token request
+type CreateScopedTokenRequest struct {
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is the token lifetime in seconds (default one hour, at most a day)
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// ScopedTokenResponse carries a scoped token
+type ScopedTokenResponse struct {
+	Token     string    `json:"token"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateScopedToken issues a token for the caller restricted to the given
+// scopes. It cannot be called with a scoped token.
+//
+//encore:api auth method=POST path=/auth/tokens/scoped
+func CreateScopedToken(ctx context.Context, req *CreateScopedTokenRequest) (*ScopedTokenResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	if len(req.Scopes) == 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "at least one scope is required"}
+	}
+	for _, s := range req.Scopes {
+		if _, ok := scopeDescriptions[s]; !ok {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "unknown scope " + s}
+		}
+	}
+	lifetime := defaultScopedTokenLifetime
+	if req.ExpiresIn != 0 {
+		lifetime = time.Duration(req.ExpiresIn) * time.Second
+		if lifetime <= 0 || lifetime > maxScopedTokenLifetime {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "expires_in must be between 1 and 86400 seconds"}
+		}
+	}
+
+	user, err := getUserByID(ctx, userID)
+	if err != nil {
+		if err == ErrUserNotFound {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "user not found"}
+		}
+		reqctx.Logger(ctx).Error("failed to get user", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	now := time.Now()
+	resp := &ScopedTokenResponse{Scopes: req.Scopes, ExpiresAt: now.Add(lifetime)}
+	resp.Token, err = signToken(UserClaims{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Name:    user.Name,
+		Guest:   user.IsGuest,
+		Version: user.TokenVersion,
+		Scopes:  req.Scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(resp.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    "canvasai",
+			Subject:   user.ID,
+			ID:        uuid.New().String(),
+		},
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to generate token", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditScopedTokenCreate, userID, user.Email, true, map[string]string{"scope": strings.Join(req.Scopes, " ")})
+	return resp, nil
+}
+
+// grantedScopes returns the scopes a token is restricted to, and whether it
+// is restricted at all. OAuth access tokens issued before the scopes claim
+// existed only carry the space-separated scope.
+func (c *UserClaims) grantedScopes() ([]string, bool) {
+	if len(c.Scopes) > 0 {
+		return c.Scopes, true
+	}
+	if c.ClientID != "" {
+		return strings.Fields(c.Scope), true
+	}
+	return nil, false
+}
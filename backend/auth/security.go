@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"golang.org/x/crypto/bcrypt"
+
+	"canvasai/reqctx"
+)
+
+// Every sign-in is matched against the devices and countries the user has
+// signed in from before. An unrecognized one sends an alert whose link locks
+// the account: all sessions are revoked and the password is replaced, so the
+// owner has to choose a new one before anyone can sign in again.
+
+const (
+	securityAlertLifetime = 7 * 24 * time.Hour
+	passwordResetLifetime = time.Hour
+)
+
+// Reasons a sign-in was flagged
+const (
+	AlertNewDevice  = "new_device"
+	AlertNewCountry = "new_country"
+)
+
+// SecureAccountRequest carries the token from a security alert link
+type SecureAccountRequest struct {
+	Token string `json:"token"`
+}
+
+// SecureAccountResponse represents the secure account response
+type SecureAccountResponse struct {
+	Email string `json:"email"`
+	// ResetToken lets the caller choose a new password right away
+	ResetToken string    `json:"resetToken"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// ResetPasswordRequest represents the password reset request payload
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// loginFingerprint identifies where a sign-in came from
+type loginFingerprint struct {
+	DeviceHash  string
+	DeviceLabel string
+	Country     string
+	IP          string
+}
+
+func fingerprintFrom(ctx context.Context) loginFingerprint {
+	info := reqctx.From(ctx)
+	label := describeDevice(info.UserAgent)
+	sum := sha256.Sum256([]byte(label))
+	fp := loginFingerprint{
+		DeviceHash:  hex.EncodeToString(sum[:]),
+		DeviceLabel: label,
+		Country:     info.Country,
+	}
+	// Only well-formed addresses can be stored as INET
+	if ip := net.ParseIP(info.IP); ip != nil {
+		fp.IP = ip.String()
+	}
+	return fp
+}
+
+// checkLoginFingerprint records where user signed in from and emails a
+// security alert when it is a device or country not seen before. The first
+// sign-in only establishes the baseline. Failures are logged, never returned,
+// so that alerting cannot block a sign-in.
+func checkLoginFingerprint(ctx context.Context, user *User) {
+	if user.IsGuest {
+		return
+	}
+	log := reqctx.Logger(ctx)
+	fp := fingerprintFrom(ctx)
+
+	var known, knownDevice, knownCountry bool
+	err := authdb.QueryRow(ctx, `
+		SELECT
+			EXISTS(SELECT 1 FROM login_fingerprints WHERE user_id = $1),
+			EXISTS(SELECT 1 FROM login_fingerprints WHERE user_id = $1 AND device_hash = $2),
+			EXISTS(SELECT 1 FROM login_fingerprints WHERE user_id = $1 AND country = $3)
+	`, user.ID, fp.DeviceHash, fp.Country).Scan(&known, &knownDevice, &knownCountry)
+	if err != nil {
+		log.Error("failed to check login fingerprint", "error", err)
+		return
+	}
+
+	_, err = authdb.Exec(ctx, `
+		INSERT INTO login_fingerprints (user_id, device_hash, device_label, country, last_ip)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::inet)
+		ON CONFLICT (user_id, device_hash, country) DO UPDATE
+		SET last_ip = EXCLUDED.last_ip, last_seen_at = NOW()
+	`, user.ID, fp.DeviceHash, fp.DeviceLabel, fp.Country, fp.IP)
+	if err != nil {
+		log.Error("failed to record login fingerprint", "error", err)
+		return
+	}
+	if !known {
+		return
+	}
+
+	var reasons []string
+	if !knownDevice {
+		reasons = append(reasons, AlertNewDevice)
+	}
+	// An unknown location is not evidence of a new one.
+	if !knownCountry && fp.Country != "" {
+		reasons = append(reasons, AlertNewCountry)
+	}
+	if len(reasons) == 0 {
+		return
+	}
+	if err := sendSecurityAlert(ctx, user, fp, reasons); err != nil {
+		log.Error("failed to send security alert", "error", err)
+		return
+	}
+	recordAuthEvent(ctx, AuditSuspiciousLogin, user.ID, user.Email, true, map[string]string{
+		"reasons": strings.Join(reasons, ","),
+		"device":  fp.DeviceLabel,
+	})
+}
+
+func sendSecurityAlert(ctx context.Context, user *User, fp loginFingerprint, reasons []string) error {
+	token, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	_, err = authdb.Exec(ctx, `
+		INSERT INTO security_alerts (user_id, token_hash, reasons, device_label, country, ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::inet, $7)
+	`, user.ID, hashSecretToken(token), reasons, fp.DeviceLabel, fp.Country, fp.IP, time.Now().Add(securityAlertLifetime))
+	if err != nil {
+		return err
+	}
+
+	location, ip := fp.Country, fp.IP
+	if location == "" {
+		location = "Unknown"
+	}
+	if ip == "" {
+		ip = "Unknown"
+	}
+	body := fmt.Sprintf(`Hi %s,
+
+Your CanvasAI account was just signed in to from a device or location we haven't seen before.
+
+Device: %s
+Location: %s
+IP address: %s
+Time: %s
+
+If this was you, you can ignore this email.
+
+If it wasn't, secure your account now. This signs you out everywhere and asks you to choose a new password:
+%s
+
+This link expires in 7 days.
+`, user.Name, fp.DeviceLabel, location, ip, time.Now().UTC().Format("2 Jan 2006 15:04 MST"),
+		frontendLink("/account/secure?token="+url.QueryEscape(token)))
+
+	return sendEmail(ctx, user.Email, "New sign-in to your CanvasAI account", body)
+}
+
+// SecureAccount locks an account from a security alert link: it signs the
+// user out everywhere and replaces the password, returning a token for
+// choosing a new one.
+//
+//encore:api public method=POST path=/auth/secure-account
+func SecureAccount(ctx context.Context, req *SecureAccountRequest) (*SecureAccountResponse, error) {
+	resetToken, err := newSecretToken()
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	lockedHash, err := randomPasswordHash()
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to hash password", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	tx, err := authdb.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(ctx, `
+		UPDATE security_alerts SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashSecretToken(req.Token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "security link is invalid or has expired"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to use security alert", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	expiresAt := time.Now().Add(passwordResetLifetime)
+	var email string
+	err = tx.QueryRow(ctx, `
+		UPDATE users
+		SET password_hash = $2, token_version = token_version + 1,
+			reset_token = $3, reset_token_expires_at = $4, updated_at = NOW()
+		WHERE id = $1
+		RETURNING email
+	`, userID, lockedHash, hashSecretToken(resetToken), expiresAt).Scan(&email)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to lock account", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	// One lock is enough; the other outstanding alerts are moot now.
+	if _, err := tx.Exec(ctx, `UPDATE security_alerts SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, userID); err != nil {
+		reqctx.Logger(ctx).Error("failed to expire security alerts", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := tx.Commit(); err != nil {
+		reqctx.Logger(ctx).Error("failed to commit account lock", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+
+	recordAuthEvent(ctx, AuditAccountSecured, userID, email, true, nil)
+
+	return &SecureAccountResponse{
+		Email:      email,
+		ResetToken: resetToken,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// ResetPassword sets a new password using a reset token and signs the user
+// out everywhere.
+//
+//encore:api public method=POST path=/auth/password/reset
+func ResetPassword(ctx context.Context, req *ResetPasswordRequest) error {
+	var user User
+	err := authdb.QueryRow(ctx, `
+		SELECT id, email, name FROM users
+		WHERE reset_token = $1 AND reset_token_expires_at > NOW()
+	`, hashSecretToken(req.Token)).Scan(&user.ID, &user.Email, &user.Name)
+	if err == sql.ErrNoRows {
+		return &errs.Error{Code: errs.NotFound, Message: "reset link is invalid or has expired"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to get reset token", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if err := checkPassword(ctx, req.NewPassword, user.Email, user.Name); err != nil {
+		return err
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to hash password", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	result, err := authdb.Exec(ctx, `
+		UPDATE users
+		SET password_hash = $2, reset_token = NULL, reset_token_expires_at = NULL,
+			token_version = token_version + 1, updated_at = NOW()
+		WHERE id = $1 AND reset_token = $3
+	`, user.ID, string(newHash), hashSecretToken(req.Token))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to reset password", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{Code: errs.NotFound, Message: "reset link is invalid or has expired"}
+	}
+
+	recordAuthEvent(ctx, AuditPasswordReset, user.ID, user.Email, true, nil)
+	return nil
+}
+
+// describeDevice reduces a User-Agent to a coarse "browser on OS" label.
+// Version numbers are dropped so routine browser updates aren't flagged.
+func describeDevice(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "firefox/") || strings.Contains(ua, "fxios/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome/") || strings.Contains(ua, "crios/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	case strings.Contains(ua, "canvasai"):
+		browser = "CanvasAI app"
+	}
+
+	os := "unknown OS"
+	switch {
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad"):
+		os = "iOS"
+	case strings.Contains(ua, "android"):
+		os = "Android"
+	case strings.Contains(ua, "windows"):
+		os = "Windows"
+	case strings.Contains(ua, "mac os x") || strings.Contains(ua, "macintosh"):
+		os = "macOS"
+	case strings.Contains(ua, "cros"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "linux"):
+		os = "Linux"
+	}
+	return browser + " on " + os
+}
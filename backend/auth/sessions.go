@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Tokens are stateless, so revoking them works by bumping the user's token
+// version: tokens carrying an older version are rejected on their next use.
+// Single tokens are revoked by ID on logout (see logout.go).
+
+// checkTokenVersion rejects tokens issued before the user's sessions were
+// last revoked.
+func checkTokenVersion(ctx context.Context, claims *UserClaims) error {
+	var version int
+	err := authdb.QueryRow(ctx, `SELECT token_version FROM users WHERE id = $1`, claims.UserID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	if claims.Version != version {
+		return ErrInvalidToken
+	}
+	return nil
+}
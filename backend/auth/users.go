@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+	"canvasai/sqlutil"
+)
+
+// UserSummary is the public view of a user shown in sharing dialogs
+type UserSummary struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Email  string  `json:"email,omitempty"`
+	Avatar *string `json:"avatar,omitempty"`
+}
+
+// SearchUsersRequest represents the user search request
+type SearchUsersRequest struct {
+	Q     string `query:"q"`
+	Limit int    `query:"limit"`
+}
+
+// LookupUsersRequest represents the batch user lookup request
+type LookupUsersRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// UsersResponse represents a list of users
+type UsersResponse struct {
+	Users []UserSummary `json:"users"`
+}
+
+const (
+	minSearchLength    = 2
+	defaultSearchLimit = 10
+	maxSearchLimit     = 20
+	maxLookupIDs       = 100
+)
+
+var searchLimiter = ratelimit.New(ratelimit.Limit{Requests: 30, Per: time.Minute})
+
+// SearchUsers finds users to invite. To keep the directory from being
+// enumerated, partial name or email matches only include people who already
+// share an organization or project with the caller; anyone else is found
+// only by their exact email address.
+//
+//encore:api auth method=GET path=/users/search
+func SearchUsers(ctx context.Context, req *SearchUsersRequest) (*UsersResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	if !searchLimiter.Allow(userID) {
+		return nil, &errs.Error{Code: errs.ResourceExhausted, Message: "too many searches, try again shortly"}
+	}
+
+	q := strings.TrimSpace(req.Q)
+	if len(q) < minSearchLength {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "query must be at least 2 characters"}
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT u.id, u.name, u.email, u.avatar
+		FROM users u
+		WHERE u.id <> $1 AND NOT u.is_guest AND u.deactivated_at IS NULL AND (
+			lower(u.email) = lower($2)
+			OR ((u.name ILIKE $3 OR u.email ILIKE $3) AND (
+				EXISTS (
+					SELECT 1 FROM organization_members mine
+					JOIN organization_members theirs ON theirs.org_id = mine.org_id
+					WHERE mine.user_id = $1 AND theirs.user_id = u.id
+				)
+				OR EXISTS (
+					SELECT 1 FROM project_collaborators mine
+					JOIN project_collaborators theirs ON theirs.project_id = mine.project_id
+					WHERE mine.user_id = $1 AND theirs.user_id = u.id
+				)
+			))
+		)
+		ORDER BY lower(u.email) = lower($2) DESC, u.name
+		LIMIT $4
+	`, userID, q, "%"+sqlutil.EscapeLike(q)+"%", limit)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to search users", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	return scanUserSummaries(rows, true)
+}
+
+// LookupUsers resolves user IDs to names and avatars. Emails are not
+// included. Only the caller, people who share an organization or project
+// with them, and discoverable users are resolved; anyone else, unknown and
+// deactivated IDs are omitted.
+//
+//encore:api auth method=POST path=/users/lookup
+func LookupUsers(ctx context.Context, req *LookupUsersRequest) (*UsersResponse, error) {
+	userID := encoreauth.UserID()
+	if userID == "" {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	if len(req.IDs) > maxLookupIDs {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "at most 100 ids can be looked up at once"}
+	}
+	if len(req.IDs) == 0 {
+		return &UsersResponse{Users: []UserSummary{}}, nil
+	}
+	if !searchLimiter.Allow(userID) {
+		return nil, &errs.Error{Code: errs.ResourceExhausted, Message: "too many lookups, try again shortly"}
+	}
+
+	rows, err := authdb.Query(ctx, `
+		SELECT u.id, u.name, u.email, u.avatar
+		FROM users u
+		WHERE u.id::text = ANY($2) AND u.deactivated_at IS NULL AND (
+			u.id = $1
+			OR u.discoverable
+			OR EXISTS (
+				SELECT 1 FROM organization_members mine
+				JOIN organization_members theirs ON theirs.org_id = mine.org_id
+				WHERE mine.user_id = $1 AND theirs.user_id = u.id
+			)
+			OR EXISTS (
+				SELECT 1 FROM project_collaborators mine
+				JOIN project_collaborators theirs ON theirs.project_id = mine.project_id
+				WHERE mine.user_id = $1 AND theirs.user_id = u.id
+			)
+		)
+		ORDER BY u.name
+	`, userID, req.IDs)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to look up users", "error", err)
+		return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	defer rows.Close()
+
+	return scanUserSummaries(rows, false)
+}
+
+func scanUserSummaries(rows *sqldb.Rows, withEmail bool) (*UsersResponse, error) {
+	resp := &UsersResponse{Users: []UserSummary{}}
+	for rows.Next() {
+		var u UserSummary
+		var avatar sql.NullString
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &avatar); err != nil {
+			return nil, &errs.Error{Code: errs.Internal, Message: "internal server error"}
+		}
+		if avatar.Valid {
+			u.Avatar = &avatar.String
+		}
+		if !withEmail {
+			u.Email = ""
+		}
+		resp.Users = append(resp.Users, u)
+	}
+	return resp, nil
+}
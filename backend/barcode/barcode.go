@@ -0,0 +1,117 @@
+// Package barcode encodes values as barcodes for canvas barcode elements:
+// EAN-13 and EAN-8 for retail packaging, Code 128 for labels and QR codes.
+// It produces the grid of dark and light modules only; the renderer and
+// the SVG preview decide how large to draw them, so output stays crisp at
+// any size.
+package barcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Formats
+const (
+	FormatEAN13   = "ean13"
+	FormatEAN8    = "ean8"
+	FormatCode128 = "code128"
+	FormatQR      = "qr"
+)
+
+// ErrEmpty is returned when there is nothing to encode.
+var ErrEmpty = errors.New("barcode: value is empty")
+
+// Code is an encoded barcode
+type Code struct {
+	Format string
+	// Width and Height count modules, without the quiet zone. Linear
+	// codes are one module high and are stretched to the element's
+	// height.
+	Width, Height int
+	// QuietZone is the blank margin the format requires on each side, in
+	// modules. Linear codes only need it left and right.
+	QuietZone int
+	// Text is the human-readable line printed under linear codes,
+	// including any check digit added.
+	Text string
+
+	modules []bool
+}
+
+// Linear reports whether the code is a single row of bars.
+func (c *Code) Linear() bool { return c.Format != FormatQR }
+
+// Dark reports whether the module at x, y is dark.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Width || y >= c.Height {
+		return false
+	}
+	return c.modules[y*c.Width+x]
+}
+
+// Bar is a run of dark modules in a row
+type Bar struct {
+	X, Width int
+}
+
+// Bars returns the runs of dark modules in row y, left to right. Drawing
+// runs rather than single modules avoids hairline seams between them.
+func (c *Code) Bars(y int) []Bar {
+	var bars []Bar
+	for x := 0; x < c.Width; x++ {
+		if !c.Dark(x, y) {
+			continue
+		}
+		start := x
+		for x < c.Width && c.Dark(x, y) {
+			x++
+		}
+		bars = append(bars, Bar{X: start, Width: x - start})
+	}
+	return bars
+}
+
+// Options tune the encoding
+type Options struct {
+	// ErrorCorrection is the QR error correction level: L, M (the
+	// default), Q or H
+	ErrorCorrection string
+}
+
+// Encode encodes value in format.
+func Encode(format, value string, opts Options) (*Code, error) {
+	if value == "" {
+		return nil, ErrEmpty
+	}
+	switch strings.ToLower(format) {
+	case FormatEAN13:
+		return encodeEAN(value, 13)
+	case FormatEAN8:
+		return encodeEAN(value, 8)
+	case FormatCode128:
+		return encodeCode128(value)
+	case FormatQR:
+		return encodeQR(value, opts.ErrorCorrection)
+	}
+	return nil, fmt.Errorf("barcode: unknown format %q", format)
+}
+
+// ValidFormat reports whether format is one Encode supports.
+func ValidFormat(format string) bool {
+	switch strings.ToLower(format) {
+	case FormatEAN13, FormatEAN8, FormatCode128, FormatQR:
+		return true
+	}
+	return false
+}
+
+// linear returns a one-row code from a string of '1' (dark) and '0'
+// modules.
+func linear(format, pattern, text string, quiet int) *Code {
+	modules := make([]bool, len(pattern))
+	for i, m := range pattern {
+		modules[i] = m == '1'
+	}
+	return &Code{Format: format, Width: len(pattern), Height: 1, QuietZone: quiet, Text: text, modules: modules}
+}
@@ -0,0 +1,108 @@
+package barcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// code128Widths are the bar and space widths of each Code 128 symbol,
+// starting with a bar. Symbols 103 to 105 start code sets A, B and C, and
+// 106 is the stop pattern, which has a final bar.
+var code128Widths = [107]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128CodeC  = 99
+	code128CodeB  = 100
+	code128StartB = 104
+	code128StartC = 105
+	code128Stop   = 106
+)
+
+// encodeCode128 encodes printable ASCII. Runs of digits are packed two to
+// a symbol in code set C when that makes the barcode shorter; everything
+// else uses code set B.
+func encodeCode128(value string) (*Code, error) {
+	for _, r := range value {
+		if r < 32 || r > 126 {
+			return nil, fmt.Errorf("barcode: code128 values are printable ASCII only")
+		}
+	}
+
+	var symbols []int
+	setC := false
+	for i := 0; i < len(value); {
+		run := digitRun(value[i:])
+		// Switching to C pays off for 4 digits at the start or end and 6 in
+		// the middle. An odd run leaves one digit in B: its first when it
+		// ends the value, so the barcode ends in C, and otherwise its last.
+		atEnd := i > 0 && i+run == len(value)
+		worth := run >= 6 || (run >= 4 && (i == 0 || atEnd))
+		if worth && run%2 == 1 {
+			if atEnd {
+				worth = false
+			}
+			run--
+		}
+		switch {
+		case worth:
+			if len(symbols) == 0 {
+				symbols = append(symbols, code128StartC)
+			} else if !setC {
+				symbols = append(symbols, code128CodeC)
+			}
+			setC = true
+			for j := 0; j < run; j += 2 {
+				symbols = append(symbols, int(value[i+j]-'0')*10+int(value[i+j+1]-'0'))
+			}
+			i += run
+		default:
+			if len(symbols) == 0 {
+				symbols = append(symbols, code128StartB)
+			} else if setC {
+				symbols = append(symbols, code128CodeB)
+			}
+			setC = false
+			symbols = append(symbols, int(value[i])-32)
+			i++
+		}
+	}
+
+	check := symbols[0]
+	for i, s := range symbols[1:] {
+		check += (i + 1) * s
+	}
+	symbols = append(symbols, check%103, code128Stop)
+
+	var b strings.Builder
+	for _, s := range symbols {
+		for i, w := range code128Widths[s] {
+			m := "1"
+			if i%2 == 1 {
+				m = "0"
+			}
+			b.WriteString(strings.Repeat(m, int(w-'0')))
+		}
+	}
+	return linear(FormatCode128, b.String(), value, 10), nil
+}
+
+// digitRun counts the digits s starts with.
+func digitRun(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,91 @@
+package barcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EAN digits are drawn in one of three encodings: L and G on the left half
+// and R on the right. R is L inverted and G is R reversed. In EAN-13 the
+// first digit is not drawn but chooses which left digits use G.
+var eanL = [10]string{
+	"0001101", "0011001", "0010011", "0111101", "0100011",
+	"0110001", "0101111", "0111011", "0110111", "0001011",
+}
+
+var ean13Parity = [10]string{
+	"LLLLLL", "LLGLGG", "LLGGLG", "LLGGGL", "LGLLGG",
+	"LGGLLG", "LGGGLL", "LGLGLG", "LGLGGL", "LGGLGL",
+}
+
+// encodeEAN encodes an EAN of length digits. The check digit may be left
+// off and is then added; if given it must be right.
+func encodeEAN(value string, length int) (*Code, error) {
+	format := FormatEAN13
+	if length == 8 {
+		format = FormatEAN8
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("barcode: %s values are digits only", format)
+		}
+	}
+	switch len(value) {
+	case length - 1:
+		value += string(rune('0' + eanCheckDigit(value)))
+	case length:
+		if int(value[length-1]-'0') != eanCheckDigit(value[:length-1]) {
+			return nil, fmt.Errorf("barcode: %s check digit is wrong", format)
+		}
+	default:
+		return nil, fmt.Errorf("barcode: %s values have %d or %d digits", format, length-1, length)
+	}
+
+	var b strings.Builder
+	b.WriteString("101")
+	left, right := value[:length/2], value[length-length/2:]
+	parity := strings.Repeat("L", len(left))
+	if length == 13 {
+		parity = ean13Parity[value[0]-'0']
+		left = value[1:7]
+	}
+	for i := range left {
+		b.WriteString(eanDigit(left[i], parity[i]))
+	}
+	b.WriteString("01010")
+	for i := range right {
+		b.WriteString(eanDigit(right[i], 'R'))
+	}
+	b.WriteString("101")
+	return linear(format, b.String(), value, 11), nil
+}
+
+func eanDigit(d, encoding byte) string {
+	l := eanL[d-'0']
+	if encoding == 'L' {
+		return l
+	}
+	r := []byte(l)
+	for i := range r {
+		r[i] ^= 1 // '0' <-> '1'
+	}
+	if encoding == 'G' {
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+	}
+	return string(r)
+}
+
+// eanCheckDigit weights the digits 3, 1, 3, ... from the right.
+func eanCheckDigit(digits string) int {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-1-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
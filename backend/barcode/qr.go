@@ -0,0 +1,534 @@
+package barcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// QR codes follow ISO/IEC 18004. A value is encoded as a single segment in
+// the most compact mode it fits (numeric, alphanumeric or bytes) and in the
+// smallest version (size) that holds it at the requested error correction
+// level. Of the eight data masks, the one with the lowest penalty score is
+// used.
+
+// ErrTooLong is returned for values that do not fit in the largest QR code.
+var ErrTooLong = errors.New("barcode: value is too long for a QR code")
+
+// Error correction levels in table order
+const (
+	eccL = iota
+	eccM
+	eccQ
+	eccH
+)
+
+// qrFormatBits are the levels' codes in the format information
+var qrFormatBits = [4]int{eccL: 1, eccM: 0, eccQ: 3, eccH: 2}
+
+// qrECCPerBlock and qrBlocks give, per level and version, the error
+// correction codewords of each block and the number of blocks.
+var qrECCPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var qrBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+const qrAlphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// qrMode is a segment encoding
+type qrMode struct {
+	indicator int
+	// countBits is the width of the character count for versions 1-9,
+	// 10-26 and 27-40
+	countBits [3]int
+}
+
+var (
+	qrNumeric = qrMode{1, [3]int{10, 12, 14}}
+	qrAlnum   = qrMode{2, [3]int{9, 11, 13}}
+	qrByte    = qrMode{4, [3]int{8, 16, 16}}
+)
+
+func encodeQR(value, level string) (*Code, error) {
+	ecl := eccM
+	switch strings.ToUpper(level) {
+	case "":
+	case "L":
+		ecl = eccL
+	case "M":
+		ecl = eccM
+	case "Q":
+		ecl = eccQ
+	case "H":
+		ecl = eccH
+	default:
+		return nil, fmt.Errorf("barcode: QR error correction must be L, M, Q or H")
+	}
+	if !utf8.ValidString(value) {
+		return nil, fmt.Errorf("barcode: QR values must be UTF-8")
+	}
+
+	mode, count := qrByte, len(value)
+	switch {
+	case strings.Trim(value, "0123456789") == "":
+		mode = qrNumeric
+	case strings.Trim(value, qrAlphanumeric) == "":
+		mode = qrAlnum
+	}
+
+	for version := 1; version <= 40; version++ {
+		countBits := mode.countBits[0]
+		if version >= 27 {
+			countBits = mode.countBits[2]
+		} else if version >= 10 {
+			countBits = mode.countBits[1]
+		}
+		capacity := qrDataCodewords(version, ecl) * 8
+		if count >= 1<<countBits || 4+countBits+qrDataBits(mode, value) > capacity {
+			continue
+		}
+
+		var bits bitBuffer
+		bits.append(mode.indicator, 4)
+		bits.append(count, countBits)
+		appendQRData(&bits, mode, value)
+		bits.append(0, min(4, capacity-len(bits)))
+		bits.append(0, (8-len(bits)%8)%8)
+		for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+			bits.append(pad, 8)
+		}
+		return drawQR(version, ecl, addECC(bits.bytes(), version, ecl)), nil
+	}
+	return nil, ErrTooLong
+}
+
+func qrDataBits(mode qrMode, value string) int {
+	n := len(value)
+	switch mode {
+	case qrNumeric:
+		return n/3*10 + [3]int{0, 4, 7}[n%3]
+	case qrAlnum:
+		return n/2*11 + n%2*6
+	}
+	return n * 8
+}
+
+func appendQRData(bits *bitBuffer, mode qrMode, value string) {
+	switch mode {
+	case qrNumeric:
+		for i := 0; i < len(value); i += 3 {
+			group := value[i:min(i+3, len(value))]
+			n := 0
+			for _, d := range group {
+				n = n*10 + int(d-'0')
+			}
+			bits.append(n, len(group)*3+1)
+		}
+	case qrAlnum:
+		for i := 0; i < len(value); i += 2 {
+			if i+1 < len(value) {
+				bits.append(strings.IndexByte(qrAlphanumeric, value[i])*45+strings.IndexByte(qrAlphanumeric, value[i+1]), 11)
+			} else {
+				bits.append(strings.IndexByte(qrAlphanumeric, value[i]), 6)
+			}
+		}
+	default:
+		for i := 0; i < len(value); i++ {
+			bits.append(int(value[i]), 8)
+		}
+	}
+}
+
+// qrRawModules is the number of modules of a version available for data
+// and error correction, after the function patterns.
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version, ecl int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[ecl][version]*qrBlocks[ecl][version]
+}
+
+// addECC splits data into blocks, appends each block's Reed-Solomon
+// codewords and interleaves the blocks.
+func addECC(data []byte, version, ecl int) []byte {
+	numBlocks := qrBlocks[ecl][version]
+	eccLen := qrECCPerBlock[ecl][version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := append([]byte{}, data[k:k+n]...)
+		k += n
+		block = append(block, rsRemainder(block, divisor)...)
+		if i < numShort {
+			// Pad short blocks so the columns line up when interleaving.
+			block = append(block[:n], append([]byte{0}, block[n:]...)...)
+		}
+		blocks[i] = block
+	}
+
+	out := make([]byte, 0, raw)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of a degree,
+// highest coefficient first and the leading 1 left out.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrGrid is a QR code being drawn. Function modules (finder, timing and
+// alignment patterns, format and version information) are not masked.
+type qrGrid struct {
+	size     int
+	dark     [][]bool
+	function [][]bool
+}
+
+func (g *qrGrid) set(x, y int, dark bool) {
+	g.dark[y][x] = dark
+	g.function[y][x] = true
+}
+
+func drawQR(version, ecl int, codewords []byte) *Code {
+	size := version*4 + 17
+	g := &qrGrid{size: size, dark: make([][]bool, size), function: make([][]bool, size)}
+	for i := range g.dark {
+		g.dark[i] = make([]bool, size)
+		g.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		g.set(6, i, i%2 == 0)
+		g.set(i, 6, i%2 == 0)
+	}
+	g.finder(3, 3)
+	g.finder(size-4, 3)
+	g.finder(3, size-4)
+	align := qrAlignment(version)
+	last := len(align) - 1
+	for i, x := range align {
+		for j, y := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			g.alignment(x, y)
+		}
+	}
+	g.format(ecl, 0) // reserve the format area before placing data
+	g.version(version)
+	g.codewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		g.mask(mask)
+		g.format(ecl, mask)
+		if p := g.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		g.mask(mask) // masking twice undoes it
+	}
+	g.mask(best)
+	g.format(ecl, best)
+
+	modules := make([]bool, 0, size*size)
+	for _, row := range g.dark {
+		modules = append(modules, row...)
+	}
+	return &Code{Format: FormatQR, Width: size, Height: size, QuietZone: 4, modules: modules}
+}
+
+// finder draws a finder pattern centered at x, y with its separator.
+func (g *qrGrid) finder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= g.size || yy >= g.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			g.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+func (g *qrGrid) alignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			g.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// qrAlignment returns the row and column positions of a version's
+// alignment patterns.
+func qrAlignment(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, pos := n-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+func (g *qrGrid) format(ecl, mask int) {
+	data := qrFormatBits[ecl]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		g.set(8, i, bit(i))
+	}
+	g.set(8, 7, bit(6))
+	g.set(8, 8, bit(7))
+	g.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		g.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		g.set(g.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		g.set(8, g.size-15+i, bit(i))
+	}
+	g.set(8, g.size-8, true)
+}
+
+func (g *qrGrid) version(version int) {
+	if version < 7 {
+		return
+	}
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 != 0
+		a, b := g.size-11+i%3, i/3
+		g.set(a, b, dark)
+		g.set(b, a, dark)
+	}
+}
+
+// codewords places the data in the zigzag order, two columns at a time
+// from the bottom right, skipping the vertical timing pattern.
+func (g *qrGrid) codewords(data []byte) {
+	i := 0
+	for right := g.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < g.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = g.size - 1 - vert
+				}
+				if !g.function[y][x] && i < len(data)*8 {
+					g.dark[y][x] = (data[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (g *qrGrid) mask(mask int) {
+	for y := 0; y < g.size; y++ {
+		for x := 0; x < g.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !g.function[y][x] {
+				g.dark[y][x] = !g.dark[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the grid by the four rules of the standard: long runs of
+// one color, 2×2 blocks, finder-like patterns and an unbalanced number of
+// dark modules.
+func (g *qrGrid) penalty() int {
+	n := g.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return g.dark[x][y]
+		}
+		return g.dark[y][x]
+	}
+
+	score := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			// 1:1:3:1:1 dark-light pattern with four light modules on
+			// one side
+			for x := 0; x+11 <= n; x++ {
+				var line [11]bool
+				for k := range line {
+					line[k] = at(x+k, y, transpose)
+				}
+				if line == qrFinderLike || line == qrFinderLikeReversed {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if g.dark[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := g.dark[y][x]
+				if c == g.dark[y][x+1] && c == g.dark[y+1][x] && c == g.dark[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	// Ten points for every 5% away from half dark.
+	k := (abs(dark*20-total*10) + total - 1) / total
+	score += max(k-1, 0) * 10
+	return score
+}
+
+var (
+	qrFinderLike         = [11]bool{true, false, true, true, true, false, true, false, false, false, false}
+	qrFinderLikeReversed = [11]bool{false, false, false, false, true, false, true, true, true, false, true}
+)
+
+// bitBuffer is a sequence of bits, most significant first
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 != 0)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, (len(b)+7)/8)
+	for i, bit := range b {
+		if bit {
+			out[i>>3] |= 0x80 >> (i & 7)
+		}
+	}
+	return out
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
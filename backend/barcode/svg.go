@@ -0,0 +1,48 @@
+package barcode
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// linearAspect is the height of a linear code's bars as a fraction of its
+// width, quiet zone included, in the SVG preview
+const linearAspect = 0.35
+
+// SVG draws the code with its quiet zone on a white background, one user
+// unit per module, so it scales without blurring. Linear codes get their
+// text underneath when withText is set.
+func (c *Code) SVG(withText bool) []byte {
+	q := c.QuietZone
+	w := c.Width + 2*q
+	h := c.Height + 2*q
+	barHeight := float64(c.Height)
+	if c.Linear() {
+		barHeight = float64(w) * linearAspect
+		h = int(barHeight)
+		if withText {
+			h += 10
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, w, h)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, w, h)
+	for y := 0; y < c.Height; y++ {
+		top, height := float64(y+q), 1.0
+		if c.Linear() {
+			top, height = 0, barHeight
+		}
+		for _, bar := range c.Bars(y) {
+			fmt.Fprintf(&b, "M%d %gh%dv%gh-%dz", bar.X+q, top, bar.Width, height, bar.Width)
+		}
+	}
+	b.WriteString(`"/>`)
+	if c.Linear() && withText {
+		fmt.Fprintf(&b, `<text x="%g" y="%d" font-family="monospace" font-size="9" text-anchor="middle">%s</text>`,
+			float64(w)/2, h-1, html.EscapeString(c.Text))
+	}
+	b.WriteString(`</svg>`)
+	return []byte(b.String())
+}
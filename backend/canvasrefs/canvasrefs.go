@@ -0,0 +1,237 @@
+// Package canvasrefs finds and rewrites the asset, font and component
+// references embedded in canvas documents, so that copying a document to
+// another owner never carries URLs that point at the source tenant's files.
+package canvasrefs
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of resource a reference points to
+type Kind string
+
+const (
+	KindAsset     Kind = "asset"
+	KindFont      Kind = "font"
+	KindComponent Kind = "component"
+)
+
+// Action describes what happened to a reference during a rewrite
+type Action string
+
+const (
+	ActionKept     Action = "kept"     // reference was already valid for the destination
+	ActionRelinked Action = "relinked" // reference now points at an existing destination resource
+	ActionCopied   Action = "copied"   // resource was copied for the destination
+	ActionRemoved  Action = "removed"  // reference could not be carried over and was dropped
+)
+
+// Ref is a single reference found in a canvas document
+type Ref struct {
+	Kind  Kind   `json:"kind"`
+	Path  string `json:"path"` // JSON pointer into the document
+	Value string `json:"value"`
+	ID    string `json:"id,omitempty"` // Referenced resource ID, when it is one of ours
+}
+
+// Mapping records how a reference was rewritten
+type Mapping struct {
+	Ref
+	To     string `json:"to,omitempty"`
+	Action Action `json:"action"`
+}
+
+// Report summarises a rewrite
+type Report struct {
+	Mappings []Mapping      `json:"mappings"`
+	Counts   map[Action]int `json:"counts"`
+}
+
+// Resolver decides how a reference is carried into the destination document.
+// It returns the replacement value and the action taken; ActionRemoved drops
+// the property from the document.
+type Resolver func(ref Ref) (to string, action Action, err error)
+
+// Property names that hold references, by kind.
+var refKeys = map[string]Kind{
+	"src":             KindAsset,
+	"source":          KindAsset,
+	"assetId":         KindAsset,
+	"assetUrl":        KindAsset,
+	"backgroundImage": KindAsset,
+	"overlayImage":    KindAsset,
+	"fontUrl":         KindFont,
+	"fontAssetId":     KindFont,
+	"componentId":     KindComponent,
+}
+
+// idKeys hold bare resource IDs rather than URLs.
+var idKeys = map[string]bool{
+	"assetId":     true,
+	"fontAssetId": true,
+	"componentId": true,
+}
+
+var (
+	uuidPattern     = `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`
+	assetURLPattern = regexp.MustCompile(`(?:^|/)assets/(` + uuidPattern + `)(?:[/?#]|$)`)
+	versionPattern  = regexp.MustCompile(`(?:^|/)assets/` + uuidPattern + `/versions/([1-9][0-9]*)/content(?:[?#]|$)`)
+	uploadPattern   = regexp.MustCompile(`(?:^|/)uploads/` + uuidPattern + `/`)
+	uuidOnly        = regexp.MustCompile(`^` + uuidPattern + `$`)
+)
+
+// AssetURL returns the canonical URL a canvas document uses for an asset.
+func AssetURL(assetID string) string {
+	return "/assets/" + assetID + "/content"
+}
+
+// VersionedAssetURL returns the URL a canvas document uses for one version
+// of an asset, which keeps showing that file after the asset is replaced.
+func VersionedAssetURL(assetID string, version int) string {
+	return "/assets/" + assetID + "/versions/" + strconv.Itoa(version) + "/content"
+}
+
+// ParseAssetVersion extracts the version from a versioned asset URL.
+func ParseAssetVersion(value string) (int, bool) {
+	if m := versionPattern.FindStringSubmatch(value); m != nil {
+		if v, err := strconv.Atoi(m[1]); err == nil {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// ParseAssetID extracts the asset ID from a canonical asset URL.
+func ParseAssetID(value string) (string, bool) {
+	if m := assetURLPattern.FindStringSubmatch(value); m != nil {
+		return strings.ToLower(m[1]), true
+	}
+	return "", false
+}
+
+// IsTenantStoragePath reports whether value is a raw storage path, which
+// embeds the uploading user's ID and must never leave its tenant.
+func IsTenantStoragePath(value string) bool {
+	return uploadPattern.MatchString(value)
+}
+
+// Find returns every reference in doc, in document order.
+func Find(doc any) []Ref {
+	var refs []Ref
+	walk(doc, "", func(parent map[string]any, key, path string, ref Ref) {
+		refs = append(refs, ref)
+	})
+	return refs
+}
+
+// Rewrite returns a deep copy of doc with every reference passed through
+// resolve, plus a report of what was done. doc is not modified.
+func Rewrite(doc any, resolve Resolver) (any, *Report, error) {
+	out := deepCopy(doc)
+	report := &Report{Counts: map[Action]int{}}
+
+	var firstErr error
+	walk(out, "", func(parent map[string]any, key, path string, ref Ref) {
+		if firstErr != nil {
+			return
+		}
+		to, action, err := resolve(ref)
+		if err != nil {
+			firstErr = err
+			return
+		}
+		switch action {
+		case ActionRemoved:
+			delete(parent, key)
+			to = ""
+		case ActionKept:
+			to = ref.Value
+		default:
+			parent[key] = to
+		}
+		report.Mappings = append(report.Mappings, Mapping{Ref: ref, To: to, Action: action})
+		report.Counts[action]++
+	})
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	return out, report, nil
+}
+
+type visitor func(parent map[string]any, key, path string, ref Ref)
+
+func walk(node any, path string, visit visitor) {
+	switch v := node.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPath := path + "/" + escapePointer(k)
+			if s, ok := v[k].(string); ok {
+				if ref, ok := classify(k, s, childPath); ok {
+					visit(v, k, childPath, ref)
+				}
+				continue
+			}
+			walk(v[k], childPath, visit)
+		}
+	case []any:
+		for i, child := range v {
+			walk(child, path+"/"+strconv.Itoa(i), visit)
+		}
+	}
+}
+
+func classify(key, value, path string) (Ref, bool) {
+	kind, ok := refKeys[key]
+	if !ok || value == "" {
+		return Ref{}, false
+	}
+	ref := Ref{Kind: kind, Path: path, Value: value}
+	if idKeys[key] {
+		if !uuidOnly.MatchString(value) {
+			return Ref{}, false
+		}
+		ref.ID = strings.ToLower(value)
+		return ref, true
+	}
+	if id, ok := ParseAssetID(value); ok {
+		ref.ID = id
+		return ref, true
+	}
+	// Inline data and third-party URLs are self-contained; only raw storage
+	// paths need attention.
+	if IsTenantStoragePath(value) {
+		return ref, true
+	}
+	return Ref{}, false
+}
+
+func deepCopy(node any) any {
+	switch v := node.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, child := range v {
+			out[k] = deepCopy(child)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, child := range v {
+			out[i] = deepCopy(child)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,381 @@
+package clipart
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Curation is done by platform admins. New items start as drafts, visible
+// only here, until they are published; archiving takes an item out of the
+// library without breaking the canvases that already use it.
+
+const (
+	maxItemNameLength = 200
+	maxItemTags       = 30
+	maxItemTagLength  = 50
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// CreateCategoryRequest represents the create category request
+type CreateCategoryRequest struct {
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+}
+
+// UpdateCategoryRequest represents the update category request
+type UpdateCategoryRequest struct {
+	Name     *string `json:"name,omitempty"`
+	Position *int    `json:"position,omitempty"`
+}
+
+// CreateItemRequest represents the create item request
+type CreateItemRequest struct {
+	Kind       string   `json:"kind"`
+	Name       string   `json:"name"`
+	CategoryID string   `json:"categoryId,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	SVG        string   `json:"svg"`
+	// Publish makes the item available right away instead of as a draft
+	Publish bool `json:"publish,omitempty"`
+}
+
+// UpdateItemRequest represents the update item request. Fields left out
+// are unchanged.
+type UpdateItemRequest struct {
+	Name       *string   `json:"name,omitempty"`
+	CategoryID *string   `json:"categoryId,omitempty"` // empty removes the category
+	Tags       *[]string `json:"tags,omitempty"`
+	Status     *string   `json:"status,omitempty"`
+	// SVG replaces the item's drawing
+	SVG *string `json:"svg,omitempty"`
+}
+
+// AdminListItemsRequest represents the admin item list request
+type AdminListItemsRequest struct {
+	ListItemsRequest
+	// Status filters by status; empty lists every item
+	Status string `query:"status"`
+}
+
+//encore:api auth method=POST path=/admin/clipart/categories
+func CreateCategory(ctx context.Context, req *CreateCategoryRequest) (*Category, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	c := &Category{Slug: strings.TrimSpace(req.Slug), Name: strings.TrimSpace(req.Name), Position: req.Position}
+	if !slugPattern.MatchString(c.Slug) || len(c.Slug) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Slug must be lowercase letters, digits and hyphens",
+		}
+	}
+	if c.Name == "" || len([]rune(c.Name)) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name must be between 1 and 100 characters",
+		}
+	}
+	err := db.QueryRow(ctx, `
+		INSERT INTO clipart_categories (slug, name, position)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (slug) DO NOTHING
+		RETURNING id
+	`, c.Slug, c.Name, c.Position).Scan(&c.ID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "A category with this slug already exists",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create clipart category", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create category",
+		}
+	}
+	return c, nil
+}
+
+//encore:api auth method=PATCH path=/admin/clipart/categories/:id
+func UpdateCategory(ctx context.Context, id string, req *UpdateCategoryRequest) (*Category, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len([]rune(name)) > 100 {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Name must be between 1 and 100 characters",
+			}
+		}
+		req.Name = &name
+	}
+
+	var c Category
+	err := db.QueryRow(ctx, `
+		UPDATE clipart_categories
+		SET name = COALESCE($2, name), position = COALESCE($3, position)
+		WHERE id::text = $1
+		RETURNING id, slug, name, position,
+			(SELECT COUNT(*) FROM clipart_items WHERE category_id = clipart_categories.id AND status = 'published')
+	`, id, req.Name, req.Position).Scan(&c.ID, &c.Slug, &c.Name, &c.Position, &c.Items)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Category not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to update clipart category", "category_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update category",
+		}
+	}
+	return &c, nil
+}
+
+// DeleteCategory removes a category; its items stay in the library
+// without one.
+//
+//encore:api auth method=DELETE path=/admin/clipart/categories/:id
+func DeleteCategory(ctx context.Context, id string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM clipart_categories WHERE id::text = $1`, id); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete clipart category", "category_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete category",
+		}
+	}
+	return nil
+}
+
+// AdminListItems lists items in every status for curation.
+//
+//encore:api auth method=GET path=/admin/clipart/items
+func AdminListItems(ctx context.Context, req *AdminListItemsRequest) (*ListItemsResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if req.Status != "" && !validStatus(req.Status) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "status must be draft, published or archived",
+		}
+	}
+	return listItems(ctx, &req.ListItemsRequest, req.Status, true)
+}
+
+//encore:api auth method=POST path=/admin/clipart/items
+func CreateItem(ctx context.Context, req *CreateItemRequest) (*Item, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if req.Kind != KindShape && req.Kind != KindClipart {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "kind must be shape or clipart",
+		}
+	}
+	name := strings.TrimSpace(req.Name)
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+	info, err := checkSVG([]byte(req.SVG))
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid SVG: " + err.Error(),
+		}
+	}
+	var categoryID *string
+	if req.CategoryID != "" {
+		categoryID = &req.CategoryID
+	}
+	status := StatusDraft
+	if req.Publish {
+		status = StatusPublished
+	}
+
+	var id string
+	err = db.QueryRow(ctx, `
+		INSERT INTO clipart_items (category_id, kind, name, tags, status, content, width, height, checksum, created_by, published_at)
+		VALUES ($1::uuid, $2, $3, $4, $5, $6, $7, $8, $9, $10, CASE WHEN $5 = 'published' THEN NOW() END)
+		ON CONFLICT (checksum) DO NOTHING
+		RETURNING id
+	`, categoryID, req.Kind, name, tags, status, req.SVG, info.width, info.height, checksum(req.SVG), auth.UserID()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "This SVG is already in the library",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create clipart item", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create item",
+		}
+	}
+	reqctx.Logger(ctx).Info("clipart item created", "item_id", id, "status", status)
+	return getItem(ctx, id)
+}
+
+//encore:api auth method=PATCH path=/admin/clipart/items/:id
+func UpdateItem(ctx context.Context, id string, req *UpdateItemRequest) (*Item, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if err := validateName(name); err != nil {
+			return nil, err
+		}
+		req.Name = &name
+	}
+	var tags *[]string
+	if req.Tags != nil {
+		normalized, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return nil, err
+		}
+		tags = &normalized
+	}
+	if req.Status != nil && !validStatus(*req.Status) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "status must be draft, published or archived",
+		}
+	}
+	var width, height *float64
+	var sum *string
+	if req.SVG != nil {
+		info, err := checkSVG([]byte(*req.SVG))
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Invalid SVG: " + err.Error(),
+			}
+		}
+		s := checksum(*req.SVG)
+		width, height, sum = &info.width, &info.height, &s
+	}
+
+	result, err := db.Exec(ctx, `
+		UPDATE clipart_items SET
+			name = COALESCE($2, name),
+			category_id = CASE WHEN $3::text IS NULL THEN category_id ELSE NULLIF($3, '')::uuid END,
+			tags = COALESCE($4, tags),
+			status = COALESCE($5, status),
+			published_at = CASE WHEN $5 = 'published' AND status <> 'published' THEN NOW() ELSE published_at END,
+			content = COALESCE($6, content),
+			width = COALESCE($7, width),
+			height = COALESCE($8, height),
+			checksum = COALESCE($9, checksum),
+			updated_at = NOW()
+		WHERE id::text = $1
+	`, id, req.Name, req.CategoryID, tags, req.Status, req.SVG, width, height, sum)
+	if err != nil {
+		if strings.Contains(err.Error(), "idx_clipart_items_checksum") {
+			return nil, &errs.Error{
+				Code:    errs.AlreadyExists,
+				Message: "This SVG is already in the library",
+			}
+		}
+		reqctx.Logger(ctx).Error("failed to update clipart item", "item_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update item",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Item not found",
+		}
+	}
+	return getItem(ctx, id)
+}
+
+// DeleteItem removes an item and its usage history. Items already on
+// canvases are copies, so they are unaffected; archive items to keep their
+// history instead.
+//
+//encore:api auth method=DELETE path=/admin/clipart/items/:id
+func DeleteItem(ctx context.Context, id string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM clipart_items WHERE id::text = $1`, id); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete clipart item", "item_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete item",
+		}
+	}
+	return nil
+}
+
+func validStatus(s string) bool {
+	return s == StatusDraft || s == StatusPublished || s == StatusArchived
+}
+
+func validateName(name string) error {
+	if name == "" || len([]rune(name)) > maxItemNameLength {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name must be between 1 and 200 characters",
+		}
+	}
+	return nil
+}
+
+// normalizeTags lowercases and deduplicates item tags.
+func normalizeTags(tags []string) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len([]rune(t)) > maxItemTagLength {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Tags must be at most 50 characters",
+			}
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	if len(out) > maxItemTags {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Items can have at most 30 tags",
+		}
+	}
+	return out, nil
+}
+
+func checksum(svg string) string {
+	sum := sha256.Sum256([]byte(svg))
+	return hex.EncodeToString(sum[:])
+}
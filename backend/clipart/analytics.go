@@ -0,0 +1,253 @@
+package clipart
+
+import (
+	"context"
+	"strings"
+
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/cron"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// ClipartAnalytics configures how long library usage is kept
+type ClipartAnalytics struct {
+	// RetentionDays is how long uses and searches are kept. Zero keeps
+	// them for 180 days.
+	RetentionDays int `json:"retentionDays"`
+}
+
+var clipartCfg struct {
+	ClipartAnalytics ClipartAnalytics
+}
+
+var _ = config.Load(context.Background(), &clipartCfg)
+
+const (
+	defaultRetentionDays = 180
+	defaultAnalyticsDays = 30
+	analyticsTopN        = 20
+)
+
+// AnalyticsRequest represents the library analytics request
+type AnalyticsRequest struct {
+	// Days is the period covered, ending now; defaults to 30
+	Days int `query:"days"`
+}
+
+// ItemUsage is how much an item was used in the period
+type ItemUsage struct {
+	ItemID string `json:"itemId"`
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Uses   int    `json:"uses"`
+	Users  int    `json:"users"`
+}
+
+// CategoryUsage is how much a category's items were used in the period
+type CategoryUsage struct {
+	CategoryID string `json:"categoryId"`
+	Name       string `json:"name"`
+	Items      int    `json:"items"`
+	Uses       int    `json:"uses"`
+}
+
+// SearchStat is how often a query was searched in the period
+type SearchStat struct {
+	Query    string `json:"query"`
+	Searches int    `json:"searches"`
+	// Results is the result count of the latest search
+	Results int `json:"results"`
+}
+
+// AnalyticsResponse summarizes library usage to guide what is added next
+type AnalyticsResponse struct {
+	Days int `json:"days"`
+	// TopItems are the most used items
+	TopItems []ItemUsage `json:"topItems"`
+	// UnusedItems are published items nobody used in the period
+	UnusedItems []ItemUsage     `json:"unusedItems"`
+	Categories  []CategoryUsage `json:"categories"`
+	// TopSearches are the most frequent queries
+	TopSearches []SearchStat `json:"topSearches"`
+	// MissedSearches are frequent queries that found nothing: what the
+	// library is missing
+	MissedSearches []SearchStat `json:"missedSearches"`
+}
+
+// Analytics summarizes how the library was used over the last days.
+//
+//encore:api auth method=GET path=/admin/clipart/analytics
+func Analytics(ctx context.Context, req *AnalyticsRequest) (*AnalyticsResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	days := req.Days
+	if days <= 0 || days > retentionDays() {
+		days = min(defaultAnalyticsDays, retentionDays())
+	}
+
+	resp := &AnalyticsResponse{
+		Days:           days,
+		TopItems:       []ItemUsage{},
+		UnusedItems:    []ItemUsage{},
+		Categories:     []CategoryUsage{},
+		TopSearches:    []SearchStat{},
+		MissedSearches: []SearchStat{},
+	}
+	fail := func(what string, err error) error {
+		reqctx.Logger(ctx).Error("failed to load clipart analytics", "query", what, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load analytics",
+		}
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT i.id, i.name, i.kind, COUNT(*), COUNT(DISTINCT u.user_id)
+		FROM clipart_usage u
+		JOIN clipart_items i ON i.id = u.item_id
+		WHERE u.used_at > NOW() - $1 * INTERVAL '1 day'
+		GROUP BY i.id
+		ORDER BY COUNT(*) DESC, i.name
+		LIMIT $2
+	`, days, analyticsTopN)
+	if err != nil {
+		return nil, fail("top items", err)
+	}
+	for rows.Next() {
+		var u ItemUsage
+		if err := rows.Scan(&u.ItemID, &u.Name, &u.Kind, &u.Uses, &u.Users); err != nil {
+			continue
+		}
+		resp.TopItems = append(resp.TopItems, u)
+	}
+	rows.Close()
+
+	// Oldest first: items that have had the longest chance to be used.
+	rows, err = db.Query(ctx, `
+		SELECT i.id, i.name, i.kind
+		FROM clipart_items i
+		WHERE i.status = 'published'
+			AND NOT EXISTS (
+				SELECT 1 FROM clipart_usage u
+				WHERE u.item_id = i.id AND u.used_at > NOW() - $1 * INTERVAL '1 day'
+			)
+		ORDER BY i.published_at NULLS FIRST, i.name
+		LIMIT $2
+	`, days, analyticsTopN)
+	if err != nil {
+		return nil, fail("unused items", err)
+	}
+	for rows.Next() {
+		var u ItemUsage
+		if err := rows.Scan(&u.ItemID, &u.Name, &u.Kind); err != nil {
+			continue
+		}
+		resp.UnusedItems = append(resp.UnusedItems, u)
+	}
+	rows.Close()
+
+	rows, err = db.Query(ctx, `
+		SELECT c.id, c.name,
+			(SELECT COUNT(*) FROM clipart_items i WHERE i.category_id = c.id AND i.status = 'published'),
+			(SELECT COUNT(*) FROM clipart_usage u JOIN clipart_items i ON i.id = u.item_id
+				WHERE i.category_id = c.id AND u.used_at > NOW() - $1 * INTERVAL '1 day')
+		FROM clipart_categories c
+		ORDER BY 4 DESC, c.position, c.name
+	`, days)
+	if err != nil {
+		return nil, fail("categories", err)
+	}
+	for rows.Next() {
+		var c CategoryUsage
+		if err := rows.Scan(&c.CategoryID, &c.Name, &c.Items, &c.Uses); err != nil {
+			continue
+		}
+		resp.Categories = append(resp.Categories, c)
+	}
+	rows.Close()
+
+	if resp.TopSearches, err = searchStats(ctx, days, false); err != nil {
+		return nil, fail("top searches", err)
+	}
+	if resp.MissedSearches, err = searchStats(ctx, days, true); err != nil {
+		return nil, fail("missed searches", err)
+	}
+	return resp, nil
+}
+
+// searchStats returns the most frequent queries of the period; missed
+// only counts queries whose latest search found nothing.
+func searchStats(ctx context.Context, days int, missed bool) ([]SearchStat, error) {
+	rows, err := db.Query(ctx, `
+		SELECT query, COUNT(*),
+			(ARRAY_AGG(results ORDER BY searched_at DESC))[1] AS latest
+		FROM clipart_searches
+		WHERE searched_at > NOW() - $1 * INTERVAL '1 day'
+		GROUP BY query
+		HAVING NOT $2 OR (ARRAY_AGG(results ORDER BY searched_at DESC))[1] = 0
+		ORDER BY COUNT(*) DESC, query
+		LIMIT $3
+	`, days, missed, analyticsTopN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []SearchStat{}
+	for rows.Next() {
+		var s SearchStat
+		if err := rows.Scan(&s.Query, &s.Searches, &s.Results); err != nil {
+			continue
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// recordSearch records a library search for the analytics. Failures are
+// only logged; they never fail the search.
+func recordSearch(ctx context.Context, q string, results int) {
+	q = strings.Join(strings.Fields(strings.ToLower(q)), " ")
+	if r := []rune(q); len(r) > maxSearchQueryLength {
+		q = string(r[:maxSearchQueryLength])
+	}
+	_, err := db.Exec(ctx, `INSERT INTO clipart_searches (query, results) VALUES ($1, $2)`, q, results)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to record clipart search", "error", err)
+	}
+}
+
+func retentionDays() int {
+	if days := clipartCfg.ClipartAnalytics.RetentionDays; days > 0 {
+		return days
+	}
+	return defaultRetentionDays
+}
+
+// Keep library usage only as long as the analytics need it.
+var _ = cron.NewJob("prune-clipart-analytics", cron.JobConfig{
+	Title:    "Delete old clipart usage and searches",
+	Every:    24 * cron.Hour,
+	Endpoint: PruneClipartAnalytics,
+})
+
+//encore:api private
+func PruneClipartAnalytics(ctx context.Context) error {
+	days := retentionDays()
+	uses, err := db.Exec(ctx, `DELETE FROM clipart_usage WHERE used_at < NOW() - $1 * INTERVAL '1 day'`, days)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to prune clipart usage", "error", err)
+		return err
+	}
+	searches, err := db.Exec(ctx, `DELETE FROM clipart_searches WHERE searched_at < NOW() - $1 * INTERVAL '1 day'`, days)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to prune clipart searches", "error", err)
+		return err
+	}
+	reqctx.Logger(ctx).Info("pruned clipart analytics", "uses", uses.RowsAffected(), "searches", searches.RowsAffected())
+	return nil
+}
@@ -0,0 +1,371 @@
+// Package clipart serves the shape and clipart library: a curated catalog
+// of vector items in categories that editors browse, search and add to
+// their canvases. Lists only carry metadata; each item's SVG is downloaded
+// on its own when it is previewed or used. Admins curate the catalog (see
+// admin.go) and use the usage analytics (see analytics.go) to decide what to
+// add next.
+package clipart
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+	"canvasai/webpolicy"
+)
+
+// The library is stored alongside the projects that use it.
+var db = sqldb.Named("project")
+
+// Item kinds
+const (
+	KindShape   = "shape"
+	KindClipart = "clipart"
+)
+
+// Item statuses
+const (
+	StatusDraft     = "draft"
+	StatusPublished = "published"
+	StatusArchived  = "archived"
+)
+
+const (
+	defaultPageSize      = 50
+	maxPageSize          = 200
+	maxSearchQueryLength = 100
+)
+
+// Category groups library items
+type Category struct {
+	ID       string `json:"id"`
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+	// Items counts the published items in the category
+	Items int `json:"items"`
+}
+
+// Item is a shape or piece of clipart in the library
+type Item struct {
+	ID         string   `json:"id"`
+	Kind       string   `json:"kind"`
+	Name       string   `json:"name"`
+	CategoryID *string  `json:"categoryId,omitempty"`
+	Tags       []string `json:"tags"`
+	Width      float64  `json:"width"`
+	Height     float64  `json:"height"`
+	// ContentURL serves the item's SVG
+	ContentURL string `json:"contentUrl"`
+
+	// Curation details, only shown to admins
+	Status      string     `json:"status,omitempty"`
+	CreatedBy   *string    `json:"createdBy,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt   *time.Time `json:"updatedAt,omitempty"`
+	PublishedAt *time.Time `json:"publishedAt,omitempty"`
+}
+
+// ListCategoriesResponse represents the list categories response
+type ListCategoriesResponse struct {
+	Categories []Category `json:"categories"`
+}
+
+// ListItemsRequest represents a library browse or search
+type ListItemsRequest struct {
+	// Query searches item names and tags
+	Query    string `query:"q"`
+	Category string `query:"category"` // category slug
+	Kind     string `query:"kind"`
+	Limit    int    `query:"limit"`
+	Offset   int    `query:"offset"`
+}
+
+// ListItemsResponse represents a page of library items
+type ListItemsResponse struct {
+	Items  []Item `json:"items"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// RecordUseRequest represents the record use request
+type RecordUseRequest struct {
+	// ProjectID is the project the item was added to
+	ProjectID string `json:"projectId,omitempty"`
+}
+
+// ListCategories returns the library's categories in display order.
+//
+//encore:api auth method=GET path=/clipart/categories
+func ListCategories(ctx context.Context) (*ListCategoriesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.slug, c.name, c.position, COUNT(i.id)
+		FROM clipart_categories c
+		LEFT JOIN clipart_items i ON i.category_id = c.id AND i.status = 'published'
+		GROUP BY c.id
+		ORDER BY c.position, c.name
+	`)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list clipart categories", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list categories",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListCategoriesResponse{Categories: []Category{}}
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Slug, &c.Name, &c.Position, &c.Items); err != nil {
+			continue
+		}
+		resp.Categories = append(resp.Categories, c)
+	}
+	return resp, nil
+}
+
+// ListItems browses the published items of the library, or searches them
+// when q is set, best matches first. Searches are recorded for the
+// analytics.
+//
+//encore:api auth method=GET path=/clipart/items
+func ListItems(ctx context.Context, req *ListItemsRequest) (*ListItemsResponse, error) {
+	resp, err := listItems(ctx, req, StatusPublished, false)
+	if err != nil {
+		return nil, err
+	}
+	if q := strings.TrimSpace(req.Query); q != "" && req.Offset <= 0 {
+		recordSearch(ctx, q, resp.Total)
+	}
+	return resp, nil
+}
+
+// GetItem returns a published item.
+//
+//encore:api auth method=GET path=/clipart/items/:id
+func GetItem(ctx context.Context, id string) (*Item, error) {
+	item, err := getItem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if item.Status != StatusPublished {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Item not found",
+		}
+	}
+	item.hideCuration()
+	return item, nil
+}
+
+// Content serves an item's SVG. Published items are public so they can be
+// used as image sources; drafts and archived items are only served to
+// admins.
+//
+//encore:api public raw method=GET path=/clipart/items/:id/content
+func Content(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := encore.CurrentRequest().PathParams.Get("id")
+
+	var content, status, checksum string
+	err := db.QueryRow(ctx, `
+		SELECT content, status, checksum FROM clipart_items WHERE id::text = $1
+	`, id).Scan(&content, &status, &checksum)
+	if err == sql.ErrNoRows {
+		http.Error(w, "item not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load clipart item", "item_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	cacheControl := "public, max-age=86400"
+	if status != StatusPublished {
+		if permissions.RequirePlatformAdmin(ctx, db) != nil {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
+		cacheControl = "private, no-cache"
+	}
+
+	etag := `"` + checksum + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// Checked on upload (see svg.go); never let it run script regardless.
+	webpolicy.UserContent(w)
+	w.Write([]byte(content))
+}
+
+// RecordUse records that the user added an item to a canvas. Editors call
+// it on insert; the counts drive the usage analytics.
+//
+//encore:api auth method=POST path=/clipart/items/:id/use
+func RecordUse(ctx context.Context, id string, req *RecordUseRequest) error {
+	var projectID *string
+	if req.ProjectID != "" {
+		if err := projectaccess.RequireRole(ctx, req.ProjectID, permissions.RoleEditor); err != nil {
+			return err
+		}
+		projectID = &req.ProjectID
+	}
+	result, err := db.Exec(ctx, `
+		INSERT INTO clipart_usage (item_id, user_id, project_id)
+		SELECT id, $2, $3 FROM clipart_items WHERE id::text = $1 AND status = 'published'
+	`, id, auth.UserID(), projectID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record clipart use", "item_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to record use",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Item not found",
+		}
+	}
+	return nil
+}
+
+// listItems lists items with status, or every status when it is empty.
+func listItems(ctx context.Context, req *ListItemsRequest, status string, curation bool) (*ListItemsResponse, error) {
+	q := strings.TrimSpace(req.Query)
+	if len(q) > maxSearchQueryLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Search query is too long",
+		}
+	}
+	if req.Kind != "" && req.Kind != KindShape && req.Kind != KindClipart {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "kind must be shape or clipart",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxPageSize {
+		limit = defaultPageSize
+	}
+	offset := max(req.Offset, 0)
+
+	filter := `WHERE TRUE`
+	args := []any{}
+	if status != "" {
+		args = append(args, status)
+		filter += fmt.Sprintf(` AND i.status = $%d`, len(args))
+	}
+	if req.Kind != "" {
+		args = append(args, req.Kind)
+		filter += fmt.Sprintf(` AND i.kind = $%d`, len(args))
+	}
+	if req.Category != "" {
+		args = append(args, req.Category)
+		filter += fmt.Sprintf(` AND c.slug = $%d`, len(args))
+	}
+	order := `i.name, i.id`
+	if q != "" {
+		args = append(args, q)
+		filter += fmt.Sprintf(` AND i.search_vector @@ websearch_to_tsquery('english', $%d)`, len(args))
+		order = fmt.Sprintf(`ts_rank_cd(i.search_vector, websearch_to_tsquery('english', $%d)) DESC, `, len(args)) + order
+	}
+	from := `
+		FROM clipart_items i
+		LEFT JOIN clipart_categories c ON c.id = i.category_id
+		` + filter
+
+	resp := &ListItemsResponse{Items: []Item{}, Limit: limit, Offset: offset}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*)`+from, args...).Scan(&resp.Total); err != nil {
+		reqctx.Logger(ctx).Error("failed to count clipart items", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list items",
+		}
+	}
+	if resp.Total == 0 {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, fmt.Sprintf(`
+		SELECT %s %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, itemColumns, from, order, len(args)+1, len(args)+2), append(args, limit, offset)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list clipart items", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list items",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			continue
+		}
+		if !curation {
+			item.hideCuration()
+		}
+		resp.Items = append(resp.Items, *item)
+	}
+	return resp, nil
+}
+
+const itemColumns = `i.id, i.kind, i.name, i.category_id, i.tags, i.width, i.height,
+	i.status, i.created_by, i.created_at, i.updated_at, i.published_at`
+
+// getItem loads an item with its curation details.
+func getItem(ctx context.Context, id string) (*Item, error) {
+	item, err := scanItem(db.QueryRow(ctx, `SELECT `+itemColumns+` FROM clipart_items i WHERE i.id::text = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Item not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load clipart item", "item_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load item",
+		}
+	}
+	return item, nil
+}
+
+func scanItem(row interface{ Scan(...any) error }) (*Item, error) {
+	var item Item
+	var createdAt, updatedAt time.Time
+	err := row.Scan(&item.ID, &item.Kind, &item.Name, &item.CategoryID, &item.Tags, &item.Width, &item.Height,
+		&item.Status, &item.CreatedBy, &createdAt, &updatedAt, &item.PublishedAt)
+	if err != nil {
+		return nil, err
+	}
+	item.CreatedAt, item.UpdatedAt = &createdAt, &updatedAt
+	item.ContentURL = "/clipart/items/" + item.ID + "/content"
+	return &item, nil
+}
+
+// hideCuration clears the details only admins see.
+func (i *Item) hideCuration() {
+	i.Status = ""
+	i.CreatedBy, i.CreatedAt, i.UpdatedAt, i.PublishedAt = nil, nil, nil, nil
+}
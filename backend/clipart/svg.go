@@ -0,0 +1,146 @@
+package clipart
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Library items are served from our own origin, so their SVG must not be
+// able to run script or pull in anything from elsewhere. Uploads are
+// checked against an allowlist of drawing elements instead of being
+// cleaned up: curators fix and re-upload anything rejected, and what is
+// stored is exactly what was reviewed.
+
+const maxSVGSize = 256 << 10
+
+// allowedElements are the SVG elements library items may use.
+var allowedElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "title": true, "desc": true, "symbol": true, "use": true,
+	"path": true, "rect": true, "circle": true, "ellipse": true, "line": true, "polyline": true, "polygon": true,
+	"linearGradient": true, "radialGradient": true, "stop": true, "clipPath": true, "mask": true, "pattern": true,
+	"text": true, "tspan": true,
+}
+
+// svgInfo is what validation learns about an item's SVG
+type svgInfo struct {
+	width, height float64
+}
+
+// checkSVG reports an error unless data is an SVG drawing made only of
+// allowed elements, with no scripts, event handlers or external
+// references, and sized by its view box or width and height.
+func checkSVG(data []byte) (*svgInfo, error) {
+	if len(data) == 0 {
+		return nil, errors.New("SVG is empty")
+	}
+	if len(data) > maxSVGSize {
+		return nil, errors.New("SVG is larger than 256 KB")
+	}
+	if bytes.Contains(bytes.ToUpper(data), []byte("<!DOCTYPE")) || bytes.Contains(bytes.ToUpper(data), []byte("<!ENTITY")) {
+		return nil, errors.New("SVG must not declare a doctype or entities")
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var info *svgInfo
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New("SVG is not well-formed XML")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if !allowedElements[name] {
+				return nil, errors.New("SVG element <" + name + "> is not allowed")
+			}
+			if depth == 0 {
+				if name != "svg" {
+					return nil, errors.New("document root must be <svg>")
+				}
+				if info = rootSize(t); info == nil {
+					return nil, errors.New("SVG needs a viewBox or a width and height")
+				}
+			}
+			for _, a := range t.Attr {
+				if err := checkAttr(a); err != nil {
+					return nil, err
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.ProcInst:
+			if t.Target != "xml" {
+				return nil, errors.New("SVG must not contain processing instructions")
+			}
+		case xml.Directive:
+			return nil, errors.New("SVG must not contain directives")
+		}
+	}
+	if info == nil {
+		return nil, errors.New("document root must be <svg>")
+	}
+	return info, nil
+}
+
+func checkAttr(a xml.Attr) error {
+	name := strings.ToLower(a.Name.Local)
+	value := strings.ToLower(strings.TrimSpace(a.Value))
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return errors.New("SVG event handler attributes are not allowed")
+	case name == "href":
+		// Only references within the document, e.g. <use href="#shape">
+		if !strings.HasPrefix(value, "#") {
+			return errors.New("SVG must not reference external resources")
+		}
+	case !localURLs(value) || strings.Contains(value, "@import"):
+		return errors.New("SVG must not reference external resources")
+	}
+	return nil
+}
+
+// localURLs reports whether every url() in an attribute value points into
+// the document, e.g. fill="url(#gradient)".
+func localURLs(value string) bool {
+	for {
+		_, rest, found := strings.Cut(value, "url(")
+		if !found {
+			return true
+		}
+		rest = strings.TrimLeft(rest, ` '"`)
+		if !strings.HasPrefix(rest, "#") {
+			return false
+		}
+		value = rest
+	}
+}
+
+// rootSize returns the drawing size from the root element's view box, or
+// its width and height.
+func rootSize(root xml.StartElement) *svgInfo {
+	attrs := map[string]string{}
+	for _, a := range root.Attr {
+		attrs[a.Name.Local] = a.Value
+	}
+	if vb := strings.Fields(strings.ReplaceAll(attrs["viewBox"], ",", " ")); len(vb) == 4 {
+		w, errW := strconv.ParseFloat(vb[2], 64)
+		h, errH := strconv.ParseFloat(vb[3], 64)
+		if errW == nil && errH == nil && w > 0 && h > 0 {
+			return &svgInfo{width: w, height: h}
+		}
+	}
+	w, errW := strconv.ParseFloat(strings.TrimSuffix(attrs["width"], "px"), 64)
+	h, errH := strconv.ParseFloat(strings.TrimSuffix(attrs["height"], "px"), 64)
+	if errW == nil && errH == nil && w > 0 && h > 0 {
+		return &svgInfo{width: w, height: h}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package comment manages review comments on projects: resolution state,
+// resolution analytics and org-level SLA reminders for unresolved feedback.
+package comment
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+	"canvasai/webhook"
+)
+
+// Comment represents a comment on a project
+type Comment struct {
+	ID         string     `json:"id"`
+	ProjectID  string     `json:"projectId"`
+	UserID     string     `json:"userId"`
+	ParentID   *string    `json:"parentId,omitempty"`
+	Content    string     `json:"content"`
+	ElementID  *string    `json:"elementId,omitempty"`
+	IsResolved bool       `json:"isResolved"`
+	ResolvedBy *string    `json:"resolvedBy,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+// CreateCommentRequest represents the create comment request
+type CreateCommentRequest struct {
+	Content   string  `json:"content"`
+	ParentID  *string `json:"parentId,omitempty"`
+	ElementID *string `json:"elementId,omitempty"`
+}
+
+// Comments are stored with their projects.
+var db = sqldb.Named("project")
+
+// CreateComment adds a comment or, with ParentID, a reply. Email addresses
+// mentioned in it that are not collaborators become invite suggestions for
+// the project owner (see mentions.go).
+//
+//encore:api auth method=POST path=/projects/:id/comments
+func CreateComment(ctx context.Context, id string, req *CreateCommentRequest) (*Comment, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleCommenter); err != nil {
+		return nil, err
+	}
+	content := strings.TrimSpace(req.Content)
+	if content == "" || len(content) > 10000 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Comment must be between 1 and 10000 characters",
+		}
+	}
+	if req.ParentID != nil {
+		parent, err := getComment(ctx, id, *req.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if parent.ParentID != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Replies must be to a top-level comment",
+			}
+		}
+	}
+
+	userID := auth.UserID()
+	var commentID string
+	err := db.QueryRow(ctx, `
+		INSERT INTO project_comments (project_id, user_id, parent_id, content, element_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, id, userID, req.ParentID, content, req.ElementID).Scan(&commentID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create comment", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create comment",
+		}
+	}
+
+	suggestInvites(ctx, id, commentID, userID, content)
+	return getComment(ctx, id, commentID)
+}
+
+//encore:api auth method=POST path=/projects/:id/comments/:commentID/resolve
+func ResolveComment(ctx context.Context, id string, commentID string) (*Comment, error) {
+	return setResolved(ctx, id, commentID, true)
+}
+
+//encore:api auth method=POST path=/projects/:id/comments/:commentID/reopen
+func ReopenComment(ctx context.Context, id string, commentID string) (*Comment, error) {
+	return setResolved(ctx, id, commentID, false)
+}
+
+// setResolved resolves or reopens a thread. Only root comments carry
+// resolution state; resolved_at is what resolution analytics measure.
+func setResolved(ctx context.Context, projectID, commentID string, resolved bool) (*Comment, error) {
+	if err := projectaccess.RequireRole(ctx, projectID, permissions.RoleCommenter); err != nil {
+		return nil, err
+	}
+
+	userID := auth.UserID()
+	result, err := db.Exec(ctx, `
+		UPDATE project_comments
+		SET is_resolved = $3,
+			resolved_by = CASE WHEN $3 THEN $4::uuid ELSE NULL END,
+			resolved_at = CASE WHEN $3 THEN NOW() ELSE NULL END
+		WHERE id = $1 AND project_id = $2 AND parent_id IS NULL AND is_resolved <> $3
+	`, commentID, projectID, resolved, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update comment resolution", "comment_id", commentID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update comment",
+		}
+	}
+
+	c, err := getComment(ctx, projectID, commentID)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected() == 0 && c.ParentID != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Only top-level comments can be resolved",
+		}
+	}
+	if result.RowsAffected() > 0 {
+		emitResolution(ctx, c, userID)
+	}
+	return c, nil
+}
+
+// emitResolution notifies org webhooks that a thread was resolved or reopened.
+func emitResolution(ctx context.Context, c *Comment, userID string) {
+	e := &webhook.Event{Type: webhook.EventCommentReopened, ProjectID: c.ProjectID}
+	data := map[string]any{"projectId": c.ProjectID, "commentId": c.ID, "reopenedBy": userID}
+	if c.IsResolved {
+		e.Type = webhook.EventCommentResolved
+		data = map[string]any{"projectId": c.ProjectID, "commentId": c.ID, "resolvedBy": userID, "resolvedAt": c.ResolvedAt}
+	}
+	if err := webhook.Emit(ctx, e, data); err != nil {
+		reqctx.Logger(ctx).Error("failed to emit webhook event", "comment_id", c.ID, "error", err)
+	}
+}
+
+func getComment(ctx context.Context, projectID, commentID string) (*Comment, error) {
+	var c Comment
+	var parentID, elementID, resolvedBy sql.NullString
+	var resolvedAt sql.NullTime
+	err := db.QueryRow(ctx, `
+		SELECT id, project_id, user_id, parent_id, content, element_id, is_resolved, resolved_by, resolved_at, created_at, updated_at
+		FROM project_comments WHERE id = $1 AND project_id = $2
+	`, commentID, projectID).Scan(&c.ID, &c.ProjectID, &c.UserID, &parentID, &c.Content, &elementID, &c.IsResolved, &resolvedBy, &resolvedAt, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Comment not found",
+		}
+	}
+	if parentID.Valid {
+		c.ParentID = &parentID.String
+	}
+	if elementID.Valid {
+		c.ElementID = &elementID.String
+	}
+	if resolvedBy.Valid {
+		c.ResolvedBy = &resolvedBy.String
+	}
+	if resolvedAt.Valid {
+		c.ResolvedAt = &resolvedAt.Time
+	}
+	return &c, nil
+}
@@ -0,0 +1,258 @@
+package comment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/notification"
+	"canvasai/permissions"
+	"canvasai/project"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Reviewers often pull someone in by mentioning their address ("ask
+// @jane@acme.com"). When that person is not on the project the mention
+// becomes an invite suggestion: the owner is notified and can approve it,
+// which sends a regular project invite, or dismiss it. Nobody is emailed
+// until the owner approves.
+
+// maxMentionsPerComment bounds the suggestions a single comment can create.
+const maxMentionsPerComment = 10
+
+var emailMention = regexp.MustCompile(`(?:^|[\s(\[,;])@([a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,})`)
+
+// InviteSuggestion is an email mentioned in a comment that is not yet a
+// collaborator
+type InviteSuggestion struct {
+	ID          string     `json:"id"`
+	ProjectID   string     `json:"projectId"`
+	CommentID   *string    `json:"commentId,omitempty"`
+	Email       string     `json:"email"`
+	SuggestedBy string     `json:"suggestedBy,omitempty"`
+	Status      string     `json:"status"` // pending, approved, dismissed
+	InviteID    *string    `json:"inviteId,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	DecidedAt   *time.Time `json:"decidedAt,omitempty"`
+}
+
+// ListInviteSuggestionsResponse represents the list invite suggestions response
+type ListInviteSuggestionsResponse struct {
+	Suggestions []InviteSuggestion `json:"suggestions"`
+}
+
+// ApproveInviteSuggestionRequest represents the approve suggestion request
+type ApproveInviteSuggestionRequest struct {
+	// Role defaults to commenter, matching how the person was brought in
+	Role string `json:"role,omitempty"`
+}
+
+// ListInviteSuggestions lists the pending suggestions on a project.
+//
+//encore:api auth method=GET path=/projects/:id/invite-suggestions
+func ListInviteSuggestions(ctx context.Context, id string) (*ListInviteSuggestionsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleOwner); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, project_id, comment_id, email, COALESCE(suggested_by::text, ''), status, invite_id, created_at, decided_at
+		FROM comment_invite_suggestions
+		WHERE project_id = $1 AND status = 'pending'
+		ORDER BY created_at DESC
+	`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list invite suggestions", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch invite suggestions",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListInviteSuggestionsResponse{Suggestions: []InviteSuggestion{}}
+	for rows.Next() {
+		s, err := scanSuggestion(rows)
+		if err != nil {
+			continue
+		}
+		resp.Suggestions = append(resp.Suggestions, *s)
+	}
+	return resp, nil
+}
+
+// ApproveInviteSuggestion invites the suggested address to the project.
+//
+//encore:api auth method=POST path=/projects/:id/invite-suggestions/:suggestionID/approve
+func ApproveInviteSuggestion(ctx context.Context, id string, suggestionID string, req *ApproveInviteSuggestionRequest) (*InviteSuggestion, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleOwner); err != nil {
+		return nil, err
+	}
+	role := req.Role
+	if role == "" {
+		role = string(permissions.RoleCommenter)
+	}
+
+	var email string
+	err := db.QueryRow(ctx, `
+		SELECT email FROM comment_invite_suggestions WHERE id = $1 AND project_id = $2 AND status = 'pending'
+	`, suggestionID, id).Scan(&email)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite suggestion not found",
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load invite suggestion", "suggestion_id", suggestionID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to approve invite suggestion",
+		}
+	}
+
+	inv, err := project.CreateInvite(ctx, id, &project.CreateInviteRequest{Email: email, Role: role})
+	if err != nil {
+		return nil, err
+	}
+	return decideSuggestion(ctx, id, suggestionID, "approved", &inv.ID)
+}
+
+// DismissInviteSuggestion declines a suggestion. The address is not
+// suggested again for this project.
+//
+//encore:api auth method=DELETE path=/projects/:id/invite-suggestions/:suggestionID
+func DismissInviteSuggestion(ctx context.Context, id string, suggestionID string) error {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleOwner); err != nil {
+		return err
+	}
+	_, err := decideSuggestion(ctx, id, suggestionID, "dismissed", nil)
+	return err
+}
+
+func decideSuggestion(ctx context.Context, projectID, suggestionID, status string, inviteID *string) (*InviteSuggestion, error) {
+	s, err := scanSuggestion(db.QueryRow(ctx, `
+		UPDATE comment_invite_suggestions
+		SET status = $3, invite_id = $4, decided_at = NOW()
+		WHERE id = $1 AND project_id = $2 AND status = 'pending'
+		RETURNING id, project_id, comment_id, email, COALESCE(suggested_by::text, ''), status, invite_id, created_at, decided_at
+	`, suggestionID, projectID, status, inviteID))
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite suggestion not found",
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update invite suggestion", "suggestion_id", suggestionID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update invite suggestion",
+		}
+	}
+	return s, nil
+}
+
+// suggestInvites records the email addresses mentioned in a comment that
+// are neither collaborators nor already invited, and tells the owner.
+// Failures are logged; they never fail the comment.
+func suggestInvites(ctx context.Context, projectID, commentID, userID, content string) {
+	emails := mentionedEmails(content)
+	if len(emails) == 0 {
+		return
+	}
+
+	var suggested []string
+	for _, email := range emails {
+		result, err := db.Exec(ctx, `
+			INSERT INTO comment_invite_suggestions (project_id, comment_id, email, suggested_by)
+			SELECT $1, $2, $3, $4
+			WHERE NOT EXISTS (
+				SELECT 1 FROM project_collaborators c
+				JOIN users u ON u.id = c.user_id
+				WHERE c.project_id = $1 AND lower(u.email) = $3
+			) AND NOT EXISTS (
+				SELECT 1 FROM project_invites i
+				WHERE i.project_id = $1 AND lower(i.email) = $3 AND i.accepted_at IS NULL AND i.expires_at > NOW()
+			)
+			ON CONFLICT (project_id, lower(email)) DO NOTHING
+		`, projectID, commentID, email, userID)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to record invite suggestion", "comment_id", commentID, "error", err)
+			continue
+		}
+		if result.RowsAffected() > 0 {
+			suggested = append(suggested, email)
+		}
+	}
+	if len(suggested) == 0 {
+		return
+	}
+
+	var ownerID, title string
+	if err := db.QueryRow(ctx, `SELECT owner_id, title FROM projects WHERE id = $1`, projectID).Scan(&ownerID, &title); err != nil {
+		reqctx.Logger(ctx).Error("failed to load project owner", "project_id", projectID, "error", err)
+		return
+	}
+	data, _ := json.Marshal(map[string]any{
+		"projectId": projectID,
+		"commentId": commentID,
+		"emails":    suggested,
+	})
+	err := notification.Send(ctx, &notification.Message{
+		UserID: ownerID,
+		Kind:   "comment.invite_suggestion",
+		Title:  fmt.Sprintf("Invite %s to %s?", strings.Join(suggested, ", "), title),
+		Body:   "They were mentioned in a comment but are not collaborators yet.",
+		Link:   fmt.Sprintf("/projects/%s?comment=%s", projectID, commentID),
+		Data:   data,
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to send invite suggestion", "comment_id", commentID, "error", err)
+	}
+}
+
+// mentionedEmails returns the distinct, lowercased addresses mentioned with
+// an @ prefix in content.
+func mentionedEmails(content string) []string {
+	var emails []string
+	seen := map[string]bool{}
+	for _, m := range emailMention.FindAllStringSubmatch(content, -1) {
+		email := strings.ToLower(strings.TrimRight(m[1], "."))
+		if seen[email] || len(email) > 255 {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+		if len(emails) == maxMentionsPerComment {
+			break
+		}
+	}
+	return emails
+}
+
+func scanSuggestion(row interface{ Scan(...any) error }) (*InviteSuggestion, error) {
+	var s InviteSuggestion
+	var commentID, inviteID sql.NullString
+	var decidedAt sql.NullTime
+	if err := row.Scan(&s.ID, &s.ProjectID, &commentID, &s.Email, &s.SuggestedBy, &s.Status, &inviteID, &s.CreatedAt, &decidedAt); err != nil {
+		return nil, err
+	}
+	if commentID.Valid {
+		s.CommentID = &commentID.String
+	}
+	if inviteID.Valid {
+		s.InviteID = &inviteID.String
+	}
+	if decidedAt.Valid {
+		s.DecidedAt = &decidedAt.Time
+	}
+	return &s, nil
+}
@@ -0,0 +1,285 @@
+package comment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+
+	"canvasai/notification"
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// SLAPolicy flags unresolved comments older than MaxAgeHours
+type SLAPolicy struct {
+	ID          string    `json:"id"`
+	OrgID       string    `json:"orgId"`
+	Name        string    `json:"name"`
+	MaxAgeHours int       `json:"maxAgeHours"`
+	AuthorRole  *string   `json:"authorRole,omitempty"` // Only comments by collaborators with this role
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// CreateSLAPolicyRequest represents the create SLA policy request
+type CreateSLAPolicyRequest struct {
+	Name        string  `json:"name"`
+	MaxAgeHours int     `json:"maxAgeHours"`
+	AuthorRole  *string `json:"authorRole,omitempty"`
+}
+
+// ListSLAPoliciesResponse represents the list SLA policies response
+type ListSLAPoliciesResponse struct {
+	Policies []SLAPolicy `json:"policies"`
+}
+
+// CommentReportRequest represents the comment report request
+type CommentReportRequest struct {
+	Since time.Time `query:"since"`
+}
+
+// CommentReport summarises comment resolution across an org's projects
+type CommentReport struct {
+	OrgID    string    `json:"orgId"`
+	Since    time.Time `json:"since"`
+	Threads  int       `json:"threads"`
+	Resolved int       `json:"resolved"`
+	Open     int       `json:"open"`
+	// Time-to-resolution statistics over threads resolved in the period
+	AvgResolutionHours    float64     `json:"avgResolutionHours"`
+	MedianResolutionHours float64     `json:"medianResolutionHours"`
+	P90ResolutionHours    float64     `json:"p90ResolutionHours"`
+	Overdue               []SLAStatus `json:"overdue"`
+}
+
+// SLAStatus counts open threads currently breaching a policy
+type SLAStatus struct {
+	PolicyID string `json:"policyId"`
+	Name     string `json:"name"`
+	Count    int    `json:"count"`
+}
+
+//encore:api auth method=GET path=/orgs/:orgID/comment-sla
+func ListSLAPolicies(ctx context.Context, orgID string) (*ListSLAPoliciesResponse, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, org_id, name, max_age_hours, author_role, enabled, created_at
+		FROM comment_sla_policies WHERE org_id = $1 ORDER BY created_at
+	`, orgID)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch SLA policies",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListSLAPoliciesResponse{Policies: []SLAPolicy{}}
+	for rows.Next() {
+		var p SLAPolicy
+		if err := rows.Scan(&p.ID, &p.OrgID, &p.Name, &p.MaxAgeHours, &p.AuthorRole, &p.Enabled, &p.CreatedAt); err != nil {
+			continue
+		}
+		resp.Policies = append(resp.Policies, p)
+	}
+	return resp, nil
+}
+
+//encore:api auth method=POST path=/orgs/:orgID/comment-sla
+func CreateSLAPolicy(ctx context.Context, orgID string, req *CreateSLAPolicyRequest) (*SLAPolicy, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(req.Name) == "" || req.MaxAgeHours <= 0 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name and a positive maxAgeHours are required",
+		}
+	}
+	if req.AuthorRole != nil && !permissions.ValidRole(*req.AuthorRole) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid author role",
+		}
+	}
+
+	p := SLAPolicy{OrgID: orgID, Name: strings.TrimSpace(req.Name), MaxAgeHours: req.MaxAgeHours, AuthorRole: req.AuthorRole, Enabled: true}
+	err := db.QueryRow(ctx, `
+		INSERT INTO comment_sla_policies (org_id, name, max_age_hours, author_role)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, orgID, p.Name, p.MaxAgeHours, p.AuthorRole).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create sla policy", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create SLA policy",
+		}
+	}
+	return &p, nil
+}
+
+//encore:api auth method=DELETE path=/orgs/:orgID/comment-sla/:policyID
+func DeleteSLAPolicy(ctx context.Context, orgID string, policyID string) error {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `DELETE FROM comment_sla_policies WHERE id = $1 AND org_id = $2`, policyID, orgID)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete SLA policy",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "SLA policy not found",
+		}
+	}
+	return nil
+}
+
+//encore:api auth method=GET path=/orgs/:orgID/reports/comments
+func GetCommentReport(ctx context.Context, orgID string, req *CommentReportRequest) (*CommentReport, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+
+	since := req.Since
+	if since.IsZero() {
+		since = time.Now().AddDate(0, 0, -30)
+	}
+	report := &CommentReport{OrgID: orgID, Since: since, Overdue: []SLAStatus{}}
+
+	err := db.QueryRow(ctx, `
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE c.is_resolved),
+			COUNT(*) FILTER (WHERE NOT c.is_resolved),
+			COALESCE(AVG(EXTRACT(EPOCH FROM c.resolved_at - c.created_at)) FILTER (WHERE c.is_resolved), 0) / 3600,
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM c.resolved_at - c.created_at)) FILTER (WHERE c.is_resolved), 0) / 3600,
+			COALESCE(percentile_cont(0.9) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM c.resolved_at - c.created_at)) FILTER (WHERE c.is_resolved), 0) / 3600
+		FROM project_comments c
+		JOIN projects p ON p.id = c.project_id
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL AND c.parent_id IS NULL AND c.created_at >= $2
+	`, orgID, since).Scan(&report.Threads, &report.Resolved, &report.Open,
+		&report.AvgResolutionHours, &report.MedianResolutionHours, &report.P90ResolutionHours)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to compute comment report", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to compute report",
+		}
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT pol.id, pol.name, COUNT(c.id)
+		FROM comment_sla_policies pol
+		JOIN projects p ON p.org_id = pol.org_id
+		JOIN project_comments c ON c.project_id = p.id
+		LEFT JOIN project_collaborators pc ON pc.project_id = c.project_id AND pc.user_id = c.user_id
+		WHERE pol.org_id = $1 AND pol.enabled AND p.deleted_at IS NULL
+			AND c.parent_id IS NULL AND NOT c.is_resolved
+			AND c.created_at < NOW() - make_interval(hours => pol.max_age_hours)
+			AND (pol.author_role IS NULL OR pc.role = pol.author_role)
+		GROUP BY pol.id, pol.name
+	`, orgID)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var s SLAStatus
+			if err := rows.Scan(&s.PolicyID, &s.Name, &s.Count); err == nil {
+				report.Overdue = append(report.Overdue, s)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// Check SLA breaches hourly and remind project owners.
+var _ = cron.NewJob("comment-sla-reminders", cron.JobConfig{
+	Title:    "Send comment SLA reminders",
+	Every:    1 * cron.Hour,
+	Endpoint: SendSLAReminders,
+})
+
+const reminderBatchSize = 500
+
+//encore:api private
+func SendSLAReminders(ctx context.Context) error {
+	rows, err := db.Query(ctx, `
+		SELECT pol.id, pol.name, pol.max_age_hours, c.id, c.project_id, p.title, p.owner_id
+		FROM comment_sla_policies pol
+		JOIN projects p ON p.org_id = pol.org_id
+		JOIN project_comments c ON c.project_id = p.id
+		LEFT JOIN project_collaborators pc ON pc.project_id = c.project_id AND pc.user_id = c.user_id
+		WHERE pol.enabled AND p.deleted_at IS NULL
+			AND c.parent_id IS NULL AND NOT c.is_resolved
+			AND c.created_at < NOW() - make_interval(hours => pol.max_age_hours)
+			AND (pol.author_role IS NULL OR pc.role = pol.author_role)
+			AND NOT EXISTS (
+				SELECT 1 FROM comment_sla_reminders r WHERE r.policy_id = pol.id AND r.comment_id = c.id
+			)
+		LIMIT $1
+	`, reminderBatchSize)
+	if err != nil {
+		return err
+	}
+
+	type breach struct {
+		policyID, policyName        string
+		maxAgeHours                 int
+		commentID, projectID, title string
+		ownerID                     string
+	}
+	var breaches []breach
+	for rows.Next() {
+		var b breach
+		if err := rows.Scan(&b.policyID, &b.policyName, &b.maxAgeHours, &b.commentID, &b.projectID, &b.title, &b.ownerID); err != nil {
+			continue
+		}
+		breaches = append(breaches, b)
+	}
+	rows.Close()
+
+	for _, b := range breaches {
+		result, err := db.Exec(ctx, `
+			INSERT INTO comment_sla_reminders (policy_id, comment_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, b.policyID, b.commentID)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			continue
+		}
+
+		data, _ := json.Marshal(map[string]string{
+			"projectId": b.projectID,
+			"commentId": b.commentID,
+			"policyId":  b.policyID,
+		})
+		err = notification.Send(ctx, &notification.Message{
+			UserID: b.ownerID,
+			Kind:   "comment.sla_reminder",
+			Title:  fmt.Sprintf("Unresolved feedback on %s", b.title),
+			Body:   fmt.Sprintf("A comment has been open for more than %dh (%s).", b.maxAgeHours, b.policyName),
+			Link:   fmt.Sprintf("/projects/%s?comment=%s", b.projectID, b.commentID),
+			Data:   data,
+		})
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to send sla reminder", "comment_id", b.commentID, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package comment
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+	"canvasai/settings"
+)
+
+// Reviewers do not always share a language. A thread is translated on
+// demand by the AI service, which detects each comment's language, into
+// the language given or else the reader's translationLanguage setting
+// (their locale by default). Translations are cached per comment and
+// language, and kept until the comment's text changes, so a thread read
+// by many people costs one provider call per comment.
+
+var translateCfg struct {
+	AIServiceURL string // Base URL of the AI service, e.g. http://ai:8000
+}
+
+var _ = config.Load(context.Background(), &translateCfg)
+
+// aiClient talks to our own AI service on the internal network, which the
+// outbound client would refuse to dial.
+var aiClient = &http.Client{Timeout: 60 * time.Second}
+
+// maxTranslationBytes bounds the untranslated text sent in one request.
+const maxTranslationBytes = 100 << 10
+
+var languageTag = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+// TranslateThreadRequest represents the translate thread request
+type TranslateThreadRequest struct {
+	// TargetLanguage overrides the caller's translation language
+	TargetLanguage string `json:"targetLanguage,omitempty"`
+}
+
+// CommentTranslation is one comment of a thread in the target language
+type CommentTranslation struct {
+	CommentID      string `json:"commentId"`
+	SourceLanguage string `json:"sourceLanguage"`
+	Content        string `json:"content"`
+	// Translated is false when the comment was already in the target
+	// language and Content is the original
+	Translated bool `json:"translated"`
+}
+
+// ThreadTranslation is a comment thread in the target language, root
+// comment first
+type ThreadTranslation struct {
+	TargetLanguage string               `json:"targetLanguage"`
+	Comments       []CommentTranslation `json:"comments"`
+}
+
+// TranslateThread translates the thread commentID belongs to.
+//
+//encore:api auth method=POST path=/projects/:id/comments/:commentID/translate
+func TranslateThread(ctx context.Context, id string, commentID string, req *TranslateThreadRequest) (*ThreadTranslation, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	c, err := getComment(ctx, id, commentID)
+	if err != nil {
+		return nil, err
+	}
+	rootID := c.ID
+	if c.ParentID != nil {
+		rootID = *c.ParentID
+	}
+
+	target, err := targetLanguage(ctx, req.TargetLanguage)
+	if err != nil {
+		return nil, err
+	}
+	log := reqctx.Logger(ctx).With("project_id", id, "comment_id", rootID, "target_language", target)
+
+	thread, err := loadThreadTranslations(ctx, id, rootID, target)
+	if err != nil {
+		log.Error("failed to load comment thread", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to translate comments",
+		}
+	}
+
+	var pending []*threadComment
+	size := 0
+	for _, tc := range thread {
+		if tc.cached == nil {
+			pending = append(pending, tc)
+			size += len(tc.content)
+		}
+	}
+	if size > maxTranslationBytes {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "Thread is too long to translate at once",
+		}
+	}
+	if len(pending) > 0 {
+		if err := translateComments(ctx, pending, target); err != nil {
+			log.Error("failed to translate comments", "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Unavailable,
+				Message: "Translation is unavailable; try again later",
+			}
+		}
+		for _, tc := range pending {
+			_, err := db.Exec(ctx, `
+				INSERT INTO comment_translations (comment_id, target_language, source_language, content_hash, content)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (comment_id, target_language) DO UPDATE
+				SET source_language = EXCLUDED.source_language, content_hash = EXCLUDED.content_hash,
+					content = EXCLUDED.content, created_at = NOW()
+			`, tc.id, target, tc.cached.SourceLanguage, tc.hash, tc.cached.Content)
+			if err != nil {
+				// The translation is still good; it is only not cached.
+				log.Warn("failed to cache comment translation", "error", err)
+			}
+		}
+	}
+
+	resp := &ThreadTranslation{TargetLanguage: target, Comments: make([]CommentTranslation, 0, len(thread))}
+	for _, tc := range thread {
+		resp.Comments = append(resp.Comments, *tc.cached)
+	}
+	return resp, nil
+}
+
+// targetLanguage returns the requested language, or else the caller's
+// translation language setting.
+func targetLanguage(ctx context.Context, requested string) (string, error) {
+	if requested != "" {
+		if !languageTag.MatchString(requested) {
+			return "", &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "targetLanguage must be a language tag such as en or pt-BR",
+			}
+		}
+		return requested, nil
+	}
+	s, err := settings.GetSettings(ctx)
+	if err != nil {
+		return "", &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load translation language",
+		}
+	}
+	if s.TranslationLanguage != "" {
+		return s.TranslationLanguage, nil
+	}
+	return s.Locale, nil
+}
+
+// threadComment is a comment of a thread being translated
+type threadComment struct {
+	id      string
+	content string
+	hash    string
+	// cached is the stored translation, if it is of the current text
+	cached *CommentTranslation
+}
+
+// loadThreadTranslations reads the thread rooted at rootID in order,
+// with any cached translations into target.
+func loadThreadTranslations(ctx context.Context, projectID, rootID, target string) ([]*threadComment, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.content, t.content_hash, t.source_language, t.content
+		FROM project_comments c
+		LEFT JOIN comment_translations t ON t.comment_id = c.id AND t.target_language = $3
+		WHERE c.project_id = $1 AND (c.id = $2 OR c.parent_id = $2)
+		ORDER BY c.parent_id IS NOT NULL, c.created_at, c.id
+	`, projectID, rootID, target)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var thread []*threadComment
+	for rows.Next() {
+		tc := &threadComment{}
+		var hash, source, translated *string
+		if err := rows.Scan(&tc.id, &tc.content, &hash, &source, &translated); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(tc.content))
+		tc.hash = hex.EncodeToString(sum[:])
+		if hash != nil && *hash == tc.hash {
+			tc.cached = &CommentTranslation{
+				CommentID:      tc.id,
+				SourceLanguage: *source,
+				Content:        *translated,
+				Translated:     *translated != tc.content,
+			}
+		}
+		thread = append(thread, tc)
+	}
+	return thread, rows.Err()
+}
+
+// translateComments has the AI service translate the comments into
+// target, setting each one's cached translation.
+func translateComments(ctx context.Context, comments []*threadComment, target string) error {
+	if translateCfg.AIServiceURL == "" {
+		return fmt.Errorf("AIServiceURL is not configured")
+	}
+	texts := make([]string, len(comments))
+	for i, tc := range comments {
+		texts[i] = tc.content
+	}
+	body, err := json.Marshal(map[string]any{"texts": texts, "target_language": target})
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(translateCfg.AIServiceURL, "/")+"/ai/translate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := aiClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("ai service returned %d: %s", resp.StatusCode, msg)
+	}
+
+	var out struct {
+		Translations []struct {
+			SourceLanguage string `json:"source_language"`
+			Text           string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return err
+	}
+	if len(out.Translations) != len(comments) {
+		return fmt.Errorf("ai service returned %d translations for %d comments", len(out.Translations), len(comments))
+	}
+	for i, tc := range comments {
+		t := out.Translations[i]
+		tc.cached = &CommentTranslation{
+			CommentID:      tc.id,
+			SourceLanguage: t.SourceLanguage,
+			Content:        t.Text,
+			Translated:     t.Text != tc.content,
+		}
+	}
+	return nil
+}
@@ -31,6 +31,80 @@ CREATE TYPE lock_type AS ENUM ('editing', 'moving', 'resizing', 'rotating');
 \i migrations/002_create_projects_table.sql
 \i migrations/003_create_assets_table.sql
 \i migrations/004_create_collaboration_tables.sql
+\i migrations/005_create_organizations_and_saml.sql
+\i migrations/006_add_project_revision_tracking.sql
+\i migrations/007_create_notifications_and_comment_sla.sql
+\i migrations/008_create_auth_audit.sql
+\i migrations/009_create_project_share_links.sql
+\i migrations/010_create_export_jobs.sql
+\i migrations/011_create_follow_sessions.sql
+\i migrations/012_add_guest_accounts.sql
+\i migrations/013_create_email_change_requests.sql
+\i migrations/014_create_webhooks.sql
+\i migrations/015_add_user_avatar_variants.sql
+\i migrations/016_create_realtime_connections.sql
+\i migrations/017_add_user_plans.sql
+\i migrations/018_create_login_fingerprints.sql
+\i migrations/019_create_oauth_provider.sql
+\i migrations/020_add_asset_prefetch_index.sql
+\i migrations/021_create_user_settings.sql
+\i migrations/022_add_account_deactivation.sql
+\i migrations/023_create_project_view_payloads.sql
+\i migrations/024_create_org_settings.sql
+\i migrations/025_create_org_invites.sql
+\i migrations/026_create_project_invites.sql
+\i migrations/027_add_project_slugs.sql
+\i migrations/028_create_impersonation_sessions.sql
+\i migrations/029_create_comment_invite_suggestions.sql
+\i migrations/030_create_api_rate_limit_overrides.sql
+\i migrations/031_create_api_keys.sql
+\i migrations/032_add_export_retention.sql
+\i migrations/033_create_user_identities.sql
+\i migrations/034_create_render_fixtures.sql
+\i migrations/035_add_asset_color_profile.sql
+\i migrations/036_create_revoked_tokens.sql
+\i migrations/037_create_asset_versions.sql
+\i migrations/038_add_project_tags.sql
+\i migrations/039_add_project_search.sql
+\i migrations/040_create_project_asset_links.sql
+\i migrations/041_create_asset_sources.sql
+\i migrations/042_add_project_version_snapshots.sql
+\i migrations/043_add_project_forks.sql
+\i migrations/044_create_icon_collections.sql
+\i migrations/045_create_clipart_library.sql
+\i migrations/046_add_project_trash.sql
+\i migrations/047_create_map_api_keys.sql
+\i migrations/048_create_templates.sql
+\i migrations/049_create_project_folders.sql
+\i migrations/050_create_sheet_bindings.sql
+\i migrations/051_create_mockup_templates.sql
+\i migrations/052_add_share_link_roles.sql
+\i migrations/053_create_pod_integration.sql
+\i migrations/054_create_shopify_integration.sql
+\i migrations/055_create_wordpress_integration.sql
+\i migrations/056_create_email_template_sync.sql
+\i migrations/057_add_project_thumbnails.sql
+\i migrations/058_create_org_embed_origins.sql
+\i migrations/059_add_share_link_abuse_alerts.sql
+\i migrations/060_create_wide_events.sql
+\i migrations/061_create_project_stars.sql
+\i migrations/062_create_region_failovers.sql
+\i migrations/063_create_comment_translations.sql
+\i migrations/064_create_project_fields.sql
+\i migrations/065_create_project_board.sql
+\i migrations/066_create_gallery.sql
+\i migrations/067_create_time_entries.sql
+\i migrations/068_create_client_portal.sql
+\i migrations/069_create_project_webhooks.sql
+\i migrations/070_create_annotation_imports.sql
+\i migrations/071_create_project_previews.sql
+\i migrations/072_create_compliance_snapshots.sql
+\i migrations/073_create_component_usage.sql
+\i migrations/074_add_project_settings.sql
+\i migrations/075_add_project_autosave.sql
+\i migrations/076_create_design_system.sql
+\i migrations/077_verify_saml_domains.sql
+\i migrations/078_create_api_key_rate_limit_overrides.sql
 
 -- Insert default data
 INSERT INTO users (id, email, name, password_hash, email_verified) VALUES
@@ -0,0 +1,418 @@
+// Package designsystem keeps an organization's design system: its design
+// tokens (colors, typography, spacing and radii), written usage
+// guidelines, and notes on the shared components its projects place.
+// Every change is announced on LibraryChanges, from which the export
+// service rebuilds the organization's documentation site.
+package designsystem
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Design systems are stored alongside the organizations they belong to.
+var db = sqldb.Named("project")
+
+// Design system bounds
+const (
+	maxTokensPerKind     = 500
+	maxTokenName         = 64
+	maxTokenValue        = 100
+	maxFontFamily        = 200
+	maxGuidelinesLength  = 100000
+	maxComponentName     = 100
+	maxComponentDesc     = 2000
+	maxComponentIDLength = 255
+	maxComponentDocs     = 1000
+)
+
+// tokenNamePattern allows names like "brand-primary" or "space.4"
+var tokenNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-/]*$`)
+
+// Tokens are an organization's design tokens
+type Tokens struct {
+	Colors     []ColorToken      `json:"colors"`
+	Typography []TypographyToken `json:"typography"`
+	// Spacing and Radii are lengths in pixels
+	Spacing []SizeToken `json:"spacing"`
+	Radii   []SizeToken `json:"radii"`
+}
+
+// ColorToken is a named color
+type ColorToken struct {
+	Name string `json:"name"`
+	// Value is a CSS color
+	Value       string `json:"value"`
+	Description string `json:"description,omitempty"`
+}
+
+// TypographyToken is a named text style
+type TypographyToken struct {
+	Name       string `json:"name"`
+	FontFamily string `json:"fontFamily"`
+	// FontSize is in pixels
+	FontSize   float64 `json:"fontSize"`
+	FontWeight int     `json:"fontWeight"`
+	// LineHeight is a multiple of the font size; 0 leaves it to the font
+	LineHeight  float64 `json:"lineHeight,omitempty"`
+	Description string  `json:"description,omitempty"`
+}
+
+// SizeToken is a named length
+type SizeToken struct {
+	Name        string  `json:"name"`
+	Value       float64 `json:"value"`
+	Description string  `json:"description,omitempty"`
+}
+
+// ComponentDoc documents a shared component. ComponentID is the
+// "componentId" its instances carry on the canvas.
+type ComponentDoc struct {
+	ComponentID string `json:"componentId"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Guidelines say when and how to use the component
+	Guidelines string    `json:"guidelines"`
+	UpdatedBy  string    `json:"updatedBy,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Library is an organization's design system
+type Library struct {
+	OrgID  string `json:"orgId"`
+	Tokens Tokens `json:"tokens"`
+	// Guidelines are the organization's general usage guidelines, as
+	// paragraphs of plain text separated by blank lines
+	Guidelines string         `json:"guidelines"`
+	Components []ComponentDoc `json:"components"`
+	// UpdatedAt is when the tokens or guidelines last changed; nil if they
+	// never have
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// UpdateLibraryRequest represents the update library request. Both fields
+// replace what is stored.
+type UpdateLibraryRequest struct {
+	Tokens     Tokens `json:"tokens"`
+	Guidelines string `json:"guidelines"`
+}
+
+// UpdateComponentDocRequest represents the update component doc request
+type UpdateComponentDocRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Guidelines  string `json:"guidelines"`
+}
+
+// LibraryChange announces a change to an organization's design system
+type LibraryChange struct {
+	OrgID string `json:"orgId"`
+}
+
+// LibraryChanges is the topic design system changes are announced on. The
+// export service rebuilds the organization's documentation site from it.
+var LibraryChanges = pubsub.NewTopic[*LibraryChange]("design-library-changes", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// GetLibrary returns an organization's design system.
+//
+//encore:api auth method=GET path=/orgs/:orgID/design-system
+func GetLibrary(ctx context.Context, orgID string) (*Library, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member", "guest"); err != nil {
+		return nil, err
+	}
+	return readLibrary(ctx, orgID)
+}
+
+// LoadLibrary returns an organization's design system to other services.
+//
+//encore:api private method=GET path=/design-system/internal/:orgID
+func LoadLibrary(ctx context.Context, orgID string) (*Library, error) {
+	return readLibrary(ctx, orgID)
+}
+
+// UpdateLibrary replaces an organization's design tokens and guidelines.
+//
+//encore:api auth method=PUT path=/orgs/:orgID/design-system
+func UpdateLibrary(ctx context.Context, orgID string, req *UpdateLibraryRequest) (*Library, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin"); err != nil {
+		return nil, err
+	}
+	req.Guidelines = strings.TrimSpace(req.Guidelines)
+	if err := validateTokens(&req.Tokens); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: err.Error(),
+		}
+	}
+	if len(req.Guidelines) > maxGuidelinesLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("Guidelines can be at most %d characters", maxGuidelinesLength),
+		}
+	}
+
+	tokens, err := json.Marshal(req.Tokens)
+	if err == nil {
+		_, err = db.Exec(ctx, `
+			INSERT INTO design_libraries (org_id, tokens, guidelines, updated_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (org_id) DO UPDATE
+			SET tokens = EXCLUDED.tokens, guidelines = EXCLUDED.guidelines,
+				updated_by = EXCLUDED.updated_by, updated_at = NOW()
+		`, orgID, tokens, req.Guidelines, auth.UserID())
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update design system", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update design system",
+		}
+	}
+	announce(ctx, orgID)
+	return readLibrary(ctx, orgID)
+}
+
+// UpdateComponentDoc documents a shared component, replacing its previous
+// documentation.
+//
+//encore:api auth method=PUT path=/orgs/:orgID/design-system/components/:componentID
+func UpdateComponentDoc(ctx context.Context, orgID, componentID string, req *UpdateComponentDocRequest) (*ComponentDoc, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin"); err != nil {
+		return nil, err
+	}
+	componentID = strings.ToLower(strings.TrimSpace(componentID))
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+	req.Guidelines = strings.TrimSpace(req.Guidelines)
+	invalid := func(msg string) error {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: msg,
+		}
+	}
+	switch {
+	case componentID == "" || len(componentID) > maxComponentIDLength:
+		return nil, invalid("Invalid component ID")
+	case req.Name == "" || len(req.Name) > maxComponentName:
+		return nil, invalid(fmt.Sprintf("Name is required and can be at most %d characters", maxComponentName))
+	case len(req.Description) > maxComponentDesc:
+		return nil, invalid(fmt.Sprintf("Description can be at most %d characters", maxComponentDesc))
+	case len(req.Guidelines) > maxGuidelinesLength:
+		return nil, invalid(fmt.Sprintf("Guidelines can be at most %d characters", maxGuidelinesLength))
+	}
+
+	var count int
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM design_component_docs WHERE org_id = $1 AND component_id <> $2
+	`, orgID, componentID).Scan(&count)
+	if err == nil && count >= maxComponentDocs {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: fmt.Sprintf("An organization can document up to %d components", maxComponentDocs),
+		}
+	}
+	doc := &ComponentDoc{ComponentID: componentID}
+	if err == nil {
+		err = db.QueryRow(ctx, `
+			INSERT INTO design_component_docs (org_id, component_id, name, description, guidelines, updated_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (org_id, component_id) DO UPDATE
+			SET name = EXCLUDED.name, description = EXCLUDED.description, guidelines = EXCLUDED.guidelines,
+				updated_by = EXCLUDED.updated_by, updated_at = NOW()
+			RETURNING name, description, guidelines, COALESCE(updated_by::text, ''), updated_at
+		`, orgID, componentID, req.Name, req.Description, req.Guidelines, auth.UserID()).Scan(
+			&doc.Name, &doc.Description, &doc.Guidelines, &doc.UpdatedBy, &doc.UpdatedAt)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update component documentation", "org_id", orgID, "component_id", componentID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update component documentation",
+		}
+	}
+	announce(ctx, orgID)
+	return doc, nil
+}
+
+// DeleteComponentDoc removes a component's documentation. The component
+// itself, and its instances in projects, are not affected.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/design-system/components/:componentID
+func DeleteComponentDoc(ctx context.Context, orgID, componentID string) error {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin"); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM design_component_docs WHERE org_id = $1 AND component_id = $2
+	`, orgID, strings.ToLower(componentID))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete component documentation", "org_id", orgID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete component documentation",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Component documentation not found",
+		}
+	}
+	announce(ctx, orgID)
+	return nil
+}
+
+func readLibrary(ctx context.Context, orgID string) (*Library, error) {
+	lib := &Library{OrgID: orgID, Components: []ComponentDoc{}}
+	var tokens []byte
+	var updatedAt time.Time
+	err := db.QueryRow(ctx, `
+		SELECT tokens, guidelines, updated_at FROM design_libraries WHERE org_id = $1
+	`, orgID).Scan(&tokens, &lib.Guidelines, &updatedAt)
+	if err == nil {
+		lib.UpdatedAt = &updatedAt
+		err = json.Unmarshal(tokens, &lib.Tokens)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return nil, libraryError(ctx, orgID, err)
+	}
+	lib.Tokens.normalize()
+
+	rows, err := db.Query(ctx, `
+		SELECT component_id, name, description, guidelines, COALESCE(updated_by::text, ''), updated_at
+		FROM design_component_docs WHERE org_id = $1
+		ORDER BY lower(name), component_id
+	`, orgID)
+	if err != nil {
+		return nil, libraryError(ctx, orgID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d ComponentDoc
+		if err := rows.Scan(&d.ComponentID, &d.Name, &d.Description, &d.Guidelines, &d.UpdatedBy, &d.UpdatedAt); err != nil {
+			return nil, libraryError(ctx, orgID, err)
+		}
+		lib.Components = append(lib.Components, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, libraryError(ctx, orgID, err)
+	}
+	return lib, nil
+}
+
+func libraryError(ctx context.Context, orgID string, err error) error {
+	reqctx.Logger(ctx).Error("failed to load design system", "org_id", orgID, "error", err)
+	return &errs.Error{
+		Code:    errs.Internal,
+		Message: "Failed to load design system",
+	}
+}
+
+// normalize replaces missing token lists with empty ones.
+func (t *Tokens) normalize() {
+	if t.Colors == nil {
+		t.Colors = []ColorToken{}
+	}
+	if t.Typography == nil {
+		t.Typography = []TypographyToken{}
+	}
+	if t.Spacing == nil {
+		t.Spacing = []SizeToken{}
+	}
+	if t.Radii == nil {
+		t.Radii = []SizeToken{}
+	}
+}
+
+func validateTokens(t *Tokens) error {
+	t.normalize()
+	if len(t.Colors) > maxTokensPerKind || len(t.Typography) > maxTokensPerKind ||
+		len(t.Spacing) > maxTokensPerKind || len(t.Radii) > maxTokensPerKind {
+		return fmt.Errorf("each kind of token can have at most %d tokens", maxTokensPerKind)
+	}
+	names := map[string]bool{}
+	checkName := func(kind string, i int, name, description string) error {
+		if len(name) > maxTokenName || !tokenNamePattern.MatchString(name) {
+			return fmt.Errorf("%s[%d].name must be up to %d letters, digits, '-', '_', '.' or '/'", kind, i, maxTokenName)
+		}
+		key := kind + ":" + strings.ToLower(name)
+		if names[key] {
+			return fmt.Errorf("%s[%d].name %q is used twice", kind, i, name)
+		}
+		names[key] = true
+		if len(description) > maxComponentDesc {
+			return fmt.Errorf("%s[%d].description can be at most %d characters", kind, i, maxComponentDesc)
+		}
+		return nil
+	}
+
+	for i := range t.Colors {
+		c := &t.Colors[i]
+		c.Value = strings.TrimSpace(c.Value)
+		if err := checkName("colors", i, c.Name, c.Description); err != nil {
+			return err
+		}
+		if _, ok := render.ParseColor(c.Value); !ok || len(c.Value) > maxTokenValue {
+			return fmt.Errorf("colors[%d].value must be a CSS color", i)
+		}
+	}
+	for i := range t.Typography {
+		f := &t.Typography[i]
+		f.FontFamily = strings.TrimSpace(f.FontFamily)
+		if err := checkName("typography", i, f.Name, f.Description); err != nil {
+			return err
+		}
+		switch {
+		case f.FontFamily == "" || len(f.FontFamily) > maxFontFamily:
+			return fmt.Errorf("typography[%d].fontFamily is required", i)
+		case f.FontSize <= 0 || f.FontSize > 1000:
+			return fmt.Errorf("typography[%d].fontSize must be between 0 and 1000 pixels", i)
+		case f.FontWeight < 100 || f.FontWeight > 900 || f.FontWeight%100 != 0:
+			return fmt.Errorf("typography[%d].fontWeight must be 100, 200, ... or 900", i)
+		case f.LineHeight < 0 || f.LineHeight > 10:
+			return fmt.Errorf("typography[%d].lineHeight must be between 0 and 10", i)
+		}
+	}
+	lengths := []struct {
+		kind   string
+		tokens []SizeToken
+	}{{"spacing", t.Spacing}, {"radii", t.Radii}}
+	for _, l := range lengths {
+		for i, s := range l.tokens {
+			if err := checkName(l.kind, i, s.Name, s.Description); err != nil {
+				return err
+			}
+			if s.Value < 0 || s.Value > 10000 {
+				return fmt.Errorf("%s[%d].value must be between 0 and 10000 pixels", l.kind, i)
+			}
+		}
+	}
+	return nil
+}
+
+// announce publishes a design system change. A failure leaves the docs
+// site stale until the export service's periodic check, so it is logged,
+// not returned.
+func announce(ctx context.Context, orgID string) {
+	if _, err := LibraryChanges.Publish(ctx, &LibraryChange{OrgID: orgID}); err != nil {
+		reqctx.Logger(ctx).Warn("failed to announce design system change", "org_id", orgID, "error", err)
+	}
+}
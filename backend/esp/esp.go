@@ -0,0 +1,226 @@
+// Package esp pushes HTML email exports into email service providers'
+// template libraries, Mailchimp and SendGrid. A user connects an account
+// with an API key, which is sealed before it is stored. A project's export
+// preset is then mapped to a template of that account: the first push
+// creates the template, or adopts an existing one, and every later push
+// updates it in place, so campaigns built on it pick up re-exports.
+// Mappings push on their own whenever a new email export of their preset
+// completes (see templates.go).
+package esp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+	"canvasai/tokenbox"
+)
+
+var secrets struct {
+	// ESPCredentialKey is a base64-encoded 32-byte key that seals the
+	// accounts' API keys at rest.
+	ESPCredentialKey string
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+// Connections and templates are stored alongside the projects they publish.
+var db = sqldb.Named("project")
+
+// maxConnectionsPerUser bounds the accounts a user can connect
+const maxConnectionsPerUser = 10
+
+// Providers
+const (
+	ProviderMailchimp = "mailchimp"
+	ProviderSendGrid  = "sendgrid"
+)
+
+// Connection is an email service provider account a user has connected
+type Connection struct {
+	ID          string    `json:"id"`
+	Provider    string    `json:"provider"`
+	AccountName string    `json:"accountName"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// ConnectAccountRequest represents the connect account request
+type ConnectAccountRequest struct {
+	Provider string `json:"provider"`
+	// APIKey is a Mailchimp API key, or a SendGrid API key with template
+	// access. It is never returned.
+	APIKey string `json:"apiKey"`
+}
+
+// ListConnectionsResponse represents the list connections response
+type ListConnectionsResponse struct {
+	Connections []Connection `json:"connections"`
+}
+
+//encore:api auth method=POST path=/esp/connections
+func ConnectAccount(ctx context.Context, req *ConnectAccountRequest) (*Connection, error) {
+	userID := auth.UserID()
+	p, ok := providers[req.Provider]
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Provider must be mailchimp or sendgrid",
+		}
+	}
+	key := strings.TrimSpace(req.APIKey)
+	if key == "" || len(key) > 512 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "An API key is required",
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM esp_connections WHERE user_id = $1`, userID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count esp connections", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect account",
+		}
+	}
+	if count >= maxConnectionsPerUser {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "You can connect up to 10 accounts",
+		}
+	}
+
+	c := &connection{Connection: Connection{Provider: req.Provider}, key: key}
+	name, err := p.account(ctx, c)
+	if err != nil {
+		return nil, providerError(ctx, "failed to verify esp account", err)
+	}
+	c.AccountName = name
+
+	sealed, err := tokenbox.Seal(secrets.ESPCredentialKey, key)
+	if errors.Is(err, tokenbox.ErrNoKey) {
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Email template sync is not configured",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to seal esp key", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect account",
+		}
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO esp_connections (user_id, provider, account_name, api_key_ciphertext)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, userID, c.Provider, c.AccountName, sealed).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create esp connection", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect account",
+		}
+	}
+
+	reqctx.Logger(ctx).Info("esp account connected", "connection_id", c.ID, "provider", c.Provider)
+	return &c.Connection, nil
+}
+
+//encore:api auth method=GET path=/esp/connections
+func ListConnections(ctx context.Context) (*ListConnectionsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, provider, account_name, created_at
+		FROM esp_connections
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, auth.UserID())
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch connections",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListConnectionsResponse{Connections: []Connection{}}
+	for rows.Next() {
+		var c Connection
+		if err := rows.Scan(&c.ID, &c.Provider, &c.AccountName, &c.CreatedAt); err != nil {
+			continue
+		}
+		resp.Connections = append(resp.Connections, c)
+	}
+	return resp, nil
+}
+
+// DisconnectAccount removes a connection and its template mappings. The
+// templates themselves are left in the account.
+//
+//encore:api auth method=DELETE path=/esp/connections/:id
+func DisconnectAccount(ctx context.Context, id string) error {
+	result, err := db.Exec(ctx, `
+		DELETE FROM esp_connections WHERE id::text = $1 AND user_id = $2
+	`, id, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete esp connection", "connection_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to disconnect account",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Connection not found",
+		}
+	}
+	reqctx.Logger(ctx).Info("esp account disconnected", "connection_id", id)
+	return nil
+}
+
+// connection is a Connection with the key to call the provider
+type connection struct {
+	Connection
+	key string
+}
+
+// getConnection loads a connection owned by userID, or any connection when
+// userID is empty.
+func getConnection(ctx context.Context, id, userID string) (*connection, error) {
+	c := &connection{}
+	var sealed []byte
+	err := db.QueryRow(ctx, `
+		SELECT id, provider, account_name, api_key_ciphertext, created_at
+		FROM esp_connections
+		WHERE id::text = $1 AND ($2 = '' OR user_id::text = $2)
+	`, id, userID).Scan(&c.ID, &c.Provider, &c.AccountName, &sealed, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Connection not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load esp connection", "connection_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load connection",
+		}
+	}
+	if c.key, err = tokenbox.Open(secrets.ESPCredentialKey, sealed); err != nil {
+		reqctx.Logger(ctx).Error("failed to open esp key", "connection_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load connection",
+		}
+	}
+	return c, nil
+}
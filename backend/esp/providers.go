@@ -0,0 +1,256 @@
+package esp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/outbound"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// espClient calls the providers' APIs, which are the only hosts it may
+// reach. Mailchimp's hosts are per data center, e.g. us6.api.mailchimp.com.
+var espClient = outbound.NewClient(outbound.Policy{
+	Timeout:          30 * time.Second,
+	MaxResponseBytes: 2 << 20,
+	AllowedHosts:     []string{".api.mailchimp.com", "api.sendgrid.com"},
+	RateLimit:        ratelimit.Limit{Requests: 5, Per: time.Second},
+})
+
+// provider is an email service provider's template API
+type provider interface {
+	// account checks the key and returns the account's name
+	account(ctx context.Context, c *connection) (string, error)
+	// push creates t's template, or updates it when it has an ID, and
+	// returns the template's ID and, for providers with versions, the
+	// version holding the HTML
+	push(ctx context.Context, c *connection, t *Template, html string) (templateID, versionID string, err error)
+}
+
+var providers = map[string]provider{
+	ProviderMailchimp: mailchimp{},
+	ProviderSendGrid:  sendgrid{},
+}
+
+// apiError is an error response from a provider
+type apiError struct {
+	provider string
+	status   int
+	message  string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("esp: %s: HTTP %d: %s", e.provider, e.status, e.message)
+}
+
+func notFound(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.status == http.StatusNotFound
+}
+
+// providerError turns a failed provider call into an API error, passing on
+// the provider's reason when it rejected the request.
+func providerError(ctx context.Context, msg string, err error) error {
+	var pe *apiError
+	if errors.As(err, &pe) && pe.status < 500 {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: pe.provider + " rejected the request: " + pe.message,
+		}
+	}
+	reqctx.Logger(ctx).Error(msg, "error", err)
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "The email service provider could not be reached",
+	}
+}
+
+// call sends a JSON request to a provider and decodes the JSON response
+// into out. message extracts the provider's reason from an error body.
+func call(ctx context.Context, name, method, endpoint string, setAuth func(*http.Request), body, out any, message func([]byte) string) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	setAuth(req)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := espClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := message(data)
+		if msg == "" {
+			msg = resp.Status
+		}
+		return &apiError{provider: name, status: resp.StatusCode, message: msg}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// mailchimp is the Mailchimp Marketing API. Keys end in their data center,
+// e.g. "…-us6", which picks the API host.
+type mailchimp struct{}
+
+// mailchimpDC matches a data center suffix
+var mailchimpDC = regexp.MustCompile(`^[a-z]+[0-9]+$`)
+
+// mailchimpNameLength is the longest template name Mailchimp accepts
+const mailchimpNameLength = 50
+
+func (mailchimp) call(ctx context.Context, c *connection, method, path string, body, out any) error {
+	i := strings.LastIndex(c.key, "-")
+	dc := c.key[i+1:]
+	if i < 0 || !mailchimpDC.MatchString(dc) {
+		return &apiError{provider: "Mailchimp", status: http.StatusBadRequest, message: "the API key does not end in a data center such as -us6"}
+	}
+	setAuth := func(req *http.Request) { req.SetBasicAuth("canvasai", c.key) }
+	return call(ctx, "Mailchimp", method, "https://"+dc+".api.mailchimp.com/3.0"+path, setAuth, body, out, func(data []byte) string {
+		var e struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		}
+		json.Unmarshal(data, &e)
+		if e.Detail != "" {
+			return e.Detail
+		}
+		return e.Title
+	})
+}
+
+func (m mailchimp) account(ctx context.Context, c *connection) (string, error) {
+	var resp struct {
+		AccountName string `json:"account_name"`
+	}
+	err := m.call(ctx, c, http.MethodGet, "/?fields=account_name", nil, &resp)
+	return resp.AccountName, err
+}
+
+func (m mailchimp) push(ctx context.Context, c *connection, t *Template, html string) (string, string, error) {
+	body := map[string]string{"name": truncate(t.Name, mailchimpNameLength), "html": html}
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	if t.TemplateID != "" {
+		err := m.call(ctx, c, http.MethodPatch, "/templates/"+t.TemplateID, body, &resp)
+		if !notFound(err) {
+			return t.TemplateID, "", err
+		}
+		// Deleted in Mailchimp; start a new one.
+	}
+	if err := m.call(ctx, c, http.MethodPost, "/templates", body, &resp); err != nil {
+		return "", "", err
+	}
+	return strconv.FormatInt(resp.ID, 10), "", nil
+}
+
+// sendgrid is the SendGrid v3 API. A dynamic template holds its HTML in
+// versions; a push updates the version it created, or adds one when the
+// template was adopted or the version deleted.
+type sendgrid struct{}
+
+func (sendgrid) call(ctx context.Context, c *connection, method, path string, body, out any) error {
+	setAuth := func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+c.key) }
+	return call(ctx, "SendGrid", method, "https://api.sendgrid.com/v3"+path, setAuth, body, out, func(data []byte) string {
+		var e struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		if json.Unmarshal(data, &e) != nil || len(e.Errors) == 0 {
+			return ""
+		}
+		return e.Errors[0].Message
+	})
+}
+
+func (s sendgrid) account(ctx context.Context, c *connection) (string, error) {
+	// Listing templates checks the key can manage them.
+	if err := s.call(ctx, c, http.MethodGet, "/templates?generations=dynamic&page_size=1", nil, nil); err != nil {
+		return "", err
+	}
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := s.call(ctx, c, http.MethodGet, "/user/username", nil, &user); err != nil || user.Username == "" {
+		// Keys restricted to templates cannot read the username.
+		return "SendGrid", nil
+	}
+	return user.Username, nil
+}
+
+func (s sendgrid) push(ctx context.Context, c *connection, t *Template, html string) (string, string, error) {
+	subject := t.Subject
+	if subject == "" {
+		subject = t.Name
+	}
+	version := map[string]any{"name": t.Name, "subject": subject, "html_content": html}
+	var resp struct {
+		ID string `json:"id"`
+	}
+
+	templateID, versionID := t.TemplateID, t.versionID
+	if templateID != "" && versionID != "" {
+		err := s.call(ctx, c, http.MethodPatch, "/templates/"+templateID+"/versions/"+versionID, version, &resp)
+		if !notFound(err) {
+			return templateID, versionID, err
+		}
+	}
+	if templateID != "" {
+		version["active"] = 1
+		err := s.call(ctx, c, http.MethodPost, "/templates/"+templateID+"/versions", version, &resp)
+		if !notFound(err) {
+			return templateID, resp.ID, err
+		}
+		// Deleted in SendGrid; start a new one.
+	}
+	err := s.call(ctx, c, http.MethodPost, "/templates", map[string]string{"name": t.Name, "generation": "dynamic"}, &resp)
+	if err != nil {
+		return "", "", err
+	}
+	templateID = resp.ID
+	version["active"] = 1
+	if err := s.call(ctx, c, http.MethodPost, "/templates/"+templateID+"/versions", version, &resp); err != nil {
+		return templateID, "", err
+	}
+	return templateID, resp.ID, nil
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
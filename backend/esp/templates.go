@@ -0,0 +1,398 @@
+package esp
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+
+	"canvasai/asset"
+	"canvasai/export"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+const maxTemplatesPerProject = 50
+
+// Template statuses
+const (
+	StatusPending = "pending"
+	StatusSynced  = "synced"
+	StatusFailed  = "failed"
+)
+
+// templateIDPattern matches Mailchimp and SendGrid ("d-…") template IDs
+var templateIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// Template maps a project's email export preset to a provider template
+type Template struct {
+	ID           string `json:"id"`
+	ProjectID    string `json:"projectId"`
+	ConnectionID string `json:"connectionId"`
+	Provider     string `json:"provider"`
+	Preset       string `json:"preset"`
+	Name         string `json:"name"`
+	// Subject is the subject of SendGrid template versions; it defaults to
+	// the name
+	Subject string `json:"subject,omitempty"`
+	// TemplateID is the provider's template ID once pushed
+	TemplateID string `json:"templateId,omitempty"`
+	// AutoSync pushes each new export of the preset as it completes
+	AutoSync       bool       `json:"autoSync"`
+	SyncedExportID string     `json:"syncedExportId,omitempty"`
+	Status         string     `json:"status"`
+	LastError      string     `json:"lastError,omitempty"`
+	SyncedAt       *time.Time `json:"syncedAt,omitempty"`
+	CreatedBy      string     `json:"createdBy,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+
+	versionID string
+}
+
+// CreateTemplateRequest represents the create template request
+type CreateTemplateRequest struct {
+	ConnectionID string `json:"connectionId"`
+	// Preset is the email_html export preset whose exports are pushed
+	Preset  string `json:"preset"`
+	Name    string `json:"name"`
+	Subject string `json:"subject,omitempty"`
+	// TemplateID adopts an existing template instead of creating one
+	TemplateID string `json:"templateId,omitempty"`
+	// AutoSync defaults to true
+	AutoSync *bool `json:"autoSync,omitempty"`
+}
+
+// ListTemplatesResponse represents the list templates response
+type ListTemplatesResponse struct {
+	Templates []Template `json:"templates"`
+}
+
+// CreateTemplate maps an email export preset to a template of one of the
+// caller's accounts. When the preset already has a completed email export
+// it is pushed straight away.
+//
+//encore:api auth method=POST path=/projects/:id/email-templates
+func CreateTemplate(ctx context.Context, id string, req *CreateTemplateRequest) (*Template, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	userID := auth.UserID()
+	preset := strings.TrimSpace(req.Preset)
+	if preset == "" || len(preset) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Preset is required and must be at most 100 characters",
+		}
+	}
+	name := strings.TrimSpace(req.Name)
+	subject := strings.TrimSpace(req.Subject)
+	if name == "" || len(name) > 255 || len(subject) > 255 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name is required, and name and subject must be at most 255 characters",
+		}
+	}
+	if req.TemplateID != "" && !templateIDPattern.MatchString(req.TemplateID) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid template ID",
+		}
+	}
+
+	c, err := getConnection(ctx, req.ConnectionID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM esp_templates WHERE project_id = $1`, id).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count esp templates", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to map template",
+		}
+	}
+	if count >= maxTemplatesPerProject {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "A project can be mapped to up to 50 templates",
+		}
+	}
+
+	t := &Template{
+		ProjectID:    id,
+		ConnectionID: c.ID,
+		Provider:     c.Provider,
+		Preset:       preset,
+		Name:         name,
+		Subject:      subject,
+		TemplateID:   req.TemplateID,
+		AutoSync:     req.AutoSync == nil || *req.AutoSync,
+		Status:       StatusPending,
+		CreatedBy:    userID,
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO esp_templates (project_id, connection_id, preset, name, subject, template_id, auto_sync, created_by)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8)
+		ON CONFLICT (project_id, connection_id, preset) DO NOTHING
+		RETURNING id, created_at
+	`, id, c.ID, preset, name, subject, t.TemplateID, t.AutoSync, userID).Scan(&t.ID, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "The preset is already mapped to a template of this account",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create esp template", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to map template",
+		}
+	}
+	reqctx.Logger(ctx).Info("email template mapped", "template_id", t.ID, "project_id", id, "provider", c.Provider)
+
+	exportID, assetID, err := latestExport(ctx, id, preset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find email template export", "template_id", t.ID, "error", err)
+	} else if exportID != "" {
+		// A failed first push is recorded on the template and can be retried.
+		pushTemplate(ctx, c, t, exportID, assetID)
+	}
+	return t, nil
+}
+
+//encore:api auth method=GET path=/projects/:id/email-templates
+func ListTemplates(ctx context.Context, id string) (*ListTemplatesResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, templateColumns+` WHERE t.project_id = $1 ORDER BY t.created_at`, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch templates",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListTemplatesResponse{Templates: []Template{}}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			continue
+		}
+		resp.Templates = append(resp.Templates, *t)
+	}
+	return resp, nil
+}
+
+// SyncTemplate pushes the preset's latest completed email export now. Only
+// the person who connected the account can push to it.
+//
+//encore:api auth method=POST path=/projects/:id/email-templates/:templateID/sync
+func SyncTemplate(ctx context.Context, id, templateID string) (*Template, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	t, err := getTemplate(ctx, id, templateID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := getConnection(ctx, t.ConnectionID, auth.UserID())
+	if errs.Code(err) == errs.NotFound {
+		return nil, &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only the person who connected this account can push to it",
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	exportID, assetID, err := latestExport(ctx, id, t.Preset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find email template export", "template_id", t.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to push template",
+		}
+	}
+	if exportID == "" {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "The preset has no completed email export to push",
+		}
+	}
+	if err := pushTemplate(ctx, c, t, exportID, assetID); err != nil {
+		return nil, providerError(ctx, "failed to push email template", err)
+	}
+	return t, nil
+}
+
+// DeleteTemplate removes a mapping. The template is left in the account.
+//
+//encore:api auth method=DELETE path=/projects/:id/email-templates/:templateID
+func DeleteTemplate(ctx context.Context, id, templateID string) error {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM esp_templates WHERE id::text = $1 AND project_id = $2
+	`, templateID, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete esp template", "template_id", templateID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to remove template",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Template not found",
+		}
+	}
+	return nil
+}
+
+var _ = pubsub.NewSubscription(export.Completions, "sync-email-templates-on-export", pubsub.SubscriptionConfig[*export.CompletedExport]{
+	Handler: syncCompletedExport,
+})
+
+// syncCompletedExport pushes a completed email export, including a
+// regenerated one, to the templates mapped to its preset with auto-sync
+// on. Failures are recorded on each template rather than retried.
+func syncCompletedExport(ctx context.Context, msg *export.CompletedExport) error {
+	if msg.Kind != export.KindEmailHTML {
+		return nil
+	}
+	rows, err := db.Query(ctx, templateColumns+`
+		WHERE t.project_id = $1 AND t.preset = $2 AND t.auto_sync
+			AND t.synced_export_id IS DISTINCT FROM $3::uuid
+	`, msg.ProjectID, msg.Preset, msg.JobID)
+	if err != nil {
+		return err
+	}
+	var templates []*Template
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		templates = append(templates, t)
+	}
+	rows.Close()
+
+	for _, t := range templates {
+		log := reqctx.Logger(ctx).With("template_id", t.ID, "export_id", msg.JobID)
+		c, err := getConnection(ctx, t.ConnectionID, "")
+		if err != nil {
+			log.Error("failed to load esp connection for sync", "error", err)
+			continue
+		}
+		if err := pushTemplate(ctx, c, t, msg.JobID, msg.AssetID); err != nil {
+			log.Warn("email template auto-sync failed", "error", err)
+		}
+	}
+	return nil
+}
+
+// pushTemplate pushes an export's HTML to the template and records the
+// outcome on t.
+func pushTemplate(ctx context.Context, c *connection, t *Template, exportID, assetID string) error {
+	log := reqctx.Logger(ctx).With("template_id", t.ID, "export_id", exportID)
+	var templateID, versionID string
+	data, err := asset.Read(ctx, assetID)
+	if err == nil {
+		templateID, versionID, err = providers[c.Provider].push(ctx, c, t, string(data.Data))
+	}
+	if templateID != "" {
+		t.TemplateID, t.versionID = templateID, versionID
+	}
+	if err != nil {
+		t.Status, t.LastError = StatusFailed, err.Error()
+		// Keep a template that was created before the failure, so the next
+		// push updates it rather than creating another.
+		if _, dbErr := db.Exec(ctx, `
+			UPDATE esp_templates
+			SET status = $2, last_error = $3, template_id = NULLIF($4, ''), version_id = NULLIF($5, '')
+			WHERE id = $1
+		`, t.ID, t.Status, t.LastError, t.TemplateID, t.versionID); dbErr != nil {
+			log.Error("failed to record email template push failure", "error", dbErr)
+		}
+		return err
+	}
+
+	now := time.Now()
+	t.SyncedExportID, t.Status, t.LastError, t.SyncedAt = exportID, StatusSynced, "", &now
+	_, err = db.Exec(ctx, `
+		UPDATE esp_templates
+		SET template_id = $2, version_id = NULLIF($3, ''), synced_export_id = $4, status = $5, last_error = NULL, synced_at = $6
+		WHERE id = $1
+	`, t.ID, t.TemplateID, t.versionID, exportID, t.Status, now)
+	if err != nil {
+		// Without the template ID the next push would create a duplicate.
+		log.Error("failed to record email template push", "provider_template_id", t.TemplateID, "error", err)
+		return err
+	}
+	log.Info("email template pushed", "provider", c.Provider, "provider_template_id", t.TemplateID)
+	return nil
+}
+
+// latestExport returns the project's most recent completed email export of
+// a preset whose artifact is still kept, or empty IDs if there is none.
+func latestExport(ctx context.Context, projectID, preset string) (exportID, assetID string, err error) {
+	err = db.QueryRow(ctx, `
+		SELECT id, artifact_asset_id
+		FROM export_jobs
+		WHERE project_id = $1 AND preset = $2 AND kind = $3 AND status = 'completed'
+			AND purged_at IS NULL AND artifact_asset_id IS NOT NULL
+		ORDER BY completed_at DESC
+		LIMIT 1
+	`, projectID, preset, export.KindEmailHTML).Scan(&exportID, &assetID)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return exportID, assetID, err
+}
+
+const templateColumns = `
+	SELECT t.id, t.project_id, t.connection_id, c.provider, t.preset, t.name, t.subject,
+		COALESCE(t.template_id, ''), COALESCE(t.version_id, ''), t.auto_sync, COALESCE(t.synced_export_id::text, ''),
+		t.status, COALESCE(t.last_error, ''), t.synced_at, COALESCE(t.created_by::text, ''), t.created_at
+	FROM esp_templates t
+	JOIN esp_connections c ON c.id = t.connection_id`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTemplate(row scanner) (*Template, error) {
+	t := &Template{}
+	err := row.Scan(&t.ID, &t.ProjectID, &t.ConnectionID, &t.Provider, &t.Preset, &t.Name, &t.Subject,
+		&t.TemplateID, &t.versionID, &t.AutoSync, &t.SyncedExportID,
+		&t.Status, &t.LastError, &t.SyncedAt, &t.CreatedBy, &t.CreatedAt)
+	return t, err
+}
+
+func getTemplate(ctx context.Context, projectID, templateID string) (*Template, error) {
+	t, err := scanTemplate(db.QueryRow(ctx, templateColumns+` WHERE t.id::text = $1 AND t.project_id = $2`, templateID, projectID))
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Template not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load esp template", "template_id", templateID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load template",
+		}
+	}
+	return t, nil
+}
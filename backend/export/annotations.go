@@ -0,0 +1,345 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Clients who review in Acrobat rather than in CanvasAI annotate the review
+// PDF and send it back. Review PDF exports record an element manifest, the
+// box every element was drawn in, so uploading the annotated file maps each
+// note onto the element under it and files it as a comment. A note placed
+// on an existing thread's callout becomes a reply to that thread.
+
+// Import limits
+const (
+	maxAnnotatedPDFSize    = 50 << 20
+	maxImportedAnnotations = 500
+	maxCommentLength       = 10000
+)
+
+// elementManifest records where a PDF export drew each element. Page i of
+// the manifest is page i of the PDF; pages beyond it (such as the review
+// index) show no canvas.
+type elementManifest struct {
+	Revision int            `json:"revision"`
+	Pages    []manifestPage `json:"pages"`
+}
+
+type manifestPage struct {
+	PageID   string             `json:"pageId"`
+	Width    float64            `json:"width"`
+	Height   float64            `json:"height"`
+	Elements []render.Placement `json:"elements"`
+	Callouts []manifestCallout  `json:"callouts,omitempty"`
+}
+
+// manifestCallout is a comment thread's numbered callout on a page
+type manifestCallout struct {
+	CommentID string  `json:"commentId"`
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+}
+
+// ImportAnnotationsRequest represents the import annotations request
+type ImportAnnotationsRequest struct {
+	// Data is the annotated PDF
+	Data []byte `json:"data"`
+}
+
+// ImportedAnnotation is a PDF annotation imported as a comment
+type ImportedAnnotation struct {
+	CommentID string   `json:"commentId"`
+	ParentID  *string  `json:"parentId,omitempty"`
+	Page      int      `json:"page"` // 1-based page of the PDF
+	Subtype   string   `json:"subtype"`
+	Author    string   `json:"author,omitempty"`
+	ElementID *string  `json:"elementId,omitempty"`
+	X         *float64 `json:"x,omitempty"`
+	Y         *float64 `json:"y,omitempty"`
+}
+
+// ImportAnnotationsResponse represents the import annotations response
+type ImportAnnotationsResponse struct {
+	Imported []ImportedAnnotation `json:"imported"`
+	// Duplicates counts annotations imported by an earlier upload
+	Duplicates int `json:"duplicates"`
+	// Empty counts annotations with no text, such as bare highlights
+	Empty int `json:"empty"`
+}
+
+// ImportAnnotations files the annotations of a reviewed copy of a review
+// PDF export as comments on its project. Anyone who can comment on the
+// project can import, and uploading the same file again is harmless.
+//
+//encore:api auth method=POST path=/exports/:id/annotations
+func ImportAnnotations(ctx context.Context, id string, req *ImportAnnotationsRequest) (*ImportAnnotationsResponse, error) {
+	var projectID, status string
+	var raw []byte
+	err := db.QueryRow(ctx, `
+		SELECT project_id, status, element_manifest FROM export_jobs WHERE id = $1
+	`, id).Scan(&projectID, &status, &raw)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Export not found",
+		}
+	}
+	if err := projectaccess.RequireRole(ctx, projectID, permissions.RoleCommenter); err != nil {
+		return nil, err
+	}
+	var manifest elementManifest
+	if status != StatusCompleted || len(raw) == 0 || json.Unmarshal(raw, &manifest) != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Annotations can only be imported into review PDF exports",
+		}
+	}
+	if len(req.Data) == 0 || len(req.Data) > maxAnnotatedPDFSize {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "PDF must be between 1 byte and 50 MB",
+		}
+	}
+
+	annots, err := render.ReadAnnotations(req.Data)
+	if errors.Is(err, render.ErrEncryptedPDF) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Password-protected PDFs cannot be imported; save an unprotected copy",
+		}
+	}
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Could not read the PDF: " + err.Error(),
+		}
+	}
+	if len(annots) > maxImportedAnnotations {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("PDF has more than %d annotations", maxImportedAnnotations),
+		}
+	}
+
+	keys := map[int]string{}
+	for _, a := range annots {
+		if a.Ref != 0 {
+			keys[a.Ref] = annotationKey(a)
+		}
+	}
+	// Threads before their replies
+	ordered := make([]render.Annotation, 0, len(annots))
+	for _, a := range annots {
+		if a.InReplyTo == 0 {
+			ordered = append(ordered, a)
+		}
+	}
+	for _, a := range annots {
+		if a.InReplyTo != 0 {
+			ordered = append(ordered, a)
+		}
+	}
+
+	userID := auth.UserID()
+	resp := &ImportAnnotationsResponse{Imported: []ImportedAnnotation{}}
+	for _, a := range ordered {
+		content := strings.TrimSpace(a.Contents)
+		if content == "" {
+			resp.Empty++
+			continue
+		}
+		if a.Author != "" {
+			content = a.Author + " (from PDF): " + content
+		}
+		content = truncate(content, maxCommentLength)
+
+		imp := ImportedAnnotation{Page: a.Page + 1, Subtype: a.Subtype, Author: a.Author}
+		if a.InReplyTo != 0 {
+			if parentKey, ok := keys[a.InReplyTo]; ok {
+				imp.ParentID = importedThread(ctx, id, parentKey)
+			}
+		}
+		if imp.ParentID == nil {
+			elementID, point, calloutID := anchorAnnotation(&manifest, a)
+			if calloutID != "" && threadExists(ctx, projectID, calloutID) {
+				imp.ParentID = &calloutID
+			} else {
+				if elementID != "" {
+					imp.ElementID = &elementID
+				}
+				if point != nil {
+					imp.X, imp.Y = &point.X, &point.Y
+				}
+			}
+		}
+
+		commentID, err := importAnnotation(ctx, id, projectID, userID, annotationKey(a), content, &imp)
+		if err == errAlreadyImported {
+			resp.Duplicates++
+			continue
+		}
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to import annotation", "export_id", id, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to import annotations",
+			}
+		}
+		imp.CommentID = commentID
+		resp.Imported = append(resp.Imported, imp)
+	}
+
+	reqctx.Logger(ctx).Info("pdf annotations imported", "export_id", id, "project_id", projectID,
+		"imported", len(resp.Imported), "duplicates", resp.Duplicates)
+	return resp, nil
+}
+
+var errAlreadyImported = errors.New("annotation already imported")
+
+// importAnnotation stores an annotation as a comment, unless an earlier
+// upload of the export already imported it.
+func importAnnotation(ctx context.Context, exportID, projectID, userID, key, content string, imp *ImportedAnnotation) (string, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var commentID string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO project_comments (project_id, user_id, parent_id, content, element_id, position_x, position_y)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, projectID, userID, imp.ParentID, content, imp.ElementID, imp.X, imp.Y).Scan(&commentID)
+	if err != nil {
+		return "", err
+	}
+	result, err := tx.Exec(ctx, `
+		INSERT INTO export_annotation_imports (export_id, annotation_key, comment_id, author, imported_by)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		ON CONFLICT (export_id, annotation_key) DO NOTHING
+	`, exportID, key, commentID, truncate(imp.Author, 255), userID)
+	if err != nil {
+		return "", err
+	}
+	if result.RowsAffected() == 0 {
+		return "", errAlreadyImported
+	}
+	return commentID, tx.Commit()
+}
+
+// importedThread returns the thread an imported annotation belongs to: its
+// comment, or that comment's parent when it was itself a reply.
+func importedThread(ctx context.Context, exportID, key string) *string {
+	var threadID string
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(c.parent_id, c.id) FROM export_annotation_imports i
+		JOIN project_comments c ON c.id = i.comment_id
+		WHERE i.export_id = $1 AND i.annotation_key = $2
+	`, exportID, key).Scan(&threadID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			reqctx.Logger(ctx).Warn("failed to look up imported thread", "export_id", exportID, "error", err)
+		}
+		return nil
+	}
+	return &threadID
+}
+
+// threadExists reports whether commentID is still a thread of the project.
+func threadExists(ctx context.Context, projectID, commentID string) bool {
+	var exists bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM project_comments WHERE id = $1 AND project_id = $2 AND parent_id IS NULL)
+	`, commentID, projectID).Scan(&exists)
+	return err == nil && exists
+}
+
+// anchorAnnotation maps an annotation onto the canvas. A note placed on a
+// thread's callout returns that thread's comment ID. Otherwise it anchors
+// to the smallest element under its anchor point, or failing that the
+// element it overlaps most. Sticky notes anchor at their icon's top-left
+// corner, other markup at its center. Annotations on pages beyond the
+// manifest, such as the review index, have no anchor.
+func anchorAnnotation(m *elementManifest, a render.Annotation) (elementID string, point *render.Point, calloutID string) {
+	if a.Page < 0 || a.Page >= len(m.Pages) {
+		return "", nil, ""
+	}
+	page := m.Pages[a.Page]
+	p := render.Point{X: a.Rect.X, Y: a.Rect.Y}
+	if a.Subtype != "Text" {
+		p.X, p.Y = a.Rect.Center()
+	}
+
+	for _, c := range page.Callouts {
+		if math.Hypot(p.X-c.X, p.Y-c.Y) <= calloutRadius+4 {
+			return "", nil, c.CommentID
+		}
+	}
+
+	best, bestArea := "", math.Inf(1)
+	for _, e := range page.Elements {
+		b := e.Box
+		if p.X >= b.X && p.X <= b.X+b.W && p.Y >= b.Y && p.Y <= b.Y+b.H && b.W*b.H <= bestArea {
+			best, bestArea = e.ID, b.W*b.H
+		}
+	}
+	if best == "" {
+		bestOverlap := 0.0
+		for _, e := range page.Elements {
+			if o := overlap(a.Rect, e.Box); o > bestOverlap {
+				best, bestOverlap = e.ID, o
+			}
+		}
+	}
+	return best, &p, ""
+}
+
+// overlap returns the area two boxes share.
+func overlap(a, b render.Box) float64 {
+	w := math.Min(a.X+a.W, b.X+b.W) - math.Max(a.X, b.X)
+	h := math.Min(a.Y+a.H, b.Y+b.H) - math.Max(a.Y, b.Y)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	return w * h
+}
+
+// annotationKey identifies an annotation across uploads: by its unique
+// name when the tool set one, otherwise by its page, position and text.
+func annotationKey(a render.Annotation) string {
+	if a.Name != "" && len(a.Name) <= 100 {
+		return fmt.Sprintf("nm:%d:%s", a.Page, a.Name)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%.1f,%.1f,%.1f,%.1f|%s|%s",
+		a.Page, a.Subtype, a.Rect.X, a.Rect.Y, a.Rect.W, a.Rect.H, a.Author, a.Contents)))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
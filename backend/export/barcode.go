@@ -0,0 +1,36 @@
+package export
+
+import (
+	"net/http"
+	"strings"
+
+	"canvasai/barcode"
+)
+
+// maxBarcodeValueLength bounds preview values; the largest QR code holds
+// under 3KB anyway.
+const maxBarcodeValueLength = 4096
+
+// BarcodePreview draws a barcode as SVG for the editor, from the format,
+// value, errorCorrection and showText query parameters of a barcode
+// element. Exports draw the element themselves (see render.drawBarcode),
+// so the preview matches them bar for bar. Values that cannot be encoded
+// are rejected with the reason.
+//
+//encore:api auth raw method=GET path=/barcodes/preview
+func BarcodePreview(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	value := q.Get("value")
+	if len(value) > maxBarcodeValueLength {
+		http.Error(w, "value is too long", http.StatusBadRequest)
+		return
+	}
+	code, err := barcode.Encode(q.Get("format"), value, barcode.Options{ErrorCorrection: q.Get("errorCorrection")})
+	if err != nil {
+		http.Error(w, strings.TrimPrefix(err.Error(), "barcode: "), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(code.SVG(q.Get("showText") == "true"))
+}
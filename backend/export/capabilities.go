@@ -0,0 +1,126 @@
+package export
+
+import (
+	"context"
+	"sort"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// capabilities maps export kinds to what their output format can reproduce.
+// Every kind in exporters should have an entry.
+var capabilities = map[string][]render.Capability{
+	KindReviewPDF: render.PDFCapabilities,
+	KindMockup:    render.RasterCapabilities,
+	KindEmailHTML: render.RasterCapabilities,
+	KindSVG:       render.SVGCapabilities,
+}
+
+// CapabilitiesResponse lists the canvas features each export kind supports
+type CapabilitiesResponse struct {
+	Kinds map[string][]render.Capability `json:"kinds"`
+}
+
+// ListExportCapabilities tells clients which canvas features each export
+// kind reproduces, approximates or drops, so the editor can warn before a
+// design relies on something that will not survive export.
+//
+//encore:api auth method=GET path=/export-capabilities
+func ListExportCapabilities(ctx context.Context) (*CapabilitiesResponse, error) {
+	return &CapabilitiesResponse{Kinds: capabilities}, nil
+}
+
+// PreflightRequest represents an export preflight request
+type PreflightRequest struct {
+	Kind string `json:"kind"`
+}
+
+// DegradedFeature is a canvas feature a project uses that the export will
+// not reproduce exactly
+type DegradedFeature struct {
+	Feature string `json:"feature"`
+	// Count is the number of elements affected
+	Count   int    `json:"count"`
+	Support string `json:"support"`
+	Note    string `json:"note,omitempty"`
+}
+
+// PreflightResponse represents an export preflight result
+type PreflightResponse struct {
+	Kind     string            `json:"kind"`
+	Elements int               `json:"elements"`
+	Degraded []DegradedFeature `json:"degraded"`
+}
+
+// PreflightExport renders the project's current canvas as the export would
+// and reports the features that will be dropped or approximated.
+//
+//encore:api auth method=POST path=/projects/:id/exports/preflight
+func PreflightExport(ctx context.Context, id string, req *PreflightRequest) (*PreflightResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	caps, ok := capabilities[req.Kind]
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Unsupported export kind",
+		}
+	}
+
+	var canvasData []byte
+	var width, height int
+	var colorProfile string
+	err := db.QueryRow(ctx, `
+		SELECT canvas_data, canvas_width, canvas_height, color_profile FROM projects WHERE id = $1
+	`, id).Scan(&canvasData, &width, &height, &colorProfile)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Canvas data could not be read",
+		}
+	}
+
+	space := render.WorkingSpace(colorProfile)
+	doc := render.NewPDF()
+	doc.SetColorSpace(space)
+	images, fonts := assetImages(space), assetFonts()
+	resp := &PreflightResponse{Kind: req.Kind, Degraded: []DegradedFeature{}}
+	counts := map[string]int{}
+	for _, page := range pages {
+		res, err := render.DrawPage(ctx, doc.AddPage(float64(width), float64(height)), page, images, fonts)
+		if err != nil {
+			reqctx.Logger(ctx).Error("preflight render failed", "project_id", id, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to check export",
+			}
+		}
+		resp.Elements += res.Elements
+		for feature, n := range res.Unsupported {
+			counts[feature] += n
+		}
+	}
+
+	for feature, n := range counts {
+		d := DegradedFeature{Feature: feature, Count: n, Support: render.SupportNone, Note: "Drawn as its bounding box."}
+		if c, ok := render.LookupCapability(caps, feature); ok {
+			d.Support, d.Note = c.Support, c.Note
+		}
+		resp.Degraded = append(resp.Degraded, d)
+	}
+	sort.Slice(resp.Degraded, func(i, j int) bool { return resp.Degraded[i].Feature < resp.Degraded[j].Feature })
+	return resp, nil
+}
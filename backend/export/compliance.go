@@ -0,0 +1,367 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+
+	"canvasai/asset"
+	"canvasai/permissions"
+	"canvasai/project"
+	"canvasai/reqctx"
+	"canvasai/settings"
+)
+
+// Organizations with scheduled snapshots enabled (see settings.Compliance)
+// get a copy of every project once per period: a review PDF, a project
+// archive, or both. Snapshot files are stored write-once: the asset and
+// its record are locked until the retention the organization configured
+// when the snapshot was taken has passed, and the database refuses to
+// change or delete them before then. Admins list and download them through
+// the compliance archive.
+
+// snapshotBatchSize bounds the snapshots taken by a single run; the rest
+// are picked up by the next one.
+const snapshotBatchSize = 50
+
+// ComplianceSnapshot is a scheduled, immutable snapshot of a project
+type ComplianceSnapshot struct {
+	ID           string `json:"id"`
+	ProjectID    string `json:"projectId"`
+	ProjectTitle string `json:"projectTitle"`
+	Revision     int    `json:"revision"`
+	// Period is the first day of the scheduled period, e.g. "2026-10-01"
+	Period    string `json:"period"`
+	Frequency string `json:"frequency"`
+	Format    string `json:"format"`
+	// SHA256 is the hex checksum of the file, for verifying downloads
+	SHA256      string    `json:"sha256"`
+	FileSize    int64     `json:"fileSize"`
+	DownloadURL string    `json:"downloadUrl"`
+	RetainUntil time.Time `json:"retainUntil"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// ListSnapshotsRequest represents the list compliance snapshots request
+type ListSnapshotsRequest struct {
+	ProjectID string `query:"projectId"`
+	Format    string `query:"format"`
+	Limit     int    `query:"limit"`
+	Offset    int    `query:"offset"`
+}
+
+// ListSnapshotsResponse represents the list compliance snapshots response
+type ListSnapshotsResponse struct {
+	Snapshots []ComplianceSnapshot `json:"snapshots"`
+	Limit     int                  `json:"limit"`
+	Offset    int                  `json:"offset"`
+}
+
+const snapshotColumns = `id, project_id, project_title, revision, period, frequency, format, sha256, file_size, retain_until, created_at`
+
+// ListComplianceSnapshots lists an organization's compliance snapshots,
+// newest first. Only organization admins can see them.
+//
+//encore:api auth method=GET path=/orgs/:orgID/compliance-archive
+func ListComplianceSnapshots(ctx context.Context, orgID string, req *ListSnapshotsRequest) (*ListSnapshotsResponse, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 50
+	} else if limit > 100 {
+		limit = 100
+	}
+	offset := max(req.Offset, 0)
+
+	rows, err := db.Query(ctx, `
+		SELECT `+snapshotColumns+` FROM compliance_snapshots
+		WHERE org_id = $1
+			AND ($2 = '' OR project_id::text = $2)
+			AND ($3 = '' OR format = $3)
+		ORDER BY created_at DESC, id
+		LIMIT $4 OFFSET $5
+	`, orgID, req.ProjectID, req.Format, limit, offset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list compliance snapshots", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch compliance snapshots",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListSnapshotsResponse{Snapshots: []ComplianceSnapshot{}, Limit: limit, Offset: offset}
+	for rows.Next() {
+		s, err := scanSnapshot(rows, orgID)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to scan compliance snapshot", "org_id", orgID, "error", err)
+			continue
+		}
+		resp.Snapshots = append(resp.Snapshots, *s)
+	}
+	return resp, nil
+}
+
+// GetComplianceSnapshot returns one of an organization's compliance
+// snapshots.
+//
+//encore:api auth method=GET path=/orgs/:orgID/compliance-archive/:snapshotID
+func GetComplianceSnapshot(ctx context.Context, orgID, snapshotID string) (*ComplianceSnapshot, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	s, _, err := getSnapshot(ctx, orgID, snapshotID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Snapshot not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load compliance snapshot", "snapshot_id", snapshotID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch compliance snapshot",
+		}
+	}
+	return s, nil
+}
+
+// DownloadComplianceSnapshot serves a compliance snapshot's file. The
+// X-Checksum-SHA256 header carries the checksum recorded when it was taken.
+//
+//encore:api auth raw method=GET path=/orgs/:orgID/compliance-archive/:snapshotID/file
+func DownloadComplianceSnapshot(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	params := encore.CurrentRequest().PathParams
+	orgID, snapshotID := params.Get("orgID"), params.Get("snapshotID")
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	log := reqctx.Logger(ctx).With("snapshot_id", snapshotID)
+
+	s, assetID, err := getSnapshot(ctx, orgID, snapshotID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "snapshot not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error("failed to load compliance snapshot", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		log.Error("failed to read compliance snapshot", "asset_id", assetID, "error", err)
+		http.Error(w, "snapshot unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", data.Asset.MimeType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, data.Asset.Filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data.Data)))
+	w.Header().Set("X-Checksum-SHA256", s.SHA256)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(data.Data)
+}
+
+func getSnapshot(ctx context.Context, orgID, snapshotID string) (*ComplianceSnapshot, string, error) {
+	var assetID string
+	row := db.QueryRow(ctx, `
+		SELECT `+snapshotColumns+`, asset_id FROM compliance_snapshots
+		WHERE org_id = $1 AND id::text = $2
+	`, orgID, snapshotID)
+	s, err := scanSnapshot(row, orgID, &assetID)
+	return s, assetID, err
+}
+
+func scanSnapshot(row interface{ Scan(...any) error }, orgID string, extra ...any) (*ComplianceSnapshot, error) {
+	var s ComplianceSnapshot
+	var period time.Time
+	dest := append([]any{&s.ID, &s.ProjectID, &s.ProjectTitle, &s.Revision, &period, &s.Frequency,
+		&s.Format, &s.SHA256, &s.FileSize, &s.RetainUntil, &s.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	s.Period = period.Format(time.DateOnly)
+	s.DownloadURL = "/orgs/" + orgID + "/compliance-archive/" + s.ID + "/file"
+	return &s, nil
+}
+
+// Take due compliance snapshots hourly.
+var _ = cron.NewJob("take-compliance-snapshots", cron.JobConfig{
+	Title:    "Take scheduled compliance snapshots of organization projects",
+	Every:    1 * cron.Hour,
+	Endpoint: TakeComplianceSnapshots,
+})
+
+//encore:api private
+func TakeComplianceSnapshots(ctx context.Context) error {
+	schedules, err := settings.SnapshotSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	taken, budget := 0, snapshotBatchSize
+	for _, org := range schedules.Schedules {
+		if budget <= 0 {
+			break
+		}
+		n, err := snapshotOrg(ctx, org.OrgID, org.Schedule, now, budget)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to take compliance snapshots", "org_id", org.OrgID, "error", err)
+		}
+		taken += n
+		budget -= n
+	}
+	reqctx.Logger(ctx).Info("took compliance snapshots", "count", taken)
+	return nil
+}
+
+// snapshotDue is a project missing a snapshot in the current period
+type snapshotDue struct {
+	projectID string
+	format    string
+}
+
+// snapshotOrg takes up to limit of an organization's snapshots due in the
+// period containing now, and returns how many it took.
+func snapshotOrg(ctx context.Context, orgID string, schedule settings.SnapshotSchedule, now time.Time, limit int) (int, error) {
+	period := periodStart(schedule.Frequency, now)
+	rows, err := db.Query(ctx, `
+		SELECT p.id, f.format
+		FROM projects p CROSS JOIN unnest($3::text[]) AS f(format)
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM compliance_snapshots s
+				WHERE s.org_id = $1 AND s.project_id = p.id AND s.period = $2 AND s.format = f.format
+			)
+		ORDER BY p.created_at, f.format
+		LIMIT $4
+	`, orgID, period, schedule.Formats, limit)
+	if err != nil {
+		return 0, err
+	}
+	var due []snapshotDue
+	for rows.Next() {
+		var d snapshotDue
+		if err := rows.Scan(&d.projectID, &d.format); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	retainUntil := now.AddDate(0, 0, schedule.RetentionDays)
+	taken := 0
+	for _, d := range due {
+		err := takeSnapshot(ctx, orgID, d, period, schedule.Frequency, retainUntil)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to take compliance snapshot", "org_id", orgID,
+				"project_id", d.projectID, "format", d.format, "error", err)
+			continue
+		}
+		taken++
+	}
+	return taken, nil
+}
+
+// takeSnapshot renders a project in format and stores it under a
+// retention lock.
+func takeSnapshot(ctx context.Context, orgID string, d snapshotDue, period time.Time, frequency string, retainUntil time.Time) error {
+	var title, slug, ownerID string
+	var revision int
+	err := db.QueryRow(ctx, `
+		SELECT title, COALESCE(slug, ''), owner_id, version FROM projects WHERE id = $1
+	`, d.projectID).Scan(&title, &slug, &ownerID, &revision)
+	if err != nil {
+		return fmt.Errorf("load project: %w", err)
+	}
+	if slug == "" {
+		slug = "project"
+	}
+	name := slug + "-" + period.Format(time.DateOnly)
+
+	var filename, mimeType string
+	var data []byte
+	switch d.format {
+	case settings.SnapshotFormatPDF:
+		// Resolved threads are part of the record
+		job := &Job{ProjectID: d.projectID, Kind: KindReviewPDF}
+		a, err := renderReviewReport(ctx, job)
+		if err != nil {
+			return fmt.Errorf("render pdf: %w", err)
+		}
+		filename, mimeType, data = name+".pdf", a.MimeType, a.Data
+		revision = *job.Revision
+	case settings.SnapshotFormatArchive:
+		archive, err := project.ArchiveForSnapshot(ctx, d.projectID)
+		if err != nil {
+			return fmt.Errorf("build archive: %w", err)
+		}
+		if data, err = json.Marshal(archive); err != nil {
+			return err
+		}
+		filename, mimeType = name+".canvasai.json", "application/json"
+	default:
+		return fmt.Errorf("unknown snapshot format %q", d.format)
+	}
+
+	// Not filed under the project, so the project can still be purged.
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:      ownerID,
+		Filename:    filename,
+		MimeType:    mimeType,
+		Data:        data,
+		RetainUntil: &retainUntil,
+	})
+	if err != nil {
+		return fmt.Errorf("store snapshot: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	result, err := db.Exec(ctx, `
+		INSERT INTO compliance_snapshots (org_id, project_id, project_title, revision, period, frequency, format, asset_id, sha256, file_size, retain_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (org_id, project_id, period, format) DO NOTHING
+	`, orgID, d.projectID, title, revision, period, frequency, d.format, stored.ID, hex.EncodeToString(sum[:]), len(data), retainUntil)
+	if err != nil {
+		return fmt.Errorf("record snapshot: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		// A concurrent run took this snapshot first. The locked file is
+		// left to its retention.
+		reqctx.Logger(ctx).Warn("duplicate compliance snapshot", "project_id", d.projectID, "asset_id", stored.ID)
+		return nil
+	}
+	reqctx.Logger(ctx).Info("compliance snapshot taken", "org_id", orgID, "project_id", d.projectID,
+		"format", d.format, "period", period.Format(time.DateOnly), "revision", revision)
+	return nil
+}
+
+// periodStart returns the first day of the scheduled period containing t:
+// the Monday of its week, the first of its month or of its quarter.
+func periodStart(frequency string, t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch frequency {
+	case settings.SnapshotWeekly:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case settings.SnapshotQuarterly:
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
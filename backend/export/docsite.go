@@ -0,0 +1,800 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+
+	"canvasai/asset"
+	"canvasai/designsystem"
+	"canvasai/permissions"
+	"canvasai/render"
+	"canvasai/reqctx"
+	"canvasai/settings"
+	"canvasai/webpolicy"
+)
+
+// Design system docs sites. An organization can publish its design system
+// (see package designsystem) as a static site anyone with the link can
+// read: its tokens, guidelines, and a page per shared component with a
+// preview rendered from an instance in one of its projects and how widely
+// it is used. Pages are generated ahead of time and stored as assets.
+// The site is rebuilt when the library changes, and an hourly check
+// catches what the library does not announce, such as new component
+// instances or branding changes. A build whose source is unchanged is
+// skipped, so the checks cost little.
+
+// Docs site limits and component preview size
+const (
+	maxSiteComponents   = 200
+	maxSiteErrorLength  = 500
+	maxSiteSlugLength   = 64
+	siteBuildTimeout    = 10 * time.Minute
+	sitePreviewWidth    = 640
+	sitePreviewHeight   = 400
+	sitePreviewMargin   = 32
+	maxSitePreviewScale = 4
+	defaultSiteAccent   = "#4f46e5"
+)
+
+// Docs site statuses
+const (
+	siteBuilding = "building"
+	siteReady    = "ready"
+	siteFailed   = "failed"
+)
+
+var siteSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// DocsSite is an organization's published design system site
+type DocsSite struct {
+	// URL is where the site is served; anyone with it can read the site
+	URL string `json:"url"`
+	// Status is building, ready or failed. A site that failed to rebuild
+	// keeps serving its last successful build.
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	BuiltAt   *time.Time `json:"builtAt,omitempty"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+var _ = pubsub.NewSubscription(designsystem.LibraryChanges, "rebuild-docs-site", pubsub.SubscriptionConfig[*designsystem.LibraryChange]{
+	Handler:        rebuildDocsSite,
+	MaxConcurrency: 2,
+	AckDeadline:    siteBuildTimeout,
+})
+
+// Rebuild docs sites whose source changed without a library change.
+var _ = cron.NewJob("refresh-docs-sites", cron.JobConfig{
+	Title:    "Rebuild design system docs sites that are out of date",
+	Every:    1 * cron.Hour,
+	Endpoint: RefreshDocsSites,
+})
+
+// PublishDocsSite publishes the organization's design system as a docs
+// site and builds it. Publishing a site that already exists rebuilds it.
+//
+//encore:api auth method=POST path=/orgs/:orgID/design-system/site
+func PublishDocsSite(ctx context.Context, orgID string) (*DocsSite, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	token, err := newSiteToken()
+	if err == nil {
+		_, err = db.Exec(ctx, `
+			INSERT INTO design_sites (org_id, token, created_by) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id) DO UPDATE SET source_hash = NULL
+		`, orgID, token, auth.UserID())
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to publish docs site", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to publish docs site",
+		}
+	}
+	// A failed build is recorded on the site, which the response reports.
+	if err := buildDocsSite(ctx, orgID); err != nil {
+		reqctx.Logger(ctx).Error("failed to build docs site", "org_id", orgID, "error", err)
+	}
+	reqctx.Logger(ctx).Info("docs site published", "org_id", orgID)
+	return getDocsSite(ctx, orgID)
+}
+
+// GetDocsSite returns the organization's docs site.
+//
+//encore:api auth method=GET path=/orgs/:orgID/design-system/site
+func GetDocsSite(ctx context.Context, orgID string) (*DocsSite, error) {
+	if err := requireOrgMember(ctx, orgID); err != nil {
+		return nil, err
+	}
+	return getDocsSite(ctx, orgID)
+}
+
+// UnpublishDocsSite takes the organization's docs site down. Publishing it
+// again gives it a new URL.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/design-system/site
+func UnpublishDocsSite(ctx context.Context, orgID string) error {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		reqctx.Logger(ctx).Error("failed to unpublish docs site", "org_id", orgID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to unpublish docs site",
+		}
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `SELECT asset_id FROM design_site_files WHERE org_id = $1`, orgID)
+	if err != nil {
+		return fail(err)
+	}
+	var assetIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			assetIDs = append(assetIDs, id)
+		}
+	}
+	rows.Close()
+	result, err := tx.Exec(ctx, `DELETE FROM design_sites WHERE org_id = $1`, orgID)
+	if err != nil {
+		return fail(err)
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "The design system is not published",
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	deleteSiteFiles(ctx, assetIDs)
+	reqctx.Logger(ctx).Info("docs site unpublished", "org_id", orgID)
+	return nil
+}
+
+//encore:api private
+func RefreshDocsSites(ctx context.Context) error {
+	rows, err := db.Query(ctx, `SELECT org_id FROM design_sites ORDER BY built_at NULLS FIRST`)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list docs sites", "error", err)
+		return err
+	}
+	var orgIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		orgIDs = append(orgIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, orgID := range orgIDs {
+		if err := buildDocsSite(ctx, orgID); err != nil {
+			reqctx.Logger(ctx).Error("failed to refresh docs site", "org_id", orgID, "error", err)
+		}
+	}
+	return nil
+}
+
+func rebuildDocsSite(ctx context.Context, msg *designsystem.LibraryChange) error {
+	return buildDocsSite(ctx, msg.OrgID)
+}
+
+// DocsSiteFile serves a file of a docs site. The site's own URL serves its
+// index page.
+//
+//encore:api public raw method=GET path=/design-sites/:token/*path
+func DocsSiteFile(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	params := encore.CurrentRequest().PathParams
+	token, path := params.Get("token"), strings.TrimPrefix(params.Get("path"), "/")
+	if path == "" {
+		path = "index.html"
+	}
+
+	var assetID string
+	err := db.QueryRow(ctx, `
+		SELECT f.asset_id FROM design_site_files f
+		JOIN design_sites s ON s.org_id = f.org_id
+		WHERE s.token = $1 AND f.path = $2
+	`, token, path).Scan(&assetID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to look up docs site file", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	etag := `"` + assetID + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	webpolicy.StaticSite(w)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read docs site file", "asset_id", assetID, "error", err)
+		http.Error(w, "page unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", data.Asset.MimeType)
+	w.Write(data.Data)
+}
+
+func getDocsSite(ctx context.Context, orgID string) (*DocsSite, error) {
+	site := &DocsSite{}
+	var token string
+	var buildError *string
+	err := db.QueryRow(ctx, `
+		SELECT token, status, error, built_at, created_by, created_at FROM design_sites WHERE org_id = $1
+	`, orgID).Scan(&token, &site.Status, &buildError, &site.BuiltAt, &site.CreatedBy, &site.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "The design system is not published",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load docs site", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load docs site",
+		}
+	}
+	if buildError != nil {
+		site.Error = *buildError
+	}
+	site.URL = siteURL(token)
+	return site, nil
+}
+
+// siteSource is everything a docs site is built from. Its hash decides
+// whether a site is out of date, so it holds no build-time values.
+type siteSource struct {
+	Name          string                `json:"name"`
+	LogoURL       string                `json:"logoUrl"`
+	Accent        string                `json:"accent"`
+	HidePoweredBy bool                  `json:"hidePoweredBy"`
+	Library       *designsystem.Library `json:"library"`
+	Components    []*siteComponent      `json:"components"`
+}
+
+// siteComponent is a shared component as its docs page shows it
+type siteComponent struct {
+	ID          string                 `json:"id"`
+	Slug        string                 `json:"slug"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Guidelines  string                 `json:"guidelines"`
+	Projects    int                    `json:"projects"`
+	Instances   int                    `json:"instances"`
+	Versions    []siteComponentVersion `json:"versions"`
+	// Element is an instance of the component to draw its preview from
+	Element map[string]any `json:"element,omitempty"`
+	// HasPreview is set once the preview is drawn
+	HasPreview bool `json:"-"`
+}
+
+type siteComponentVersion struct {
+	Version   string `json:"version"`
+	Projects  int    `json:"projects"`
+	Instances int    `json:"instances"`
+}
+
+// siteFile is a generated file of a docs site
+type siteFile struct {
+	path     string
+	mimeType string
+	data     []byte
+}
+
+// buildDocsSite rebuilds an organization's docs site if its source
+// changed. Organizations without a site are skipped.
+func buildDocsSite(ctx context.Context, orgID string) error {
+	ctx, cancel := context.WithTimeout(ctx, siteBuildTimeout)
+	defer cancel()
+	log := reqctx.Logger(ctx).With("org_id", orgID)
+
+	var createdBy string
+	var builtHash *string
+	err := db.QueryRow(ctx, `
+		SELECT created_by, source_hash FROM design_sites WHERE org_id = $1
+	`, orgID).Scan(&createdBy, &builtHash)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	src, err := loadSiteSource(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(encoded)
+	hash := hex.EncodeToString(sum[:])
+	if builtHash != nil && *builtHash == hash {
+		return nil
+	}
+	_, err = db.Exec(ctx, `UPDATE design_sites SET status = $2 WHERE org_id = $1`, orgID, siteBuilding)
+	if err != nil {
+		return err
+	}
+
+	files, err := renderSite(ctx, src)
+	if err != nil {
+		// Retrying will not fix the source; the next change tries again.
+		log.Warn("failed to build docs site", "error", err)
+		msg := err.Error()
+		if len(msg) > maxSiteErrorLength {
+			msg = msg[:maxSiteErrorLength]
+		}
+		_, err = db.Exec(ctx, `
+			UPDATE design_sites SET status = $2, error = $3, source_hash = $4 WHERE org_id = $1
+		`, orgID, siteFailed, msg, hash)
+		return err
+	}
+	if err := publishSiteFiles(ctx, orgID, createdBy, hash, files); err != nil {
+		return err
+	}
+	log.Info("docs site built", "files", len(files), "components", len(src.Components))
+	return nil
+}
+
+// loadSiteSource gathers an organization's library, branding and
+// component usage.
+func loadSiteSource(ctx context.Context, orgID string) (*siteSource, error) {
+	lib, err := designsystem.LoadLibrary(ctx, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("load library: %w", err)
+	}
+	branding, err := settings.LoadOrgBranding(ctx, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("load branding: %w", err)
+	}
+	src := &siteSource{
+		Name:          branding.DisplayName,
+		LogoURL:       branding.LogoURL,
+		Accent:        branding.PrimaryColor,
+		HidePoweredBy: branding.HidePoweredBy,
+		Library:       lib,
+	}
+	if src.Name == "" {
+		err := db.QueryRow(ctx, `SELECT name FROM organizations WHERE id = $1`, orgID).Scan(&src.Name)
+		if err != nil {
+			return nil, fmt.Errorf("load organization: %w", err)
+		}
+	}
+	if src.Accent == "" {
+		src.Accent = defaultSiteAccent
+	}
+	if src.Components, err = siteComponents(ctx, orgID, lib.Components); err != nil {
+		return nil, fmt.Errorf("load components: %w", err)
+	}
+	return src, nil
+}
+
+// siteComponents lists the documented components and the most used ones,
+// documented first, with their usage and an instance to preview.
+func siteComponents(ctx context.Context, orgID string, docs []designsystem.ComponentDoc) ([]*siteComponent, error) {
+	var components []*siteComponent
+	byID := map[string]*siteComponent{}
+	add := func(c *siteComponent) *siteComponent {
+		c.Slug = siteSlug(c.ID)
+		c.Versions = []siteComponentVersion{}
+		byID[c.ID] = c
+		components = append(components, c)
+		return c
+	}
+	for _, d := range docs {
+		if len(components) == maxSiteComponents {
+			break
+		}
+		add(&siteComponent{ID: d.ComponentID, Name: d.Name, Description: d.Description, Guidelines: d.Guidelines})
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT u.component_id, u.version, COUNT(DISTINCT u.project_id), SUM(u.instances)
+		FROM project_component_usage u
+		JOIN projects p ON p.id = u.project_id
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL AND u.instances > 0
+		GROUP BY u.component_id, u.version
+		ORDER BY u.component_id, u.version DESC
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	var used []*siteComponent
+	usedByID := map[string]*siteComponent{}
+	for rows.Next() {
+		var id string
+		var v siteComponentVersion
+		if err := rows.Scan(&id, &v.Version, &v.Projects, &v.Instances); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c := usedByID[id]
+		if c == nil {
+			c = &siteComponent{ID: id}
+			usedByID[id] = c
+			used = append(used, c)
+		}
+		c.Versions = append(c.Versions, v)
+		c.Instances += v.Instances
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Projects counts each project once, whatever versions it uses.
+	rows, err = db.Query(ctx, `
+		SELECT u.component_id, COUNT(DISTINCT u.project_id)
+		FROM project_component_usage u
+		JOIN projects p ON p.id = u.project_id
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL AND u.instances > 0
+		GROUP BY u.component_id
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c := usedByID[id]; c != nil {
+			c.Projects = n
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(used, func(i, j int) bool {
+		if used[i].Projects != used[j].Projects {
+			return used[i].Projects > used[j].Projects
+		}
+		return used[i].Instances > used[j].Instances
+	})
+	for _, u := range used {
+		c := byID[u.ID]
+		if c == nil {
+			if len(components) == maxSiteComponents {
+				continue
+			}
+			// Undocumented components are listed under their ID.
+			c = add(&siteComponent{ID: u.ID, Name: u.ID})
+		}
+		c.Projects, c.Instances, c.Versions = u.Projects, u.Instances, u.Versions
+	}
+	if err := findComponentElements(ctx, orgID, byID); err != nil {
+		return nil, err
+	}
+	return components, nil
+}
+
+// findComponentElements picks, for each component, an instance from the
+// project that most recently saved one. Each project's canvas is read
+// once however many components it provides.
+func findComponentElements(ctx context.Context, orgID string, components map[string]*siteComponent) error {
+	if len(components) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(components))
+	for id := range components {
+		ids = append(ids, id)
+	}
+	rows, err := db.Query(ctx, `
+		SELECT DISTINCT ON (u.component_id) u.component_id, u.project_id
+		FROM project_component_usage u
+		JOIN projects p ON p.id = u.project_id
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL AND u.instances > 0 AND u.component_id = ANY($2)
+		ORDER BY u.component_id, u.last_used_at DESC, u.project_id
+	`, orgID, ids)
+	if err != nil {
+		return err
+	}
+	byProject := map[string]map[string]bool{}
+	for rows.Next() {
+		var componentID, projectID string
+		if err := rows.Scan(&componentID, &projectID); err != nil {
+			rows.Close()
+			return err
+		}
+		if byProject[projectID] == nil {
+			byProject[projectID] = map[string]bool{}
+		}
+		byProject[projectID][componentID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for projectID, wanted := range byProject {
+		var canvasData []byte
+		err := db.QueryRow(ctx, `SELECT canvas_data FROM projects WHERE id = $1`, projectID).Scan(&canvasData)
+		if err != nil {
+			return err
+		}
+		pages, err := render.ParsePages(canvasData)
+		if err != nil {
+			// A broken canvas only costs its components their preview.
+			continue
+		}
+		for _, page := range pages {
+			findComponentInstances(page.Objects, wanted, components)
+		}
+	}
+	return nil
+}
+
+// findComponentInstances sets the element of each wanted component that
+// does not have one yet to its first instance among objects.
+func findComponentInstances(objects []map[string]any, wanted map[string]bool, components map[string]*siteComponent) {
+	for _, obj := range objects {
+		if id, _ := obj["componentId"].(string); id != "" {
+			id = strings.ToLower(id)
+			if c := components[id]; wanted[id] && c.Element == nil {
+				c.Element = obj
+			}
+		}
+		if raw, ok := obj["objects"].([]any); ok {
+			children := make([]map[string]any, 0, len(raw))
+			for _, child := range raw {
+				if m, ok := child.(map[string]any); ok {
+					children = append(children, m)
+				}
+			}
+			findComponentInstances(children, wanted, components)
+		}
+	}
+}
+
+// renderSite generates a docs site's pages, component previews and
+// tokens file.
+func renderSite(ctx context.Context, src *siteSource) ([]siteFile, error) {
+	var files []siteFile
+	for _, c := range src.Components {
+		if c.Element == nil {
+			continue
+		}
+		data, err := drawComponentPreview(ctx, c.Element)
+		if err != nil {
+			// The page is still useful without its preview.
+			reqctx.Logger(ctx).Warn("failed to draw component preview", "org_id", src.Library.OrgID, "component_id", c.ID, "error", err)
+			continue
+		}
+		c.HasPreview = true
+		files = append(files, siteFile{path: sitePreviewsPrefix + c.Slug + ".png", mimeType: "image/png", data: data})
+	}
+
+	page := func(path string, name string, data any) error {
+		var buf bytes.Buffer
+		if err := siteTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+			return fmt.Errorf("render %s: %w", path, err)
+		}
+		files = append(files, siteFile{path: path, mimeType: "text/html; charset=utf-8", data: buf.Bytes()})
+		return nil
+	}
+	view := newSiteView(src)
+	if err := page("index.html", "index", view); err != nil {
+		return nil, err
+	}
+	for _, c := range src.Components {
+		if err := page("components/"+c.Slug+".html", "component", view.component(c)); err != nil {
+			return nil, err
+		}
+	}
+	tokens, err := json.MarshalIndent(src.Library.Tokens, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, siteFile{path: "tokens.json", mimeType: "application/json", data: tokens})
+	return files, nil
+}
+
+// drawComponentPreview draws a component instance centered on white,
+// scaled to fit the preview.
+func drawComponentPreview(ctx context.Context, element map[string]any) ([]byte, error) {
+	obj := make(map[string]any, len(element)+1)
+	for k, v := range element {
+		obj[k] = v
+	}
+	// Layout only measures elements with an ID.
+	obj["id"] = "preview"
+	placements := render.Layout([]map[string]any{obj})
+	if len(placements) == 0 {
+		return nil, fmt.Errorf("component instance has no size")
+	}
+	box := placements[0].Box
+	if box.W <= 0 || box.H <= 0 {
+		return nil, fmt.Errorf("component instance has no size")
+	}
+
+	scale := math.Min(maxSitePreviewScale, math.Min(
+		float64(sitePreviewWidth-2*sitePreviewMargin)/box.W,
+		float64(sitePreviewHeight-2*sitePreviewMargin)/box.H,
+	))
+	w, h := box.W*scale, box.H*scale
+	canvas := render.NewCanvas(sitePreviewWidth, sitePreviewHeight, white)
+	canvas.Transform(render.Translate((sitePreviewWidth-w)/2, (sitePreviewHeight-h)/2))
+	canvas.Transform(render.Scale(scale, scale))
+	canvas.Transform(render.Translate(-box.X, -box.Y))
+	page := render.Page{ID: render.DefaultPageID, Objects: []map[string]any{obj}}
+	if _, err := render.DrawPage(ctx, canvas, page, assetImages(render.SRGB), nil); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas.Pixels()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// publishSiteFiles stores a build's files and swaps them in for the
+// previous build's, which are then deleted.
+func publishSiteFiles(ctx context.Context, orgID, userID, hash string, files []siteFile) error {
+	stored := make([]string, 0, len(files))
+	for _, f := range files {
+		filename := "design-system-" + strings.ReplaceAll(f.path, "/", "-")
+		a, err := asset.Store(ctx, &asset.StoreRequest{
+			UserID:   userID,
+			Filename: filename,
+			MimeType: f.mimeType,
+			Data:     f.data,
+		})
+		if err != nil {
+			deleteSiteFiles(ctx, stored)
+			return fmt.Errorf("store %s: %w", f.path, err)
+		}
+		stored = append(stored, a.ID)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		deleteSiteFiles(ctx, stored)
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous []string
+	// Locking the site serializes concurrent builds' swaps.
+	err = tx.QueryRow(ctx, `SELECT 1 FROM design_sites WHERE org_id = $1 FOR UPDATE`, orgID).Scan(new(int))
+	if err == nil {
+		rows, qerr := tx.Query(ctx, `DELETE FROM design_site_files WHERE org_id = $1 RETURNING asset_id`, orgID)
+		if err = qerr; err == nil {
+			for rows.Next() {
+				var id string
+				if err = rows.Scan(&id); err != nil {
+					break
+				}
+				previous = append(previous, id)
+			}
+			rows.Close()
+		}
+	}
+	for i, f := range files {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO design_site_files (org_id, path, asset_id) VALUES ($1, $2, $3)
+		`, orgID, f.path, stored[i])
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+			UPDATE design_sites SET status = $2, error = NULL, source_hash = $3, built_at = NOW()
+			WHERE org_id = $1
+		`, orgID, siteReady, hash)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// Unpublished meanwhile, or failed: the new files are not needed.
+		deleteSiteFiles(ctx, stored)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	deleteSiteFiles(ctx, previous)
+	return nil
+}
+
+func deleteSiteFiles(ctx context.Context, assetIDs []string) {
+	for _, id := range assetIDs {
+		if err := asset.Delete(ctx, id); err != nil {
+			reqctx.Logger(ctx).Warn("failed to delete docs site file", "asset_id", id, "error", err)
+		}
+	}
+}
+
+// siteSlug names a component's files. IDs that are not safe in a path are
+// replaced by a hash.
+func siteSlug(componentID string) string {
+	if len(componentID) <= maxSiteSlugLength && siteSlugPattern.MatchString(componentID) {
+		return componentID
+	}
+	sum := sha256.Sum256([]byte(componentID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// siteURL is where a docs site is served.
+func siteURL(token string) string {
+	base := encore.Meta().APIBaseURL
+	base.Path = "/design-sites/" + token + "/"
+	return base.String()
+}
+
+func newSiteToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func requireOrgMember(ctx context.Context, orgID string) error {
+	var role string
+	err := db.QueryRow(ctx, `
+		SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2
+	`, orgID, auth.UserID()).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check organization membership",
+		}
+	}
+	if role != "admin" && role != "member" && role != "guest" {
+		return &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Organization member access required",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package export
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"regexp"
+	"strings"
+
+	"canvasai/designsystem"
+	"canvasai/render"
+)
+
+// The pages of a design system docs site. They are self-contained: styles
+// are inline and the only files they refer to are the site's own and the
+// organization's logo, so the site works wherever its files are served.
+
+// Token swatches are drawn at their size up to these bounds, in pixels
+const (
+	maxSampleFontSize = 96
+	maxSampleLength   = 480
+)
+
+// fontFamilyUnsafe matches what may not appear in a font-family value
+// written into a style attribute
+var fontFamilyUnsafe = regexp.MustCompile(`[^A-Za-z0-9 ,_-]`)
+
+// siteView is what the pages of a docs site show
+type siteView struct {
+	// Root is the relative path from the page to the site's root
+	Root          string
+	Name          string
+	LogoURL       string
+	Accent        string
+	HidePoweredBy bool
+	Guidelines    []string
+	Colors        []colorView
+	Typography    []typographyView
+	Spacing       []lengthView
+	Radii         []lengthView
+	Components    []componentView
+}
+
+type colorView struct {
+	Name, Value, Description string
+	// Hex is Value as #rrggbbaa, which is safe in a style attribute
+	Hex string
+}
+
+type typographyView struct {
+	Name, Summary, Description string
+	Style                      template.CSS
+}
+
+type lengthView struct {
+	Name        string
+	Value       float64
+	Description string
+	// Sample is the value bounded to what the page can show
+	Sample float64
+}
+
+type componentView struct {
+	Slug, Name, Description string
+	Projects, Instances     int
+	HasPreview              bool
+}
+
+// componentPage is what a component's page shows
+type componentPage struct {
+	*siteView
+	Component  componentView
+	Guidelines []string
+	Versions   []siteComponentVersion
+}
+
+func newSiteView(src *siteSource) *siteView {
+	t := src.Library.Tokens
+	v := &siteView{
+		Name:          src.Name,
+		LogoURL:       src.LogoURL,
+		Accent:        src.Accent,
+		HidePoweredBy: src.HidePoweredBy,
+		Guidelines:    paragraphs(src.Library.Guidelines),
+	}
+	for _, c := range t.Colors {
+		col, _ := render.ParseColor(c.Value)
+		v.Colors = append(v.Colors, colorView{Name: c.Name, Value: c.Value, Description: c.Description, Hex: hexColor(col)})
+	}
+	for _, f := range t.Typography {
+		v.Typography = append(v.Typography, typographyView{
+			Name:        f.Name,
+			Summary:     typographySummary(f),
+			Description: f.Description,
+			Style:       typographyStyle(f),
+		})
+	}
+	v.Spacing = lengthViews(t.Spacing)
+	v.Radii = lengthViews(t.Radii)
+	for _, c := range src.Components {
+		v.Components = append(v.Components, componentView{
+			Slug:        c.Slug,
+			Name:        c.Name,
+			Description: c.Description,
+			Projects:    c.Projects,
+			Instances:   c.Instances,
+			HasPreview:  c.HasPreview,
+		})
+	}
+	return v
+}
+
+// component returns the view of a component's page, one level below the
+// site's root.
+func (v *siteView) component(c *siteComponent) *componentPage {
+	page := *v
+	page.Root = "../"
+	return &componentPage{
+		siteView: &page,
+		Component: componentView{
+			Slug:        c.Slug,
+			Name:        c.Name,
+			Description: c.Description,
+			Projects:    c.Projects,
+			Instances:   c.Instances,
+			HasPreview:  c.HasPreview,
+		},
+		Guidelines: paragraphs(c.Guidelines),
+		Versions:   c.Versions,
+	}
+}
+
+// paragraphs splits guidelines at blank lines.
+func paragraphs(text string) []string {
+	var out []string
+	for _, p := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func hexColor(c render.Color) string {
+	b := func(v float64) int { return int(math.Round(clampUnit(v) * 255)) }
+	return fmt.Sprintf("#%02x%02x%02x%02x", b(c.R), b(c.G), b(c.B), b(c.A))
+}
+
+func clampUnit(v float64) float64 { return math.Max(0, math.Min(1, v)) }
+
+func typographySummary(f designsystem.TypographyToken) string {
+	s := fmt.Sprintf("%s, %gpx, weight %d", f.FontFamily, f.FontSize, f.FontWeight)
+	if f.LineHeight > 0 {
+		s += fmt.Sprintf(", line height %g", f.LineHeight)
+	}
+	return s
+}
+
+// typographyStyle is the style of a typography token's sample text. The
+// font family is reduced to characters that cannot leave the declaration.
+func typographyStyle(f designsystem.TypographyToken) template.CSS {
+	family := strings.TrimSpace(fontFamilyUnsafe.ReplaceAllString(f.FontFamily, ""))
+	if family == "" {
+		family = "sans-serif"
+	}
+	style := fmt.Sprintf("font-family: %s; font-size: %gpx; font-weight: %d;", family, math.Min(f.FontSize, maxSampleFontSize), f.FontWeight)
+	if f.LineHeight > 0 {
+		style += fmt.Sprintf(" line-height: %g;", f.LineHeight)
+	}
+	return template.CSS(style)
+}
+
+func lengthViews(tokens []designsystem.SizeToken) []lengthView {
+	views := make([]lengthView, 0, len(tokens))
+	for _, t := range tokens {
+		views = append(views, lengthView{Name: t.Name, Value: t.Value, Description: t.Description, Sample: math.Min(t.Value, maxSampleLength)})
+	}
+	return views
+}
+
+var siteTemplates = template.Must(template.New("site").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.}}</title>
+{{end}}
+
+{{define "style"}}<style>
+body { margin: 0; font-family: system-ui, -apple-system, "Segoe UI", Roboto, sans-serif; color: #212121; background: #fafafa; }
+header { display: flex; align-items: center; gap: 16px; padding: 20px 40px; background: #fff; border-bottom: 4px solid {{.Accent}}; }
+header img { max-height: 40px; }
+header a { color: inherit; text-decoration: none; }
+main { max-width: 1080px; margin: 0 auto; padding: 24px 40px 64px; }
+h1 { font-size: 22px; margin: 0; }
+h2 { font-size: 18px; margin: 40px 0 16px; padding-bottom: 8px; border-bottom: 1px solid #e4e4e7; }
+p.guideline { line-height: 1.6; white-space: pre-line; }
+.muted { color: #737373; font-size: 13px; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(220px, 1fr)); gap: 16px; }
+.card { background: #fff; border: 1px solid #e4e4e7; border-radius: 8px; overflow: hidden; }
+.card .body { padding: 12px; }
+.card a { color: inherit; text-decoration: none; }
+.swatch { height: 72px; background-image: linear-gradient(45deg, #eee 25%, transparent 25%, transparent 75%, #eee 75%); background-size: 16px 16px; }
+.swatch div { height: 100%; }
+.preview { display: block; width: 100%; background: #fff; border-bottom: 1px solid #e4e4e7; }
+.sample { margin: 8px 0 4px; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+.row { display: flex; align-items: center; gap: 16px; margin-bottom: 12px; }
+.row .name { width: 180px; flex-shrink: 0; }
+.bar { height: 16px; background: {{.Accent}}; border-radius: 2px; }
+.radius { width: 64px; height: 64px; border: 2px solid {{.Accent}}; flex-shrink: 0; }
+table { border-collapse: collapse; }
+td, th { text-align: left; padding: 6px 16px 6px 0; border-bottom: 1px solid #e4e4e7; }
+footer { text-align: center; padding: 24px; }
+</style>
+</head>
+{{end}}
+
+{{define "header"}}<header>
+{{- if .LogoURL}}<img src="{{.LogoURL}}" alt="">{{end}}
+<h1><a href="{{.Root}}index.html">{{.Name}} design system</a></h1>
+</header>
+{{end}}
+
+{{define "footer"}}
+{{- if not .HidePoweredBy}}<footer class="muted">Made with CanvasAI</footer>{{end}}
+</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "head" printf "%s design system" .Name}}{{template "style" .}}
+<body>
+{{template "header" .}}
+<main>
+{{- if .Guidelines}}
+<h2>Guidelines</h2>
+{{range .Guidelines}}<p class="guideline">{{.}}</p>
+{{end}}
+{{- end}}
+
+{{- if .Colors}}
+<h2>Colors</h2>
+<div class="grid">
+{{- range .Colors}}
+<div class="card"><div class="swatch"><div style="background-color: {{.Hex}}"></div></div>
+<div class="body"><strong>{{.Name}}</strong><div class="muted">{{.Value}}</div>
+{{- if .Description}}<p>{{.Description}}</p>{{end}}</div></div>
+{{- end}}
+</div>
+{{- end}}
+
+{{- if .Typography}}
+<h2>Typography</h2>
+{{- range .Typography}}
+<div class="card" style="margin-bottom: 12px"><div class="body">
+<strong>{{.Name}}</strong> <span class="muted">{{.Summary}}</span>
+<div class="sample" style="{{.Style}}">The quick brown fox jumps over the lazy dog</div>
+{{- if .Description}}<p class="muted">{{.Description}}</p>{{end}}
+</div></div>
+{{- end}}
+{{- end}}
+
+{{- if .Spacing}}
+<h2>Spacing</h2>
+{{- range .Spacing}}
+<div class="row"><div class="name"><strong>{{.Name}}</strong> <span class="muted">{{.Value}}px</span></div>
+<div class="bar" style="width: {{.Sample}}px"></div>
+{{- if .Description}}<span class="muted">{{.Description}}</span>{{end}}</div>
+{{- end}}
+{{- end}}
+
+{{- if .Radii}}
+<h2>Corner radii</h2>
+{{- range .Radii}}
+<div class="row"><div class="name"><strong>{{.Name}}</strong> <span class="muted">{{.Value}}px</span></div>
+<div class="radius" style="border-radius: {{.Sample}}px"></div>
+{{- if .Description}}<span class="muted">{{.Description}}</span>{{end}}</div>
+{{- end}}
+{{- end}}
+
+{{- if .Components}}
+<h2>Components</h2>
+<div class="grid">
+{{- range .Components}}
+<div class="card"><a href="components/{{.Slug}}.html">
+{{- if .HasPreview}}<img class="preview" src="previews/{{.Slug}}.png" alt="">{{end}}
+<div class="body"><strong>{{.Name}}</strong>
+<div class="muted">Used in {{.Projects}} projects</div>
+{{- if .Description}}<p>{{.Description}}</p>{{end}}</div></a></div>
+{{- end}}
+</div>
+{{- end}}
+
+<p class="muted"><a href="tokens.json">Download the design tokens (JSON)</a></p>
+</main>
+{{template "footer" .}}{{end}}
+
+{{define "component"}}{{template "head" printf "%s · %s design system" .Component.Name .Name}}{{template "style" .}}
+<body>
+{{template "header" .}}
+<main>
+<p class="muted"><a href="../index.html">All components</a></p>
+<h2>{{.Component.Name}}</h2>
+{{- if .Component.Description}}<p>{{.Component.Description}}</p>{{end}}
+{{- if .Component.HasPreview}}
+<div class="card"><img class="preview" src="../previews/{{.Component.Slug}}.png" alt="{{.Component.Name}}"></div>
+{{- end}}
+
+{{- if .Guidelines}}
+<h2>Usage guidelines</h2>
+{{range .Guidelines}}<p class="guideline">{{.}}</p>
+{{end}}
+{{- end}}
+
+<h2>Adoption</h2>
+<p>{{.Component.Instances}} instances in {{.Component.Projects}} projects.</p>
+{{- if .Versions}}
+<table>
+<tr><th>Version</th><th>Projects</th><th>Instances</th></tr>
+{{- range .Versions}}
+<tr><td>{{if .Version}}{{.Version}}{{else}}<span class="muted">unversioned</span>{{end}}</td><td>{{.Projects}}</td><td>{{.Instances}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</main>
+{{template "footer" .}}{{end}}
+`))
@@ -0,0 +1,212 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"encore.dev"
+
+	"canvasai/asset"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// KindEmailHTML is an HTML email of a project page: the page drawn as an
+// image in a table layout that email clients render consistently. The
+// image is served from an unguessable public URL, since recipients load it
+// without signing in, and outlives the export's retention so emails that
+// were already sent keep their image.
+const KindEmailHTML = "email_html"
+
+const (
+	defaultEmailWidth = 600
+	minEmailWidth     = 320
+	maxEmailWidth     = 1200
+)
+
+// emailOptions are the options accepted by email_html exports
+type emailOptions struct {
+	PageID string `json:"pageId,omitempty"`
+	// Width is the email's width in CSS pixels (default 600); the image is
+	// drawn at twice that for high-density screens
+	Width int `json:"width,omitempty"`
+	// LinkURL is where clicking the image goes
+	LinkURL string `json:"linkUrl,omitempty"`
+	// AltText defaults to the project's title
+	AltText string `json:"altText,omitempty"`
+	// Preheader is the preview text shown after the subject in inboxes
+	Preheader string `json:"preheader,omitempty"`
+}
+
+var emailTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body style="margin:0;padding:0;background-color:#ffffff;">
+{{- if .Preheader}}
+<div style="display:none;max-height:0;overflow:hidden;">{{.Preheader}}</div>
+{{- end}}
+<table role="presentation" width="100%" cellpadding="0" cellspacing="0" border="0">
+<tr><td align="center">
+<table role="presentation" width="{{.Width}}" cellpadding="0" cellspacing="0" border="0" style="width:100%;max-width:{{.Width}}px;">
+<tr><td>
+{{- if .LinkURL}}<a href="{{.LinkURL}}" target="_blank">{{end -}}
+<img src="{{.ImageURL}}" width="{{.Width}}" alt="{{.AltText}}" style="display:block;width:100%;height:auto;border:0;">
+{{- if .LinkURL}}</a>{{end}}
+</td></tr>
+</table>
+</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// renderEmail draws a project page and wraps it in an HTML email.
+func renderEmail(ctx context.Context, job *Job) (*artifact, error) {
+	var opts emailOptions
+	if len(job.Options) > 0 {
+		if err := json.Unmarshal(job.Options, &opts); err != nil {
+			return nil, fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	if opts.Width == 0 {
+		opts.Width = defaultEmailWidth
+	}
+	if opts.Width < minEmailWidth || opts.Width > maxEmailWidth {
+		return nil, fmt.Errorf("invalid options: width must be between %d and %d", minEmailWidth, maxEmailWidth)
+	}
+	if opts.LinkURL != "" {
+		u, err := url.Parse(opts.LinkURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid options: linkUrl must be an http or https URL")
+		}
+	}
+
+	var title, slug string
+	var revision int
+	err := db.QueryRow(ctx, `
+		SELECT title, COALESCE(slug, ''), version FROM projects WHERE id = $1
+	`, job.ProjectID).Scan(&title, &slug, &revision)
+	if err != nil {
+		return nil, fmt.Errorf("load project: %w", err)
+	}
+	job.Revision = &revision
+	if job.SourceVersion != nil {
+		job.Revision = job.SourceVersion
+	}
+	img, err := drawPageImage(ctx, job, opts.PageID, render.Box{W: float64(2 * opts.Width)})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	name := slug
+	if name == "" {
+		name = "project"
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:    job.UserID,
+		ProjectID: job.ProjectID,
+		Filename:  name + "-email.png",
+		MimeType:  "image/png",
+		Data:      buf.Bytes(),
+		Width:     &width,
+		Height:    &height,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store email image: %w", err)
+	}
+	token, err := newEmailImageToken()
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO export_email_images (token, asset_id, project_id, export_job_id) VALUES ($1, $2, $3, $4)
+	`, token, stored.ID, job.ProjectID, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("record email image: %w", err)
+	}
+
+	altText := strings.TrimSpace(opts.AltText)
+	if altText == "" {
+		altText = title
+	}
+	var out bytes.Buffer
+	err = emailTemplate.Execute(&out, map[string]any{
+		"Title":     title,
+		"Preheader": opts.Preheader,
+		"Width":     opts.Width,
+		"LinkURL":   opts.LinkURL,
+		"ImageURL":  emailImageURL(token),
+		"AltText":   altText,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &artifact{
+		Filename: name + "-email.html",
+		MimeType: "text/html",
+		Data:     out.Bytes(),
+	}, nil
+}
+
+// EmailImage serves the image of an HTML email export to its recipients.
+//
+//encore:api public raw method=GET path=/exports/email-images/:token
+func EmailImage(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	token := encore.CurrentRequest().PathParams.Get("token")
+
+	var assetID string
+	err := db.QueryRow(ctx, `SELECT asset_id FROM export_email_images WHERE token = $1`, token).Scan(&assetID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to look up email image", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read email image", "asset_id", assetID, "error", err)
+		http.Error(w, "image unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// Each export stores a new image under a new token.
+	w.Header().Set("Content-Type", data.Asset.MimeType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(data.Data)
+}
+
+// emailImageURL is where an HTML email export's image is served.
+func emailImageURL(token string) string {
+	base := encore.Meta().APIBaseURL
+	base.Path = "/exports/email-images/" + token
+	return base.String()
+}
+
+func newEmailImageToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
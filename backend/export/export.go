@@ -0,0 +1,422 @@
+// Package export renders projects into downloadable artifacts. Export jobs
+// are queued through the ExportJobs topic and processed asynchronously; the
+// resulting files are stored through the asset service.
+package export
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/faults"
+	"canvasai/notification"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+	"canvasai/webhook"
+	"canvasai/wideevent"
+)
+
+// Job statuses
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Job is an export request and its outcome
+type Job struct {
+	ID              string          `json:"id"`
+	ProjectID       string          `json:"projectId"`
+	UserID          string          `json:"userId"`
+	Kind            string          `json:"kind"`
+	Preset          string          `json:"preset"`
+	Status          string          `json:"status"`
+	Options         json.RawMessage `json:"options,omitempty"`
+	Revision        *int            `json:"revision,omitempty"`
+	SourceVersion   *int            `json:"sourceVersion,omitempty"`
+	RegeneratedFrom *string         `json:"regeneratedFrom,omitempty"`
+	ArtifactAssetID *string         `json:"artifactAssetId,omitempty"`
+	ArtifactURL     string          `json:"artifactUrl,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	StartedAt       *time.Time      `json:"startedAt,omitempty"`
+	CompletedAt     *time.Time      `json:"completedAt,omitempty"`
+	PurgedAt        *time.Time      `json:"purgedAt,omitempty"`
+}
+
+// CreateExportRequest represents the create export request
+type CreateExportRequest struct {
+	Kind    string          `json:"kind"`
+	Options json.RawMessage `json:"options,omitempty"`
+	// Preset names the export settings for retention, e.g. "weekly-client-review".
+	// Defaults to the kind.
+	Preset string `json:"preset,omitempty"`
+}
+
+// ListExportsResponse represents the list exports response
+type ListExportsResponse struct {
+	Exports []Job `json:"exports"`
+}
+
+// JobMessage asks the export worker to run a job
+type JobMessage struct {
+	JobID     string `json:"jobId"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// artifact is a rendered export file
+type artifact struct {
+	Filename string
+	MimeType string
+	Data     []byte
+	// Manifest records where elements were drawn, for PDF artifacts
+	Manifest *elementManifest
+}
+
+// CompletedExport announces a completed export job
+type CompletedExport struct {
+	JobID     string `json:"jobId"`
+	ProjectID string `json:"projectId"`
+	UserID    string `json:"userId"`
+	Kind      string `json:"kind"`
+	Preset    string `json:"preset"`
+	AssetID   string `json:"assetId"`
+	MimeType  string `json:"mimeType"`
+	// RegeneratedFrom is the export this one regenerated, if any
+	RegeneratedFrom *string `json:"regeneratedFrom,omitempty"`
+}
+
+// Completions is the topic completed exports are announced on, for
+// services that publish artifacts elsewhere.
+var Completions = pubsub.NewTopic[*CompletedExport]("export-completions", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// exporter renders a job into an artifact
+type exporter func(ctx context.Context, job *Job) (*artifact, error)
+
+// exporters maps job kinds to their renderers.
+var exporters = map[string]exporter{
+	KindReviewPDF: renderReviewReport,
+	KindMockup:    renderMockup,
+	KindEmailHTML: renderEmail,
+	KindSVG:       renderSVG,
+}
+
+// ExportJobs is the queue of export jobs waiting to be rendered.
+var ExportJobs = pubsub.NewTopic[*JobMessage]("export-jobs", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(ExportJobs, "run-export", pubsub.SubscriptionConfig[*JobMessage]{
+	Handler:        runJob,
+	MaxConcurrency: 4,
+	AckDeadline:    5 * time.Minute,
+})
+
+// Exports are rendered from project data.
+var db = sqldb.Named("project")
+
+//encore:api auth method=POST path=/projects/:id/exports
+func CreateExport(ctx context.Context, id string, req *CreateExportRequest) (*Job, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	if _, ok := exporters[req.Kind]; !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Unsupported export kind",
+		}
+	}
+	if len(req.Options) > 0 && !json.Valid(req.Options) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Options must be valid JSON",
+		}
+	}
+	preset := strings.TrimSpace(req.Preset)
+	if preset == "" {
+		preset = req.Kind
+	}
+	if len(preset) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Preset must be at most 100 characters",
+		}
+	}
+
+	return queueJob(ctx, &Job{
+		ProjectID: id,
+		UserID:    auth.UserID(),
+		Kind:      req.Kind,
+		Preset:    preset,
+		Status:    StatusQueued,
+		Options:   req.Options,
+	})
+}
+
+//encore:api auth method=GET path=/projects/:id/exports
+func ListExports(ctx context.Context, id string) (*ListExportsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT `+jobColumns+` FROM export_jobs
+		WHERE project_id = $1 AND user_id = $2
+		ORDER BY created_at DESC LIMIT 50
+	`, id, auth.UserID())
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch exports",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListExportsResponse{Exports: []Job{}}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			continue
+		}
+		resp.Exports = append(resp.Exports, *job)
+	}
+	return resp, nil
+}
+
+//encore:api auth method=GET path=/exports/:id
+func GetExport(ctx context.Context, id string) (*Job, error) {
+	job, err := getJob(ctx, id)
+	if err != nil || job.UserID != auth.UserID() {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Export not found",
+		}
+	}
+	return job, nil
+}
+
+// queueJob records a new job and hands it to the export worker.
+func queueJob(ctx context.Context, job *Job) (*Job, error) {
+	err := db.QueryRow(ctx, `
+		INSERT INTO export_jobs (project_id, user_id, kind, preset, options, source_version, regenerated_from)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, job.ProjectID, job.UserID, job.Kind, job.Preset, nullJSON(job.Options), job.SourceVersion, job.RegeneratedFrom).Scan(&job.ID, &job.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create export job", "project_id", job.ProjectID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create export",
+		}
+	}
+
+	if err := enqueue(ctx, job.ID); err != nil {
+		return nil, err
+	}
+	reqctx.Logger(ctx).Info("export queued", "job_id", job.ID, "kind", job.Kind)
+	return job, nil
+}
+
+func enqueue(ctx context.Context, jobID string) error {
+	msg := &JobMessage{JobID: jobID, RequestID: reqctx.From(ctx).RequestID}
+	if _, err := ExportJobs.Publish(ctx, msg); err != nil {
+		reqctx.Logger(ctx).Error("failed to enqueue export job", "job_id", jobID, "error", err)
+		markFailed(ctx, jobID, "failed to queue export")
+		return &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to queue export",
+		}
+	}
+	return nil
+}
+
+// runJob renders a queued job. Rendering errors fail the job rather than
+// the message, so a broken document is not retried indefinitely.
+func runJob(ctx context.Context, msg *JobMessage) error {
+	ctx = reqctx.With(ctx, reqctx.Info{RequestID: msg.RequestID})
+	log := reqctx.Logger(ctx).With("job_id", msg.JobID)
+
+	// An injected failure leaves the job queued for redelivery.
+	if err := faults.Inject(ctx, faults.DB); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		UPDATE export_jobs SET status = $2, started_at = NOW()
+		WHERE id = $1 AND status = $3
+	`, msg.JobID, StatusRunning, StatusQueued)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		// Already picked up by an earlier delivery.
+		return nil
+	}
+
+	job, err := getJob(ctx, msg.JobID)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	ev := wideevent.Start(wideevent.KindExport)
+	ev.Set("job_id", job.ID)
+	ev.Set("export_kind", job.Kind)
+	ev.Set("project_id", job.ProjectID)
+	art, err := exporters[job.Kind](ctx, job)
+	ev.Step("render")
+	if err != nil {
+		log.Error("export failed", "kind", job.Kind, "error", err)
+		markFailed(ctx, job.ID, err.Error())
+		ev.Finish(ctx, err)
+		return nil
+	}
+	ev.Set("bytes", len(art.Data))
+
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:    job.UserID,
+		ProjectID: job.ProjectID,
+		Filename:  art.Filename,
+		MimeType:  art.MimeType,
+		Data:      art.Data,
+	})
+	ev.Step("store")
+	if err != nil {
+		log.Error("failed to store export artifact", "error", err)
+		markFailed(ctx, job.ID, "failed to store export")
+		ev.Finish(ctx, err)
+		return nil
+	}
+
+	var manifest []byte
+	if art.Manifest != nil {
+		if manifest, err = json.Marshal(art.Manifest); err != nil {
+			log.Warn("failed to encode element manifest", "error", err)
+		}
+	}
+	_, err = db.Exec(ctx, `
+		UPDATE export_jobs SET status = $2, artifact_asset_id = $3, revision = $4, element_manifest = $5, completed_at = NOW()
+		WHERE id = $1
+	`, job.ID, StatusCompleted, stored.ID, job.Revision, manifest)
+	ev.Step("db_write")
+	ev.Finish(ctx, err)
+	if err != nil {
+		return err
+	}
+	log.Info("export completed", "kind", job.Kind, "bytes", len(art.Data), "duration_ms", time.Since(started).Milliseconds())
+
+	_, err = Completions.Publish(ctx, &CompletedExport{
+		JobID:           job.ID,
+		ProjectID:       job.ProjectID,
+		UserID:          job.UserID,
+		Kind:            job.Kind,
+		Preset:          job.Preset,
+		AssetID:         stored.ID,
+		MimeType:        art.MimeType,
+		RegeneratedFrom: job.RegeneratedFrom,
+	})
+	if err != nil {
+		log.Error("failed to announce export completion", "error", err)
+	}
+
+	data, _ := json.Marshal(map[string]string{"projectId": job.ProjectID, "exportId": job.ID, "assetId": stored.ID})
+	err = notification.Send(ctx, &notification.Message{
+		UserID: job.UserID,
+		Kind:   "export.completed",
+		Title:  "Your export is ready",
+		Body:   fmt.Sprintf("%s is ready to download.", art.Filename),
+		Link:   canvasrefs.AssetURL(stored.ID),
+		Data:   data,
+	})
+	if err != nil {
+		log.Error("failed to send export notification", "error", err)
+	}
+
+	err = webhook.Emit(ctx, &webhook.Event{Type: webhook.EventExportCompleted, ProjectID: job.ProjectID}, map[string]string{
+		"projectId": job.ProjectID,
+		"exportId":  job.ID,
+		"kind":      job.Kind,
+		"assetId":   stored.ID,
+		"url":       canvasrefs.AssetURL(stored.ID),
+	})
+	if err != nil {
+		log.Error("failed to emit webhook event", "error", err)
+	}
+	return nil
+}
+
+func markFailed(ctx context.Context, jobID, reason string) {
+	_, err := db.Exec(ctx, `
+		UPDATE export_jobs SET status = $2, error = $3, completed_at = NOW() WHERE id = $1
+	`, jobID, StatusFailed, reason)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to mark export failed", "job_id", jobID, "error", err)
+	}
+}
+
+const jobColumns = `id, project_id, user_id, kind, COALESCE(preset, kind), status, options, revision, source_version, regenerated_from, artifact_asset_id, COALESCE(error, ''), created_at, started_at, completed_at, purged_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row scanner) (*Job, error) {
+	var job Job
+	var options []byte
+	var revision, sourceVersion sql.NullInt64
+	var regeneratedFrom, artifactID sql.NullString
+	var startedAt, completedAt, purgedAt sql.NullTime
+	if err := row.Scan(&job.ID, &job.ProjectID, &job.UserID, &job.Kind, &job.Preset, &job.Status, &options, &revision, &sourceVersion, &regeneratedFrom, &artifactID, &job.Error, &job.CreatedAt, &startedAt, &completedAt, &purgedAt); err != nil {
+		return nil, err
+	}
+	job.Options = options
+	if revision.Valid {
+		r := int(revision.Int64)
+		job.Revision = &r
+	}
+	if sourceVersion.Valid {
+		v := int(sourceVersion.Int64)
+		job.SourceVersion = &v
+	}
+	if regeneratedFrom.Valid {
+		job.RegeneratedFrom = &regeneratedFrom.String
+	}
+	if artifactID.Valid {
+		job.ArtifactAssetID = &artifactID.String
+		job.ArtifactURL = canvasrefs.AssetURL(artifactID.String)
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+	if purgedAt.Valid {
+		job.PurgedAt = &purgedAt.Time
+	}
+	return &job, nil
+}
+
+func getJob(ctx context.Context, id string) (*Job, error) {
+	return scanJob(db.QueryRow(ctx, `SELECT `+jobColumns+` FROM export_jobs WHERE id = $1`, id))
+}
+
+func nullJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return []byte(raw)
+}
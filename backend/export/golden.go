@@ -0,0 +1,414 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"image"
+	"image/png"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Golden-image fixtures guard the renderer against regressions. A fixture
+// is a canvas document with an approved baseline render. A check renders
+// every fixture onto a raster canvas and diffs it against its baseline;
+// fixtures whose renders drifted beyond their thresholds fail. The canonical
+// fixtures in fixtures/ are added automatically; admins can add their own,
+// and approve a new baseline once a rendering change is intended. Nothing
+// runs the check automatically: run it (POST /admin/render-fixture-checks)
+// before a release.
+
+//go:embed fixtures/*.json
+var builtinFixtures embed.FS
+
+// Fixture check statuses
+const (
+	FixturePass       = "pass"
+	FixtureFail       = "fail"
+	FixtureNoBaseline = "no_baseline"
+	FixtureError      = "error"
+)
+
+const (
+	defaultFixtureMaxChangedRatio = 0.001
+	maxFixtureSide                = 4096
+)
+
+var fixtureName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,99}$`)
+
+// RenderFixture is a canvas document with an approved render
+type RenderFixture struct {
+	Name              string          `json:"name"`
+	Description       string          `json:"description,omitempty"`
+	Canvas            json.RawMessage `json:"canvas"`
+	Width             int             `json:"width"`
+	Height            int             `json:"height"`
+	DeltaThreshold    float64         `json:"deltaThreshold"`
+	MaxChangedRatio   float64         `json:"maxChangedRatio"`
+	Builtin           bool            `json:"builtin"`
+	HasBaseline       bool            `json:"hasBaseline"`
+	BaselineUpdatedAt *time.Time      `json:"baselineUpdatedAt,omitempty"`
+	UpdatedAt         time.Time       `json:"updatedAt"`
+}
+
+// ListRenderFixturesResponse represents the list fixtures response
+type ListRenderFixturesResponse struct {
+	Fixtures []RenderFixture `json:"fixtures"`
+}
+
+// PutRenderFixtureRequest creates or replaces a fixture's document
+type PutRenderFixtureRequest struct {
+	Description string          `json:"description,omitempty"`
+	Canvas      json.RawMessage `json:"canvas"`
+	Width       int             `json:"width"`
+	Height      int             `json:"height"`
+	// DeltaThreshold is the per-pixel ΔE above which a pixel counts as
+	// changed (default render.JustNoticeableDelta)
+	DeltaThreshold float64 `json:"deltaThreshold,omitempty"`
+	// MaxChangedRatio is the share of changed pixels tolerated (default 0.1%)
+	MaxChangedRatio float64 `json:"maxChangedRatio,omitempty"`
+}
+
+// FixtureResult is the outcome of checking one fixture
+type FixtureResult struct {
+	Name   string       `json:"name"`
+	Status string       `json:"status"`
+	Diff   *render.Diff `json:"diff,omitempty"`
+	// Unsupported counts elements the renderer drew approximately
+	Unsupported map[string]int `json:"unsupported,omitempty"`
+	// Render is the current render (PNG) for fixtures that did not pass
+	Render []byte `json:"render,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CheckRenderFixturesResponse represents the fixture check report
+type CheckRenderFixturesResponse struct {
+	Passed  bool            `json:"passed"`
+	Results []FixtureResult `json:"results"`
+}
+
+//encore:api auth method=GET path=/admin/render-fixtures
+func ListRenderFixtures(ctx context.Context) (*ListRenderFixturesResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	fixtures, err := loadFixtures(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ListRenderFixturesResponse{Fixtures: fixtures}, nil
+}
+
+// PutRenderFixture creates or updates a fixture. The baseline is kept, so a
+// changed document fails the next check until its baseline is approved.
+//
+//encore:api auth method=PUT path=/admin/render-fixtures/:name
+func PutRenderFixture(ctx context.Context, name string, req *PutRenderFixtureRequest) (*RenderFixture, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if !fixtureName.MatchString(name) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Fixture names use lowercase letters, digits and hyphens",
+		}
+	}
+	if err := validateFixture(req); err != nil {
+		return nil, err
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO render_fixtures (name, description, canvas_data, width, height, delta_threshold, max_changed_ratio)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7)
+		ON CONFLICT (name) DO UPDATE
+		SET description = EXCLUDED.description, canvas_data = EXCLUDED.canvas_data,
+			width = EXCLUDED.width, height = EXCLUDED.height,
+			delta_threshold = EXCLUDED.delta_threshold, max_changed_ratio = EXCLUDED.max_changed_ratio,
+			updated_at = NOW()
+	`, name, req.Description, []byte(req.Canvas), req.Width, req.Height, req.DeltaThreshold, req.MaxChangedRatio)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to save render fixture", "name", name, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to save fixture",
+		}
+	}
+	return getFixture(ctx, name)
+}
+
+//encore:api auth method=DELETE path=/admin/render-fixtures/:name
+func DeleteRenderFixture(ctx context.Context, name string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `DELETE FROM render_fixtures WHERE name = $1 AND NOT builtin`, name)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete render fixture", "name", name, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete fixture",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Fixture not found or built in",
+		}
+	}
+	return nil
+}
+
+// ApproveRenderFixture stores the current render of a fixture as its
+// baseline.
+//
+//encore:api auth method=POST path=/admin/render-fixtures/:name/approve
+func ApproveRenderFixture(ctx context.Context, name string) (*RenderFixture, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	f, err := getFixture(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := renderFixture(ctx, f)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Fixture failed to render: " + err.Error(),
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to encode render",
+		}
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE render_fixtures SET baseline = $2, baseline_updated_at = NOW(), baseline_updated_by = $3
+		WHERE name = $1
+	`, name, buf.Bytes(), auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to save fixture baseline", "name", name, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to approve fixture",
+		}
+	}
+	reqctx.Logger(ctx).Info("render fixture baseline approved", "name", name)
+	return getFixture(ctx, name)
+}
+
+// CheckRenderFixtures renders every fixture and diffs it against its
+// baseline. Passed is false when any fixture failed, errored or has no
+// baseline yet.
+//
+//encore:api auth method=POST path=/admin/render-fixture-checks
+func CheckRenderFixtures(ctx context.Context) (*CheckRenderFixturesResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	fixtures, err := loadFixtures(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CheckRenderFixturesResponse{Passed: true, Results: []FixtureResult{}}
+	for i := range fixtures {
+		r := checkFixture(ctx, &fixtures[i])
+		if r.Status != FixturePass {
+			resp.Passed = false
+		}
+		resp.Results = append(resp.Results, r)
+	}
+	reqctx.Logger(ctx).Info("render fixtures checked", "fixtures", len(resp.Results), "passed", resp.Passed)
+	return resp, nil
+}
+
+func checkFixture(ctx context.Context, f *RenderFixture) FixtureResult {
+	r := FixtureResult{Name: f.Name}
+	img, res, err := renderFixture(ctx, f)
+	if err != nil {
+		r.Status, r.Error = FixtureError, err.Error()
+		return r
+	}
+	r.Unsupported = res.Unsupported
+
+	var baseline []byte
+	if err := db.QueryRow(ctx, `SELECT baseline FROM render_fixtures WHERE name = $1`, f.Name).Scan(&baseline); err != nil {
+		r.Status, r.Error = FixtureError, "failed to load baseline"
+		return r
+	}
+	if len(baseline) == 0 {
+		r.Status, r.Render = FixtureNoBaseline, encodePNG(img)
+		return r
+	}
+	want, err := png.Decode(bytes.NewReader(baseline))
+	if err != nil {
+		r.Status, r.Error = FixtureError, "baseline is not a valid PNG"
+		return r
+	}
+
+	diff := render.Compare(want, img, f.DeltaThreshold)
+	r.Diff = &diff
+	if diff.SizeMismatch || diff.ChangedRatio > f.MaxChangedRatio {
+		r.Status, r.Render = FixtureFail, encodePNG(img)
+		return r
+	}
+	r.Status = FixturePass
+	return r
+}
+
+// renderFixture draws the first page of a fixture onto a raster canvas.
+// Image elements are not loaded so renders do not depend on stored assets.
+func renderFixture(ctx context.Context, f *RenderFixture) (image.Image, *render.Result, error) {
+	pages, err := render.ParsePages(f.Canvas)
+	if err != nil {
+		return nil, nil, err
+	}
+	canvas := render.NewCanvas(f.Width, f.Height, pageBackground(f.Canvas))
+	res, err := render.DrawPage(ctx, canvas, pages[0], nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return canvas.Pixels(), res, nil
+}
+
+func encodePNG(img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func validateFixture(req *PutRenderFixtureRequest) error {
+	if len(req.Canvas) == 0 || !json.Valid(req.Canvas) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Canvas must be valid JSON",
+		}
+	}
+	if req.Width <= 0 || req.Height <= 0 || req.Width > maxFixtureSide || req.Height > maxFixtureSide {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Width and height must be between 1 and 4096",
+		}
+	}
+	if req.DeltaThreshold <= 0 {
+		req.DeltaThreshold = render.JustNoticeableDelta
+	}
+	if req.MaxChangedRatio <= 0 {
+		req.MaxChangedRatio = defaultFixtureMaxChangedRatio
+	}
+	if req.MaxChangedRatio > 1 {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "maxChangedRatio must be at most 1",
+		}
+	}
+	return nil
+}
+
+// seedBuiltinFixtures adds the canonical fixtures that are not stored yet.
+// Existing ones are left alone so their baselines stay valid.
+func seedBuiltinFixtures(ctx context.Context) error {
+	files, err := builtinFixtures.ReadDir("fixtures")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := builtinFixtures.ReadFile(path.Join("fixtures", file.Name()))
+		if err != nil {
+			return err
+		}
+		var req PutRenderFixtureRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		if err := validateFixture(&req); err != nil {
+			return err
+		}
+		_, err = db.Exec(ctx, `
+			INSERT INTO render_fixtures (name, description, canvas_data, width, height, delta_threshold, max_changed_ratio, builtin)
+			VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, TRUE)
+			ON CONFLICT (name) DO NOTHING
+		`, strings.TrimSuffix(file.Name(), ".json"), req.Description, []byte(req.Canvas), req.Width, req.Height, req.DeltaThreshold, req.MaxChangedRatio)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const fixtureColumns = `name, COALESCE(description, ''), canvas_data, width, height, delta_threshold, max_changed_ratio, builtin, baseline IS NOT NULL, baseline_updated_at, updated_at`
+
+func loadFixtures(ctx context.Context) ([]RenderFixture, error) {
+	if err := seedBuiltinFixtures(ctx); err != nil {
+		reqctx.Logger(ctx).Error("failed to seed render fixtures", "error", err)
+	}
+	rows, err := db.Query(ctx, `SELECT `+fixtureColumns+` FROM render_fixtures ORDER BY name`)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list render fixtures", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch fixtures",
+		}
+	}
+	defer rows.Close()
+
+	fixtures := []RenderFixture{}
+	for rows.Next() {
+		f, err := scanFixture(rows)
+		if err != nil {
+			continue
+		}
+		fixtures = append(fixtures, *f)
+	}
+	return fixtures, nil
+}
+
+func getFixture(ctx context.Context, name string) (*RenderFixture, error) {
+	f, err := scanFixture(db.QueryRow(ctx, `SELECT `+fixtureColumns+` FROM render_fixtures WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Fixture not found",
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load render fixture", "name", name, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch fixture",
+		}
+	}
+	return f, nil
+}
+
+func scanFixture(row scanner) (*RenderFixture, error) {
+	var f RenderFixture
+	var canvas []byte
+	var baselineAt sql.NullTime
+	if err := row.Scan(&f.Name, &f.Description, &canvas, &f.Width, &f.Height, &f.DeltaThreshold, &f.MaxChangedRatio, &f.Builtin, &f.HasBaseline, &baselineAt, &f.UpdatedAt); err != nil {
+		return nil, err
+	}
+	f.Canvas = canvas
+	if baselineAt.Valid {
+		f.BaselineUpdatedAt = &baselineAt.Time
+	}
+	return &f, nil
+}
@@ -0,0 +1,601 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// KindMockup is a presentation image of a design placed on a mockup
+// template: a photo of a t-shirt, phone or billboard with the surface the
+// design goes on. The design is warped onto the surface (see render.Warp)
+// and, for templates that ask for it, multiplied with the photo so its
+// folds and lighting show through. The design is either an image asset,
+// such as a PNG exported from the editor, or a project page drawn by the
+// raster renderer, which draws text as glyph boxes.
+const KindMockup = "mockup"
+
+const (
+	// maxMockupSide bounds template photos and so mockup output
+	maxMockupSide = 6000
+	// maxDesignScale bounds how far a page is enlarged to fill its surface
+	maxDesignScale = 4
+)
+
+var categoryPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Mockup blend modes
+const (
+	MockupBlendNormal   = "normal"
+	MockupBlendMultiply = "multiply"
+)
+
+// MockupPlacement is where designs go on a template's photo, in pixels of
+// the photo: four corners for a flat surface, or a mesh for a curved one
+type MockupPlacement struct {
+	// Corners are the design's top-left, top-right, bottom-right and
+	// bottom-left corners
+	Corners [][2]float64 `json:"corners,omitempty"`
+	Mesh    *MockupMesh  `json:"mesh,omitempty"`
+}
+
+// MockupMesh is a grid of (Columns+1)×(Rows+1) points, row by row from the
+// top-left
+type MockupMesh struct {
+	Columns int          `json:"columns"`
+	Rows    int          `json:"rows"`
+	Points  [][2]float64 `json:"points"`
+}
+
+// MockupTemplate is a photo designs can be placed on
+type MockupTemplate struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// PreviewURL is the template's photo
+	PreviewURL string          `json:"previewUrl"`
+	Width      int             `json:"width"`
+	Height     int             `json:"height"`
+	Placement  MockupPlacement `json:"placement"`
+	BlendMode  string          `json:"blendMode"`
+	Active     bool            `json:"active"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+
+	baseAssetID    string
+	overlayAssetID *string
+}
+
+// ListMockupTemplatesRequest represents the list mockup templates request
+type ListMockupTemplatesRequest struct {
+	Category string `query:"category"`
+}
+
+// ListMockupTemplatesResponse represents the list mockup templates response
+type ListMockupTemplatesResponse struct {
+	Templates []MockupTemplate `json:"templates"`
+}
+
+// CreateMockupTemplateRequest represents the create mockup template request
+type CreateMockupTemplateRequest struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// BaseAssetID is the photo, an image the admin uploaded
+	BaseAssetID string `json:"baseAssetId"`
+	// OverlayAssetID is an optional transparent image of the photo's size
+	// drawn over the design, for highlights or a device frame
+	OverlayAssetID string          `json:"overlayAssetId,omitempty"`
+	Placement      MockupPlacement `json:"placement"`
+	BlendMode      string          `json:"blendMode,omitempty"`
+}
+
+// UpdateMockupTemplateRequest represents the update mockup template request
+type UpdateMockupTemplateRequest struct {
+	Name      *string          `json:"name,omitempty"`
+	Category  *string          `json:"category,omitempty"`
+	Placement *MockupPlacement `json:"placement,omitempty"`
+	BlendMode *string          `json:"blendMode,omitempty"`
+	Active    *bool            `json:"active,omitempty"`
+}
+
+// CreateMockupRequest represents the create mockup request
+type CreateMockupRequest struct {
+	TemplateID string `json:"templateId"`
+	// PageID is the page to place; defaults to the first
+	PageID string `json:"pageId,omitempty"`
+	// AssetID places an image of the project, such as an exported PNG,
+	// instead of rendering a page
+	AssetID string `json:"assetId,omitempty"`
+}
+
+// mockupOptions are the options of mockup exports
+type mockupOptions struct {
+	TemplateID string `json:"templateId"`
+	PageID     string `json:"pageId,omitempty"`
+	AssetID    string `json:"assetId,omitempty"`
+}
+
+//encore:api auth method=GET path=/mockups/templates
+func ListMockupTemplates(ctx context.Context, req *ListMockupTemplatesRequest) (*ListMockupTemplatesResponse, error) {
+	args := []any{}
+	filter := "is_active"
+	if req.Category != "" {
+		args = append(args, req.Category)
+		filter += fmt.Sprintf(" AND category = $%d", len(args))
+	}
+	rows, err := db.Query(ctx, mockupColumns+` WHERE `+filter+` ORDER BY category, name`, args...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list mockup templates", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list mockup templates",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListMockupTemplatesResponse{Templates: []MockupTemplate{}}
+	for rows.Next() {
+		t, err := scanMockupTemplate(rows)
+		if err != nil {
+			continue
+		}
+		resp.Templates = append(resp.Templates, *t)
+	}
+	return resp, nil
+}
+
+// CreateMockup queues a mockup export of a project page or image on a
+// template. The mockup is stored as an asset of the project when the job
+// completes, like any export.
+//
+//encore:api auth method=POST path=/projects/:id/mockups
+func CreateMockup(ctx context.Context, id string, req *CreateMockupRequest) (*Job, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	if _, err := getMockupTemplate(ctx, req.TemplateID, true); err != nil {
+		return nil, err
+	}
+	if req.AssetID != "" {
+		if err := permissions.Authorize(ctx, permissions.Asset(req.AssetID), permissions.AssetView); err != nil {
+			return nil, err
+		}
+	}
+	options, err := json.Marshal(mockupOptions{TemplateID: req.TemplateID, PageID: req.PageID, AssetID: req.AssetID})
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create mockup",
+		}
+	}
+	return queueJob(ctx, &Job{
+		ProjectID: id,
+		UserID:    auth.UserID(),
+		Kind:      KindMockup,
+		Preset:    KindMockup,
+		Status:    StatusQueued,
+		Options:   options,
+	})
+}
+
+// CreateMockupTemplate adds a template from a photo the admin uploaded. The
+// photo and overlay are copied as public assets so every user can preview
+// the template.
+//
+//encore:api auth method=POST path=/admin/mockups/templates
+func CreateMockupTemplate(ctx context.Context, req *CreateMockupTemplateRequest) (*MockupTemplate, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	t := &MockupTemplate{
+		Name:      strings.TrimSpace(req.Name),
+		Category:  strings.ToLower(strings.TrimSpace(req.Category)),
+		Placement: req.Placement,
+		BlendMode: req.BlendMode,
+	}
+	if t.BlendMode == "" {
+		t.BlendMode = MockupBlendNormal
+	}
+	if err := validateMockupTemplate(t); err != nil {
+		return nil, err
+	}
+
+	base, w, h, err := copyMockupImage(ctx, req.BaseAssetID)
+	if err != nil {
+		return nil, err
+	}
+	t.baseAssetID, t.Width, t.Height = base, w, h
+	if req.OverlayAssetID != "" {
+		overlay, ow, oh, err := copyMockupImage(ctx, req.OverlayAssetID)
+		if err != nil {
+			deleteMockupAssets(ctx, base, nil)
+			return nil, err
+		}
+		t.overlayAssetID = &overlay
+		if ow != w || oh != h {
+			deleteMockupAssets(ctx, base, t.overlayAssetID)
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Overlay must be the same size as the photo",
+			}
+		}
+	}
+
+	placement, _ := json.Marshal(t.Placement)
+	err = db.QueryRow(ctx, `
+		INSERT INTO mockup_templates (name, category, base_asset_id, overlay_asset_id, width, height, placement, blend_mode, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`, t.Name, t.Category, t.baseAssetID, t.overlayAssetID, t.Width, t.Height, placement, t.BlendMode, auth.UserID()).Scan(&t.ID)
+	if err != nil {
+		deleteMockupAssets(ctx, t.baseAssetID, t.overlayAssetID)
+		reqctx.Logger(ctx).Error("failed to create mockup template", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create mockup template",
+		}
+	}
+	reqctx.Logger(ctx).Info("mockup template created", "template_id", t.ID, "category", t.Category)
+	return getMockupTemplate(ctx, t.ID, false)
+}
+
+//encore:api auth method=PATCH path=/admin/mockups/templates/:id
+func UpdateMockupTemplate(ctx context.Context, id string, req *UpdateMockupTemplateRequest) (*MockupTemplate, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	t, err := getMockupTemplate(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name != nil {
+		t.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Category != nil {
+		t.Category = strings.ToLower(strings.TrimSpace(*req.Category))
+	}
+	if req.Placement != nil {
+		t.Placement = *req.Placement
+	}
+	if req.BlendMode != nil {
+		t.BlendMode = *req.BlendMode
+	}
+	if req.Active != nil {
+		t.Active = *req.Active
+	}
+	if err := validateMockupTemplate(t); err != nil {
+		return nil, err
+	}
+
+	placement, _ := json.Marshal(t.Placement)
+	_, err = db.Exec(ctx, `
+		UPDATE mockup_templates
+		SET name = $2, category = $3, placement = $4, blend_mode = $5, is_active = $6, updated_at = NOW()
+		WHERE id = $1
+	`, t.ID, t.Name, t.Category, placement, t.BlendMode, t.Active)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update mockup template", "template_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update mockup template",
+		}
+	}
+	return getMockupTemplate(ctx, t.ID, false)
+}
+
+// DeleteMockupTemplate deletes a template and its copies of the photo and
+// overlay. Mockups already made are kept.
+//
+//encore:api auth method=DELETE path=/admin/mockups/templates/:id
+func DeleteMockupTemplate(ctx context.Context, id string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	var baseAssetID string
+	var overlayAssetID *string
+	err := db.QueryRow(ctx, `
+		DELETE FROM mockup_templates WHERE id::text = $1 RETURNING base_asset_id, overlay_asset_id
+	`, id).Scan(&baseAssetID, &overlayAssetID)
+	if err == sql.ErrNoRows {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Mockup template not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete mockup template", "template_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete mockup template",
+		}
+	}
+	deleteMockupAssets(ctx, baseAssetID, overlayAssetID)
+	reqctx.Logger(ctx).Info("mockup template deleted", "template_id", id)
+	return nil
+}
+
+// renderMockup places a project page, or an image of the project, on a
+// mockup template.
+func renderMockup(ctx context.Context, job *Job) (*artifact, error) {
+	var opts mockupOptions
+	if err := json.Unmarshal(job.Options, &opts); err != nil || opts.TemplateID == "" {
+		return nil, fmt.Errorf("invalid options: a templateId is required")
+	}
+	t, err := getMockupTemplate(ctx, opts.TemplateID, false)
+	if err != nil {
+		return nil, fmt.Errorf("mockup template not found")
+	}
+	warp := t.Placement.warp()
+
+	var slug string
+	var revision int
+	err = db.QueryRow(ctx, `SELECT COALESCE(slug, ''), version FROM projects WHERE id = $1`, job.ProjectID).Scan(&slug, &revision)
+	if err != nil {
+		return nil, fmt.Errorf("load project: %w", err)
+	}
+	var design image.Image
+	if opts.AssetID != "" {
+		design, err = mockupDesignImage(ctx, job, opts.AssetID)
+	} else {
+		design, err = drawPageImage(ctx, job, opts.PageID, warp.Bounds())
+		job.Revision = &revision
+		if job.SourceVersion != nil {
+			job.Revision = job.SourceVersion
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	photo, err := decodeAsset(ctx, t.baseAssetID)
+	if err != nil {
+		return nil, fmt.Errorf("load mockup photo: %w", err)
+	}
+	canvas := render.NewCanvas(t.Width, t.Height, render.Color{})
+	canvas.Image(photo, 0, 0, float64(t.Width), float64(t.Height), 1)
+	canvas.Save()
+	if t.BlendMode != MockupBlendNormal {
+		canvas.SetBlendMode(t.BlendMode)
+	}
+	if err := canvas.Warp(design, warp, 1); err != nil {
+		return nil, fmt.Errorf("mockup placement: %w", err)
+	}
+	canvas.Restore()
+	if t.overlayAssetID != nil {
+		overlay, err := decodeAsset(ctx, *t.overlayAssetID)
+		if err != nil {
+			return nil, fmt.Errorf("load mockup overlay: %w", err)
+		}
+		canvas.Image(overlay, 0, 0, float64(t.Width), float64(t.Height), 1)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas.Pixels()); err != nil {
+		return nil, err
+	}
+	name := slug
+	if name == "" {
+		name = "project"
+	}
+	return &artifact{
+		Filename: fmt.Sprintf("%s-%s-mockup.png", name, t.Category),
+		MimeType: "image/png",
+		Data:     buf.Bytes(),
+	}, nil
+}
+
+// mockupDesignImage loads an image asset to place. Jobs run without the
+// requester's session, so the asset must belong to the project or to the
+// requester.
+func mockupDesignImage(ctx context.Context, job *Job, assetID string) (image.Image, error) {
+	var allowed bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM assets WHERE id::text = $1 AND (project_id = $2 OR user_id = $3)
+		)
+	`, assetID, job.ProjectID, job.UserID).Scan(&allowed)
+	if err != nil || !allowed {
+		return nil, fmt.Errorf("design image not found")
+	}
+	return decodeAsset(ctx, assetID)
+}
+
+// drawPageImage draws a project page on a raster canvas, enlarged so it
+// is not blurred when stretched over the surface it is shown on.
+func drawPageImage(ctx context.Context, job *Job, pageID string, surface render.Box) (image.Image, error) {
+	var canvasData []byte
+	var width, height int
+	err := db.QueryRow(ctx, `
+		SELECT canvas_data, canvas_width, canvas_height FROM projects WHERE id = $1
+	`, job.ProjectID).Scan(&canvasData, &width, &height)
+	if err != nil {
+		return nil, fmt.Errorf("load project: %w", err)
+	}
+	if job.SourceVersion != nil {
+		err = db.QueryRow(ctx, `
+			SELECT canvas_data FROM project_versions WHERE project_id = $1 AND version_number = $2
+		`, job.ProjectID, *job.SourceVersion).Scan(&canvasData)
+		if err != nil {
+			return nil, fmt.Errorf("load version %d: %w", *job.SourceVersion, err)
+		}
+	}
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return nil, err
+	}
+	page := render.FindPage(pages, pageID)
+	if page == nil {
+		return nil, fmt.Errorf("page not found")
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("project has no canvas size")
+	}
+
+	scale := math.Max(surface.W/float64(width), surface.H/float64(height))
+	scale = math.Min(math.Max(scale, 1), maxDesignScale)
+	canvas := render.NewCanvas(int(float64(width)*scale), int(float64(height)*scale), pageBackground(canvasData))
+	canvas.Transform(render.Scale(scale, scale))
+	if _, err := render.DrawPage(ctx, canvas, *page, assetImages(render.SRGB), nil); err != nil {
+		return nil, err
+	}
+	return canvas.Pixels(), nil
+}
+
+func decodeAsset(ctx context.Context, assetID string) (image.Image, error) {
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data.Data))
+	return img, err
+}
+
+// copyMockupImage stores a public copy of an image the admin can view and
+// returns it with its size.
+func copyMockupImage(ctx context.Context, assetID string) (string, int, int, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(assetID), permissions.AssetView); err != nil {
+		return "", 0, 0, err
+	}
+	src, err := asset.Read(ctx, assetID)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src.Data))
+	if err != nil {
+		return "", 0, 0, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Mockup images must be PNG or JPEG",
+		}
+	}
+	if cfg.Width > maxMockupSide || cfg.Height > maxMockupSide {
+		return "", 0, 0, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("Mockup images must be at most %d pixels on each side", maxMockupSide),
+		}
+	}
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:   auth.UserID(),
+		Filename: src.Asset.Filename,
+		MimeType: src.Asset.MimeType,
+		Data:     src.Data,
+		Width:    &cfg.Width,
+		Height:   &cfg.Height,
+		Public:   true,
+	})
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return stored.ID, cfg.Width, cfg.Height, nil
+}
+
+// deleteMockupAssets deletes a template's copies of its images. Failures
+// are logged; the copies are no longer referenced.
+func deleteMockupAssets(ctx context.Context, baseAssetID string, overlayAssetID *string) {
+	ids := []string{baseAssetID}
+	if overlayAssetID != nil {
+		ids = append(ids, *overlayAssetID)
+	}
+	for _, id := range ids {
+		if err := asset.Delete(ctx, id); err != nil {
+			reqctx.Logger(ctx).Warn("failed to delete mockup template asset", "asset_id", id, "error", err)
+		}
+	}
+}
+
+func validateMockupTemplate(t *MockupTemplate) error {
+	if t.Name == "" || len([]rune(t.Name)) > 100 {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name must be between 1 and 100 characters",
+		}
+	}
+	if !categoryPattern.MatchString(t.Category) || len(t.Category) > 100 {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Category must be lowercase letters, digits and hyphens, such as t-shirt",
+		}
+	}
+	if t.BlendMode != MockupBlendNormal && t.BlendMode != MockupBlendMultiply {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Blend mode must be normal or multiply",
+		}
+	}
+	if (len(t.Placement.Corners) > 0) == (t.Placement.Mesh != nil) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Placement needs either corners or a mesh",
+		}
+	}
+	if err := t.Placement.warp().Validate(); err != nil {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid placement: " + err.Error(),
+		}
+	}
+	return nil
+}
+
+// warp converts the placement to the renderer's warp.
+func (p MockupPlacement) warp() render.Warp {
+	points := func(pts [][2]float64) []render.Point {
+		out := make([]render.Point, len(pts))
+		for i, pt := range pts {
+			out[i] = render.Point{X: pt[0], Y: pt[1]}
+		}
+		return out
+	}
+	if p.Mesh != nil {
+		return render.Warp{Columns: p.Mesh.Columns, Rows: p.Mesh.Rows, Mesh: points(p.Mesh.Points)}
+	}
+	return render.Warp{Corners: points(p.Corners)}
+}
+
+const mockupColumns = `
+	SELECT id, name, category, base_asset_id, overlay_asset_id, width, height, placement,
+		blend_mode, is_active, created_at, updated_at
+	FROM mockup_templates`
+
+func scanMockupTemplate(row scanner) (*MockupTemplate, error) {
+	t := &MockupTemplate{}
+	var placement []byte
+	err := row.Scan(&t.ID, &t.Name, &t.Category, &t.baseAssetID, &t.overlayAssetID, &t.Width, &t.Height,
+		&placement, &t.BlendMode, &t.Active, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(placement, &t.Placement); err != nil {
+		return nil, err
+	}
+	t.PreviewURL = canvasrefs.AssetURL(t.baseAssetID)
+	return t, nil
+}
+
+// getMockupTemplate loads a template; activeOnly hides retired ones.
+func getMockupTemplate(ctx context.Context, id string, activeOnly bool) (*MockupTemplate, error) {
+	t, err := scanMockupTemplate(db.QueryRow(ctx, mockupColumns+` WHERE id::text = $1 AND (is_active OR NOT $2)`, id, activeOnly))
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Mockup template not found",
+		}
+	}
+	return t, nil
+}
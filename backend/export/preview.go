@@ -0,0 +1,311 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+
+	"canvasai/asset"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Link previews (Open Graph images) of public projects and share links.
+// Chat apps and social sites fetch them without signing in, so they are
+// served publicly for projects that are public, or with a live share
+// token. Each page's preview is rendered on first request and cached until
+// the project's next revision; fetching one never counts as opening the
+// share link.
+
+// Preview image size, as Open Graph recommends
+const (
+	previewWidth  = 1200
+	previewHeight = 630
+	previewMargin = 48
+)
+
+var previewBackdrop = render.Color{R: 0.957, G: 0.957, B: 0.961, A: 1}
+
+// LinkPreview is the metadata a link unfurls to. The web app renders it
+// as Open Graph and Twitter card tags.
+type LinkPreview struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// Path is the web app path the link opens
+	Path        string `json:"path"`
+	ImageURL    string `json:"imageUrl"`
+	ImageWidth  int    `json:"imageWidth"`
+	ImageHeight int    `json:"imageHeight"`
+}
+
+// previewSource is a project as its link preview shows it
+type previewSource struct {
+	projectID string
+	ownerID   string
+	pageID    string
+	revision  int
+}
+
+// GetProjectPreview returns the link preview of a public project.
+//
+//encore:api public method=GET path=/projects/:id/preview
+func GetProjectPreview(ctx context.Context, id string) (*LinkPreview, error) {
+	if _, err := loadPreviewSource(ctx, id, ""); err != nil {
+		return nil, previewError(ctx, id, err)
+	}
+	return linkPreview(ctx, id, "/projects/"+id, "")
+}
+
+// GetSharedPreview returns the link preview of a share link. Unlike
+// opening the link, it does not count as a use.
+//
+//encore:api public method=GET path=/shared/:token/preview
+func GetSharedPreview(ctx context.Context, token string) (*LinkPreview, error) {
+	var projectID string
+	err := db.QueryRow(ctx, `SELECT project_id FROM project_share_links WHERE token = $1`, token).Scan(&projectID)
+	if err == nil {
+		_, err = loadPreviewSource(ctx, projectID, token)
+	}
+	if err != nil {
+		return nil, previewError(ctx, projectID, err)
+	}
+	// The web app's share link route (see project.sharePath)
+	return linkPreview(ctx, projectID, "/s/"+token, token)
+}
+
+func linkPreview(ctx context.Context, projectID, path, shareToken string) (*LinkPreview, error) {
+	p := &LinkPreview{
+		Path:        path,
+		ImageURL:    previewURL(projectID, shareToken),
+		ImageWidth:  previewWidth,
+		ImageHeight: previewHeight,
+	}
+	err := db.QueryRow(ctx, `
+		SELECT title, COALESCE(description, '') FROM projects WHERE id = $1
+	`, projectID).Scan(&p.Title, &p.Description)
+	if err != nil {
+		return nil, previewError(ctx, projectID, err)
+	}
+	return p, nil
+}
+
+func previewError(ctx context.Context, projectID string, err error) error {
+	if err == sql.ErrNoRows {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Preview not found",
+		}
+	}
+	reqctx.Logger(ctx).Error("failed to load link preview", "project_id", projectID, "error", err)
+	return &errs.Error{
+		Code:    errs.Internal,
+		Message: "Failed to load preview",
+	}
+}
+
+// Preview serves a project's link preview image. Projects that are not
+// public need the token of a live share link in the "share" query
+// parameter; a link to a page previews that page.
+//
+//encore:api public raw method=GET path=/projects/:id/preview.png
+func Preview(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := encore.CurrentRequest().PathParams.Get("id")
+	log := reqctx.Logger(ctx).With("project_id", id)
+
+	src, err := loadPreviewSource(ctx, id, req.URL.Query().Get("share"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "preview not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error("failed to load project preview", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	assetID, err := cachedPreview(ctx, src)
+	if err != nil {
+		log.Error("failed to render project preview", "revision", src.revision, "error", err)
+		http.Error(w, "preview unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	etag := `"` + assetID + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=600")
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		log.Error("failed to read project preview", "asset_id", assetID, "error", err)
+		http.Error(w, "preview unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data.Data)
+}
+
+// loadPreviewSource checks that a project can be previewed, publicly or
+// through shareToken, and returns what to preview. It returns
+// sql.ErrNoRows when it cannot.
+func loadPreviewSource(ctx context.Context, projectID, shareToken string) (*previewSource, error) {
+	src := &previewSource{projectID: projectID}
+	var public bool
+	err := db.QueryRow(ctx, `
+		SELECT p.owner_id, p.is_public, p.version
+		FROM projects p JOIN users u ON u.id = p.owner_id
+		WHERE p.id::text = $1 AND p.deleted_at IS NULL AND u.deactivated_at IS NULL
+	`, projectID).Scan(&src.ownerID, &public, &src.revision)
+	if err != nil {
+		return nil, err
+	}
+	if shareToken == "" {
+		if !public {
+			return nil, sql.ErrNoRows
+		}
+		return src, nil
+	}
+	err = db.QueryRow(ctx, `
+		SELECT COALESCE(page_id, '') FROM project_share_links
+		WHERE token = $1 AND project_id::text = $2
+			AND (expires_at IS NULL OR expires_at > NOW())
+			AND (max_uses IS NULL OR use_count < max_uses)
+	`, shareToken, projectID).Scan(&src.pageID)
+	if err == sql.ErrNoRows && public {
+		return src, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// cachedPreview returns the asset of the project's preview at its current
+// revision, rendering and caching it first if needed.
+func cachedPreview(ctx context.Context, src *previewSource) (string, error) {
+	var assetID string
+	var revision int
+	err := db.QueryRow(ctx, `
+		SELECT asset_id, revision FROM project_previews WHERE project_id = $1 AND page_id = $2
+	`, src.projectID, src.pageID).Scan(&assetID, &revision)
+	if err == nil && revision >= src.revision {
+		return assetID, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	previousID := assetID
+
+	var canvasData []byte
+	var width, height int
+	err = db.QueryRow(ctx, `
+		SELECT canvas_data, COALESCE(canvas_width, 0), COALESCE(canvas_height, 0), version
+		FROM projects WHERE id = $1
+	`, src.projectID).Scan(&canvasData, &width, &height, &src.revision)
+	if err != nil {
+		return "", err
+	}
+	img, err := drawPreview(ctx, canvasData, width, height, src.pageID)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	w, h := previewWidth, previewHeight
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:    src.ownerID,
+		ProjectID: src.projectID,
+		Filename:  "preview.png",
+		MimeType:  "image/png",
+		Data:      buf.Bytes(),
+		Width:     &w,
+		Height:    &h,
+	})
+	if err != nil {
+		return "", fmt.Errorf("store preview: %w", err)
+	}
+
+	result, err := db.Exec(ctx, `
+		INSERT INTO project_previews (project_id, page_id, revision, asset_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (project_id, page_id) DO UPDATE
+		SET revision = EXCLUDED.revision, asset_id = EXCLUDED.asset_id, rendered_at = NOW()
+		WHERE project_previews.revision < EXCLUDED.revision
+	`, src.projectID, src.pageID, src.revision, stored.ID)
+	if err != nil || result.RowsAffected() == 0 {
+		// Failed, or a concurrent request cached this revision first, in
+		// which case that request's image is served.
+		deletePreview(ctx, stored.ID)
+		if err != nil {
+			return "", err
+		}
+		return cachedPreview(ctx, src)
+	}
+	if previousID != "" {
+		deletePreview(ctx, previousID)
+	}
+	reqctx.Logger(ctx).Info("project preview rendered", "project_id", src.projectID, "revision", src.revision)
+	return stored.ID, nil
+}
+
+// drawPreview draws a page centered on a neutral backdrop at the preview
+// size. Pages without a background show white.
+func drawPreview(ctx context.Context, canvasData []byte, width, height int, pageID string) (image.Image, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("project has no canvas size")
+	}
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return nil, err
+	}
+	page := render.FindPage(pages, pageID)
+	if page == nil {
+		page = &pages[0]
+	}
+
+	scale := math.Min(
+		float64(previewWidth-2*previewMargin)/float64(width),
+		float64(previewHeight-2*previewMargin)/float64(height),
+	)
+	w, h := float64(width)*scale, float64(height)*scale
+	canvas := render.NewCanvas(previewWidth, previewHeight, previewBackdrop)
+	canvas.Transform(render.Translate((previewWidth-w)/2, (previewHeight-h)/2))
+	canvas.Transform(render.Scale(scale, scale))
+	background := pageBackground(canvasData)
+	if !background.Visible() {
+		background = white
+	}
+	canvas.Rect(0, 0, float64(width), float64(height), 0, render.Style{Fill: background})
+	if _, err := render.DrawPage(ctx, canvas, *page, assetImages(render.SRGB), nil); err != nil {
+		return nil, err
+	}
+	return canvas.Pixels(), nil
+}
+
+func deletePreview(ctx context.Context, assetID string) {
+	if err := asset.Delete(ctx, assetID); err != nil {
+		reqctx.Logger(ctx).Warn("failed to delete project preview", "asset_id", assetID, "error", err)
+	}
+}
+
+// previewURL is where a project's link preview image is served.
+func previewURL(projectID, shareToken string) string {
+	base := encore.Meta().APIBaseURL
+	base.Path = "/projects/" + projectID + "/preview.png"
+	if shareToken != "" {
+		base.RawQuery = url.Values{"share": {shareToken}}.Encode()
+	}
+	return base.String()
+}
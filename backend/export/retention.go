@@ -0,0 +1,197 @@
+package export
+
+import (
+	"context"
+	"database/sql"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/cron"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/asset"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Export artifacts are not kept forever. Depending on the retention policy
+// they are purged once they reach a certain age, or as soon as a newer
+// export of the same preset (per project and user) has completed. A purged
+// job keeps its settings, so it can be regenerated later.
+
+// Retention policies
+const (
+	RetentionAge             = "age"
+	RetentionLatestPerPreset = "latest_per_preset"
+)
+
+// ExportRetention configures how long export artifacts are kept
+type ExportRetention struct {
+	// Policy is RetentionAge (default) or RetentionLatestPerPreset
+	Policy string `json:"policy"`
+	// Days an artifact is kept under the age policy. Zero uses the default.
+	Days int `json:"days"`
+}
+
+var retentionCfg struct {
+	Retention ExportRetention
+}
+
+var _ = config.Load(context.Background(), &retentionCfg)
+
+const (
+	defaultRetentionDays = 30
+
+	// purgeBatchSize bounds the artifacts removed by a single purge run.
+	purgeBatchSize = 500
+)
+
+// RegenerateExportRequest represents the regenerate export request
+type RegenerateExportRequest struct {
+	// Version renders a saved project version instead of the current project
+	Version *int `json:"version,omitempty"`
+}
+
+// RegenerateExport queues a new export with the settings of an earlier one,
+// typically after its artifact was purged.
+//
+//encore:api auth method=POST path=/exports/:id/regenerate
+func RegenerateExport(ctx context.Context, id string, req *RegenerateExportRequest) (*Job, error) {
+	orig, err := getJob(ctx, id)
+	if err != nil || orig.UserID != auth.UserID() {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Export not found",
+		}
+	}
+	if err := projectaccess.RequireRole(ctx, orig.ProjectID, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	if _, ok := exporters[orig.Kind]; !ok {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "This export kind is no longer supported",
+		}
+	}
+
+	if req.Version != nil {
+		var exists bool
+		err := db.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM project_versions WHERE project_id = $1 AND version_number = $2)
+		`, orig.ProjectID, *req.Version).Scan(&exists)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to check project version", "project_id", orig.ProjectID, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to create export",
+			}
+		}
+		if !exists {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Version not found",
+			}
+		}
+	}
+
+	return queueJob(ctx, &Job{
+		ProjectID:       orig.ProjectID,
+		UserID:          orig.UserID,
+		Kind:            orig.Kind,
+		Preset:          orig.Preset,
+		Status:          StatusQueued,
+		Options:         orig.Options,
+		SourceVersion:   req.Version,
+		RegeneratedFrom: &orig.ID,
+	})
+}
+
+// Purge expired export artifacts hourly.
+var _ = cron.NewJob("purge-export-artifacts", cron.JobConfig{
+	Title:    "Delete export artifacts past their retention",
+	Every:    1 * cron.Hour,
+	Endpoint: PurgeExportArtifacts,
+})
+
+//encore:api private
+func PurgeExportArtifacts(ctx context.Context) error {
+	rows, err := purgeCandidates(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find expired exports", "error", err)
+		return err
+	}
+	type candidate struct {
+		jobID   string
+		assetID sql.NullString
+	}
+	var expired []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.jobID, &c.assetID); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	purged := 0
+	for _, c := range expired {
+		if c.assetID.Valid {
+			if err := asset.Delete(ctx, c.assetID.String); err != nil {
+				reqctx.Logger(ctx).Error("failed to delete export artifact", "job_id", c.jobID, "asset_id", c.assetID.String, "error", err)
+				continue
+			}
+		}
+		_, err := db.Exec(ctx, `
+			UPDATE export_jobs SET purged_at = NOW(), artifact_asset_id = NULL WHERE id = $1
+		`, c.jobID)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to mark export purged", "job_id", c.jobID, "error", err)
+			continue
+		}
+		purged++
+	}
+	reqctx.Logger(ctx).Info("purged export artifacts", "count", purged, "policy", retentionPolicy())
+	return nil
+}
+
+// purgeCandidates returns the completed jobs whose artifacts the retention
+// policy no longer keeps, oldest first.
+func purgeCandidates(ctx context.Context) (*sqldb.Rows, error) {
+	if retentionPolicy() == RetentionLatestPerPreset {
+		return db.Query(ctx, `
+			SELECT id, artifact_asset_id FROM (
+				SELECT id, artifact_asset_id, completed_at,
+					row_number() OVER (PARTITION BY project_id, user_id, COALESCE(preset, kind) ORDER BY completed_at DESC) AS rank
+				FROM export_jobs
+				WHERE status = $1 AND purged_at IS NULL
+			) j
+			WHERE rank > 1
+			ORDER BY completed_at
+			LIMIT $2
+		`, StatusCompleted, purgeBatchSize)
+	}
+	days := retentionCfg.Retention.Days
+	if days <= 0 {
+		days = defaultRetentionDays
+	}
+	return db.Query(ctx, `
+		SELECT id, artifact_asset_id FROM export_jobs
+		WHERE status = $1 AND purged_at IS NULL AND completed_at < NOW() - $2 * INTERVAL '1 day'
+		ORDER BY completed_at
+		LIMIT $3
+	`, StatusCompleted, days, purgeBatchSize)
+}
+
+func retentionPolicy() string {
+	if retentionCfg.Retention.Policy == RetentionLatestPerPreset {
+		return RetentionLatestPerPreset
+	}
+	return RetentionAge
+}
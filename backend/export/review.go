@@ -0,0 +1,442 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+	"time"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// KindReviewPDF is a client-review PDF: page renders with numbered comment
+// callouts followed by an index of all feedback.
+const KindReviewPDF = "review_pdf"
+
+// reviewOptions are the options accepted by review_pdf exports
+type reviewOptions struct {
+	// IncludeResolved keeps resolved threads in the report (default true)
+	IncludeResolved *bool `json:"includeResolved,omitempty"`
+}
+
+// reviewThread is a numbered root comment with its replies
+type reviewThread struct {
+	Number    int
+	ID        string
+	Author    string
+	Content   string
+	Resolved  bool
+	CreatedAt time.Time
+	ElementID string
+	X, Y      *float64
+	Replies   []reviewReply
+
+	// Resolved placement on the rendered pages
+	PageIndex int
+	Anchor    *render.Point
+	Bounds    *render.Box
+}
+
+type reviewReply struct {
+	Author    string
+	Content   string
+	CreatedAt time.Time
+}
+
+// calloutRadius is the radius of a thread's numbered callout, in points
+const calloutRadius = 11
+
+// Index page layout, in points (US Letter)
+const (
+	indexWidth  = 612
+	indexHeight = 792
+	indexMargin = 50
+)
+
+var (
+	calloutOpen     = render.Color{R: 0.898, G: 0.282, B: 0.302, A: 1}
+	calloutResolved = render.Color{R: 0.55, G: 0.55, B: 0.55, A: 1}
+	white           = render.Color{R: 1, G: 1, B: 1, A: 1}
+	ink             = render.Color{R: 0.13, G: 0.13, B: 0.13, A: 1}
+	muted           = render.Color{R: 0.45, G: 0.45, B: 0.45, A: 1}
+)
+
+func renderReviewReport(ctx context.Context, job *Job) (*artifact, error) {
+	var opts reviewOptions
+	if len(job.Options) > 0 {
+		if err := json.Unmarshal(job.Options, &opts); err != nil {
+			return nil, fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	includeResolved := opts.IncludeResolved == nil || *opts.IncludeResolved
+
+	var title, slug, colorProfile string
+	var canvasData []byte
+	var width, height, revision int
+	err := db.QueryRow(ctx, `
+		SELECT title, COALESCE(slug, ''), canvas_data, canvas_width, canvas_height, version, color_profile
+		FROM projects WHERE id = $1
+	`, job.ProjectID).Scan(&title, &slug, &canvasData, &width, &height, &revision, &colorProfile)
+	if err != nil {
+		return nil, fmt.Errorf("load project: %w", err)
+	}
+	if job.SourceVersion != nil {
+		// Regenerating from history: the saved version supplies the canvas,
+		// the project its current page size.
+		revision = *job.SourceVersion
+		err = db.QueryRow(ctx, `
+			SELECT COALESCE(title, $3), canvas_data FROM project_versions
+			WHERE project_id = $1 AND version_number = $2
+		`, job.ProjectID, revision, title).Scan(&title, &canvasData)
+		if err != nil {
+			return nil, fmt.Errorf("load version %d: %w", revision, err)
+		}
+	}
+	job.Revision = &revision
+
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return nil, err
+	}
+	threads, err := loadThreads(ctx, job.ProjectID, includeResolved)
+	if err != nil {
+		return nil, err
+	}
+	placeThreads(threads, pages)
+
+	space := render.WorkingSpace(colorProfile)
+	doc := render.NewPDF()
+	doc.SetColorSpace(space)
+	images, fonts := assetImages(space), assetFonts()
+	background := pageBackground(canvasData)
+	manifest := &elementManifest{Revision: revision, Pages: make([]manifestPage, len(pages))}
+	for i, page := range pages {
+		manifest.Pages[i] = manifestPage{
+			PageID:   page.ID,
+			Width:    float64(width),
+			Height:   float64(height),
+			Elements: render.Layout(page.Objects),
+		}
+		surface := doc.AddPage(float64(width), float64(height))
+		if background.Visible() {
+			surface.Rect(0, 0, float64(width), float64(height), 0, render.Style{Fill: background})
+		}
+		if _, err := render.DrawPage(ctx, surface, page, images, fonts); err != nil {
+			return nil, err
+		}
+		for _, t := range threads {
+			if t.PageIndex == i && t.Anchor != nil {
+				drawCallout(surface, t, space)
+				manifest.Pages[i].Callouts = append(manifest.Pages[i].Callouts, manifestCallout{CommentID: t.ID, X: t.Anchor.X, Y: t.Anchor.Y})
+			}
+		}
+	}
+	drawIndex(doc, title, revision, pages, threads)
+
+	name := slug
+	if name == "" {
+		name = "project"
+	}
+	return &artifact{
+		Filename: name + "-review.pdf",
+		MimeType: "application/pdf",
+		Data:     doc.Bytes(),
+		Manifest: manifest,
+	}, nil
+}
+
+func loadThreads(ctx context.Context, projectID string, includeResolved bool) ([]*reviewThread, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.parent_id, COALESCE(u.name, u.email, 'Unknown'), c.content,
+			c.is_resolved, c.created_at, COALESCE(c.element_id, ''), c.position_x, c.position_y
+		FROM project_comments c
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.project_id = $1
+		ORDER BY c.created_at, c.id
+	`, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("load comments: %w", err)
+	}
+	defer rows.Close()
+
+	var threads []*reviewThread
+	byID := map[string]*reviewThread{}
+	type reply struct {
+		parentID string
+		reviewReply
+	}
+	var replies []reply
+	for rows.Next() {
+		var id, author, content, elementID string
+		var parentID sql.NullString
+		var resolved bool
+		var createdAt time.Time
+		var x, y sql.NullFloat64
+		if err := rows.Scan(&id, &parentID, &author, &content, &resolved, &createdAt, &elementID, &x, &y); err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			replies = append(replies, reply{parentID.String, reviewReply{author, content, createdAt}})
+			continue
+		}
+		if resolved && !includeResolved {
+			continue
+		}
+		t := &reviewThread{
+			Number:    len(threads) + 1,
+			ID:        id,
+			Author:    author,
+			Content:   content,
+			Resolved:  resolved,
+			CreatedAt: createdAt,
+			ElementID: elementID,
+			PageIndex: -1,
+		}
+		if x.Valid && y.Valid {
+			t.X, t.Y = &x.Float64, &y.Float64
+		}
+		threads = append(threads, t)
+		byID[id] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, r := range replies {
+		if t, ok := byID[r.parentID]; ok {
+			t.Replies = append(t.Replies, r.reviewReply)
+		}
+	}
+	return threads, nil
+}
+
+// placeThreads anchors each thread on a page: on its element when it has one
+// that still exists, otherwise at its pinned position on the first page.
+func placeThreads(threads []*reviewThread, pages []render.Page) {
+	for _, t := range threads {
+		if t.ElementID != "" {
+			for i, page := range pages {
+				if _, box, ok := render.Locate(page.Objects, t.ElementID); ok {
+					t.PageIndex = i
+					t.Bounds = &box
+					t.Anchor = &render.Point{X: box.X + box.W, Y: box.Y}
+					break
+				}
+			}
+		}
+		if t.Anchor == nil && t.X != nil && t.Y != nil {
+			t.PageIndex = 0
+			t.Anchor = &render.Point{X: *t.X, Y: *t.Y}
+		}
+	}
+}
+
+// drawCallout marks a thread on the page. The callout colors are sRGB and
+// are converted so they look the same in every working space.
+func drawCallout(s render.Surface, t *reviewThread, space render.ColorSpace) {
+	color := calloutOpen
+	if t.Resolved {
+		color = calloutResolved
+	}
+	color = color.Convert(render.SRGB, space)
+	if t.Bounds != nil {
+		s.Rect(t.Bounds.X, t.Bounds.Y, t.Bounds.W, t.Bounds.H, 0, render.Style{Stroke: color, StrokeWidth: 1.5})
+	}
+
+	s.Ellipse(t.Anchor.X, t.Anchor.Y, calloutRadius, calloutRadius, render.Style{Fill: color, Stroke: white, StrokeWidth: 2})
+	label := fmt.Sprint(t.Number)
+	size := 11.0
+	if len(label) > 2 {
+		size = 8
+	}
+	w := render.TextWidth(label, size, true)
+	s.Text(t.Anchor.X-w/2, t.Anchor.Y+size*0.36, render.TextRun{Text: label, Size: size, Bold: true, Color: white})
+}
+
+// indexWriter lays out the feedback index, adding pages as they fill up.
+type indexWriter struct {
+	doc  *render.PDF
+	page *render.PDFPage
+	y    float64
+}
+
+func (w *indexWriter) newPage() {
+	w.page = w.doc.AddPage(indexWidth, indexHeight)
+	w.y = indexMargin
+}
+
+func (w *indexWriter) line(text string, size float64, bold bool, color render.Color, indent float64) {
+	width := indexWidth - 2*indexMargin - indent
+	for _, l := range render.WrapText(text, size, bold, width) {
+		if w.y+size > indexHeight-indexMargin {
+			w.newPage()
+		}
+		w.y += size
+		w.page.Text(indexMargin+indent, w.y, render.TextRun{Text: l, Size: size, Bold: bold, Color: color})
+		w.y += size * 0.35
+	}
+}
+
+func (w *indexWriter) space(h float64) { w.y += h }
+
+func drawIndex(doc *render.PDF, title string, revision int, pages []render.Page, threads []*reviewThread) {
+	w := &indexWriter{doc: doc}
+	w.newPage()
+
+	open := 0
+	for _, t := range threads {
+		if !t.Resolved {
+			open++
+		}
+	}
+	w.line("Review report", 20, true, ink, 0)
+	w.line(title, 14, false, ink, 0)
+	w.line(fmt.Sprintf("Revision %d  |  Generated %s  |  %d open, %d resolved",
+		revision, time.Now().UTC().Format("2 Jan 2006 15:04 MST"), open, len(threads)-open), 9, false, muted, 0)
+	w.space(16)
+
+	if len(threads) == 0 {
+		w.line("No feedback has been left on this project.", 11, false, muted, 0)
+		return
+	}
+
+	for _, t := range threads {
+		status := "Open"
+		if t.Resolved {
+			status = "Resolved"
+		}
+		location := "Not pinned to the canvas"
+		if t.PageIndex >= 0 {
+			location = "Page " + fmt.Sprint(t.PageIndex+1)
+			if name := pages[t.PageIndex].Name; name != "" {
+				location += " (" + name + ")"
+			}
+		}
+		w.line(fmt.Sprintf("#%d  %s", t.Number, status), 11, true, ink, 0)
+		w.line(fmt.Sprintf("%s  |  %s  |  %s", t.Author, t.CreatedAt.UTC().Format("2 Jan 2006"), location), 8.5, false, muted, 0)
+		for _, para := range strings.Split(t.Content, "\n") {
+			w.line(para, 10, false, ink, 0)
+		}
+		for _, r := range t.Replies {
+			w.space(2)
+			w.line(fmt.Sprintf("%s replied on %s:", r.Author, r.CreatedAt.UTC().Format("2 Jan 2006")), 8.5, false, muted, 16)
+			for _, para := range strings.Split(r.Content, "\n") {
+				w.line(para, 9.5, false, ink, 16)
+			}
+		}
+		w.space(12)
+	}
+}
+
+// pageBackground returns the document's background color, if any.
+func pageBackground(canvasData []byte) render.Color {
+	var doc struct {
+		Background string `json:"background"`
+	}
+	if len(canvasData) == 0 || json.Unmarshal(canvasData, &doc) != nil {
+		return render.Color{}
+	}
+	c, _ := render.ParseColor(doc.Background)
+	return c
+}
+
+// assetImages loads image elements from the asset service, caching each
+// asset for the duration of a render. Images are converted from their
+// embedded profile (sRGB when they have none) to the working space.
+func assetImages(space render.ColorSpace) render.ImageLoader {
+	cache := map[string]image.Image{}
+	return func(ctx context.Context, src string) (image.Image, error) {
+		id, ok := canvasrefs.ParseAssetID(src)
+		if !ok {
+			return nil, fmt.Errorf("unsupported image source")
+		}
+		// Projects that froze an asset reference one of its versions.
+		version, versioned := canvasrefs.ParseAssetVersion(src)
+		key := id
+		if versioned {
+			key = fmt.Sprintf("%s@%d", id, version)
+		}
+		if img, ok := cache[key]; ok {
+			return img, nil
+		}
+		var data *asset.AssetData
+		var err error
+		if versioned {
+			data, err = asset.ReadVersion(ctx, id, version)
+		} else {
+			data, err = asset.Read(ctx, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(data.Data))
+		if err != nil {
+			return nil, err
+		}
+		profile := render.SRGB.Profile()
+		if icc, ok := render.EmbeddedProfile(data.Data); ok {
+			if p, err := render.ParseICC(icc); err == nil {
+				profile = p
+			} else {
+				reqctx.Logger(ctx).Warn("ignoring embedded color profile", "asset_id", id, "error", err)
+			}
+		}
+		if profile.Space() != space {
+			img = render.ConvertImage(img, profile, space.Profile())
+		}
+		cache[key] = img
+		return img, nil
+	}
+}
+
+// assetFonts loads uploaded fonts from the asset service, caching each
+// font, or the reason it could not be read, for the duration of a render.
+func assetFonts() render.FontLoader {
+	type loaded struct {
+		font *render.Font
+		err  error
+	}
+	cache := map[string]loaded{}
+	return func(ctx context.Context, src string) (*render.Font, error) {
+		id, ok := canvasrefs.ParseAssetID(src)
+		if !ok {
+			// fontAssetId holds a bare asset ID.
+			id, ok = canvasrefs.ParseAssetID(canvasrefs.AssetURL(src))
+		}
+		if !ok {
+			return nil, fmt.Errorf("unsupported font source")
+		}
+		version, versioned := canvasrefs.ParseAssetVersion(src)
+		key := id
+		if versioned {
+			key = fmt.Sprintf("%s@%d", id, version)
+		}
+		if l, ok := cache[key]; ok {
+			return l.font, l.err
+		}
+		var data *asset.AssetData
+		var err error
+		if versioned {
+			data, err = asset.ReadVersion(ctx, id, version)
+		} else {
+			data, err = asset.Read(ctx, id)
+		}
+		var font *render.Font
+		if err == nil {
+			font, err = render.ParseFont(data.Data)
+		}
+		if err != nil {
+			reqctx.Logger(ctx).Warn("drawing text without its uploaded font", "asset_id", id, "error", err)
+		}
+		cache[key] = loaded{font, err}
+		return font, err
+	}
+}
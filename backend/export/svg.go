@@ -0,0 +1,78 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"canvasai/render"
+)
+
+// KindSVG is a vector image of one page of a project. Uploaded fonts are
+// embedded, subset to the glyphs the page draws. SVG colors are sRGB, so
+// images are converted to sRGB and canvas colors are written unchanged.
+const KindSVG = "svg"
+
+// svgOptions are the options accepted by svg exports
+type svgOptions struct {
+	// PageID selects the page to export (default the first)
+	PageID string `json:"pageId,omitempty"`
+}
+
+func renderSVG(ctx context.Context, job *Job) (*artifact, error) {
+	var opts svgOptions
+	if len(job.Options) > 0 {
+		if err := json.Unmarshal(job.Options, &opts); err != nil {
+			return nil, fmt.Errorf("invalid options: %w", err)
+		}
+	}
+
+	var slug string
+	var canvasData []byte
+	var width, height, revision int
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(slug, ''), canvas_data, canvas_width, canvas_height, version
+		FROM projects WHERE id = $1
+	`, job.ProjectID).Scan(&slug, &canvasData, &width, &height, &revision)
+	if err != nil {
+		return nil, fmt.Errorf("load project: %w", err)
+	}
+	if job.SourceVersion != nil {
+		revision = *job.SourceVersion
+		err = db.QueryRow(ctx, `
+			SELECT canvas_data FROM project_versions
+			WHERE project_id = $1 AND version_number = $2
+		`, job.ProjectID, revision).Scan(&canvasData)
+		if err != nil {
+			return nil, fmt.Errorf("load version %d: %w", revision, err)
+		}
+	}
+	job.Revision = &revision
+
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return nil, err
+	}
+	page := render.FindPage(pages, opts.PageID)
+	if page == nil {
+		return nil, fmt.Errorf("page %q not found", opts.PageID)
+	}
+
+	doc := render.NewSVG(float64(width), float64(height))
+	if background := pageBackground(canvasData); background.Visible() {
+		doc.Rect(0, 0, float64(width), float64(height), 0, render.Style{Fill: background})
+	}
+	if _, err := render.DrawPage(ctx, doc, *page, assetImages(render.SRGB), assetFonts()); err != nil {
+		return nil, err
+	}
+
+	name := slug
+	if name == "" {
+		name = "project"
+	}
+	return &artifact{
+		Filename: name + ".svg",
+		MimeType: "image/svg+xml",
+		Data:     doc.Bytes(),
+	}, nil
+}
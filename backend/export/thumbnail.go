@@ -0,0 +1,136 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"time"
+
+	"encore.dev/pubsub"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/project"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// thumbnailSize is the longest side of a project thumbnail, in pixels
+const thumbnailSize = 480
+
+// Project thumbnails are rendered after each canvas save and shown on the
+// dashboard. Saves arrive in bursts while someone edits, so a save that is
+// no longer the project's latest revision is skipped: the latest one has
+// its own message.
+var _ = pubsub.NewSubscription(project.CanvasSaves, "render-project-thumbnail", pubsub.SubscriptionConfig[*project.CanvasSave]{
+	Handler:        renderThumbnail,
+	MaxConcurrency: 2,
+	AckDeadline:    2 * time.Minute,
+})
+
+func renderThumbnail(ctx context.Context, msg *project.CanvasSave) error {
+	log := reqctx.Logger(ctx).With("project_id", msg.ProjectID)
+
+	var canvasData []byte
+	var width, height, revision int
+	var ownerID string
+	var renderedRevision *int
+	var previousID *string
+	err := db.QueryRow(ctx, `
+		SELECT canvas_data, COALESCE(canvas_width, 0), COALESCE(canvas_height, 0), version, owner_id,
+			thumbnail_revision, thumbnail_asset_id
+		FROM projects WHERE id = $1 AND deleted_at IS NULL
+	`, msg.ProjectID).Scan(&canvasData, &width, &height, &revision, &ownerID, &renderedRevision, &previousID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if revision > msg.Revision || (renderedRevision != nil && *renderedRevision >= revision) {
+		return nil
+	}
+
+	img, err := drawThumbnail(ctx, canvasData, width, height)
+	if err != nil {
+		// Retrying will not fix the document; the next save tries again.
+		log.Warn("failed to render project thumbnail", "revision", revision, "error", err)
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:    ownerID,
+		ProjectID: msg.ProjectID,
+		Filename:  "thumbnail.png",
+		MimeType:  "image/png",
+		Data:      buf.Bytes(),
+		Width:     &w,
+		Height:    &h,
+	})
+	if err != nil {
+		return fmt.Errorf("store thumbnail: %w", err)
+	}
+
+	result, err := db.Exec(ctx, `
+		UPDATE projects SET thumbnail = $2, thumbnail_asset_id = $3, thumbnail_revision = $4
+		WHERE id = $1 AND (thumbnail_revision IS NULL OR thumbnail_revision < $4)
+	`, msg.ProjectID, canvasrefs.AssetURL(stored.ID), stored.ID, revision)
+	if err != nil || result.RowsAffected() == 0 {
+		// Failed, or a newer thumbnail landed first.
+		deleteThumbnail(ctx, stored.ID)
+		return err
+	}
+	if previousID != nil {
+		deleteThumbnail(ctx, *previousID)
+	}
+	log.Info("project thumbnail rendered", "revision", revision, "asset_id", stored.ID)
+	return nil
+}
+
+// drawThumbnail draws a canvas document's first page scaled to fit within
+// thumbnailSize.
+func drawThumbnail(ctx context.Context, canvasData []byte, width, height int) (image.Image, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("project has no canvas size")
+	}
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return nil, err
+	}
+	page := render.FindPage(pages, "")
+	if page == nil {
+		return nil, fmt.Errorf("project has no pages")
+	}
+
+	scale := math.Min(1, thumbnailSize/float64(max(width, height)))
+	w := max(1, int(math.Round(float64(width)*scale)))
+	h := max(1, int(math.Round(float64(height)*scale)))
+	canvas := render.NewCanvas(w, h, pageBackground(canvasData))
+	canvas.Transform(render.Scale(scale, scale))
+	if _, err := render.DrawPage(ctx, canvas, *page, assetImages(render.SRGB), nil); err != nil {
+		return nil, err
+	}
+	return canvas.Pixels(), nil
+}
+
+// deleteThumbnail removes a replaced thumbnail, unless a saved version of
+// the project still shows it as its preview.
+func deleteThumbnail(ctx context.Context, assetID string) {
+	var kept bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM project_versions WHERE thumbnail = $1)
+	`, canvasrefs.AssetURL(assetID)).Scan(&kept)
+	if err == nil && !kept {
+		err = asset.Delete(ctx, assetID)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to delete project thumbnail", "asset_id", assetID, "error", err)
+	}
+}
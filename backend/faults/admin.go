@@ -0,0 +1,89 @@
+package faults
+
+import (
+	"context"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Admins are checked against the users stored in the project database.
+var db = sqldb.Named("project")
+
+// maxLatencyMs bounds the latency a rule may add
+const maxLatencyMs = 60000
+
+// RulesResponse represents the active fault rules
+type RulesResponse struct {
+	Enabled bool   `json:"enabled"`
+	Rules   []Rule `json:"rules"`
+}
+
+// SetRulesRequest represents the set fault rules request
+type SetRulesRequest struct {
+	Rules []Rule `json:"rules"`
+}
+
+//encore:api auth method=GET path=/admin/faults
+func GetRules(ctx context.Context) (*RulesResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	return &RulesResponse{Enabled: Enabled(), Rules: append([]Rule{}, rules()...)}, nil
+}
+
+// PutRules replaces the active rules on the instance that serves the
+// request, until ClearRules or a restart.
+//
+//encore:api auth method=PUT path=/admin/faults
+func PutRules(ctx context.Context, req *SetRulesRequest) (*RulesResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if !Enabled() {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Fault injection is disabled in this environment",
+		}
+	}
+	for _, r := range req.Rules {
+		switch r.Target {
+		case DB, Storage, Provider:
+		default:
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "target must be db, storage or provider",
+			}
+		}
+		if r.LatencyMs < 0 || r.LatencyMs > maxLatencyMs {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "latencyMs must be between 0 and 60000",
+			}
+		}
+		if r.ErrorRate < 0 || r.ErrorRate > 1 {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "errorRate must be between 0 and 1",
+			}
+		}
+	}
+	SetRules(req.Rules...)
+	reqctx.Logger(ctx).Warn("fault rules replaced", "rules", len(req.Rules))
+	return GetRules(ctx)
+}
+
+// ClearRules restores the configured rules.
+//
+//encore:api auth method=DELETE path=/admin/faults
+func ClearRules(ctx context.Context) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	Reset()
+	reqctx.Logger(ctx).Warn("fault rules reset")
+	return nil
+}
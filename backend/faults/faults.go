@@ -0,0 +1,145 @@
+// Package faults injects failures for resilience testing: added latency
+// and errors at the database, object storage and third-party provider
+// calls of chosen endpoints, so retries, dead-letter queues and graceful
+// degradation can be exercised by integration tests. It is off unless
+// Faults.Enabled is set in config, and never runs in production. Rules
+// come from config; tests replace them with SetRules, or over the admin
+// API (see admin.go) when testing a deployed environment.
+//
+// Call sites ask for their fault before doing the real work:
+//
+//	if err := faults.Inject(ctx, faults.Storage); err != nil {
+//		return err
+//	}
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev"
+	"encore.dev/config"
+)
+
+// Targets are the kinds of call a fault applies to
+const (
+	DB       = "db"
+	Storage  = "storage"
+	Provider = "provider" // third-party APIs, called through outbound
+)
+
+// ErrInjected is returned, wrapped, by every injected failure.
+var ErrInjected = errors.New("faults: injected failure")
+
+// Rule injects a fault into the calls to Target made while handling
+// Endpoint.
+type Rule struct {
+	// Endpoint is "service.Endpoint" for API calls and
+	// "service.subscription" for Pub/Sub handlers. "service.*" matches a
+	// whole service and empty matches everything.
+	Endpoint string `json:"endpoint"`
+	Target   string `json:"target"` // db, storage or provider
+	// LatencyMs is added before each matching call
+	LatencyMs int `json:"latencyMs"`
+	// ErrorRate is the fraction of matching calls that fail, 0 to 1
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// Config enables fault injection
+type Config struct {
+	Enabled bool   `json:"enabled"`
+	Rules   []Rule `json:"rules"`
+}
+
+var faultsCfg struct {
+	Faults Config
+}
+
+var _ = config.Load(context.Background(), &faultsCfg)
+
+var (
+	mu sync.RWMutex
+	// override replaces the configured rules while set (see SetRules)
+	override []Rule
+	hasRules bool
+)
+
+// SetRules replaces the configured rules, so one test can inject
+// different faults than the next. Enabled must still be set in config.
+func SetRules(rules ...Rule) {
+	mu.Lock()
+	override, hasRules = rules, true
+	mu.Unlock()
+}
+
+// Reset restores the configured rules.
+func Reset() {
+	mu.Lock()
+	override, hasRules = nil, false
+	mu.Unlock()
+}
+
+// Enabled reports whether faults may be injected in this environment.
+func Enabled() bool {
+	return faultsCfg.Faults.Enabled && encore.Meta().Environment.Type != encore.EnvProduction
+}
+
+// Inject applies the faults for target in the current endpoint: it waits
+// out any added latency, then fails with ErrInjected at the rule's rate.
+// It returns nil immediately when fault injection is disabled.
+func Inject(ctx context.Context, target string) error {
+	if !Enabled() {
+		return nil
+	}
+	name := endpointName()
+	for _, r := range rules() {
+		if r.Target != target || !matches(r.Endpoint, name) {
+			continue
+		}
+		if r.LatencyMs > 0 {
+			t := time.NewTimer(time.Duration(r.LatencyMs) * time.Millisecond)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+		if r.ErrorRate > 0 && rand.Float64() < r.ErrorRate {
+			return fmt.Errorf("%w: %s in %s", ErrInjected, target, name)
+		}
+	}
+	return nil
+}
+
+func rules() []Rule {
+	mu.RLock()
+	defer mu.RUnlock()
+	if hasRules {
+		return override
+	}
+	return faultsCfg.Faults.Rules
+}
+
+// endpointName names what the current request is handling, as rules
+// match it.
+func endpointName() string {
+	req := encore.CurrentRequest()
+	if req.Type == encore.PubSubMessage && req.Message != nil {
+		return req.Message.Service + "." + req.Message.Subscription
+	}
+	return req.Service + "." + req.Endpoint
+}
+
+func matches(pattern, name string) bool {
+	if pattern == "" || pattern == name {
+		return true
+	}
+	service, ok := strings.CutSuffix(pattern, ".*")
+	return ok && strings.HasPrefix(name, service+".")
+}
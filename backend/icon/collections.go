@@ -0,0 +1,258 @@
+package icon
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Icon collections are stored alongside the organizations they belong to.
+var db = sqldb.Named("project")
+
+const (
+	maxCollectionNameLength = 100
+	maxCollectionsPerOrg    = 100
+	maxIconsPerCollection   = 500
+)
+
+// IconCollection is a named list of an organization's favorite icons
+type IconCollection struct {
+	ID        string        `json:"id"`
+	OrgID     string        `json:"orgId"`
+	Name      string        `json:"name"`
+	CreatedBy string        `json:"createdBy,omitempty"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Icons     []IconSummary `json:"icons"`
+}
+
+// ListIconCollectionsResponse represents the list icon collections response
+type ListIconCollectionsResponse struct {
+	Collections []IconCollection `json:"collections"`
+}
+
+// CreateIconCollectionRequest represents the create icon collection request
+type CreateIconCollectionRequest struct {
+	Name string `json:"name"`
+}
+
+// ListIconCollections returns the organization's icon collections with
+// their icons, most recently added first.
+//
+//encore:api auth method=GET path=/orgs/:orgID/icon-collections
+func ListIconCollections(ctx context.Context, orgID string) (*ListIconCollectionsResponse, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member", "guest"); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.name, COALESCE(c.created_by::text, ''), c.created_at, i.icon_id
+		FROM icon_collections c
+		LEFT JOIN icon_collection_items i ON i.collection_id = c.id
+		WHERE c.org_id = $1
+		ORDER BY lower(c.name), c.id, i.added_at DESC
+	`, orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list icon collections", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list icon collections",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListIconCollectionsResponse{Collections: []IconCollection{}}
+	for rows.Next() {
+		var c IconCollection
+		var iconID sql.NullString
+		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedBy, &c.CreatedAt, &iconID); err != nil {
+			continue
+		}
+		if n := len(resp.Collections); n == 0 || resp.Collections[n-1].ID != c.ID {
+			c.OrgID = orgID
+			c.Icons = []IconSummary{}
+			resp.Collections = append(resp.Collections, c)
+		}
+		if iconID.Valid {
+			last := &resp.Collections[len(resp.Collections)-1]
+			prefix, name, _ := strings.Cut(iconID.String, ":")
+			last.Icons = append(last.Icons, summarize(prefix, name))
+		}
+	}
+	return resp, nil
+}
+
+// CreateIconCollection adds an icon collection to the organization.
+//
+//encore:api auth method=POST path=/orgs/:orgID/icon-collections
+func CreateIconCollection(ctx context.Context, orgID string, req *CreateIconCollectionRequest) (*IconCollection, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member"); err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len([]rune(name)) > maxCollectionNameLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name must be between 1 and 100 characters",
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM icon_collections WHERE org_id = $1`, orgID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count icon collections", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create icon collection",
+		}
+	}
+	if count >= maxCollectionsPerOrg {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "The organization has too many icon collections",
+		}
+	}
+
+	c := &IconCollection{OrgID: orgID, Name: name, CreatedBy: auth.UserID(), Icons: []IconSummary{}}
+	err := db.QueryRow(ctx, `
+		INSERT INTO icon_collections (org_id, name, created_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, lower(name)) DO NOTHING
+		RETURNING id, created_at
+	`, orgID, name, c.CreatedBy).Scan(&c.ID, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "A collection with this name already exists",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create icon collection", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create icon collection",
+		}
+	}
+	return c, nil
+}
+
+// DeleteIconCollection removes a collection. Members can delete the
+// collections they created; admins can delete any.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/icon-collections/:collectionID
+func DeleteIconCollection(ctx context.Context, orgID string, collectionID string) error {
+	role, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member")
+	if err != nil {
+		return err
+	}
+	createdBy, err := collectionCreator(ctx, orgID, collectionID)
+	if err != nil {
+		return err
+	}
+	if role != "admin" && createdBy != auth.UserID() {
+		return &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only the collection's creator or an admin can delete it",
+		}
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM icon_collections WHERE id = $1`, collectionID); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete icon collection", "collection_id", collectionID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete icon collection",
+		}
+	}
+	return nil
+}
+
+// AddCollectionIcon adds an icon from the library to a collection.
+//
+//encore:api auth method=PUT path=/orgs/:orgID/icon-collections/:collectionID/icons/:set/:name
+func AddCollectionIcon(ctx context.Context, orgID string, collectionID string, set string, name string) error {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member"); err != nil {
+		return err
+	}
+	if _, err := collectionCreator(ctx, orgID, collectionID); err != nil {
+		return err
+	}
+	if _, _, err := loadIcon(ctx, set, name); err != nil {
+		return iconError(ctx, set, name, err)
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM icon_collection_items WHERE collection_id = $1`, collectionID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count collection icons", "collection_id", collectionID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to add icon",
+		}
+	}
+	if count >= maxIconsPerCollection {
+		return &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "The collection is full",
+		}
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO icon_collection_items (collection_id, icon_id, added_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (collection_id, icon_id) DO NOTHING
+	`, collectionID, set+":"+name, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to add collection icon", "collection_id", collectionID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to add icon",
+		}
+	}
+	return nil
+}
+
+// RemoveCollectionIcon removes an icon from a collection.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/icon-collections/:collectionID/icons/:set/:name
+func RemoveCollectionIcon(ctx context.Context, orgID string, collectionID string, set string, name string) error {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member"); err != nil {
+		return err
+	}
+	if _, err := collectionCreator(ctx, orgID, collectionID); err != nil {
+		return err
+	}
+	_, err := db.Exec(ctx, `
+		DELETE FROM icon_collection_items WHERE collection_id = $1 AND icon_id = $2
+	`, collectionID, set+":"+name)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to remove collection icon", "collection_id", collectionID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to remove icon",
+		}
+	}
+	return nil
+}
+
+// collectionCreator returns who created a collection of the organization.
+func collectionCreator(ctx context.Context, orgID, collectionID string) (string, error) {
+	var createdBy string
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(created_by::text, '') FROM icon_collections WHERE id::text = $1 AND org_id = $2
+	`, collectionID, orgID).Scan(&createdBy)
+	if err == sql.ErrNoRows {
+		return "", &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Icon collection not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load icon collection", "collection_id", collectionID, "error", err)
+		return "", &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load icon collection",
+		}
+	}
+	return createdBy, nil
+}
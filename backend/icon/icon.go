@@ -0,0 +1,587 @@
+// Package icon offers editors a library of open icon sets, such as Material
+// Design Icons, Lucide and the free Font Awesome sets. Icons are searched
+// and fetched through an Iconify-compatible API and proxied so clients never
+// talk to it directly. Only sets published under an open license are
+// offered, and every set carries its license so designs can credit the
+// author where required. Fetched icons are normalized into canvas elements
+// (see svg.go), and organizations can keep collections of favorite icons
+// (see collections.go).
+package icon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+
+	"canvasai/outbound"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+	"canvasai/webpolicy"
+)
+
+// IconLibrary configures where icons come from and which sets are offered
+type IconLibrary struct {
+	// APIURL is the Iconify-compatible API icons are fetched from. Empty
+	// uses the public Iconify API.
+	APIURL string `json:"apiUrl"`
+	// Sets limits the library to these set prefixes, e.g. "mdi" or
+	// "fa6-solid". Empty offers every set under an open license.
+	Sets []string `json:"sets"`
+}
+
+var iconCfg struct {
+	IconLibrary IconLibrary
+}
+
+var _ = config.Load(context.Background(), &iconCfg)
+
+const (
+	defaultAPIURL = "https://api.iconify.design"
+
+	defaultSearchLimit = 64
+	maxSearchLimit     = 200
+	// minUpstreamLimit is the smallest page the Iconify search API returns
+	minUpstreamLimit = 32
+
+	maxSearchQueryLength = 100
+	setsCacheTTL         = time.Hour
+	iconCacheTTL         = 24 * time.Hour
+	maxCachedIcons       = 5000
+)
+
+// openLicenses are the SPDX licenses a set must be under to be offered,
+// mapped to whether designs using its icons must credit the author.
+var openLicenses = map[string]bool{
+	"Apache-2.0":   false,
+	"MIT":          false,
+	"ISC":          false,
+	"BSD-2-Clause": false,
+	"BSD-3-Clause": false,
+	"CC0-1.0":      false,
+	"Unlicense":    false,
+	"OFL-1.1":      false,
+	"MPL-2.0":      false,
+	"CC-BY-3.0":    true,
+	"CC-BY-4.0":    true,
+	"CC-BY-SA-3.0": true,
+	"CC-BY-SA-4.0": true,
+}
+
+// namePattern matches Iconify set prefixes and icon names.
+var namePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// iconifyClient talks to the icon API, which is the only host it may reach.
+var iconifyClient = outbound.NewClient(outbound.Policy{
+	Timeout:          10 * time.Second,
+	MaxResponseBytes: 5 << 20,
+	AllowedHosts:     []string{apiURL().Hostname()},
+	RateLimit:        ratelimit.Limit{Requests: 50, Per: time.Second},
+})
+
+// License describes the terms an icon set is published under
+type License struct {
+	Title string `json:"title"`
+	SPDX  string `json:"spdx"`
+	URL   string `json:"url,omitempty"`
+	// Attribution is set when designs using the icons must credit the
+	// set's author
+	Attribution bool `json:"attribution"`
+}
+
+// IconSet is a collection of icons by one author
+type IconSet struct {
+	Prefix    string  `json:"prefix"`
+	Name      string  `json:"name"`
+	Total     int     `json:"total"`
+	Author    string  `json:"author,omitempty"`
+	AuthorURL string  `json:"authorUrl,omitempty"`
+	License   License `json:"license"`
+	Category  string  `json:"category,omitempty"`
+	// Multicolor sets keep their own colors; the others take the color
+	// they are inserted with
+	Multicolor bool `json:"multicolor"`
+}
+
+// ListIconSetsResponse represents the list icon sets response
+type ListIconSetsResponse struct {
+	Sets []IconSet `json:"sets"`
+}
+
+// IconSummary is an icon in search results
+type IconSummary struct {
+	// ID is the icon's "prefix:name" identifier
+	ID   string `json:"id"`
+	Set  string `json:"set"`
+	Name string `json:"name"`
+	// PreviewURL serves the icon as SVG
+	PreviewURL string `json:"previewUrl"`
+}
+
+// SearchIconsRequest represents an icon search
+type SearchIconsRequest struct {
+	Query string `query:"q"`
+	// Set limits the search to one set prefix
+	Set    string `query:"set"`
+	Limit  int    `query:"limit"`
+	Offset int    `query:"offset"`
+}
+
+// SearchIconsResponse represents a page of matching icons
+type SearchIconsResponse struct {
+	Icons []IconSummary `json:"icons"`
+	// Sets describes the sets of the icons on the page, with their licenses
+	Sets   map[string]IconSet `json:"sets"`
+	Total  int                `json:"total"`
+	Limit  int                `json:"limit"`
+	Offset int                `json:"offset"`
+}
+
+// GetIconRequest represents the get icon request
+type GetIconRequest struct {
+	// Color replaces currentColor in the icon, as #rgb or #rrggbb.
+	// Defaults to black.
+	Color string `query:"color"`
+	// Size is the width of the canvas element in pixels (default 96)
+	Size int `query:"size"`
+}
+
+// Icon is an icon ready to be added to a canvas
+type Icon struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Set describes the icon's set, including its license
+	Set    IconSet `json:"set"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	SVG    string  `json:"svg"`
+	// Element is the icon as a canvas object: a path when the SVG is a
+	// single-color drawing, otherwise an image of the SVG
+	Element map[string]any `json:"element"`
+}
+
+var errIconNotFound = errors.New("icon not found")
+
+// ListIconSets returns the icon sets in the library.
+//
+//encore:api auth method=GET path=/icons/sets
+func ListIconSets(ctx context.Context) (*ListIconSetsResponse, error) {
+	sets, err := iconSets(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load icon sets", "error", err)
+		return nil, unavailable()
+	}
+	resp := &ListIconSetsResponse{Sets: make([]IconSet, 0, len(sets))}
+	for _, s := range sets {
+		resp.Sets = append(resp.Sets, s)
+	}
+	sort.Slice(resp.Sets, func(i, j int) bool { return resp.Sets[i].Name < resp.Sets[j].Name })
+	return resp, nil
+}
+
+// SearchIcons finds icons by name and tags.
+//
+//encore:api auth method=GET path=/icons/search
+func SearchIcons(ctx context.Context, req *SearchIconsRequest) (*SearchIconsResponse, error) {
+	q := strings.TrimSpace(req.Query)
+	if q == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "q is required",
+		}
+	}
+	if len(q) > maxSearchQueryLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Search query is too long",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxSearchLimit {
+		limit = defaultSearchLimit
+	}
+	offset := max(req.Offset, 0)
+
+	sets, err := iconSets(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load icon sets", "error", err)
+		return nil, unavailable()
+	}
+	var prefixes []string
+	if req.Set != "" {
+		if _, ok := sets[req.Set]; !ok {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Icon set not found",
+			}
+		}
+		prefixes = []string{req.Set}
+	} else {
+		for prefix := range sets {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+	}
+
+	params := url.Values{}
+	params.Set("query", q)
+	params.Set("limit", strconv.Itoa(max(limit, minUpstreamLimit)))
+	params.Set("start", strconv.Itoa(offset))
+	params.Set("prefixes", strings.Join(prefixes, ","))
+	var result struct {
+		Icons []string `json:"icons"`
+		Total int      `json:"total"`
+	}
+	if err := fetchJSON(ctx, "/search", params, &result); err != nil {
+		reqctx.Logger(ctx).Error("failed to search icons", "error", err)
+		return nil, unavailable()
+	}
+
+	resp := &SearchIconsResponse{
+		Icons:  []IconSummary{},
+		Sets:   map[string]IconSet{},
+		Total:  result.Total,
+		Limit:  limit,
+		Offset: offset,
+	}
+	for _, id := range result.Icons {
+		prefix, name, ok := strings.Cut(id, ":")
+		set, offered := sets[prefix]
+		if !ok || !offered {
+			continue
+		}
+		resp.Icons = append(resp.Icons, summarize(prefix, name))
+		resp.Sets[prefix] = set
+		if len(resp.Icons) == limit {
+			break
+		}
+	}
+	return resp, nil
+}
+
+// GetIcon returns an icon with its SVG and canvas element.
+//
+//encore:api auth method=GET path=/icons/:set/:name
+func GetIcon(ctx context.Context, set string, name string, req *GetIconRequest) (*Icon, error) {
+	color := strings.ToLower(req.Color)
+	if color == "" {
+		color = defaultColor
+	} else if !colorPattern.MatchString(color) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "color must be a hex color such as #1a73e8",
+		}
+	}
+	size := req.Size
+	if size == 0 {
+		size = defaultElementSize
+	} else if size < minElementSize || size > maxElementSize {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("size must be between %d and %d", minElementSize, maxElementSize),
+		}
+	}
+
+	info, data, err := loadIcon(ctx, set, name)
+	if err != nil {
+		return nil, iconError(ctx, set, name, err)
+	}
+	svg := data.svg()
+	return &Icon{
+		ID:      set + ":" + name,
+		Name:    name,
+		Set:     info,
+		Width:   data.Width,
+		Height:  data.Height,
+		SVG:     svg,
+		Element: canvasElement(set+":"+name, data, color, float64(size)),
+	}, nil
+}
+
+// IconSVG serves an icon as an SVG file for previews. Icons are public, so
+// it needs no credentials and can be used as an image source.
+//
+//encore:api public raw method=GET path=/icons/:set/:name/svg
+func IconSVG(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	set := encore.CurrentRequest().PathParams.Get("set")
+	name := encore.CurrentRequest().PathParams.Get("name")
+
+	_, data, err := loadIcon(ctx, set, name)
+	if errors.Is(err, errIconNotFound) {
+		http.Error(w, "icon not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load icon", "icon", set+":"+name, "error", err)
+		http.Error(w, "icon library unavailable", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	// The SVG comes from a third party; never let it run script.
+	webpolicy.UserContent(w)
+	w.Write([]byte(data.svg()))
+}
+
+func summarize(prefix, name string) IconSummary {
+	return IconSummary{
+		ID:         prefix + ":" + name,
+		Set:        prefix,
+		Name:       name,
+		PreviewURL: "/icons/" + prefix + "/" + name + "/svg",
+	}
+}
+
+func unavailable() error {
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "The icon library is unavailable, try again later",
+	}
+}
+
+func iconError(ctx context.Context, set, name string, err error) error {
+	if errors.Is(err, errIconNotFound) {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Icon not found",
+		}
+	}
+	reqctx.Logger(ctx).Error("failed to load icon", "icon", set+":"+name, "error", err)
+	return unavailable()
+}
+
+// iconifyInfo is a set as described by the Iconify API
+type iconifyInfo struct {
+	Name   string `json:"name"`
+	Total  int    `json:"total"`
+	Author struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	} `json:"author"`
+	License struct {
+		Title string `json:"title"`
+		SPDX  string `json:"spdx"`
+		URL   string `json:"url"`
+	} `json:"license"`
+	Category string `json:"category"`
+	Palette  bool   `json:"palette"`
+	Hidden   bool   `json:"hidden"`
+}
+
+var (
+	setsMu      sync.Mutex
+	cachedSets  map[string]IconSet
+	setsExpires time.Time
+)
+
+// iconSets returns the offered sets by prefix, cached for setsCacheTTL.
+func iconSets(ctx context.Context) (map[string]IconSet, error) {
+	setsMu.Lock()
+	sets, expires := cachedSets, setsExpires
+	setsMu.Unlock()
+	if sets != nil && time.Now().Before(expires) {
+		return sets, nil
+	}
+
+	params := url.Values{}
+	if len(iconCfg.IconLibrary.Sets) > 0 {
+		params.Set("prefixes", strings.Join(iconCfg.IconLibrary.Sets, ","))
+	}
+	var infos map[string]iconifyInfo
+	if err := fetchJSON(ctx, "/collections", params, &infos); err != nil {
+		if sets != nil {
+			// Serve the stale list rather than no library at all.
+			reqctx.Logger(ctx).Warn("failed to refresh icon sets", "error", err)
+			return sets, nil
+		}
+		return nil, err
+	}
+	sets = map[string]IconSet{}
+	for prefix, info := range infos {
+		attribution, open := openLicenses[info.License.SPDX]
+		if !open || info.Hidden || !namePattern.MatchString(prefix) {
+			continue
+		}
+		sets[prefix] = IconSet{
+			Prefix:    prefix,
+			Name:      info.Name,
+			Total:     info.Total,
+			Author:    info.Author.Name,
+			AuthorURL: info.Author.URL,
+			License: License{
+				Title:       info.License.Title,
+				SPDX:        info.License.SPDX,
+				URL:         info.License.URL,
+				Attribution: attribution,
+			},
+			Category:   info.Category,
+			Multicolor: info.Palette,
+		}
+	}
+
+	setsMu.Lock()
+	cachedSets, setsExpires = sets, time.Now().Add(setsCacheTTL)
+	setsMu.Unlock()
+	return sets, nil
+}
+
+type cachedIcon struct {
+	data    *iconData
+	expires time.Time
+}
+
+var (
+	iconsMu     sync.Mutex
+	cachedIcons = map[string]cachedIcon{}
+)
+
+// loadIcon returns an icon of an offered set, cached for iconCacheTTL.
+func loadIcon(ctx context.Context, set, name string) (IconSet, *iconData, error) {
+	if !namePattern.MatchString(set) || !namePattern.MatchString(name) {
+		return IconSet{}, nil, errIconNotFound
+	}
+	sets, err := iconSets(ctx)
+	if err != nil {
+		return IconSet{}, nil, err
+	}
+	info, ok := sets[set]
+	if !ok {
+		return IconSet{}, nil, errIconNotFound
+	}
+
+	id := set + ":" + name
+	iconsMu.Lock()
+	cached, ok := cachedIcons[id]
+	iconsMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return info, cached.data, nil
+	}
+
+	data, err := fetchIcon(ctx, set, name)
+	if err != nil {
+		return IconSet{}, nil, err
+	}
+	iconsMu.Lock()
+	if len(cachedIcons) >= maxCachedIcons {
+		cachedIcons = map[string]cachedIcon{}
+	}
+	cachedIcons[id] = cachedIcon{data: data, expires: time.Now().Add(iconCacheTTL)}
+	iconsMu.Unlock()
+	return info, data, nil
+}
+
+// iconifySet is the icon data format of the Iconify API. Dimensions left
+// out of an icon are inherited from the set.
+type iconifySet struct {
+	Icons map[string]struct {
+		Body   string   `json:"body"`
+		Left   *float64 `json:"left"`
+		Top    *float64 `json:"top"`
+		Width  *float64 `json:"width"`
+		Height *float64 `json:"height"`
+	} `json:"icons"`
+	Aliases map[string]struct {
+		Parent string `json:"parent"`
+		Rotate int    `json:"rotate"`
+		HFlip  bool   `json:"hFlip"`
+		VFlip  bool   `json:"vFlip"`
+	} `json:"aliases"`
+	Left   float64 `json:"left"`
+	Top    float64 `json:"top"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+func fetchIcon(ctx context.Context, set, name string) (*iconData, error) {
+	params := url.Values{}
+	params.Set("icons", name)
+	var result iconifySet
+	if err := fetchJSON(ctx, "/"+set+".json", params, &result); err != nil {
+		return nil, err
+	}
+
+	data := &iconData{Left: result.Left, Top: result.Top, Width: result.Width, Height: result.Height}
+	if data.Width == 0 {
+		data.Width = 16
+	}
+	if data.Height == 0 {
+		data.Height = 16
+	}
+	// An alias is another icon, possibly rotated or flipped. Aliases of
+	// aliases are resolved a few levels deep.
+	for i := 0; i < 4; i++ {
+		alias, ok := result.Aliases[name]
+		if !ok {
+			break
+		}
+		name = alias.Parent
+		data.Rotate = (data.Rotate + alias.Rotate) % 4
+		data.HFlip = data.HFlip != alias.HFlip
+		data.VFlip = data.VFlip != alias.VFlip
+	}
+	icon, ok := result.Icons[name]
+	if !ok || icon.Body == "" {
+		return nil, errIconNotFound
+	}
+	data.Body = icon.Body
+	if icon.Left != nil {
+		data.Left = *icon.Left
+	}
+	if icon.Top != nil {
+		data.Top = *icon.Top
+	}
+	if icon.Width != nil {
+		data.Width = *icon.Width
+	}
+	if icon.Height != nil {
+		data.Height = *icon.Height
+	}
+	return data, nil
+}
+
+// fetchJSON gets path from the icon API and decodes the response into v.
+func fetchJSON(ctx context.Context, path string, params url.Values, v any) error {
+	u := apiURL()
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := iconifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errIconNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("icon API returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func apiURL() *url.URL {
+	raw := iconCfg.IconLibrary.APIURL
+	if raw == "" {
+		raw = defaultAPIURL
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		u, _ = url.Parse(defaultAPIURL)
+	}
+	return u
+}
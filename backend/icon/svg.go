@@ -0,0 +1,381 @@
+package icon
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Icons arrive as SVG. Most are single-color drawings made of a few
+// shapes, which become one canvas path the editor can recolor, resize and
+// restyle like any other element. Anything the canvas cannot represent
+// faithfully as a path, such as several colors, transforms or gradients,
+// is inserted as an image of the SVG instead, which looks right but can
+// only be recolored through the currentColor substituted here.
+
+const (
+	defaultColor       = "#000000"
+	defaultElementSize = 96
+	minElementSize     = 8
+	maxElementSize     = 2048
+)
+
+var (
+	colorPattern  = regexp.MustCompile(`^#([0-9a-f]{3}|[0-9a-f]{6})$`)
+	numberPattern = regexp.MustCompile(`[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?`)
+)
+
+// iconData is an icon's SVG body and view box
+type iconData struct {
+	Body   string
+	Left   float64
+	Top    float64
+	Width  float64
+	Height float64
+	// Rotate is in quarter turns; flips mirror the icon in its view box
+	Rotate int
+	HFlip  bool
+	VFlip  bool
+}
+
+// svg returns the icon as a standalone SVG document.
+func (d *iconData) svg() string {
+	body := d.Body
+	var transforms []string
+	if d.Rotate != 0 {
+		transforms = append(transforms, "rotate("+fmtNum(float64(d.Rotate)*90)+" "+fmtNum(d.Left+d.Width/2)+" "+fmtNum(d.Top+d.Height/2)+")")
+	}
+	if d.HFlip {
+		transforms = append(transforms, "translate("+fmtNum(2*d.Left+d.Width)+" 0) scale(-1 1)")
+	}
+	if d.VFlip {
+		transforms = append(transforms, "translate(0 "+fmtNum(2*d.Top+d.Height)+") scale(1 -1)")
+	}
+	if len(transforms) > 0 {
+		body = `<g transform="` + strings.Join(transforms, " ") + `">` + body + `</g>`
+	}
+	return `<svg xmlns="http://www.w3.org/2000/svg" width="` + fmtNum(d.Width) + `" height="` + fmtNum(d.Height) +
+		`" viewBox="` + fmtNum(d.Left) + " " + fmtNum(d.Top) + " " + fmtNum(d.Width) + " " + fmtNum(d.Height) + `">` + body + `</svg>`
+}
+
+// canvasElement returns the icon as a canvas object size pixels wide,
+// drawn in color where it uses currentColor.
+func canvasElement(id string, d *iconData, color string, size float64) map[string]any {
+	svg := d.svg()
+	el, ok := pathElement(svg, color)
+	if ok {
+		// Fabric measures the path itself when it loads; the view box keeps
+		// the icon's padding until then.
+		el["pathOffset"] = map[string]any{"x": d.Left + d.Width/2, "y": d.Top + d.Height/2}
+	} else {
+		colored := strings.ReplaceAll(svg, "currentColor", color)
+		el = map[string]any{
+			"type": "image",
+			"src":  "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(colored)),
+		}
+	}
+	scale := size / d.Width
+	el["left"] = 0
+	el["top"] = 0
+	el["width"] = d.Width
+	el["height"] = d.Height
+	el["scaleX"] = scale
+	el["scaleY"] = scale
+	el["iconId"] = id
+	return el
+}
+
+// shapePaint is how a shape is filled and stroked
+type shapePaint struct {
+	fill, stroke, strokeWidth string
+	lineCap, lineJoin         string
+	fillRule                  string
+	opacity                   string
+}
+
+// inheritedAttrs are the presentation attributes groups pass on.
+var inheritedAttrs = map[string]bool{
+	"fill":            true,
+	"stroke":          true,
+	"stroke-width":    true,
+	"stroke-linecap":  true,
+	"stroke-linejoin": true,
+	"fill-rule":       true,
+}
+
+// ignoredAttrs don't affect how a shape is drawn on the canvas.
+var ignoredAttrs = map[string]bool{
+	"id":                true,
+	"xmlns":             true,
+	"width":             true,
+	"height":            true,
+	"viewBox":           true,
+	"clip-rule":         true,
+	"stroke-miterlimit": true,
+}
+
+// shapeAttrs are the geometry attributes of each supported shape.
+var shapeAttrs = map[string][]string{
+	"path":     {"d"},
+	"circle":   {"cx", "cy", "r"},
+	"ellipse":  {"cx", "cy", "rx", "ry"},
+	"rect":     {"x", "y", "width", "height", "rx", "ry"},
+	"line":     {"x1", "y1", "x2", "y2"},
+	"polygon":  {"points"},
+	"polyline": {"points"},
+}
+
+// pathElement converts an SVG drawn in a single paint into a Fabric.js path
+// object. It reports false for anything else.
+func pathElement(svg, color string) (map[string]any, bool) {
+	dec := xml.NewDecoder(strings.NewReader(svg))
+	stack := []shapePaint{{fill: "#000000", strokeWidth: "1"}}
+	skip := 0
+	var paint *shapePaint
+	var data []string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 || t.Name.Local == "title" || t.Name.Local == "desc" {
+				skip++
+				continue
+			}
+			p := stack[len(stack)-1]
+			p.opacity = ""
+			geometry := map[string]string{}
+			_, isShape := shapeAttrs[t.Name.Local]
+			if !isShape && t.Name.Local != "svg" && t.Name.Local != "g" {
+				return nil, false
+			}
+			for _, a := range t.Attr {
+				name := a.Name.Local
+				switch {
+				case isShape && contains(shapeAttrs[t.Name.Local], name):
+					geometry[name] = a.Value
+				case a.Name.Space != "" || ignoredAttrs[name]:
+				case inheritedAttrs[name]:
+					if !setPaint(&p, name, a.Value, color) {
+						return nil, false
+					}
+				case name == "opacity" && isShape:
+					p.opacity = a.Value
+				default:
+					// transform, style, class, mask, filter and the like
+					return nil, false
+				}
+			}
+			stack = append(stack, p)
+			if !isShape {
+				continue
+			}
+			d, ok := shapeData(t.Name.Local, geometry)
+			if !ok {
+				return nil, false
+			}
+			if paint != nil && *paint != p {
+				return nil, false
+			}
+			paint = &p
+			data = append(data, d)
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if paint == nil || (paint.fill == "" && paint.stroke == "") {
+		return nil, false
+	}
+
+	el := map[string]any{
+		"type":        "path",
+		"path":        strings.Join(data, " "),
+		"fill":        nullable(paint.fill),
+		"stroke":      nullable(paint.stroke),
+		"strokeWidth": 0.0,
+	}
+	if paint.stroke != "" {
+		width, err := strconv.ParseFloat(paint.strokeWidth, 64)
+		if err != nil {
+			return nil, false
+		}
+		el["strokeWidth"] = width
+		if paint.lineCap != "" {
+			el["strokeLineCap"] = paint.lineCap
+		}
+		if paint.lineJoin != "" {
+			el["strokeLineJoin"] = paint.lineJoin
+		}
+	}
+	if paint.fillRule != "" {
+		el["fillRule"] = paint.fillRule
+	}
+	if paint.opacity != "" {
+		opacity, err := strconv.ParseFloat(paint.opacity, 64)
+		if err != nil {
+			return nil, false
+		}
+		el["opacity"] = opacity
+	}
+	return el, true
+}
+
+// setPaint applies a presentation attribute and reports whether the canvas
+// supports its value.
+func setPaint(p *shapePaint, name, value, color string) bool {
+	value = strings.TrimSpace(value)
+	switch name {
+	case "fill", "stroke":
+		switch {
+		case value == "none":
+			value = ""
+		case value == "currentColor":
+			value = color
+		case strings.HasPrefix(value, "url("):
+			// Gradients and patterns
+			return false
+		}
+		if name == "fill" {
+			p.fill = value
+		} else {
+			p.stroke = value
+		}
+	case "stroke-width":
+		p.strokeWidth = value
+	case "stroke-linecap":
+		p.lineCap = value
+	case "stroke-linejoin":
+		p.lineJoin = value
+	case "fill-rule":
+		p.fillRule = value
+	}
+	return true
+}
+
+// shapeData returns the path data of a shape.
+func shapeData(kind string, attrs map[string]string) (string, bool) {
+	if kind == "path" {
+		d := strings.TrimSpace(attrs["d"])
+		return absoluteStart(d), d != ""
+	}
+	if kind == "polygon" || kind == "polyline" {
+		points := numberPattern.FindAllString(attrs["points"], -1)
+		if len(points) < 4 || len(points)%2 != 0 {
+			return "", false
+		}
+		d := "M" + points[0] + " " + points[1] + " L" + strings.Join(points[2:], " ")
+		if kind == "polygon" {
+			d += " Z"
+		}
+		return d, true
+	}
+
+	n := map[string]float64{}
+	for _, name := range shapeAttrs[kind] {
+		raw, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			// Percentages and other units are relative to the viewport
+			return "", false
+		}
+		n[name] = v
+	}
+	switch kind {
+	case "circle":
+		return ellipseData(n["cx"], n["cy"], n["r"], n["r"]), n["r"] > 0
+	case "ellipse":
+		return ellipseData(n["cx"], n["cy"], n["rx"], n["ry"]), n["rx"] > 0 && n["ry"] > 0
+	case "line":
+		return "M" + fmtNum(n["x1"]) + " " + fmtNum(n["y1"]) + " L" + fmtNum(n["x2"]) + " " + fmtNum(n["y2"]), true
+	case "rect":
+		return rectData(n, attrs)
+	}
+	return "", false
+}
+
+func ellipseData(cx, cy, rx, ry float64) string {
+	r := fmtNum(rx) + " " + fmtNum(ry)
+	return "M" + fmtNum(cx-rx) + " " + fmtNum(cy) +
+		" a" + r + " 0 1 0 " + fmtNum(2*rx) + " 0" +
+		" a" + r + " 0 1 0 " + fmtNum(-2*rx) + " 0 Z"
+}
+
+func rectData(n map[string]float64, attrs map[string]string) (string, bool) {
+	x, y, w, h := n["x"], n["y"], n["width"], n["height"]
+	if w <= 0 || h <= 0 {
+		return "", false
+	}
+	// A missing radius takes the other one's value
+	rx, ry := n["rx"], n["ry"]
+	if _, ok := attrs["rx"]; !ok {
+		rx = ry
+	}
+	if _, ok := attrs["ry"]; !ok {
+		ry = rx
+	}
+	rx, ry = min(rx, w/2), min(ry, h/2)
+	if rx <= 0 || ry <= 0 {
+		return "M" + fmtNum(x) + " " + fmtNum(y) + " h" + fmtNum(w) + " v" + fmtNum(h) + " h" + fmtNum(-w) + " Z", true
+	}
+	r := " a" + fmtNum(rx) + " " + fmtNum(ry) + " 0 0 1 "
+	return "M" + fmtNum(x+rx) + " " + fmtNum(y) +
+		" h" + fmtNum(w-2*rx) + r + fmtNum(rx) + " " + fmtNum(ry) +
+		" v" + fmtNum(h-2*ry) + r + fmtNum(-rx) + " " + fmtNum(ry) +
+		" h" + fmtNum(2*rx-w) + r + fmtNum(-rx) + " " + fmtNum(-ry) +
+		" v" + fmtNum(2*ry-h) + r + fmtNum(rx) + " " + fmtNum(-ry) + " Z", true
+}
+
+// absoluteStart makes a path that starts with a relative moveto start with
+// an absolute one. A leading "m" is absolute on its own, but not once the
+// path is appended to another.
+func absoluteStart(d string) string {
+	if !strings.HasPrefix(d, "m") {
+		return d
+	}
+	rest := d[1:]
+	loc := numberPattern.FindAllStringIndex(rest, 2)
+	if len(loc) < 2 {
+		return d
+	}
+	x, y := rest[loc[0][0]:loc[0][1]], rest[loc[1][0]:loc[1][1]]
+	rest = strings.TrimLeft(rest[loc[1][1]:], " ,\t\n")
+	if loc := numberPattern.FindStringIndex(rest); loc != nil && loc[0] == 0 {
+		// Further pairs are relative lineto commands
+		rest = "l" + rest
+	}
+	return "M" + x + " " + y + " " + rest
+}
+
+func nullable(color string) any {
+	if color == "" {
+		return nil
+	}
+	return color
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func fmtNum(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,328 @@
+package maps
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Provider API keys live in the MapProviderKeys secret and never leave the
+// server: the tile proxy adds them to upstream requests. The secret is a
+// JSON array of keys tried in order, so a new key can be rolled out by
+// adding it and the old one retired by removing it. What admins change at
+// runtime, disabling a key and reading its usage, is kept in the database.
+
+// providerKeyConfig is one entry of the MapProviderKeys secret
+type providerKeyConfig struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+	// DailyLimit caps the upstream requests made with the key per UTC day.
+	// Zero is unlimited.
+	DailyLimit int `json:"dailyLimit,omitempty"`
+}
+
+var (
+	keyringOnce sync.Once
+	keyring     []providerKeyConfig
+	keyringErr  error
+)
+
+// providerKeys returns the configured keys in the order they are tried.
+func providerKeys() ([]providerKeyConfig, error) {
+	keyringOnce.Do(func() {
+		if secrets.MapProviderKeys == "" {
+			return
+		}
+		if err := json.Unmarshal([]byte(secrets.MapProviderKeys), &keyring); err != nil {
+			keyringErr = fmt.Errorf("parse MapProviderKeys: %w", err)
+			return
+		}
+		seen := map[string]bool{}
+		for _, k := range keyring {
+			if k.ID == "" || k.Key == "" || seen[k.ID] {
+				keyringErr = errors.New("MapProviderKeys entries need a unique id and a key")
+				return
+			}
+			seen[k.ID] = true
+		}
+	})
+	return keyring, keyringErr
+}
+
+// keyStateTTL is how long the disabled keys and usage read from the
+// database are trusted before being read again.
+const keyStateTTL = time.Minute
+
+var (
+	keyStateMu     sync.Mutex
+	keyStateLoaded time.Time
+	keyStateDay    string
+	disabledKeys   = map[string]bool{}
+	keyUsage       = map[string]int{}
+)
+
+// usableKeys returns the keys that are neither disabled nor over their
+// daily limit, in the order they should be tried.
+func usableKeys(ctx context.Context) ([]providerKeyConfig, error) {
+	ring, err := providerKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(ring) == 0 {
+		return nil, nil
+	}
+
+	keyStateMu.Lock()
+	defer keyStateMu.Unlock()
+	today := time.Now().UTC().Format(time.DateOnly)
+	if time.Since(keyStateLoaded) > keyStateTTL || keyStateDay != today {
+		if err := loadKeyState(ctx, today); err != nil {
+			return nil, err
+		}
+	}
+
+	var usable []providerKeyConfig
+	for _, k := range ring {
+		if disabledKeys[k.ID] || (k.DailyLimit > 0 && keyUsage[k.ID] >= k.DailyLimit) {
+			continue
+		}
+		usable = append(usable, k)
+	}
+	return usable, nil
+}
+
+// loadKeyState reads disabled keys and today's usage. keyStateMu must be
+// held.
+func loadKeyState(ctx context.Context, today string) error {
+	disabled := map[string]bool{}
+	rows, err := db.Query(ctx, `SELECT key_id FROM map_api_keys WHERE disabled_at IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			disabled[id] = true
+		}
+	}
+	rows.Close()
+
+	usage := map[string]int{}
+	rows, err = db.Query(ctx, `SELECT key_id, requests FROM map_api_key_usage WHERE day = $1`, today)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err == nil {
+			usage[id] = n
+		}
+	}
+	rows.Close()
+
+	disabledKeys, keyUsage, keyStateLoaded, keyStateDay = disabled, usage, time.Now(), today
+	return nil
+}
+
+// recordKeyUse counts an upstream request made with a key, and a failure
+// when the provider rejected the key.
+func recordKeyUse(ctx context.Context, keyID string, failure error) {
+	keyStateMu.Lock()
+	keyUsage[keyID]++
+	keyStateMu.Unlock()
+
+	failed := 0
+	if failure != nil {
+		failed = 1
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO map_api_key_usage (key_id, day, requests, failures)
+		VALUES ($1, (NOW() AT TIME ZONE 'UTC')::date, 1, $2)
+		ON CONFLICT (key_id, day) DO UPDATE SET
+			requests = map_api_key_usage.requests + 1,
+			failures = map_api_key_usage.failures + EXCLUDED.failures
+	`, keyID, failed)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to record map key usage", "key_id", keyID, "error", err)
+	}
+	if failure != nil {
+		_, err = db.Exec(ctx, `
+			INSERT INTO map_api_keys (key_id, last_error, last_error_at)
+			VALUES ($1, $2, NOW())
+			ON CONFLICT (key_id) DO UPDATE SET last_error = EXCLUDED.last_error, last_error_at = NOW()
+		`, keyID, failure.Error())
+		if err != nil {
+			reqctx.Logger(ctx).Warn("failed to record map key error", "key_id", keyID, "error", err)
+		}
+	}
+}
+
+// ProviderKey describes a configured provider API key. The key itself is
+// never returned.
+type ProviderKey struct {
+	ID string `json:"id"`
+	// Hint is the key's last four characters
+	Hint          string     `json:"hint"`
+	DailyLimit    int        `json:"dailyLimit,omitempty"`
+	RequestsToday int        `json:"requestsToday"`
+	FailuresToday int        `json:"failuresToday"`
+	Disabled      bool       `json:"disabled"`
+	DisabledAt    *time.Time `json:"disabledAt,omitempty"`
+	DisabledBy    *string    `json:"disabledBy,omitempty"`
+	DisableReason string     `json:"disableReason,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorAt   *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// ListProviderKeysResponse represents the list provider keys response
+type ListProviderKeysResponse struct {
+	Keys []ProviderKey `json:"keys"`
+}
+
+// DisableProviderKeyRequest represents the disable provider key request
+type DisableProviderKeyRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// ListProviderKeys shows the configured provider keys in the order they
+// are tried, with today's usage.
+//
+//encore:api auth method=GET path=/admin/maps/keys
+func ListProviderKeys(ctx context.Context) (*ListProviderKeysResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	ring, err := providerKeys()
+	if err != nil {
+		reqctx.Logger(ctx).Error("invalid map provider keys", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Map provider keys are misconfigured",
+		}
+	}
+
+	resp := &ListProviderKeysResponse{Keys: []ProviderKey{}}
+	for _, k := range ring {
+		pk := ProviderKey{ID: k.ID, Hint: keyHint(k.Key), DailyLimit: k.DailyLimit}
+		var reason, lastError sql.NullString
+		err := db.QueryRow(ctx, `
+			SELECT k.disabled_at, k.disabled_by, k.disabled_reason, k.last_error, k.last_error_at,
+				COALESCE(u.requests, 0), COALESCE(u.failures, 0)
+			FROM (SELECT $1::text AS key_id) q
+			LEFT JOIN map_api_keys k ON k.key_id = q.key_id
+			LEFT JOIN map_api_key_usage u ON u.key_id = q.key_id AND u.day = (NOW() AT TIME ZONE 'UTC')::date
+		`, k.ID).Scan(&pk.DisabledAt, &pk.DisabledBy, &reason, &lastError, &pk.LastErrorAt, &pk.RequestsToday, &pk.FailuresToday)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to load map key state", "key_id", k.ID, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to list keys",
+			}
+		}
+		pk.Disabled = pk.DisabledAt != nil
+		pk.DisableReason, pk.LastError = reason.String, lastError.String
+		resp.Keys = append(resp.Keys, pk)
+	}
+	return resp, nil
+}
+
+// DisableProviderKey stops a key from being used, e.g. while it is being
+// rotated out or after the provider flagged it.
+//
+//encore:api auth method=POST path=/admin/maps/keys/:id/disable
+func DisableProviderKey(ctx context.Context, id string, req *DisableProviderKeyRequest) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	if err := requireKey(id); err != nil {
+		return err
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if len([]rune(reason)) > 500 {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Reason must be at most 500 characters",
+		}
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO map_api_keys (key_id, disabled_at, disabled_by, disabled_reason)
+		VALUES ($1, NOW(), $2, NULLIF($3, ''))
+		ON CONFLICT (key_id) DO UPDATE SET
+			disabled_at = NOW(), disabled_by = EXCLUDED.disabled_by, disabled_reason = EXCLUDED.disabled_reason
+	`, id, auth.UserID(), reason)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to disable map key", "key_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to disable key",
+		}
+	}
+	forgetKeyState()
+	reqctx.Logger(ctx).Info("map provider key disabled", "key_id", id)
+	return nil
+}
+
+// EnableProviderKey puts a disabled key back into use.
+//
+//encore:api auth method=POST path=/admin/maps/keys/:id/enable
+func EnableProviderKey(ctx context.Context, id string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	if err := requireKey(id); err != nil {
+		return err
+	}
+	_, err := db.Exec(ctx, `
+		UPDATE map_api_keys SET disabled_at = NULL, disabled_by = NULL, disabled_reason = NULL WHERE key_id = $1
+	`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to enable map key", "key_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to enable key",
+		}
+	}
+	forgetKeyState()
+	reqctx.Logger(ctx).Info("map provider key enabled", "key_id", id)
+	return nil
+}
+
+// forgetKeyState makes the next request read key state from the database.
+// Other instances pick up the change within keyStateTTL.
+func forgetKeyState() {
+	keyStateMu.Lock()
+	keyStateLoaded = time.Time{}
+	keyStateMu.Unlock()
+}
+
+func requireKey(id string) error {
+	ring, _ := providerKeys()
+	for _, k := range ring {
+		if k.ID == id {
+			return nil
+		}
+	}
+	return &errs.Error{
+		Code:    errs.NotFound,
+		Message: "Key not found",
+	}
+}
+
+func keyHint(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return "…" + key[len(key)-4:]
+}
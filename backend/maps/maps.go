@@ -0,0 +1,492 @@
+// Package maps lets editors drop location maps onto canvases. It proxies
+// map tiles from a configured XYZ tile provider, so the provider's API
+// keys stay on the server (see keys.go) and tiles are cached, and renders
+// static map snapshots from those tiles (see tiles.go). A snapshot is
+// stored as a project asset, so exports draw it like any other image.
+package maps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/outbound"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// MapTiles configures the tile provider maps are drawn from
+type MapTiles struct {
+	// TileURL is the provider's tile template, with {style}, {z}, {x}, {y}
+	// and, for providers that need one, {key} placeholders. Empty uses
+	// OpenStreetMap's standard tiles.
+	TileURL string `json:"tileUrl"`
+	// Styles are the provider's map styles; the first is the default
+	Styles []string `json:"styles"`
+	// Attribution is the credit the provider requires on every map
+	Attribution string `json:"attribution"`
+	MaxZoom     int    `json:"maxZoom"`
+}
+
+var mapsCfg struct {
+	MapTiles MapTiles
+}
+
+var _ = config.Load(context.Background(), &mapsCfg)
+
+var secrets struct {
+	MapProviderKeys string // JSON keyring of provider API keys, see keys.go
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+// Key state and usage are stored alongside the projects maps are used in.
+var db = sqldb.Named("project")
+
+const (
+	defaultTileURL     = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+	defaultAttribution = "© OpenStreetMap contributors"
+	defaultStyle       = "standard"
+	defaultMaxZoom     = 19
+
+	minMapSize = 64
+	// maxMapPixels bounds each side of a rendered map, after scaling
+	maxMapPixels = 2048
+
+	maxCachedMaps = 200
+)
+
+// tileClient fetches tiles from the provider, which is the only host it
+// may reach.
+var tileClient = outbound.NewClient(outbound.Policy{
+	Timeout:          10 * time.Second,
+	MaxResponseBytes: 2 << 20,
+	AllowedHosts:     []string{tileHost()},
+	RateLimit:        ratelimit.Limit{Requests: 100, Per: time.Second},
+})
+
+var (
+	tileLimiter = ratelimit.New(ratelimit.Limit{Requests: 600, Per: time.Minute})
+	mapLimiter  = ratelimit.New(ratelimit.Limit{Requests: 30, Per: time.Minute})
+)
+
+var (
+	errNoProviderKey = errors.New("maps: no usable provider key")
+	errKeyRejected   = errors.New("maps: provider rejected the key")
+)
+
+// MapStylesResponse describes the maps editors can use
+type MapStylesResponse struct {
+	Styles      []string `json:"styles"`
+	Attribution string   `json:"attribution"`
+	MaxZoom     int      `json:"maxZoom"`
+	// TileURL is the proxied tile template for interactive map pickers
+	TileURL string `json:"tileUrl"`
+}
+
+// MapSnapshotRequest represents the map snapshot request
+type MapSnapshotRequest struct {
+	View
+}
+
+// MapSnapshotResponse carries the stored snapshot and the canvas element
+// that shows it
+type MapSnapshotResponse struct {
+	AssetID string         `json:"assetId"`
+	Element map[string]any `json:"element"`
+}
+
+//encore:api auth method=GET path=/maps/styles
+func ListMapStyles(ctx context.Context) (*MapStylesResponse, error) {
+	return &MapStylesResponse{
+		Styles:      styles(),
+		Attribution: attribution(),
+		MaxZoom:     maxZoom(),
+		TileURL:     "/maps/tiles/{style}/{z}/{x}/{y}",
+	}, nil
+}
+
+// Tile serves one map tile for interactive map pickers.
+//
+//encore:api auth raw method=GET path=/maps/tiles/:style/:z/:x/:y
+func Tile(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	params := encore.CurrentRequest().PathParams
+	k := tileKey{style: params.Get("style")}
+	var errZ, errX, errY error
+	k.z, errZ = strconv.Atoi(params.Get("z"))
+	k.x, errX = strconv.Atoi(params.Get("x"))
+	k.y, errY = strconv.Atoi(strings.TrimSuffix(params.Get("y"), ".png"))
+	if errZ != nil || errX != nil || errY != nil || !validStyle(k.style) ||
+		k.z < 0 || k.z > maxZoom() || k.x < 0 || k.x >= 1<<k.z || k.y < 0 || k.y >= 1<<k.z {
+		http.Error(w, "invalid tile", http.StatusBadRequest)
+		return
+	}
+	if !tileLimiter.Allow(auth.UserID()) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	t, err := loadTile(ctx, k)
+	if err != nil {
+		writeTileError(ctx, w, k, err)
+		return
+	}
+	w.Header().Set("Content-Type", t.mimeType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(t.data)
+}
+
+// StaticMap renders a map preview as a PNG, with the view given as query
+// parameters. Nothing is stored; use CreateMapSnapshot to add the map to a
+// canvas.
+//
+//encore:api auth raw method=GET path=/maps/static
+func StaticMap(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	q := req.URL.Query()
+	v := View{Style: q.Get("style"), Marker: q.Get("marker") == "true"}
+	var err error
+	parse := func(name string, dst any) {
+		if err != nil {
+			return
+		}
+		switch d := dst.(type) {
+		case *float64:
+			*d, err = strconv.ParseFloat(q.Get(name), 64)
+		case *int:
+			if s := q.Get(name); s != "" {
+				*d, err = strconv.Atoi(s)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%s must be a number", name)
+		}
+	}
+	parse("lat", &v.Lat)
+	parse("lon", &v.Lon)
+	parse("zoom", &v.Zoom)
+	parse("width", &v.Width)
+	parse("height", &v.Height)
+	parse("scale", &v.Scale)
+	if err == nil {
+		err = validateView(&v)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !mapLimiter.Allow(auth.UserID()) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	data, err := renderPNG(ctx, v)
+	if err != nil {
+		writeTileError(ctx, w, tileKey{style: v.Style, z: v.Zoom}, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(data)
+}
+
+// CreateMapSnapshot renders a map and stores it as an asset of the
+// project. The returned element shows it with the provider's attribution
+// and keeps the view, so editors can re-center the map and snapshot it
+// again.
+//
+//encore:api auth method=POST path=/projects/:id/maps
+func CreateMapSnapshot(ctx context.Context, id string, req *MapSnapshotRequest) (*MapSnapshotResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	v := req.View
+	if err := validateView(&v); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: err.Error(),
+		}
+	}
+	userID := auth.UserID()
+	if !mapLimiter.Allow(userID) {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "Too many map requests, try again shortly",
+		}
+	}
+
+	data, err := renderPNG(ctx, v)
+	if err != nil {
+		return nil, mapError(ctx, err)
+	}
+	width, height := v.Width*v.Scale, v.Height*v.Scale
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:    userID,
+		ProjectID: id,
+		Filename:  "map.png",
+		MimeType:  "image/png",
+		Data:      data,
+		Width:     &width,
+		Height:    &height,
+		AltText:   fmt.Sprintf("Map of %.5f, %.5f", v.Lat, v.Lon),
+		Dedupe:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MapSnapshotResponse{AssetID: stored.ID, Element: mapElement(stored.ID, v)}, nil
+}
+
+// mapElement returns a group of the snapshot image and, when the provider
+// requires one, an attribution line in its bottom right corner. Group
+// children are positioned from the group's center.
+func mapElement(assetID string, v View) map[string]any {
+	w, h := float64(v.Width), float64(v.Height)
+	scale := float64(v.Scale)
+	objects := []any{map[string]any{
+		"type":   "image",
+		"src":    canvasrefs.AssetURL(assetID),
+		"left":   -w / 2,
+		"top":    -h / 2,
+		"width":  w * scale,
+		"height": h * scale,
+		"scaleX": 1 / scale,
+		"scaleY": 1 / scale,
+	}}
+	if credit := attribution(); credit != "" {
+		objects = append(objects, map[string]any{
+			"type":            "textbox",
+			"text":            credit,
+			"left":            -w/2 + 4,
+			"top":             h/2 - 16,
+			"width":           w - 8,
+			"height":          12,
+			"fontSize":        10,
+			"textAlign":       "right",
+			"fill":            "#333333",
+			"backgroundColor": "rgba(255,255,255,0.7)",
+		})
+	}
+	return map[string]any{
+		"type":    "group",
+		"left":    0,
+		"top":     0,
+		"width":   w,
+		"height":  h,
+		"objects": objects,
+		"map": map[string]any{
+			"lat":    v.Lat,
+			"lon":    v.Lon,
+			"zoom":   v.Zoom,
+			"style":  v.Style,
+			"scale":  v.Scale,
+			"marker": v.Marker,
+		},
+	}
+}
+
+// validateView fills in defaults and checks the view is one we render.
+func validateView(v *View) error {
+	if v.Style == "" {
+		v.Style = styles()[0]
+	}
+	if v.Scale == 0 {
+		v.Scale = 1
+	}
+	switch {
+	case !validStyle(v.Style):
+		return errors.New("unknown map style")
+	case v.Lat < -90 || v.Lat > 90 || v.Lon < -180 || v.Lon > 180:
+		return errors.New("lat must be between -90 and 90 and lon between -180 and 180")
+	case v.Zoom < 0 || v.Zoom > maxZoom():
+		return fmt.Errorf("zoom must be between 0 and %d", maxZoom())
+	case v.Scale != 1 && v.Scale != 2:
+		return errors.New("scale must be 1 or 2")
+	case v.Width < minMapSize || v.Height < minMapSize:
+		return fmt.Errorf("width and height must be at least %d", minMapSize)
+	case v.Width*v.Scale > maxMapPixels || v.Height*v.Scale > maxMapPixels:
+		return fmt.Errorf("width and height times scale must be at most %d", maxMapPixels)
+	}
+	// There are no tiles past the provider's deepest zoom to draw a sharper
+	// map from.
+	if v.Zoom+v.Scale-1 > maxZoom() {
+		v.Scale = 1
+	}
+	return nil
+}
+
+var (
+	mapMu    sync.Mutex
+	mapCache = map[View][]byte{}
+)
+
+// renderPNG renders a view as a PNG, reusing recent renders of the same
+// view.
+func renderPNG(ctx context.Context, v View) ([]byte, error) {
+	mapMu.Lock()
+	data, ok := mapCache[v]
+	mapMu.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	img, err := renderMap(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = encodePNG(img); err != nil {
+		return nil, err
+	}
+	mapMu.Lock()
+	if len(mapCache) >= maxCachedMaps {
+		mapCache = map[View][]byte{}
+	}
+	mapCache[v] = data
+	mapMu.Unlock()
+	return data, nil
+}
+
+// fetchTile downloads a tile from the provider, trying the provider keys
+// in order until one is accepted.
+func fetchTile(ctx context.Context, k tileKey) ([]byte, string, error) {
+	template := tileTemplate()
+	if !strings.Contains(template, "{key}") {
+		return getTile(ctx, tileURL(template, k, ""))
+	}
+	keys, err := usableKeys(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, key := range keys {
+		data, mimeType, err := getTile(ctx, tileURL(template, k, key.Key))
+		if errors.Is(err, errKeyRejected) {
+			reqctx.Logger(ctx).Warn("map provider rejected key", "key_id", key.ID, "error", err)
+			recordKeyUse(ctx, key.ID, err)
+			continue
+		}
+		recordKeyUse(ctx, key.ID, nil)
+		return data, mimeType, err
+	}
+	return nil, "", errNoProviderKey
+}
+
+func getTile(ctx context.Context, rawURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "CanvasAI/1.0 (+map snapshots)")
+	resp, err := tileClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusNoContent:
+		return nil, "", errTileNotFound
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return nil, "", fmt.Errorf("%w: status %d", errKeyRejected, resp.StatusCode)
+	default:
+		return nil, "", fmt.Errorf("maps: tile provider returned status %d", resp.StatusCode)
+	}
+	mimeType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if mimeType != "image/png" && mimeType != "image/jpeg" {
+		return nil, "", fmt.Errorf("maps: unsupported tile type %q", mimeType)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mimeType, nil
+}
+
+func writeTileError(ctx context.Context, w http.ResponseWriter, k tileKey, err error) {
+	switch {
+	case errors.Is(err, errTileNotFound):
+		http.Error(w, "tile not found", http.StatusNotFound)
+	case errors.Is(err, errNoProviderKey):
+		reqctx.Logger(ctx).Error("no usable map provider key", "tile", k.String())
+		http.Error(w, "maps are unavailable", http.StatusServiceUnavailable)
+	default:
+		reqctx.Logger(ctx).Error("failed to load map tile", "tile", k.String(), "error", err)
+		http.Error(w, "failed to load map", http.StatusBadGateway)
+	}
+}
+
+func mapError(ctx context.Context, err error) error {
+	if errors.Is(err, errNoProviderKey) {
+		reqctx.Logger(ctx).Error("no usable map provider key")
+	} else {
+		reqctx.Logger(ctx).Error("failed to render map", "error", err)
+	}
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "Maps are unavailable right now",
+	}
+}
+
+func tileTemplate() string {
+	if t := mapsCfg.MapTiles.TileURL; t != "" {
+		return t
+	}
+	return defaultTileURL
+}
+
+// tileHost returns the host of the tile template.
+func tileHost() string {
+	u, err := url.Parse(tileURL(tileTemplate(), tileKey{style: defaultStyle}, ""))
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func styles() []string {
+	if s := mapsCfg.MapTiles.Styles; len(s) > 0 {
+		return s
+	}
+	return []string{defaultStyle}
+}
+
+func validStyle(style string) bool {
+	for _, s := range styles() {
+		if s == style {
+			return true
+		}
+	}
+	return false
+}
+
+func attribution() string {
+	if mapsCfg.MapTiles.TileURL == "" {
+		return defaultAttribution
+	}
+	return mapsCfg.MapTiles.Attribution
+}
+
+func maxZoom() int {
+	if z := mapsCfg.MapTiles.MaxZoom; z > 0 {
+		return min(z, 22)
+	}
+	return defaultMaxZoom
+}
@@ -0,0 +1,232 @@
+package maps
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maps are drawn from XYZ tiles in the Web Mercator projection: at zoom z
+// the world is a square of 2^z × 2^z tiles of tileSize pixels.
+
+const (
+	tileSize = 256
+	// maxLatitude is where Web Mercator tiles end
+	maxLatitude = 85.05112878
+
+	tileCacheTTL    = 24 * time.Hour
+	maxCachedTiles  = 2000
+	tileConcurrency = 8
+)
+
+// errTileNotFound is returned for tiles the provider does not have, such
+// as open ocean on some styles. They are drawn blank.
+var errTileNotFound = errors.New("maps: tile not found")
+
+// tileKey identifies a tile of a style
+type tileKey struct {
+	style   string
+	z, x, y int
+}
+
+func (k tileKey) String() string {
+	return fmt.Sprintf("%s/%d/%d/%d", k.style, k.z, k.x, k.y)
+}
+
+type cachedTile struct {
+	data      []byte
+	mimeType  string
+	fetchedAt time.Time
+}
+
+var (
+	tileMu    sync.Mutex
+	tileCache = map[tileKey]*cachedTile{}
+)
+
+// loadTile returns a tile's encoded image, from the cache when it is fresh.
+func loadTile(ctx context.Context, k tileKey) (*cachedTile, error) {
+	tileMu.Lock()
+	t, ok := tileCache[k]
+	tileMu.Unlock()
+	if ok && time.Since(t.fetchedAt) < tileCacheTTL {
+		return t, nil
+	}
+
+	data, mimeType, err := fetchTile(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	t = &cachedTile{data: data, mimeType: mimeType, fetchedAt: time.Now()}
+	tileMu.Lock()
+	if len(tileCache) >= maxCachedTiles {
+		tileCache = map[tileKey]*cachedTile{}
+	}
+	tileCache[k] = t
+	tileMu.Unlock()
+	return t, nil
+}
+
+// View is the part of the world a map shows
+type View struct {
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+	Zoom int     `json:"zoom"`
+	// Width and Height are the map's size in canvas pixels
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Style  string `json:"style"`
+	// Scale renders at twice the pixel density for sharp prints
+	Scale int `json:"scale"`
+	// Marker pins the center of the map
+	Marker bool `json:"marker"`
+}
+
+// worldPixel returns the position of a coordinate in pixels at zoom z.
+func worldPixel(lat, lon float64, z int) (float64, float64) {
+	lat = math.Max(-maxLatitude, math.Min(maxLatitude, lat))
+	size := float64(tileSize) * math.Exp2(float64(z))
+	x := (lon + 180) / 360 * size
+	sin := math.Sin(lat * math.Pi / 180)
+	y := (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * size
+	return x, y
+}
+
+// renderMap composes the tiles under v into one image of Width×Height
+// times Scale pixels. Tiles wrap around the antimeridian; beyond the poles
+// the map is left blank.
+func renderMap(ctx context.Context, v View) (*image.NRGBA, error) {
+	z := v.Zoom + v.Scale - 1
+	w, h := v.Width*v.Scale, v.Height*v.Scale
+	cx, cy := worldPixel(v.Lat, v.Lon, z)
+	x0, y0 := int(math.Round(cx))-w/2, int(math.Round(cy))-h/2
+	n := 1 << z
+
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(out, out.Bounds(), image.NewUniform(blankColor), image.Point{}, draw.Src)
+
+	type placed struct {
+		key    tileKey
+		dx, dy int
+	}
+	var tiles []placed
+	for ty := floorDiv(y0, tileSize); ty <= floorDiv(y0+h-1, tileSize); ty++ {
+		if ty < 0 || ty >= n {
+			continue
+		}
+		for tx := floorDiv(x0, tileSize); tx <= floorDiv(x0+w-1, tileSize); tx++ {
+			key := tileKey{style: v.Style, z: z, x: ((tx % n) + n) % n, y: ty}
+			tiles = append(tiles, placed{key: key, dx: tx*tileSize - x0, dy: ty*tileSize - y0})
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, tileConcurrency)
+	)
+	for _, p := range tiles {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p placed) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			img, err := decodeTile(ctx, p.key)
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, errTileNotFound) {
+				return
+			} else if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			r := image.Rect(p.dx, p.dy, p.dx+tileSize, p.dy+tileSize)
+			draw.Draw(out, r, img, img.Bounds().Min, draw.Src)
+		}(p)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if v.Marker {
+		drawMarker(out, w/2, h/2, 6*v.Scale)
+	}
+	return out, nil
+}
+
+func decodeTile(ctx context.Context, k tileKey) (image.Image, error) {
+	t, err := loadTile(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(t.data))
+	if err != nil {
+		return nil, fmt.Errorf("maps: decode tile %s: %w", k, err)
+	}
+	return img, nil
+}
+
+var (
+	blankColor  = color.NRGBA{R: 0xe5, G: 0xe3, B: 0xdf, A: 0xff}
+	markerColor = color.NRGBA{R: 0xd9, G: 0x30, B: 0x25, A: 0xff}
+)
+
+// drawMarker draws a pin head: a red dot with a white ring.
+func drawMarker(img *image.NRGBA, cx, cy, r int) {
+	ring := r + max(r/3, 2)
+	for y := cy - ring; y <= cy+ring; y++ {
+		for x := cx - ring; x <= cx+ring; x++ {
+			d := (x-cx)*(x-cx) + (y-cy)*(y-cy)
+			switch {
+			case d <= r*r:
+				img.SetNRGBA(x, y, markerColor)
+			case d <= ring*ring:
+				img.SetNRGBA(x, y, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+			}
+		}
+	}
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// floorDiv divides rounding towards negative infinity.
+func floorDiv(a, b int) int {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// tileURL fills in the provider's tile template.
+func tileURL(template string, k tileKey, key string) string {
+	return strings.NewReplacer(
+		"{style}", k.style,
+		"{z}", strconv.Itoa(k.z),
+		"{x}", strconv.Itoa(k.x),
+		"{y}", strconv.Itoa(k.y),
+		"{key}", url.QueryEscape(key),
+	).Replace(template)
+}
@@ -0,0 +1,49 @@
+-- Create organizations (workspaces) table
+CREATE TABLE organizations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    slug VARCHAR(255) UNIQUE NOT NULL,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create organization members table
+CREATE TABLE organization_members (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(50) NOT NULL DEFAULT 'member', -- admin, member, guest
+    provisioned_by VARCHAR(50), -- NULL for manual invites, 'saml' for JIT provisioning
+    joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(org_id, user_id)
+);
+
+-- Create SAML SSO configuration table (one IdP per organization)
+CREATE TABLE saml_configs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL UNIQUE REFERENCES organizations(id) ON DELETE CASCADE,
+    domain VARCHAR(255) UNIQUE NOT NULL, -- Email domain routed to this IdP
+    idp_entity_id TEXT NOT NULL,
+    idp_metadata_xml TEXT NOT NULL,
+    attribute_mapping JSONB NOT NULL DEFAULT '{}',
+    enabled BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create indexes for better performance
+CREATE INDEX idx_organization_members_org_id ON organization_members(org_id);
+CREATE INDEX idx_organization_members_user_id ON organization_members(user_id);
+CREATE INDEX idx_saml_configs_domain ON saml_configs(lower(domain));
+
+-- Create triggers for updated_at timestamps
+CREATE TRIGGER update_organizations_updated_at 
+    BEFORE UPDATE ON organizations 
+    FOR EACH ROW 
+    EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TRIGGER update_saml_configs_updated_at 
+    BEFORE UPDATE ON saml_configs 
+    FOR EACH ROW 
+    EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,2 @@
+-- Track who saved the current revision so conflicting editors can be notified
+ALTER TABLE projects ADD COLUMN last_saved_by UUID REFERENCES users(id) ON DELETE SET NULL;
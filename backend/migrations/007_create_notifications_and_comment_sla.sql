@@ -0,0 +1,47 @@
+-- Associate projects with the workspace they belong to (NULL for personal projects)
+ALTER TABLE projects ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
+CREATE INDEX idx_projects_org_id ON projects(org_id) WHERE org_id IS NOT NULL;
+
+-- Create notifications table for in-app notifications
+CREATE TABLE notifications (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(100) NOT NULL, -- e.g. 'comment.sla_reminder'
+    title VARCHAR(255) NOT NULL,
+    body TEXT,
+    link TEXT,
+    data JSONB,
+    read_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create org-configurable comment SLA policies
+CREATE TABLE comment_sla_policies (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    max_age_hours INTEGER NOT NULL CHECK (max_age_hours > 0),
+    author_role VARCHAR(50), -- Only comments by collaborators with this role; NULL for all
+    enabled BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Track reminders already sent so each comment is reminded once per policy
+CREATE TABLE comment_sla_reminders (
+    policy_id UUID NOT NULL REFERENCES comment_sla_policies(id) ON DELETE CASCADE,
+    comment_id UUID NOT NULL REFERENCES project_comments(id) ON DELETE CASCADE,
+    sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (policy_id, comment_id)
+);
+
+-- Create indexes for better performance
+CREATE INDEX idx_notifications_user_id ON notifications(user_id, created_at DESC);
+CREATE INDEX idx_notifications_unread ON notifications(user_id) WHERE read_at IS NULL;
+CREATE INDEX idx_comment_sla_policies_org_id ON comment_sla_policies(org_id);
+CREATE INDEX idx_project_comments_unresolved ON project_comments(created_at) WHERE is_resolved = FALSE;
+
+CREATE TRIGGER update_comment_sla_policies_updated_at 
+    BEFORE UPDATE ON comment_sla_policies 
+    FOR EACH ROW 
+    EXECUTE FUNCTION update_updated_at_column();
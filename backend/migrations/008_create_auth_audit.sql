@@ -0,0 +1,32 @@
+-- Platform role for staff accounts
+ALTER TABLE users ADD COLUMN role VARCHAR(50) NOT NULL DEFAULT 'user'; -- user, moderator, admin
+
+-- Create append-only security audit log for authentication events
+CREATE TABLE auth_audit (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    email VARCHAR(255), -- Attempted email, kept for failed logins of unknown accounts
+    event VARCHAR(100) NOT NULL, -- e.g. 'login.success', 'login.failure', 'token.refresh'
+    success BOOLEAN NOT NULL,
+    ip_address VARCHAR(64),
+    user_agent TEXT,
+    metadata JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_auth_audit_user_id ON auth_audit(user_id, created_at DESC);
+CREATE INDEX idx_auth_audit_event ON auth_audit(event);
+CREATE INDEX idx_auth_audit_created_at ON auth_audit(created_at);
+
+-- Reject updates and deletes so the audit log stays append-only
+CREATE OR REPLACE FUNCTION prevent_auth_audit_mutation()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'auth_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER auth_audit_append_only
+    BEFORE UPDATE OR DELETE ON auth_audit
+    FOR EACH ROW
+    EXECUTE FUNCTION prevent_auth_audit_mutation();
@@ -0,0 +1,13 @@
+-- Create share links that grant read access to a project, optionally
+-- focused on a single page or element
+CREATE TABLE project_share_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    page_id VARCHAR(255), -- NULL links to the whole project
+    element_id VARCHAR(255), -- Canvas element the link focuses on
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_project_share_links_project_id ON project_share_links(project_id);
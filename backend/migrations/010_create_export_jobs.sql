@@ -0,0 +1,19 @@
+-- Create export jobs, rendered asynchronously by the export service
+CREATE TABLE export_jobs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(50) NOT NULL, -- e.g. 'review_pdf'
+    status VARCHAR(20) NOT NULL DEFAULT 'queued', -- queued, running, completed, failed
+    options JSONB,
+    revision INTEGER, -- Project revision the export was rendered from
+    artifact_asset_id UUID REFERENCES assets(id) ON DELETE SET NULL,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX idx_export_jobs_project_id ON export_jobs(project_id, created_at DESC);
+CREATE INDEX idx_export_jobs_user_id ON export_jobs(user_id);
+CREATE INDEX idx_export_jobs_status ON export_jobs(status) WHERE status IN ('queued', 'running');
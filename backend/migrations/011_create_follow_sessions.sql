@@ -0,0 +1,10 @@
+-- Create follow-the-presenter sessions; one per project at a time
+CREATE TABLE follow_sessions (
+    project_id UUID PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+    leader_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    page_id VARCHAR(255),
+    viewport JSONB, -- Last broadcast viewport, sent to late joiners
+    raised_hands UUID[] NOT NULL DEFAULT '{}', -- Followers asking for control, in order
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,7 @@
+-- Guest accounts let visitors try the editor before signing up. Guests get a
+-- placeholder email and are purged once guest_expires_at passes unless they
+-- upgrade to a full account.
+ALTER TABLE users ADD COLUMN is_guest BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN guest_expires_at TIMESTAMP;
+
+CREATE INDEX idx_users_guest_expires_at ON users(guest_expires_at) WHERE is_guest;
@@ -0,0 +1,21 @@
+-- Bumped to invalidate every token previously issued to a user
+ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
+
+-- Create pending email changes. Both the current and the new address must
+-- confirm before the change is applied; only token hashes are stored.
+CREATE TABLE email_change_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    old_email VARCHAR(255) NOT NULL,
+    new_email VARCHAR(255) NOT NULL,
+    old_token_hash VARCHAR(64) NOT NULL UNIQUE,
+    new_token_hash VARCHAR(64) NOT NULL UNIQUE,
+    old_confirmed_at TIMESTAMP,
+    new_confirmed_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    cancelled_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_email_change_requests_user_id ON email_change_requests(user_id, created_at DESC);
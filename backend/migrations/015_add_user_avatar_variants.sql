@@ -0,0 +1,3 @@
+-- Resized avatar variants keyed by pixel size, e.g. {"32": "/assets/<id>/content"}.
+-- users.avatar holds the canonical (largest) variant.
+ALTER TABLE users ADD COLUMN avatar_variants JSONB;
@@ -0,0 +1,24 @@
+-- Track open WebSocket connections across instances so connection quotas
+-- hold service-wide. Instances refresh last_seen_at while a connection is
+-- open; rows that stop being refreshed are ignored and later swept.
+CREATE TABLE realtime_connections (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    org_id UUID REFERENCES organizations(id) ON DELETE CASCADE,
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    connected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_realtime_connections_user ON realtime_connections(user_id, last_seen_at);
+CREATE INDEX idx_realtime_connections_org ON realtime_connections(org_id, last_seen_at) WHERE org_id IS NOT NULL;
+
+-- Admin overrides of the default connection caps
+CREATE TABLE realtime_quota_overrides (
+    scope VARCHAR(10) NOT NULL, -- user, org
+    subject_id UUID NOT NULL,
+    max_connections INTEGER NOT NULL CHECK (max_connections >= 0),
+    set_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, subject_id)
+);
@@ -0,0 +1,3 @@
+-- Billing plan of each account; limits such as document size budgets are
+-- configured per plan.
+ALTER TABLE users ADD COLUMN plan VARCHAR(20) NOT NULL DEFAULT 'free'; -- free, pro, team
@@ -0,0 +1,30 @@
+-- Devices and countries each user has signed in from. A sign-in that does
+-- not match any of them triggers a security alert email.
+CREATE TABLE login_fingerprints (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_hash VARCHAR(64) NOT NULL,
+    device_label VARCHAR(255) NOT NULL,
+    country VARCHAR(2) NOT NULL DEFAULT '', -- empty when the edge could not geolocate
+    last_ip INET,
+    first_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, device_hash, country)
+);
+
+-- Alerts sent for unrecognized sign-ins. The emailed token lets the owner
+-- lock the account in one click.
+CREATE TABLE security_alerts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    reasons TEXT[] NOT NULL, -- new_device, new_country
+    device_label VARCHAR(255) NOT NULL,
+    country VARCHAR(2) NOT NULL DEFAULT '',
+    ip INET,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_security_alerts_user_id ON security_alerts(user_id);
@@ -0,0 +1,57 @@
+-- Third-party apps registered to act on behalf of CanvasAI users through the
+-- OAuth2 authorization code flow with PKCE.
+CREATE TABLE oauth_apps (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    client_id VARCHAR(64) UNIQUE NOT NULL,
+    client_secret_hash VARCHAR(64), -- NULL for public clients (PKCE only)
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    homepage_url TEXT,
+    logo_url TEXT,
+    redirect_uris TEXT[] NOT NULL,
+    scopes TEXT[] NOT NULL, -- the most an app may request
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_oauth_apps_owner_id ON oauth_apps(owner_id);
+
+-- Single-use codes handed to the app's redirect URI after consent
+CREATE TABLE oauth_authorization_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    app_id UUID NOT NULL REFERENCES oauth_apps(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    code_challenge VARCHAR(128) NOT NULL, -- S256
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- A user's consent to an app. Every token issued from one authorization
+-- belongs to the same grant, so revoking the grant revokes them all.
+CREATE TABLE oauth_grants (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id UUID NOT NULL REFERENCES oauth_apps(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_oauth_grants_user_id ON oauth_grants(user_id) WHERE revoked_at IS NULL;
+
+-- Access/refresh token pairs. Access tokens are JWTs whose jti is the row
+-- ID; refresh tokens are opaque and rotate on every use.
+CREATE TABLE oauth_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    grant_id UUID NOT NULL REFERENCES oauth_grants(id) ON DELETE CASCADE,
+    refresh_token_hash VARCHAR(64) UNIQUE NOT NULL,
+    access_expires_at TIMESTAMP NOT NULL,
+    refresh_expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_oauth_tokens_grant_id ON oauth_tokens(grant_id);
@@ -0,0 +1,7 @@
+-- BlurHash placeholders for raster assets, computed on upload
+ALTER TABLE assets ADD COLUMN blurhash VARCHAR(64);
+
+-- Asset IDs each page of the canvas references, in paint order:
+-- {"<pageId>": ["<assetId>", ...]}. Rebuilt on every canvas save and used
+-- to serve page prefetch manifests without parsing the document.
+ALTER TABLE projects ADD COLUMN asset_refs JSONB;
@@ -0,0 +1,9 @@
+-- Per-user preferences. data holds the Settings document in the shape of
+-- schema_version; older documents are upgraded by the settings service when
+-- read.
+CREATE TABLE user_settings (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    schema_version INTEGER NOT NULL,
+    data JSONB NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
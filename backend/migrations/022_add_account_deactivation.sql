@@ -0,0 +1,7 @@
+-- Deactivated accounts keep their data but cannot sign in and are hidden
+-- from collaborator lists until reactivated through an emailed link.
+ALTER TABLE users ADD COLUMN deactivated_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN reactivation_token VARCHAR(64); -- SHA-256 of the emailed token
+ALTER TABLE users ADD COLUMN reactivation_token_expires_at TIMESTAMP;
+
+CREATE INDEX idx_users_reactivation_token ON users(reactivation_token) WHERE reactivation_token IS NOT NULL;
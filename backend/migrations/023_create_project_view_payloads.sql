@@ -0,0 +1,9 @@
+-- Flattened, read-only render payloads served to share link viewers. One row
+-- per project holding the payload for the revision it was built from; a
+-- newer revision replaces it on the next view.
+CREATE TABLE project_view_payloads (
+    project_id UUID PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,18 @@
+-- Organization settings, stored like user_settings as a versioned JSON
+-- document. Holds the defaults applied to projects created in the org.
+CREATE TABLE org_settings (
+    org_id UUID PRIMARY KEY REFERENCES organizations(id) ON DELETE CASCADE,
+    schema_version INTEGER NOT NULL,
+    data JSONB NOT NULL,
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Projects created in an organization, and the settings they were created
+-- with from its defaults
+ALTER TABLE projects ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
+ALTER TABLE projects ADD COLUMN color_profile VARCHAR(20) NOT NULL DEFAULT 'srgb';
+ALTER TABLE projects ADD COLUMN autosave_interval INTEGER; -- seconds; NULL defers to user settings
+ALTER TABLE projects ADD COLUMN share_links_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+
+CREATE INDEX idx_projects_org_id ON projects(org_id) WHERE org_id IS NOT NULL;
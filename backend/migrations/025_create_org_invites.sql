@@ -0,0 +1,20 @@
+-- Pending invitations to join an organization. Invites are addressed to an
+-- email so people without an account yet can accept after signing up.
+CREATE TABLE org_invites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(50) NOT NULL DEFAULT 'member', -- admin, member, guest
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP
+);
+
+-- At most one open invite per address and organization
+CREATE UNIQUE INDEX idx_org_invites_pending ON org_invites(org_id, lower(email)) WHERE accepted_at IS NULL;
+CREATE INDEX idx_org_invites_email ON org_invites(lower(email)) WHERE accepted_at IS NULL;
+
+-- Assets belong to the workspace of the project they were uploaded to
+ALTER TABLE assets ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
+CREATE INDEX idx_assets_org_id ON assets(org_id) WHERE org_id IS NOT NULL;
@@ -0,0 +1,19 @@
+-- Invitations to collaborate on a project, sent by email to addresses that
+-- may not have an account yet. Only a hash of the emailed token is stored.
+CREATE TABLE project_invites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(50) NOT NULL DEFAULT 'viewer', -- editor, commenter, viewer
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    invited_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    last_sent_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    send_count INTEGER NOT NULL DEFAULT 1,
+    accepted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    accepted_at TIMESTAMP
+);
+
+-- At most one open invite per address and project
+CREATE UNIQUE INDEX idx_project_invites_pending ON project_invites(project_id, lower(email)) WHERE accepted_at IS NULL;
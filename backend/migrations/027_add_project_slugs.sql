@@ -0,0 +1,17 @@
+-- Project slugs are unique per owner for personal projects and per
+-- organization for organization projects, ignoring case.
+CREATE UNIQUE INDEX idx_projects_owner_slug ON projects(owner_id, lower(slug)) WHERE org_id IS NULL;
+CREATE UNIQUE INDEX idx_projects_org_slug ON projects(org_id, lower(slug)) WHERE org_id IS NOT NULL;
+
+-- Slugs a project was known by before a rename, so old links keep
+-- resolving. A slug is released again once another project claims it.
+CREATE TABLE project_slug_redirects (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    org_id UUID REFERENCES organizations(id) ON DELETE CASCADE,
+    slug VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_project_slug_redirects_slug ON project_slug_redirects(lower(slug));
@@ -0,0 +1,14 @@
+-- Support staff signed in as a user. Tokens issued for a session carry its
+-- ID and stop working once it is ended or expires.
+CREATE TABLE impersonation_sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    admin_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP
+);
+
+CREATE INDEX idx_impersonation_sessions_user ON impersonation_sessions(user_id, created_at DESC);
+CREATE INDEX idx_impersonation_sessions_admin ON impersonation_sessions(admin_id, created_at DESC);
@@ -0,0 +1,18 @@
+-- Email addresses mentioned in comments that do not belong to a
+-- collaborator. The project owner approves a suggestion to send an invite,
+-- or dismisses it.
+CREATE TABLE comment_invite_suggestions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    comment_id UUID REFERENCES project_comments(id) ON DELETE SET NULL,
+    email VARCHAR(255) NOT NULL,
+    suggested_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, approved, dismissed
+    invite_id UUID REFERENCES project_invites(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    decided_at TIMESTAMP
+);
+
+-- One suggestion per address and project; dismissed addresses are not
+-- suggested again.
+CREATE UNIQUE INDEX idx_comment_invite_suggestions_email ON comment_invite_suggestions(project_id, lower(email));
@@ -0,0 +1,7 @@
+-- Admin overrides of the per-plan API rate limit for individual users
+CREATE TABLE api_rate_limit_overrides (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    requests_per_minute INTEGER NOT NULL CHECK (requests_per_minute > 0),
+    set_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,10 @@
+-- Export retention: artifacts are purged after a retention period or once a
+-- newer export of the same preset supersedes them. Jobs keep their settings
+-- so a purged export can be regenerated.
+ALTER TABLE export_jobs ADD COLUMN preset VARCHAR(100);
+ALTER TABLE export_jobs ADD COLUMN source_version INTEGER; -- Version requested on regeneration; NULL renders the current project
+ALTER TABLE export_jobs ADD COLUMN regenerated_from UUID REFERENCES export_jobs(id) ON DELETE SET NULL;
+ALTER TABLE export_jobs ADD COLUMN purged_at TIMESTAMP;
+
+CREATE INDEX idx_export_jobs_retention ON export_jobs(completed_at)
+    WHERE status = 'completed' AND purged_at IS NULL;
@@ -0,0 +1,14 @@
+-- External identities (e.g. a Google account) a user can sign in with. An
+-- identity belongs to exactly one user; a user can have several.
+CREATE TABLE user_identities (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    provider_user_id VARCHAR(255) NOT NULL,
+    email VARCHAR(255), -- as reported by the provider when linked
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMP,
+    UNIQUE(provider, provider_user_id)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
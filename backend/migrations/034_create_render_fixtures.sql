@@ -0,0 +1,19 @@
+-- Golden-image fixtures for the export renderer. Each fixture is a canvas
+-- document with an approved baseline render; checks re-render it and diff
+-- against the baseline.
+CREATE TABLE render_fixtures (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) UNIQUE NOT NULL,
+    description TEXT,
+    canvas_data JSONB NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    delta_threshold REAL NOT NULL DEFAULT 2.3, -- Per-pixel ΔE above which a pixel counts as changed
+    max_changed_ratio REAL NOT NULL DEFAULT 0.001, -- Share of changed pixels tolerated
+    builtin BOOLEAN NOT NULL DEFAULT FALSE,
+    baseline BYTEA, -- Approved render, PNG
+    baseline_updated_at TIMESTAMP,
+    baseline_updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
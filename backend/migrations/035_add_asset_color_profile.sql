@@ -0,0 +1,3 @@
+-- Color profile embedded in uploaded images, by description. NULL means the
+-- image is untagged and treated as sRGB.
+ALTER TABLE assets ADD COLUMN color_profile VARCHAR(200);
@@ -0,0 +1,26 @@
+-- Asset version history: replacing an asset's file keeps the previous file
+-- as a version that can be restored until retention purges it.
+ALTER TABLE assets ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE assets ADD COLUMN version_created_at TIMESTAMP; -- When the current file was uploaded; NULL means created_at
+
+CREATE TABLE asset_versions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    mime_type VARCHAR(100) NOT NULL,
+    file_size BIGINT NOT NULL,
+    file_path TEXT NOT NULL,
+    width INTEGER,
+    height INTEGER,
+    checksum VARCHAR(64),
+    blurhash VARCHAR(64),
+    color_profile VARCHAR(200),
+    created_at TIMESTAMP NOT NULL, -- When this version was uploaded
+    replaced_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    replaced_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    purged_at TIMESTAMP, -- File removed by retention; the entry is kept for history
+    UNIQUE(asset_id, version)
+);
+
+CREATE INDEX idx_asset_versions_retention ON asset_versions(replaced_at) WHERE purged_at IS NULL;
@@ -0,0 +1,5 @@
+-- Project tags, used to organize and filter the project list
+ALTER TABLE projects ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_projects_tags ON projects USING GIN(tags);
+CREATE INDEX idx_projects_title_lower ON projects(lower(title));
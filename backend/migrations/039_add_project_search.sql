@@ -0,0 +1,38 @@
+-- Full-text project search over the title, description and the text layers
+-- of the canvas. canvas_text is kept in step with canvas_data by a trigger so
+-- every write path (saves, imports, duplicates) is covered.
+ALTER TABLE projects ADD COLUMN canvas_text TEXT NOT NULL DEFAULT '';
+
+-- Text of every text layer in a canvas document, one layer per line
+CREATE OR REPLACE FUNCTION canvas_text_layers(doc JSONB)
+RETURNS TEXT AS $$
+    SELECT COALESCE(string_agg(t #>> '{}', E'\n'), '')
+    FROM jsonb_path_query(doc, 'strict $.**.text ? (@.type() == "string")') AS t
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION set_project_canvas_text()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.canvas_text := canvas_text_layers(NEW.canvas_data);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER set_project_canvas_text_trigger
+    BEFORE INSERT OR UPDATE OF canvas_data ON projects
+    FOR EACH ROW
+    EXECUTE FUNCTION set_project_canvas_text();
+
+-- Backfill without touching updated_at
+ALTER TABLE projects DISABLE TRIGGER update_projects_updated_at;
+UPDATE projects SET canvas_text = canvas_text_layers(canvas_data) WHERE canvas_data IS NOT NULL;
+ALTER TABLE projects ENABLE TRIGGER update_projects_updated_at;
+
+-- Titles rank above descriptions, which rank above canvas text
+ALTER TABLE projects ADD COLUMN search_vector TSVECTOR GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE(description, '')), 'B') ||
+    setweight(to_tsvector('english', canvas_text), 'C')
+) STORED;
+
+CREATE INDEX idx_projects_search_vector ON projects USING GIN(search_vector);
@@ -0,0 +1,15 @@
+-- Linked assets: projects follow an asset's current file unless they freeze
+-- it at a version. Frozen versions are exempt from version retention.
+CREATE TABLE project_asset_links (
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    frozen_version INTEGER NOT NULL,
+    frozen_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    frozen_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (project_id, asset_id)
+);
+
+CREATE INDEX idx_project_asset_links_asset_id ON project_asset_links(asset_id, frozen_version);
+
+-- Find the projects using an asset through the usage index
+CREATE INDEX idx_projects_asset_refs ON projects USING GIN(asset_refs);
@@ -0,0 +1,19 @@
+-- Assets imported from a URL remember their source, so a revalidation job
+-- can notice when the upstream file changes and offer to refresh the copy.
+CREATE TABLE asset_sources (
+    asset_id UUID PRIMARY KEY REFERENCES assets(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    etag TEXT,
+    last_modified TEXT,
+    checksum VARCHAR(64) NOT NULL, -- Upstream file the asset was last fetched from
+    update_available BOOLEAN NOT NULL DEFAULT FALSE,
+    upstream_checksum VARCHAR(64), -- Changed upstream file, when update_available
+    failures INTEGER NOT NULL DEFAULT 0, -- Consecutive failed checks
+    last_error TEXT,
+    checked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    changed_at TIMESTAMP,
+    refreshed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_asset_sources_checked_at ON asset_sources(checked_at);
@@ -0,0 +1,19 @@
+-- Project version history: snapshots of the canvas taken on request
+-- (manual) or automatically before a save makes a significant change.
+-- version_number is the project revision the snapshot captured.
+ALTER TABLE project_versions ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'auto'; -- manual, auto
+ALTER TABLE project_versions ADD COLUMN label VARCHAR(255);
+ALTER TABLE project_versions ADD COLUMN canvas_width INTEGER;
+ALTER TABLE project_versions ADD COLUMN canvas_height INTEGER;
+ALTER TABLE project_versions ADD COLUMN element_count INTEGER NOT NULL DEFAULT 0;
+
+-- Top-level elements of a canvas document, across pages
+CREATE OR REPLACE FUNCTION canvas_element_count(doc JSONB)
+RETURNS INTEGER AS $$
+    SELECT jsonb_array_length(jsonb_path_query_array(doc, 'lax $.objects[*]'))
+        + jsonb_array_length(jsonb_path_query_array(doc, 'lax $.pages[*].objects[*]'))
+$$ LANGUAGE SQL IMMUTABLE;
+
+UPDATE project_versions SET element_count = canvas_element_count(canvas_data);
+
+CREATE INDEX idx_project_versions_kind ON project_versions(project_id, kind, version_number DESC);
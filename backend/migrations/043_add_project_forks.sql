@@ -0,0 +1,5 @@
+-- Forks of public projects remember the project they were remixed from.
+-- Deleting the original keeps the fork.
+ALTER TABLE projects ADD COLUMN forked_from UUID REFERENCES projects(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_projects_forked_from ON projects(forked_from) WHERE forked_from IS NOT NULL;
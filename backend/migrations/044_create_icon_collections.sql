@@ -0,0 +1,19 @@
+-- Organization icon collections: named lists of favorite icons from the
+-- icon library, referenced by their Iconify "prefix:name" IDs
+CREATE TABLE icon_collections (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_icon_collections_name ON icon_collections(org_id, lower(name));
+
+CREATE TABLE icon_collection_items (
+    collection_id UUID NOT NULL REFERENCES icon_collections(id) ON DELETE CASCADE,
+    icon_id VARCHAR(200) NOT NULL,
+    added_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (collection_id, icon_id)
+);
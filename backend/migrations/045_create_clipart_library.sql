@@ -0,0 +1,69 @@
+-- Shape and clipart library: a curated catalog of vector items grouped in
+-- categories. Items are drafts until an admin publishes them.
+CREATE TABLE clipart_categories (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    slug VARCHAR(100) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE clipart_items (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    category_id UUID REFERENCES clipart_categories(id) ON DELETE SET NULL,
+    kind VARCHAR(20) NOT NULL, -- shape, clipart
+    name VARCHAR(200) NOT NULL,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'draft', -- draft, published, archived
+    content TEXT NOT NULL, -- sanitized SVG
+    width REAL NOT NULL,
+    height REAL NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    search_vector TSVECTOR NOT NULL DEFAULT ''::tsvector,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX idx_clipart_items_category ON clipart_items(category_id, name) WHERE status = 'published';
+CREATE INDEX idx_clipart_items_search_vector ON clipart_items USING GIN(search_vector);
+CREATE UNIQUE INDEX idx_clipart_items_checksum ON clipart_items(checksum);
+
+-- Names rank above tags
+CREATE OR REPLACE FUNCTION set_clipart_search_vector()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', NEW.name), 'A') ||
+        setweight(to_tsvector('english', array_to_string(NEW.tags, ' ')), 'B');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER set_clipart_search_vector_trigger
+    BEFORE INSERT OR UPDATE OF name, tags ON clipart_items
+    FOR EACH ROW
+    EXECUTE FUNCTION set_clipart_search_vector();
+
+-- Usage analytics: items added to canvases and searches run, kept for
+-- ClipartAnalytics.retentionDays
+CREATE TABLE clipart_usage (
+    id BIGSERIAL PRIMARY KEY,
+    item_id UUID NOT NULL REFERENCES clipart_items(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    project_id UUID REFERENCES projects(id) ON DELETE SET NULL,
+    used_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_clipart_usage_item ON clipart_usage(item_id, used_at);
+CREATE INDEX idx_clipart_usage_used_at ON clipart_usage(used_at);
+
+CREATE TABLE clipart_searches (
+    id BIGSERIAL PRIMARY KEY,
+    query VARCHAR(100) NOT NULL, -- lowercased and trimmed
+    results INTEGER NOT NULL,
+    searched_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_clipart_searches_searched_at ON clipart_searches(searched_at);
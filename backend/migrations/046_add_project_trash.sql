@@ -0,0 +1,6 @@
+-- Deleted projects go to the trash, where their owner can restore them
+-- until they are purged after 30 days.
+ALTER TABLE projects ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE projects ADD COLUMN deleted_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_projects_trash ON projects(owner_id, deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,20 @@
+-- Runtime state of the map provider keys configured in the MapProviderKeys
+-- secret. The keys themselves are never stored.
+CREATE TABLE map_api_keys (
+    key_id VARCHAR(100) PRIMARY KEY,
+    disabled_at TIMESTAMP,
+    disabled_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    disabled_reason VARCHAR(500),
+    last_error TEXT,
+    last_error_at TIMESTAMP
+);
+
+-- Upstream requests made with each key per UTC day, for daily limits and
+-- the admin overview
+CREATE TABLE map_api_key_usage (
+    key_id VARCHAR(100) NOT NULL,
+    day DATE NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    failures INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (key_id, day)
+);
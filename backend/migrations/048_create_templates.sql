@@ -0,0 +1,58 @@
+-- Project templates: curated templates managed by platform admins and
+-- templates users publish from their projects, either publicly or to their
+-- organization. A template keeps its own copy of the canvas, so later
+-- edits to the source project do not change it.
+CREATE TABLE template_categories (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    slug VARCHAR(100) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE templates (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    category_id UUID REFERENCES template_categories(id) ON DELETE SET NULL,
+    title VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    curated BOOLEAN NOT NULL DEFAULT FALSE,
+    visibility VARCHAR(20) NOT NULL DEFAULT 'public', -- public, org
+    org_id UUID REFERENCES organizations(id) ON DELETE CASCADE,
+    canvas_data JSONB NOT NULL,
+    canvas_width INTEGER NOT NULL,
+    canvas_height INTEGER NOT NULL,
+    color_profile VARCHAR(20) NOT NULL DEFAULT 'srgb',
+    -- Copies of the assets the canvas references, owned by the template
+    asset_ids UUID[] NOT NULL DEFAULT '{}',
+    thumbnail_asset_id UUID REFERENCES assets(id) ON DELETE SET NULL,
+    source_project_id UUID REFERENCES projects(id) ON DELETE SET NULL,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    uses INTEGER NOT NULL DEFAULT 0,
+    search_vector TSVECTOR NOT NULL DEFAULT ''::tsvector,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (visibility = 'public' OR org_id IS NOT NULL)
+);
+
+CREATE INDEX idx_templates_category ON templates(category_id);
+CREATE INDEX idx_templates_org ON templates(org_id) WHERE org_id IS NOT NULL;
+CREATE INDEX idx_templates_created_by ON templates(created_by);
+CREATE INDEX idx_templates_search_vector ON templates USING GIN(search_vector);
+
+-- Titles rank above tags, tags above descriptions
+CREATE OR REPLACE FUNCTION set_template_search_vector()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', NEW.title), 'A') ||
+        setweight(to_tsvector('english', array_to_string(NEW.tags, ' ')), 'B') ||
+        setweight(to_tsvector('english', NEW.description), 'C');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER set_template_search_vector_trigger
+    BEFORE INSERT OR UPDATE OF title, tags, description ON templates
+    FOR EACH ROW
+    EXECUTE FUNCTION set_template_search_vector();
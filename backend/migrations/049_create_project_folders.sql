@@ -0,0 +1,20 @@
+-- Folders for organizing the projects a user owns on their dashboard.
+-- Folders nest; deleting one deletes its subfolders and moves their
+-- projects back to the top level.
+CREATE TABLE project_folders (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    parent_id UUID REFERENCES project_folders(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_project_folders_owner ON project_folders(owner_id, parent_id);
+-- Sibling folders have distinct names
+CREATE UNIQUE INDEX idx_project_folders_name ON project_folders(
+    owner_id, COALESCE(parent_id, '00000000-0000-0000-0000-000000000000'::uuid), lower(name));
+
+ALTER TABLE projects ADD COLUMN folder_id UUID REFERENCES project_folders(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_projects_folder_id ON projects(folder_id) WHERE folder_id IS NOT NULL;
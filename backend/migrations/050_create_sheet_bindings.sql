@@ -0,0 +1,54 @@
+-- Google Sheets connected to projects, and the text elements bound to
+-- their cells. A sync job copies cell values into the canvas and records
+-- every change.
+CREATE TABLE sheet_connections (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    spreadsheet_id VARCHAR(128) NOT NULL,
+    title VARCHAR(255) NOT NULL DEFAULT '',
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    sync_interval_minutes INTEGER NOT NULL DEFAULT 60,
+    next_sync_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_synced_at TIMESTAMP,
+    -- failures counts consecutive syncs that could not read the spreadsheet
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (project_id, spreadsheet_id)
+);
+
+CREATE INDEX idx_sheet_connections_next_sync ON sheet_connections(next_sync_at);
+
+CREATE TABLE sheet_bindings (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    connection_id UUID NOT NULL REFERENCES sheet_connections(id) ON DELETE CASCADE,
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    element_id VARCHAR(255) NOT NULL,
+    -- cell_range is an A1 range such as Prices!B2 or Sheet1!A1:C3
+    cell_range VARCHAR(255) NOT NULL,
+    -- value is the text last copied into the element; NULL until synced
+    value TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'ok', 'broken')),
+    last_error TEXT,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    synced_at TIMESTAMP,
+    changed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (project_id, element_id)
+);
+
+CREATE INDEX idx_sheet_bindings_connection ON sheet_bindings(connection_id);
+
+CREATE TABLE sheet_binding_changes (
+    id BIGSERIAL PRIMARY KEY,
+    binding_id UUID NOT NULL REFERENCES sheet_bindings(id) ON DELETE CASCADE,
+    old_value TEXT,
+    new_value TEXT NOT NULL,
+    -- source is schedule for the sync job or manual for on-demand syncs
+    source VARCHAR(20) NOT NULL,
+    revision INTEGER,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_sheet_binding_changes_binding ON sheet_binding_changes(binding_id, changed_at DESC);
@@ -0,0 +1,23 @@
+-- Mockup templates: a photo (a t-shirt, a phone, a billboard) and where on
+-- it designs are placed. placement holds either perspective corners or a
+-- mesh, in pixels of the photo; see render.Warp.
+CREATE TABLE mockup_templates (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) NOT NULL,
+    category VARCHAR(100) NOT NULL,
+    base_asset_id UUID NOT NULL REFERENCES assets(id),
+    -- overlay_asset_id is an optional transparent image drawn over the
+    -- design, for highlights or a device frame
+    overlay_asset_id UUID REFERENCES assets(id),
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    placement JSONB NOT NULL,
+    blend_mode VARCHAR(20) NOT NULL DEFAULT 'normal'
+        CHECK (blend_mode IN ('normal', 'multiply')),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_mockup_templates_category ON mockup_templates(category, name) WHERE is_active;
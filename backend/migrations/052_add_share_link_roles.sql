@@ -0,0 +1,17 @@
+-- Give share links a role and an optional expiry and use limit.
+-- Signed-in users who open a link are recorded so the link's role applies
+-- to them until it is revoked (deleted) or expires.
+ALTER TABLE project_share_links
+    ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'viewer' CHECK (role IN ('viewer', 'commenter', 'editor')),
+    ADD COLUMN expires_at TIMESTAMP,
+    ADD COLUMN max_uses INTEGER CHECK (max_uses > 0),
+    ADD COLUMN use_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE project_share_link_grants (
+    link_id UUID NOT NULL REFERENCES project_share_links(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (link_id, user_id)
+);
+
+CREATE INDEX idx_project_share_link_grants_user_id ON project_share_link_grants(user_id);
@@ -0,0 +1,48 @@
+-- Create print-on-demand connections, the products projects are published
+-- as, and the orders placed for them
+CREATE TABLE pod_connections (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(20) NOT NULL CHECK (provider IN ('printful', 'printify')),
+    store_id VARCHAR(64) NOT NULL,
+    store_name VARCHAR(255) NOT NULL DEFAULT '',
+    token_ciphertext BYTEA NOT NULL, -- API token sealed with PODTokenKey
+    webhook_token VARCHAR(64) NOT NULL UNIQUE, -- Path secret of the webhook URL
+    webhook_ids TEXT[] NOT NULL DEFAULT '{}', -- Provider webhook IDs, for Printify
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, provider, store_id)
+);
+
+CREATE TABLE pod_products (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    connection_id UUID NOT NULL REFERENCES pod_connections(id) ON DELETE CASCADE,
+    asset_id UUID REFERENCES assets(id) ON DELETE SET NULL, -- Print file; NULL once deleted
+    export_job_id UUID, -- Export the print file came from, if any
+    config JSONB NOT NULL,
+    external_product_id VARCHAR(64),
+    file_token VARCHAR(64) NOT NULL UNIQUE, -- Path secret the provider fetches the print file with
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'pushed', 'failed')),
+    last_error TEXT,
+    pushed_at TIMESTAMP,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_pod_products_project_id ON pod_products(project_id);
+CREATE INDEX idx_pod_products_connection_id ON pod_products(connection_id);
+
+CREATE TABLE pod_orders (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    product_id UUID NOT NULL REFERENCES pod_products(id) ON DELETE CASCADE,
+    external_order_id VARCHAR(64) NOT NULL,
+    status VARCHAR(50) NOT NULL, -- Provider's own status
+    fulfillment VARCHAR(20) NOT NULL, -- pending, in_production, shipped, delivered, canceled, failed
+    carrier VARCHAR(100),
+    tracking_number VARCHAR(255),
+    tracking_url TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(product_id, external_order_id)
+);
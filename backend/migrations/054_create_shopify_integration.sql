@@ -0,0 +1,31 @@
+-- Create Shopify store connections and the links that publish a project's
+-- exports as product images
+CREATE TABLE shopify_connections (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    shop_domain VARCHAR(255) NOT NULL, -- e.g. example.myshopify.com
+    shop_name VARCHAR(255) NOT NULL DEFAULT '',
+    token_ciphertext BYTEA NOT NULL, -- Admin API token sealed with ShopifyTokenKey
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, shop_domain)
+);
+
+CREATE TABLE shopify_product_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    connection_id UUID NOT NULL REFERENCES shopify_connections(id) ON DELETE CASCADE,
+    product_id VARCHAR(32) NOT NULL, -- Shopify product ID
+    product_title VARCHAR(255) NOT NULL DEFAULT '',
+    preset VARCHAR(100) NOT NULL, -- Export preset whose artifacts are published
+    auto_sync BOOLEAN NOT NULL DEFAULT TRUE,
+    image_ids TEXT[] NOT NULL DEFAULT '{}', -- Product images added by the last sync
+    synced_export_id UUID,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'synced', 'failed')),
+    last_error TEXT,
+    synced_at TIMESTAMP,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(project_id, connection_id, product_id, preset)
+);
+
+CREATE INDEX idx_shopify_product_links_project_preset ON shopify_product_links(project_id, preset);
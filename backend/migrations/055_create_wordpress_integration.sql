@@ -0,0 +1,31 @@
+-- Create WordPress site connections and the history of exports published
+-- to them
+CREATE TABLE wordpress_sites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    site_url VARCHAR(500) NOT NULL, -- e.g. https://blog.example.com
+    site_name VARCHAR(255) NOT NULL DEFAULT '',
+    username VARCHAR(255) NOT NULL,
+    password_ciphertext BYTEA NOT NULL, -- Application password sealed with WordPressCredentialKey
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, site_url, username)
+);
+
+CREATE TABLE wordpress_publications (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    site_id UUID REFERENCES wordpress_sites(id) ON DELETE SET NULL,
+    site_url VARCHAR(500) NOT NULL, -- Kept so history survives disconnecting the site
+    export_job_id UUID REFERENCES export_jobs(id) ON DELETE SET NULL,
+    alt_text TEXT NOT NULL DEFAULT '',
+    media_id BIGINT,
+    media_url TEXT,
+    post_id BIGINT, -- Draft post created with the media, if any
+    post_url TEXT,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('published', 'failed')),
+    error TEXT,
+    published_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_wordpress_publications_project ON wordpress_publications(project_id, created_at DESC);
@@ -0,0 +1,42 @@
+-- Host the images of HTML email exports, which recipients load without
+-- signing in, and sync the exports to email service providers' template
+-- libraries
+CREATE TABLE export_email_images (
+    token VARCHAR(64) PRIMARY KEY,
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    export_job_id UUID REFERENCES export_jobs(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE esp_connections (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(20) NOT NULL CHECK (provider IN ('mailchimp', 'sendgrid')),
+    account_name VARCHAR(255) NOT NULL DEFAULT '',
+    api_key_ciphertext BYTEA NOT NULL, -- Sealed with ESPCredentialKey
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_esp_connections_user ON esp_connections(user_id);
+
+-- Maps a project's export preset to a template, so each new export of the
+-- preset updates the same template
+CREATE TABLE esp_templates (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    connection_id UUID NOT NULL REFERENCES esp_connections(id) ON DELETE CASCADE,
+    preset VARCHAR(100) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL DEFAULT '', -- SendGrid only
+    template_id VARCHAR(64), -- Set once first pushed
+    version_id VARCHAR(64), -- SendGrid template version holding the HTML
+    auto_sync BOOLEAN NOT NULL DEFAULT TRUE,
+    synced_export_id UUID,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'synced', 'failed')),
+    last_error TEXT,
+    synced_at TIMESTAMP,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(project_id, connection_id, preset)
+);
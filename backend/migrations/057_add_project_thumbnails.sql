@@ -0,0 +1,4 @@
+-- Project thumbnails: a small preview rendered after canvas saves. The
+-- revision it was rendered from lets the renderer skip stale requests.
+ALTER TABLE projects ADD COLUMN thumbnail_asset_id UUID REFERENCES assets(id) ON DELETE SET NULL;
+ALTER TABLE projects ADD COLUMN thumbnail_revision INTEGER;
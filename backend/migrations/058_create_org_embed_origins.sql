@@ -0,0 +1,9 @@
+-- Origins an organization's projects may be embedded on, on top of the
+-- configured defaults (see webpolicy).
+CREATE TABLE org_embed_origins (
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    origin VARCHAR(300) NOT NULL, -- normalized, e.g. https://example.com or https://*.example.com
+    added_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (org_id, origin)
+);
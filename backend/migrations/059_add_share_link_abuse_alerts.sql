@@ -0,0 +1,3 @@
+-- When the project owner was last alerted that a share link is getting
+-- unusual traffic; alerts are sent at most once an hour per link.
+ALTER TABLE project_share_links ADD COLUMN abuse_alerted_at TIMESTAMP;
@@ -0,0 +1,18 @@
+-- Sampled wide events: one row per save, export or AI job with its step
+-- timings (see wideevent). Failed and slow work is always kept.
+CREATE TABLE wide_events (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL, -- save, export, ai
+    request_id VARCHAR(100),
+    duration_ms DOUBLE PRECISION NOT NULL,
+    outcome VARCHAR(10) NOT NULL, -- ok, error
+    error TEXT,
+    steps JSONB NOT NULL DEFAULT '{}', -- step name to milliseconds
+    fields JSONB NOT NULL DEFAULT '{}',
+    sample_rate DOUBLE PRECISION NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_wide_events_kind_created ON wide_events(kind, created_at DESC);
+CREATE INDEX idx_wide_events_duration ON wide_events(kind, duration_ms DESC);
+CREATE INDEX idx_wide_events_created ON wide_events(created_at);
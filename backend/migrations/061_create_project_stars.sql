@@ -0,0 +1,14 @@
+-- Users' starred projects. star_count mirrors the number of stars so public
+-- projects can be ranked by it without counting.
+CREATE TABLE project_stars (
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (project_id, user_id)
+);
+
+CREATE INDEX idx_project_stars_user ON project_stars(user_id, created_at DESC);
+
+ALTER TABLE projects ADD COLUMN star_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX idx_projects_public_stars ON projects(star_count DESC) WHERE is_public AND deleted_at IS NULL;
@@ -0,0 +1,12 @@
+-- Promotions of a standby region to primary (see region). The most recent
+-- names the current primary for instances started in standby mode.
+CREATE TABLE region_failovers (
+    id BIGSERIAL PRIMARY KEY,
+    region VARCHAR(50) NOT NULL,
+    promoted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    reason TEXT,
+    replication_lag_seconds DOUBLE PRECISION NOT NULL DEFAULT 0,
+    promoted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_region_failovers_promoted ON region_failovers(promoted_at DESC);
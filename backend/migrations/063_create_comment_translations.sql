@@ -0,0 +1,12 @@
+-- Cached comment translations, one per comment and target language.
+-- content_hash is the hash of the text that was translated, so an edited
+-- comment is translated again.
+CREATE TABLE comment_translations (
+    comment_id UUID NOT NULL REFERENCES project_comments(id) ON DELETE CASCADE,
+    target_language VARCHAR(16) NOT NULL,
+    source_language VARCHAR(16) NOT NULL,
+    content_hash VARCHAR(64) NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (comment_id, target_language)
+);
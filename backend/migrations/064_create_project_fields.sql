@@ -0,0 +1,19 @@
+-- Custom project fields defined by organizations. Each project of the
+-- organization keeps its values in projects.custom_fields, keyed by the
+-- field's key.
+CREATE TABLE org_project_fields (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    key VARCHAR(40) NOT NULL,
+    label VARCHAR(100) NOT NULL,
+    type VARCHAR(16) NOT NULL CHECK (type IN ('text', 'number', 'date', 'select', 'boolean')),
+    options TEXT[] NOT NULL DEFAULT '{}',
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, key)
+);
+
+ALTER TABLE projects ADD COLUMN custom_fields JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_projects_custom_fields ON projects USING GIN (custom_fields jsonb_path_ops);
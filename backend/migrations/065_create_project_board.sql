@@ -0,0 +1,35 @@
+-- Status boards: each organization arranges its projects in columns of
+-- its own. board_position orders the projects within a column; moves
+-- place a project between its neighbours, so positions are fractional.
+CREATE TABLE org_board_columns (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    color VARCHAR(7),
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_org_board_columns_org ON org_board_columns(org_id, position);
+
+ALTER TABLE projects
+    ADD COLUMN board_column_id UUID REFERENCES org_board_columns(id) ON DELETE SET NULL,
+    ADD COLUMN board_position DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+CREATE INDEX idx_projects_board ON projects(board_column_id, board_position) WHERE deleted_at IS NULL;
+
+-- Status changes, newest last. Column names are copied so the history
+-- survives a column being renamed or deleted.
+CREATE TABLE project_status_history (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    from_column_id UUID REFERENCES org_board_columns(id) ON DELETE SET NULL,
+    from_name VARCHAR(100),
+    to_column_id UUID REFERENCES org_board_columns(id) ON DELETE SET NULL,
+    to_name VARCHAR(100),
+    changed_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_project_status_history_project ON project_status_history(project_id, changed_at);
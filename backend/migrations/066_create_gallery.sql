@@ -0,0 +1,11 @@
+-- Public gallery: public projects are listed for discovery unless their
+-- owner opts out, and may be filed under a template category.
+ALTER TABLE users ADD COLUMN discoverable BOOLEAN NOT NULL DEFAULT TRUE;
+
+ALTER TABLE projects ADD COLUMN gallery_category_id UUID REFERENCES template_categories(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_projects_public_created ON projects(created_at DESC) WHERE is_public AND deleted_at IS NULL;
+CREATE INDEX idx_projects_gallery_category ON projects(gallery_category_id) WHERE is_public AND deleted_at IS NULL;
+
+-- Trending counts each public project's recent stars
+CREATE INDEX idx_project_stars_project_created ON project_stars(project_id, created_at DESC);
@@ -0,0 +1,18 @@
+-- Time spent on projects: edit sessions recorded from saves while a
+-- project's owner has time tracking on, and entries people log by hand.
+ALTER TABLE projects ADD COLUMN time_tracking BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE project_time_entries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    source VARCHAR(20) NOT NULL CHECK (source IN ('session', 'manual')),
+    started_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP NOT NULL,
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (ended_at >= started_at)
+);
+
+CREATE INDEX idx_project_time_entries_project ON project_time_entries(project_id, started_at);
+CREATE INDEX idx_project_time_entries_user ON project_time_entries(user_id, started_at);
@@ -0,0 +1,22 @@
+-- Client portal: organization projects shared to the organization's
+-- clients, and the approval decisions clients record on them.
+CREATE TABLE portal_projects (
+    project_id UUID PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    added_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_portal_projects_org ON portal_projects(org_id, added_at DESC);
+
+CREATE TABLE project_approvals (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    decision VARCHAR(20) NOT NULL CHECK (decision IN ('approved', 'changes_requested')),
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_project_approvals_project ON project_approvals(project_id, created_at DESC);
@@ -0,0 +1,11 @@
+-- Project webhooks: endpoints registered by a project's owner rather than
+-- an organization. An endpoint belongs to exactly one of the two. Events
+-- of projects outside an organization are logged without one.
+ALTER TABLE webhook_endpoints ALTER COLUMN org_id DROP NOT NULL;
+ALTER TABLE webhook_endpoints ADD COLUMN project_id UUID REFERENCES projects(id) ON DELETE CASCADE;
+ALTER TABLE webhook_endpoints ADD CONSTRAINT webhook_endpoints_scope
+    CHECK ((org_id IS NULL) <> (project_id IS NULL));
+
+ALTER TABLE webhook_events ALTER COLUMN org_id DROP NOT NULL;
+
+CREATE INDEX idx_webhook_endpoints_project_id ON webhook_endpoints(project_id);
@@ -0,0 +1,19 @@
+-- PDF exports record where each element was drawn, so annotations made on
+-- the PDF in review tools can be mapped back onto the canvas.
+ALTER TABLE export_jobs ADD COLUMN element_manifest JSONB;
+
+-- Annotations imported from PDFs returned by reviewers, one row per
+-- annotation and export, so uploading the same file again imports nothing
+-- twice and later replies find their thread.
+CREATE TABLE export_annotation_imports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    export_id UUID NOT NULL REFERENCES export_jobs(id) ON DELETE CASCADE,
+    annotation_key VARCHAR(128) NOT NULL, -- the annotation's PDF name, or a hash of its content
+    comment_id UUID NOT NULL REFERENCES project_comments(id) ON DELETE CASCADE,
+    author VARCHAR(255), -- author named in the PDF
+    imported_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (export_id, annotation_key)
+);
+
+CREATE INDEX idx_export_annotation_imports_comment_id ON export_annotation_imports(comment_id);
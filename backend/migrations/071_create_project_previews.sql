@@ -0,0 +1,11 @@
+-- Open Graph preview images of public and shared projects. Each is
+-- rendered on first request and served from the cache until the project's
+-- next revision. page_id is empty for the project's first page.
+CREATE TABLE project_previews (
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    page_id VARCHAR(255) NOT NULL DEFAULT '',
+    revision INTEGER NOT NULL,
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    rendered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (project_id, page_id)
+);
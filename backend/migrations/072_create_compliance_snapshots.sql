@@ -0,0 +1,68 @@
+-- Compliance snapshots: scheduled, immutable exports of an organization's
+-- projects. Their files are assets under a retention lock: until
+-- retain_until neither the asset nor the snapshot record can be changed or
+-- deleted. Snapshot assets belong to no project, so purging a project from
+-- the trash leaves its snapshots in place.
+ALTER TABLE assets ADD COLUMN retain_until TIMESTAMP;
+
+CREATE OR REPLACE FUNCTION prevent_retained_asset_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF OLD.retain_until IS NULL OR OLD.retain_until <= NOW() THEN
+        RETURN CASE WHEN TG_OP = 'DELETE' THEN OLD ELSE NEW END;
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'asset % is retained until %', OLD.id, OLD.retain_until;
+    END IF;
+    IF NEW.file_path IS DISTINCT FROM OLD.file_path
+        OR NEW.checksum IS DISTINCT FROM OLD.checksum
+        OR NEW.file_size IS DISTINCT FROM OLD.file_size
+        OR NEW.user_id IS DISTINCT FROM OLD.user_id
+        OR NEW.project_id IS DISTINCT FROM OLD.project_id
+        OR NEW.retain_until IS NULL OR NEW.retain_until < OLD.retain_until THEN
+        RAISE EXCEPTION 'asset % is retained until %', OLD.id, OLD.retain_until;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER assets_retention_lock
+    BEFORE UPDATE OR DELETE ON assets
+    FOR EACH ROW
+    EXECUTE FUNCTION prevent_retained_asset_change();
+
+CREATE TABLE compliance_snapshots (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id UUID NOT NULL REFERENCES organizations(id),
+    -- Not a foreign key: snapshots outlive the project
+    project_id UUID NOT NULL,
+    project_title VARCHAR(255) NOT NULL,
+    revision INTEGER NOT NULL,
+    -- period is the first day of the scheduled period the snapshot covers
+    period DATE NOT NULL,
+    frequency VARCHAR(20) NOT NULL,
+    format VARCHAR(20) NOT NULL,
+    asset_id UUID NOT NULL REFERENCES assets(id),
+    sha256 VARCHAR(64) NOT NULL,
+    file_size BIGINT NOT NULL,
+    retain_until TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, project_id, period, format)
+);
+
+CREATE INDEX idx_compliance_snapshots_org_created ON compliance_snapshots(org_id, created_at DESC);
+
+CREATE OR REPLACE FUNCTION prevent_compliance_snapshot_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' AND OLD.retain_until <= NOW() THEN
+        RETURN OLD;
+    END IF;
+    RAISE EXCEPTION 'compliance snapshot % is immutable until %', OLD.id, OLD.retain_until;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER compliance_snapshots_worm
+    BEFORE UPDATE OR DELETE ON compliance_snapshots
+    FOR EACH ROW
+    EXECUTE FUNCTION prevent_compliance_snapshot_change();
@@ -0,0 +1,16 @@
+-- Shared component usage: how many instances of each component version a
+-- project's canvas holds, refreshed on every canvas save. Rows of
+-- components a project no longer uses are kept with zero instances, so
+-- last_used_at still tells when it was last seen.
+CREATE TABLE project_component_usage (
+    project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    component_id VARCHAR(255) NOT NULL,
+    -- version is empty for instances that do not name one
+    version VARCHAR(50) NOT NULL DEFAULT '',
+    instances INTEGER NOT NULL,
+    first_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (project_id, component_id, version)
+);
+
+CREATE INDEX idx_project_component_usage_component ON project_component_usage(component_id, version);
@@ -0,0 +1,3 @@
+-- Per-project editor settings (grid, units, background, snapping, bleed).
+-- An empty document means the defaults; see project/editorsettings.go.
+ALTER TABLE projects ADD COLUMN settings JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,7 @@
+-- Autosave bursts. autosaved_at is when the current revision was written
+-- by an autosave (NULL after any other save). autosave_pending marks a
+-- revision whose save announcement was deferred until the burst ends.
+ALTER TABLE projects ADD COLUMN autosaved_at TIMESTAMP;
+ALTER TABLE projects ADD COLUMN autosave_pending BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX idx_projects_autosave_pending ON projects(autosaved_at) WHERE autosave_pending;
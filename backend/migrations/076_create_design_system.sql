@@ -0,0 +1,41 @@
+-- Design system documentation: an organization's design tokens and usage
+-- guidelines, notes on its shared components, and the static docs site
+-- generated from them.
+CREATE TABLE design_libraries (
+    org_id UUID PRIMARY KEY REFERENCES organizations(id) ON DELETE CASCADE,
+    tokens JSONB NOT NULL DEFAULT '{}',
+    guidelines TEXT NOT NULL DEFAULT '',
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE design_component_docs (
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    component_id VARCHAR(255) NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    guidelines TEXT NOT NULL DEFAULT '',
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (org_id, component_id)
+);
+
+-- source_hash identifies what the site was last built from, so unchanged
+-- libraries are not rebuilt.
+CREATE TABLE design_sites (
+    org_id UUID PRIMARY KEY REFERENCES organizations(id) ON DELETE CASCADE,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'building',
+    error TEXT,
+    source_hash VARCHAR(64),
+    built_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE design_site_files (
+    org_id UUID NOT NULL REFERENCES design_sites(org_id) ON DELETE CASCADE,
+    path VARCHAR(255) NOT NULL,
+    asset_id UUID NOT NULL REFERENCES assets(id) ON DELETE CASCADE,
+    PRIMARY KEY (org_id, path)
+);
@@ -0,0 +1,21 @@
+-- SAML domain verification. A configuration only signs users in once its
+-- organization proved it owns the domain with a DNS TXT record, so a
+-- domain is only unique among verified configurations. Existing
+-- configurations must verify before single sign-on works again.
+ALTER TABLE saml_configs ADD COLUMN verification_token VARCHAR(64);
+ALTER TABLE saml_configs ADD COLUMN domain_verified_at TIMESTAMP;
+UPDATE saml_configs SET verification_token = md5(random()::text || id::text);
+ALTER TABLE saml_configs ALTER COLUMN verification_token SET NOT NULL;
+
+ALTER TABLE saml_configs DROP CONSTRAINT saml_configs_domain_key;
+CREATE UNIQUE INDEX idx_saml_configs_verified_domain ON saml_configs(lower(domain)) WHERE domain_verified_at IS NOT NULL;
+
+-- Service provider initiated logins waiting for the IdP's response. Each
+-- is accepted once, so responses the app did not ask for are refused.
+CREATE TABLE saml_login_requests (
+    id VARCHAR(64) PRIMARY KEY,
+    org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_saml_login_requests_expires_at ON saml_login_requests(expires_at);
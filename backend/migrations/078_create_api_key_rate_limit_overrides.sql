@@ -0,0 +1,8 @@
+-- Admin overrides of the API rate limit for individual API keys. A key with
+-- an override is counted on its own instead of against its owner's limit.
+CREATE TABLE api_key_rate_limit_overrides (
+    api_key_id UUID PRIMARY KEY REFERENCES api_keys(id) ON DELETE CASCADE,
+    requests_per_minute INTEGER NOT NULL CHECK (requests_per_minute > 0),
+    set_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
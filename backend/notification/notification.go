@@ -0,0 +1,156 @@
+// Package notification delivers in-app notifications to users. Other
+// services publish to the Notifications topic; the notification service
+// persists them and serves each user's inbox.
+package notification
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+)
+
+// Notification is a message for a single user
+type Notification struct {
+	ID        string          `json:"id"`
+	UserID    string          `json:"userId"`
+	Kind      string          `json:"kind"`
+	Title     string          `json:"title"`
+	Body      string          `json:"body,omitempty"`
+	Link      string          `json:"link,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ReadAt    *time.Time      `json:"readAt,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// Message is published by services that want to notify a user
+type Message struct {
+	UserID string          `json:"userId"`
+	Kind   string          `json:"kind"`
+	Title  string          `json:"title"`
+	Body   string          `json:"body,omitempty"`
+	Link   string          `json:"link,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// ListNotificationsRequest represents the list notifications request
+type ListNotificationsRequest struct {
+	UnreadOnly bool `query:"unread"`
+	Limit      int  `query:"limit"`
+}
+
+// ListNotificationsResponse represents the list notifications response
+type ListNotificationsResponse struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int            `json:"unread"`
+}
+
+// Notifications is the topic other services publish notifications to.
+var Notifications = pubsub.NewTopic[*Message]("notifications", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(Notifications, "store-notification", pubsub.SubscriptionConfig[*Message]{
+	Handler: store,
+})
+
+var db = sqldb.NewDatabase("notification", sqldb.DatabaseConfig{
+	Migrations: "../migrations",
+})
+
+// Send publishes a notification for a user.
+func Send(ctx context.Context, msg *Message) error {
+	_, err := Notifications.Publish(ctx, msg)
+	return err
+}
+
+func store(ctx context.Context, msg *Message) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO notifications (user_id, kind, title, body, link, data)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, msg.UserID, msg.Kind, msg.Title, msg.Body, msg.Link, nullJSON(msg.Data))
+	return err
+}
+
+//encore:api auth method=GET path=/notifications
+func ListNotifications(ctx context.Context, req *ListNotificationsRequest) (*ListNotificationsResponse, error) {
+	userID := auth.UserID()
+
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, user_id, kind, title, COALESCE(body, ''), COALESCE(link, ''), data, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1 AND ($2 = FALSE OR read_at IS NULL)
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, userID, req.UnreadOnly, limit)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list notifications", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch notifications",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListNotificationsResponse{Notifications: []Notification{}}
+	for rows.Next() {
+		var n Notification
+		var data []byte
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &n.Title, &n.Body, &n.Link, &data, &readAt, &n.CreatedAt); err != nil {
+			continue
+		}
+		n.Data = data
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+		resp.Notifications = append(resp.Notifications, n)
+	}
+
+	if err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL
+	`, userID).Scan(&resp.Unread); err != nil {
+		reqctx.Logger(ctx).Error("failed to count unread notifications", "error", err)
+	}
+	return resp, nil
+}
+
+//encore:api auth method=POST path=/notifications/:id/read
+func MarkRead(ctx context.Context, id string) error {
+	result, err := db.Exec(ctx, `
+		UPDATE notifications SET read_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND read_at IS NULL
+	`, id, auth.UserID())
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update notification",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Notification not found",
+		}
+	}
+	return nil
+}
+
+func nullJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return []byte(raw)
+}
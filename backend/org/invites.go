@@ -0,0 +1,289 @@
+package org
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/notification"
+	"canvasai/reqctx"
+	"canvasai/webhook"
+)
+
+// Invites are addressed to an email rather than a user, so people can be
+// invited before they have an account. Whoever signs in with a verified
+// address sees the invites sent to it and can accept or decline them.
+
+const inviteLifetime = 14 * 24 * time.Hour
+
+// Invite is a pending invitation to join an organization
+type Invite struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"orgId"`
+	OrgName   string    `json:"orgName,omitempty"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invitedBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CreateInviteRequest represents the create invite request
+type CreateInviteRequest struct {
+	Email string `json:"email"`
+	// Role defaults to member
+	Role string `json:"role,omitempty"`
+}
+
+// ListInvitesResponse represents the list invites response
+type ListInvitesResponse struct {
+	Invites []Invite `json:"invites"`
+}
+
+// CreateInvite invites an email address to the organization. Inviting an
+// address that already has an open invite replaces it, which also serves
+// as a resend.
+//
+//encore:api auth method=POST path=/orgs/:orgID/invites
+func CreateInvite(ctx context.Context, orgID string, req *CreateInviteRequest) (*Invite, error) {
+	if _, err := requireRole(ctx, orgID, RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if at := strings.LastIndex(email, "@"); at < 1 || at == len(email)-1 || len(email) > 255 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid email address",
+		}
+	}
+	role := req.Role
+	if role == "" {
+		role = RoleMember
+	}
+	if !validRole(role) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Role must be admin, member, guest or client",
+		}
+	}
+
+	var existing string
+	err := db.QueryRow(ctx, `
+		SELECT u.id FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1 AND lower(u.email) = $2
+	`, orgID, email).Scan(&existing)
+	if err == nil {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "This person is already a member",
+		}
+	} else if err != sql.ErrNoRows {
+		reqctx.Logger(ctx).Error("failed to check membership", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create invite",
+		}
+	}
+
+	inv := &Invite{OrgID: orgID, Email: email, Role: role, InvitedBy: auth.UserID()}
+	err = db.QueryRow(ctx, `
+		INSERT INTO org_invites (org_id, email, role, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (org_id, lower(email)) WHERE accepted_at IS NULL DO UPDATE
+		SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by,
+			created_at = NOW(), expires_at = EXCLUDED.expires_at
+		RETURNING id, created_at, expires_at
+	`, orgID, email, role, inv.InvitedBy, time.Now().Add(inviteLifetime)).Scan(&inv.ID, &inv.CreatedAt, &inv.ExpiresAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create invite", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create invite",
+		}
+	}
+
+	notifyInvitee(ctx, inv)
+	return inv, nil
+}
+
+//encore:api auth method=GET path=/orgs/:orgID/invites
+func ListInvites(ctx context.Context, orgID string) (*ListInvitesResponse, error) {
+	if _, err := requireRole(ctx, orgID, RoleAdmin); err != nil {
+		return nil, err
+	}
+	return queryInvites(ctx, `i.org_id = $1`, orgID)
+}
+
+//encore:api auth method=DELETE path=/orgs/:orgID/invites/:inviteID
+func RevokeInvite(ctx context.Context, orgID string, inviteID string) error {
+	if _, err := requireRole(ctx, orgID, RoleAdmin); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM org_invites WHERE id = $1 AND org_id = $2 AND accepted_at IS NULL
+	`, inviteID, orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to revoke invite", "org_id", orgID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to revoke invite",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite not found",
+		}
+	}
+	return nil
+}
+
+// ListMyInvites lists the open invites addressed to the caller's verified
+// email.
+//
+//encore:api auth method=GET path=/org-invites
+func ListMyInvites(ctx context.Context) (*ListInvitesResponse, error) {
+	return queryInvites(ctx, `lower(i.email) = (
+		SELECT lower(email) FROM users WHERE id = $1 AND email_verified AND NOT is_guest
+	)`, auth.UserID())
+}
+
+//encore:api auth method=POST path=/org-invites/:id/accept
+func AcceptInvite(ctx context.Context, id string) (*Organization, error) {
+	userID := auth.UserID()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to accept invite",
+		}
+	}
+	defer tx.Rollback()
+
+	var inv Invite
+	err = tx.QueryRow(ctx, `
+		UPDATE org_invites i SET accepted_at = NOW()
+		FROM users u
+		WHERE i.id = $1 AND u.id = $2 AND lower(i.email) = lower(u.email)
+			AND u.email_verified AND NOT u.is_guest
+			AND i.accepted_at IS NULL AND i.expires_at > NOW()
+		RETURNING i.org_id, i.email, i.role, COALESCE(i.invited_by::text, '')
+	`, id, userID).Scan(&inv.OrgID, &inv.Email, &inv.Role, &inv.InvitedBy)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite not found or expired",
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO organization_members (org_id, user_id, role)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, user_id) DO NOTHING
+		`, inv.OrgID, userID, inv.Role)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to accept invite", "invite_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to accept invite",
+		}
+	}
+
+	data := map[string]string{"userId": userID, "email": inv.Email, "role": inv.Role}
+	if inv.InvitedBy != "" {
+		data["invitedBy"] = inv.InvitedBy
+	}
+	if err := webhook.Emit(ctx, &webhook.Event{Type: webhook.EventMemberJoined, OrgID: inv.OrgID}, data); err != nil {
+		reqctx.Logger(ctx).Warn("failed to emit member joined event", "org_id", inv.OrgID, "error", err)
+	}
+	return GetOrg(ctx, inv.OrgID)
+}
+
+//encore:api auth method=DELETE path=/org-invites/:id
+func DeclineInvite(ctx context.Context, id string) error {
+	result, err := db.Exec(ctx, `
+		DELETE FROM org_invites i
+		USING users u
+		WHERE i.id = $1 AND u.id = $2 AND lower(i.email) = lower(u.email)
+			AND u.email_verified AND i.accepted_at IS NULL
+	`, id, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to decline invite", "invite_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to decline invite",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite not found",
+		}
+	}
+	return nil
+}
+
+func queryInvites(ctx context.Context, where string, arg any) (*ListInvitesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT i.id, i.org_id, o.name, i.email, i.role, COALESCE(i.invited_by::text, ''), i.created_at, i.expires_at
+		FROM org_invites i
+		JOIN organizations o ON o.id = i.org_id
+		WHERE i.accepted_at IS NULL AND i.expires_at > NOW() AND `+where+`
+		ORDER BY i.created_at DESC
+	`, arg)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list invites", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch invites",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListInvitesResponse{Invites: []Invite{}}
+	for rows.Next() {
+		var inv Invite
+		if err := rows.Scan(&inv.ID, &inv.OrgID, &inv.OrgName, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			continue
+		}
+		resp.Invites = append(resp.Invites, inv)
+	}
+	return resp, nil
+}
+
+// notifyInvitee tells an existing user about their invite in-app. People
+// without an account find it after signing up.
+func notifyInvitee(ctx context.Context, inv *Invite) {
+	var userID, orgName string
+	err := db.QueryRow(ctx, `
+		SELECT u.id, o.name FROM users u, organizations o
+		WHERE lower(u.email) = $1 AND o.id = $2 AND u.email_verified AND NOT u.is_guest
+	`, inv.Email, inv.OrgID).Scan(&userID, &orgName)
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"inviteId": inv.ID, "orgId": inv.OrgID, "role": inv.Role})
+	err = notification.Send(ctx, &notification.Message{
+		UserID: userID,
+		Kind:   "org.invite",
+		Title:  "You're invited to join " + orgName,
+		Link:   "/invites",
+		Data:   data,
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to notify invitee", "invite_id", inv.ID, "error", err)
+	}
+}
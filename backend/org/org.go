@@ -0,0 +1,365 @@
+// Package org manages organizations (workspaces): who belongs to them and
+// with which role. Projects and assets created in an organization belong to
+// it; the project and asset services resolve access through membership.
+package org
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+)
+
+// Member roles
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+	// RoleClient is an external client who only sees the projects shared
+	// to the organization's client portal
+	RoleClient = "client"
+)
+
+// Organization is a workspace
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Role is the caller's role in the organization
+	Role    string   `json:"role"`
+	Members []Member `json:"members,omitempty"`
+}
+
+// Member is a user's membership of an organization
+type Member struct {
+	UserID        string    `json:"userId"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	Role          string    `json:"role"`
+	ProvisionedBy string    `json:"provisionedBy,omitempty"`
+	JoinedAt      time.Time `json:"joinedAt"`
+}
+
+// CreateOrgRequest represents the create organization request
+type CreateOrgRequest struct {
+	Name string `json:"name"`
+	// Slug defaults to one derived from the name
+	Slug string `json:"slug,omitempty"`
+}
+
+// UpdateMemberRequest represents the update member request
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// ListOrgsResponse represents the list organizations response
+type ListOrgsResponse struct {
+	Organizations []Organization `json:"organizations"`
+}
+
+var db = sqldb.NewDatabase("org", sqldb.DatabaseConfig{
+	Migrations: "../migrations",
+})
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+//encore:api auth method=POST path=/orgs
+func CreateOrg(ctx context.Context, req *CreateOrgRequest) (*Organization, error) {
+	userID := auth.UserID()
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 255 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name must be between 1 and 255 characters",
+		}
+	}
+	slug := req.Slug
+	if slug == "" {
+		slug = slugify(name)
+	}
+	if !slugPattern.MatchString(slug) || len(slug) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Slug must be lowercase letters, digits and dashes",
+		}
+	}
+
+	var guest bool
+	if err := db.QueryRow(ctx, `SELECT is_guest FROM users WHERE id = $1`, userID).Scan(&guest); err != nil {
+		reqctx.Logger(ctx).Error("failed to check guest status", "user_id", userID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create organization",
+		}
+	}
+	if guest {
+		return nil, &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Sign up to create organizations",
+		}
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create organization",
+		}
+	}
+	defer tx.Rollback()
+
+	o := &Organization{Name: name, Slug: slug, CreatedBy: userID, Role: RoleAdmin}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO organizations (name, slug, created_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (slug) DO NOTHING
+		RETURNING id, created_at
+	`, o.Name, o.Slug, userID).Scan(&o.ID, &o.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "An organization with this slug already exists",
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, $3)
+		`, o.ID, userID, RoleAdmin)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create organization", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create organization",
+		}
+	}
+
+	reqctx.Logger(ctx).Info("organization created", "org_id", o.ID)
+	return o, nil
+}
+
+//encore:api auth method=GET path=/orgs
+func ListOrgs(ctx context.Context) (*ListOrgsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT o.id, o.name, o.slug, COALESCE(o.created_by::text, ''), o.created_at, m.role
+		FROM organizations o
+		JOIN organization_members m ON m.org_id = o.id
+		WHERE m.user_id = $1
+		ORDER BY o.name
+	`, auth.UserID())
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch organizations",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListOrgsResponse{Organizations: []Organization{}}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.Slug, &o.CreatedBy, &o.CreatedAt, &o.Role); err != nil {
+			continue
+		}
+		resp.Organizations = append(resp.Organizations, o)
+	}
+	return resp, nil
+}
+
+//encore:api auth method=GET path=/orgs/:orgID
+func GetOrg(ctx context.Context, orgID string) (*Organization, error) {
+	role, err := requireRole(ctx, orgID, RoleAdmin, RoleMember, RoleGuest)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Organization{Role: role, Members: []Member{}}
+	err = db.QueryRow(ctx, `
+		SELECT id, name, slug, COALESCE(created_by::text, ''), created_at FROM organizations WHERE id = $1
+	`, orgID).Scan(&o.ID, &o.Name, &o.Slug, &o.CreatedBy, &o.CreatedAt)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Organization not found",
+		}
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT u.id, u.name, u.email, m.role, COALESCE(m.provisioned_by, ''), m.joined_at
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1 AND u.deactivated_at IS NULL
+		ORDER BY u.name
+	`, orgID)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var m Member
+			if err := rows.Scan(&m.UserID, &m.Name, &m.Email, &m.Role, &m.ProvisionedBy, &m.JoinedAt); err == nil {
+				o.Members = append(o.Members, m)
+			}
+		}
+	}
+	return o, nil
+}
+
+//encore:api auth method=PATCH path=/orgs/:orgID/members/:userID
+func UpdateMember(ctx context.Context, orgID string, userID string, req *UpdateMemberRequest) error {
+	if _, err := requireRole(ctx, orgID, RoleAdmin); err != nil {
+		return err
+	}
+	if !validRole(req.Role) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Role must be admin, member, guest or client",
+		}
+	}
+	return changeMembership(ctx, orgID, userID, func(tx *sqldb.Tx) (sqldb.ExecResult, error) {
+		return tx.Exec(ctx, `UPDATE organization_members SET role = $3 WHERE org_id = $1 AND user_id = $2`, orgID, userID, req.Role)
+	})
+}
+
+// RemoveMember removes a member from the organization. Admins can remove
+// anyone; members can remove themselves to leave.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/members/:userID
+func RemoveMember(ctx context.Context, orgID string, userID string) error {
+	if userID != auth.UserID() {
+		if _, err := requireRole(ctx, orgID, RoleAdmin); err != nil {
+			return err
+		}
+	}
+	return changeMembership(ctx, orgID, userID, func(tx *sqldb.Tx) (sqldb.ExecResult, error) {
+		return tx.Exec(ctx, `DELETE FROM organization_members WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+	})
+}
+
+// changeMembership runs change against a member's row, refusing to leave
+// the organization without an admin.
+func changeMembership(ctx context.Context, orgID, userID string, change func(tx *sqldb.Tx) (sqldb.ExecResult, error)) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update member",
+		}
+	}
+	defer tx.Rollback()
+
+	// Lock the admin rows so two admins demoting each other cannot both win.
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM organization_members WHERE org_id = $1 AND role = $2 FOR UPDATE`, orgID, RoleAdmin); err != nil {
+		reqctx.Logger(ctx).Error("failed to lock admins", "org_id", orgID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update member",
+		}
+	}
+
+	result, err := change(tx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update member", "org_id", orgID, "user_id", userID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update member",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Member not found",
+		}
+	}
+
+	var admins int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM organization_members WHERE org_id = $1 AND role = $2`, orgID, RoleAdmin).Scan(&admins); err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update member",
+		}
+	}
+	if admins == 0 {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "An organization needs at least one admin",
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update member",
+		}
+	}
+	return nil
+}
+
+// requireRole returns the caller's role in orgID, or an error unless it is
+// one of roles. Non-members are told the organization does not exist.
+func requireRole(ctx context.Context, orgID string, roles ...string) (string, error) {
+	var role string
+	err := db.QueryRow(ctx, `
+		SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2
+	`, orgID, auth.UserID()).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Organization not found",
+		}
+	}
+	if err != nil {
+		return "", &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check organization membership",
+		}
+	}
+	for _, r := range roles {
+		if role == r {
+			return role, nil
+		}
+	}
+	return "", &errs.Error{
+		Code:    errs.PermissionDenied,
+		Message: "Organization admin access required",
+	}
+}
+
+func validRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember || role == RoleGuest || role == RoleClient
+}
+
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if len(slug) > 60 {
+		slug = strings.TrimSuffix(slug[:60], "-")
+	}
+	if slug == "" {
+		slug = "workspace"
+	}
+	return slug
+}
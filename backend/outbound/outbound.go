@@ -0,0 +1,300 @@
+// Package outbound provides the HTTP client used for every server-initiated
+// request to a URL we do not control (webhooks, link unfurls, imports,
+// third-party APIs). Clients refuse to connect to private, loopback and
+// other non-public addresses, check the address actually dialed so DNS
+// rebinding cannot swap in an internal IP after validation, and enforce
+// time, size and per-destination rate limits.
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"canvasai/faults"
+	"canvasai/ratelimit"
+)
+
+var (
+	ErrBlockedAddress   = errors.New("outbound: destination address is not allowed")
+	ErrHostNotAllowed   = errors.New("outbound: destination host is not allowed")
+	ErrRateLimited      = errors.New("outbound: too many requests to destination")
+	ErrResponseTooLarge = errors.New("outbound: response body too large")
+)
+
+// Policy configures a client. Zero fields take the defaults below.
+type Policy struct {
+	// Timeout bounds the whole request, including reading the body
+	Timeout time.Duration
+	// MaxResponseBytes caps the response body; reads past it fail with
+	// ErrResponseTooLarge
+	MaxResponseBytes int64
+	// AllowedHosts restricts destinations to these hosts. A leading dot
+	// matches subdomains (".example.com"). Empty allows any public host.
+	AllowedHosts []string
+	// AllowedPorts restricts destination ports (default 80 and 443)
+	AllowedPorts []int
+	// RateLimit caps requests per destination host. Zero disables it.
+	RateLimit ratelimit.Limit
+	// MaxRedirects is how many redirects are followed (default 5)
+	MaxRedirects int
+}
+
+const (
+	defaultTimeout          = 10 * time.Second
+	defaultMaxResponseBytes = 10 << 20
+	defaultMaxRedirects     = 5
+	dialTimeout             = 5 * time.Second
+)
+
+var defaultPorts = []int{80, 443}
+
+// NewClient returns an *http.Client that applies the policy. Proxy settings
+// from the environment are ignored, since a proxy would dial on our behalf
+// and bypass the address checks.
+func NewClient(p Policy) *http.Client {
+	if p.Timeout <= 0 {
+		p.Timeout = defaultTimeout
+	}
+	if p.MaxResponseBytes <= 0 {
+		p.MaxResponseBytes = defaultMaxResponseBytes
+	}
+	if len(p.AllowedPorts) == 0 {
+		p.AllowedPorts = defaultPorts
+	}
+	if p.MaxRedirects <= 0 {
+		p.MaxRedirects = defaultMaxRedirects
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			return checkDial(p, network, address)
+		},
+	}
+	t := &transport{
+		policy: p,
+		limits: ratelimit.New(p.RateLimit),
+		next: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   dialTimeout,
+			ResponseHeaderTimeout: p.Timeout,
+		},
+	}
+	return &http.Client{
+		Transport: t,
+		Timeout:   p.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > p.MaxRedirects {
+				return fmt.Errorf("outbound: stopped after %d redirects", p.MaxRedirects)
+			}
+			return checkURL(p, req.URL)
+		},
+	}
+}
+
+// CheckURL reports whether a client with the policy may fetch rawURL,
+// resolving its host now. It gives callers early feedback (e.g. when a
+// webhook URL is registered); clients re-check every address they dial.
+func CheckURL(ctx context.Context, p Policy, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("outbound: invalid URL: %w", err)
+	}
+	if err := checkURL(p, u); err != nil {
+		return err
+	}
+	if len(p.AllowedPorts) == 0 {
+		p.AllowedPorts = defaultPorts
+	}
+	if !portAllowed(p, urlPort(u)) {
+		return fmt.Errorf("%w: port %d", ErrBlockedAddress, urlPort(u))
+	}
+
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !IsPublic(addr) {
+			return fmt.Errorf("%w: %s", ErrBlockedAddress, addr)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("outbound: resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !IsPublic(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrBlockedAddress, host, addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// transport applies the host allowlist, rate limits and body cap around
+// the underlying transport.
+type transport struct {
+	policy Policy
+	limits *ratelimit.Limiter
+	next   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkURL(t.policy, req.URL); err != nil {
+		return nil, err
+	}
+	if !t.limits.Allow(strings.ToLower(req.URL.Hostname())) {
+		return nil, fmt.Errorf("%w: %s", ErrRateLimited, req.URL.Hostname())
+	}
+	if err := faults.Inject(req.Context(), faults.Provider); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > t.policy.MaxResponseBytes {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, resp.ContentLength)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.policy.MaxResponseBytes}
+	return resp, nil
+}
+
+// checkURL validates the scheme and host of a request or redirect target.
+func checkURL(p Policy, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", ErrBlockedAddress, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: URLs with credentials", ErrBlockedAddress)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrBlockedAddress)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".internal") {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	if len(p.AllowedHosts) > 0 && !hostAllowed(p.AllowedHosts, host) {
+		return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+	}
+	return nil
+}
+
+// checkDial runs for every connection after DNS resolution, so it sees the
+// address actually being connected to.
+func checkDial(p Policy, network, address string) error {
+	if network != "tcp4" && network != "tcp6" {
+		return fmt.Errorf("%w: network %s", ErrBlockedAddress, network)
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, address)
+	}
+	if !IsPublic(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, ap.Addr().Unmap())
+	}
+	if !portAllowed(p, int(ap.Port())) {
+		return fmt.Errorf("%w: port %d", ErrBlockedAddress, ap.Port())
+	}
+	return nil
+}
+
+// nonPublic lists special-purpose ranges not covered by the netip
+// predicates (RFC 6890 and friends).
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 can reach IPv4 internals
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"), // 6to4 embeds arbitrary IPv4
+}
+
+// IsPublic reports whether addr is a globally routable unicast address.
+func IsPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() ||
+		addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublic {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func hostAllowed(allowed []string, host string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if host == strings.TrimPrefix(a, ".") || (strings.HasPrefix(a, ".") && strings.HasSuffix(host, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+func portAllowed(p Policy, port int) bool {
+	for _, allowed := range p.AllowedPorts {
+		if port == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func urlPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	if u.Scheme == "http" {
+		return 80
+	}
+	return 443
+}
+
+// limitedBody fails reads once more than remaining bytes have been read,
+// rather than silently truncating the body.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - int(-b.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
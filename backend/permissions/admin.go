@@ -0,0 +1,106 @@
+package permissions
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+)
+
+// Admin roles are not resource roles: platform admins (users.role) run the
+// service itself, and organization admins (organization_members.role) run
+// an organization. Services check them against their own handle to the
+// database holding those tables.
+
+// adminRole is the value of both role columns that makes a user an admin
+const adminRole = "admin"
+
+// IsPlatformAdmin reports whether userID is a platform admin.
+func IsPlatformAdmin(ctx context.Context, db *sqldb.Database, userID string) (bool, error) {
+	if userID == "" || strings.HasPrefix(userID, ServicePrefix) {
+		return false, nil
+	}
+	var role string
+	err := db.QueryRow(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return role == adminRole, nil
+}
+
+// RequirePlatformAdmin returns nil if the current user is a platform admin,
+// and a PermissionDenied (or Unauthenticated) error otherwise.
+func RequirePlatformAdmin(ctx context.Context, db *sqldb.Database) error {
+	userID := auth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	admin, err := IsPlatformAdmin(ctx, db, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check platform role", "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if !admin {
+		return &errs.Error{Code: errs.PermissionDenied, Message: "admin access required"}
+	}
+	return nil
+}
+
+// RequireOrgAdmin returns nil if the current user is an admin of orgID, and
+// a PermissionDenied (or Unauthenticated) error otherwise.
+func RequireOrgAdmin(ctx context.Context, db *sqldb.Database, orgID string) error {
+	userID := auth.UserID()
+	if userID == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	var role string
+	err := db.QueryRow(ctx, `
+		SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2
+	`, orgID, userID).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		reqctx.Logger(ctx).Error("failed to check organization role", "org_id", orgID, "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if role != adminRole {
+		return &errs.Error{Code: errs.PermissionDenied, Message: "organization admin access required"}
+	}
+	return nil
+}
+
+// RequireOrgRole returns the current user's role in orgID if it is one of
+// roles. Non-members get NotFound so the organization's existence is not
+// revealed; members with another role get PermissionDenied.
+func RequireOrgRole(ctx context.Context, db *sqldb.Database, orgID string, roles ...string) (string, error) {
+	userID := auth.UserID()
+	if userID == "" {
+		return "", &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	var role string
+	err := db.QueryRow(ctx, `
+		SELECT role FROM organization_members WHERE org_id::text = $1 AND user_id = $2
+	`, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", &errs.Error{Code: errs.NotFound, Message: "organization not found"}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check organization role", "org_id", orgID, "error", err)
+		return "", &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	for _, r := range roles {
+		if r == role {
+			return role, nil
+		}
+	}
+	if len(roles) == 1 && roles[0] == adminRole {
+		return "", &errs.Error{Code: errs.PermissionDenied, Message: "organization admin access required"}
+	}
+	return "", &errs.Error{Code: errs.PermissionDenied, Message: "organization role not permitted"}
+}
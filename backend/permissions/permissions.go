@@ -0,0 +1,251 @@
+// Package permissions maps collaborator roles to the capabilities they grant
+// and provides a single Authorize check for every service. Services that own
+// a resource type register a RoleResolver for it; callers only ever ask
+// whether the current user may perform a capability on a resource. Resolved
+// roles are cached briefly, so handlers that check several times, or
+// clients that poll, do not each hit the database. The admin checks every
+// service shares are in admin.go.
+package permissions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// Role is a user's role on a resource
+type Role string
+
+const (
+	RoleNone      Role = ""
+	RoleOwner     Role = "owner"
+	RoleEditor    Role = "editor"
+	RoleCommenter Role = "commenter"
+	RoleViewer    Role = "viewer"
+)
+
+// Capability is an action that can be performed on a resource
+type Capability string
+
+const (
+	ProjectView    Capability = "project.view"
+	ProjectComment Capability = "project.comment"
+	ProjectEdit    Capability = "project.edit"
+	ProjectShare   Capability = "project.share"
+	ProjectDelete  Capability = "project.delete"
+	// ProjectManage covers the owner's settings: where the project is
+	// filed, time tracking and others' time entries
+	ProjectManage Capability = "project.manage"
+
+	AssetView   Capability = "asset.view"
+	AssetUpload Capability = "asset.upload"
+	AssetDelete Capability = "asset.delete"
+)
+
+// roleCapabilities is the declarative role to capability mapping.
+var roleCapabilities = map[Role][]Capability{
+	RoleOwner: {
+		ProjectView, ProjectComment, ProjectEdit, ProjectShare, ProjectDelete, ProjectManage,
+		AssetView, AssetUpload, AssetDelete,
+	},
+	RoleEditor: {
+		ProjectView, ProjectComment, ProjectEdit,
+		AssetView, AssetUpload, AssetDelete,
+	},
+	RoleCommenter: {
+		ProjectView, ProjectComment,
+		AssetView,
+	},
+	RoleViewer: {
+		ProjectView,
+		AssetView,
+	},
+}
+
+var grants = func() map[Role]map[Capability]bool {
+	m := map[Role]map[Capability]bool{}
+	for role, caps := range roleCapabilities {
+		m[role] = map[Capability]bool{}
+		for _, c := range caps {
+			m[role][c] = true
+		}
+	}
+	return m
+}()
+
+// Can reports whether role grants capability.
+func Can(role Role, capability Capability) bool {
+	return grants[role][capability]
+}
+
+// ValidRole reports whether r is one of the known roles.
+func ValidRole(r string) bool {
+	_, ok := roleCapabilities[Role(r)]
+	return ok
+}
+
+// Resource identifies the object a capability is checked against
+type Resource struct {
+	Type string
+	ID   string
+}
+
+// Resource types
+const (
+	TypeProject = "project"
+	TypeAsset   = "asset"
+)
+
+// ServicePrefix starts the user ID of internal services calling with a
+// machine token, e.g. "service:ai". They may view any project or asset;
+// the endpoints they reach are limited by the auth service.
+const ServicePrefix = "service:"
+
+// Project returns the resource for a project.
+func Project(id string) Resource { return Resource{Type: TypeProject, ID: id} }
+
+// Asset returns the resource for an asset.
+func Asset(id string) Resource { return Resource{Type: TypeAsset, ID: id} }
+
+// RoleResolver returns userID's role on the resource with the given ID, or
+// RoleNone if they have no access. It must not return an error for missing
+// resources.
+type RoleResolver func(ctx context.Context, id, userID string) (Role, error)
+
+var (
+	mu        sync.RWMutex
+	resolvers = map[string]RoleResolver{}
+)
+
+const (
+	// roleCacheTTL bounds how long a role change can go unnoticed by
+	// instances that did not make it.
+	roleCacheTTL   = 5 * time.Second
+	maxCachedRoles = 10000
+)
+
+type cacheKey struct {
+	res    Resource
+	userID string
+}
+
+type cachedRole struct {
+	role       Role
+	resolvedAt time.Time
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[cacheKey]cachedRole{}
+)
+
+// RegisterResolver registers the role resolver for a resource type. It is
+// called by the service that owns the resource.
+func RegisterResolver(resourceType string, resolve RoleResolver) {
+	mu.Lock()
+	defer mu.Unlock()
+	resolvers[resourceType] = resolve
+}
+
+// RoleFor returns the current user's role on res.
+func RoleFor(ctx context.Context, res Resource) (Role, error) {
+	return RoleOf(ctx, res, auth.UserID())
+}
+
+type projectsKey struct{}
+
+// WithProjects confines the request in ctx to the given projects: roles on
+// any other project, or on any other type of resource, resolve to RoleNone
+// whatever the user's own access. Project-limited API keys use it.
+func WithProjects(ctx context.Context, projectIDs []string) context.Context {
+	allowed := make(map[string]bool, len(projectIDs))
+	for _, id := range projectIDs {
+		allowed[strings.ToLower(id)] = true
+	}
+	return context.WithValue(ctx, projectsKey{}, allowed)
+}
+
+// confined reports whether ctx is confined to projects that exclude res.
+func confined(ctx context.Context, res Resource) bool {
+	allowed, ok := ctx.Value(projectsKey{}).(map[string]bool)
+	if !ok {
+		return false
+	}
+	return res.Type != TypeProject || !allowed[strings.ToLower(res.ID)]
+}
+
+// RoleOf returns userID's role on res, from the cache when it is fresh.
+func RoleOf(ctx context.Context, res Resource, userID string) (Role, error) {
+	if userID == "" || confined(ctx, res) {
+		return RoleNone, nil
+	}
+	if strings.HasPrefix(userID, ServicePrefix) {
+		return RoleViewer, nil
+	}
+
+	k := cacheKey{res: res, userID: userID}
+	cacheMu.Lock()
+	c, ok := cache[k]
+	cacheMu.Unlock()
+	if ok && time.Since(c.resolvedAt) < roleCacheTTL {
+		return c.role, nil
+	}
+
+	mu.RLock()
+	resolve, ok := resolvers[res.Type]
+	mu.RUnlock()
+	if !ok {
+		return RoleNone, fmt.Errorf("permissions: no resolver registered for %q", res.Type)
+	}
+	role, err := resolve(ctx, res.ID, userID)
+	if err != nil {
+		return RoleNone, err
+	}
+	cacheMu.Lock()
+	if len(cache) >= maxCachedRoles {
+		cache = map[cacheKey]cachedRole{}
+	}
+	cache[k] = cachedRole{role: role, resolvedAt: time.Now()}
+	cacheMu.Unlock()
+	return role, nil
+}
+
+// Forget drops the cached roles on res. Services call it after changing
+// who can access the resource.
+func Forget(res Resource) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for k := range cache {
+		if k.res == res {
+			delete(cache, k)
+		}
+	}
+}
+
+// Authorize returns nil if the current user holds capability on res, and a
+// PermissionDenied (or Unauthenticated) error otherwise.
+func Authorize(ctx context.Context, res Resource, capability Capability) error {
+	if auth.UserID() == "" {
+		return &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+
+	role, err := RoleFor(ctx, res)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to resolve role", "resource", res.Type, "resource_id", res.ID, "error", err)
+		return &errs.Error{Code: errs.Internal, Message: "internal server error"}
+	}
+	if !Can(role, capability) {
+		return &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: fmt.Sprintf("missing permission %s", capability),
+		}
+	}
+	return nil
+}
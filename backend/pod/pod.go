@@ -0,0 +1,304 @@
+// Package pod publishes designs to print-on-demand providers, Printful and
+// Printify. A user connects a store with an API token; a project is then
+// mapped to products of that store, each with a print file (an export or an
+// image asset of the project) and the provider's product configuration.
+// Pushing a product creates or updates it at the provider, which fetches
+// the print file from us (see webhooks.go). The provider's order webhooks
+// report orders placed for the products and their fulfillment status.
+package pod
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+	"canvasai/tokenbox"
+)
+
+var secrets struct {
+	// PODTokenKey is a base64-encoded 32-byte key that seals the providers'
+	// API tokens at rest.
+	PODTokenKey string
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+// Connections and products are stored alongside the projects they publish.
+var db = sqldb.Named("project")
+
+// Providers
+const (
+	ProviderPrintful = "printful"
+	ProviderPrintify = "printify"
+)
+
+// maxConnectionsPerUser bounds the stores a user can connect
+const maxConnectionsPerUser = 10
+
+// Connection is a print-on-demand store a user has connected
+type Connection struct {
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	StoreID   string    `json:"storeId"`
+	StoreName string    `json:"storeName"`
+	Products  int       `json:"products"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ConnectStoreRequest represents the connect store request
+type ConnectStoreRequest struct {
+	Provider string `json:"provider"`
+	// APIToken is a Printful private token or a Printify personal access
+	// token. It is never returned.
+	APIToken string `json:"apiToken"`
+	// StoreID picks one of the token's stores; it may be left out when the
+	// token has only one
+	StoreID string `json:"storeId,omitempty"`
+}
+
+// ListConnectionsResponse represents the list connections response
+type ListConnectionsResponse struct {
+	Connections []Connection `json:"connections"`
+}
+
+// ConnectStore connects a print-on-demand store and subscribes to its order
+// webhooks. A Printful store has a single webhook URL, so connecting it
+// replaces any other service's.
+//
+//encore:api auth method=POST path=/pod/connections
+func ConnectStore(ctx context.Context, req *ConnectStoreRequest) (*Connection, error) {
+	userID := auth.UserID()
+	p, ok := providers[req.Provider]
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Provider must be printful or printify",
+		}
+	}
+	token := strings.TrimSpace(req.APIToken)
+	if token == "" || len(token) > 512 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "An API token is required",
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM pod_connections WHERE user_id = $1`, userID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count pod connections", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect store",
+		}
+	}
+	if count >= maxConnectionsPerUser {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "You can connect up to 10 stores",
+		}
+	}
+
+	stores, err := p.stores(ctx, token)
+	if err != nil {
+		return nil, providerError(ctx, "failed to list pod stores", err)
+	}
+	var picked *store
+	for i := range stores {
+		if stores[i].id == req.StoreID || (req.StoreID == "" && len(stores) == 1) {
+			picked = &stores[i]
+		}
+	}
+	if picked == nil {
+		msg := "Store not found for this token"
+		if req.StoreID == "" && len(stores) > 1 {
+			msg = "This token has several stores; choose one with storeId"
+		}
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: msg,
+		}
+	}
+
+	sealed, err := tokenbox.Seal(secrets.PODTokenKey, token)
+	if errors.Is(err, tokenbox.ErrNoKey) {
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Print-on-demand is not configured",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to seal pod token", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect store",
+		}
+	}
+	webhookToken, err := newToken()
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect store",
+		}
+	}
+	c := &connection{
+		Connection: Connection{Provider: req.Provider, StoreID: picked.id, StoreName: picked.name},
+		token:      token,
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO pod_connections (user_id, provider, store_id, store_name, token_ciphertext, webhook_token)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, provider, store_id) DO NOTHING
+		RETURNING id, created_at
+	`, userID, c.Provider, c.StoreID, c.StoreName, sealed, webhookToken).Scan(&c.ID, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "This store is already connected",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create pod connection", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect store",
+		}
+	}
+
+	webhookIDs, err := p.subscribe(ctx, c, webhookURL(webhookToken))
+	if err != nil {
+		db.Exec(ctx, `DELETE FROM pod_connections WHERE id = $1`, c.ID)
+		return nil, providerError(ctx, "failed to subscribe to pod webhooks", err)
+	}
+	if _, err := db.Exec(ctx, `UPDATE pod_connections SET webhook_ids = $2 WHERE id = $1`, c.ID, webhookIDs); err != nil {
+		reqctx.Logger(ctx).Warn("failed to save pod webhook ids", "connection_id", c.ID, "error", err)
+	}
+
+	reqctx.Logger(ctx).Info("pod store connected", "connection_id", c.ID, "provider", c.Provider)
+	return &c.Connection, nil
+}
+
+//encore:api auth method=GET path=/pod/connections
+func ListConnections(ctx context.Context) (*ListConnectionsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.provider, c.store_id, c.store_name, c.created_at,
+			(SELECT COUNT(*) FROM pod_products p WHERE p.connection_id = c.id)
+		FROM pod_connections c
+		WHERE c.user_id = $1
+		ORDER BY c.created_at
+	`, auth.UserID())
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch connections",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListConnectionsResponse{Connections: []Connection{}}
+	for rows.Next() {
+		var c Connection
+		if err := rows.Scan(&c.ID, &c.Provider, &c.StoreID, &c.StoreName, &c.CreatedAt, &c.Products); err != nil {
+			continue
+		}
+		resp.Connections = append(resp.Connections, c)
+	}
+	return resp, nil
+}
+
+// DisconnectStore removes a connection and its product mappings, and
+// unsubscribes from its webhooks. Products already at the provider are left
+// in the store.
+//
+//encore:api auth method=DELETE path=/pod/connections/:id
+func DisconnectStore(ctx context.Context, id string) error {
+	c, err := getConnection(ctx, id, auth.UserID())
+	if err != nil {
+		return err
+	}
+	if err := providers[c.Provider].unsubscribe(ctx, c); err != nil {
+		// The webhook URL stops resolving once the row is gone.
+		reqctx.Logger(ctx).Warn("failed to unsubscribe from pod webhooks", "connection_id", id, "error", err)
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM pod_connections WHERE id = $1`, c.ID); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete pod connection", "connection_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to disconnect store",
+		}
+	}
+	reqctx.Logger(ctx).Info("pod store disconnected", "connection_id", id)
+	return nil
+}
+
+// connection is a Connection with the credentials to call the provider
+type connection struct {
+	Connection
+	token      string
+	webhookIDs []string
+}
+
+// getConnection loads a connection owned by userID, or any connection when
+// userID is empty.
+func getConnection(ctx context.Context, id, userID string) (*connection, error) {
+	c := &connection{}
+	var sealed []byte
+	err := db.QueryRow(ctx, `
+		SELECT id, provider, store_id, store_name, token_ciphertext, webhook_ids, created_at
+		FROM pod_connections
+		WHERE id::text = $1 AND ($2 = '' OR user_id::text = $2)
+	`, id, userID).Scan(&c.ID, &c.Provider, &c.StoreID, &c.StoreName, &sealed, &c.webhookIDs, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Connection not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load pod connection", "connection_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load connection",
+		}
+	}
+	if c.token, err = tokenbox.Open(secrets.PODTokenKey, sealed); err != nil {
+		reqctx.Logger(ctx).Error("failed to open pod token", "connection_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load connection",
+		}
+	}
+	return c, nil
+}
+
+// providerError turns a failed provider call into an API error, passing on
+// the provider's reason when it rejected the request.
+func providerError(ctx context.Context, msg string, err error) error {
+	var pe *apiError
+	if errors.As(err, &pe) && pe.status < 500 {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: pe.provider + " rejected the request: " + pe.message,
+		}
+	}
+	reqctx.Logger(ctx).Error(msg, "error", err)
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "The print-on-demand provider could not be reached",
+	}
+}
+
+// newToken returns an unguessable URL path secret.
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,445 @@
+package pod
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+const (
+	maxProductsPerProject = 50
+	maxVariants           = 100
+)
+
+// Product statuses
+const (
+	StatusPending = "pending"
+	StatusPushed  = "pushed"
+	StatusFailed  = "failed"
+)
+
+// Product maps a project to a product of a connected store
+type Product struct {
+	ID           string `json:"id"`
+	ProjectID    string `json:"projectId"`
+	ConnectionID string `json:"connectionId"`
+	Provider     string `json:"provider"`
+	// AssetID is the print file; it is empty once the file has been deleted,
+	// for example when its export expired
+	AssetID     string        `json:"assetId,omitempty"`
+	ExportJobID string        `json:"exportJobId,omitempty"`
+	Config      ProductConfig `json:"config"`
+	// ExternalProductID is the product's ID at the provider once pushed
+	ExternalProductID string     `json:"externalProductId,omitempty"`
+	Status            string     `json:"status"`
+	LastError         string     `json:"lastError,omitempty"`
+	PushedAt          *time.Time `json:"pushedAt,omitempty"`
+	CreatedBy         string     `json:"createdBy,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt"`
+	UpdatedAt         time.Time  `json:"updatedAt"`
+}
+
+// ProductConfig is how a product is set up at the provider
+type ProductConfig struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// BlueprintID and PrintProviderID pick the Printify catalog product and
+	// who prints it; Printful products are picked by their variants
+	BlueprintID     int64 `json:"blueprintId,omitempty"`
+	PrintProviderID int64 `json:"printProviderId,omitempty"`
+	// Placement is where the print file goes: a Printful file type such as
+	// default or back, or a Printify position such as front
+	Placement string          `json:"placement,omitempty"`
+	Variants  []VariantConfig `json:"variants"`
+}
+
+// VariantConfig is a catalog variant to sell, such as a size and color
+type VariantConfig struct {
+	VariantID  int64 `json:"variantId"`
+	PriceCents int   `json:"priceCents"`
+}
+
+// SaveProductRequest represents the create and update product requests.
+// The print file is a completed export of the project, or an image asset
+// of it.
+type SaveProductRequest struct {
+	ConnectionID string        `json:"connectionId,omitempty"`
+	ExportJobID  string        `json:"exportJobId,omitempty"`
+	AssetID      string        `json:"assetId,omitempty"`
+	Config       ProductConfig `json:"config"`
+}
+
+// ListProductsResponse represents the list products response
+type ListProductsResponse struct {
+	Products []Product `json:"products"`
+}
+
+// CreateProduct maps the project to a new product of one of the caller's
+// stores and pushes it. A failed push is recorded on the product, which can
+// be pushed again.
+//
+//encore:api auth method=POST path=/projects/:id/pod-products
+func CreateProduct(ctx context.Context, id string, req *SaveProductRequest) (*Product, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	userID := auth.UserID()
+	c, err := getConnection(ctx, req.ConnectionID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(c.Provider, &req.Config); err != nil {
+		return nil, err
+	}
+	assetID, exportJobID, err := printFile(ctx, id, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM pod_products WHERE project_id = $1`, id).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count pod products", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create product",
+		}
+	}
+	if count >= maxProductsPerProject {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "A project can have up to 50 products",
+		}
+	}
+
+	fileToken, err := newToken()
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create product",
+		}
+	}
+	config, _ := json.Marshal(req.Config)
+	var productID string
+	err = db.QueryRow(ctx, `
+		INSERT INTO pod_products (project_id, connection_id, asset_id, export_job_id, config, file_token, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, id, c.ID, assetID, exportJobID, config, fileToken, userID).Scan(&productID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create pod product", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create product",
+		}
+	}
+	reqctx.Logger(ctx).Info("pod product created", "project_id", id, "product_id", productID, "provider", c.Provider)
+	return pushProduct(ctx, id, productID)
+}
+
+//encore:api auth method=GET path=/projects/:id/pod-products
+func ListProducts(ctx context.Context, id string) (*ListProductsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, productColumns+` WHERE p.project_id = $1 ORDER BY p.created_at`, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch products",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListProductsResponse{Products: []Product{}}
+	for rows.Next() {
+		p, _, err := scanProduct(rows)
+		if err != nil {
+			continue
+		}
+		resp.Products = append(resp.Products, *p)
+	}
+	return resp, nil
+}
+
+// UpdateProduct replaces a product's print file and configuration and
+// pushes it again. Its store cannot be changed.
+//
+//encore:api auth method=PUT path=/projects/:id/pod-products/:productID
+func UpdateProduct(ctx context.Context, id string, productID string, req *SaveProductRequest) (*Product, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	p, _, err := getProduct(ctx, id, productID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getConnection(ctx, p.ConnectionID, auth.UserID()); errs.Code(err) == errs.NotFound {
+		return nil, &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only the person who connected this store can change its products",
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if req.ConnectionID != "" && req.ConnectionID != p.ConnectionID {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "A product's store cannot be changed; create a new product instead",
+		}
+	}
+	if err := validateConfig(p.Provider, &req.Config); err != nil {
+		return nil, err
+	}
+	assetID, exportJobID, err := printFile(ctx, id, req)
+	if err != nil {
+		return nil, err
+	}
+	config, _ := json.Marshal(req.Config)
+	_, err = db.Exec(ctx, `
+		UPDATE pod_products SET asset_id = $2, export_job_id = $3, config = $4, updated_at = NOW()
+		WHERE id = $1
+	`, p.ID, assetID, exportJobID, config)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update pod product", "product_id", p.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update product",
+		}
+	}
+	return pushProduct(ctx, id, p.ID)
+}
+
+// PushProduct pushes a product to its store again, such as after a failed
+// push.
+//
+//encore:api auth method=POST path=/projects/:id/pod-products/:productID/push
+func PushProduct(ctx context.Context, id string, productID string) (*Product, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	return pushProduct(ctx, id, productID)
+}
+
+// DeleteProduct removes a product mapping and its order history. The
+// product is left in the store.
+//
+//encore:api auth method=DELETE path=/projects/:id/pod-products/:productID
+func DeleteProduct(ctx context.Context, id string, productID string) error {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `DELETE FROM pod_products WHERE id::text = $1 AND project_id = $2`, productID, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete pod product", "product_id", productID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete product",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Product not found",
+		}
+	}
+	return nil
+}
+
+// pushProduct creates or updates a product at its provider and records the
+// outcome. Provider failures are saved on the product and returned.
+// Changes to a product are only saved once the caller has been checked
+// here, so UpdateProduct checks the connection first as well.
+func pushProduct(ctx context.Context, projectID, productID string) (*Product, error) {
+	p, fileToken, err := getProduct(ctx, projectID, productID)
+	if err != nil {
+		return nil, err
+	}
+	if p.AssetID == "" {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "The print file has been deleted; choose a new one",
+		}
+	}
+	// The store's token is the connecting user's, so only they push to it.
+	c, err := getConnection(ctx, p.ConnectionID, auth.UserID())
+	if errs.Code(err) == errs.NotFound {
+		return nil, &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only the person who connected this store can push to it",
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	externalID, pushErr := providers[c.Provider].push(ctx, c, p, fileURL(fileToken))
+	if pushErr != nil {
+		reqctx.Logger(ctx).Warn("pod product push failed", "product_id", p.ID, "error", pushErr)
+		if _, err := db.Exec(ctx, `
+			UPDATE pod_products SET status = $2, last_error = $3, updated_at = NOW() WHERE id = $1
+		`, p.ID, StatusFailed, pushErr.Error()); err != nil {
+			reqctx.Logger(ctx).Error("failed to record pod push failure", "product_id", p.ID, "error", err)
+		}
+		return nil, providerError(ctx, "failed to push pod product", pushErr)
+	}
+	_, err = db.Exec(ctx, `
+		UPDATE pod_products
+		SET status = $2, external_product_id = $3, last_error = NULL, pushed_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+	`, p.ID, StatusPushed, externalID)
+	if err != nil {
+		// The product exists at the provider; without its ID the next push
+		// would create a duplicate, so make sure this is noticed.
+		reqctx.Logger(ctx).Error("failed to record pod push", "product_id", p.ID, "external_product_id", externalID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "The product was pushed but could not be saved",
+		}
+	}
+	reqctx.Logger(ctx).Info("pod product pushed", "product_id", p.ID, "external_product_id", externalID)
+	p, _, err = getProduct(ctx, projectID, productID)
+	return p, err
+}
+
+// printFile resolves a request's print file to an image asset of the
+// project, returning the export job it came from if any.
+func printFile(ctx context.Context, projectID string, req *SaveProductRequest) (assetID string, exportJobID *string, err error) {
+	if (req.ExportJobID == "") == (req.AssetID == "") {
+		return "", nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Choose the print file with either exportJobId or assetId",
+		}
+	}
+	if req.ExportJobID != "" {
+		err = db.QueryRow(ctx, `
+			SELECT artifact_asset_id FROM export_jobs
+			WHERE id::text = $1 AND project_id = $2 AND status = 'completed' AND artifact_asset_id IS NOT NULL
+		`, req.ExportJobID, projectID).Scan(&assetID)
+		if err != nil {
+			return "", nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Export not found or not completed",
+			}
+		}
+		exportJobID = &req.ExportJobID
+	} else {
+		assetID = req.AssetID
+	}
+
+	var mimeType string
+	err = db.QueryRow(ctx, `
+		SELECT mime_type FROM assets WHERE id::text = $1 AND project_id = $2
+	`, assetID, projectID).Scan(&mimeType)
+	if err != nil {
+		return "", nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Print file not found in this project",
+		}
+	}
+	if mimeType != "image/png" && mimeType != "image/jpeg" {
+		return "", nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Print files must be PNG or JPEG images",
+		}
+	}
+	return assetID, exportJobID, nil
+}
+
+func validateConfig(provider string, cfg *ProductConfig) error {
+	cfg.Title = strings.TrimSpace(cfg.Title)
+	if cfg.Title == "" || len([]rune(cfg.Title)) > 255 {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Title must be between 1 and 255 characters",
+		}
+	}
+	if len(cfg.Description) > 10000 || len(cfg.Placement) > 50 {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Description or placement is too long",
+		}
+	}
+	if len(cfg.Variants) == 0 || len(cfg.Variants) > maxVariants {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Choose between 1 and 100 variants",
+		}
+	}
+	seen := map[int64]bool{}
+	for _, v := range cfg.Variants {
+		if v.VariantID <= 0 || v.PriceCents <= 0 || seen[v.VariantID] {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Each variant needs a distinct variantId and a positive priceCents",
+			}
+		}
+		seen[v.VariantID] = true
+	}
+	if provider == ProviderPrintify && (cfg.BlueprintID <= 0 || cfg.PrintProviderID <= 0) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Printify products need a blueprintId and printProviderId",
+		}
+	}
+	return nil
+}
+
+const productColumns = `
+	SELECT p.id, p.project_id, p.connection_id, c.provider, COALESCE(p.asset_id::text, ''), COALESCE(p.export_job_id::text, ''),
+		p.config, COALESCE(p.external_product_id, ''), p.status, COALESCE(p.last_error, ''), p.pushed_at,
+		COALESCE(p.created_by::text, ''), p.created_at, p.updated_at, p.file_token
+	FROM pod_products p
+	JOIN pod_connections c ON c.id = p.connection_id`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanProduct scans a productColumns row, returning the file token too.
+func scanProduct(row scanner) (*Product, string, error) {
+	p := &Product{}
+	var config []byte
+	var fileToken string
+	err := row.Scan(&p.ID, &p.ProjectID, &p.ConnectionID, &p.Provider, &p.AssetID, &p.ExportJobID, &config,
+		&p.ExternalProductID, &p.Status, &p.LastError, &p.PushedAt, &p.CreatedBy, &p.CreatedAt, &p.UpdatedAt, &fileToken)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(config, &p.Config); err != nil {
+		return nil, "", err
+	}
+	return p, fileToken, nil
+}
+
+func getProduct(ctx context.Context, projectID, productID string) (*Product, string, error) {
+	p, fileToken, err := scanProduct(db.QueryRow(ctx, productColumns+` WHERE p.id::text = $1 AND p.project_id = $2`, productID, projectID))
+	if err == sql.ErrNoRows {
+		return nil, "", &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Product not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load pod product", "product_id", productID, "error", err)
+		return nil, "", &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load product",
+		}
+	}
+	return p, fileToken, nil
+}
+
+// fileURL is where providers fetch a product's print file (see File).
+func fileURL(fileToken string) string {
+	base := encore.Meta().APIBaseURL
+	base.Path = "/pod/files/" + fileToken
+	return base.String()
+}
@@ -0,0 +1,463 @@
+package pod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"canvasai/outbound"
+	"canvasai/ratelimit"
+)
+
+// podClient calls the providers' APIs, which are the only hosts it may
+// reach. Printful allows 120 requests a minute per token; Printify 600.
+var podClient = outbound.NewClient(outbound.Policy{
+	Timeout:          30 * time.Second,
+	MaxResponseBytes: 4 << 20,
+	AllowedHosts:     []string{"api.printful.com", "api.printify.com"},
+	RateLimit:        ratelimit.Limit{Requests: 2, Per: time.Second},
+})
+
+// provider is a print-on-demand provider's API
+type provider interface {
+	// stores lists the stores a token can manage
+	stores(ctx context.Context, token string) ([]store, error)
+	// subscribe registers the webhook URL for order events and returns the
+	// IDs of the webhooks it created, if the provider has any
+	subscribe(ctx context.Context, c *connection, webhookURL string) ([]string, error)
+	unsubscribe(ctx context.Context, c *connection) error
+	// push creates the product, or updates it when it has an external ID,
+	// and returns its external ID
+	push(ctx context.Context, c *connection, p *Product, fileURL string) (string, error)
+	// order fetches an order's current state
+	order(ctx context.Context, c *connection, orderID string) (*order, error)
+	// webhookOrderID returns the order a webhook event is about, or "" for
+	// events about anything else
+	webhookOrderID(body []byte) (string, error)
+}
+
+var providers = map[string]provider{
+	ProviderPrintful: printful{},
+	ProviderPrintify: printify{},
+}
+
+// store is a store at a provider
+type store struct {
+	id   string
+	name string
+}
+
+// order is an order at a provider
+type order struct {
+	id string
+	// status is the provider's own status
+	status      string
+	fulfillment string
+	// refs identifies the products ordered: our product IDs for Printful,
+	// the provider's product IDs for Printify
+	refs []string
+
+	carrier        string
+	trackingNumber string
+	trackingURL    string
+}
+
+// Fulfillment statuses, common to both providers
+const (
+	FulfillmentPending      = "pending"
+	FulfillmentInProduction = "in_production"
+	FulfillmentShipped      = "shipped"
+	FulfillmentDelivered    = "delivered"
+	FulfillmentCanceled     = "canceled"
+	FulfillmentFailed       = "failed"
+)
+
+// apiError is an error response from a provider
+type apiError struct {
+	provider string
+	status   int
+	message  string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("pod: %s: HTTP %d: %s", e.provider, e.status, e.message)
+}
+
+// call sends a JSON request to a provider and decodes the JSON response
+// into out. message extracts the provider's reason from an error body.
+func call(ctx context.Context, name, method, endpoint, token string, header http.Header, body, out any, message func([]byte) string) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := podClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := message(data)
+		if msg == "" {
+			msg = resp.Status
+		}
+		return &apiError{provider: name, status: resp.StatusCode, message: msg}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// printful is the Printful API (v1). Products are sync products whose
+// variants carry our product ID in their external ID, so orders can be
+// traced back to the product.
+type printful struct{}
+
+const printfulAPI = "https://api.printful.com"
+
+var printfulFulfillment = map[string]string{
+	"draft":     FulfillmentPending,
+	"pending":   FulfillmentPending,
+	"onhold":    FulfillmentPending,
+	"inprocess": FulfillmentInProduction,
+	"partial":   FulfillmentInProduction,
+	"fulfilled": FulfillmentShipped,
+	"canceled":  FulfillmentCanceled,
+	"archived":  FulfillmentCanceled,
+	"failed":    FulfillmentFailed,
+}
+
+func (printful) call(ctx context.Context, c *connection, token, method, path string, body, out any) error {
+	header := http.Header{}
+	if c != nil {
+		token = c.token
+		header.Set("X-PF-Store-Id", c.StoreID)
+	}
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err := call(ctx, "Printful", method, printfulAPI+path, token, header, body, &result, func(data []byte) string {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(data, &e)
+		return e.Error.Message
+	})
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(result.Result, out)
+}
+
+func (p printful) stores(ctx context.Context, token string) ([]store, error) {
+	var result []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := p.call(ctx, nil, token, http.MethodGet, "/stores", nil, &result); err != nil {
+		return nil, err
+	}
+	out := make([]store, len(result))
+	for i, s := range result {
+		out[i] = store{id: strconv.FormatInt(s.ID, 10), name: s.Name}
+	}
+	return out, nil
+}
+
+func (p printful) subscribe(ctx context.Context, c *connection, webhookURL string) ([]string, error) {
+	body := map[string]any{
+		"url":   webhookURL,
+		"types": []string{"order_updated", "order_failed", "order_canceled", "order_put_hold", "package_shipped", "package_returned"},
+	}
+	return nil, p.call(ctx, c, "", http.MethodPost, "/webhooks", body, nil)
+}
+
+func (p printful) unsubscribe(ctx context.Context, c *connection) error {
+	return p.call(ctx, c, "", http.MethodDelete, "/webhooks", nil, nil)
+}
+
+func (p printful) push(ctx context.Context, c *connection, prod *Product, fileURL string) (string, error) {
+	placement := prod.Config.Placement
+	if placement == "" {
+		placement = "default"
+	}
+	variants := make([]map[string]any, len(prod.Config.Variants))
+	for i, v := range prod.Config.Variants {
+		variants[i] = map[string]any{
+			"external_id":  prod.ID + "_" + strconv.FormatInt(v.VariantID, 10),
+			"variant_id":   v.VariantID,
+			"retail_price": fmt.Sprintf("%d.%02d", v.PriceCents/100, v.PriceCents%100),
+			"files":        []map[string]string{{"type": placement, "url": fileURL}},
+		}
+	}
+	body := map[string]any{
+		"sync_product":  map[string]string{"external_id": prod.ID, "name": prod.Config.Title},
+		"sync_variants": variants,
+	}
+	method, path := http.MethodPost, "/store/products"
+	if prod.ExternalProductID != "" {
+		method, path = http.MethodPut, "/store/products/"+url.PathEscape(prod.ExternalProductID)
+	}
+	var result struct {
+		ID int64 `json:"id"`
+	}
+	if err := p.call(ctx, c, "", method, path, body, &result); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(result.ID, 10), nil
+}
+
+func (p printful) order(ctx context.Context, c *connection, orderID string) (*order, error) {
+	var result struct {
+		ID     int64  `json:"id"`
+		Status string `json:"status"`
+		Items  []struct {
+			ExternalVariantID string `json:"external_variant_id"`
+		} `json:"items"`
+		Shipments []struct {
+			Carrier        string `json:"carrier"`
+			TrackingNumber string `json:"tracking_number"`
+			TrackingURL    string `json:"tracking_url"`
+		} `json:"shipments"`
+	}
+	if err := p.call(ctx, c, "", http.MethodGet, "/orders/"+url.PathEscape(orderID), nil, &result); err != nil {
+		return nil, err
+	}
+	o := &order{id: strconv.FormatInt(result.ID, 10), status: result.Status, fulfillment: printfulFulfillment[result.Status]}
+	if o.fulfillment == "" {
+		o.fulfillment = FulfillmentPending
+	}
+	for _, item := range result.Items {
+		if productID, _, ok := strings.Cut(item.ExternalVariantID, "_"); ok {
+			o.refs = append(o.refs, productID)
+		}
+	}
+	if n := len(result.Shipments); n > 0 {
+		s := result.Shipments[n-1]
+		o.carrier, o.trackingNumber, o.trackingURL = s.Carrier, s.TrackingNumber, s.TrackingURL
+	}
+	return o, nil
+}
+
+func (printful) webhookOrderID(body []byte) (string, error) {
+	var event struct {
+		Data struct {
+			Order *struct {
+				ID int64 `json:"id"`
+			} `json:"order"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", err
+	}
+	if event.Data.Order == nil {
+		return "", nil
+	}
+	return strconv.FormatInt(event.Data.Order.ID, 10), nil
+}
+
+// printify is the Printify API (v1). Print files are uploaded to the
+// account's media library from our file URL, then placed on the product.
+type printify struct{}
+
+const printifyAPI = "https://api.printify.com/v1"
+
+// printifyTopics are the order events Printify sends to the webhook
+var printifyTopics = []string{
+	"order:created", "order:updated", "order:sent-to-production", "order:shipment:created", "order:shipment:delivered",
+}
+
+var printifyFulfillment = map[string]string{
+	"pending":               FulfillmentPending,
+	"on-hold":               FulfillmentPending,
+	"payment-not-received":  FulfillmentPending,
+	"sending-to-production": FulfillmentInProduction,
+	"in-production":         FulfillmentInProduction,
+	"partially-fulfilled":   FulfillmentInProduction,
+	"fulfilled":             FulfillmentShipped,
+	"canceled":              FulfillmentCanceled,
+	"had-issues":            FulfillmentFailed,
+}
+
+func (printify) call(ctx context.Context, token, method, path string, body, out any) error {
+	return call(ctx, "Printify", method, printifyAPI+path, token, nil, body, out, func(data []byte) string {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &e)
+		return e.Message
+	})
+}
+
+func (p printify) shopPath(c *connection, path string) string {
+	return "/shops/" + url.PathEscape(c.StoreID) + path
+}
+
+func (p printify) stores(ctx context.Context, token string) ([]store, error) {
+	var result []struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+	}
+	if err := p.call(ctx, token, http.MethodGet, "/shops.json", nil, &result); err != nil {
+		return nil, err
+	}
+	out := make([]store, len(result))
+	for i, s := range result {
+		out[i] = store{id: strconv.FormatInt(s.ID, 10), name: s.Title}
+	}
+	return out, nil
+}
+
+func (p printify) subscribe(ctx context.Context, c *connection, webhookURL string) ([]string, error) {
+	var ids []string
+	for _, topic := range printifyTopics {
+		var result struct {
+			ID string `json:"id"`
+		}
+		err := p.call(ctx, c.token, http.MethodPost, p.shopPath(c, "/webhooks.json"), map[string]string{"topic": topic, "url": webhookURL}, &result)
+		if err != nil {
+			c.webhookIDs = ids
+			p.unsubscribe(ctx, c)
+			return nil, err
+		}
+		ids = append(ids, result.ID)
+	}
+	return ids, nil
+}
+
+func (p printify) unsubscribe(ctx context.Context, c *connection) error {
+	host := url.Values{"host": {webhookHost()}}.Encode()
+	var firstErr error
+	for _, id := range c.webhookIDs {
+		err := p.call(ctx, c.token, http.MethodDelete, p.shopPath(c, "/webhooks/"+url.PathEscape(id)+".json?"+host), nil, nil)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p printify) push(ctx context.Context, c *connection, prod *Product, fileURL string) (string, error) {
+	var image struct {
+		ID string `json:"id"`
+	}
+	upload := map[string]string{"file_name": prod.ID + ".png", "url": fileURL}
+	if err := p.call(ctx, c.token, http.MethodPost, "/uploads/images.json", upload, &image); err != nil {
+		return "", err
+	}
+
+	placement := prod.Config.Placement
+	if placement == "" {
+		placement = "front"
+	}
+	variants := make([]map[string]any, len(prod.Config.Variants))
+	variantIDs := make([]int64, len(prod.Config.Variants))
+	for i, v := range prod.Config.Variants {
+		variants[i] = map[string]any{"id": v.VariantID, "price": v.PriceCents, "is_enabled": true}
+		variantIDs[i] = v.VariantID
+	}
+	body := map[string]any{
+		"title":             prod.Config.Title,
+		"description":       prod.Config.Description,
+		"blueprint_id":      prod.Config.BlueprintID,
+		"print_provider_id": prod.Config.PrintProviderID,
+		"variants":          variants,
+		"print_areas": []map[string]any{{
+			"variant_ids": variantIDs,
+			"placeholders": []map[string]any{{
+				"position": placement,
+				"images":   []map[string]any{{"id": image.ID, "x": 0.5, "y": 0.5, "scale": 1, "angle": 0}},
+			}},
+		}},
+	}
+	method, path := http.MethodPost, p.shopPath(c, "/products.json")
+	if prod.ExternalProductID != "" {
+		method, path = http.MethodPut, p.shopPath(c, "/products/"+url.PathEscape(prod.ExternalProductID)+".json")
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := p.call(ctx, c.token, method, path, body, &result); err != nil {
+		return "", err
+	}
+	return result.ID, nil
+}
+
+func (p printify) order(ctx context.Context, c *connection, orderID string) (*order, error) {
+	var result struct {
+		ID        string `json:"id"`
+		Status    string `json:"status"`
+		LineItems []struct {
+			ProductID string `json:"product_id"`
+		} `json:"line_items"`
+		Shipments []struct {
+			Carrier     string  `json:"carrier"`
+			Number      string  `json:"number"`
+			URL         string  `json:"url"`
+			DeliveredAt *string `json:"delivered_at"`
+		} `json:"shipments"`
+	}
+	if err := p.call(ctx, c.token, http.MethodGet, p.shopPath(c, "/orders/"+url.PathEscape(orderID)+".json"), nil, &result); err != nil {
+		return nil, err
+	}
+	o := &order{id: result.ID, status: result.Status, fulfillment: printifyFulfillment[result.Status]}
+	if o.fulfillment == "" {
+		o.fulfillment = FulfillmentPending
+	}
+	for _, item := range result.LineItems {
+		o.refs = append(o.refs, item.ProductID)
+	}
+	if n := len(result.Shipments); n > 0 {
+		s := result.Shipments[n-1]
+		o.carrier, o.trackingNumber, o.trackingURL = s.Carrier, s.Number, s.URL
+		if s.DeliveredAt != nil && o.fulfillment == FulfillmentShipped {
+			o.fulfillment = FulfillmentDelivered
+		}
+	}
+	return o, nil
+}
+
+func (printify) webhookOrderID(body []byte) (string, error) {
+	var event struct {
+		Resource struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		} `json:"resource"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return "", err
+	}
+	if event.Resource.Type != "order" {
+		return "", nil
+	}
+	return event.Resource.ID, nil
+}
@@ -0,0 +1,237 @@
+package pod
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+
+	"canvasai/asset"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Webhook and print file URLs carry an unguessable token instead of being
+// signed, since Printful does not sign its webhooks. Webhook events are only
+// taken as a cue: the order is fetched from the provider with the store's
+// token, so a forged event cannot change what is recorded.
+
+// maxWebhookBody bounds webhook payloads
+const maxWebhookBody = 1 << 20
+
+// Order is an order placed in a store for one of a project's products
+type Order struct {
+	ID              string `json:"id"`
+	ProductID       string `json:"productId"`
+	ExternalOrderID string `json:"externalOrderId"`
+	// Status is the provider's own status; Fulfillment is one of pending,
+	// in_production, shipped, delivered, canceled and failed
+	Status         string    `json:"status"`
+	Fulfillment    string    `json:"fulfillment"`
+	Carrier        string    `json:"carrier,omitempty"`
+	TrackingNumber string    `json:"trackingNumber,omitempty"`
+	TrackingURL    string    `json:"trackingUrl,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// ListOrdersRequest represents the list orders request
+type ListOrdersRequest struct {
+	ProductID string `query:"productId"`
+	Limit     int    `query:"limit"`
+	Offset    int    `query:"offset"`
+}
+
+// ListOrdersResponse represents the list orders response
+type ListOrdersResponse struct {
+	Orders []Order `json:"orders"`
+	Total  int     `json:"total"`
+}
+
+const (
+	defaultOrdersLimit = 50
+	maxOrdersLimit     = 200
+)
+
+// ListOrders lists the orders for a project's products, most recently
+// updated first.
+//
+//encore:api auth method=GET path=/projects/:id/pod-orders
+func ListOrders(ctx context.Context, id string, req *ListOrdersRequest) (*ListOrdersResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxOrdersLimit {
+		limit = defaultOrdersLimit
+	}
+	offset := max(req.Offset, 0)
+
+	resp := &ListOrdersResponse{Orders: []Order{}}
+	filter := `p.project_id = $1 AND ($2 = '' OR p.id::text = $2)`
+	if err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM pod_orders o JOIN pod_products p ON p.id = o.product_id WHERE `+filter,
+		id, req.ProductID).Scan(&resp.Total); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch orders",
+		}
+	}
+	rows, err := db.Query(ctx, `
+		SELECT o.id, o.product_id, o.external_order_id, o.status, o.fulfillment, COALESCE(o.carrier, ''),
+			COALESCE(o.tracking_number, ''), COALESCE(o.tracking_url, ''), o.created_at, o.updated_at
+		FROM pod_orders o
+		JOIN pod_products p ON p.id = o.product_id
+		WHERE `+filter+`
+		ORDER BY o.updated_at DESC
+		LIMIT $3 OFFSET $4
+	`, id, req.ProductID, limit, offset)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch orders",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.ID, &o.ProductID, &o.ExternalOrderID, &o.Status, &o.Fulfillment, &o.Carrier,
+			&o.TrackingNumber, &o.TrackingURL, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			continue
+		}
+		resp.Orders = append(resp.Orders, o)
+	}
+	return resp, nil
+}
+
+// Webhook receives a provider's order events for a connection.
+//
+//encore:api public raw method=POST path=/pod/webhooks/:token
+func Webhook(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	token := encore.CurrentRequest().PathParams.Get("token")
+
+	var connectionID string
+	err := db.QueryRow(ctx, `SELECT id FROM pod_connections WHERE webhook_token = $1`, token).Scan(&connectionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to look up pod webhook", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log := reqctx.Logger(ctx).With("connection_id", connectionID)
+	c, err := getConnection(ctx, connectionID, "")
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	p := providers[c.Provider]
+	orderID, err := p.webhookOrderID(body)
+	if err != nil {
+		log.Warn("rejected pod webhook", "error", err)
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+	if orderID == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	o, err := p.order(ctx, c, orderID)
+	if err != nil {
+		// Providers retry failed deliveries.
+		log.Warn("failed to fetch pod order", "order_id", orderID, "error", err)
+		http.Error(w, "order unavailable", http.StatusBadGateway)
+		return
+	}
+	if err := recordOrder(ctx, c, o); err != nil {
+		log.Error("failed to record pod order", "order_id", orderID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordOrder saves an order's state against each of the connection's
+// products it contains. Orders for products not published from here are
+// ignored.
+func recordOrder(ctx context.Context, c *connection, o *order) error {
+	if len(o.refs) == 0 {
+		return nil
+	}
+	result, err := db.Exec(ctx, `
+		INSERT INTO pod_orders (product_id, external_order_id, status, fulfillment, carrier, tracking_number, tracking_url)
+		SELECT p.id, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, '')
+		FROM pod_products p
+		WHERE p.connection_id = $1 AND (p.id::text = ANY($2) OR p.external_product_id = ANY($2))
+		ON CONFLICT (product_id, external_order_id) DO UPDATE
+		SET status = EXCLUDED.status, fulfillment = EXCLUDED.fulfillment,
+			carrier = COALESCE(EXCLUDED.carrier, pod_orders.carrier),
+			tracking_number = COALESCE(EXCLUDED.tracking_number, pod_orders.tracking_number),
+			tracking_url = COALESCE(EXCLUDED.tracking_url, pod_orders.tracking_url),
+			updated_at = NOW()
+	`, c.ID, o.refs, o.id, o.status, o.fulfillment, o.carrier, o.trackingNumber, o.trackingURL)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() > 0 {
+		reqctx.Logger(ctx).Info("pod order updated", "connection_id", c.ID, "order_id", o.id, "fulfillment", o.fulfillment)
+	}
+	return nil
+}
+
+// File serves a product's print file to its provider.
+//
+//encore:api public raw method=GET path=/pod/files/:token
+func File(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	token := encore.CurrentRequest().PathParams.Get("token")
+
+	var assetID string
+	err := db.QueryRow(ctx, `
+		SELECT asset_id FROM pod_products WHERE file_token = $1 AND asset_id IS NOT NULL
+	`, token).Scan(&assetID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to look up pod print file", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read pod print file", "asset_id", assetID, "error", err)
+		http.Error(w, "file unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", data.Asset.MimeType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Write(data.Data)
+}
+
+// webhookURL is where providers send a connection's order events.
+func webhookURL(token string) string {
+	base := encore.Meta().APIBaseURL
+	base.Path = "/pod/webhooks/" + token
+	return base.String()
+}
+
+// webhookHost is the host of webhook URLs.
+func webhookHost() string {
+	base := encore.Meta().APIBaseURL
+	return base.Host
+}
@@ -0,0 +1,427 @@
+package project
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"github.com/google/uuid"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/permissions"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// ArchiveVersion is the project archive format produced by ExportProject.
+// Version 2 added the page manifest and asset checksums; version 1
+// archives are still imported.
+const ArchiveVersion = 2
+
+// ProjectArchive is a portable, self-contained copy of a project
+type ProjectArchive struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Project    ArchivedProject `json:"project"`
+	// Pages lists the canvas pages and the assets each one uses
+	Pages  []ArchivedPage  `json:"pages,omitempty"`
+	Assets []ArchivedAsset `json:"assets"`
+}
+
+// ArchivedPage is a canvas page in an archive's manifest
+type ArchivedPage struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	AssetIDs []string `json:"assetIds"`
+}
+
+// ArchivedProject holds the project fields carried in an archive
+type ArchivedProject struct {
+	Title        string          `json:"title"`
+	Description  string          `json:"description,omitempty"`
+	CanvasWidth  int             `json:"canvasWidth"`
+	CanvasHeight int             `json:"canvasHeight"`
+	CanvasData   json.RawMessage `json:"canvasData,omitempty"`
+}
+
+// ArchivedAsset is an asset embedded in an archive. ID is the asset's ID in
+// the exporting workspace, as referenced by the canvas data.
+type ArchivedAsset struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mimeType"`
+	AltText  string `json:"altText,omitempty"`
+	Width    *int   `json:"width,omitempty"`
+	Height   *int   `json:"height,omitempty"`
+	// SHA256 is the hex checksum of Data, checked on import when present
+	SHA256 string `json:"sha256,omitempty"`
+	Data   []byte `json:"data"`
+}
+
+// ImportProjectRequest represents the import project request
+type ImportProjectRequest struct {
+	Archive ProjectArchive `json:"archive"`
+	// Title overrides the archived project title
+	Title string `json:"title,omitempty"`
+}
+
+// ImportProjectResponse represents the import project response
+type ImportProjectResponse struct {
+	Project *Project `json:"project"`
+	// AssetIDs maps archived asset IDs to their newly created IDs
+	AssetIDs map[string]string  `json:"assetIds"`
+	Report   *canvasrefs.Report `json:"report"`
+}
+
+const (
+	maxArchiveAssets    = 200
+	maxArchiveAssetSize = 500 << 20
+)
+
+// ExportProject packs a project into an archive that ImportProject can
+// recreate in any account: the canvas, its page manifest and every asset
+// the canvas references, embedded once each. Like duplication it requires
+// the editor role, since the archive carries the project's assets. A
+// reference to a previous version of an asset embeds that version's file.
+// Assets referenced only by storage path, or since deleted, are left out
+// and dropped on import.
+//
+//encore:api auth method=GET path=/projects/:id/export
+func ExportProject(ctx context.Context, id string) (*ProjectArchive, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	return buildArchive(ctx, id)
+}
+
+// ArchiveForSnapshot packs a project into an archive for the export
+// service's compliance snapshots, which run without a signed-in user.
+//
+//encore:api private method=POST path=/projects/internal/:id/archive
+func ArchiveForSnapshot(ctx context.Context, id string) (*ProjectArchive, error) {
+	return buildArchive(ctx, id)
+}
+
+// buildArchive packs a project for ExportProject and ArchiveForSnapshot.
+func buildArchive(ctx context.Context, id string) (*ProjectArchive, error) {
+	src, err := loadCopySource(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &ProjectArchive{
+		Version:    ArchiveVersion,
+		ExportedAt: time.Now(),
+		Project: ArchivedProject{
+			Title:        src.title,
+			Description:  src.description,
+			CanvasWidth:  src.width,
+			CanvasHeight: src.height,
+			CanvasData:   json.RawMessage(src.canvasData),
+		},
+		Assets: []ArchivedAsset{},
+	}
+	if len(src.canvasData) == 0 {
+		archive.Project.CanvasData = nil
+	}
+	pages, err := render.ParsePages(src.canvasData)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to parse canvas for export", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to export project",
+		}
+	}
+
+	embedded := map[string]bool{}
+	var total int
+	for _, page := range pages {
+		entry := ArchivedPage{ID: page.ID, Name: page.Name, AssetIDs: []string{}}
+		listed := map[string]bool{}
+		for _, ref := range canvasrefs.Find(map[string]any{"objects": toAny(page.Objects)}) {
+			if ref.Kind != canvasrefs.KindAsset || ref.ID == "" {
+				continue
+			}
+			key := strings.ToLower(ref.ID)
+			if !embedded[key] {
+				a, err := archiveAsset(ctx, ref)
+				if err != nil {
+					return nil, err
+				}
+				if a == nil {
+					continue
+				}
+				total += len(a.Data)
+				if len(archive.Assets) >= maxArchiveAssets || total > maxArchiveAssetSize {
+					return nil, &errs.Error{
+						Code:    errs.FailedPrecondition,
+						Message: "Project has too many assets to export",
+					}
+				}
+				embedded[key] = true
+				archive.Assets = append(archive.Assets, *a)
+			}
+			if !listed[key] {
+				listed[key] = true
+				entry.AssetIDs = append(entry.AssetIDs, key)
+			}
+		}
+		archive.Pages = append(archive.Pages, entry)
+	}
+
+	reqctx.Logger(ctx).Info("project exported", "project_id", id, "assets", len(archive.Assets))
+	return archive, nil
+}
+
+// toAny converts page objects to the generic form canvasrefs walks.
+func toAny(objects []map[string]any) []any {
+	out := make([]any, len(objects))
+	for i, o := range objects {
+		out[i] = o
+	}
+	return out
+}
+
+// archiveAsset reads the asset, or asset version, a canvas reference points
+// at. It returns nil when the asset no longer exists.
+func archiveAsset(ctx context.Context, ref canvasrefs.Ref) (*ArchivedAsset, error) {
+	var data *asset.AssetData
+	var err error
+	if version := refVersion(ref); version > 0 {
+		data, err = asset.ReadVersion(ctx, ref.ID, version)
+	} else {
+		data, err = asset.Read(ctx, ref.ID)
+	}
+	if errs.Code(err) == errs.NotFound {
+		return nil, nil
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to read asset for export", "asset_id", ref.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to export project",
+		}
+	}
+	sum := sha256.Sum256(data.Data)
+	return &ArchivedAsset{
+		ID:       strings.ToLower(ref.ID),
+		Filename: data.Asset.Filename,
+		MimeType: data.Asset.MimeType,
+		AltText:  data.Asset.AltText,
+		Width:    data.Asset.Width,
+		Height:   data.Asset.Height,
+		SHA256:   hex.EncodeToString(sum[:]),
+		Data:     data.Data,
+	}, nil
+}
+
+//encore:api auth method=POST path=/projects/import
+func ImportProject(ctx context.Context, req *ImportProjectRequest) (*ImportProjectResponse, error) {
+	userID := auth.UserID()
+	archive := req.Archive
+
+	if err := validateArchive(&archive); err != nil {
+		return nil, err
+	}
+	if err := checkGuestProjectLimit(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := checkProjectQuota(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = archive.Project.Title
+	}
+
+	now := time.Now()
+	project := &Project{
+		ID:                uuid.New().String(),
+		Title:             title,
+		OwnerID:           userID,
+		Description:       archive.Project.Description,
+		CanvasWidth:       archive.Project.CanvasWidth,
+		CanvasHeight:      archive.Project.CanvasHeight,
+		Revision:          1,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		ColorProfile:      "srgb",
+		ShareLinksEnabled: true,
+	}
+	if project.CanvasWidth <= 0 || project.CanvasHeight <= 0 {
+		project.CanvasWidth, project.CanvasHeight = 800, 600
+	}
+	if err := assignSlug(ctx, project, ""); err != nil {
+		return nil, err
+	}
+
+	if err := insertProject(ctx, project, nil); err != nil {
+		return nil, err
+	}
+
+	assetIDs, err := reuploadArchiveAssets(ctx, project, archive.Assets)
+	if err != nil {
+		discardProject(ctx, project.ID)
+		return nil, err
+	}
+
+	canvasData, report, err := relinkArchiveAssets(archive.Project.CanvasData, assetIDs)
+	if err != nil {
+		discardProject(ctx, project.ID)
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid canvas data: " + err.Error(),
+		}
+	}
+
+	if len(canvasData) > 0 {
+		if project.SizeBudget, err = checkDocumentBudget(ctx, userID, len(canvasData)); err != nil {
+			discardProject(ctx, project.ID)
+			return nil, err
+		}
+		if err := checkPageQuota(project.SizeBudget.Plan, canvasData); err != nil {
+			discardProject(ctx, project.ID)
+			return nil, err
+		}
+		_, assetRefs, err := buildAssetIndex(canvasData)
+		if err == nil {
+			_, err = db.Exec(ctx, `UPDATE projects SET canvas_data = $2, asset_refs = $3 WHERE id = $1`, project.ID, canvasData, assetRefs)
+		}
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to save imported canvas", "project_id", project.ID, "error", err)
+			discardProject(ctx, project.ID)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to import project",
+			}
+		}
+		project.CanvasData = json.RawMessage(canvasData)
+		announceCanvasSave(ctx, project.ID, project.Revision)
+	}
+
+	reqctx.Logger(ctx).Info("project imported", "project_id", project.ID, "assets", len(assetIDs))
+	return &ImportProjectResponse{
+		Project:  project,
+		AssetIDs: assetIDs,
+		Report:   report,
+	}, nil
+}
+
+func validateArchive(archive *ProjectArchive) error {
+	if archive.Version < 1 || archive.Version > ArchiveVersion {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Unsupported archive version",
+		}
+	}
+	if strings.TrimSpace(archive.Project.Title) == "" {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Title is required",
+		}
+	}
+	if len(archive.Project.CanvasData) > 0 {
+		if err := validateCanvasDocument(archive.Project.CanvasData); err != nil {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Invalid canvas data: " + err.Error(),
+			}
+		}
+	}
+
+	if len(archive.Assets) > maxArchiveAssets {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Archive contains too many assets",
+		}
+	}
+	var total int
+	seen := map[string]bool{}
+	for _, a := range archive.Assets {
+		if a.ID == "" || seen[a.ID] {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Archive assets must have unique IDs",
+			}
+		}
+		seen[a.ID] = true
+		if a.SHA256 != "" {
+			sum := sha256.Sum256(a.Data)
+			if !strings.EqualFold(a.SHA256, hex.EncodeToString(sum[:])) {
+				return &errs.Error{
+					Code:    errs.InvalidArgument,
+					Message: "Archive asset " + a.ID + " does not match its checksum",
+				}
+			}
+		}
+		total += len(a.Data)
+	}
+	if total > maxArchiveAssetSize {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Archive assets exceed the maximum total size",
+		}
+	}
+	return nil
+}
+
+func reuploadArchiveAssets(ctx context.Context, project *Project, assets []ArchivedAsset) (map[string]string, error) {
+	ids := make(map[string]string, len(assets))
+	for _, a := range assets {
+		stored, err := asset.Store(ctx, &asset.StoreRequest{
+			UserID:    project.OwnerID,
+			ProjectID: project.ID,
+			Filename:  a.Filename,
+			MimeType:  a.MimeType,
+			Data:      a.Data,
+			Width:     a.Width,
+			Height:    a.Height,
+			AltText:   a.AltText,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ids[strings.ToLower(a.ID)] = stored.ID
+	}
+	return ids, nil
+}
+
+// relinkArchiveAssets points the canvas at the re-uploaded assets. References
+// to anything not shipped in the archive are dropped.
+func relinkArchiveAssets(canvasData []byte, assetIDs map[string]string) ([]byte, *canvasrefs.Report, error) {
+	if len(canvasData) == 0 {
+		return nil, &canvasrefs.Report{Counts: map[canvasrefs.Action]int{}}, nil
+	}
+
+	var doc any
+	if err := json.Unmarshal(canvasData, &doc); err != nil {
+		return nil, nil, err
+	}
+	rewritten, report, err := canvasrefs.Rewrite(doc, func(ref canvasrefs.Ref) (string, canvasrefs.Action, error) {
+		if ref.Kind == canvasrefs.KindComponent {
+			return ref.Value, canvasrefs.ActionKept, nil
+		}
+		if newID, ok := assetIDs[ref.ID]; ok {
+			return formatRef(ref, newID, 0), canvasrefs.ActionRelinked, nil
+		}
+		return "", canvasrefs.ActionRemoved, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := json.Marshal(rewritten)
+	return out, report, err
+}
+
+// discardProject removes a partially imported project.
+func discardProject(ctx context.Context, projectID string) {
+	if _, err := db.Exec(ctx, "DELETE FROM projects WHERE id = $1", projectID); err != nil {
+		reqctx.Logger(ctx).Error("failed to clean up partial import", "project_id", projectID, "error", err)
+	}
+}
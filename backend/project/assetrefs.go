@@ -0,0 +1,135 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"canvasai/canvasrefs"
+)
+
+// carryTarget is the user and project carryAssets copies assets to
+type carryTarget struct {
+	userID    string
+	projectID *string // nil for assets outside any project
+	// copyAll copies assets the user already owns too, instead of
+	// relinking them
+	copyAll bool
+	public  bool
+}
+
+// carryAssets rewrites the asset references in a canvas document that is
+// being copied for target.userID. Assets the target already owns are
+// relinked to their canonical URL; anything else is copied into the
+// target's library so the new document never points at another tenant's
+// files. Copies share the underlying storage object (copy-on-write). A
+// reference to a previous version of an asset the target does not own is
+// copied from that version's file, since the copy starts without history.
+// It returns the IDs of the copies.
+func carryAssets(ctx context.Context, canvasData []byte, target carryTarget) ([]byte, *canvasrefs.Report, []string, error) {
+	targetUserID := target.userID
+	if len(canvasData) == 0 {
+		return canvasData, &canvasrefs.Report{Counts: map[canvasrefs.Action]int{}}, nil, nil
+	}
+
+	var doc any
+	if err := json.Unmarshal(canvasData, &doc); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Documents often reference the same asset many times; copy it once.
+	carried := map[string]string{}
+
+	rewritten, report, err := canvasrefs.Rewrite(doc, func(ref canvasrefs.Ref) (string, canvasrefs.Action, error) {
+		if ref.Kind == canvasrefs.KindComponent {
+			return ref.Value, canvasrefs.ActionKept, nil
+		}
+
+		assetID := ref.ID
+		if assetID == "" {
+			// Raw storage path; resolve it back to the asset row, preferring
+			// the target's own copy since copies share their file.
+			err := db.QueryRow(ctx, `
+				SELECT id FROM assets WHERE file_path = $1 ORDER BY user_id = $2 DESC LIMIT 1
+			`, ref.Value, targetUserID).Scan(&assetID)
+			if err == sql.ErrNoRows {
+				return "", canvasrefs.ActionRemoved, nil
+			} else if err != nil {
+				return "", "", err
+			}
+		}
+
+		version := refVersion(ref)
+		key := assetID + "@" + strconv.Itoa(version)
+		if newID, ok := carried[key]; ok {
+			return formatRef(ref, newID, 0), canvasrefs.ActionCopied, nil
+		}
+
+		var ownerID string
+		err := db.QueryRow(ctx, `SELECT user_id FROM assets WHERE id = $1`, assetID).Scan(&ownerID)
+		if err == sql.ErrNoRows {
+			return "", canvasrefs.ActionRemoved, nil
+		} else if err != nil {
+			return "", "", err
+		}
+
+		if ownerID == targetUserID && !target.copyAll {
+			to := formatRef(ref, assetID, version)
+			if to == ref.Value {
+				return to, canvasrefs.ActionKept, nil
+			}
+			return to, canvasrefs.ActionRelinked, nil
+		}
+
+		newID := uuid.New().String()
+		copied, err := db.Exec(ctx, `
+			INSERT INTO assets (id, project_id, user_id, filename, original_filename, mime_type, file_size, file_path,
+				thumbnail_path, width, height, duration, metadata, is_public, tags, alt_text, checksum, blurhash, org_id)
+			SELECT $1, $2, $3, COALESCE(v.filename, a.filename), a.original_filename, COALESCE(v.mime_type, a.mime_type),
+				COALESCE(v.file_size, a.file_size), COALESCE(v.file_path, a.file_path),
+				CASE WHEN v.id IS NULL THEN a.thumbnail_path END, COALESCE(v.width, a.width), COALESCE(v.height, a.height),
+				a.duration, a.metadata, $6, a.tags, a.alt_text, COALESCE(v.checksum, a.checksum), COALESCE(v.blurhash, a.blurhash),
+				(SELECT org_id FROM projects WHERE id = $2)
+			FROM assets a
+			LEFT JOIN asset_versions v ON v.asset_id = a.id AND v.version = $5 AND v.purged_at IS NULL
+			WHERE a.id = $4
+		`, newID, target.projectID, targetUserID, assetID, version, target.public)
+		if err != nil {
+			return "", "", err
+		}
+		if copied.RowsAffected() == 0 {
+			return "", canvasrefs.ActionRemoved, nil
+		}
+		carried[key] = newID
+		return formatRef(ref, newID, 0), canvasrefs.ActionCopied, nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	out, err := json.Marshal(rewritten)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	copies := make([]string, 0, len(carried))
+	for _, id := range carried {
+		copies = append(copies, id)
+	}
+	return out, report, copies, nil
+}
+
+// formatRef renders assetID in the same shape as the original reference,
+// pinned to version unless it is zero.
+func formatRef(ref canvasrefs.Ref, assetID string, version int) string {
+	if ref.ID != "" && strings.EqualFold(ref.ID, ref.Value) {
+		return assetID
+	}
+	if version > 0 {
+		return canvasrefs.VersionedAssetURL(assetID, version)
+	}
+	return canvasrefs.AssetURL(assetID)
+}
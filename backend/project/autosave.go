@@ -0,0 +1,231 @@
+package project
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+
+	"canvasai/permissions"
+	"canvasai/realtime"
+	"canvasai/reqctx"
+	"canvasai/wideevent"
+)
+
+// Editors autosave every few seconds while someone works. Autosaves send
+// element operations like PatchCanvas, but never take a version snapshot:
+// history keeps the saves people make on purpose. Consecutive autosaves by
+// the same user form a burst, which is coalesced: each still saves a new
+// revision, so collaborators' conflict checks keep working, but the save
+// is only announced (thumbnail, webhooks, component usage) once the burst
+// has been quiet for autosaveCoalesceWindow. An autosave that changes
+// nothing is not written at all. A stale base revision is not an error:
+// the response carries the conflict for the editor to resolve.
+
+// autosaveCoalesceWindow is how long after an autosave the next one by the
+// same user still belongs to its burst
+const autosaveCoalesceWindow = 15 * time.Second
+
+// AutosaveRequest represents the autosave request
+type AutosaveRequest struct {
+	// Ops are the changes since BaseRevision; none saves nothing
+	Ops []CanvasOp `json:"ops"`
+	// BaseRevision is the revision the operations were made against, also
+	// accepted as an If-Match header. One of them is required.
+	BaseRevision *int   `json:"baseRevision,omitempty"`
+	IfMatch      string `header:"If-Match"`
+}
+
+// AutosaveResponse reports what an autosave did
+type AutosaveResponse struct {
+	// Saved is false when nothing was written: the operations changed
+	// nothing, or Conflict is set
+	Saved bool `json:"saved"`
+	// Revision is the project's revision after the autosave
+	Revision  int       `json:"revision"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Coalesced reports that the save continued a burst, so announcing it
+	// was deferred
+	Coalesced bool `json:"coalesced,omitempty"`
+	// Conflict is set when another save landed after BaseRevision; the
+	// operations were not applied
+	Conflict       *SaveConflict     `json:"conflict,omitempty"`
+	SizeBudget     *SizeBudget       `json:"sizeBudget,omitempty"`
+	EmbeddedImages *ExtractionReport `json:"embeddedImages,omitempty"`
+}
+
+//encore:api auth method=PUT path=/projects/:id/autosave
+func Autosave(ctx context.Context, id string, req *AutosaveRequest) (*AutosaveResponse, error) {
+	ev := wideevent.Start(wideevent.KindSave)
+	ev.Set("project_id", id)
+	ev.Set("user_id", auth.UserID())
+	ev.Set("autosave", true)
+	ev.Set("patch_ops", len(req.Ops))
+	resp, err := autosave(ctx, id, req, ev)
+	if resp != nil {
+		ev.Set("coalesced", resp.Coalesced)
+		ev.Set("conflict", resp.Conflict != nil)
+	}
+	ev.Finish(ctx, err)
+	return resp, err
+}
+
+func autosave(ctx context.Context, id string, req *AutosaveRequest, ev *wideevent.Event) (*AutosaveResponse, error) {
+	userID := auth.UserID()
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	update := &UpdateProjectRequest{BaseRevision: req.BaseRevision, IfMatch: req.IfMatch}
+	if err := resolveBaseRevision(update); err != nil {
+		return nil, err
+	}
+	base := *update.BaseRevision
+	if len(req.Ops) > maxCanvasOps {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("An autosave can have at most %d operations", maxCanvasOps),
+		}
+	}
+
+	var canvasData []byte
+	var revision int
+	var lastSavedBy string
+	var autosavedAt *time.Time
+	var updatedAt time.Time
+	err := db.QueryRow(ctx, `
+		SELECT canvas_data, version, COALESCE(last_saved_by::text, ''), autosaved_at, updated_at
+		FROM projects WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&canvasData, &revision, &lastSavedBy, &autosavedAt, &updatedAt)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if revision != base {
+		return autosaveConflict(saveConflict(ctx, id, RevisionInfo{Revision: base, UserID: userID, SavedAt: time.Now()}))
+	}
+
+	doc := map[string]any{}
+	if len(canvasData) > 0 && string(canvasData) != "null" {
+		if err := json.Unmarshal(canvasData, &doc); err != nil || doc == nil {
+			return nil, &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "Project canvas data is invalid",
+			}
+		}
+	}
+	if err := upgradeCanvas(doc); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas data is invalid: " + err.Error(),
+		}
+	}
+	before, err := json.Marshal(doc)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas data is invalid",
+		}
+	}
+	for i, op := range req.Ops {
+		if err := applyCanvasOp(doc, op); err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("ops[%d]: %v", i, err),
+			}
+		}
+	}
+	ev.Step("patch")
+	if after, err := json.Marshal(doc); err == nil && bytes.Equal(before, after) {
+		return &AutosaveResponse{Revision: revision, UpdatedAt: updatedAt}, nil
+	}
+
+	opts := saveOptions{autosave: true}
+	opts.coalesce = lastSavedBy == userID && autosavedAt != nil && time.Since(*autosavedAt) < autosaveCoalesceWindow
+	update.CanvasData = doc
+	project, err := updateProject(ctx, id, update, ev, opts)
+	if err != nil {
+		return autosaveConflict(err)
+	}
+
+	patch := &CanvasPatch{Revision: project.Revision, BaseRevision: base, UserID: userID, Ops: req.Ops}
+	if err := realtime.Publish(ctx, id, realtime.EventCanvasPatched, patch); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish canvas patch", "project_id", id, "error", err)
+	}
+	return &AutosaveResponse{
+		Saved:          true,
+		Revision:       project.Revision,
+		UpdatedAt:      project.UpdatedAt,
+		Coalesced:      opts.coalesce,
+		SizeBudget:     project.SizeBudget,
+		EmbeddedImages: project.EmbeddedImages,
+	}, nil
+}
+
+// autosaveConflict turns a save conflict error into an autosave response.
+// Other errors are returned as they are.
+func autosaveConflict(err error) (*AutosaveResponse, error) {
+	var e *errs.Error
+	if errors.As(err, &e) {
+		if conflict, ok := e.Details.(*SaveConflict); ok {
+			return &AutosaveResponse{
+				Revision:  conflict.Current.Revision,
+				UpdatedAt: conflict.Current.SavedAt,
+				Conflict:  conflict,
+			}, nil
+		}
+	}
+	return nil, err
+}
+
+// Announce coalesced autosaves once their burst has gone quiet.
+var _ = cron.NewJob("flush-autosaves", cron.JobConfig{
+	Title:    "Announce coalesced autosaves",
+	Every:    1 * cron.Minute,
+	Endpoint: FlushAutosaves,
+})
+
+//encore:api private
+func FlushAutosaves(ctx context.Context) error {
+	rows, err := db.Query(ctx, `
+		UPDATE projects SET autosave_pending = FALSE
+		WHERE autosave_pending AND autosaved_at < $1
+		RETURNING id, version
+	`, time.Now().Add(-autosaveCoalesceWindow))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to flush autosaves", "error", err)
+		return err
+	}
+	type flushed struct {
+		id       string
+		revision int
+	}
+	var saves []flushed
+	for rows.Next() {
+		var f flushed
+		if err := rows.Scan(&f.id, &f.revision); err != nil {
+			rows.Close()
+			return err
+		}
+		saves = append(saves, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range saves {
+		announceCanvasSave(ctx, f.id, f.revision)
+	}
+	if len(saves) > 0 {
+		reqctx.Logger(ctx).Info("announced coalesced autosaves", "count", len(saves))
+	}
+	return nil
+}
@@ -0,0 +1,595 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// An organization tracks where its projects stand on a status board. Its
+// admins set up the columns ("Brief", "In review", "Approved"...); editors
+// drag projects between and within them. Each project keeps its column
+// and its place in it, projects without a column are listed as
+// unassigned, and every change of column is recorded in the project's
+// status history.
+
+const (
+	maxBoardColumns       = 20
+	maxBoardColumnName    = 100
+	defaultBoardLaneSize  = 50
+	maxBoardLaneSize      = 200
+	minBoardPositionDelta = 1e-6
+
+	// BoardUnassigned names the lane of projects without a column
+	BoardUnassigned = "unassigned"
+)
+
+var boardColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// BoardColumn is a status column of an organization's board
+type BoardColumn struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"orgId"`
+	Name      string    `json:"name"`
+	Color     string    `json:"color,omitempty"`
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ListBoardColumnsResponse represents a board's columns, left to right
+type ListBoardColumnsResponse struct {
+	Columns []BoardColumn `json:"columns"`
+}
+
+// CreateBoardColumnRequest represents the create board column request
+type CreateBoardColumnRequest struct {
+	Name  string `json:"name"`
+	Color string `json:"color,omitempty"` // #rrggbb
+	// Position defaults to after the existing columns
+	Position *int `json:"position,omitempty"`
+}
+
+// UpdateBoardColumnRequest changes the fields that are set
+type UpdateBoardColumnRequest struct {
+	Name *string `json:"name,omitempty"`
+	// Color is cleared with an empty string
+	Color    *string `json:"color,omitempty"`
+	Position *int    `json:"position,omitempty"`
+}
+
+// GetBoardRequest represents the board request
+type GetBoardRequest struct {
+	// Limit caps the projects listed in each lane
+	Limit int `query:"limit"`
+	// Column pages through one lane, a column ID or "unassigned", from
+	// Offset
+	Column string `query:"column"`
+	Offset int    `query:"offset"`
+}
+
+// BoardLane is a column of the board with the projects in it, in order
+type BoardLane struct {
+	// Column is empty for the lane of unassigned projects
+	Column   *BoardColumn `json:"column,omitempty"`
+	Count    int          `json:"count"`
+	Projects []Project    `json:"projects"`
+}
+
+// Board represents an organization's projects grouped by status. The
+// unassigned lane comes first.
+type Board struct {
+	OrgID string      `json:"orgId"`
+	Lanes []BoardLane `json:"lanes"`
+}
+
+// MoveProjectStatusRequest represents the move project request
+type MoveProjectStatusRequest struct {
+	// ColumnID is the column to move to; empty takes the project off the
+	// board's columns
+	ColumnID string `json:"columnId"`
+	// Index is the project's place in the column, from the top. Omitted
+	// puts it last.
+	Index *int `json:"index,omitempty"`
+}
+
+// ProjectStatus is where a project is on its board
+type ProjectStatus struct {
+	ColumnID   *string `json:"columnId"`
+	ColumnName *string `json:"columnName,omitempty"`
+	Index      int     `json:"index"`
+}
+
+// StatusChange is a move of a project from one column to another.
+// Column names are as they were at the time.
+type StatusChange struct {
+	ID           string    `json:"id"`
+	FromColumnID *string   `json:"fromColumnId"`
+	FromName     *string   `json:"fromName"`
+	ToColumnID   *string   `json:"toColumnId"`
+	ToName       *string   `json:"toName"`
+	ChangedBy    *string   `json:"changedBy,omitempty"`
+	ChangedAt    time.Time `json:"changedAt"`
+}
+
+// ListStatusHistoryResponse represents a project's status changes, oldest
+// first
+type ListStatusHistoryResponse struct {
+	Changes []StatusChange `json:"changes"`
+}
+
+//encore:api auth method=GET path=/orgs/:orgID/board/columns
+func ListBoardColumns(ctx context.Context, orgID string) (*ListBoardColumnsResponse, error) {
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		return nil, err
+	}
+	columns, err := boardColumns(ctx, orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list board columns", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch board columns",
+		}
+	}
+	return &ListBoardColumnsResponse{Columns: columns}, nil
+}
+
+//encore:api auth method=POST path=/orgs/:orgID/board/columns
+func CreateBoardColumn(ctx context.Context, orgID string, req *CreateBoardColumnRequest) (*BoardColumn, error) {
+	if err := requireOrgMember(ctx, orgID, "admin"); err != nil {
+		return nil, err
+	}
+	name, err := validateBoardColumn(req.Name, req.Color)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM org_board_columns WHERE org_id = $1`, orgID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count board columns", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create board column",
+		}
+	}
+	if count >= maxBoardColumns {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: fmt.Sprintf("A board can have at most %d columns", maxBoardColumns),
+		}
+	}
+	position := count
+	if req.Position != nil {
+		position = *req.Position
+	}
+
+	var id string
+	err = db.QueryRow(ctx, `
+		INSERT INTO org_board_columns (org_id, name, color, position)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		RETURNING id
+	`, orgID, name, req.Color, position).Scan(&id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create board column", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create board column",
+		}
+	}
+	return getBoardColumn(ctx, orgID, id)
+}
+
+//encore:api auth method=PATCH path=/orgs/:orgID/board/columns/:columnID
+func UpdateBoardColumn(ctx context.Context, orgID string, columnID string, req *UpdateBoardColumnRequest) (*BoardColumn, error) {
+	if err := requireOrgMember(ctx, orgID, "admin"); err != nil {
+		return nil, err
+	}
+	column, err := getBoardColumn(ctx, orgID, columnID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name != nil {
+		column.Name = *req.Name
+	}
+	if req.Color != nil {
+		column.Color = *req.Color
+	}
+	if req.Position != nil {
+		column.Position = *req.Position
+	}
+	if column.Name, err = validateBoardColumn(column.Name, column.Color); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE org_board_columns SET name = $3, color = NULLIF($4, ''), position = $5, updated_at = NOW()
+		WHERE id = $1 AND org_id = $2
+	`, columnID, orgID, column.Name, column.Color, column.Position)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update board column", "column_id", columnID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update board column",
+		}
+	}
+	return getBoardColumn(ctx, orgID, columnID)
+}
+
+// DeleteBoardColumn removes a column. Its projects become unassigned.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/board/columns/:columnID
+func DeleteBoardColumn(ctx context.Context, orgID string, columnID string) error {
+	if err := requireOrgMember(ctx, orgID, "admin"); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `DELETE FROM org_board_columns WHERE id = $1 AND org_id = $2`, columnID, orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete board column", "column_id", columnID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete board column",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Board column not found",
+		}
+	}
+	return nil
+}
+
+// GetBoard lists an organization's projects by column, with each lane's
+// count.
+//
+//encore:api auth method=GET path=/orgs/:orgID/board
+func GetBoard(ctx context.Context, orgID string, req *GetBoardRequest) (*Board, error) {
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		return nil, err
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxBoardLaneSize {
+		limit = defaultBoardLaneSize
+	}
+	log := reqctx.Logger(ctx).With("org_id", orgID)
+
+	columns, err := boardColumns(ctx, orgID)
+	if err != nil {
+		log.Error("failed to list board columns", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch board",
+		}
+	}
+	board := &Board{OrgID: orgID, Lanes: []BoardLane{{Projects: []Project{}}}}
+	lanes := map[string]*BoardLane{}
+	for i := range columns {
+		if req.Column == "" || req.Column == columns[i].ID {
+			board.Lanes = append(board.Lanes, BoardLane{Column: &columns[i], Projects: []Project{}})
+		}
+	}
+	if req.Column != "" && req.Column != BoardUnassigned {
+		if len(board.Lanes) == 1 {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Board column not found",
+			}
+		}
+		board.Lanes = board.Lanes[1:]
+	} else if req.Column == BoardUnassigned {
+		board.Lanes = board.Lanes[:1]
+	}
+	for i := range board.Lanes {
+		key := ""
+		if c := board.Lanes[i].Column; c != nil {
+			key = c.ID
+		}
+		lanes[key] = &board.Lanes[i]
+	}
+
+	counts, err := db.Query(ctx, `
+		SELECT COALESCE(board_column_id::text, ''), COUNT(*) FROM projects
+		WHERE org_id::text = $1 AND deleted_at IS NULL
+		GROUP BY board_column_id
+	`, orgID)
+	if err != nil {
+		log.Error("failed to count board projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch board",
+		}
+	}
+	for counts.Next() {
+		var key string
+		var n int
+		if err := counts.Scan(&key, &n); err == nil && lanes[key] != nil {
+			lanes[key].Count = n
+		}
+	}
+	counts.Close()
+
+	offset := 0
+	if req.Column != "" {
+		offset = max(req.Offset, 0)
+	}
+	// p.id breaks ties so pages neither overlap nor skip projects.
+	rows, err := db.Query(ctx, `
+		SELECT id, title, slug, owner_id, description, thumbnail, tags, is_public, created_at, updated_at, org_id, custom_fields, lane
+		FROM (
+			SELECT p.*, COALESCE(p.board_column_id::text, '') AS lane,
+				row_number() OVER (PARTITION BY p.board_column_id ORDER BY p.board_position, p.id) AS n
+			FROM projects p
+			WHERE p.org_id::text = $1 AND p.deleted_at IS NULL
+		) ranked
+		WHERE n > $2 AND n <= $2 + $3
+		ORDER BY lane, n
+	`, orgID, offset, limit)
+	if err != nil {
+		log.Error("failed to list board projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch board",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Project
+		var key string
+		err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.OwnerID, &p.Description, &p.Thumbnail, &p.Tags, &p.IsPublic, &p.CreatedAt, &p.UpdatedAt, &p.OrgID, &p.CustomFields, &key)
+		if err != nil {
+			continue
+		}
+		if lane := lanes[key]; lane != nil {
+			lane.Projects = append(lane.Projects, p)
+		}
+	}
+	return board, nil
+}
+
+// MoveProjectStatus moves a project to a column of its organization's
+// board, or to another place in its column. A change of column is
+// recorded in the project's status history.
+//
+//encore:api auth method=POST path=/projects/:id/status
+func MoveProjectStatus(ctx context.Context, id string, req *MoveProjectStatusRequest) (*ProjectStatus, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	log := reqctx.Logger(ctx).With("project_id", id)
+	failed := &errs.Error{
+		Code:    errs.Internal,
+		Message: "Failed to move project",
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		log.Error("failed to begin transaction", "error", err)
+		return nil, failed
+	}
+	defer tx.Rollback()
+
+	var orgID sql.NullString
+	var fromID, fromName *string
+	err = tx.QueryRow(ctx, `
+		SELECT p.org_id, p.board_column_id, c.name
+		FROM projects p
+		LEFT JOIN org_board_columns c ON c.id = p.board_column_id
+		WHERE p.id = $1 AND p.deleted_at IS NULL
+		FOR UPDATE OF p
+	`, id).Scan(&orgID, &fromID, &fromName)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if !orgID.Valid {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Only organization projects are on a board",
+		}
+	}
+
+	status := &ProjectStatus{}
+	if req.ColumnID != "" {
+		var name string
+		err := tx.QueryRow(ctx, `
+			SELECT name FROM org_board_columns WHERE id::text = $1 AND org_id = $2
+		`, req.ColumnID, orgID.String).Scan(&name)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Board column not found",
+			}
+		}
+		status.ColumnID, status.ColumnName = &req.ColumnID, &name
+	}
+
+	position, index, err := boardPosition(ctx, tx, orgID.String, status.ColumnID, id, req.Index)
+	if err != nil {
+		log.Error("failed to place project on board", "error", err)
+		return nil, failed
+	}
+	status.Index = index
+
+	_, err = tx.Exec(ctx, `
+		UPDATE projects SET board_column_id = $2::uuid, board_position = $3 WHERE id = $1
+	`, id, status.ColumnID, position)
+	if err != nil {
+		log.Error("failed to move project", "error", err)
+		return nil, failed
+	}
+	if !sameColumn(fromID, status.ColumnID) {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO project_status_history (project_id, from_column_id, from_name, to_column_id, to_name, changed_by)
+			VALUES ($1, $2::uuid, $3, $4::uuid, $5, $6)
+		`, id, fromID, fromName, status.ColumnID, status.ColumnName, auth.UserID())
+		if err != nil {
+			log.Error("failed to record status change", "error", err)
+			return nil, failed
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("failed to move project", "error", err)
+		return nil, failed
+	}
+	return status, nil
+}
+
+//encore:api auth method=GET path=/projects/:id/status-history
+func ListStatusHistory(ctx context.Context, id string) (*ListStatusHistoryResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, `
+		SELECT id, from_column_id, from_name, to_column_id, to_name, changed_by, changed_at
+		FROM project_status_history WHERE project_id = $1
+		ORDER BY changed_at, id
+	`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list status history", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch status history",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListStatusHistoryResponse{Changes: []StatusChange{}}
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.ID, &c.FromColumnID, &c.FromName, &c.ToColumnID, &c.ToName, &c.ChangedBy, &c.ChangedAt); err != nil {
+			continue
+		}
+		resp.Changes = append(resp.Changes, c)
+	}
+	return resp, nil
+}
+
+// boardPosition returns the position that puts a project at index among
+// the other projects of a column, or last without one. When neighbouring
+// positions get too close to split, the column is renumbered first.
+func boardPosition(ctx context.Context, tx *sqldb.Tx, orgID string, columnID *string, projectID string, index *int) (float64, int, error) {
+	const others = `
+		FROM projects WHERE org_id = $1 AND board_column_id IS NOT DISTINCT FROM $2::uuid
+			AND id <> $3 AND deleted_at IS NULL`
+	load := func() ([]float64, error) {
+		rows, err := tx.Query(ctx, `SELECT board_position`+others+` ORDER BY board_position, id`, orgID, columnID, projectID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var positions []float64
+		for rows.Next() {
+			var p float64
+			if err := rows.Scan(&p); err != nil {
+				return nil, err
+			}
+			positions = append(positions, p)
+		}
+		return positions, rows.Err()
+	}
+
+	positions, err := load()
+	if err != nil {
+		return 0, 0, err
+	}
+	i := len(positions)
+	if index != nil {
+		i = min(max(*index, 0), len(positions))
+	}
+	switch {
+	case len(positions) == 0:
+		return 1, 0, nil
+	case i == 0:
+		return positions[0] - 1, i, nil
+	case i == len(positions):
+		return positions[i-1] + 1, i, nil
+	}
+	if positions[i]-positions[i-1] < minBoardPositionDelta {
+		_, err := tx.Exec(ctx, `
+			UPDATE projects p SET board_position = r.n
+			FROM (SELECT id, row_number() OVER (ORDER BY board_position, id) AS n`+others+`) r
+			WHERE p.id = r.id
+		`, orgID, columnID, projectID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if positions, err = load(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return (positions[i-1] + positions[i]) / 2, i, nil
+}
+
+func sameColumn(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func validateBoardColumn(name, color string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxBoardColumnName {
+		return "", &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("name must be between 1 and %d characters", maxBoardColumnName),
+		}
+	}
+	if color != "" && !boardColorPattern.MatchString(color) {
+		return "", &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "color must be a hex color such as #3b82f6",
+		}
+	}
+	return name, nil
+}
+
+// boardColumns returns an organization's columns, left to right.
+func boardColumns(ctx context.Context, orgID string) ([]BoardColumn, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, org_id, name, COALESCE(color, ''), position, created_at, updated_at
+		FROM org_board_columns WHERE org_id = $1
+		ORDER BY position, created_at, id
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []BoardColumn{}
+	for rows.Next() {
+		var c BoardColumn
+		if err := rows.Scan(&c.ID, &c.OrgID, &c.Name, &c.Color, &c.Position, &c.CreatedAt, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+func getBoardColumn(ctx context.Context, orgID, columnID string) (*BoardColumn, error) {
+	var c BoardColumn
+	err := db.QueryRow(ctx, `
+		SELECT id, org_id, name, COALESCE(color, ''), position, created_at, updated_at
+		FROM org_board_columns WHERE id = $1 AND org_id = $2
+	`, columnID, orgID).Scan(&c.ID, &c.OrgID, &c.Name, &c.Color, &c.Position, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Board column not found",
+		}
+	}
+	return &c, nil
+}
@@ -0,0 +1,306 @@
+package project
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+
+	"canvasai/permissions"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Plans
+const (
+	PlanFree = "free"
+	PlanPro  = "pro"
+	PlanTeam = "team"
+)
+
+// DocumentBudgets caps the serialized canvas size per plan, in bytes. Zero
+// uses the default; nothing may exceed maxCanvasSize.
+type DocumentBudgets struct {
+	Free int `json:"free"`
+	Pro  int `json:"pro"`
+	Team int `json:"team"`
+	// WarnPercent is the share of the budget at which saves start warning
+	WarnPercent int `json:"warnPercent"`
+}
+
+var budgetCfg struct {
+	DocumentBudgets DocumentBudgets
+}
+
+var _ = config.Load(context.Background(), &budgetCfg)
+
+const (
+	defaultFreeBudget  = 2 << 20
+	defaultProBudget   = 5 << 20
+	defaultTeamBudget  = maxCanvasSize
+	defaultWarnPercent = 80
+
+	// heavyElementLimit bounds how many elements the size report lists
+	heavyElementLimit = 20
+)
+
+// Budget levels
+const (
+	BudgetOK       = "ok"
+	BudgetWarning  = "warning"
+	BudgetExceeded = "exceeded"
+)
+
+// SizeBudget measures a canvas document against its plan's limit
+type SizeBudget struct {
+	Plan    string `json:"plan"`
+	Bytes   int    `json:"bytes"`
+	Limit   int    `json:"limit"`
+	Percent int    `json:"percent"`
+	Level   string `json:"level"`
+	Message string `json:"message,omitempty"`
+	// UpgradePlan is the next plan up, when the document is over budget
+	UpgradePlan string `json:"upgradePlan,omitempty"`
+}
+
+// ErrDetails marks SizeBudget as structured error details.
+func (*SizeBudget) ErrDetails() {}
+
+// HeavyElement is an element that contributes much of a document's size
+type HeavyElement struct {
+	ID     string `json:"id,omitempty"`
+	Type   string `json:"type"`
+	PageID string `json:"pageId"`
+	Bytes  int    `json:"bytes"`
+	// EmbeddedBytes is the part of Bytes taken by inline data URIs
+	EmbeddedBytes int    `json:"embeddedBytes,omitempty"`
+	Suggestion    string `json:"suggestion"`
+}
+
+// SizeReport is the size analysis of a project's canvas
+type SizeReport struct {
+	Budget   SizeBudget     `json:"budget"`
+	Elements []HeavyElement `json:"elements"`
+}
+
+//encore:api auth method=GET path=/projects/:id/size
+func AnalyzeProjectSize(ctx context.Context, id string) (*SizeReport, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+
+	var canvasData []byte
+	var plan string
+	err := db.QueryRow(ctx, `
+		SELECT p.canvas_data, u.plan FROM projects p
+		JOIN users u ON u.id = p.owner_id
+		WHERE p.id = $1
+	`, id).Scan(&canvasData, &plan)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+
+	var compact bytes.Buffer
+	if len(canvasData) > 0 {
+		if err := json.Compact(&compact, canvasData); err != nil {
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to analyze project",
+			}
+		}
+	}
+	elements, err := heavyElements(compact.Bytes())
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Invalid canvas data: " + err.Error(),
+		}
+	}
+	return &SizeReport{
+		Budget:   *measureBudget(plan, compact.Len()),
+		Elements: elements,
+	}, nil
+}
+
+// checkDocumentBudget measures a canvas document of size bytes owned by
+// ownerID, rejecting it if it exceeds the owner's plan budget.
+func checkDocumentBudget(ctx context.Context, ownerID string, size int) (*SizeBudget, error) {
+	var plan string
+	if err := db.QueryRow(ctx, `SELECT plan FROM users WHERE id = $1`, ownerID).Scan(&plan); err != nil {
+		reqctx.Logger(ctx).Error("failed to load plan", "user_id", ownerID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check document size",
+		}
+	}
+	budget := measureBudget(plan, size)
+	if budget.Level == BudgetExceeded {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: budget.Message,
+			Details: budget,
+		}
+	}
+	return budget, nil
+}
+
+// checkProjectBudget is checkDocumentBudget for an existing project.
+func checkProjectBudget(ctx context.Context, projectID string, size int) (*SizeBudget, error) {
+	var ownerID string
+	if err := db.QueryRow(ctx, `SELECT owner_id FROM projects WHERE id = $1`, projectID).Scan(&ownerID); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	return checkDocumentBudget(ctx, ownerID, size)
+}
+
+func measureBudget(plan string, size int) *SizeBudget {
+	limits := budgetCfg.DocumentBudgets
+	var limit int
+	switch plan {
+	case PlanPro:
+		limit = orDefault(limits.Pro, defaultProBudget)
+	case PlanTeam:
+		limit = orDefault(limits.Team, defaultTeamBudget)
+	default:
+		plan = PlanFree
+		limit = orDefault(limits.Free, defaultFreeBudget)
+	}
+	if limit > maxCanvasSize {
+		limit = maxCanvasSize
+	}
+	warnAt := orDefault(limits.WarnPercent, defaultWarnPercent)
+
+	b := &SizeBudget{
+		Plan:    plan,
+		Bytes:   size,
+		Limit:   limit,
+		Percent: size * 100 / limit,
+		Level:   BudgetOK,
+	}
+	switch {
+	case size > limit:
+		b.Level = BudgetExceeded
+		b.Message = fmt.Sprintf("Document is %s, over the %s limit of the %s plan. Move embedded images to uploaded assets to reduce its size.",
+			formatBytes(size), formatBytes(limit), plan) +
+			upgradeHint(plan, func(plan string) int { return measureBudget(plan, 0).Limit }, formatBytes)
+		b.UpgradePlan = upgradePlan(plan)
+	case b.Percent >= warnAt:
+		b.Level = BudgetWarning
+		b.Message = fmt.Sprintf("Document is at %d%% of the %s limit of the %s plan.", b.Percent, formatBytes(limit), plan)
+	}
+	return b
+}
+
+// heavyElements returns the largest elements of a compact canvas document,
+// biggest first, with a suggestion for shrinking each.
+func heavyElements(canvasData []byte) ([]HeavyElement, error) {
+	elements := []HeavyElement{}
+	if len(canvasData) == 0 {
+		return elements, nil
+	}
+
+	// Elements are kept raw so each is measured as it is stored.
+	type page struct {
+		ID      string            `json:"id"`
+		Objects []json.RawMessage `json:"objects"`
+	}
+	var doc struct {
+		Pages   []page            `json:"pages"`
+		Objects []json.RawMessage `json:"objects"`
+	}
+	if err := json.Unmarshal(canvasData, &doc); err != nil {
+		return nil, fmt.Errorf("canvas data must be a JSON object")
+	}
+	if len(doc.Pages) == 0 {
+		doc.Pages = []page{{ID: render.DefaultPageID, Objects: doc.Objects}}
+	}
+
+	for _, p := range doc.Pages {
+		for _, raw := range p.Objects {
+			var obj map[string]any
+			if err := json.Unmarshal(raw, &obj); err != nil {
+				continue
+			}
+			e := HeavyElement{PageID: p.ID, Bytes: len(raw)}
+			e.ID, _ = obj["id"].(string)
+			e.Type, _ = obj["type"].(string)
+			e.EmbeddedBytes = embeddedBytes(obj)
+			e.Suggestion = suggestFix(e, obj)
+			elements = append(elements, e)
+		}
+	}
+
+	sort.SliceStable(elements, func(i, j int) bool { return elements[i].Bytes > elements[j].Bytes })
+	if len(elements) > heavyElementLimit {
+		elements = elements[:heavyElementLimit]
+	}
+	return elements, nil
+}
+
+// embeddedBytes totals the inline data URIs anywhere within node.
+func embeddedBytes(node any) int {
+	switch v := node.(type) {
+	case string:
+		if strings.HasPrefix(v, "data:") {
+			return len(v)
+		}
+	case map[string]any:
+		n := 0
+		for _, child := range v {
+			n += embeddedBytes(child)
+		}
+		return n
+	case []any:
+		n := 0
+		for _, child := range v {
+			n += embeddedBytes(child)
+		}
+		return n
+	}
+	return 0
+}
+
+func suggestFix(e HeavyElement, obj map[string]any) string {
+	switch {
+	case e.EmbeddedBytes*2 > e.Bytes:
+		return "Upload the embedded image as an asset and reference it by URL instead of inlining it."
+	case e.Type == "path" || e.Type == "polyline" || e.Type == "polygon":
+		return "Simplify the path to reduce its point count."
+	case e.Type == "group":
+		if children, ok := obj["objects"].([]any); ok && len(children) > 50 {
+			return fmt.Sprintf("Group holds %d elements; flatten it to an image if it no longer needs editing.", len(children))
+		}
+		return "Check the group's children for embedded images or complex paths."
+	case e.Type == "textbox" || e.Type == "i-text" || e.Type == "text":
+		return "Remove per-character styles that are no longer needed."
+	}
+	return "Remove unused properties or split the element into simpler shapes."
+}
+
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,430 @@
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+// maxCanvasSize bounds a canvas document's serialized size
+const maxCanvasSize = 10 << 20
+
+// CanvasSchemaVersion is the version of the canvas document written today.
+// Documents without a schemaVersion are version 1.
+const CanvasSchemaVersion = 2
+
+// canvasUpgrades[v] turns a version v canvas document into a version v+1
+// document. Add a step here whenever the document changes shape, then bump
+// CanvasSchemaVersion. Stored documents are upgraded when they are read
+// and saves store the current version.
+var canvasUpgrades = map[int]func(doc map[string]any){
+	// Version 2 stacks elements in list order and drops layerIndex.
+	1: func(doc map[string]any) { walkElementLists(doc, stackByLayerIndex) },
+}
+
+const (
+	maxCanvasPages      = 200
+	maxCanvasElements   = 20000
+	maxGroupDepth       = 20
+	maxCanvasIDLength   = 200
+	maxElementType      = 40
+	maxElementText      = 100000
+	maxElementPoints    = 100000
+	maxColorLength      = 200
+	maxCanvasCoordinate = 1e6
+)
+
+// canvasNumbers bounds the numeric element properties
+var canvasNumbers = []struct {
+	key      string
+	min, max float64
+}{
+	{"left", -maxCanvasCoordinate, maxCanvasCoordinate},
+	{"top", -maxCanvasCoordinate, maxCanvasCoordinate},
+	{"x1", -maxCanvasCoordinate, maxCanvasCoordinate},
+	{"y1", -maxCanvasCoordinate, maxCanvasCoordinate},
+	{"x2", -maxCanvasCoordinate, maxCanvasCoordinate},
+	{"y2", -maxCanvasCoordinate, maxCanvasCoordinate},
+	{"width", 0, maxCanvasCoordinate},
+	{"height", 0, maxCanvasCoordinate},
+	{"rx", 0, maxCanvasCoordinate},
+	{"ry", 0, maxCanvasCoordinate},
+	{"radius", 0, maxCanvasCoordinate},
+	{"strokeWidth", 0, maxCanvasCoordinate},
+	{"fontSize", 0, maxCanvasCoordinate},
+	{"scaleX", -10000, 10000},
+	{"scaleY", -10000, 10000},
+	{"angle", -3600, 3600},
+	{"skewX", -90, 90},
+	{"skewY", -90, 90},
+	{"opacity", 0, 1},
+}
+
+// canvasBools are the boolean element properties
+var canvasBools = []string{"visible", "locked", "flipX", "flipY", "selectable", "evented"}
+
+// canvasOrigins lists the named values of originX and originY, which may
+// also be numbers
+var canvasOrigins = map[string][]string{
+	"originX": {"left", "center", "right"},
+	"originY": {"top", "center", "bottom"},
+}
+
+// validateCanvasDocument checks that raw is a well-formed canvas document of
+// any supported version. Errors name the offending field, e.g.
+// "pages[0].objects[3].opacity: must be between 0 and 1".
+func validateCanvasDocument(raw []byte) error {
+	_, err := parseCanvasDocument(raw)
+	return err
+}
+
+// normalizeCanvasDocument validates raw and returns it upgraded to the
+// current schema version, as saves store it.
+func normalizeCanvasDocument(raw []byte) ([]byte, error) {
+	doc, err := parseCanvasDocument(raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func parseCanvasDocument(raw []byte) (map[string]any, error) {
+	if len(raw) > maxCanvasSize {
+		return nil, fmt.Errorf("canvas data exceeds %d bytes", maxCanvasSize)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(raw, &doc); err != nil || doc == nil {
+		return nil, fmt.Errorf("canvas data must be a JSON object")
+	}
+	if err := upgradeCanvas(doc); err != nil {
+		return nil, err
+	}
+	v := &canvasValidator{}
+	if err := v.document(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// upgradeCanvas brings a decoded document up to CanvasSchemaVersion in
+// place.
+func upgradeCanvas(doc map[string]any) error {
+	version := 1
+	if raw, ok := doc["schemaVersion"]; ok {
+		n, ok := raw.(float64)
+		if !ok || n != math.Trunc(n) || n < 1 {
+			return fmt.Errorf("schemaVersion: must be a positive integer")
+		}
+		if n > CanvasSchemaVersion {
+			return fmt.Errorf("schemaVersion: %v is newer than this server supports (%d)", n, CanvasSchemaVersion)
+		}
+		version = int(n)
+	}
+	for ; version < CanvasSchemaVersion; version++ {
+		step, ok := canvasUpgrades[version]
+		if !ok {
+			return fmt.Errorf("schemaVersion: no upgrade from version %d", version)
+		}
+		step(doc)
+	}
+	doc["schemaVersion"] = CanvasSchemaVersion
+	return nil
+}
+
+// upgradeCanvasData upgrades a stored document for a reader. Documents that
+// cannot be upgraded are returned unchanged.
+func upgradeCanvasData(raw []byte) []byte {
+	var doc map[string]any
+	if len(raw) == 0 || json.Unmarshal(raw, &doc) != nil || doc == nil {
+		return raw
+	}
+	if v, ok := doc["schemaVersion"].(float64); ok && v == CanvasSchemaVersion {
+		return raw
+	}
+	if upgradeCanvas(doc) != nil {
+		return raw
+	}
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return raw
+	}
+	return upgraded
+}
+
+// upgradeCanvasValue is upgradeCanvasData for a document already decoded.
+func upgradeCanvasValue(v any) any {
+	if doc, ok := v.(map[string]any); ok {
+		_ = upgradeCanvas(doc)
+	}
+	return v
+}
+
+// walkElementLists calls fn with every element list of a document: the
+// top-level objects, each page's objects and each group's children.
+func walkElementLists(doc map[string]any, fn func([]any)) {
+	var walk func(list []any)
+	walk = func(list []any) {
+		fn(list)
+		for _, el := range list {
+			if obj, ok := el.(map[string]any); ok {
+				if children, ok := obj["objects"].([]any); ok {
+					walk(children)
+				}
+			}
+		}
+	}
+	if list, ok := doc["objects"].([]any); ok {
+		walk(list)
+	}
+	if pages, ok := doc["pages"].([]any); ok {
+		for _, p := range pages {
+			if page, ok := p.(map[string]any); ok {
+				if list, ok := page["objects"].([]any); ok {
+					walk(list)
+				}
+			}
+		}
+	}
+}
+
+// stackByLayerIndex orders a version 1 element list by layerIndex, keeping
+// elements without one where they are relative to each other.
+func stackByLayerIndex(list []any) {
+	type layered struct {
+		index float64
+		el    any
+	}
+	sorted := make([]layered, len(list))
+	for i, el := range list {
+		sorted[i] = layered{float64(i), el}
+		if obj, ok := el.(map[string]any); ok {
+			if n, ok := obj["layerIndex"].(float64); ok {
+				sorted[i].index = n
+			}
+			delete(obj, "layerIndex")
+		}
+	}
+	sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].index < sorted[b].index })
+	for i := range sorted {
+		list[i] = sorted[i].el
+	}
+}
+
+// canvasValidator checks a current-version document
+type canvasValidator struct {
+	elements int
+}
+
+func (v *canvasValidator) document(doc map[string]any) error {
+	if raw, ok := doc["pages"]; ok && raw != nil {
+		pages, ok := raw.([]any)
+		if !ok {
+			return fmt.Errorf("pages: must be an array of pages")
+		}
+		if len(pages) > maxCanvasPages {
+			return fmt.Errorf("pages: at most %d pages are allowed", maxCanvasPages)
+		}
+		seen := map[string]bool{}
+		for i, p := range pages {
+			path := fmt.Sprintf("pages[%d]", i)
+			page, ok := p.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: must be an object", path)
+			}
+			id, ok := page["id"].(string)
+			if !ok || id == "" || len(id) > maxCanvasIDLength {
+				return fmt.Errorf("%s.id: must be a string of 1 to %d characters", path, maxCanvasIDLength)
+			}
+			if seen[id] {
+				return fmt.Errorf("%s.id: duplicates another page's id %q", path, id)
+			}
+			seen[id] = true
+			if err := optionalString(page, path, "name", maxCanvasIDLength); err != nil {
+				return err
+			}
+			if err := v.elementList(page["objects"], path+".objects", 0); err != nil {
+				return err
+			}
+		}
+	}
+	if err := v.elementList(doc["objects"], "objects", 0); err != nil {
+		return err
+	}
+	if bg, ok := doc["background"]; ok {
+		if err := checkPaint(bg, "background"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *canvasValidator) elementList(raw any, path string, depth int) error {
+	if raw == nil {
+		return nil
+	}
+	list, ok := raw.([]any)
+	if !ok {
+		return fmt.Errorf("%s: must be an array of elements", path)
+	}
+	for i, el := range list {
+		if err := v.element(el, fmt.Sprintf("%s[%d]", path, i), depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *canvasValidator) element(raw any, path string, depth int) error {
+	obj, ok := raw.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: must be an object", path)
+	}
+	v.elements++
+	if v.elements > maxCanvasElements {
+		return fmt.Errorf("%s: a canvas can have at most %d elements", path, maxCanvasElements)
+	}
+
+	kind, ok := obj["type"].(string)
+	if !ok || kind == "" || len(kind) > maxElementType {
+		return fmt.Errorf("%s.type: is required", path)
+	}
+	for _, key := range []string{"id", "name"} {
+		if err := optionalString(obj, path, key, maxCanvasIDLength); err != nil {
+			return err
+		}
+	}
+	if err := optionalString(obj, path, "text", maxElementText); err != nil {
+		return err
+	}
+	for _, bounds := range canvasNumbers {
+		key := bounds.key
+		raw, ok := obj[key]
+		if !ok || raw == nil {
+			continue
+		}
+		n, ok := raw.(float64)
+		if !ok {
+			return fmt.Errorf("%s.%s: must be a number", path, key)
+		}
+		if n < bounds.min || n > bounds.max {
+			return fmt.Errorf("%s.%s: must be between %g and %g", path, key, bounds.min, bounds.max)
+		}
+	}
+	for _, key := range canvasBools {
+		if raw, ok := obj[key]; ok && raw != nil {
+			if _, ok := raw.(bool); !ok {
+				return fmt.Errorf("%s.%s: must be true or false", path, key)
+			}
+		}
+	}
+	for _, key := range []string{"originX", "originY"} {
+		named := canvasOrigins[key]
+		switch o := obj[key].(type) {
+		case nil, float64:
+		case string:
+			if !slices.Contains(named, o) {
+				return fmt.Errorf("%s.%s: must be %s, %s or %s", path, key, named[0], named[1], named[2])
+			}
+		default:
+			return fmt.Errorf("%s.%s: must be a string or number", path, key)
+		}
+	}
+	for _, key := range []string{"fill", "stroke"} {
+		if err := checkPaint(obj[key], path+"."+key); err != nil {
+			return err
+		}
+	}
+	if raw, ok := obj["points"]; ok && raw != nil {
+		points, ok := raw.([]any)
+		if !ok || len(points) > maxElementPoints {
+			return fmt.Errorf("%s.points: must be an array of at most %d points", path, maxElementPoints)
+		}
+		for i, p := range points {
+			pt, ok := p.(map[string]any)
+			_, xok := pt["x"].(float64)
+			_, yok := pt["y"].(float64)
+			if !ok || !xok || !yok {
+				return fmt.Errorf("%s.points[%d]: must have numeric x and y", path, i)
+			}
+		}
+	}
+	if children, ok := obj["objects"]; ok && children != nil {
+		if depth+1 > maxGroupDepth {
+			return fmt.Errorf("%s.objects: groups can be nested at most %d deep", path, maxGroupDepth)
+		}
+		if err := v.elementList(children, path+".objects", depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPaint validates a fill or stroke: a color string, a gradient or an
+// image pattern.
+func checkPaint(raw any, path string) error {
+	switch p := raw.(type) {
+	case nil:
+		return nil
+	case string:
+		if len(p) > maxColorLength {
+			return fmt.Errorf("%s: must be at most %d characters", path, maxColorLength)
+		}
+		return nil
+	case map[string]any:
+		if src, ok := p["source"]; ok {
+			if _, ok := src.(string); !ok {
+				return fmt.Errorf("%s.source: must be a string", path)
+			}
+			return nil
+		}
+		if t := p["type"]; t != "linear" && t != "radial" {
+			return fmt.Errorf("%s.type: must be linear or radial", path)
+		}
+		stops, ok := p["colorStops"].([]any)
+		if !ok {
+			return fmt.Errorf("%s.colorStops: must be an array", path)
+		}
+		for i, s := range stops {
+			stop, ok := s.(map[string]any)
+			offset, offsetOK := stop["offset"].(float64)
+			color, colorOK := stop["color"].(string)
+			if !ok || !offsetOK || offset < 0 || offset > 1 {
+				return fmt.Errorf("%s.colorStops[%d].offset: must be between 0 and 1", path, i)
+			}
+			if !colorOK || len(color) > maxColorLength {
+				return fmt.Errorf("%s.colorStops[%d].color: must be a color", path, i)
+			}
+		}
+		if raw, ok := p["coords"]; ok && raw != nil {
+			coords, ok := raw.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s.coords: must be an object", path)
+			}
+			for key, c := range coords {
+				if _, ok := c.(float64); !ok {
+					return fmt.Errorf("%s.coords.%s: must be a number", path, key)
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s: must be a color, gradient or pattern", path)
+	}
+}
+
+func optionalString(obj map[string]any, path, key string, max int) error {
+	raw, ok := obj[key]
+	if !ok || raw == nil {
+		return nil
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return fmt.Errorf("%s.%s: must be a string", path, key)
+	}
+	if len(s) > max {
+		return fmt.Errorf("%s.%s: must be at most %d characters", path, key, max)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/notification"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+	"canvasai/webhook"
+)
+
+// Collaborators with accounts can be added directly; people without one are
+// invited by email (see invites.go). Only the owner adds collaborators and
+// changes their roles, and the owner's own row cannot be changed here.
+// Every change notifies the person it affects.
+
+// AddCollaboratorRequest represents the add collaborator request
+type AddCollaboratorRequest struct {
+	// UserID or Email identifies an existing account
+	UserID string `json:"userId,omitempty"`
+	Email  string `json:"email,omitempty"`
+	// Role defaults to viewer
+	Role string `json:"role,omitempty"`
+}
+
+// UpdateCollaboratorRequest represents the update collaborator request
+type UpdateCollaboratorRequest struct {
+	Role string `json:"role"`
+}
+
+//encore:api auth method=POST path=/projects/:id/collaborators
+func AddCollaborator(ctx context.Context, id string, req *AddCollaboratorRequest) (*Collaborator, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+	actorID := auth.UserID()
+	if err := denyGuest(ctx, actorID); err != nil {
+		return nil, err
+	}
+	role := req.Role
+	if role == "" {
+		role = string(permissions.RoleViewer)
+	}
+	if err := validateCollaboratorRole(role); err != nil {
+		return nil, err
+	}
+
+	var userID string
+	err := db.QueryRow(ctx, `
+		SELECT id FROM users
+		WHERE (id::text = $1 OR ($2 <> '' AND lower(email) = $2)) AND deactivated_at IS NULL
+	`, req.UserID, strings.ToLower(strings.TrimSpace(req.Email))).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "User not found; invite them by email instead",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to look up collaborator", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to add collaborator",
+		}
+	}
+
+	collab := &Collaborator{UserID: userID, Role: role}
+	err = db.QueryRow(ctx, `
+		INSERT INTO project_collaborators (project_id, user_id, role, invited_by, accepted_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (project_id, user_id) DO NOTHING
+		RETURNING invited_at
+	`, id, userID, role, actorID).Scan(&collab.AddedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "This person is already a collaborator",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to add collaborator", "project_id", id, "user_id", userID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to add collaborator",
+		}
+	}
+
+	projectaccess.Forget(id)
+	reqctx.Logger(ctx).Info("collaborator added", "project_id", id, "user_id", userID, "role", role)
+	notifyCollaborator(ctx, id, userID, "project.collaborator.added", role, func(project string) string {
+		return "You were added to " + project + " as " + articleRole(role)
+	})
+	emitCollaboratorEvent(ctx, webhook.EventCollaboratorAdded, id, map[string]string{
+		"projectId": id, "userId": userID, "role": role, "addedBy": actorID,
+	})
+	return collab, nil
+}
+
+// UpdateCollaborator changes a collaborator's role. Ownership cannot be
+// given or taken away this way.
+//
+//encore:api auth method=PATCH path=/projects/:id/collaborators/:userID
+func UpdateCollaborator(ctx context.Context, id string, userID string, req *UpdateCollaboratorRequest) (*Collaborator, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+	if err := validateCollaboratorRole(req.Role); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update collaborator",
+		}
+	}
+	defer tx.Rollback()
+
+	collab := &Collaborator{UserID: userID, Role: req.Role}
+	var previous string
+	err = tx.QueryRow(ctx, `
+		SELECT role, invited_at FROM project_collaborators
+		WHERE project_id = $1 AND user_id::text = $2
+		FOR UPDATE
+	`, id, userID).Scan(&previous, &collab.AddedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Collaborator not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load collaborator", "project_id", id, "user_id", userID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update collaborator",
+		}
+	}
+	if previous == string(permissions.RoleOwner) {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "The owner's role cannot be changed",
+		}
+	}
+	if previous == req.Role {
+		return collab, nil
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE project_collaborators SET role = $3 WHERE project_id = $1 AND user_id::text = $2
+	`, id, userID, req.Role)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update collaborator", "project_id", id, "user_id", userID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update collaborator",
+		}
+	}
+
+	projectaccess.Forget(id)
+	reqctx.Logger(ctx).Info("collaborator role changed", "project_id", id, "user_id", userID, "from", previous, "to", req.Role)
+	notifyCollaborator(ctx, id, userID, "project.collaborator.role_changed", req.Role, func(project string) string {
+		return "You are now " + articleRole(req.Role) + " on " + project
+	})
+	return collab, nil
+}
+
+// RemoveCollaborator removes a collaborator. The owner can remove anyone
+// but themselves, and any other collaborator can remove themselves to
+// leave the project.
+//
+//encore:api auth method=DELETE path=/projects/:id/collaborators/:userID
+func RemoveCollaborator(ctx context.Context, id string, userID string) error {
+	actorID := auth.UserID()
+	leaving := userID == actorID
+	if !leaving {
+		if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+			return err
+		}
+	}
+
+	var role string
+	err := db.QueryRow(ctx, `
+		DELETE FROM project_collaborators
+		WHERE project_id::text = $1 AND user_id::text = $2 AND role <> $3
+		RETURNING role
+	`, id, userID, string(permissions.RoleOwner)).Scan(&role)
+	if err == sql.ErrNoRows {
+		var isOwner bool
+		_ = db.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM project_collaborators WHERE project_id::text = $1 AND user_id::text = $2 AND role = $3
+			)
+		`, id, userID, string(permissions.RoleOwner)).Scan(&isOwner)
+		if isOwner {
+			return &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "The owner cannot leave their project; delete it instead",
+			}
+		}
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Collaborator not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to remove collaborator", "project_id", id, "user_id", userID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to remove collaborator",
+		}
+	}
+
+	projectaccess.Forget(id)
+	emitCollaboratorEvent(ctx, webhook.EventCollaboratorRemoved, id, map[string]string{
+		"projectId": id, "userId": userID, "role": role, "removedBy": actorID,
+	})
+	if leaving {
+		reqctx.Logger(ctx).Info("collaborator left project", "project_id", id, "user_id", userID)
+		var ownerID string
+		if err := db.QueryRow(ctx, `SELECT owner_id FROM projects WHERE id = $1`, id).Scan(&ownerID); err == nil {
+			name := collaboratorName(ctx, userID)
+			notifyCollaborator(ctx, id, ownerID, "project.collaborator.left", role, func(project string) string {
+				return name + " left " + project
+			})
+		}
+		return nil
+	}
+	reqctx.Logger(ctx).Info("collaborator removed", "project_id", id, "user_id", userID)
+	notifyCollaborator(ctx, id, userID, "project.collaborator.removed", role, func(project string) string {
+		return "You were removed from " + project
+	})
+	return nil
+}
+
+func validateCollaboratorRole(role string) error {
+	if !permissions.ValidRole(role) || role == string(permissions.RoleOwner) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Role must be editor, commenter or viewer",
+		}
+	}
+	return nil
+}
+
+// notifyCollaborator notifies userID of a change to a project's
+// collaborators, titled by title from the project's title. Failures are
+// logged; the change itself has been made.
+func notifyCollaborator(ctx context.Context, projectID, userID, kind, role string, title func(project string) string) {
+	var projectTitle string
+	if err := db.QueryRow(ctx, `SELECT title FROM projects WHERE id::text = $1`, projectID).Scan(&projectTitle); err != nil {
+		reqctx.Logger(ctx).Warn("failed to load project for notification", "project_id", projectID, "error", err)
+		return
+	}
+	link := "/projects/" + projectID
+	if kind == "project.collaborator.removed" {
+		link = ""
+	}
+	data, _ := json.Marshal(map[string]string{"projectId": projectID, "role": role, "by": auth.UserID()})
+	err := notification.Send(ctx, &notification.Message{
+		UserID: userID,
+		Kind:   kind,
+		Title:  title(projectTitle),
+		Link:   link,
+		Data:   data,
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to notify collaborator", "project_id", projectID, "user_id", userID, "kind", kind, "error", err)
+	}
+}
+
+// emitCollaboratorEvent emits a collaborator webhook event for projectID.
+// Failures are logged; the change itself has been made.
+func emitCollaboratorEvent(ctx context.Context, eventType, projectID string, data map[string]string) {
+	if err := webhook.Emit(ctx, &webhook.Event{Type: eventType, ProjectID: projectID}, data); err != nil {
+		reqctx.Logger(ctx).Error("failed to emit webhook event", "project_id", projectID, "type", eventType, "error", err)
+	}
+}
+
+// collaboratorName returns a user's display name, or their email.
+func collaboratorName(ctx context.Context, userID string) string {
+	var name string
+	if err := db.QueryRow(ctx, `SELECT COALESCE(NULLIF(name, ''), email) FROM users WHERE id::text = $1`, userID).Scan(&name); err != nil {
+		return "A collaborator"
+	}
+	return name
+}
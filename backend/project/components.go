@@ -0,0 +1,346 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+
+	"canvasai/reqctx"
+)
+
+// Shared component usage. Canvas elements placed from a shared component
+// carry its "componentId" and, when the library versions it, a
+// "componentVersion". After each canvas save the project's instances are
+// counted per component version, so an organization can see which
+// components are adopted, which projects are stuck on old versions, and
+// which components nobody has used lately and can be retired.
+
+// Component analytics bounds
+const (
+	defaultComponentDays = 90
+	maxComponentDays     = 365
+	componentAnalyticsN  = 50
+	maxComponentIDLength = 255
+	maxComponentVersion  = 50
+)
+
+var _ = pubsub.NewSubscription(CanvasSaves, "index-component-usage", pubsub.SubscriptionConfig[*CanvasSave]{
+	Handler:        indexComponentUsage,
+	MaxConcurrency: 4,
+})
+
+// componentKey is a version of a component
+type componentKey struct {
+	id      string
+	version string
+}
+
+// indexComponentUsage records the component instances of a saved canvas.
+// Like thumbnails, a save that is no longer the project's latest revision
+// is skipped.
+func indexComponentUsage(ctx context.Context, msg *CanvasSave) error {
+	var canvasData []byte
+	var revision int
+	err := db.QueryRow(ctx, `
+		SELECT canvas_data, version FROM projects WHERE id = $1 AND deleted_at IS NULL
+	`, msg.ProjectID).Scan(&canvasData, &revision)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if revision > msg.Revision {
+		return nil
+	}
+
+	counts := map[componentKey]int{}
+	if len(canvasData) > 0 {
+		var doc any
+		if err := json.Unmarshal(canvasData, &doc); err != nil {
+			// Retrying will not fix the document; the next save tries again.
+			reqctx.Logger(ctx).Warn("failed to parse canvas for component usage", "project_id", msg.ProjectID, "error", err)
+			return nil
+		}
+		countComponents(doc, counts)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids := make([]string, 0, len(counts))
+	versions := make([]string, 0, len(counts))
+	for k, n := range counts {
+		ids = append(ids, k.id)
+		versions = append(versions, k.version)
+		_, err := tx.Exec(ctx, `
+			INSERT INTO project_component_usage (project_id, component_id, version, instances)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (project_id, component_id, version) DO UPDATE
+			SET instances = EXCLUDED.instances, last_used_at = NOW()
+		`, msg.ProjectID, k.id, k.version, n)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE project_component_usage u SET instances = 0
+		WHERE project_id = $1 AND instances > 0
+			AND NOT EXISTS (
+				SELECT 1 FROM unnest($2::text[], $3::text[]) AS k(component_id, version)
+				WHERE k.component_id = u.component_id AND k.version = u.version
+			)
+	`, msg.ProjectID, ids, versions)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// countComponents adds the component instances in a canvas document,
+// including those nested in groups, to counts.
+func countComponents(node any, counts map[componentKey]int) {
+	switch v := node.(type) {
+	case map[string]any:
+		if id, _ := v["componentId"].(string); id != "" && len(id) <= maxComponentIDLength {
+			counts[componentKey{id: strings.ToLower(id), version: componentVersion(v["componentVersion"])}]++
+		}
+		for _, child := range v {
+			countComponents(child, counts)
+		}
+	case []any:
+		for _, child := range v {
+			countComponents(child, counts)
+		}
+	}
+}
+
+// componentVersion normalizes a "componentVersion" value, which libraries
+// write as a number or a string.
+func componentVersion(v any) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = strings.TrimSpace(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if len(s) > maxComponentVersion {
+		return ""
+	}
+	return s
+}
+
+// ComponentAnalyticsRequest represents the component analytics request
+type ComponentAnalyticsRequest struct {
+	// Days is the period covered, ending now; defaults to 90
+	Days int `query:"days"`
+}
+
+// ComponentVersionUsage is the adoption of one version of a component
+type ComponentVersionUsage struct {
+	// Version is empty for instances that do not name one
+	Version   string `json:"version"`
+	Projects  int    `json:"projects"`
+	Instances int    `json:"instances"`
+}
+
+// ComponentUsage is the adoption of a component across the organization's
+// projects
+type ComponentUsage struct {
+	ComponentID string `json:"componentId"`
+	// Projects and Instances count the projects currently using the
+	// component and its instances in them
+	Projects  int `json:"projects"`
+	Instances int `json:"instances"`
+	// Adoption is the share of the organization's projects using it
+	Adoption    float64                 `json:"adoption"`
+	Versions    []ComponentVersionUsage `json:"versions"`
+	FirstUsedAt time.Time               `json:"firstUsedAt"`
+	LastUsedAt  time.Time               `json:"lastUsedAt"`
+}
+
+// ComponentAnalyticsResponse summarizes shared component usage to guide
+// library cleanup
+type ComponentAnalyticsResponse struct {
+	Days int `json:"days"`
+	// Projects is the number of projects in the organization
+	Projects int `json:"projects"`
+	// TopComponents are the components used in the most projects
+	TopComponents []ComponentUsage `json:"topComponents"`
+	// StaleComponents were used before but saved in no project during the
+	// period, least recently used first: candidates for removal
+	StaleComponents []ComponentUsage `json:"staleComponents"`
+}
+
+// ComponentAnalytics summarizes how an organization's projects use shared
+// components.
+//
+//encore:api auth method=GET path=/orgs/:orgID/components/analytics
+func ComponentAnalytics(ctx context.Context, orgID string, req *ComponentAnalyticsRequest) (*ComponentAnalyticsResponse, error) {
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		return nil, err
+	}
+	days := req.Days
+	if days <= 0 || days > maxComponentDays {
+		days = defaultComponentDays
+	}
+	fail := func(what string, err error) error {
+		reqctx.Logger(ctx).Error("failed to load component analytics", "org_id", orgID, "query", what, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load component analytics",
+		}
+	}
+
+	resp := &ComponentAnalyticsResponse{Days: days}
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM projects WHERE org_id = $1 AND deleted_at IS NULL
+	`, orgID).Scan(&resp.Projects)
+	if err != nil {
+		return nil, fail("projects", err)
+	}
+	if resp.TopComponents, err = componentUsage(ctx, orgID, days, false, resp.Projects); err != nil {
+		return nil, fail("top components", err)
+	}
+	if resp.StaleComponents, err = componentUsage(ctx, orgID, days, true, resp.Projects); err != nil {
+		return nil, fail("stale components", err)
+	}
+	return resp, nil
+}
+
+// componentUsage returns the organization's most used components, or with
+// stale those not saved in any project during the period.
+func componentUsage(ctx context.Context, orgID string, days int, stale bool, orgProjects int) ([]ComponentUsage, error) {
+	order := `COUNT(DISTINCT u.project_id) FILTER (WHERE u.instances > 0) DESC, SUM(u.instances) DESC, u.component_id`
+	if stale {
+		order = `MAX(u.last_used_at), u.component_id`
+	}
+	rows, err := db.Query(ctx, `
+		SELECT u.component_id,
+			COUNT(DISTINCT u.project_id) FILTER (WHERE u.instances > 0),
+			COALESCE(SUM(u.instances), 0), MIN(u.first_used_at), MAX(u.last_used_at)
+		FROM project_component_usage u
+		JOIN projects p ON p.id = u.project_id
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL
+		GROUP BY u.component_id
+		HAVING $2 = (MAX(u.last_used_at) < NOW() - $3 * INTERVAL '1 day')
+			AND ($2 OR SUM(u.instances) > 0)
+		ORDER BY `+order+`
+		LIMIT $4
+	`, orgID, stale, days, componentAnalyticsN)
+	if err != nil {
+		return nil, err
+	}
+	usage := []ComponentUsage{}
+	for rows.Next() {
+		var u ComponentUsage
+		if err := rows.Scan(&u.ComponentID, &u.Projects, &u.Instances, &u.FirstUsedAt, &u.LastUsedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if orgProjects > 0 {
+			u.Adoption = float64(u.Projects) / float64(orgProjects)
+		}
+		usage = append(usage, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range usage {
+		if usage[i].Versions, err = versionUsage(ctx, orgID, usage[i].ComponentID); err != nil {
+			return nil, fmt.Errorf("versions of %s: %w", usage[i].ComponentID, err)
+		}
+	}
+	return usage, nil
+}
+
+// versionUsage breaks a component's current use down by version, newest
+// use first.
+func versionUsage(ctx context.Context, orgID, componentID string) ([]ComponentVersionUsage, error) {
+	rows, err := db.Query(ctx, `
+		SELECT u.version, COUNT(DISTINCT u.project_id), SUM(u.instances)
+		FROM project_component_usage u
+		JOIN projects p ON p.id = u.project_id
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL AND u.component_id = $2 AND u.instances > 0
+		GROUP BY u.version
+		ORDER BY MAX(u.last_used_at) DESC, u.version DESC
+	`, orgID, componentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []ComponentVersionUsage{}
+	for rows.Next() {
+		var v ComponentVersionUsage
+		if err := rows.Scan(&v.Version, &v.Projects, &v.Instances); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// ComponentProject is a project using a component
+type ComponentProject struct {
+	ProjectID string `json:"projectId"`
+	Title     string `json:"title"`
+	Version   string `json:"version"`
+	Instances int    `json:"instances"`
+	// LastUsedAt is when a save of the project last contained the version
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// ComponentProjectsResponse represents the component projects response
+type ComponentProjectsResponse struct {
+	Projects []ComponentProject `json:"projects"`
+}
+
+// ComponentProjects lists the organization's projects that use a
+// component, for instance to find those to update before retiring a
+// version.
+//
+//encore:api auth method=GET path=/orgs/:orgID/components/:componentID/projects
+func ComponentProjects(ctx context.Context, orgID, componentID string) (*ComponentProjectsResponse, error) {
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, `
+		SELECT p.id, p.title, u.version, u.instances, u.last_used_at
+		FROM project_component_usage u
+		JOIN projects p ON p.id = u.project_id
+		WHERE p.org_id = $1 AND p.deleted_at IS NULL AND u.component_id = $2 AND u.instances > 0
+		ORDER BY u.version, p.title
+		LIMIT 500
+	`, orgID, strings.ToLower(componentID))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list component projects", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list projects",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ComponentProjectsResponse{Projects: []ComponentProject{}}
+	for rows.Next() {
+		var p ComponentProject
+		if err := rows.Scan(&p.ProjectID, &p.Title, &p.Version, &p.Instances, &p.LastUsedAt); err != nil {
+			continue
+		}
+		resp.Projects = append(resp.Projects, p)
+	}
+	return resp, nil
+}
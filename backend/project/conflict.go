@@ -0,0 +1,99 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/realtime"
+	"canvasai/reqctx"
+)
+
+// resolveBaseRevision sets req.BaseRevision from the If-Match header, which
+// carries a revision as an entity tag ("12", W/"12" or 12), and requires
+// one of the two so no save can overwrite changes it has not seen.
+func resolveBaseRevision(req *UpdateProjectRequest) error {
+	if req.IfMatch != "" {
+		tag := strings.Trim(strings.TrimPrefix(strings.TrimSpace(req.IfMatch), "W/"), `"`)
+		rev, err := strconv.Atoi(tag)
+		if err != nil || rev < 0 {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "If-Match must be a project revision",
+			}
+		}
+		if req.BaseRevision != nil && *req.BaseRevision != rev {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "If-Match and baseRevision disagree",
+			}
+		}
+		req.BaseRevision = &rev
+	}
+	if req.BaseRevision == nil {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "baseRevision or an If-Match header is required",
+		}
+	}
+	return nil
+}
+
+// checkBaseRevision returns the save conflict if the project has moved past
+// baseRevision, without writing anything. A nil baseRevision always passes.
+func checkBaseRevision(ctx context.Context, projectID string, baseRevision *int, userID string) error {
+	if baseRevision == nil {
+		return nil
+	}
+	var revision int
+	err := db.QueryRow(ctx, `SELECT version FROM projects WHERE id = $1`, projectID).Scan(&revision)
+	if err != nil || revision != *baseRevision {
+		return saveConflict(ctx, projectID, RevisionInfo{Revision: *baseRevision, UserID: userID, SavedAt: time.Now()})
+	}
+	return nil
+}
+
+// saveConflict builds the error returned when an update was based on a stale
+// revision, and notifies both the rejected editor and the author of the
+// current revision so their editors can prompt instead of failing silently.
+func saveConflict(ctx context.Context, projectID string, attempted RevisionInfo) error {
+	var current RevisionInfo
+	var savedBy sql.NullString
+	err := db.QueryRow(ctx, `
+		SELECT version, last_saved_by, updated_at FROM projects WHERE id = $1
+	`, projectID).Scan(&current.Revision, &savedBy, &current.SavedAt)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	current.UserID = savedBy.String
+
+	conflict := &SaveConflict{
+		ProjectID: projectID,
+		Attempted: attempted,
+		Current:   current,
+	}
+
+	targets := []string{attempted.UserID}
+	if current.UserID != "" && current.UserID != attempted.UserID {
+		targets = append(targets, current.UserID)
+	}
+	if err := realtime.Publish(ctx, projectID, realtime.EventAutosaveConflict, conflict, targets...); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish save conflict", "project_id", projectID, "error", err)
+	}
+
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: "Project was modified by someone else",
+		Details: conflict,
+	}
+}
+
+// ErrDetails marks SaveConflict as structured error details.
+func (*SaveConflict) ErrDetails() {}
@@ -0,0 +1,291 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"github.com/google/uuid"
+
+	"canvasai/canvasrefs"
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// A project can be copied two ways. Duplicating makes a working copy of a
+// project the user can edit, in the same workspace and optionally shared
+// with the same people. Forking lets anyone remix a public project: the
+// fork is a private personal project that remembers where it came from.
+// Either way the canvas is deep-copied, and assets the new owner does not
+// own are copied into their library sharing the stored files (see
+// carryAssets), so later changes to either project never affect the
+// other.
+
+const maxProjectTitleLength = 255
+
+// DuplicateProjectRequest represents the duplicate project request
+type DuplicateProjectRequest struct {
+	// Title defaults to "Copy of" the source project's title
+	Title string `json:"title,omitempty"`
+	// IncludeCollaborators shares the copy with the source's collaborators
+	// in the same roles, its owner becoming an editor. It requires
+	// permission to share the source.
+	IncludeCollaborators bool `json:"includeCollaborators,omitempty"`
+}
+
+// ForkProjectRequest represents the fork project request
+type ForkProjectRequest struct {
+	// Title defaults to the public project's title
+	Title string `json:"title,omitempty"`
+}
+
+// CopyProjectResponse represents a duplicated or forked project
+type CopyProjectResponse struct {
+	Project *Project `json:"project"`
+	// Report counts how the canvas's asset references were carried over
+	Report *canvasrefs.Report `json:"report"`
+}
+
+// DuplicateProject copies a project the user can edit. The copy belongs to
+// the user and stays in the source's organization, if any.
+//
+//encore:api auth method=POST path=/projects/:id/duplicate
+func DuplicateProject(ctx context.Context, id string, req *DuplicateProjectRequest) (*CopyProjectResponse, error) {
+	userID := auth.UserID()
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	if req.IncludeCollaborators {
+		if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+			return nil, err
+		}
+	}
+
+	src, err := loadCopySource(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	project := src.newProject(userID, copyTitle(req.Title, "Copy of "+src.title))
+	project.OrgID = src.orgID
+	project.AutosaveInterval = src.autosaveInterval
+	project.ShareLinksEnabled = src.shareLinksEnabled
+
+	report, err := copyProject(ctx, id, src, project, req.IncludeCollaborators)
+	if err != nil {
+		return nil, err
+	}
+	reqctx.Logger(ctx).Info("project duplicated", "project_id", project.ID, "source_id", id, "collaborators", req.IncludeCollaborators)
+	return copyResponse(ctx, project, report)
+}
+
+// ForkProject copies a public project into the user's personal projects.
+//
+//encore:api auth method=POST path=/projects/:id/fork
+func ForkProject(ctx context.Context, id string, req *ForkProjectRequest) (*CopyProjectResponse, error) {
+	userID := auth.UserID()
+
+	src, err := loadCopySource(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !src.isPublic {
+		// Private projects are duplicated by their collaborators instead;
+		// don't reveal that they exist.
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	project := src.newProject(userID, copyTitle(req.Title, src.title))
+	project.ShareLinksEnabled = true
+	project.ForkedFrom = &id
+
+	report, err := copyProject(ctx, id, src, project, false)
+	if err != nil {
+		return nil, err
+	}
+	reqctx.Logger(ctx).Info("project forked", "project_id", project.ID, "source_id", id)
+	return copyResponse(ctx, project, report)
+}
+
+// copySource is the part of a project that is copied
+type copySource struct {
+	title             string
+	description       string
+	canvasData        []byte
+	width, height     int
+	orgID             *string
+	colorProfile      string
+	autosaveInterval  *int
+	shareLinksEnabled bool
+	tags              []string
+	isPublic          bool
+	// settings is the editor settings document; nil for templates
+	settings []byte
+}
+
+func loadCopySource(ctx context.Context, id string) (*copySource, error) {
+	var src copySource
+	err := db.QueryRow(ctx, `
+		SELECT title, description, canvas_data, canvas_width, canvas_height, org_id, color_profile,
+			autosave_interval, share_links_enabled, tags, is_public, settings
+		FROM projects WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&src.title, &src.description, &src.canvasData, &src.width, &src.height, &src.orgID, &src.colorProfile,
+		&src.autosaveInterval, &src.shareLinksEnabled, &src.tags, &src.isPublic, &src.settings)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to copy project",
+		}
+	}
+	return &src, nil
+}
+
+// newProject returns a private project for ownerID with the source's
+// content settings.
+func (src *copySource) newProject(ownerID, title string) *Project {
+	now := time.Now()
+	return &Project{
+		ID:           uuid.New().String(),
+		Title:        title,
+		OwnerID:      ownerID,
+		Description:  src.description,
+		Tags:         src.tags,
+		CanvasWidth:  src.width,
+		CanvasHeight: src.height,
+		Revision:     1,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ColorProfile: src.colorProfile,
+	}
+}
+
+// copyTitle returns the requested title, or fallback, cut to fit.
+func copyTitle(requested, fallback string) string {
+	title := strings.TrimSpace(requested)
+	if title == "" {
+		title = fallback
+	}
+	if r := []rune(title); len(r) > maxProjectTitleLength {
+		title = string(r[:maxProjectTitleLength])
+	}
+	return title
+}
+
+// copyProject creates project with a copy of the source's canvas. A
+// project left half copied by a failure is removed. sourceID is empty when
+// the source is a template rather than a project.
+func copyProject(ctx context.Context, sourceID string, src *copySource, project *Project, withCollaborators bool) (*canvasrefs.Report, error) {
+	if err := checkGuestProjectLimit(ctx, project.OwnerID); err != nil {
+		return nil, err
+	}
+	if err := checkProjectQuota(ctx, project.OwnerID); err != nil {
+		return nil, err
+	}
+	if len(src.canvasData) > 0 {
+		budget, err := checkDocumentBudget(ctx, project.OwnerID, len(src.canvasData))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPageQuota(budget.Plan, src.canvasData); err != nil {
+			return nil, err
+		}
+		project.SizeBudget = budget
+	}
+	if err := assignSlug(ctx, project, ""); err != nil {
+		return nil, err
+	}
+	if err := insertProject(ctx, project, nil); err != nil {
+		return nil, err
+	}
+
+	target := carryTarget{userID: project.OwnerID, projectID: &project.ID}
+	// A template deletes its assets with itself, including for its creator.
+	target.copyAll = sourceID == ""
+	canvasData, report, _, err := carryAssets(ctx, src.canvasData, target)
+	if err == nil && sourceID != "" {
+		err = copyAssetLinks(ctx, sourceID, project)
+	}
+	var assetRefs []byte
+	if err == nil && len(canvasData) > 0 {
+		// Assets the copy still shares with the source stay frozen where the
+		// source froze them.
+		var doc any
+		if err = json.Unmarshal(canvasData, &doc); err == nil {
+			if doc, err = applyAssetLinks(ctx, project.ID, doc); err == nil {
+				canvasData, err = json.Marshal(doc)
+			}
+		}
+		if err == nil {
+			_, assetRefs, err = buildAssetIndex(canvasData)
+		}
+	}
+	if err == nil && withCollaborators {
+		err = copyCollaborators(ctx, sourceID, project)
+	}
+	if err == nil {
+		_, err = db.Exec(ctx, `
+			UPDATE projects SET canvas_data = $2, asset_refs = $3, tags = $4, forked_from = $5, settings = COALESCE($6, settings)
+			WHERE id = $1
+		`, project.ID, canvasData, assetRefs, project.Tags, project.ForkedFrom, src.settings)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to copy project", "project_id", project.ID, "source_id", sourceID, "error", err)
+		discardProject(ctx, project.ID)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to copy project",
+		}
+	}
+	if len(canvasData) > 0 {
+		announceCanvasSave(ctx, project.ID, project.Revision)
+	}
+	return report, nil
+}
+
+// copyAssetLinks copies the source's frozen assets that the copy still
+// references directly, which are those its owner owns.
+func copyAssetLinks(ctx context.Context, sourceID string, project *Project) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO project_asset_links (project_id, asset_id, frozen_version, frozen_by, frozen_at)
+		SELECT $2, l.asset_id, l.frozen_version, l.frozen_by, l.frozen_at
+		FROM project_asset_links l
+		JOIN assets a ON a.id = l.asset_id
+		WHERE l.project_id = $1 AND a.user_id = $3
+	`, sourceID, project.ID, project.OwnerID)
+	return err
+}
+
+// copyCollaborators adds the source's active collaborators to the copy,
+// other than its new owner. Pending invitations are not copied.
+func copyCollaborators(ctx context.Context, sourceID string, project *Project) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO project_collaborators (project_id, user_id, role, invited_by, accepted_at)
+		SELECT $2, c.user_id, CASE c.role WHEN 'owner' THEN 'editor' ELSE c.role END, $3, c.accepted_at
+		FROM project_collaborators c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.project_id = $1 AND c.user_id <> $3 AND u.deactivated_at IS NULL
+		ON CONFLICT (project_id, user_id) DO NOTHING
+	`, sourceID, project.ID, project.OwnerID)
+	return err
+}
+
+// copyResponse returns the copied project as saved.
+func copyResponse(ctx context.Context, project *Project, report *canvasrefs.Report) (*CopyProjectResponse, error) {
+	saved, err := GetProject(ctx, project.ID)
+	if err != nil {
+		return nil, err
+	}
+	saved.SizeBudget = project.SizeBudget
+	return &CopyProjectResponse{Project: saved, Report: report}, nil
+}
@@ -0,0 +1,302 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/realtime"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Editor settings travel with the project rather than the user, so every
+// collaborator works on the same grid, in the same units and with the same
+// bleed. They are a typed document in projects.settings; an empty document
+// means ProjectSettingsDefaults. Users' own editor defaults (settings
+// service) only seed what the project leaves open, such as rulers.
+
+// Measurement units
+const (
+	UnitPixels      = "px"
+	UnitPoints      = "pt"
+	UnitMillimeters = "mm"
+	UnitCentimeters = "cm"
+	UnitInches      = "in"
+)
+
+// pixelsPerUnit converts lengths to canvas pixels (96 per inch, as in CSS)
+var pixelsPerUnit = map[string]float64{
+	UnitPixels:      1,
+	UnitPoints:      96.0 / 72,
+	UnitMillimeters: 96 / 25.4,
+	UnitCentimeters: 96 / 2.54,
+	UnitInches:      96,
+}
+
+// Editor settings bounds. Lengths are checked in pixels whatever the unit.
+const (
+	minGridSpacingPx  = 1
+	maxGridSpacingPx  = 1000
+	maxGridSubdivs    = 16
+	maxBleedPx        = 500
+	maxSnapThreshold  = 50
+	maxBackgroundSpec = 50
+)
+
+// ProjectSettings are a project's editor settings. Lengths are in Units.
+type ProjectSettings struct {
+	Units string       `json:"units"`
+	Grid  GridSettings `json:"grid"`
+	// Background is the color around and behind the pages in the editor:
+	// a CSS color or "transparent"
+	Background string       `json:"background"`
+	Snapping   SnapSettings `json:"snapping"`
+	Bleed      Margins      `json:"bleed"`
+}
+
+// GridSettings configure the editor grid
+type GridSettings struct {
+	Visible bool    `json:"visible"`
+	Spacing float64 `json:"spacing"`
+	// Subdivisions draws lighter lines between grid lines; 1 draws none
+	Subdivisions int `json:"subdivisions"`
+}
+
+// SnapSettings configure what moved elements snap to
+type SnapSettings struct {
+	ToGrid    bool `json:"toGrid"`
+	ToObjects bool `json:"toObjects"`
+	ToGuides  bool `json:"toGuides"`
+	ToBleed   bool `json:"toBleed"`
+	// Threshold is the snapping distance in screen pixels
+	Threshold int `json:"threshold"`
+}
+
+// Margins are lengths on each side of a page
+type Margins struct {
+	Top    float64 `json:"top"`
+	Right  float64 `json:"right"`
+	Bottom float64 `json:"bottom"`
+	Left   float64 `json:"left"`
+}
+
+// ProjectSettingsDefaults are the settings of a project that has not
+// changed anything
+var ProjectSettingsDefaults = ProjectSettings{
+	Units:      UnitPixels,
+	Grid:       GridSettings{Visible: false, Spacing: 8, Subdivisions: 1},
+	Background: "#f4f4f5",
+	Snapping:   SnapSettings{ToGrid: true, ToObjects: true, ToGuides: true, Threshold: 6},
+}
+
+// UpdateProjectSettingsRequest changes the fields that are set and keeps
+// the rest. Changing Units alone converts the grid spacing and bleed, so
+// they keep their size.
+type UpdateProjectSettingsRequest struct {
+	Units      *string            `json:"units,omitempty"`
+	Grid       *GridSettingsPatch `json:"grid,omitempty"`
+	Background *string            `json:"background,omitempty"`
+	Snapping   *SnapSettingsPatch `json:"snapping,omitempty"`
+	// Bleed replaces the bleed as a whole
+	Bleed *Margins `json:"bleed,omitempty"`
+}
+
+// GridSettingsPatch changes the grid settings that are set
+type GridSettingsPatch struct {
+	Visible      *bool    `json:"visible,omitempty"`
+	Spacing      *float64 `json:"spacing,omitempty"`
+	Subdivisions *int     `json:"subdivisions,omitempty"`
+}
+
+// SnapSettingsPatch changes the snapping settings that are set
+type SnapSettingsPatch struct {
+	ToGrid    *bool `json:"toGrid,omitempty"`
+	ToObjects *bool `json:"toObjects,omitempty"`
+	ToGuides  *bool `json:"toGuides,omitempty"`
+	ToBleed   *bool `json:"toBleed,omitempty"`
+	Threshold *int  `json:"threshold,omitempty"`
+}
+
+// GetProjectSettings returns a project's editor settings.
+//
+//encore:api auth method=GET path=/projects/:id/settings
+func GetProjectSettings(ctx context.Context, id string) (*ProjectSettings, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+	var raw []byte
+	err := db.QueryRow(ctx, `SELECT settings FROM projects WHERE id = $1 AND deleted_at IS NULL`, id).Scan(&raw)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	return loadProjectSettings(ctx, id, raw), nil
+}
+
+// UpdateProjectSettings changes a project's editor settings. Editors
+// connected to the project receive the new settings.
+//
+//encore:api auth method=PATCH path=/projects/:id/settings
+func UpdateProjectSettings(ctx context.Context, id string, req *UpdateProjectSettingsRequest) (*ProjectSettings, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update project settings",
+		}
+	}
+	defer tx.Rollback()
+
+	var raw []byte
+	err = tx.QueryRow(ctx, `SELECT settings FROM projects WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id).Scan(&raw)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	s := loadProjectSettings(ctx, id, raw)
+	applyProjectSettings(s, req)
+	if err := validateProjectSettings(s); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: err.Error(),
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE projects SET settings = $2, updated_at = NOW() WHERE id = $1`, id, data)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update project settings", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update project settings",
+		}
+	}
+
+	payload := map[string]any{"settings": s, "updatedBy": auth.UserID()}
+	if err := realtime.Publish(ctx, id, realtime.EventProjectSettings, payload); err != nil {
+		reqctx.Logger(ctx).Warn("failed to announce project settings", "project_id", id, "error", err)
+	}
+	return s, nil
+}
+
+// loadProjectSettings reads a stored settings document over the defaults.
+// A document that no longer validates falls back to the defaults.
+func loadProjectSettings(ctx context.Context, projectID string, raw []byte) *ProjectSettings {
+	s := ProjectSettingsDefaults
+	if len(raw) == 0 {
+		return &s
+	}
+	if err := json.Unmarshal(raw, &s); err == nil {
+		err = validateProjectSettings(&s)
+		if err == nil {
+			return &s
+		}
+		reqctx.Logger(ctx).Warn("stored project settings are invalid, using defaults", "project_id", projectID, "error", err)
+	}
+	s = ProjectSettingsDefaults
+	return &s
+}
+
+func applyProjectSettings(s *ProjectSettings, req *UpdateProjectSettingsRequest) {
+	if req.Units != nil && *req.Units != s.Units {
+		if to, ok := pixelsPerUnit[*req.Units]; ok {
+			ratio := pixelsPerUnit[s.Units] / to
+			s.Grid.Spacing = convertLength(s.Grid.Spacing, ratio)
+			b := &s.Bleed
+			b.Top, b.Right = convertLength(b.Top, ratio), convertLength(b.Right, ratio)
+			b.Bottom, b.Left = convertLength(b.Bottom, ratio), convertLength(b.Left, ratio)
+		}
+		s.Units = *req.Units
+	}
+	if g := req.Grid; g != nil {
+		if g.Visible != nil {
+			s.Grid.Visible = *g.Visible
+		}
+		if g.Spacing != nil {
+			s.Grid.Spacing = *g.Spacing
+		}
+		if g.Subdivisions != nil {
+			s.Grid.Subdivisions = *g.Subdivisions
+		}
+	}
+	if req.Background != nil {
+		s.Background = strings.TrimSpace(*req.Background)
+	}
+	if p := req.Snapping; p != nil {
+		if p.ToGrid != nil {
+			s.Snapping.ToGrid = *p.ToGrid
+		}
+		if p.ToObjects != nil {
+			s.Snapping.ToObjects = *p.ToObjects
+		}
+		if p.ToGuides != nil {
+			s.Snapping.ToGuides = *p.ToGuides
+		}
+		if p.ToBleed != nil {
+			s.Snapping.ToBleed = *p.ToBleed
+		}
+		if p.Threshold != nil {
+			s.Snapping.Threshold = *p.Threshold
+		}
+	}
+	if req.Bleed != nil {
+		s.Bleed = *req.Bleed
+	}
+}
+
+// convertLength scales a length to another unit, keeping four decimals.
+func convertLength(v, ratio float64) float64 {
+	return math.Round(v*ratio*1e4) / 1e4
+}
+
+func validateProjectSettings(s *ProjectSettings) error {
+	px, ok := pixelsPerUnit[s.Units]
+	if !ok {
+		return fmt.Errorf("units must be px, pt, mm, cm or in")
+	}
+	if sp := s.Grid.Spacing * px; sp < minGridSpacingPx || sp > maxGridSpacingPx {
+		return fmt.Errorf("grid.spacing must be between %g and %g %s", convertLength(minGridSpacingPx, 1/px), convertLength(maxGridSpacingPx, 1/px), s.Units)
+	}
+	if n := s.Grid.Subdivisions; n < 1 || n > maxGridSubdivs {
+		return fmt.Errorf("grid.subdivisions must be between 1 and %d", maxGridSubdivs)
+	}
+	if b := s.Background; b != "transparent" {
+		if _, ok := render.ParseColor(b); !ok || len(b) > maxBackgroundSpec {
+			return fmt.Errorf("background must be a CSS color or transparent")
+		}
+	}
+	if t := s.Snapping.Threshold; t < 0 || t > maxSnapThreshold {
+		return fmt.Errorf("snapping.threshold must be between 0 and %d pixels", maxSnapThreshold)
+	}
+	sides := []struct {
+		name  string
+		value float64
+	}{{"top", s.Bleed.Top}, {"right", s.Bleed.Right}, {"bottom", s.Bleed.Bottom}, {"left", s.Bleed.Left}}
+	for _, side := range sides {
+		if v := side.value * px; v < 0 || v > maxBleedPx {
+			return fmt.Errorf("bleed.%s must be between 0 and %g %s", side.name, convertLength(maxBleedPx, 1/px), s.Units)
+		}
+	}
+	return nil
+}
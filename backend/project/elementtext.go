@@ -0,0 +1,155 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/realtime"
+	"canvasai/reqctx"
+)
+
+// Other services can fill text elements from outside data, such as the
+// linked spreadsheet cells of the sheets service. The text is written into
+// the canvas as a new revision, and connected editors are sent the new
+// text so they can apply it without reloading.
+
+// maxTextWriteAttempts bounds retries when editors save in between
+const maxTextWriteAttempts = 3
+
+// textTypes are the element types whose content is their text property
+var textTypes = map[string]bool{
+	"text":    true,
+	"i-text":  true,
+	"textbox": true,
+}
+
+// SetElementTextRequest represents the set element text request
+type SetElementTextRequest struct {
+	// Text maps element IDs to their new text
+	Text map[string]string `json:"text"`
+	// Source names what changed the text, for editors
+	Source string `json:"source"`
+}
+
+// SetElementTextResponse reports what a text update changed
+type SetElementTextResponse struct {
+	Revision int `json:"revision"`
+	// Changed are the elements whose text was replaced
+	Changed []string `json:"changed"`
+	// Missing are the requested elements the canvas no longer has, or that
+	// are not text
+	Missing []string `json:"missing"`
+}
+
+// SetElementText replaces the text of text elements, including those in
+// groups. Elements that already show the text are left alone, and the
+// project is only saved when something changed.
+//
+//encore:api private method=POST path=/projects/internal/:id/element-text
+func SetElementText(ctx context.Context, id string, req *SetElementTextRequest) (*SetElementTextResponse, error) {
+	for attempt := 1; ; attempt++ {
+		var canvasData []byte
+		var revision int
+		err := db.QueryRow(ctx, `
+			SELECT canvas_data, version FROM projects WHERE id = $1 AND deleted_at IS NULL
+		`, id).Scan(&canvasData, &revision)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Project not found",
+			}
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(canvasData, &doc); err != nil || doc == nil {
+			return nil, &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "Project canvas data is invalid",
+			}
+		}
+
+		resp := &SetElementTextResponse{Revision: revision, Changed: []string{}, Missing: []string{}}
+		found := map[string]bool{}
+		setText(doc, req.Text, found, &resp.Changed)
+		for elementID := range req.Text {
+			if !found[elementID] {
+				resp.Missing = append(resp.Missing, elementID)
+			}
+		}
+		sort.Strings(resp.Missing)
+		if len(resp.Changed) == 0 {
+			return resp, nil
+		}
+
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to update element text",
+			}
+		}
+		result, err := db.Exec(ctx, `
+			UPDATE projects SET canvas_data = $2, version = version + 1, updated_at = NOW()
+			WHERE id = $1 AND version = $3
+		`, id, raw, revision)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to update element text", "project_id", id, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to update element text",
+			}
+		}
+		if result.RowsAffected() == 0 {
+			if attempt < maxTextWriteAttempts {
+				continue
+			}
+			return nil, &errs.Error{
+				Code:    errs.Aborted,
+				Message: "The project was saved by someone else, try again",
+			}
+		}
+
+		resp.Revision = revision + 1
+		text := make(map[string]string, len(resp.Changed))
+		for _, elementID := range resp.Changed {
+			text[elementID] = req.Text[elementID]
+		}
+		event := map[string]any{"revision": resp.Revision, "source": req.Source, "text": text}
+		if err := realtime.Publish(ctx, id, realtime.EventElementsUpdated, event); err != nil {
+			reqctx.Logger(ctx).Error("failed to publish element text update", "project_id", id, "error", err)
+		}
+		announceCanvasSave(ctx, id, resp.Revision)
+		reqctx.Logger(ctx).Info("element text updated", "project_id", id, "source", req.Source, "elements", len(resp.Changed))
+		return resp, nil
+	}
+}
+
+// setText walks a canvas document's pages, objects and groups, setting the
+// text of the text elements in values. It records every text element it
+// finds in found and the ones it changed in changed.
+func setText(node any, values map[string]string, found map[string]bool, changed *[]string) {
+	switch n := node.(type) {
+	case map[string]any:
+		if elementID, _ := n["id"].(string); elementID != "" {
+			kind, _ := n["type"].(string)
+			if text, ok := values[elementID]; ok && textTypes[kind] {
+				found[elementID] = true
+				if current, _ := n["text"].(string); current != text {
+					n["text"] = text
+					*changed = append(*changed, elementID)
+				}
+			}
+		}
+		for _, key := range []string{"pages", "objects"} {
+			if children, ok := n[key].([]any); ok {
+				setText(children, values, found, changed)
+			}
+		}
+	case []any:
+		for _, child := range n {
+			setText(child, values, found, changed)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package project
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+
+	"canvasai/asset"
+	"canvasai/canvasrefs"
+	"canvasai/reqctx"
+)
+
+// Editors paste images straight into the canvas as base64 data URIs, which
+// bloats every save and revision of the document. Saves move them into the
+// asset service and point the canvas at the stored asset instead.
+
+// minEmbeddedImageSize leaves tiny inline images (icons, patterns) alone;
+// the asset URL would not be much shorter.
+const minEmbeddedImageSize = 1 << 10
+
+// embeddedImageTypes maps the image types extracted from data URIs to the
+// file extension they are stored under.
+var embeddedImageTypes = map[string]string{
+	"image/png":     "png",
+	"image/jpeg":    "jpg",
+	"image/gif":     "gif",
+	"image/webp":    "webp",
+	"image/svg+xml": "svg",
+}
+
+// ExtractionReport summarises the embedded images moved out of a canvas
+type ExtractionReport struct {
+	Extracted int `json:"extracted"`
+	// BytesSaved is how much smaller the document became
+	BytesSaved int `json:"bytesSaved"`
+	// Failed counts images that could not be stored and were left inline
+	Failed int `json:"failed,omitempty"`
+	// stored are the assets created for the images, which
+	// discardExtractedImages removes if the save does not go through
+	stored []string
+}
+
+// extractEmbeddedImages replaces base64 image data URIs anywhere in doc with
+// asset URLs, storing each image as an asset of projectID uploaded by
+// userID. doc is modified in place. Images that cannot be stored stay
+// inline so the save still goes through. It returns nil if doc held no
+// embedded images.
+func extractEmbeddedImages(ctx context.Context, projectID, userID string, doc any) *ExtractionReport {
+	report := &ExtractionReport{}
+	urls := map[string]string{}
+
+	replace := func(value string) (string, bool) {
+		if url, ok := urls[value]; ok {
+			report.BytesSaved += len(value) - len(url)
+			return url, true
+		}
+		mimeType, data, ok := parseImageDataURI(value)
+		if !ok || len(data) < minEmbeddedImageSize || len(data) > asset.MaxAssetSize {
+			return "", false
+		}
+
+		sum := sha256.Sum256(data)
+		req := &asset.StoreRequest{
+			UserID:    userID,
+			ProjectID: projectID,
+			Filename:  "embedded-" + hex.EncodeToString(sum[:4]) + "." + embeddedImageTypes[mimeType],
+			MimeType:  mimeType,
+			Data:      data,
+			Dedupe:    true,
+		}
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			req.Width, req.Height = &cfg.Width, &cfg.Height
+		}
+		stored, err := asset.Store(ctx, req)
+		if err != nil {
+			reqctx.Logger(ctx).Warn("failed to extract embedded image", "project_id", projectID, "error", err)
+			report.Failed++
+			return "", false
+		}
+
+		if !stored.Deduped {
+			report.stored = append(report.stored, stored.ID)
+		}
+		url := canvasrefs.AssetURL(stored.ID)
+		urls[value] = url
+		report.Extracted++
+		report.BytesSaved += len(value) - len(url)
+		return url, true
+	}
+
+	var walk func(node any)
+	walk = func(node any) {
+		switch v := node.(type) {
+		case map[string]any:
+			for k, child := range v {
+				if s, ok := child.(string); ok {
+					if url, ok := replace(s); ok {
+						v[k] = url
+					}
+					continue
+				}
+				walk(child)
+			}
+		case []any:
+			for i, child := range v {
+				if s, ok := child.(string); ok {
+					if url, ok := replace(s); ok {
+						v[i] = url
+					}
+					continue
+				}
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+
+	if report.Extracted == 0 && report.Failed == 0 {
+		return nil
+	}
+	reqctx.Logger(ctx).Info("extracted embedded images", "project_id", projectID,
+		"extracted", report.Extracted, "failed", report.Failed, "bytes_saved", report.BytesSaved)
+	return report
+}
+
+// discardExtractedImages deletes the assets a save that did not go through
+// stored for its embedded images. Assets the images were deduplicated
+// against belong to earlier saves and are kept.
+func discardExtractedImages(ctx context.Context, projectID string, report *ExtractionReport) {
+	if report == nil {
+		return
+	}
+	for _, id := range report.stored {
+		if err := asset.Delete(ctx, id); err != nil {
+			reqctx.Logger(ctx).Warn("failed to discard extracted image", "project_id", projectID, "asset_id", id, "error", err)
+		}
+	}
+}
+
+// parseImageDataURI decodes a base64 "data:image/...;base64," URI.
+func parseImageDataURI(value string) (string, []byte, bool) {
+	if !strings.HasPrefix(value, "data:image/") {
+		return "", nil, false
+	}
+	header, payload, ok := strings.Cut(value[len("data:"):], ",")
+	if !ok {
+		return "", nil, false
+	}
+	params := strings.Split(header, ";")
+	mimeType := strings.ToLower(params[0])
+	if _, ok := embeddedImageTypes[mimeType]; !ok || params[len(params)-1] != "base64" {
+		return "", nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, false
+	}
+	return mimeType, data, true
+}
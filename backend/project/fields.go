@@ -0,0 +1,534 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Organizations track their own project metadata, such as the client, the
+// campaign or a status, as custom fields. Admins define the fields; every
+// project of the organization can then hold a value for each, checked
+// against the field's type. Values are returned with the project, filter
+// ListProjects and SearchProjects (field=key:value) and are columns of
+// the project inventory report (see inventory.go).
+
+// Custom field types
+const (
+	FieldText    = "text"
+	FieldNumber  = "number"
+	FieldDate    = "date" // YYYY-MM-DD
+	FieldSelect  = "select"
+	FieldBoolean = "boolean"
+)
+
+const (
+	maxOrgFields       = 50
+	maxFieldLabel      = 100
+	maxFieldOptions    = 100
+	maxFieldOption     = 100
+	maxFieldTextLength = 1000
+	maxFieldFilters    = 10
+)
+
+var fieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// ProjectField is a custom field an organization defined for its projects
+type ProjectField struct {
+	ID    string `json:"id"`
+	OrgID string `json:"orgId"`
+	// Key names the field in project values and filters
+	Key   string `json:"key"`
+	Label string `json:"label"`
+	Type  string `json:"type"` // text, number, date, select or boolean
+	// Options are the choices of a select field
+	Options   []string  `json:"options,omitempty"`
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ListProjectFieldsResponse represents an organization's custom fields, in
+// display order
+type ListProjectFieldsResponse struct {
+	Fields []ProjectField `json:"fields"`
+}
+
+// CreateProjectFieldRequest represents the create project field request
+type CreateProjectFieldRequest struct {
+	Key     string   `json:"key"`
+	Label   string   `json:"label"`
+	Type    string   `json:"type"`
+	Options []string `json:"options,omitempty"`
+	// Position defaults to after the existing fields
+	Position *int `json:"position,omitempty"`
+}
+
+// UpdateProjectFieldRequest changes the fields that are set. A field's
+// key and type cannot change. Values outside new select options are kept
+// until the project's value is next changed.
+type UpdateProjectFieldRequest struct {
+	Label    *string   `json:"label,omitempty"`
+	Options  *[]string `json:"options,omitempty"`
+	Position *int      `json:"position,omitempty"`
+}
+
+// SetProjectFieldsRequest sets a project's custom field values by key.
+// Null clears a value; fields that are not given are kept.
+type SetProjectFieldsRequest struct {
+	Fields map[string]any `json:"fields"`
+}
+
+// ProjectFieldsResponse represents a project's custom field values
+type ProjectFieldsResponse struct {
+	Fields map[string]any `json:"fields"`
+}
+
+//encore:api auth method=GET path=/orgs/:orgID/project-fields
+func ListProjectFields(ctx context.Context, orgID string) (*ListProjectFieldsResponse, error) {
+	if err := requireOrgMember(ctx, orgID, "admin", "member", "guest"); err != nil {
+		return nil, err
+	}
+	fields, err := orgFields(ctx, orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list project fields", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch project fields",
+		}
+	}
+	return &ListProjectFieldsResponse{Fields: fields}, nil
+}
+
+//encore:api auth method=POST path=/orgs/:orgID/project-fields
+func CreateProjectField(ctx context.Context, orgID string, req *CreateProjectFieldRequest) (*ProjectField, error) {
+	if err := requireOrgMember(ctx, orgID, "admin"); err != nil {
+		return nil, err
+	}
+	if !fieldKeyPattern.MatchString(req.Key) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "key must start with a letter and have at most 40 lowercase letters, digits and underscores",
+		}
+	}
+	switch req.Type {
+	case FieldText, FieldNumber, FieldDate, FieldSelect, FieldBoolean:
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "type must be text, number, date, select or boolean",
+		}
+	}
+	label, options, err := validateFieldDefinition(req.Type, req.Label, req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM org_project_fields WHERE org_id = $1`, orgID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count project fields", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create project field",
+		}
+	}
+	if count >= maxOrgFields {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: fmt.Sprintf("An organization can have at most %d project fields", maxOrgFields),
+		}
+	}
+	position := count
+	if req.Position != nil {
+		position = *req.Position
+	}
+
+	var id string
+	err = db.QueryRow(ctx, `
+		INSERT INTO org_project_fields (org_id, key, label, type, options, position)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (org_id, key) DO NOTHING
+		RETURNING id
+	`, orgID, req.Key, label, req.Type, options, position).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "A project field with this key already exists",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create project field", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create project field",
+		}
+	}
+	return getOrgField(ctx, orgID, id)
+}
+
+//encore:api auth method=PATCH path=/orgs/:orgID/project-fields/:fieldID
+func UpdateProjectField(ctx context.Context, orgID string, fieldID string, req *UpdateProjectFieldRequest) (*ProjectField, error) {
+	if err := requireOrgMember(ctx, orgID, "admin"); err != nil {
+		return nil, err
+	}
+	field, err := getOrgField(ctx, orgID, fieldID)
+	if err != nil {
+		return nil, err
+	}
+	label, options := field.Label, field.Options
+	if req.Label != nil {
+		label = *req.Label
+	}
+	if req.Options != nil {
+		options = *req.Options
+	}
+	if label, options, err = validateFieldDefinition(field.Type, label, options); err != nil {
+		return nil, err
+	}
+	position := field.Position
+	if req.Position != nil {
+		position = *req.Position
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE org_project_fields SET label = $3, options = $4, position = $5, updated_at = NOW()
+		WHERE id = $1 AND org_id = $2
+	`, fieldID, orgID, label, options, position)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update project field", "field_id", fieldID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update project field",
+		}
+	}
+	return getOrgField(ctx, orgID, fieldID)
+}
+
+// DeleteProjectField removes a field and its values from every project of
+// the organization.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/project-fields/:fieldID
+func DeleteProjectField(ctx context.Context, orgID string, fieldID string) error {
+	if err := requireOrgMember(ctx, orgID, "admin"); err != nil {
+		return err
+	}
+	field, err := getOrgField(ctx, orgID, fieldID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete project field",
+		}
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `DELETE FROM org_project_fields WHERE id = $1`, fieldID)
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+			UPDATE projects SET custom_fields = custom_fields - $2
+			WHERE org_id = $1 AND custom_fields ? $2
+		`, orgID, field.Key)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete project field", "field_id", fieldID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete project field",
+		}
+	}
+	return nil
+}
+
+// SetProjectFields sets custom field values on a project of an
+// organization.
+//
+//encore:api auth method=PATCH path=/projects/:id/fields
+func SetProjectFields(ctx context.Context, id string, req *SetProjectFieldsRequest) (*ProjectFieldsResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update project fields",
+		}
+	}
+	defer tx.Rollback()
+
+	var orgID sql.NullString
+	values := map[string]any{}
+	err = tx.QueryRow(ctx, `SELECT org_id, custom_fields FROM projects WHERE id = $1 FOR UPDATE`, id).Scan(&orgID, &values)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if !orgID.Valid {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Only organization projects have custom fields",
+		}
+	}
+	fields, err := orgFields(ctx, orgID.String)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project fields", "org_id", orgID.String, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update project fields",
+		}
+	}
+	byKey := map[string]ProjectField{}
+	for _, f := range fields {
+		byKey[f.Key] = f
+	}
+
+	for key, raw := range req.Fields {
+		f, ok := byKey[key]
+		if !ok {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("%s: no such project field", key),
+			}
+		}
+		if raw == nil {
+			delete(values, key)
+			continue
+		}
+		value, err := fieldValue(f, raw)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("%s: %v", key, err),
+			}
+		}
+		values[key] = value
+	}
+
+	data, err := json.Marshal(values)
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE projects SET custom_fields = $2, updated_at = NOW() WHERE id = $1`, id, data)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update project fields", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update project fields",
+		}
+	}
+	return &ProjectFieldsResponse{Fields: values}, nil
+}
+
+// validateFieldDefinition checks a field's label and options, returning
+// them trimmed.
+func validateFieldDefinition(kind, label string, options []string) (string, []string, error) {
+	label = strings.TrimSpace(label)
+	if label == "" || len(label) > maxFieldLabel {
+		return "", nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("label must be between 1 and %d characters", maxFieldLabel),
+		}
+	}
+	if kind != FieldSelect {
+		if len(options) > 0 {
+			return "", nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Only select fields have options",
+			}
+		}
+		return label, []string{}, nil
+	}
+
+	trimmed := []string{}
+	for _, o := range options {
+		o = strings.TrimSpace(o)
+		if o == "" || len(o) > maxFieldOption {
+			return "", nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("Options must be between 1 and %d characters", maxFieldOption),
+			}
+		}
+		if !slices.Contains(trimmed, o) {
+			trimmed = append(trimmed, o)
+		}
+	}
+	if len(trimmed) == 0 || len(trimmed) > maxFieldOptions {
+		return "", nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("A select field needs between 1 and %d options", maxFieldOptions),
+		}
+	}
+	return label, trimmed, nil
+}
+
+// fieldValue checks a JSON value against the field's type, returning it
+// as stored.
+func fieldValue(f ProjectField, raw any) (any, error) {
+	switch f.Type {
+	case FieldText:
+		s, ok := raw.(string)
+		if !ok || len(s) > maxFieldTextLength {
+			return nil, fmt.Errorf("must be text of at most %d characters", maxFieldTextLength)
+		}
+		return s, nil
+	case FieldNumber:
+		n, ok := raw.(float64)
+		if !ok || math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return n, nil
+	case FieldDate:
+		s, _ := raw.(string)
+		if _, err := time.Parse(time.DateOnly, s); err != nil {
+			return nil, fmt.Errorf("must be a date such as 2024-05-31")
+		}
+		return s, nil
+	case FieldSelect:
+		s, _ := raw.(string)
+		if !slices.Contains(f.Options, s) {
+			return nil, fmt.Errorf("must be one of the field's options")
+		}
+		return s, nil
+	case FieldBoolean:
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("has an unknown type")
+}
+
+// fieldFilter turns field=key:value filters into a JSON document that the
+// matching projects' custom_fields contain, or nil without filters.
+func fieldFilter(ctx context.Context, orgID string, filters []string) ([]byte, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	if orgID == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "orgId is required to filter by field",
+		}
+	}
+	if len(filters) > maxFieldFilters {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("At most %d field filters are allowed", maxFieldFilters),
+		}
+	}
+	fields, err := orgFields(ctx, orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project fields", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch projects",
+		}
+	}
+
+	contains := map[string]any{}
+	for _, filter := range filters {
+		key, text, _ := strings.Cut(filter, ":")
+		i := slices.IndexFunc(fields, func(f ProjectField) bool { return f.Key == key })
+		if i < 0 {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("field: %q is not a project field", key),
+			}
+		}
+		f := fields[i]
+		var raw any = text
+		switch f.Type {
+		case FieldNumber:
+			n, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, &errs.Error{
+					Code:    errs.InvalidArgument,
+					Message: fmt.Sprintf("field: %s must be a number", key),
+				}
+			}
+			raw = n
+		case FieldBoolean:
+			b, err := strconv.ParseBool(text)
+			if err != nil {
+				return nil, &errs.Error{
+					Code:    errs.InvalidArgument,
+					Message: fmt.Sprintf("field: %s must be true or false", key),
+				}
+			}
+			raw = b
+		}
+		value, err := fieldValue(f, raw)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("field: %s %v", key, err),
+			}
+		}
+		contains[key] = value
+	}
+	return json.Marshal(contains)
+}
+
+// orgFields returns an organization's fields in display order.
+func orgFields(ctx context.Context, orgID string) ([]ProjectField, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, org_id, key, label, type, options, position, created_at, updated_at
+		FROM org_project_fields WHERE org_id = $1
+		ORDER BY position, created_at, id
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := []ProjectField{}
+	for rows.Next() {
+		var f ProjectField
+		if err := rows.Scan(&f.ID, &f.OrgID, &f.Key, &f.Label, &f.Type, &f.Options, &f.Position, &f.CreatedAt, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+func getOrgField(ctx context.Context, orgID, fieldID string) (*ProjectField, error) {
+	var f ProjectField
+	err := db.QueryRow(ctx, `
+		SELECT id, org_id, key, label, type, options, position, created_at, updated_at
+		FROM org_project_fields WHERE id = $1 AND org_id = $2
+	`, fieldID, orgID).Scan(&f.ID, &f.OrgID, &f.Key, &f.Label, &f.Type, &f.Options, &f.Position, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project field not found",
+		}
+	}
+	return &f, nil
+}
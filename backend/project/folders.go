@@ -0,0 +1,385 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// Folders organize the projects a user owns on their dashboard. They are
+// personal: each owner files their own projects, and collaborators see
+// shared projects at their top level. Folders nest up to maxFolderDepth
+// levels. Deleting a folder deletes its subfolders and moves the projects
+// in them back to the top level.
+
+const (
+	maxFolderDepth      = 8
+	maxFolderNameLength = 255
+	maxFoldersPerUser   = 500
+	maxBulkMove         = 100
+)
+
+// FolderRoot is the folderId that lists projects outside any folder
+const FolderRoot = "root"
+
+// Folder is a folder of projects
+type Folder struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	ParentID *string `json:"parentId,omitempty"`
+	// Projects counts the projects directly in the folder
+	Projects  int       `json:"projects"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ListFoldersResponse represents the list folders response
+type ListFoldersResponse struct {
+	Folders []Folder `json:"folders"`
+}
+
+// CreateFolderRequest represents the create folder request
+type CreateFolderRequest struct {
+	Name string `json:"name"`
+	// ParentID nests the folder; empty creates it at the top level
+	ParentID string `json:"parentId,omitempty"`
+}
+
+// UpdateFolderRequest represents the update folder request. Fields left
+// out are unchanged.
+type UpdateFolderRequest struct {
+	Name *string `json:"name,omitempty"`
+	// ParentID moves the folder; empty moves it to the top level
+	ParentID *string `json:"parentId,omitempty"`
+}
+
+// MoveToFolderRequest represents the move to folder request
+type MoveToFolderRequest struct {
+	// FolderID is the destination; empty moves the project to the top
+	// level
+	FolderID string `json:"folderId,omitempty"`
+}
+
+// MoveProjectsRequest represents the bulk move request
+type MoveProjectsRequest struct {
+	ProjectIDs []string `json:"projectIds"`
+	FolderID   string   `json:"folderId,omitempty"`
+}
+
+// MoveProjectsResponse represents the bulk move response
+type MoveProjectsResponse struct {
+	Moved int `json:"moved"`
+	// Skipped lists the projects that were not moved because the user does
+	// not own them or they do not exist
+	Skipped []string `json:"skipped"`
+}
+
+// ListFolders returns all of the user's folders, sorted by name. Clients
+// build the tree from their parent IDs.
+//
+//encore:api auth method=GET path=/folders
+func ListFolders(ctx context.Context) (*ListFoldersResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT f.id, f.name, f.parent_id, f.created_at, f.updated_at,
+			(SELECT COUNT(*) FROM projects p WHERE p.folder_id = f.id AND p.deleted_at IS NULL)
+		FROM project_folders f
+		WHERE f.owner_id = $1
+		ORDER BY lower(f.name), f.id
+	`, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list folders", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list folders",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListFoldersResponse{Folders: []Folder{}}
+	for rows.Next() {
+		var f Folder
+		if err := rows.Scan(&f.ID, &f.Name, &f.ParentID, &f.CreatedAt, &f.UpdatedAt, &f.Projects); err != nil {
+			continue
+		}
+		resp.Folders = append(resp.Folders, f)
+	}
+	return resp, nil
+}
+
+//encore:api auth method=POST path=/folders
+func CreateFolder(ctx context.Context, req *CreateFolderRequest) (*Folder, error) {
+	userID := auth.UserID()
+	name, err := folderName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	var parentID *string
+	if req.ParentID != "" {
+		depth, err := folderDepth(ctx, req.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if depth >= maxFolderDepth {
+			return nil, &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "Folders can be nested at most 8 levels deep",
+			}
+		}
+		parentID = &req.ParentID
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM project_folders WHERE owner_id = $1`, userID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count folders", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create folder",
+		}
+	}
+	if count >= maxFoldersPerUser {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "Folder limit reached",
+		}
+	}
+
+	f := &Folder{Name: name, ParentID: parentID}
+	err = db.QueryRow(ctx, `
+		INSERT INTO project_folders (owner_id, parent_id, name)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
+	`, userID, parentID, name).Scan(&f.ID, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return nil, folderWriteError(ctx, err, "Failed to create folder")
+	}
+	return f, nil
+}
+
+// UpdateFolder renames a folder or moves it, with its contents, under
+// another folder.
+//
+//encore:api auth method=PATCH path=/folders/:id
+func UpdateFolder(ctx context.Context, id string, req *UpdateFolderRequest) (*Folder, error) {
+	if _, err := folderDepth(ctx, id); err != nil {
+		return nil, err
+	}
+	if req.Name != nil {
+		name, err := folderName(*req.Name)
+		if err != nil {
+			return nil, err
+		}
+		req.Name = &name
+	}
+	if req.ParentID != nil && *req.ParentID != "" {
+		if err := checkFolderMove(ctx, id, *req.ParentID); err != nil {
+			return nil, err
+		}
+	}
+
+	var f Folder
+	err := db.QueryRow(ctx, `
+		UPDATE project_folders SET
+			name = COALESCE($2, name),
+			parent_id = CASE WHEN $3::text IS NULL THEN parent_id ELSE NULLIF($3, '')::uuid END,
+			updated_at = NOW()
+		WHERE id::text = $1
+		RETURNING id, name, parent_id, created_at, updated_at,
+			(SELECT COUNT(*) FROM projects p WHERE p.folder_id = project_folders.id AND p.deleted_at IS NULL)
+	`, id, req.Name, req.ParentID).Scan(&f.ID, &f.Name, &f.ParentID, &f.CreatedAt, &f.UpdatedAt, &f.Projects)
+	if err != nil {
+		return nil, folderWriteError(ctx, err, "Failed to update folder")
+	}
+	return &f, nil
+}
+
+// DeleteFolder deletes a folder and its subfolders. The projects in them
+// are kept and move to the top level.
+//
+//encore:api auth method=DELETE path=/folders/:id
+func DeleteFolder(ctx context.Context, id string) error {
+	if _, err := folderDepth(ctx, id); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM project_folders WHERE id::text = $1`, id); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete folder", "folder_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete folder",
+		}
+	}
+	return nil
+}
+
+// MoveToFolder files a project the user owns in one of their folders.
+// Moving a project to another workspace is MoveProject.
+//
+//encore:api auth method=POST path=/projects/:id/move
+func MoveToFolder(ctx context.Context, id string, req *MoveToFolderRequest) error {
+	resp, err := MoveProjects(ctx, &MoveProjectsRequest{ProjectIDs: []string{id}, FolderID: req.FolderID})
+	if err != nil {
+		return err
+	}
+	if resp.Moved == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	return nil
+}
+
+// MoveProjects files several projects in a folder at once. Projects the
+// user does not own are skipped.
+//
+//encore:api auth method=POST path=/projects/move
+func MoveProjects(ctx context.Context, req *MoveProjectsRequest) (*MoveProjectsResponse, error) {
+	if len(req.ProjectIDs) == 0 || len(req.ProjectIDs) > maxBulkMove {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Between 1 and 100 projects can be moved at once",
+		}
+	}
+	var folderID *string
+	if req.FolderID != "" {
+		if _, err := folderDepth(ctx, req.FolderID); err != nil {
+			return nil, err
+		}
+		folderID = &req.FolderID
+	}
+
+	rows, err := db.Query(ctx, `
+		UPDATE projects SET folder_id = $3
+		WHERE id::text = ANY($1) AND owner_id = $2 AND deleted_at IS NULL
+		RETURNING id
+	`, req.ProjectIDs, auth.UserID(), folderID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to move projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to move projects",
+		}
+	}
+	defer rows.Close()
+
+	moved := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			moved[id] = true
+		}
+	}
+	resp := &MoveProjectsResponse{Moved: len(moved), Skipped: []string{}}
+	for _, id := range req.ProjectIDs {
+		if !moved[id] {
+			resp.Skipped = append(resp.Skipped, id)
+		}
+	}
+	return resp, nil
+}
+
+// folderDepth returns how deep one of the user's folders is nested, 1 for
+// a top-level folder. Other users' folders are not found.
+func folderDepth(ctx context.Context, id string) (int, error) {
+	var depth int
+	err := db.QueryRow(ctx, `
+		WITH RECURSIVE chain AS (
+			SELECT id, parent_id, 1 AS depth FROM project_folders WHERE id::text = $1 AND owner_id = $2
+			UNION ALL
+			SELECT f.id, f.parent_id, c.depth + 1 FROM project_folders f JOIN chain c ON f.id = c.parent_id
+			WHERE c.depth <= $3
+		)
+		SELECT MAX(depth) FROM chain HAVING COUNT(*) > 0
+	`, id, auth.UserID(), maxFolderDepth).Scan(&depth)
+	if err == sql.ErrNoRows {
+		return 0, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Folder not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load folder", "folder_id", id, "error", err)
+		return 0, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load folder",
+		}
+	}
+	return depth, nil
+}
+
+// checkFolderMove returns an error unless folder id can be moved under
+// parentID: the parent must not be the folder or inside it, and the
+// folder's subtree must still fit within maxFolderDepth.
+func checkFolderMove(ctx context.Context, id, parentID string) error {
+	parentDepth, err := folderDepth(ctx, parentID)
+	if err != nil {
+		return err
+	}
+	var cycle bool
+	var height int
+	err = db.QueryRow(ctx, `
+		WITH RECURSIVE subtree AS (
+			SELECT id, 1 AS height FROM project_folders WHERE id::text = $1
+			UNION ALL
+			SELECT f.id, s.height + 1 FROM project_folders f JOIN subtree s ON f.parent_id = s.id
+			WHERE s.height <= $3
+		)
+		SELECT COALESCE(bool_or(id::text = $2), FALSE), COALESCE(MAX(height), 0) FROM subtree
+	`, id, parentID, maxFolderDepth).Scan(&cycle, &height)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check folder move", "folder_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to move folder",
+		}
+	}
+	if cycle {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "A folder cannot be moved into itself",
+		}
+	}
+	if parentDepth+height > maxFolderDepth {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Folders can be nested at most 8 levels deep",
+		}
+	}
+	return nil
+}
+
+func folderName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > maxFolderNameLength {
+		return "", &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name must be between 1 and 255 characters",
+		}
+	}
+	return name, nil
+}
+
+// folderWriteError maps a failed folder insert or update to an API error.
+func folderWriteError(ctx context.Context, err error, message string) error {
+	if err == sql.ErrNoRows {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Folder not found",
+		}
+	}
+	if strings.Contains(err.Error(), "idx_project_folders_name") {
+		return &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "A folder with this name already exists here",
+		}
+	}
+	reqctx.Logger(ctx).Error("failed to save folder", "error", err)
+	return &errs.Error{
+		Code:    errs.Internal,
+		Message: message,
+	}
+}
@@ -0,0 +1,271 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// The gallery is the community page's view of public projects. A project
+// is listed while it is public and its owner is discoverable, an account
+// setting (PUT /auth/profile) that is on by default; owners who turn it
+// off keep their projects public to link holders but out of the gallery
+// and creator profiles. Projects may be filed under one of the template
+// categories.
+
+// Gallery sort keys
+const (
+	GallerySortTrending = "trending"
+	GallerySortRecent   = "recent"
+	GallerySortStars    = "stars"
+)
+
+// galleryOrder maps sort keys to ORDER BY clauses
+var galleryOrder = map[string]string{
+	GallerySortTrending: "recent_stars DESC, p.star_count DESC, p.created_at DESC",
+	GallerySortRecent:   "p.created_at DESC",
+	GallerySortStars:    "p.star_count DESC, p.created_at DESC",
+}
+
+// trendingWindow is how far back stars count toward trending
+const trendingWindow = 7 * 24 * time.Hour
+
+// galleryListed is the condition for a project to be in the gallery
+const galleryListed = `p.is_public AND p.deleted_at IS NULL AND u.discoverable AND u.deactivated_at IS NULL AND NOT u.is_guest`
+
+// GalleryRequest filters the gallery
+type GalleryRequest struct {
+	// Sort is trending (default), recent or stars. Trending ranks by
+	// stars received in the last week.
+	Sort string `query:"sort"`
+	// Category is a template category slug
+	Category string `query:"category"`
+	Tag      string `query:"tag"`
+	// Creator lists one creator's projects
+	Creator string `query:"creator"`
+	Limit   int    `query:"limit"`
+	Offset  int    `query:"offset"`
+}
+
+// Creator is the public profile of a project's owner
+type Creator struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	Avatar         *string           `json:"avatar,omitempty"`
+	AvatarVariants map[string]string `json:"avatarVariants,omitempty"`
+}
+
+// GalleryProject is a project as the gallery shows it
+type GalleryProject struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Slug        string    `json:"slug"`
+	Description string    `json:"description,omitempty"`
+	Thumbnail   string    `json:"thumbnail,omitempty"`
+	Tags        []string  `json:"tags"`
+	Category    string    `json:"category,omitempty"`
+	StarCount   int       `json:"starCount"`
+	Creator     Creator   `json:"creator"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// GalleryResponse represents a page of the gallery
+type GalleryResponse struct {
+	Projects []GalleryProject `json:"projects"`
+	Total    int              `json:"total"`
+	Limit    int              `json:"limit"`
+	Offset   int              `json:"offset"`
+}
+
+// ListGallery lists public projects for discovery. It needs no sign-in.
+//
+//encore:api public method=GET path=/gallery
+func ListGallery(ctx context.Context, req *GalleryRequest) (*GalleryResponse, error) {
+	sortKey := req.Sort
+	if sortKey == "" {
+		sortKey = GallerySortTrending
+	}
+	order, ok := galleryOrder[sortKey]
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "sort must be trending, recent or stars",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxProjectPageSize {
+		limit = defaultProjectPageSize
+	}
+	offset := max(req.Offset, 0)
+
+	// Recent stars are only counted for trending.
+	var args []any
+	recentStars := "0"
+	if sortKey == GallerySortTrending {
+		args = append(args, time.Now().Add(-trendingWindow))
+		recentStars = `(SELECT COUNT(*) FROM project_stars s WHERE s.project_id = p.id AND s.created_at > $1)`
+	}
+	filter := galleryListed
+	if req.Category != "" {
+		args = append(args, req.Category)
+		filter += fmt.Sprintf(` AND c.slug = $%d`, len(args))
+	}
+	if tag := strings.ToLower(strings.TrimSpace(req.Tag)); tag != "" {
+		args = append(args, tag)
+		filter += fmt.Sprintf(` AND $%d = ANY(p.tags)`, len(args))
+	}
+	if req.Creator != "" {
+		args = append(args, req.Creator)
+		filter += fmt.Sprintf(` AND p.owner_id::text = $%d`, len(args))
+	}
+
+	rows, err := db.Query(ctx, fmt.Sprintf(`
+		SELECT p.id, p.title, p.slug, p.description, p.thumbnail, p.tags, COALESCE(c.slug, ''), p.star_count,
+			p.created_at, p.updated_at, u.id, u.name, u.avatar, u.avatar_variants,
+			%s AS recent_stars, COUNT(*) OVER ()
+		FROM projects p
+		JOIN users u ON u.id = p.owner_id
+		LEFT JOIN template_categories c ON c.id = p.gallery_category_id
+		WHERE %s
+		ORDER BY %s, p.id
+		LIMIT $%d OFFSET $%d
+	`, recentStars, filter, order, len(args)+1, len(args)+2), append(args, limit, offset)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list gallery", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch gallery",
+		}
+	}
+	defer rows.Close()
+
+	resp := &GalleryResponse{Projects: []GalleryProject{}, Limit: limit, Offset: offset}
+	for rows.Next() {
+		var p GalleryProject
+		var description, thumbnail sql.NullString
+		var variants []byte
+		var recent int
+		err := rows.Scan(&p.ID, &p.Title, &p.Slug, &description, &thumbnail, &p.Tags, &p.Category, &p.StarCount,
+			&p.CreatedAt, &p.UpdatedAt, &p.Creator.ID, &p.Creator.Name, &p.Creator.Avatar, &variants,
+			&recent, &resp.Total)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to scan gallery project", "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to fetch gallery",
+			}
+		}
+		p.Description, p.Thumbnail = description.String, thumbnail.String
+		if p.Tags == nil {
+			p.Tags = []string{}
+		}
+		if len(variants) > 0 {
+			json.Unmarshal(variants, &p.Creator.AvatarVariants)
+		}
+		resp.Projects = append(resp.Projects, p)
+	}
+	if err := rows.Err(); err != nil {
+		reqctx.Logger(ctx).Error("failed to list gallery", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch gallery",
+		}
+	}
+	return resp, nil
+}
+
+// CreatorProfile is a creator's public profile, with totals over their
+// gallery projects
+type CreatorProfile struct {
+	Creator
+	ProjectCount int       `json:"projectCount"`
+	StarCount    int       `json:"starCount"`
+	JoinedAt     time.Time `json:"joinedAt"`
+}
+
+// GetCreatorProfile returns a discoverable creator's profile. Their
+// projects are listed by GET /gallery?creator=.
+//
+//encore:api public method=GET path=/gallery/creators/:userID
+func GetCreatorProfile(ctx context.Context, userID string) (*CreatorProfile, error) {
+	profile := &CreatorProfile{}
+	var variants []byte
+	err := db.QueryRow(ctx, `
+		SELECT u.id, u.name, u.avatar, u.avatar_variants, u.created_at,
+			COUNT(p.id), COALESCE(SUM(p.star_count), 0)
+		FROM users u
+		LEFT JOIN projects p ON p.owner_id = u.id AND p.is_public AND p.deleted_at IS NULL
+		WHERE u.id::text = $1 AND u.discoverable AND u.deactivated_at IS NULL AND NOT u.is_guest
+		GROUP BY u.id
+	`, userID).Scan(&profile.ID, &profile.Name, &profile.Avatar, &variants, &profile.JoinedAt,
+		&profile.ProjectCount, &profile.StarCount)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Creator not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load creator profile", "user_id", userID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch creator",
+		}
+	}
+	if len(variants) > 0 {
+		json.Unmarshal(variants, &profile.AvatarVariants)
+	}
+	return profile, nil
+}
+
+// SetGalleryCategoryRequest represents the set gallery category request
+type SetGalleryCategoryRequest struct {
+	// Category is a template category slug; empty removes the category
+	Category string `json:"category"`
+}
+
+// SetGalleryCategory files a project under a gallery category.
+//
+//encore:api auth method=PUT path=/projects/:id/gallery-category
+func SetGalleryCategory(ctx context.Context, id string, req *SetGalleryCategoryRequest) error {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return err
+	}
+	var categoryID *string
+	if req.Category != "" {
+		var cid string
+		err := db.QueryRow(ctx, `SELECT id FROM template_categories WHERE slug = $1`, req.Category).Scan(&cid)
+		if err == sql.ErrNoRows {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Unknown category",
+			}
+		} else if err != nil {
+			reqctx.Logger(ctx).Error("failed to look up category", "project_id", id, "error", err)
+			return &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to set category",
+			}
+		}
+		categoryID = &cid
+	}
+	_, err := db.Exec(ctx, `
+		UPDATE projects SET gallery_category_id = $2 WHERE id = $1 AND deleted_at IS NULL
+	`, id, categoryID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to set gallery category", "project_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to set category",
+		}
+	}
+	return nil
+}
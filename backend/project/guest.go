@@ -0,0 +1,72 @@
+package project
+
+import (
+	"context"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// maxGuestProjects is how many projects a guest account may own before it
+// has to be upgraded to a full account.
+const maxGuestProjects = 1
+
+// isGuest reports whether userID is a guest account.
+func isGuest(ctx context.Context, userID string) (bool, error) {
+	var guest bool
+	err := db.QueryRow(ctx, `SELECT is_guest FROM users WHERE id = $1`, userID).Scan(&guest)
+	return guest, err
+}
+
+// checkGuestProjectLimit rejects project creation for guests that already
+// own their one project.
+func checkGuestProjectLimit(ctx context.Context, userID string) error {
+	guest, err := isGuest(ctx, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check guest status", "user_id", userID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create project",
+		}
+	}
+	if !guest {
+		return nil
+	}
+
+	var owned int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM projects WHERE owner_id = $1`, userID).Scan(&owned); err != nil {
+		reqctx.Logger(ctx).Error("failed to count guest projects", "user_id", userID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create project",
+		}
+	}
+	if owned >= maxGuestProjects {
+		return &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "Guest accounts can create one project. Sign up to create more.",
+		}
+	}
+	return nil
+}
+
+// denyGuest rejects actions that would expose a guest's work to others,
+// such as publishing a project or creating a share link.
+func denyGuest(ctx context.Context, userID string) error {
+	guest, err := isGuest(ctx, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check guest status", "user_id", userID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check account",
+		}
+	}
+	if guest {
+		return &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Sign up to share projects",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package project
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// inventoryColumns are the report's columns before the custom fields
+var inventoryColumns = []string{"id", "title", "owner", "tags", "public", "created_at", "updated_at"}
+
+// ProjectInventory is a CSV report of an organization's projects, one row
+// per project with a column for each custom field, for audits and
+// spreadsheets.
+//
+//encore:api auth raw method=GET path=/orgs/:orgID/reports/projects
+func ProjectInventory(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	orgID := encore.CurrentRequest().PathParams.Get("orgID")
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	log := reqctx.Logger(ctx).With("org_id", orgID)
+
+	fields, err := orgFields(ctx, orgID)
+	if err != nil {
+		log.Error("failed to load project fields", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(ctx, `
+		SELECT p.id, p.title, COALESCE(u.email, ''), p.tags, p.is_public, p.created_at, p.updated_at, p.custom_fields
+		FROM projects p
+		LEFT JOIN users u ON u.id = p.owner_id
+		WHERE p.org_id::text = $1 AND p.deleted_at IS NULL
+		ORDER BY p.created_at, p.id
+	`, orgID)
+	if err != nil {
+		log.Error("failed to list projects for inventory", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="projects-%s.csv"`, time.Now().UTC().Format(time.DateOnly)))
+	w.Header().Set("Cache-Control", "no-store")
+	out := csv.NewWriter(w)
+
+	header := append([]string{}, inventoryColumns...)
+	for _, f := range fields {
+		header = append(header, f.Label)
+	}
+	out.Write(header)
+
+	for rows.Next() {
+		var id, title, owner string
+		var tags []string
+		var public bool
+		var createdAt, updatedAt time.Time
+		values := map[string]any{}
+		if err := rows.Scan(&id, &title, &owner, &tags, &public, &createdAt, &updatedAt, &values); err != nil {
+			log.Error("failed to read project for inventory", "error", err)
+			break
+		}
+		record := []string{
+			id, csvCell(title), owner, csvCell(strings.Join(tags, ", ")), strconv.FormatBool(public),
+			createdAt.UTC().Format(time.RFC3339), updatedAt.UTC().Format(time.RFC3339),
+		}
+		for _, f := range fields {
+			record = append(record, csvCell(fieldText(values[f.Key])))
+		}
+		out.Write(record)
+	}
+	out.Flush()
+}
+
+// fieldText formats a custom field value for the report.
+func fieldText(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// csvCell keeps user-entered text from being read as a formula when the
+// report is opened in a spreadsheet.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
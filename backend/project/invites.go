@@ -0,0 +1,428 @@
+package project
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+
+	canvasauth "canvasai/auth"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+	"canvasai/webhook"
+)
+
+// Collaborators can be invited by email, whether or not the address has an
+// account. The invite email carries a token; following it either accepts
+// the invite for the signed-in user or signs up with it (see
+// canvasauth.SignupEvent), and the invite becomes a project_collaborators
+// row.
+
+const (
+	inviteLifetime = 7 * 24 * time.Hour
+	// resendInterval and maxInviteSends keep resends from being used to
+	// flood an inbox.
+	resendInterval = time.Minute
+	maxInviteSends = 5
+)
+
+// Invite is a pending invitation to collaborate on a project
+type Invite struct {
+	ID         string    `json:"id"`
+	ProjectID  string    `json:"projectId"`
+	Email      string    `json:"email"`
+	Role       string    `json:"role"`
+	InvitedBy  string    `json:"invitedBy,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	LastSentAt time.Time `json:"lastSentAt"`
+	SendCount  int       `json:"sendCount"`
+}
+
+// CreateInviteRequest represents the create invite request
+type CreateInviteRequest struct {
+	Email string `json:"email"`
+	// Role defaults to viewer
+	Role string `json:"role,omitempty"`
+}
+
+// ListInvitesResponse represents the list invites response
+type ListInvitesResponse struct {
+	Invites []Invite `json:"invites"`
+}
+
+// InvitePreview describes an invite to the person following its link
+type InvitePreview struct {
+	ProjectID    string    `json:"projectId"`
+	ProjectTitle string    `json:"projectTitle"`
+	InviterName  string    `json:"inviterName,omitempty"`
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+var _ = pubsub.NewSubscription(canvasauth.Signups, "accept-project-invite", pubsub.SubscriptionConfig[*canvasauth.SignupEvent]{
+	Handler: acceptInviteOnSignup,
+})
+
+// CreateInvite emails an invitation to collaborate. Inviting an address
+// that already has an open invite replaces it with a fresh link.
+//
+//encore:api auth method=POST path=/projects/:id/invites
+func CreateInvite(ctx context.Context, id string, req *CreateInviteRequest) (*Invite, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+	userID := auth.UserID()
+	if err := denyGuest(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if at := strings.LastIndex(email, "@"); at < 1 || at == len(email)-1 || len(email) > 255 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid email address",
+		}
+	}
+	role := req.Role
+	if role == "" {
+		role = string(permissions.RoleViewer)
+	}
+	if !permissions.ValidRole(role) || role == string(permissions.RoleOwner) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Role must be editor, commenter or viewer",
+		}
+	}
+
+	var exists bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM project_collaborators c JOIN users u ON u.id = c.user_id
+			WHERE c.project_id = $1 AND lower(u.email) = $2
+		)
+	`, id, email).Scan(&exists)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check collaborators", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create invite",
+		}
+	}
+	if exists {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "This person is already a collaborator",
+		}
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create invite",
+		}
+	}
+	inv := &Invite{ProjectID: id, Email: email, Role: role, InvitedBy: userID}
+	err = db.QueryRow(ctx, `
+		INSERT INTO project_invites (project_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (project_id, lower(email)) WHERE accepted_at IS NULL DO UPDATE
+		SET role = EXCLUDED.role, token_hash = EXCLUDED.token_hash, invited_by = EXCLUDED.invited_by,
+			created_at = NOW(), expires_at = EXCLUDED.expires_at, last_sent_at = NOW(), send_count = 1
+		RETURNING id, created_at, expires_at, last_sent_at, send_count
+	`, id, email, role, hashInviteToken(token), userID, time.Now().Add(inviteLifetime)).Scan(&inv.ID, &inv.CreatedAt, &inv.ExpiresAt, &inv.LastSentAt, &inv.SendCount)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create invite", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create invite",
+		}
+	}
+
+	if err := sendInviteEmail(ctx, inv, token); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+//encore:api auth method=GET path=/projects/:id/invites
+func ListInvites(ctx context.Context, id string) (*ListInvitesResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, project_id, email, role, COALESCE(invited_by::text, ''), created_at, expires_at, last_sent_at, send_count
+		FROM project_invites
+		WHERE project_id = $1 AND accepted_at IS NULL
+		ORDER BY created_at DESC
+	`, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch invites",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListInvitesResponse{Invites: []Invite{}}
+	for rows.Next() {
+		var inv Invite
+		if err := rows.Scan(&inv.ID, &inv.ProjectID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt, &inv.LastSentAt, &inv.SendCount); err != nil {
+			continue
+		}
+		resp.Invites = append(resp.Invites, inv)
+	}
+	return resp, nil
+}
+
+// ResendInvite emails a new link for an open invite and extends its expiry.
+// The previous link stops working.
+//
+//encore:api auth method=POST path=/projects/:id/invites/:inviteID/resend
+func ResendInvite(ctx context.Context, id string, inviteID string) (*Invite, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to resend invite",
+		}
+	}
+	inv := &Invite{ID: inviteID, ProjectID: id}
+	err = db.QueryRow(ctx, `
+		UPDATE project_invites
+		SET token_hash = $3, expires_at = $4, last_sent_at = NOW(), send_count = send_count + 1
+		WHERE id = $1 AND project_id = $2 AND accepted_at IS NULL
+			AND last_sent_at < $5 AND send_count < $6
+		RETURNING email, role, COALESCE(invited_by::text, ''), created_at, expires_at, last_sent_at, send_count
+	`, inviteID, id, hashInviteToken(token), time.Now().Add(inviteLifetime), time.Now().Add(-resendInterval), maxInviteSends).Scan(
+		&inv.Email, &inv.Role, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt, &inv.LastSentAt, &inv.SendCount)
+	if err == sql.ErrNoRows {
+		var sends int
+		var lastSent time.Time
+		err = db.QueryRow(ctx, `
+			SELECT send_count, last_sent_at FROM project_invites
+			WHERE id = $1 AND project_id = $2 AND accepted_at IS NULL
+		`, inviteID, id).Scan(&sends, &lastSent)
+		if err == sql.ErrNoRows {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Invite not found",
+			}
+		}
+		if err == nil {
+			msg := "Invite was sent too recently, try again in a minute"
+			if sends >= maxInviteSends {
+				msg = "Invite has been resent too many times; revoke it and invite again"
+			}
+			return nil, &errs.Error{
+				Code:    errs.ResourceExhausted,
+				Message: msg,
+			}
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to resend invite", "invite_id", inviteID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to resend invite",
+		}
+	}
+
+	if err := sendInviteEmail(ctx, inv, token); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+//encore:api auth method=DELETE path=/projects/:id/invites/:inviteID
+func RevokeInvite(ctx context.Context, id string, inviteID string) error {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM project_invites WHERE id = $1 AND project_id = $2 AND accepted_at IS NULL
+	`, inviteID, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to revoke invite", "invite_id", inviteID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to revoke invite",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite not found",
+		}
+	}
+	return nil
+}
+
+// GetInvite describes an open invite so its landing page can offer to
+// sign in or sign up.
+//
+//encore:api public method=GET path=/project-invites/:token
+func GetInvite(ctx context.Context, token string) (*InvitePreview, error) {
+	var p InvitePreview
+	err := db.QueryRow(ctx, `
+		SELECT i.project_id, p.title, COALESCE(u.name, ''), i.email, i.role, i.expires_at
+		FROM project_invites i
+		JOIN projects p ON p.id = i.project_id
+		LEFT JOIN users u ON u.id = i.invited_by
+		WHERE i.token_hash = $1 AND i.accepted_at IS NULL AND i.expires_at > NOW() AND p.deleted_at IS NULL
+	`, hashInviteToken(token)).Scan(&p.ProjectID, &p.ProjectTitle, &p.InviterName, &p.Email, &p.Role, &p.ExpiresAt)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite not found or expired",
+		}
+	}
+	return &p, nil
+}
+
+// AcceptInvite adds the signed-in user as a collaborator from an invite
+// link. The link itself proves the invite reached them, so it can be
+// accepted with an account under a different address.
+//
+//encore:api auth method=POST path=/project-invites/:token/accept
+func AcceptInvite(ctx context.Context, token string) (*Project, error) {
+	projectID, err := redeemInvite(ctx, token, auth.UserID())
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Invite not found or expired",
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to accept invite", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to accept invite",
+		}
+	}
+	return GetProject(ctx, projectID)
+}
+
+func acceptInviteOnSignup(ctx context.Context, e *canvasauth.SignupEvent) error {
+	if e.InviteToken == "" {
+		return nil
+	}
+	_, err := redeemInvite(ctx, e.InviteToken, e.UserID)
+	if err == sql.ErrNoRows {
+		reqctx.Logger(ctx).Info("signup invite not found or expired", "user_id", e.UserID)
+		return nil
+	}
+	return err
+}
+
+// redeemInvite marks an open invite accepted and makes userID a
+// collaborator with its role. Someone who already collaborates keeps the
+// role they have. It returns sql.ErrNoRows when the token does not match
+// an open invite.
+func redeemInvite(ctx context.Context, token, userID string) (string, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var projectID, role string
+	var invitedBy sql.NullString
+	err = tx.QueryRow(ctx, `
+		UPDATE project_invites SET accepted_at = NOW(), accepted_by = $2
+		WHERE token_hash = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		RETURNING project_id, role, invited_by
+	`, hashInviteToken(token), userID).Scan(&projectID, &role, &invitedBy)
+	if err != nil {
+		return "", err
+	}
+	result, err := tx.Exec(ctx, `
+		INSERT INTO project_collaborators (project_id, user_id, role, invited_by, accepted_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (project_id, user_id) DO NOTHING
+	`, projectID, userID, role, invitedBy)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	projectaccess.Forget(projectID)
+	reqctx.Logger(ctx).Info("project invite accepted", "project_id", projectID, "user_id", userID)
+	if result.RowsAffected() > 0 {
+		data := map[string]string{"projectId": projectID, "userId": userID, "role": role}
+		if invitedBy.Valid {
+			data["addedBy"] = invitedBy.String
+		}
+		emitCollaboratorEvent(ctx, webhook.EventCollaboratorAdded, projectID, data)
+	}
+	return projectID, nil
+}
+
+func sendInviteEmail(ctx context.Context, inv *Invite, token string) error {
+	var title, inviter string
+	err := db.QueryRow(ctx, `
+		SELECT p.title, COALESCE(u.name, 'Someone')
+		FROM projects p LEFT JOIN users u ON u.id = $2
+		WHERE p.id = $1
+	`, inv.ProjectID, inv.InvitedBy).Scan(&title, &inviter)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load invite details", "invite_id", inv.ID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to send invite",
+		}
+	}
+
+	body := fmt.Sprintf(`%s invited you to collaborate on "%s" in CanvasAI as %s.
+
+Open the project:
+{link}
+
+You can sign in or create an account from that page. The invitation expires on %s.
+`, inviter, title, articleRole(inv.Role), inv.ExpiresAt.UTC().Format("January 2, 2006"))
+
+	err = canvasauth.SendEmail(ctx, &canvasauth.SendEmailRequest{
+		To:       inv.Email,
+		Subject:  fmt.Sprintf("%s invited you to %s", inviter, title),
+		Body:     body,
+		LinkPath: "/invites/" + token,
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to send invite email", "invite_id", inv.ID, "error", err)
+		return &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Invite saved but the email could not be sent; try resending it",
+		}
+	}
+	return nil
+}
+
+// articleRole returns "an editor", "a viewer" and so on.
+func articleRole(role string) string {
+	if strings.HasPrefix(role, "e") {
+		return "an " + role
+	}
+	return "a " + role
+}
+
+func hashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
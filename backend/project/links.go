@@ -0,0 +1,377 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/canvasrefs"
+	"canvasai/permissions"
+	"canvasai/realtime"
+	"canvasai/reqctx"
+)
+
+// Assets are linked: a canvas references an asset by its canonical URL, so
+// replacing the asset (a shared logo, say) updates every project using it.
+// A project can opt out by freezing an asset at a version. Its canvas then
+// references that version's URL, and saves keep every reference to the
+// asset pinned there until it is unfrozen. References by bare asset ID
+// cannot carry a version and always follow the current file.
+
+// Asset link modes
+const (
+	LinkLive   = "live"
+	LinkFrozen = "frozen"
+)
+
+// LinkedAsset is an asset a project's canvas references
+type LinkedAsset struct {
+	AssetID        string `json:"assetId"`
+	Filename       string `json:"filename"`
+	Mode           string `json:"mode"`
+	CurrentVersion int    `json:"currentVersion"`
+	// FrozenVersion is the version a frozen asset is shown at
+	FrozenVersion *int       `json:"frozenVersion,omitempty"`
+	FrozenBy      *string    `json:"frozenBy,omitempty"`
+	FrozenAt      *time.Time `json:"frozenAt,omitempty"`
+	// UpdateAvailable is set when a frozen asset has been replaced since
+	UpdateAvailable bool `json:"updateAvailable"`
+}
+
+// ListLinkedAssetsResponse represents the list linked assets response
+type ListLinkedAssetsResponse struct {
+	Assets []LinkedAsset `json:"assets"`
+}
+
+// SetAssetLinkRequest represents the set asset link request
+type SetAssetLinkRequest struct {
+	// Mode is live to follow the asset's current file or frozen to keep
+	// showing one version
+	Mode string `json:"mode"`
+	// Version to freeze at; defaults to the current version
+	Version int `json:"version,omitempty"`
+}
+
+// ListLinkedAssets lists the assets the project uses and whether each
+// follows updates, plus assets it froze and no longer uses.
+//
+//encore:api auth method=GET path=/projects/:id/linked-assets
+func ListLinkedAssets(ctx context.Context, id string) (*ListLinkedAssetsResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+	index, _, err := loadAssetIndex(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var assetIDs []string
+	for _, ids := range index {
+		assetIDs = append(assetIDs, ids...)
+	}
+
+	resp := &ListLinkedAssetsResponse{Assets: []LinkedAsset{}}
+	rows, err := db.Query(ctx, `
+		SELECT a.id, a.original_filename, a.version, l.frozen_version, l.frozen_by, l.frozen_at
+		FROM assets a
+		LEFT JOIN project_asset_links l ON l.asset_id = a.id AND l.project_id = $2
+		WHERE a.id::text = ANY($1) OR l.project_id IS NOT NULL
+		ORDER BY a.original_filename, a.id
+	`, assetIDs, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list linked assets", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list linked assets",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a LinkedAsset
+		var frozenBy sql.NullString
+		if err := rows.Scan(&a.AssetID, &a.Filename, &a.CurrentVersion, &a.FrozenVersion, &frozenBy, &a.FrozenAt); err != nil {
+			continue
+		}
+		describeLink(&a, frozenBy)
+		resp.Assets = append(resp.Assets, a)
+	}
+	return resp, nil
+}
+
+// SetAssetLink freezes an asset the project uses at a version, or makes it
+// follow the asset's current file again. The canvas is rewritten and saved
+// as a new revision; open editors are told to reload it.
+//
+//encore:api auth method=PUT path=/projects/:id/linked-assets/:assetID
+func SetAssetLink(ctx context.Context, id string, assetID string, req *SetAssetLinkRequest) (*LinkedAsset, error) {
+	userID := auth.UserID()
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	assetID = strings.ToLower(assetID)
+	if req.Mode != LinkLive && req.Mode != LinkFrozen {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "mode must be live or frozen",
+		}
+	}
+
+	var canvasData []byte
+	var revision, current int
+	err := db.QueryRow(ctx, `
+		SELECT p.canvas_data, p.version, a.version
+		FROM projects p, assets a
+		WHERE p.id = $1 AND a.id = $2
+	`, id, assetID).Scan(&canvasData, &revision, &current)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Asset not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update asset link",
+		}
+	}
+
+	version := 0
+	if req.Mode == LinkFrozen {
+		version = req.Version
+		if version == 0 {
+			version = current
+		}
+		var available bool
+		err := db.QueryRow(ctx, `
+			SELECT $2 = $3 OR EXISTS(
+				SELECT 1 FROM asset_versions WHERE asset_id = $1 AND version = $2 AND purged_at IS NULL
+			)
+		`, assetID, version, current).Scan(&available)
+		if err != nil || !available {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Version not found",
+			}
+		}
+	}
+
+	var doc any
+	if err := json.Unmarshal(canvasData, &doc); err != nil || len(canvasData) == 0 {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas data is invalid",
+		}
+	}
+	uses := false
+	for _, ref := range canvasrefs.Find(doc) {
+		if isAssetURLRef(ref) && ref.ID == assetID {
+			uses = true
+			break
+		}
+	}
+	if !uses && req.Mode == LinkFrozen {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "The project does not use this asset",
+		}
+	}
+	if !uses {
+		// Unfreezing an asset the canvas no longer uses only releases the
+		// version for retention.
+		if _, err := db.Exec(ctx, `DELETE FROM project_asset_links WHERE project_id = $1 AND asset_id = $2`, id, assetID); err != nil {
+			reqctx.Logger(ctx).Error("failed to delete asset link", "project_id", id, "asset_id", assetID, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to update asset link",
+			}
+		}
+		return loadAssetLink(ctx, id, assetID, current), nil
+	}
+	rewritten, err := linkAssetRefs(doc, map[string]int{assetID: version})
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas data is invalid",
+		}
+	}
+	raw, err := json.Marshal(rewritten)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update asset link",
+		}
+	}
+
+	if err := saveAssetLink(ctx, id, assetID, userID, version, revision, raw); err != nil {
+		if err == errRevisionChanged {
+			return nil, &errs.Error{
+				Code:    errs.Aborted,
+				Message: "The project was saved by someone else, try again",
+			}
+		}
+		reqctx.Logger(ctx).Error("failed to save asset link", "project_id", id, "asset_id", assetID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update asset link",
+		}
+	}
+
+	event := map[string]any{"assetId": assetID, "mode": req.Mode, "revision": revision + 1}
+	if version > 0 {
+		event["version"] = version
+	}
+	if err := realtime.Publish(ctx, id, realtime.EventAssetLinkChanged, event); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish asset link change", "project_id", id, "error", err)
+	}
+	announceCanvasSave(ctx, id, revision+1)
+	reqctx.Logger(ctx).Info("asset link changed", "project_id", id, "asset_id", assetID, "mode", req.Mode, "version", version)
+
+	return loadAssetLink(ctx, id, assetID, current), nil
+}
+
+// loadAssetLink describes a project's link to an asset after a change.
+func loadAssetLink(ctx context.Context, projectID, assetID string, current int) *LinkedAsset {
+	link := &LinkedAsset{AssetID: assetID, CurrentVersion: current}
+	var frozenBy sql.NullString
+	err := db.QueryRow(ctx, `
+		SELECT a.original_filename, l.frozen_version, l.frozen_by, l.frozen_at
+		FROM assets a
+		LEFT JOIN project_asset_links l ON l.asset_id = a.id AND l.project_id = $2
+		WHERE a.id = $1
+	`, assetID, projectID).Scan(&link.Filename, &link.FrozenVersion, &frozenBy, &link.FrozenAt)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to reload asset link", "project_id", projectID, "asset_id", assetID, "error", err)
+	}
+	describeLink(link, frozenBy)
+	return link
+}
+
+// saveAssetLink stores the rewritten canvas as a new revision and records
+// the link, provided nobody saved the project since revision was read.
+func saveAssetLink(ctx context.Context, projectID, assetID, userID string, version, revision int, canvasData []byte) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(ctx, `
+		UPDATE projects
+		SET canvas_data = $2, version = version + 1, updated_at = NOW(), last_saved_by = $3
+		WHERE id = $1 AND version = $4
+	`, projectID, canvasData, userID, revision)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return errRevisionChanged
+	}
+	if version > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO project_asset_links (project_id, asset_id, frozen_version, frozen_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (project_id, asset_id) DO UPDATE
+			SET frozen_version = EXCLUDED.frozen_version, frozen_by = EXCLUDED.frozen_by, frozen_at = NOW()
+		`, projectID, assetID, version, userID)
+	} else {
+		_, err = tx.Exec(ctx, `
+			DELETE FROM project_asset_links WHERE project_id = $1 AND asset_id = $2
+		`, projectID, assetID)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyAssetLinks pins the references of a document about to be saved to
+// the versions the project froze them at, so assets added again or
+// restored from an older copy stay frozen. References to versions of
+// assets the project has not frozen are relinked to the current file. It
+// returns doc unchanged when nothing needs rewriting.
+func applyAssetLinks(ctx context.Context, projectID string, doc any) (any, error) {
+	rows, err := db.Query(ctx, `
+		SELECT asset_id, frozen_version FROM project_asset_links WHERE project_id = $1
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	frozen := map[string]int{}
+	for rows.Next() {
+		var assetID string
+		var version int
+		if err := rows.Scan(&assetID, &version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		frozen[assetID] = version
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	versions := map[string]int{}
+	stale := false
+	for _, ref := range canvasrefs.Find(doc) {
+		if !isAssetURLRef(ref) {
+			continue
+		}
+		versions[ref.ID] = frozen[ref.ID]
+		stale = stale || refVersion(ref) != frozen[ref.ID]
+	}
+	if !stale {
+		return doc, nil
+	}
+	return linkAssetRefs(doc, versions)
+}
+
+// linkAssetRefs returns a copy of doc with the URL references to the given
+// assets pointing at a version, or at the current file for version zero.
+// References to other assets are kept.
+func linkAssetRefs(doc any, versions map[string]int) (any, error) {
+	rewritten, _, err := canvasrefs.Rewrite(doc, func(ref canvasrefs.Ref) (string, canvasrefs.Action, error) {
+		version, ok := versions[ref.ID]
+		if !ok || !isAssetURLRef(ref) || refVersion(ref) == version {
+			return ref.Value, canvasrefs.ActionKept, nil
+		}
+		if version > 0 {
+			return canvasrefs.VersionedAssetURL(ref.ID, version), canvasrefs.ActionRelinked, nil
+		}
+		return canvasrefs.AssetURL(ref.ID), canvasrefs.ActionRelinked, nil
+	})
+	return rewritten, err
+}
+
+// isAssetURLRef reports whether ref references an asset by URL, the only
+// form that can carry a version.
+func isAssetURLRef(ref canvasrefs.Ref) bool {
+	return ref.Kind != canvasrefs.KindComponent && ref.ID != "" && !strings.EqualFold(ref.ID, ref.Value)
+}
+
+// refVersion returns the version a reference pins, or zero if it follows
+// the current file.
+func refVersion(ref canvasrefs.Ref) int {
+	version, _ := canvasrefs.ParseAssetVersion(ref.Value)
+	return version
+}
+
+var errRevisionChanged = errors.New("project revision changed")
+
+// describeLink fills in a linked asset's mode from its frozen version.
+func describeLink(a *LinkedAsset, frozenBy sql.NullString) {
+	a.Mode = LinkLive
+	if a.FrozenVersion != nil {
+		a.Mode = LinkFrozen
+		a.UpdateAvailable = *a.FrozenVersion != a.CurrentVersion
+	}
+	if frozenBy.Valid {
+		a.FrozenBy = &frozenBy.String
+	}
+}
@@ -0,0 +1,96 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+	"canvasai/settings"
+)
+
+// applyOrgDefaults files project under orgID and gives it the organization's
+// project defaults: canvas size, color profile, autosave interval and
+// sharing, after checking the title against its naming rules. An untitled
+// project is named by the organization's template, filled from nameFields.
+// The caller must be an admin or member of the organization; org guests
+// cannot create projects in it.
+func applyOrgDefaults(ctx context.Context, project *Project, orgID string, nameFields map[string]string) error {
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		return err
+	}
+
+	org, err := settings.GetOrgSettings(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	defaults := org.Projects
+
+	if project.Title == "" && defaults.Naming.Template != "" {
+		title, err := renderNameTemplate(defaults.Naming.Template, nameFields, project.CreatedAt)
+		if err != nil {
+			return err
+		}
+		project.Title = title
+	}
+	if pattern := defaults.Naming.TitlePattern; pattern != "" {
+		// Anchor the pattern so it describes the whole title.
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err == nil && !re.MatchString(project.Title) {
+			msg := "Title does not follow the organization's naming convention"
+			if defaults.Naming.TitleHint != "" {
+				msg += ": " + defaults.Naming.TitleHint
+			}
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: msg,
+			}
+		}
+	}
+
+	project.OrgID = &orgID
+	project.CanvasWidth = defaults.Canvas.Width
+	project.CanvasHeight = defaults.Canvas.Height
+	project.ColorProfile = defaults.ColorProfile
+	if defaults.AutosaveInterval > 0 {
+		interval := defaults.AutosaveInterval
+		project.AutosaveInterval = &interval
+	}
+	project.IsPublic = defaults.Sharing.Public
+	project.ShareLinksEnabled = defaults.Sharing.ShareLinks
+	return nil
+}
+
+// requireOrgMember returns an error unless the caller belongs to orgID with
+// one of roles.
+func requireOrgMember(ctx context.Context, orgID string, roles ...string) error {
+	var role string
+	err := db.QueryRow(ctx, `
+		SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2
+	`, orgID, auth.UserID()).Scan(&role)
+	if err == sql.ErrNoRows {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Organization not found",
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check organization membership", "org_id", orgID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check organization membership",
+		}
+	}
+	for _, r := range roles {
+		if role == r {
+			return nil
+		}
+	}
+	return &errs.Error{
+		Code:    errs.PermissionDenied,
+		Message: "Your organization role does not allow this",
+	}
+}
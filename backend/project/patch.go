@@ -0,0 +1,314 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/realtime"
+	"canvasai/reqctx"
+	"canvasai/wideevent"
+)
+
+// A save only needs to send what changed. PatchCanvas takes a list of
+// element operations against a base revision and applies them to the
+// stored canvas. Either every operation applies and the result is saved as
+// the next revision, through the same checks as a full save, or nothing
+// is saved. Collaborators are sent the operations so they can apply them
+// without reloading the canvas.
+
+// Canvas patch operations
+const (
+	CanvasOpAdd    = "add"
+	CanvasOpUpdate = "update"
+	CanvasOpRemove = "remove"
+	CanvasOpMove   = "move"
+)
+
+// maxCanvasOps bounds the operations in one patch
+const maxCanvasOps = 1000
+
+// CanvasOp changes one element, found by its ID anywhere in the canvas,
+// including inside groups
+type CanvasOp struct {
+	Op        string `json:"op"` // add, update, remove or move
+	ElementID string `json:"elementId"`
+	// PageID or ParentID, a group, is where add and move put the element.
+	// With neither it goes in the canvas' top-level objects, which only
+	// canvases without pages have.
+	PageID   string `json:"pageId,omitempty"`
+	ParentID string `json:"parentId,omitempty"`
+	// Index is the element's position in its list, bottom of the stack
+	// first. Omitted puts it on top.
+	Index *int `json:"index,omitempty"`
+	// Element is the element an add inserts
+	Element map[string]any `json:"element,omitempty"`
+	// Props are the properties an update sets; null removes a property
+	Props map[string]any `json:"props,omitempty"`
+}
+
+// PatchCanvasRequest represents the patch canvas request
+type PatchCanvasRequest struct {
+	Ops []CanvasOp `json:"ops"`
+	// BaseRevision is the revision the operations were made against, also
+	// accepted as an If-Match header. One of them is required.
+	BaseRevision *int   `json:"baseRevision,omitempty"`
+	IfMatch      string `header:"If-Match"`
+}
+
+// PatchCanvasResponse reports the revision a patch saved
+type PatchCanvasResponse struct {
+	Revision       int               `json:"revision"`
+	UpdatedAt      time.Time         `json:"updatedAt"`
+	SizeBudget     *SizeBudget       `json:"sizeBudget,omitempty"`
+	EmbeddedImages *ExtractionReport `json:"embeddedImages,omitempty"`
+}
+
+// CanvasPatch is the realtime event sent to collaborators for a patch
+type CanvasPatch struct {
+	Revision     int        `json:"revision"`
+	BaseRevision int        `json:"baseRevision"`
+	UserID       string     `json:"userId"`
+	Ops          []CanvasOp `json:"ops"`
+}
+
+//encore:api auth method=PATCH path=/projects/:id/canvas
+func PatchCanvas(ctx context.Context, id string, req *PatchCanvasRequest) (*PatchCanvasResponse, error) {
+	ev := wideevent.Start(wideevent.KindSave)
+	ev.Set("project_id", id)
+	ev.Set("user_id", auth.UserID())
+	ev.Set("patch_ops", len(req.Ops))
+	resp, err := patchCanvas(ctx, id, req, ev)
+	ev.Finish(ctx, err)
+	return resp, err
+}
+
+func patchCanvas(ctx context.Context, id string, req *PatchCanvasRequest, ev *wideevent.Event) (*PatchCanvasResponse, error) {
+	userID := auth.UserID()
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	update := &UpdateProjectRequest{BaseRevision: req.BaseRevision, IfMatch: req.IfMatch}
+	if err := resolveBaseRevision(update); err != nil {
+		return nil, err
+	}
+	base := *update.BaseRevision
+	if len(req.Ops) == 0 || len(req.Ops) > maxCanvasOps {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("A patch must have between 1 and %d operations", maxCanvasOps),
+		}
+	}
+
+	var canvasData []byte
+	var revision int
+	err := db.QueryRow(ctx, `
+		SELECT canvas_data, version FROM projects WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&canvasData, &revision)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if revision != base {
+		return nil, saveConflict(ctx, id, RevisionInfo{Revision: base, UserID: userID, SavedAt: time.Now()})
+	}
+
+	doc := map[string]any{}
+	if len(canvasData) > 0 && string(canvasData) != "null" {
+		if err := json.Unmarshal(canvasData, &doc); err != nil || doc == nil {
+			return nil, &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "Project canvas data is invalid",
+			}
+		}
+	}
+	if err := upgradeCanvas(doc); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas data is invalid: " + err.Error(),
+		}
+	}
+	for i, op := range req.Ops {
+		if err := applyCanvasOp(doc, op); err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("ops[%d]: %v", i, err),
+			}
+		}
+	}
+	ev.Step("patch")
+
+	update.CanvasData = doc
+	project, err := updateProject(ctx, id, update, ev, saveOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	patch := &CanvasPatch{Revision: project.Revision, BaseRevision: base, UserID: userID, Ops: req.Ops}
+	if err := realtime.Publish(ctx, id, realtime.EventCanvasPatched, patch); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish canvas patch", "project_id", id, "error", err)
+	}
+	return &PatchCanvasResponse{
+		Revision:       project.Revision,
+		UpdatedAt:      project.UpdatedAt,
+		SizeBudget:     project.SizeBudget,
+		EmbeddedImages: project.EmbeddedImages,
+	}, nil
+}
+
+// applyCanvasOp applies op to doc in place. The result is validated when
+// it is saved.
+func applyCanvasOp(doc map[string]any, op CanvasOp) error {
+	if op.ElementID == "" {
+		return fmt.Errorf("elementId is required")
+	}
+	switch op.Op {
+	case CanvasOpAdd:
+		if op.Element == nil {
+			return fmt.Errorf("element is required")
+		}
+		if id, ok := op.Element["id"]; ok && id != op.ElementID {
+			return fmt.Errorf("element.id must match elementId")
+		}
+		if _, _, ok := findElement(doc, op.ElementID); ok {
+			return fmt.Errorf("element %q already exists", op.ElementID)
+		}
+		op.Element["id"] = op.ElementID
+		return insertElement(doc, op, op.Element)
+
+	case CanvasOpUpdate:
+		owner, i, ok := findElement(doc, op.ElementID)
+		if !ok {
+			return fmt.Errorf("element %q not found", op.ElementID)
+		}
+		el, _ := owner["objects"].([]any)[i].(map[string]any)
+		for key, value := range op.Props {
+			switch {
+			case key == "id" || key == "objects":
+				return fmt.Errorf("props.%s cannot be updated", key)
+			case value == nil:
+				delete(el, key)
+			default:
+				el[key] = value
+			}
+		}
+		return nil
+
+	case CanvasOpRemove:
+		if _, ok := removeElement(doc, op.ElementID); !ok {
+			return fmt.Errorf("element %q not found", op.ElementID)
+		}
+		return nil
+
+	case CanvasOpMove:
+		// The element leaves its list first, so moving a group into
+		// itself finds no parent.
+		el, ok := removeElement(doc, op.ElementID)
+		if !ok {
+			return fmt.Errorf("element %q not found", op.ElementID)
+		}
+		return insertElement(doc, op, el)
+
+	default:
+		return fmt.Errorf("op must be add, update, remove or move")
+	}
+}
+
+// findElement returns the page, group or document whose objects list holds
+// the element with id, and its index in the list.
+func findElement(doc map[string]any, id string) (map[string]any, int, bool) {
+	var search func(owner map[string]any) (map[string]any, int, bool)
+	search = func(owner map[string]any) (map[string]any, int, bool) {
+		list, _ := owner["objects"].([]any)
+		for i, raw := range list {
+			el, ok := raw.(map[string]any)
+			if !ok {
+				continue
+			}
+			if elID, _ := el["id"].(string); elID == id {
+				return owner, i, true
+			}
+			if found, j, ok := search(el); ok {
+				return found, j, true
+			}
+		}
+		return nil, 0, false
+	}
+	if owner, i, ok := search(doc); ok {
+		return owner, i, true
+	}
+	pages, _ := doc["pages"].([]any)
+	for _, raw := range pages {
+		if page, ok := raw.(map[string]any); ok {
+			if owner, i, ok := search(page); ok {
+				return owner, i, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+func removeElement(doc map[string]any, id string) (any, bool) {
+	owner, i, ok := findElement(doc, id)
+	if !ok {
+		return nil, false
+	}
+	list := owner["objects"].([]any)
+	el := list[i]
+	owner["objects"] = append(list[:i:i], list[i+1:]...)
+	return el, true
+}
+
+// insertElement puts el in the list op names, at op.Index.
+func insertElement(doc map[string]any, op CanvasOp, el any) error {
+	var owner map[string]any
+	switch {
+	case op.ParentID != "":
+		parent, i, ok := findElement(doc, op.ParentID)
+		if !ok {
+			return fmt.Errorf("parent %q not found", op.ParentID)
+		}
+		group, _ := parent["objects"].([]any)[i].(map[string]any)
+		if kind, _ := group["type"].(string); kind != "group" {
+			return fmt.Errorf("parent %q is not a group", op.ParentID)
+		}
+		owner = group
+	case op.PageID != "":
+		pages, _ := doc["pages"].([]any)
+		for _, raw := range pages {
+			if page, ok := raw.(map[string]any); ok && page["id"] == op.PageID {
+				owner = page
+				break
+			}
+		}
+		if owner == nil {
+			return fmt.Errorf("page %q not found", op.PageID)
+		}
+	default:
+		if pages, _ := doc["pages"].([]any); len(pages) > 0 {
+			return fmt.Errorf("pageId or parentId is required")
+		}
+		owner = doc
+	}
+
+	list, _ := owner["objects"].([]any)
+	i := len(list)
+	if op.Index != nil {
+		if *op.Index < 0 || *op.Index > len(list) {
+			return fmt.Errorf("index must be between 0 and %d", len(list))
+		}
+		i = *op.Index
+	}
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = el
+	owner["objects"] = list
+	return nil
+}
@@ -0,0 +1,66 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+)
+
+func init() {
+	permissions.RegisterResolver(permissions.TypeProject, projectRole)
+}
+
+// orgMemberRoles is the access organization members get to the
+// organization's projects they are not collaborators on. Org guests only
+// see projects they were added to.
+var orgMemberRoles = map[string]permissions.Role{
+	"admin":  permissions.RoleEditor,
+	"member": permissions.RoleViewer,
+}
+
+// projectRole resolves a user's role on a project from its collaborators,
+// the live share links they have opened (see share.go) and, for
+// organization projects, the user's role in the organization. Org
+// clients only get access to the projects in the client portal.
+// Projects whose owner has deactivated their account are read-only: other
+// collaborators keep access but no more than a viewer's. Projects in the
+// trash grant no access at all (see trash.go).
+func projectRole(ctx context.Context, projectID, userID string) (permissions.Role, error) {
+	var collabRole, orgRole string
+	var linkRoles []string
+	var ownerDeactivated, inPortal bool
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(c.role, ''), COALESCE(m.role, ''), u.deactivated_at IS NOT NULL,
+			EXISTS (SELECT 1 FROM portal_projects pp WHERE pp.project_id = p.id AND pp.org_id = p.org_id),
+			ARRAY(
+				SELECT l.role FROM project_share_link_grants g
+				JOIN project_share_links l ON l.id = g.link_id
+				WHERE l.project_id = p.id AND g.user_id = $2 AND `+liveShareLink+`
+			)
+		FROM projects p
+		JOIN users u ON u.id = p.owner_id
+		LEFT JOIN project_collaborators c ON c.project_id = p.id AND c.user_id = $2
+		LEFT JOIN organization_members m ON m.org_id = p.org_id AND m.user_id = $2
+		WHERE p.id = $1 AND p.deleted_at IS NULL
+	`, projectID, userID).Scan(&collabRole, &orgRole, &ownerDeactivated, &inPortal, &linkRoles)
+	if err == sql.ErrNoRows {
+		return permissions.RoleNone, nil
+	}
+	if err != nil {
+		return permissions.RoleNone, err
+	}
+
+	role := projectaccess.Stronger(permissions.Role(collabRole), orgMemberRoles[orgRole])
+	if orgRole == orgClientRole && inPortal {
+		role = projectaccess.Stronger(role, portalClientRole)
+	}
+	for _, lr := range linkRoles {
+		role = projectaccess.Stronger(role, permissions.Role(lr))
+	}
+	if ownerDeactivated && role != permissions.RoleOwner && role != permissions.RoleNone {
+		return permissions.RoleViewer, nil
+	}
+	return role, nil
+}
@@ -0,0 +1,326 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/realtime"
+	"canvasai/reqctx"
+	"canvasai/settings"
+)
+
+// An organization's clients are external members with the client role.
+// They see none of the organization's projects except those its admins
+// and members share to the client portal, where clients can comment and
+// approve or request changes, and which shows the organization's
+// white-label branding.
+
+const (
+	orgClientRole = "client"
+	// portalClientRole is the access clients get to portal projects
+	portalClientRole = permissions.RoleCommenter
+
+	maxApprovalNote = 2000
+)
+
+// Approval decisions
+const (
+	ApprovalApproved         = "approved"
+	ApprovalChangesRequested = "changes_requested"
+)
+
+// Approval is a decision on a project at one revision
+type Approval struct {
+	ID        string    `json:"id"`
+	ProjectID string    `json:"projectId"`
+	UserID    string    `json:"userId"`
+	UserName  string    `json:"userName"`
+	Revision  int       `json:"revision"`
+	Decision  string    `json:"decision"` // approved or changes_requested
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PortalProject is a project as the client portal shows it
+type PortalProject struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Thumbnail   string    `json:"thumbnail,omitempty"`
+	Revision    int       `json:"revision"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	SharedAt    time.Time `json:"sharedAt"`
+	// Approval is the latest decision; it is stale when its revision is
+	// not the current one
+	Approval     *Approval `json:"approval,omitempty"`
+	OpenComments int       `json:"openComments"`
+}
+
+// Portal is an organization's client portal
+type Portal struct {
+	OrgID    string            `json:"orgId"`
+	Name     string            `json:"name"`
+	Branding settings.Branding `json:"branding"`
+	Projects []PortalProject   `json:"projects"`
+}
+
+// GetPortal returns the client portal, newest shared project first.
+// Admins and members see it as clients do.
+//
+//encore:api auth method=GET path=/orgs/:orgID/portal
+func GetPortal(ctx context.Context, orgID string) (*Portal, error) {
+	if err := requireOrgMember(ctx, orgID, "admin", "member", orgClientRole); err != nil {
+		return nil, err
+	}
+	log := reqctx.Logger(ctx).With("org_id", orgID)
+
+	portal := &Portal{OrgID: orgID, Projects: []PortalProject{}}
+	if err := db.QueryRow(ctx, `SELECT name FROM organizations WHERE id = $1`, orgID).Scan(&portal.Name); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Organization not found",
+		}
+	}
+	branding, err := settings.GetOrgBranding(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	portal.Branding = *branding
+
+	rows, err := db.Query(ctx, `
+		SELECT p.id, p.title, p.description, p.thumbnail, p.version, p.updated_at, pp.added_at,
+			(SELECT COUNT(*) FROM project_comments c WHERE c.project_id = p.id AND c.parent_id IS NULL AND NOT c.is_resolved),
+			a.id, a.user_id, COALESCE(u.name, ''), a.revision, a.decision, a.note, a.created_at
+		FROM portal_projects pp
+		JOIN projects p ON p.id = pp.project_id AND p.org_id = pp.org_id
+		LEFT JOIN LATERAL (
+			SELECT * FROM project_approvals WHERE project_id = p.id ORDER BY created_at DESC LIMIT 1
+		) a ON TRUE
+		LEFT JOIN users u ON u.id = a.user_id
+		WHERE pp.org_id = $1 AND p.deleted_at IS NULL
+		ORDER BY pp.added_at DESC, p.id
+	`, orgID)
+	if err != nil {
+		log.Error("failed to list portal projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch portal",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p PortalProject
+		var description, thumbnail sql.NullString
+		var approvalID, approverID, decision, note sql.NullString
+		var approverName string
+		var revision sql.NullInt64
+		var decidedAt sql.NullTime
+		err := rows.Scan(&p.ID, &p.Title, &description, &thumbnail, &p.Revision, &p.UpdatedAt, &p.SharedAt,
+			&p.OpenComments, &approvalID, &approverID, &approverName, &revision, &decision, &note, &decidedAt)
+		if err != nil {
+			log.Error("failed to scan portal project", "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to fetch portal",
+			}
+		}
+		p.Description, p.Thumbnail = description.String, thumbnail.String
+		if approvalID.Valid {
+			p.Approval = &Approval{
+				ID:        approvalID.String,
+				ProjectID: p.ID,
+				UserID:    approverID.String,
+				UserName:  approverName,
+				Revision:  int(revision.Int64),
+				Decision:  decision.String,
+				Note:      note.String,
+				CreatedAt: decidedAt.Time,
+			}
+		}
+		portal.Projects = append(portal.Projects, p)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error("failed to list portal projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch portal",
+		}
+	}
+	return portal, nil
+}
+
+// SharePortalProject shares one of the organization's projects to its
+// client portal.
+//
+//encore:api auth method=PUT path=/orgs/:orgID/portal/projects/:projectID
+func SharePortalProject(ctx context.Context, orgID string, projectID string) error {
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		return err
+	}
+	if err := permissions.Authorize(ctx, permissions.Project(projectID), permissions.ProjectEdit); err != nil {
+		return err
+	}
+	var projectOrg string
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(org_id::text, '') FROM projects WHERE id = $1 AND deleted_at IS NULL
+	`, projectID).Scan(&projectOrg)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if projectOrg != orgID {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Only the organization's projects can be shared to its portal",
+		}
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO portal_projects (project_id, org_id, added_by) VALUES ($1, $2, $3)
+		ON CONFLICT (project_id) DO NOTHING
+	`, projectID, orgID, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to share project to portal", "org_id", orgID, "project_id", projectID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to share project",
+		}
+	}
+	projectaccess.Forget(projectID)
+	return nil
+}
+
+// UnsharePortalProject takes a project out of the client portal. Clients
+// lose access to it; their comments and approvals are kept.
+//
+//encore:api auth method=DELETE path=/orgs/:orgID/portal/projects/:projectID
+func UnsharePortalProject(ctx context.Context, orgID string, projectID string) error {
+	if err := requireOrgMember(ctx, orgID, "admin", "member"); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM portal_projects WHERE project_id::text = $1 AND org_id::text = $2
+	`, projectID, orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to unshare project from portal", "org_id", orgID, "project_id", projectID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to unshare project",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project is not in the portal",
+		}
+	}
+	projectaccess.Forget(projectID)
+	return nil
+}
+
+// RecordApprovalRequest represents an approval decision
+type RecordApprovalRequest struct {
+	Decision string `json:"decision"` // approved or changes_requested
+	Note     string `json:"note,omitempty"`
+}
+
+// RecordApproval approves the project's current revision or requests
+// changes to it. Anyone who can comment may decide, clients included.
+//
+//encore:api auth method=POST path=/projects/:id/approvals
+func RecordApproval(ctx context.Context, id string, req *RecordApprovalRequest) (*Approval, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectComment); err != nil {
+		return nil, err
+	}
+	switch req.Decision {
+	case ApprovalApproved, ApprovalChangesRequested:
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "decision must be approved or changes_requested",
+		}
+	}
+	note := strings.TrimSpace(req.Note)
+	if len([]rune(note)) > maxApprovalNote {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("Note must be at most %d characters", maxApprovalNote),
+		}
+	}
+
+	a := &Approval{ProjectID: id, UserID: auth.UserID(), Decision: req.Decision, Note: note}
+	err := db.QueryRow(ctx, `
+		INSERT INTO project_approvals (project_id, user_id, revision, decision, note)
+		SELECT id, $2, version, $3, $4 FROM projects WHERE id = $1
+		RETURNING id, revision, created_at,
+			(SELECT name FROM users WHERE id = $2)
+	`, id, a.UserID, a.Decision, a.Note).Scan(&a.ID, &a.Revision, &a.CreatedAt, &a.UserName)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record approval", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to record decision",
+		}
+	}
+	if err := realtime.Publish(ctx, id, realtime.EventProjectApproval, a); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish approval", "project_id", id, "error", err)
+	}
+	return a, nil
+}
+
+// ListApprovalsResponse represents a project's decisions, newest first
+type ListApprovalsResponse struct {
+	Approvals []Approval `json:"approvals"`
+}
+
+//encore:api auth method=GET path=/projects/:id/approvals
+func ListApprovals(ctx context.Context, id string) (*ListApprovalsResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, `
+		SELECT a.id, a.user_id, COALESCE(u.name, ''), a.revision, a.decision, a.note, a.created_at
+		FROM project_approvals a
+		LEFT JOIN users u ON u.id = a.user_id
+		WHERE a.project_id = $1
+		ORDER BY a.created_at DESC, a.id
+	`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list approvals", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch approvals",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListApprovalsResponse{Approvals: []Approval{}}
+	for rows.Next() {
+		a := Approval{ProjectID: id}
+		if err := rows.Scan(&a.ID, &a.UserID, &a.UserName, &a.Revision, &a.Decision, &a.Note, &a.CreatedAt); err != nil {
+			reqctx.Logger(ctx).Error("failed to scan approval", "project_id", id, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to fetch approvals",
+			}
+		}
+		resp.Approvals = append(resp.Approvals, a)
+	}
+	if err := rows.Err(); err != nil {
+		reqctx.Logger(ctx).Error("failed to list approvals", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch approvals",
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,197 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/canvasrefs"
+	"canvasai/permissions"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Every canvas save records which assets each page references (the
+// projects.asset_refs index), so the editor and viewer can ask for a page's
+// assets up front and prefetch them in the order they are painted, showing
+// BlurHash placeholders until they arrive.
+
+// PrefetchAsset is an asset a page needs
+type PrefetchAsset struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	MimeType string `json:"mimeType"`
+	FileSize int64  `json:"fileSize"`
+	Width    *int   `json:"width,omitempty"`
+	Height   *int   `json:"height,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+}
+
+// PrefetchManifest lists a page's assets in paint order
+type PrefetchManifest struct {
+	ProjectID string          `json:"projectId"`
+	PageID    string          `json:"pageId"`
+	Revision  int             `json:"revision"`
+	Assets    []PrefetchAsset `json:"assets"`
+	// TotalBytes is the combined size of the assets
+	TotalBytes int64 `json:"totalBytes"`
+}
+
+// assetIndex maps page IDs to the asset IDs they reference, in paint order
+type assetIndex map[string][]string
+
+// GetPrefetchManifest returns the assets a page references. Single-page
+// documents use the page ID "default".
+//
+//encore:api auth method=GET path=/projects/:id/pages/:pageID/prefetch
+func GetPrefetchManifest(ctx context.Context, id string, pageID string) (*PrefetchManifest, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+
+	index, revision, err := loadAssetIndex(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	assetIDs, ok := index[pageID]
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Page not found",
+		}
+	}
+
+	manifest := &PrefetchManifest{ProjectID: id, PageID: pageID, Revision: revision, Assets: []PrefetchAsset{}}
+	if len(assetIDs) == 0 {
+		return manifest, nil
+	}
+
+	// Only describe assets the project's viewers can load; anything else in
+	// the document will fail to render for them anyway.
+	rows, err := db.Query(ctx, `
+		SELECT id, mime_type, file_size, width, height, COALESCE(blurhash, '')
+		FROM assets
+		WHERE id::text = ANY($1) AND (project_id = $2 OR COALESCE(is_public, FALSE))
+	`, assetIDs, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load prefetch assets", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to build prefetch manifest",
+		}
+	}
+	defer rows.Close()
+
+	found := map[string]PrefetchAsset{}
+	for rows.Next() {
+		var a PrefetchAsset
+		if err := rows.Scan(&a.ID, &a.MimeType, &a.FileSize, &a.Width, &a.Height, &a.Blurhash); err != nil {
+			continue
+		}
+		a.URL = canvasrefs.AssetURL(a.ID)
+		found[a.ID] = a
+	}
+	for _, assetID := range assetIDs {
+		if a, ok := found[assetID]; ok {
+			manifest.Assets = append(manifest.Assets, a)
+			manifest.TotalBytes += a.FileSize
+		}
+	}
+	return manifest, nil
+}
+
+// loadAssetIndex returns a project's asset index and revision, building and
+// storing the index for projects last saved before it existed.
+func loadAssetIndex(ctx context.Context, projectID string) (assetIndex, int, error) {
+	var raw []byte
+	var revision int
+	err := db.QueryRow(ctx, `SELECT asset_refs, version FROM projects WHERE id = $1`, projectID).Scan(&raw, &revision)
+	if err == sql.ErrNoRows {
+		return nil, 0, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load asset index", "project_id", projectID, "error", err)
+		return nil, 0, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to build prefetch manifest",
+		}
+	}
+	if raw != nil {
+		var index assetIndex
+		if err := json.Unmarshal(raw, &index); err == nil {
+			return index, revision, nil
+		}
+	}
+
+	var canvasData []byte
+	if err := db.QueryRow(ctx, `SELECT canvas_data FROM projects WHERE id = $1`, projectID).Scan(&canvasData); err != nil {
+		reqctx.Logger(ctx).Error("failed to load canvas data", "project_id", projectID, "error", err)
+		return nil, 0, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to build prefetch manifest",
+		}
+	}
+	index, indexJSON, err := buildAssetIndex(canvasData)
+	if err != nil {
+		return nil, 0, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas data is invalid",
+		}
+	}
+	// Only store it if no save raced in with a newer document.
+	if _, err := db.Exec(ctx, `UPDATE projects SET asset_refs = $2 WHERE id = $1 AND version = $3`, projectID, indexJSON, revision); err != nil {
+		reqctx.Logger(ctx).Warn("failed to store asset index", "project_id", projectID, "error", err)
+	}
+	return index, revision, nil
+}
+
+// buildAssetIndex collects the asset references of every page of a canvas
+// document, in paint order and without duplicates. It returns the index
+// and its JSON encoding for storage.
+func buildAssetIndex(canvasData []byte) (assetIndex, []byte, error) {
+	index := assetIndex{}
+	if len(canvasData) > 0 {
+		var doc struct {
+			Pages []struct {
+				ID      string `json:"id"`
+				Objects any    `json:"objects"`
+			} `json:"pages"`
+			Objects any `json:"objects"`
+		}
+		if err := json.Unmarshal(canvasData, &doc); err != nil {
+			return nil, nil, err
+		}
+		if len(doc.Pages) == 0 {
+			index[render.DefaultPageID] = pageAssetIDs(doc.Objects)
+		}
+		for _, page := range doc.Pages {
+			index[page.ID] = pageAssetIDs(page.Objects)
+		}
+	} else {
+		index[render.DefaultPageID] = []string{}
+	}
+
+	raw, err := json.Marshal(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return index, raw, nil
+}
+
+func pageAssetIDs(objects any) []string {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, ref := range canvasrefs.Find(objects) {
+		if ref.Kind == canvasrefs.KindComponent || ref.ID == "" || seen[ref.ID] {
+			continue
+		}
+		seen[ref.ID] = true
+		ids = append(ids, ref.ID)
+	}
+	return ids
+}
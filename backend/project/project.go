@@ -2,12 +2,24 @@ package project
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
 	"github.com/google/uuid"
+
+	"canvasai/faults"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/realtime"
+	"canvasai/reqctx"
+	"canvasai/settings"
+	"canvasai/sqlutil"
+	"canvasai/wideevent"
 )
 
 // Project represents a design project
@@ -18,13 +30,44 @@ type Project struct {
 	OwnerID       string         `json:"ownerId"`
 	Description   string         `json:"description,omitempty"`
 	Thumbnail     string         `json:"thumbnail,omitempty"`
+	Tags          []string       `json:"tags"`
 	CanvasData    any            `json:"canvasData,omitempty"`
 	CanvasWidth   int            `json:"canvasWidth"`
 	CanvasHeight  int            `json:"canvasHeight"`
 	IsPublic      bool           `json:"isPublic"`
+	Revision      int            `json:"revision"`
 	CreatedAt     time.Time      `json:"createdAt"`
 	UpdatedAt     time.Time      `json:"updatedAt"`
 	Collaborators []Collaborator `json:"collaborators"`
+
+	// OrgID is set for projects created in an organization, which start
+	// with the organization's project defaults (see orgdefaults.go)
+	OrgID             *string `json:"orgId,omitempty"`
+	ColorProfile      string  `json:"colorProfile"`
+	AutosaveInterval  *int    `json:"autosaveInterval,omitempty"`
+	ShareLinksEnabled bool    `json:"shareLinksEnabled"`
+
+	// ForkedFrom is the public project this project was forked from, while
+	// it still exists
+	ForkedFrom *string `json:"forkedFrom,omitempty"`
+
+	// FolderID is the owner's folder the project is filed in (see
+	// folders.go); it is only shown to the owner
+	FolderID *string `json:"folderId,omitempty"`
+
+	// Starred is whether the caller starred the project (see stars.go);
+	// StarCount is only shown for public projects
+	Starred   bool `json:"starred"`
+	StarCount int  `json:"starCount,omitempty"`
+
+	// CustomFields are the values of the organization's custom project
+	// fields, by key (see fields.go)
+	CustomFields map[string]any `json:"customFields,omitempty"`
+
+	// SizeBudget and EmbeddedImages are returned by saves that change the
+	// canvas data
+	SizeBudget     *SizeBudget       `json:"sizeBudget,omitempty"`
+	EmbeddedImages *ExtractionReport `json:"embeddedImages,omitempty"`
 }
 
 // Collaborator represents a project collaborator
@@ -39,6 +82,13 @@ type CreateProjectRequest struct {
 	Title          string `json:"title"`
 	Description    string `json:"description,omitempty"`
 	TemplatePrompt string `json:"templatePrompt,omitempty"`
+	// OrgID creates the project in an organization the caller belongs to
+	OrgID string `json:"orgId,omitempty"`
+	// Slug is a custom URL slug; by default one is derived from the title
+	Slug string `json:"slug,omitempty"`
+	// NameFields fill the organization's naming template when Title is
+	// empty, e.g. {"client": "acme", "campaign": "spring"}
+	NameFields map[string]string `json:"nameFields,omitempty"`
 }
 
 // UpdateProjectRequest represents the update project request
@@ -49,12 +99,105 @@ type UpdateProjectRequest struct {
 	CanvasData   interface{} `json:"canvasData,omitempty"`
 	CanvasWidth  *int        `json:"canvasWidth,omitempty"`
 	CanvasHeight *int        `json:"canvasHeight,omitempty"`
+	// ColorProfile is the working color space: srgb, display-p3 or cmyk.
+	// Colors keep their values; exports are rendered and tagged in the new
+	// space.
+	ColorProfile *string `json:"colorProfile,omitempty"`
+	// Tags replaces the project's tags when set
+	Tags *[]string `json:"tags,omitempty"`
+	// BaseRevision is the revision the client's changes are based on, also
+	// accepted as an If-Match header. One of them is required: the update
+	// is rejected if another save landed in the meantime.
+	BaseRevision *int   `json:"baseRevision,omitempty"`
+	IfMatch      string `header:"If-Match"`
+}
+
+// SaveConflict describes an update rejected because the project moved on
+type SaveConflict struct {
+	ProjectID string       `json:"projectId"`
+	Attempted RevisionInfo `json:"attempted"`
+	Current   RevisionInfo `json:"current"`
+}
+
+// RevisionInfo identifies who produced a revision and when
+type RevisionInfo struct {
+	Revision int       `json:"revision"`
+	UserID   string    `json:"userId,omitempty"`
+	SavedAt  time.Time `json:"savedAt"`
+}
+
+// Project list contexts
+const (
+	ContextPersonal = "personal"
+	ContextOrg      = "org"
+)
+
+// Project list filters
+const (
+	FilterOwned   = "owned"   // projects the user owns
+	FilterShared  = "shared"  // projects owned by someone else
+	FilterPublic  = "public"  // projects anyone with the link can view
+	FilterStarred = "starred" // projects the user starred
+)
+
+// Project list sort keys
+const (
+	SortUpdatedAt = "updatedAt"
+	SortCreatedAt = "createdAt"
+	SortTitle     = "title"
+	SortStars     = "stars"
+)
+
+// projectSortColumns maps sort keys to columns and their default order
+var projectSortColumns = map[string]struct{ column, order string }{
+	SortUpdatedAt: {"p.updated_at", "desc"},
+	SortCreatedAt: {"p.created_at", "desc"},
+	SortTitle:     {"lower(p.title)", "asc"},
+	SortStars:     {"p.star_count", "desc"},
 }
 
-// ListProjectsResponse represents the list projects response
+const (
+	defaultProjectPageSize = 50
+	maxProjectPageSize     = 200
+	maxProjectTags         = 20
+	maxProjectTagLength    = 50
+)
+
+// ListProjectsRequest filters the project list
+type ListProjectsRequest struct {
+	// Context is "personal" for projects outside any organization, "org"
+	// for one organization's projects, or empty for both
+	Context string `query:"context"`
+	OrgID   string `query:"orgId"`
+	// Filter narrows the list to owned, shared, public or starred
+	// projects. Starred public projects are listed even if the user does
+	// not collaborate on them.
+	Filter string `query:"filter"`
+	// Query matches a substring of the title, ignoring case
+	Query        string    `query:"q"`
+	Tag          string    `query:"tag"`
+	UpdatedSince time.Time `query:"updatedSince"`
+	// FolderID lists one of the user's folders, or with "root" the
+	// projects outside them
+	FolderID string `query:"folderId"`
+	// Fields filter by custom field values, given as key:value; they
+	// need orgId
+	Fields []string `query:"field"`
+	// Sort is updatedAt (default), createdAt, title or stars; Order is asc
+	// or desc and defaults to newest first, A to Z for titles, or most
+	// starred first
+	Sort   string `query:"sort"`
+	Order  string `query:"order"`
+	Limit  int    `query:"limit"`
+	Offset int    `query:"offset"`
+}
+
+// ListProjectsResponse represents a page of the project list
 type ListProjectsResponse struct {
 	Projects []Project `json:"projects"`
-	Total    int       `json:"total"`
+	Total    int       `json:"total"` // matching projects across all pages
+	Limit    int       `json:"limit"`
+	Offset   int       `json:"offset"`
 }
 
 var db = sqldb.NewDatabase("project", sqldb.DatabaseConfig{
@@ -65,76 +208,253 @@ var db = sqldb.NewDatabase("project", sqldb.DatabaseConfig{
 func CreateProject(ctx context.Context, req *CreateProjectRequest) (*Project, error) {
 	userID := auth.UserID()
 	
-	if req.Title == "" {
+	// Organization projects may be titled by the organization's naming
+	// template instead.
+	if req.Title == "" && req.OrgID == "" {
 		return nil, &errs.Error{
 			Code:    errs.InvalidArgument,
 			Message: "Title is required",
 		}
 	}
+	if err := checkGuestProjectLimit(ctx, userID); err != nil {
+		return nil, err
+	}
+	if err := checkProjectQuota(ctx, userID); err != nil {
+		return nil, err
+	}
 
-	projectID := uuid.New().String()
-	slug := generateSlug(req.Title)
 	now := time.Now()
+	project := &Project{
+		ID:                uuid.New().String(),
+		Title:             req.Title,
+		OwnerID:           userID,
+		Description:       req.Description,
+		CanvasWidth:       800,
+		CanvasHeight:      600,
+		IsPublic:          false,
+		Revision:          1,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		ColorProfile:      "srgb",
+		ShareLinksEnabled: true,
+	}
+	if req.OrgID != "" {
+		if err := applyOrgDefaults(ctx, project, req.OrgID, req.NameFields); err != nil {
+			return nil, err
+		}
+	}
+	if project.Title == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Title is required",
+		}
+	}
+	if err := assignSlug(ctx, project, req.Slug); err != nil {
+		return nil, err
+	}
+
+	if err := insertProject(ctx, project, nil); err != nil {
+		return nil, err
+	}
+
+	return project, nil
+}
+
+// insertProject creates the project row and adds its owner as a
+// collaborator in a single transaction.
+func insertProject(ctx context.Context, project *Project, canvasData []byte) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create project",
+		}
+	}
+	defer tx.Rollback()
 
 	// Create project
-	_, err := db.Exec(ctx, `
-		INSERT INTO projects (id, title, slug, owner_id, description, is_public, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	`, projectID, req.Title, slug, userID, req.Description, false, now, now)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO projects (id, title, slug, owner_id, description, is_public, canvas_data, canvas_width, canvas_height, created_at, updated_at,
+			org_id, color_profile, autosave_interval, share_links_enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+	`, project.ID, project.Title, project.Slug, project.OwnerID, project.Description, project.IsPublic, canvasData, project.CanvasWidth, project.CanvasHeight, project.CreatedAt, project.UpdatedAt,
+		project.OrgID, project.ColorProfile, project.AutosaveInterval, project.ShareLinksEnabled)
 	if err != nil {
-		return nil, &errs.Error{
+		reqctx.Logger(ctx).Error("failed to create project", "error", err)
+		return &errs.Error{
 			Code:    errs.Internal,
 			Message: "Failed to create project",
 		}
 	}
 
 	// Add owner as collaborator
-	_, err = db.Exec(ctx, `
+	_, err = tx.Exec(ctx, `
 		INSERT INTO project_collaborators (project_id, user_id, role, invited_by)
 		VALUES ($1, $2, $3, $4)
-	`, projectID, userID, "owner", userID)
+	`, project.ID, project.OwnerID, "owner", project.OwnerID)
 	if err != nil {
-		return nil, &errs.Error{
+		return &errs.Error{
 			Code:    errs.Internal,
 			Message: "Failed to add owner as collaborator",
 		}
 	}
 
-	project := &Project{
-		ID:           projectID,
-		Title:        req.Title,
-		Slug:         slug,
-		OwnerID:      userID,
-		Description:  req.Description,
-		CanvasWidth:  800,
-		CanvasHeight: 600,
-		IsPublic:     false,
-		CreatedAt:    now,
-		UpdatedAt:    now,
-		Collaborators: []Collaborator{
-			{
-				UserID:  userID,
-				Role:    "owner",
-				AddedAt: now,
-			},
-		},
+	if err := tx.Commit(); err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create project",
+		}
 	}
 
-	return project, nil
+	project.Collaborators = []Collaborator{
+		{
+			UserID:  project.OwnerID,
+			Role:    "owner",
+			AddedAt: project.CreatedAt,
+		},
+	}
+	return nil
 }
 
 //encore:api auth method=GET path=/projects
-func ListProjects(ctx context.Context) (*ListProjectsResponse, error) {
+func ListProjects(ctx context.Context, req *ListProjectsRequest) (*ListProjectsResponse, error) {
 	userID := auth.UserID()
 
-	rows, err := db.Query(ctx, `
-		SELECT p.id, p.title, p.slug, p.owner_id, p.description, p.thumbnail, p.is_public, p.created_at, p.updated_at
+	scope := req.Context
+	if scope == "" && req.OrgID != "" {
+		scope = ContextOrg
+	}
+	var filter string
+	args := []any{userID}
+	switch scope {
+	case "":
+		// Everything the user collaborates on, personal or not
+		filter = `(c.user_id IS NOT NULL)`
+		if req.Filter == FilterStarred {
+			filter = `(c.user_id IS NOT NULL OR p.is_public)`
+		}
+	case ContextPersonal:
+		filter = `(c.user_id IS NOT NULL AND p.org_id IS NULL)`
+	case ContextOrg:
+		if req.OrgID == "" {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "orgId is required for the org context",
+			}
+		}
+		// The organization's projects the user collaborates on or can see
+		// through their membership (see projectRole)
+		filter = `(p.org_id::text = $2 AND (c.user_id IS NOT NULL OR m.role IN ('admin', 'member')))`
+		args = append(args, req.OrgID)
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "context must be personal or org",
+		}
+	}
+
+	filter += ` AND p.deleted_at IS NULL`
+
+	switch req.Filter {
+	case "":
+	case FilterOwned:
+		filter += ` AND p.owner_id = $1`
+	case FilterShared:
+		filter += ` AND p.owner_id <> $1`
+	case FilterPublic:
+		filter += ` AND p.is_public`
+	case FilterStarred:
+		filter += ` AND s.user_id IS NOT NULL`
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "filter must be owned, shared, public or starred",
+		}
+	}
+	if q := strings.TrimSpace(req.Query); q != "" {
+		args = append(args, "%"+sqlutil.EscapeLike(strings.ToLower(q))+"%")
+		filter += fmt.Sprintf(` AND lower(p.title) LIKE $%d`, len(args))
+	}
+	if req.Tag != "" {
+		args = append(args, strings.ToLower(strings.TrimSpace(req.Tag)))
+		filter += fmt.Sprintf(` AND $%d = ANY(p.tags)`, len(args))
+	}
+	if !req.UpdatedSince.IsZero() {
+		args = append(args, req.UpdatedSince)
+		filter += fmt.Sprintf(` AND p.updated_at >= $%d`, len(args))
+	}
+	switch req.FolderID {
+	case "":
+	case FolderRoot:
+		// Projects shared with the user are in their owner's folders.
+		filter += ` AND (p.folder_id IS NULL OR p.owner_id <> $1)`
+	default:
+		args = append(args, req.FolderID)
+		filter += fmt.Sprintf(` AND p.folder_id::text = $%d AND p.owner_id = $1`, len(args))
+	}
+	contains, err := fieldFilter(ctx, req.OrgID, req.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if contains != nil {
+		args = append(args, contains)
+		filter += fmt.Sprintf(` AND p.custom_fields @> $%d::jsonb`, len(args))
+	}
+
+	sortKey := req.Sort
+	if sortKey == "" {
+		sortKey = SortUpdatedAt
+	}
+	sort, ok := projectSortColumns[sortKey]
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "sort must be updatedAt, createdAt, title or stars",
+		}
+	}
+	order := sort.order
+	switch strings.ToLower(req.Order) {
+	case "":
+	case "asc", "desc":
+		order = strings.ToLower(req.Order)
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "order must be asc or desc",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxProjectPageSize {
+		limit = defaultProjectPageSize
+	}
+	offset := max(req.Offset, 0)
+
+	const from = `
 		FROM projects p
-		JOIN project_collaborators c ON p.id = c.project_id
-		WHERE c.user_id = $1
-		ORDER BY p.updated_at DESC
-	`, userID)
+		LEFT JOIN project_collaborators c ON p.id = c.project_id AND c.user_id = $1
+		LEFT JOIN organization_members m ON m.org_id = p.org_id AND m.user_id = $1
+		LEFT JOIN project_stars s ON s.project_id = p.id AND s.user_id = $1
+		WHERE `
+	resp := &ListProjectsResponse{Projects: []Project{}, Limit: limit, Offset: offset}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*)`+from+filter, args...).Scan(&resp.Total); err != nil {
+		reqctx.Logger(ctx).Error("failed to count projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch projects",
+		}
+	}
+
+	// p.id breaks ties so pages neither overlap nor skip projects.
+	rows, err := db.Query(ctx, `
+		SELECT p.id, p.title, p.slug, p.owner_id, p.description, p.thumbnail, p.tags, p.is_public, p.created_at, p.updated_at, p.org_id,
+			CASE WHEN p.owner_id = $1 THEN p.folder_id END, s.user_id IS NOT NULL, p.star_count, p.custom_fields`+
+		from+filter+fmt.Sprintf(`
+		ORDER BY %s %s, p.id %s
+		LIMIT $%d OFFSET $%d
+	`, sort.column, order, order, len(args)+1, len(args)+2), append(args, limit, offset)...)
 	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list projects", "error", err)
 		return nil, &errs.Error{
 			Code:    errs.Internal,
 			Message: "Failed to fetch projects",
@@ -142,57 +462,57 @@ func ListProjects(ctx context.Context) (*ListProjectsResponse, error) {
 	}
 	defer rows.Close()
 
-	var projects []Project
 	for rows.Next() {
 		var p Project
-		err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.OwnerID, &p.Description, &p.Thumbnail, &p.IsPublic, &p.CreatedAt, &p.UpdatedAt)
+		var stars int
+		err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.OwnerID, &p.Description, &p.Thumbnail, &p.Tags, &p.IsPublic, &p.CreatedAt, &p.UpdatedAt, &p.OrgID, &p.FolderID,
+			&p.Starred, &stars, &p.CustomFields)
 		if err != nil {
 			continue
 		}
-		projects = append(projects, p)
+		if p.IsPublic {
+			p.StarCount = stars
+		}
+		resp.Projects = append(resp.Projects, p)
 	}
-
-	return &ListProjectsResponse{
-		Projects: projects,
-		Total:    len(projects),
-	}, nil
+	return resp, nil
 }
 
 //encore:api auth method=GET path=/projects/:id
 func GetProject(ctx context.Context, id string) (*Project, error) {
-	userID := auth.UserID()
-
 	// Check if user has access to this project
-	var hasAccess bool
-	err := db.QueryRow(ctx, `
-		SELECT EXISTS(
-			SELECT 1 FROM project_collaborators
-			WHERE project_id = $1 AND user_id = $2
-		)
-	`, id, userID).Scan(&hasAccess)
-	if err != nil || !hasAccess {
-		return nil, &errs.Error{
-			Code:    errs.PermissionDenied,
-			Message: "Access denied to this project",
-		}
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
 	}
 
 	var project Project
-	err = db.QueryRow(ctx, `
-		SELECT id, title, slug, owner_id, description, thumbnail, canvas_data, canvas_width, canvas_height, is_public, created_at, updated_at
+	var stars int
+	err := db.QueryRow(ctx, `
+		SELECT id, title, slug, owner_id, description, thumbnail, canvas_data, canvas_width, canvas_height, is_public, version, created_at, updated_at,
+			org_id, color_profile, autosave_interval, share_links_enabled, tags, forked_from,
+			CASE WHEN owner_id::text = $2 THEN folder_id END,
+			EXISTS (SELECT 1 FROM project_stars WHERE project_id = projects.id AND user_id::text = $2), star_count, custom_fields
 		FROM projects WHERE id = $1
-	`, id).Scan(&project.ID, &project.Title, &project.Slug, &project.OwnerID, &project.Description, &project.Thumbnail, &project.CanvasData, &project.CanvasWidth, &project.CanvasHeight, &project.IsPublic, &project.CreatedAt, &project.UpdatedAt)
+	`, id, auth.UserID()).Scan(&project.ID, &project.Title, &project.Slug, &project.OwnerID, &project.Description, &project.Thumbnail, &project.CanvasData, &project.CanvasWidth, &project.CanvasHeight, &project.IsPublic, &project.Revision, &project.CreatedAt, &project.UpdatedAt,
+		&project.OrgID, &project.ColorProfile, &project.AutosaveInterval, &project.ShareLinksEnabled, &project.Tags, &project.ForkedFrom, &project.FolderID,
+		&project.Starred, &stars, &project.CustomFields)
 	if err != nil {
 		return nil, &errs.Error{
 			Code:    errs.NotFound,
 			Message: "Project not found",
 		}
 	}
+	if project.IsPublic {
+		project.StarCount = stars
+	}
+	project.CanvasData = upgradeCanvasValue(project.CanvasData)
 
-	// Get collaborators
+	// Get collaborators, leaving out deactivated accounts
 	rows, err := db.Query(ctx, `
-		SELECT user_id, role, invited_at
-		FROM project_collaborators WHERE project_id = $1
+		SELECT c.user_id, c.role, c.invited_at
+		FROM project_collaborators c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.project_id = $1 AND u.deactivated_at IS NULL
 	`, id)
 	if err == nil {
 		defer rows.Close()
@@ -210,23 +530,140 @@ func GetProject(ctx context.Context, id string) (*Project, error) {
 
 //encore:api auth method=PUT path=/projects/:id
 func UpdateProject(ctx context.Context, id string, req *UpdateProjectRequest) (*Project, error) {
+	ev := wideevent.Start(wideevent.KindSave)
+	ev.Set("project_id", id)
+	ev.Set("user_id", auth.UserID())
+	project, err := updateProject(ctx, id, req, ev, saveOptions{})
+	ev.Finish(ctx, err)
+	return project, err
+}
+
+// saveOptions adjust updateProject for autosaves (see autosave.go)
+type saveOptions struct {
+	// autosave skips the version snapshot and starts or continues a burst
+	autosave bool
+	// coalesce defers announcing the save until the burst ends
+	coalesce bool
+}
+
+// updateProject saves a project, timing each stage of the save in ev.
+func updateProject(ctx context.Context, id string, req *UpdateProjectRequest, ev *wideevent.Event, opts saveOptions) (*Project, error) {
 	userID := auth.UserID()
 
-	// Check if user is owner or editor
-	var role string
-	err := db.QueryRow(ctx, `
-		SELECT role FROM project_collaborators
-		WHERE project_id = $1 AND user_id = $2
-	`, id, userID).Scan(&role)
-	if err != nil || (role != "owner" && role != "editor") {
+	// Check if user can edit
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	if err := resolveBaseRevision(req); err != nil {
+		return nil, err
+	}
+	if req.IsPublic != nil {
+		// Publishing a project, or taking it down, is sharing it.
+		if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+			return nil, err
+		}
+		if *req.IsPublic {
+			if err := denyGuest(ctx, userID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if p := req.ColorProfile; p != nil {
+		switch *p {
+		case settings.ColorProfileSRGB, settings.ColorProfileDisplayP3, settings.ColorProfileCMYK:
+		default:
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Color profile must be srgb, display-p3 or cmyk",
+			}
+		}
+	}
+
+	var tags any
+	if req.Tags != nil {
+		normalized, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return nil, err
+		}
+		tags = normalized
+	}
+	ev.Step("validation")
+
+	var budget *SizeBudget
+	var extracted *ExtractionReport
+	var assetRefs []byte
+	committed := false
+	if req.CanvasData != nil {
+		// Embedded images are stored before the save is checked, since
+		// extracting them changes its size; a stale base revision is caught
+		// first, and the images are removed again if the save fails.
+		if err := checkBaseRevision(ctx, id, req.BaseRevision, userID); err != nil {
+			return nil, err
+		}
+		extracted = extractEmbeddedImages(ctx, id, userID, req.CanvasData)
+		defer func() {
+			if !committed {
+				discardExtractedImages(ctx, id, extracted)
+			}
+		}()
+		linked, err := applyAssetLinks(ctx, id, req.CanvasData)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to apply asset links", "project_id", id, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to update project",
+			}
+		}
+		req.CanvasData = linked
+		raw, err := json.Marshal(req.CanvasData)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Invalid canvas data",
+			}
+		}
+		ev.Set("canvas_bytes", len(raw))
+		if budget, err = checkProjectBudget(ctx, id, len(raw)); err != nil {
+			return nil, err
+		}
+		if raw, err = normalizeCanvasDocument(raw); err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Invalid canvas data: " + err.Error(),
+			}
+		}
+		if err := checkPageQuota(budget.Plan, raw); err != nil {
+			return nil, err
+		}
+		req.CanvasData = json.RawMessage(raw)
+		if !opts.autosave {
+			if err := snapshotBeforeSave(ctx, id, req.BaseRevision, raw); err != nil {
+				reqctx.Logger(ctx).Warn("failed to snapshot project", "project_id", id, "error", err)
+			}
+		}
+		if _, assetRefs, err = buildAssetIndex(raw); err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Invalid canvas data",
+			}
+		}
+		ev.Step("canvas_processing")
+	}
+
+	if err := faults.Inject(ctx, faults.DB); err != nil {
+		reqctx.Logger(ctx).Error("failed to update project", "project_id", id, "error", err)
 		return nil, &errs.Error{
-			Code:    errs.PermissionDenied,
-			Message: "Insufficient permissions to update project",
+			Code:    errs.Internal,
+			Message: "Failed to update project",
 		}
 	}
 
-	// Update project
-	_, err = db.Exec(ctx, `
+	// Update project, bumping the revision only if it still matches the
+	// client's base revision (when one was supplied). Any other save ends
+	// an autosave burst.
+	now := time.Now()
+	result, err := db.Exec(ctx, `
 		UPDATE projects
 		SET title = COALESCE(NULLIF($2, ''), title),
 			description = COALESCE(NULLIF($3, ''), description),
@@ -234,59 +671,112 @@ func UpdateProject(ctx context.Context, id string, req *UpdateProjectRequest) (*
 			canvas_data = COALESCE($5, canvas_data),
 			canvas_width = COALESCE($6, canvas_width),
 			canvas_height = COALESCE($7, canvas_height),
-			updated_at = $8
-		WHERE id = $1
-	`, id, req.Title, req.Description, req.IsPublic, req.CanvasData, req.CanvasWidth, req.CanvasHeight, time.Now())
+			updated_at = $8,
+			version = version + 1,
+			last_saved_by = $9,
+			asset_refs = COALESCE($11, asset_refs),
+			color_profile = COALESCE($12, color_profile),
+			tags = COALESCE($13, tags),
+			autosaved_at = CASE WHEN $14 THEN $8 END,
+			autosave_pending = $15
+		WHERE id = $1 AND ($10::int IS NULL OR version = $10)
+	`, id, req.Title, req.Description, req.IsPublic, req.CanvasData, req.CanvasWidth, req.CanvasHeight, now, userID, req.BaseRevision, assetRefs, req.ColorProfile, tags,
+		opts.autosave, opts.coalesce)
+	ev.Step("db_write")
+	if err == nil && req.BaseRevision != nil && result.RowsAffected() == 0 {
+		return nil, saveConflict(ctx, id, RevisionInfo{Revision: *req.BaseRevision, UserID: userID, SavedAt: now})
+	}
 	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update project", "project_id", id, "error", err)
 		return nil, &errs.Error{
 			Code:    errs.Internal,
 			Message: "Failed to update project",
 		}
 	}
+	committed = true
 
-	return GetProject(ctx, id)
+	reqctx.Logger(ctx).Info("project updated", "project_id", id)
+	project, err := GetProject(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ev.Step("reload")
+	ev.Set("revision", project.Revision)
+	project.SizeBudget = budget
+	project.EmbeddedImages = extracted
+	if req.CanvasData != nil || req.CanvasWidth != nil || req.CanvasHeight != nil {
+		if !opts.coalesce {
+			announceCanvasSave(ctx, id, project.Revision)
+		}
+		recordEditSession(ctx, id, userID)
+	}
+	return project, nil
 }
 
+// DeleteProject moves a project to the trash. Its owner can restore it
+// until it is purged (see trash.go).
+//
 //encore:api auth method=DELETE path=/projects/:id
 func DeleteProject(ctx context.Context, id string) error {
-	userID := auth.UserID()
-
-	// Check if user is owner
-	var ownerID string
+	var exists bool
 	err := db.QueryRow(ctx, `
-		SELECT owner_id FROM projects WHERE id = $1
-	`, id).Scan(&ownerID)
-	if err != nil {
+		SELECT EXISTS(SELECT 1 FROM projects WHERE id = $1 AND deleted_at IS NULL)
+	`, id).Scan(&exists)
+	if err != nil || !exists {
 		return &errs.Error{
 			Code:    errs.NotFound,
 			Message: "Project not found",
 		}
 	}
 
-	if ownerID != userID {
-		return &errs.Error{
-			Code:    errs.PermissionDenied,
-			Message: "Only project owner can delete the project",
-		}
+	// Check if user is owner
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectDelete); err != nil {
+		return err
 	}
 
-	// Delete project (cascading deletes will handle collaborators)
-	_, err = db.Exec(ctx, "DELETE FROM projects WHERE id = $1", id)
+	userID := auth.UserID()
+	_, err = db.Exec(ctx, `
+		UPDATE projects SET deleted_at = NOW(), deleted_by = $2 WHERE id = $1 AND deleted_at IS NULL
+	`, id, userID)
 	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete project", "project_id", id, "error", err)
 		return &errs.Error{
 			Code:    errs.Internal,
 			Message: "Failed to delete project",
 		}
 	}
+	projectaccess.Forget(id)
+	if err := realtime.Publish(ctx, id, realtime.EventProjectTrashed, map[string]any{"deletedBy": userID}); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish project deletion", "project_id", id, "error", err)
+	}
 
 	return nil
 }
 
-func generateSlug(title string) string {
-	// Simple slug generation - in production, use a more robust solution
-	slug := title
-	if len(slug) > 50 {
-		slug = slug[:50]
+// normalizeTags lowercases, trims and de-duplicates tags so they filter
+// case-insensitively.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxProjectTagLength {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("Tags must be at most %d characters", maxProjectTagLength),
+			}
+		}
+		seen[t] = true
+		normalized = append(normalized, t)
+	}
+	if len(normalized) > maxProjectTags {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("A project can have at most %d tags", maxProjectTags),
+		}
 	}
-	return slug + "-" + uuid.New().String()[:8]
+	return normalized, nil
 }
@@ -0,0 +1,237 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+
+	"canvasai/reqctx"
+)
+
+// Each plan limits how many projects a user may own and how many pages a
+// project may have, alongside the canvas size budgets in budget.go. A
+// request that would go over a limit fails with ResourceExhausted, naming
+// the plan that would allow it. Projects in the trash do not count, but
+// restoring one is checked like creating it.
+
+// PlanQuota limits what a user on one plan may hold. Zero uses the default.
+type PlanQuota struct {
+	MaxProjects int `json:"maxProjects"`
+	MaxPages    int `json:"maxPages"`
+}
+
+// ProjectQuotas holds the quota of each plan
+type ProjectQuotas struct {
+	Free PlanQuota `json:"free"`
+	Pro  PlanQuota `json:"pro"`
+	Team PlanQuota `json:"team"`
+}
+
+var quotaCfg struct {
+	ProjectQuotas ProjectQuotas
+}
+
+var _ = config.Load(context.Background(), &quotaCfg)
+
+const (
+	defaultFreeMaxProjects = 25
+	defaultProMaxProjects  = 500
+	defaultTeamMaxProjects = 5000
+
+	defaultFreeMaxPages = 10
+	defaultProMaxPages  = 100
+	defaultTeamMaxPages = maxCanvasPages
+)
+
+// Quota resources
+const (
+	QuotaProjects = "projects"
+	QuotaPages    = "pages"
+)
+
+// QuotaExceeded is the detail of an error for a request over a plan quota
+type QuotaExceeded struct {
+	Plan     string `json:"plan"`
+	Resource string `json:"resource"`
+	Used     int    `json:"used"`
+	Limit    int    `json:"limit"`
+	// UpgradePlan is the next plan up, if any
+	UpgradePlan string `json:"upgradePlan,omitempty"`
+}
+
+// ErrDetails marks QuotaExceeded as structured error details.
+func (*QuotaExceeded) ErrDetails() {}
+
+// quotaFor returns plan's quota, and plan itself with unknown plans read
+// as free.
+func quotaFor(plan string) (string, PlanQuota) {
+	quotas := quotaCfg.ProjectQuotas
+	var q PlanQuota
+	switch plan {
+	case PlanPro:
+		q.MaxProjects = orDefault(quotas.Pro.MaxProjects, defaultProMaxProjects)
+		q.MaxPages = orDefault(quotas.Pro.MaxPages, defaultProMaxPages)
+	case PlanTeam:
+		q.MaxProjects = orDefault(quotas.Team.MaxProjects, defaultTeamMaxProjects)
+		q.MaxPages = orDefault(quotas.Team.MaxPages, defaultTeamMaxPages)
+	default:
+		plan = PlanFree
+		q.MaxProjects = orDefault(quotas.Free.MaxProjects, defaultFreeMaxProjects)
+		q.MaxPages = orDefault(quotas.Free.MaxPages, defaultFreeMaxPages)
+	}
+	q.MaxPages = min(q.MaxPages, maxCanvasPages)
+	return plan, q
+}
+
+// upgradePlan returns the plan above plan, or "" for the top plan.
+func upgradePlan(plan string) string {
+	switch plan {
+	case PlanFree:
+		return PlanPro
+	case PlanPro:
+		return PlanTeam
+	}
+	return ""
+}
+
+// upgradeHint suggests the plan above plan when it raises the limit
+// limitOf reads from a plan.
+func upgradeHint(plan string, limitOf func(plan string) int, format func(int) string) string {
+	next := upgradePlan(plan)
+	if next == "" || limitOf(next) <= limitOf(plan) {
+		return ""
+	}
+	return fmt.Sprintf(" Upgrade to the %s plan for up to %s.", next, format(limitOf(next)))
+}
+
+func maxProjectsOf(plan string) int {
+	_, q := quotaFor(plan)
+	return q.MaxProjects
+}
+
+func maxPagesOf(plan string) int {
+	_, q := quotaFor(plan)
+	return q.MaxPages
+}
+
+func quotaError(plan, resource string, used, limit int, message string) error {
+	return &errs.Error{
+		Code:    errs.ResourceExhausted,
+		Message: message,
+		Details: &QuotaExceeded{
+			Plan:        plan,
+			Resource:    resource,
+			Used:        used,
+			Limit:       limit,
+			UpgradePlan: upgradePlan(plan),
+		},
+	}
+}
+
+// checkProjectQuota rejects a new project for userID if they already own
+// as many projects as their plan allows.
+func checkProjectQuota(ctx context.Context, userID string) error {
+	var plan string
+	var owned int
+	err := db.QueryRow(ctx, `
+		SELECT u.plan, (SELECT COUNT(*) FROM projects p WHERE p.owner_id = u.id AND p.deleted_at IS NULL)
+		FROM users u WHERE u.id = $1
+	`, userID).Scan(&plan, &owned)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to count owned projects", "user_id", userID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check project quota",
+		}
+	}
+	plan, q := quotaFor(plan)
+	if owned < q.MaxProjects {
+		return nil
+	}
+	return quotaError(plan, QuotaProjects, owned, q.MaxProjects,
+		fmt.Sprintf("The %s plan allows %d projects.", plan, q.MaxProjects)+
+			upgradeHint(plan, maxProjectsOf, func(n int) string { return fmt.Sprintf("%d projects", n) }))
+}
+
+// checkPageQuota rejects a canvas document with more pages than plan
+// allows.
+func checkPageQuota(plan string, canvasData []byte) error {
+	pages := countPages(canvasData)
+	plan, q := quotaFor(plan)
+	if pages <= q.MaxPages {
+		return nil
+	}
+	return quotaError(plan, QuotaPages, pages, q.MaxPages,
+		fmt.Sprintf("Document has %d pages; the %s plan allows %d per project.", pages, plan, q.MaxPages)+
+			upgradeHint(plan, maxPagesOf, func(n int) string { return fmt.Sprintf("%d pages", n) }))
+}
+
+// countPages returns the pages of a canvas document. A document without
+// pages is one page.
+func countPages(canvasData []byte) int {
+	var doc struct {
+		Pages []json.RawMessage `json:"pages"`
+	}
+	if len(canvasData) == 0 || json.Unmarshal(canvasData, &doc) != nil || len(doc.Pages) == 0 {
+		return 1
+	}
+	return len(doc.Pages)
+}
+
+// UsageMeter is the consumption of one quota
+type UsageMeter struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+}
+
+// Usage reports the caller's consumption of their plan's quotas. Pages
+// and CanvasBytes are the largest of the caller's projects, as those
+// limits apply per project.
+type Usage struct {
+	Plan        string     `json:"plan"`
+	Projects    UsageMeter `json:"projects"`
+	Pages       UsageMeter `json:"pages"`
+	CanvasBytes UsageMeter `json:"canvasBytes"`
+	// UpgradePlan is the next plan up, if any
+	UpgradePlan string `json:"upgradePlan,omitempty"`
+}
+
+//encore:api auth method=GET path=/usage
+func GetUsage(ctx context.Context) (*Usage, error) {
+	userID := auth.UserID()
+	var plan string
+	var projects, pages, canvasBytes int
+	// Canvas bytes are measured as stored, which may differ slightly from
+	// the size a save is checked at.
+	err := db.QueryRow(ctx, `
+		SELECT u.plan, COUNT(p.id),
+			COALESCE(MAX(CASE WHEN jsonb_typeof(p.canvas_data->'pages') = 'array'
+				THEN GREATEST(jsonb_array_length(p.canvas_data->'pages'), 1) ELSE 1 END), 0),
+			COALESCE(MAX(octet_length(p.canvas_data::text)), 0)
+		FROM users u
+		LEFT JOIN projects p ON p.owner_id = u.id AND p.deleted_at IS NULL
+		WHERE u.id = $1
+		GROUP BY u.plan
+	`, userID).Scan(&plan, &projects, &pages, &canvasBytes)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load usage", "user_id", userID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load usage",
+		}
+	}
+
+	budget := measureBudget(plan, canvasBytes)
+	plan, q := quotaFor(plan)
+	return &Usage{
+		Plan:        plan,
+		Projects:    UsageMeter{Used: projects, Limit: q.MaxProjects},
+		Pages:       UsageMeter{Used: pages, Limit: q.MaxPages},
+		CanvasBytes: UsageMeter{Used: canvasBytes, Limit: budget.Limit},
+		UpgradePlan: upgradePlan(plan),
+	}, nil
+}
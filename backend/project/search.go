@@ -0,0 +1,185 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// Projects are searched through projects.search_vector, which weighs the
+// title above the description above the text layers of the canvas (see
+// migration 039). Matches are highlighted by ts_headline between two
+// control characters that never appear in rendered text, and returned as
+// fragments so clients can mark them up without trusting project content
+// as HTML.
+
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+
+	maxSearchQueryLength = 200
+)
+
+var (
+	titleHeadlineOptions   = `HighlightAll=TRUE, StartSel="` + highlightStart + `", StopSel="` + highlightStop + `"`
+	snippetHeadlineOptions = `MaxFragments=2, MaxWords=25, MinWords=10, FragmentDelimiter=" … ", StartSel="` + highlightStart + `", StopSel="` + highlightStop + `"`
+)
+
+// SearchProjectsRequest represents a project search
+type SearchProjectsRequest struct {
+	// Query uses web search syntax: quoted phrases, "or" and -excluded words
+	Query string `query:"q"`
+	// OrgID limits results to one organization's projects
+	OrgID string `query:"orgId"`
+	// Fields filter by custom field values, given as key:value; they need
+	// orgId
+	Fields []string `query:"field"`
+	Limit  int      `query:"limit"`
+	Offset int      `query:"offset"`
+}
+
+// HighlightFragment is a run of text that either matches the query or not
+type HighlightFragment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// ProjectSearchResult is a project matching a search
+type ProjectSearchResult struct {
+	Project Project `json:"project"`
+	Rank    float64 `json:"rank"`
+	// Title is the whole title with matching words highlighted
+	Title []HighlightFragment `json:"title"`
+	// Snippet is the best matching passage of the description and canvas
+	// text
+	Snippet []HighlightFragment `json:"snippet"`
+}
+
+// SearchProjectsResponse represents a page of search results, best first
+type SearchProjectsResponse struct {
+	Results []ProjectSearchResult `json:"results"`
+	Total   int                   `json:"total"`
+	Limit   int                   `json:"limit"`
+	Offset  int                   `json:"offset"`
+}
+
+// SearchProjects finds the projects the user can open whose title,
+// description or canvas text matches the query.
+//
+//encore:api auth method=GET path=/projects/search
+func SearchProjects(ctx context.Context, req *SearchProjectsRequest) (*SearchProjectsResponse, error) {
+	userID := auth.UserID()
+
+	q := strings.TrimSpace(req.Query)
+	if q == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "q is required",
+		}
+	}
+	if len(q) > maxSearchQueryLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Search query is too long",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxProjectPageSize {
+		limit = defaultProjectPageSize
+	}
+	offset := max(req.Offset, 0)
+
+	// Projects the user collaborates on or can see through their
+	// organization membership, as in ListProjects
+	const from = `
+		FROM projects p
+		CROSS JOIN websearch_to_tsquery('english', $2) AS query
+		LEFT JOIN project_collaborators c ON p.id = c.project_id AND c.user_id = $1
+		LEFT JOIN organization_members m ON m.org_id = p.org_id AND m.user_id = $1
+		WHERE p.search_vector @@ query AND p.deleted_at IS NULL
+			AND (c.user_id IS NOT NULL OR m.role IN ('admin', 'member'))`
+	filter := ""
+	args := []any{userID, q}
+	if req.OrgID != "" {
+		args = append(args, req.OrgID)
+		filter += fmt.Sprintf(` AND p.org_id::text = $%d`, len(args))
+	}
+	contains, err := fieldFilter(ctx, req.OrgID, req.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if contains != nil {
+		args = append(args, contains)
+		filter += fmt.Sprintf(` AND p.custom_fields @> $%d::jsonb`, len(args))
+	}
+
+	resp := &SearchProjectsResponse{Results: []ProjectSearchResult{}, Limit: limit, Offset: offset}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*)`+from+filter, args...).Scan(&resp.Total); err != nil {
+		reqctx.Logger(ctx).Error("failed to count search results", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to search projects",
+		}
+	}
+	if resp.Total == 0 {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT p.id, p.title, p.slug, p.owner_id, p.description, p.thumbnail, p.tags, p.is_public, p.created_at, p.updated_at, p.org_id, p.custom_fields,
+			ts_rank_cd(p.search_vector, query) AS rank,`+fmt.Sprintf(`
+			ts_headline('english', p.title, query, $%d),
+			ts_headline('english', concat_ws(E'\n', p.description, p.canvas_text), query, $%d)`, len(args)+1, len(args)+2)+
+		from+filter+fmt.Sprintf(`
+		ORDER BY rank DESC, p.updated_at DESC, p.id
+		LIMIT $%d OFFSET $%d
+	`, len(args)+3, len(args)+4), append(args, titleHeadlineOptions, snippetHeadlineOptions, limit, offset)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to search projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to search projects",
+		}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r ProjectSearchResult
+		var title, snippet string
+		p := &r.Project
+		err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.OwnerID, &p.Description, &p.Thumbnail, &p.Tags, &p.IsPublic, &p.CreatedAt, &p.UpdatedAt, &p.OrgID, &p.CustomFields,
+			&r.Rank, &title, &snippet)
+		if err != nil {
+			continue
+		}
+		r.Title = highlightFragments(title)
+		r.Snippet = highlightFragments(snippet)
+		resp.Results = append(resp.Results, r)
+	}
+	return resp, nil
+}
+
+// highlightFragments splits ts_headline output into plain and matching runs.
+func highlightFragments(headline string) []HighlightFragment {
+	fragments := []HighlightFragment{}
+	for headline != "" {
+		before, rest, found := strings.Cut(headline, highlightStart)
+		if before != "" {
+			fragments = append(fragments, HighlightFragment{Text: before})
+		}
+		if !found {
+			break
+		}
+		match, after, _ := strings.Cut(rest, highlightStop)
+		if match != "" {
+			fragments = append(fragments, HighlightFragment{Text: match, Match: true})
+		}
+		headline = after
+	}
+	return fragments
+}
@@ -0,0 +1,485 @@
+package project
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/region"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// ShareLink grants access to a project through an unguessable token.
+// PageID and ElementID optionally focus the link on part of the canvas.
+//
+// Anyone with a viewer link can open it. Commenter and editor links only
+// open for signed-in users. A signed-in user who opens a link keeps its
+// role on the project, as if they were a collaborator, until the link is
+// revoked or expires. Each first open by a signed-in user, and every open
+// by an anonymous one, counts towards MaxUses.
+type ShareLink struct {
+	ID        string     `json:"id"`
+	ProjectID string     `json:"projectId"`
+	Token     string     `json:"token"`
+	Role      string     `json:"role"`
+	PageID    string     `json:"pageId,omitempty"`
+	ElementID string     `json:"elementId,omitempty"`
+	Path      string     `json:"path"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	MaxUses   *int       `json:"maxUses,omitempty"`
+	UseCount  int        `json:"useCount"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// CreateShareLinkRequest represents the create share link request
+type CreateShareLinkRequest struct {
+	// Role is viewer, commenter or editor; defaults to viewer
+	Role      string     `json:"role,omitempty"`
+	PageID    string     `json:"pageId,omitempty"`
+	ElementID string     `json:"elementId,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	MaxUses   *int       `json:"maxUses,omitempty"`
+}
+
+// ListShareLinksResponse represents the list share links response
+type ListShareLinksResponse struct {
+	Links []ShareLink `json:"links"`
+}
+
+// liveShareLink is the SQL condition for a share link l that has not expired.
+const liveShareLink = `(l.expires_at IS NULL OR l.expires_at > NOW())`
+
+// sharedTarget is what an opened share link gives access to
+type sharedTarget struct {
+	linkID    string
+	projectID string
+	pageID    string
+	elementID string
+	role      string
+}
+
+// SharedProject is the payload served for a share link. When the link
+// targets a page or element only that page is included. Share tokens survive
+// slug renames; Slug is always the project's current one.
+type SharedProject struct {
+	ProjectID    string         `json:"projectId"`
+	Title        string         `json:"title"`
+	Slug         string         `json:"slug"`
+	Description  string         `json:"description,omitempty"`
+	Role         string         `json:"role"`
+	CanvasWidth  int            `json:"canvasWidth"`
+	CanvasHeight int            `json:"canvasHeight"`
+	Revision     int            `json:"revision"`
+	PageID       string         `json:"pageId,omitempty"`
+	ElementID    string         `json:"elementId,omitempty"`
+	Page         *render.Page   `json:"page,omitempty"`
+	Element      map[string]any `json:"element,omitempty"`
+	CanvasData   any            `json:"canvasData,omitempty"`
+	// TargetMissing is set when the linked page or element has since been
+	// deleted; the client falls back to the project or page view.
+	TargetMissing bool `json:"targetMissing,omitempty"`
+}
+
+//encore:api auth method=POST path=/projects/:id/share-links
+func CreateShareLink(ctx context.Context, id string, req *CreateShareLinkRequest) (*ShareLink, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+	if err := denyGuest(ctx, auth.UserID()); err != nil {
+		return nil, err
+	}
+	role := req.Role
+	if role == "" {
+		role = string(permissions.RoleViewer)
+	}
+	if !permissions.ValidRole(role) || role == string(permissions.RoleOwner) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Role must be editor, commenter or viewer",
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Expiry must be in the future",
+		}
+	}
+	if req.MaxUses != nil && *req.MaxUses < 1 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Max uses must be at least 1",
+		}
+	}
+
+	var canvasData []byte
+	var linksEnabled bool
+	if err := db.QueryRow(ctx, `SELECT canvas_data, share_links_enabled FROM projects WHERE id = $1`, id).Scan(&canvasData, &linksEnabled); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if !linksEnabled {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Share links are disabled for this project",
+		}
+	}
+	pageID, err := validateShareTarget(canvasData, req.PageID, req.ElementID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create share link",
+		}
+	}
+
+	link := &ShareLink{
+		ProjectID: id,
+		Token:     token,
+		Role:      role,
+		PageID:    pageID,
+		ElementID: req.ElementID,
+		Path:      sharePath(token),
+		ExpiresAt: req.ExpiresAt,
+		MaxUses:   req.MaxUses,
+		CreatedBy: auth.UserID(),
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO project_share_links (project_id, token, role, page_id, element_id, expires_at, max_uses, created_by)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8)
+		RETURNING id, created_at
+	`, id, token, link.Role, link.PageID, link.ElementID, link.ExpiresAt, link.MaxUses, link.CreatedBy).Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create share link", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create share link",
+		}
+	}
+	reqctx.Logger(ctx).Info("share link created", "project_id", id, "link_id", link.ID, "role", link.Role)
+	return link, nil
+}
+
+// ListShareLinks lists a project's share links, including expired and used
+// up ones until they are revoked.
+//
+//encore:api auth method=GET path=/projects/:id/share-links
+func ListShareLinks(ctx context.Context, id string) (*ListShareLinksResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, project_id, token, role, COALESCE(page_id, ''), COALESCE(element_id, ''), expires_at, max_uses, use_count,
+			created_by, created_at
+		FROM project_share_links
+		WHERE project_id = $1
+		ORDER BY created_at DESC
+	`, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch share links",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListShareLinksResponse{Links: []ShareLink{}}
+	for rows.Next() {
+		var link ShareLink
+		if err := rows.Scan(&link.ID, &link.ProjectID, &link.Token, &link.Role, &link.PageID, &link.ElementID, &link.ExpiresAt,
+			&link.MaxUses, &link.UseCount, &link.CreatedBy, &link.CreatedAt); err != nil {
+			continue
+		}
+		link.Path = sharePath(link.Token)
+		resp.Links = append(resp.Links, link)
+	}
+	return resp, nil
+}
+
+// RevokeShareLink deletes a share link. It stops opening, and people who
+// opened it lose the access it gave them.
+//
+//encore:api auth method=DELETE path=/projects/:id/share-links/:linkID
+func RevokeShareLink(ctx context.Context, id string, linkID string) error {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM project_share_links WHERE id::text = $1 AND project_id = $2
+	`, linkID, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to revoke share link", "link_id", linkID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to revoke share link",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Share link not found",
+		}
+	}
+	projectaccess.Forget(id)
+	reqctx.Logger(ctx).Info("share link revoked", "project_id", id, "link_id", linkID)
+	return nil
+}
+
+// RevokeAllShareLinksResponse represents the revoke all share links response
+type RevokeAllShareLinksResponse struct {
+	Revoked int64 `json:"revoked"`
+}
+
+// RevokeAllShareLinks deletes every share link of a project.
+//
+//encore:api auth method=DELETE path=/projects/:id/share-links
+func RevokeAllShareLinks(ctx context.Context, id string) (*RevokeAllShareLinksResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectShare); err != nil {
+		return nil, err
+	}
+	result, err := db.Exec(ctx, `DELETE FROM project_share_links WHERE project_id = $1`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to revoke share links", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to revoke share links",
+		}
+	}
+	projectaccess.Forget(id)
+	reqctx.Logger(ctx).Info("share links revoked", "project_id", id, "count", result.RowsAffected())
+	return &RevokeAllShareLinksResponse{Revoked: result.RowsAffected()}, nil
+}
+
+//encore:api public method=GET path=/shared/:token
+func GetSharedProject(ctx context.Context, token string) (*SharedProject, error) {
+	target, err := openShareLink(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	projectID, pageID, elementID := target.projectID, target.pageID, target.elementID
+
+	shared := &SharedProject{ProjectID: projectID, PageID: pageID, ElementID: elementID, Role: target.role}
+	var canvasData []byte
+	err = db.QueryRow(ctx, `
+		SELECT title, COALESCE(slug, ''), COALESCE(description, ''), canvas_data, canvas_width, canvas_height, version
+		FROM projects WHERE id = $1
+	`, projectID).Scan(&shared.Title, &shared.Slug, &shared.Description, &canvasData, &shared.CanvasWidth, &shared.CanvasHeight, &shared.Revision)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+
+	if pageID == "" && elementID == "" {
+		if len(canvasData) > 0 {
+			shared.CanvasData = json.RawMessage(upgradeCanvasData(canvasData))
+		}
+		return shared, nil
+	}
+
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to parse shared canvas", "project_id", projectID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load shared project",
+		}
+	}
+	page := render.FindPage(pages, pageID)
+	if page == nil {
+		shared.TargetMissing = true
+		page = &pages[0]
+	}
+	shared.Page = page
+	if elementID != "" {
+		shared.Element = render.FindElement(page.Objects, elementID)
+		if shared.Element == nil {
+			shared.TargetMissing = true
+		}
+	}
+	return shared, nil
+}
+
+// openShareLink resolves a share token for the person opening it and
+// counts the use. Opens are throttled (see sharethrottle.go). A signed-in user is recorded against the link, so only
+// their first open counts and the link's role applies to them elsewhere
+// (see projectRole).
+func openShareLink(ctx context.Context, token string) (*sharedTarget, error) {
+	if err := throttleShareOpen(ctx, token); err != nil {
+		return nil, err
+	}
+	t := &sharedTarget{}
+	err := db.QueryRow(ctx, `
+		SELECT l.id, l.project_id, COALESCE(l.page_id, ''), COALESCE(l.element_id, ''), l.role
+		FROM project_share_links l
+		JOIN projects p ON p.id = l.project_id
+		JOIN users u ON u.id = p.owner_id
+		WHERE l.token = $1 AND `+liveShareLink+` AND u.deactivated_at IS NULL AND p.deleted_at IS NULL
+	`, token).Scan(&t.linkID, &t.projectID, &t.pageID, &t.elementID, &t.role)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Share link not found",
+		}
+	}
+
+	// Internal services read shared projects like anonymous visitors.
+	userID := auth.UserID()
+	if strings.HasPrefix(userID, permissions.ServicePrefix) {
+		userID = ""
+	}
+	if userID == "" && t.role != string(permissions.RoleViewer) {
+		return nil, &errs.Error{
+			Code:    errs.Unauthenticated,
+			Message: "Sign in to open this link",
+		}
+	}
+	if err := watchShareOpen(ctx, t, userID); err != nil {
+		return nil, err
+	}
+	if region.ReadOnly(ctx) {
+		return standbyShareOpen(ctx, t)
+	}
+
+	fail := func(err error) (*sharedTarget, error) {
+		reqctx.Logger(ctx).Error("failed to open share link", "link_id", t.linkID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to open share link",
+		}
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	if userID != "" {
+		result, err := tx.Exec(ctx, `
+			INSERT INTO project_share_link_grants (link_id, user_id) VALUES ($1, $2)
+			ON CONFLICT (link_id, user_id) DO NOTHING
+		`, t.linkID, userID)
+		if err != nil {
+			return fail(err)
+		}
+		if result.RowsAffected() == 0 {
+			return t, nil
+		}
+	}
+	result, err := tx.Exec(ctx, `
+		UPDATE project_share_links SET use_count = use_count + 1
+		WHERE id = $1 AND (max_uses IS NULL OR use_count < max_uses)
+	`, t.linkID)
+	if err != nil {
+		return fail(err)
+	}
+	if result.RowsAffected() == 0 {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "This share link has been used the maximum number of times",
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	if userID != "" {
+		projectaccess.Forget(t.projectID)
+	}
+	return t, nil
+}
+
+// standbyShareOpen opens a link in a standby region, whose database is a
+// read-only replica (see region). The open is not counted or recorded, so
+// links with a use limit wait for the primary.
+func standbyShareOpen(ctx context.Context, t *sharedTarget) (*sharedTarget, error) {
+	var limited bool
+	err := db.QueryRow(ctx, `SELECT max_uses IS NOT NULL FROM project_share_links WHERE id = $1`, t.linkID).Scan(&limited)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to open share link", "link_id", t.linkID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to open share link",
+		}
+	}
+	if limited {
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "This share link can't be opened right now, try again later",
+		}
+	}
+	return t, nil
+}
+
+// validateShareTarget checks that the requested page and element exist in
+// the canvas. It returns the page ID to store, filled in from the element's
+// page when only an element was given.
+func validateShareTarget(canvasData []byte, pageID, elementID string) (string, error) {
+	if pageID == "" && elementID == "" {
+		return "", nil
+	}
+
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return "", &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas is invalid",
+		}
+	}
+
+	if pageID != "" {
+		page := render.FindPage(pages, pageID)
+		if page == nil {
+			return "", &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Page not found",
+			}
+		}
+		if elementID != "" && render.FindElement(page.Objects, elementID) == nil {
+			return "", &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Element not found on page",
+			}
+		}
+		return pageID, nil
+	}
+
+	for _, page := range pages {
+		if render.FindElement(page.Objects, elementID) != nil {
+			return page.ID, nil
+		}
+	}
+	return "", &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: "Element not found",
+	}
+}
+
+// sharePath is the web app route that opens a share link.
+func sharePath(token string) string {
+	return "/s/" + token
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
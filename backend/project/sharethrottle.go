@@ -0,0 +1,211 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+
+	canvasauth "canvasai/auth"
+	"canvasai/notification"
+	"canvasai/ratelimit"
+	"canvasai/region"
+	"canvasai/reqctx"
+)
+
+// Share links are public, so opening one is throttled against scraping.
+// Every open counts against a bucket for the link's token and one for the
+// caller's IP (see ratelimit; the buckets are per instance). Opens whose
+// address is unknown share one IP bucket rather than going unthrottled. Each link's
+// opens are also tallied per minute: a minute far above the link's recent
+// average is a spike. A spike alerts the project's owner, at most once per
+// shareAlertInterval, and with ChallengeOnSpike set makes anonymous
+// visitors solve the bot challenge (see canvasauth.VerifyChallenge) while
+// it lasts.
+
+// ShareThrottle configures abuse protection for share links. Zero values
+// use the defaults.
+type ShareThrottle struct {
+	// PerLinkPerMinute and PerIPPerMinute bound the opens of one link and
+	// the opens from one address
+	PerLinkPerMinute int
+	PerIPPerMinute   int
+	// SpikeFactor and SpikeMinimum define a spike: a minute with at least
+	// SpikeMinimum opens and SpikeFactor times the link's average
+	SpikeFactor  int
+	SpikeMinimum int
+	// ChallengeOnSpike asks anonymous visitors of a spiking link to solve
+	// the bot challenge
+	ChallengeOnSpike bool
+}
+
+var throttleCfg struct {
+	ShareThrottle ShareThrottle
+}
+
+var _ = config.Load(context.Background(), &throttleCfg)
+
+const (
+	defaultSharePerLink = 300
+	defaultSharePerIP   = 60
+	defaultSpikeFactor  = 5
+	defaultSpikeMinimum = 100
+
+	// unknownIPBucket is the IP bucket of callers without an address
+	unknownIPBucket = "unknown"
+
+	// shareTrafficWindow is the minutes of history a spike is measured
+	// against
+	shareTrafficWindow   = 10
+	shareSpikeDuration   = 15 * time.Minute
+	shareAlertInterval   = time.Hour
+	maxTrackedShareLinks = 4096
+)
+
+var (
+	shareLimitersOnce sync.Once
+	linkLimiter       *ratelimit.Limiter
+	ipLimiter         *ratelimit.Limiter
+)
+
+// throttleShareOpen counts an attempt to open token against the token's
+// and the caller's buckets. It runs before the token is looked up, so
+// guessing tokens is throttled too.
+func throttleShareOpen(ctx context.Context, token string) error {
+	shareLimitersOnce.Do(func() {
+		c := throttleCfg.ShareThrottle
+		linkLimiter = ratelimit.New(ratelimit.Limit{Requests: orDefault(c.PerLinkPerMinute, defaultSharePerLink), Per: time.Minute})
+		ipLimiter = ratelimit.New(ratelimit.Limit{Requests: orDefault(c.PerIPPerMinute, defaultSharePerIP), Per: time.Minute})
+	})
+	ip := reqctx.From(ctx).IP
+	if ip == "" {
+		ip = unknownIPBucket
+	}
+	if !ipLimiter.Allow(ip) {
+		reqctx.Logger(ctx).Warn("share link opens throttled", "ip", ip)
+		return &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "Too many requests, try again later",
+		}
+	}
+	if !linkLimiter.Allow(token) {
+		return &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "This link is receiving too many requests, try again later",
+		}
+	}
+	return nil
+}
+
+// linkTraffic is a link's opens per minute
+type linkTraffic struct {
+	minute     int64 // Unix minute that count covers
+	count      int
+	history    []int // previous minutes, oldest first
+	spikeUntil time.Time
+}
+
+var (
+	trafficMu sync.Mutex
+	traffic   = map[string]*linkTraffic{}
+)
+
+// recordShareOpen tallies an open of a link. It reports whether the link is
+// in a spike, and whether this open started it.
+func recordShareOpen(linkID string, now time.Time) (spiking, started bool, count int) {
+	c := throttleCfg.ShareThrottle
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+
+	t, ok := traffic[linkID]
+	if !ok {
+		if len(traffic) >= maxTrackedShareLinks {
+			traffic = map[string]*linkTraffic{}
+		}
+		t = &linkTraffic{minute: now.Unix() / 60}
+		traffic[linkID] = t
+	}
+	if m := now.Unix() / 60; m != t.minute {
+		t.history = append(t.history, t.count)
+		// Minutes without opens count as zero.
+		for i := t.minute + 1; i < m && i-t.minute <= shareTrafficWindow; i++ {
+			t.history = append(t.history, 0)
+		}
+		if len(t.history) > shareTrafficWindow {
+			t.history = t.history[len(t.history)-shareTrafficWindow:]
+		}
+		t.minute, t.count = m, 0
+	}
+	t.count++
+
+	var total int
+	for _, n := range t.history {
+		total += n
+	}
+	average := 0.0
+	if len(t.history) > 0 {
+		average = float64(total) / float64(len(t.history))
+	}
+	if now.After(t.spikeUntil) && t.count >= orDefault(c.SpikeMinimum, defaultSpikeMinimum) &&
+		float64(t.count) > float64(orDefault(c.SpikeFactor, defaultSpikeFactor))*average {
+		t.spikeUntil = now.Add(shareSpikeDuration)
+		started = true
+	}
+	return now.Before(t.spikeUntil), started, t.count
+}
+
+// watchShareOpen records an open of t's link and applies the spike
+// response. userID is empty for anonymous visitors.
+func watchShareOpen(ctx context.Context, t *sharedTarget, userID string) error {
+	spiking, started, count := recordShareOpen(t.linkID, time.Now())
+	if started {
+		reqctx.Logger(ctx).Warn("share link traffic spike", "link_id", t.linkID, "project_id", t.projectID, "opens_this_minute", count)
+		alertShareSpike(ctx, t, count)
+	}
+	if spiking && userID == "" && throttleCfg.ShareThrottle.ChallengeOnSpike {
+		return canvasauth.VerifyChallenge(ctx)
+	}
+	return nil
+}
+
+// alertShareSpike notifies the project's owner that a link is being
+// hammered, unless they were alerted about it recently by any instance.
+func alertShareSpike(ctx context.Context, t *sharedTarget, count int) {
+	if region.ReadOnly(ctx) {
+		// The alert can't be recorded on a standby; the primary's
+		// instances alert once traffic returns to them.
+		return
+	}
+	var ownerID, title string
+	err := db.QueryRow(ctx, `
+		UPDATE project_share_links l SET abuse_alerted_at = NOW()
+		FROM projects p
+		WHERE l.id = $1 AND p.id = l.project_id
+			AND (l.abuse_alerted_at IS NULL OR l.abuse_alerted_at < NOW() - $2 * INTERVAL '1 second')
+		RETURNING p.owner_id, p.title
+	`, t.linkID, int(shareAlertInterval.Seconds())).Scan(&ownerID, &title)
+	if err == sql.ErrNoRows {
+		// Alerted recently.
+		return
+	} else if err != nil {
+		reqctx.Logger(ctx).Warn("failed to record share link alert", "link_id", t.linkID, "error", err)
+		return
+	}
+	data, _ := json.Marshal(map[string]any{"projectId": t.projectID, "linkId": t.linkID, "opensPerMinute": count})
+	err = notification.Send(ctx, &notification.Message{
+		UserID: ownerID,
+		Kind:   "project.share_link.abuse",
+		Title:  fmt.Sprintf("A share link to %q is getting unusual traffic", title),
+		Body:   fmt.Sprintf("It was opened %d times in a minute. Revoke it if you did not expect this.", count),
+		Link:   "/projects/" + t.projectID,
+		Data:   data,
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to alert owner of share link spike", "link_id", t.linkID, "error", err)
+	}
+}
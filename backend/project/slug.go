@@ -0,0 +1,436 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Slugs are the human-readable part of project URLs. They are unique, ignoring
+// case, among an owner's personal projects or among an organization's
+// projects. Renaming a slug keeps the old one as a redirect, so links that
+// were handed out before keep resolving until another project claims it.
+// Slugs derived from titles are folded to ASCII ("Café Menü" becomes
+// cafe-menu), and words the app's URLs use are reserved.
+
+const maxSlugLength = 80
+
+var (
+	slugPattern         = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	templatePlaceholder = regexp.MustCompile(`\{([a-zA-Z][a-zA-Z0-9_]*)\}`)
+)
+
+// reservedSlugs would be mistaken for routes next to project slugs
+var reservedSlugs = map[string]bool{
+	"admin": true, "api": true, "archive": true, "edit": true, "editor": true,
+	"embed": true, "export": true, "folders": true, "gallery": true, "import": true,
+	"login": true, "new": true, "preview": true, "search": true, "settings": true,
+	"shared": true, "signup": true, "starred": true, "tags": true, "templates": true,
+	"trash": true, "view": true,
+}
+
+// asciiFold strips accents by decomposing letters and dropping the marks.
+// A chain keeps state, so each use needs its own.
+func asciiFold() transform.Transformer {
+	return transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+}
+
+// letterFold spells out the letters that have no decomposition
+var letterFold = strings.NewReplacer("ß", "ss", "æ", "ae", "œ", "oe", "ø", "o", "ł", "l", "đ", "d", "ð", "d", "þ", "th", "ı", "i")
+
+// RenameSlugRequest represents the rename slug request
+type RenameSlugRequest struct {
+	Slug string `json:"slug"`
+}
+
+// ResolveSlugRequest names the workspace a slug is looked up in
+type ResolveSlugRequest struct {
+	// OrgID looks the slug up among an organization's projects
+	OrgID string `query:"orgId"`
+	// OwnerID looks it up among a user's personal projects; it defaults to
+	// the caller
+	OwnerID string `query:"ownerId"`
+}
+
+// ResolvedSlug is the project a slug refers to
+type ResolvedSlug struct {
+	ProjectID string `json:"projectId"`
+	// Slug is the project's current slug
+	Slug string `json:"slug"`
+	// Redirected is set when the requested slug is a former one; clients
+	// should replace it with Slug
+	Redirected bool `json:"redirected"`
+}
+
+// RenameSlug changes a project's slug, keeping the previous one as a
+// redirect.
+//
+//encore:api auth method=PUT,PATCH path=/projects/:id/slug
+func RenameSlug(ctx context.Context, id string, req *RenameSlugRequest) (*Project, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	slug := strings.ToLower(strings.TrimSpace(req.Slug))
+	if err := validateSlug(slug); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to rename slug",
+		}
+	}
+	defer tx.Rollback()
+
+	var ownerID, current string
+	var orgID *string
+	err = tx.QueryRow(ctx, `
+		SELECT owner_id, org_id, COALESCE(slug, '') FROM projects WHERE id = $1 FOR UPDATE
+	`, id).Scan(&ownerID, &orgID, &current)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if current == slug {
+		return GetProject(ctx, id)
+	}
+
+	taken, err := slugTaken(ctx, slug, ownerID, orgID, id)
+	if err == nil && taken {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "Another project already uses this slug",
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE projects SET slug = $2, updated_at = NOW() WHERE id = $1`, id, slug)
+	}
+	if err == nil && current != "" && !strings.EqualFold(current, slug) {
+		err = recordSlugRedirect(ctx, tx, id, ownerID, orgID, current)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to rename slug", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to rename slug",
+		}
+	}
+
+	reqctx.Logger(ctx).Info("project slug renamed", "project_id", id, "slug", slug)
+	return GetProject(ctx, id)
+}
+
+// FormerSlug is a slug a project was known by before a rename
+type FormerSlug struct {
+	Slug      string    `json:"slug"`
+	RenamedAt time.Time `json:"renamedAt"`
+	// Redirects is false once another project in the workspace has
+	// claimed the slug
+	Redirects bool `json:"redirects"`
+}
+
+// SlugHistoryResponse represents a project's former slugs, newest first
+type SlugHistoryResponse struct {
+	Slug    string       `json:"slug"`
+	History []FormerSlug `json:"history"`
+}
+
+//encore:api auth method=GET path=/projects/:id/slug-history
+func GetSlugHistory(ctx context.Context, id string) (*SlugHistoryResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+	resp := &SlugHistoryResponse{History: []FormerSlug{}}
+	if err := db.QueryRow(ctx, `SELECT COALESCE(slug, '') FROM projects WHERE id = $1`, id).Scan(&resp.Slug); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	// A slug stops redirecting here when another live project uses it, or
+	// when another project renamed away from it later (see ResolveSlug).
+	rows, err := db.Query(ctx, `
+		SELECT r.slug, r.created_at, lower(r.slug) <> lower($2) AND NOT EXISTS (
+			SELECT 1 FROM projects q
+			WHERE lower(q.slug) = lower(r.slug) AND q.id <> r.project_id AND q.deleted_at IS NULL
+				AND (q.org_id = r.org_id OR (r.org_id IS NULL AND q.org_id IS NULL AND q.owner_id = r.owner_id))
+		) AND NOT EXISTS (
+			SELECT 1 FROM project_slug_redirects o
+			WHERE lower(o.slug) = lower(r.slug) AND o.project_id <> r.project_id AND o.created_at > r.created_at
+				AND (o.org_id = r.org_id OR (r.org_id IS NULL AND o.org_id IS NULL AND o.owner_id = r.owner_id))
+		)
+		FROM project_slug_redirects r
+		WHERE r.project_id = $1
+		ORDER BY r.created_at DESC
+	`, id, resp.Slug)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list slug history", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch slug history",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f FormerSlug
+		if err := rows.Scan(&f.Slug, &f.RenamedAt, &f.Redirects); err != nil {
+			reqctx.Logger(ctx).Error("failed to scan slug history", "project_id", id, "error", err)
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to fetch slug history",
+			}
+		}
+		resp.History = append(resp.History, f)
+	}
+	if err := rows.Err(); err != nil {
+		reqctx.Logger(ctx).Error("failed to list slug history", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch slug history",
+		}
+	}
+	return resp, nil
+}
+
+// ResolveSlug finds the project a slug refers to in a workspace, following
+// redirects left by renames.
+//
+//encore:api auth method=GET path=/project-slugs/:slug
+func ResolveSlug(ctx context.Context, slug string, req *ResolveSlugRequest) (*ResolvedSlug, error) {
+	scope, redirectScope := `p.org_id IS NULL AND p.owner_id = $2`, `r.org_id IS NULL AND r.owner_id = $2`
+	workspace := req.OwnerID
+	if req.OrgID != "" {
+		scope, redirectScope, workspace = `p.org_id = $2`, `r.org_id = $2`, req.OrgID
+	} else if workspace == "" {
+		workspace = auth.UserID()
+	}
+
+	resolved := &ResolvedSlug{}
+	err := db.QueryRow(ctx, `
+		SELECT p.id, p.slug FROM projects p WHERE lower(p.slug) = lower($1) AND p.deleted_at IS NULL AND `+scope,
+		slug, workspace).Scan(&resolved.ProjectID, &resolved.Slug)
+	if err == sql.ErrNoRows {
+		resolved.Redirected = true
+		err = db.QueryRow(ctx, `
+			SELECT p.id, p.slug FROM project_slug_redirects r
+			JOIN projects p ON p.id = r.project_id
+			WHERE lower(r.slug) = lower($1) AND p.deleted_at IS NULL AND `+redirectScope+`
+			ORDER BY r.created_at DESC
+			LIMIT 1
+		`, slug, workspace).Scan(&resolved.ProjectID, &resolved.Slug)
+	}
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to resolve slug", "slug", slug, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to resolve slug",
+		}
+	}
+
+	if err := permissions.Authorize(ctx, permissions.Project(resolved.ProjectID), permissions.ProjectView); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	return resolved, nil
+}
+
+// assignSlug gives a new project the requested slug, or one derived from
+// its title that is free in the project's workspace.
+func assignSlug(ctx context.Context, project *Project, requested string) error {
+	if requested == "" {
+		slug, err := uniqueSlug(ctx, slugify(project.Title), project.OwnerID, project.OrgID, project.ID)
+		if err != nil {
+			return err
+		}
+		project.Slug = slug
+		return nil
+	}
+
+	slug := strings.ToLower(strings.TrimSpace(requested))
+	if err := validateSlug(slug); err != nil {
+		return err
+	}
+	taken, err := slugTaken(ctx, slug, project.OwnerID, project.OrgID, project.ID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check slug", "slug", slug, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check slug",
+		}
+	}
+	if taken {
+		return &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "Another project already uses this slug",
+		}
+	}
+	project.Slug = slug
+	return nil
+}
+
+// uniqueSlug returns base, or base with a numeric suffix, whichever is first
+// free in the workspace.
+func uniqueSlug(ctx context.Context, base, ownerID string, orgID *string, excludeID string) (string, error) {
+	for n := 1; n <= 50; n++ {
+		slug := base
+		if n > 1 {
+			suffix := fmt.Sprintf("-%d", n)
+			slug = strings.TrimSuffix(truncateSlug(base, maxSlugLength-len(suffix)), "-") + suffix
+		}
+		if reservedSlugs[slug] {
+			continue
+		}
+		taken, err := slugTaken(ctx, slug, ownerID, orgID, excludeID)
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to check slug", "slug", slug, "error", err)
+			return "", &errs.Error{
+				Code:    errs.Internal,
+				Message: "Failed to check slug",
+			}
+		}
+		if !taken {
+			return slug, nil
+		}
+	}
+	// Heavily reused titles fall back to a random suffix.
+	return strings.TrimSuffix(truncateSlug(base, maxSlugLength-9), "-") + "-" + uuid.New().String()[:8], nil
+}
+
+// slugTaken reports whether a project other than excludeID uses slug in the
+// owner's personal workspace, or in orgID's when set.
+func slugTaken(ctx context.Context, slug, ownerID string, orgID *string, excludeID string) (bool, error) {
+	var taken bool
+	var err error
+	if orgID != nil {
+		err = db.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM projects WHERE org_id = $1 AND lower(slug) = lower($2) AND id::text <> $3)
+		`, *orgID, slug, excludeID).Scan(&taken)
+	} else {
+		err = db.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM projects WHERE org_id IS NULL AND owner_id = $1 AND lower(slug) = lower($2) AND id::text <> $3)
+		`, ownerID, slug, excludeID).Scan(&taken)
+	}
+	return taken, err
+}
+
+// recordSlugRedirect keeps a project's former slug resolving within the
+// workspace it was used in.
+func recordSlugRedirect(ctx context.Context, tx *sqldb.Tx, projectID, ownerID string, orgID *string, slug string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO project_slug_redirects (project_id, owner_id, org_id, slug) VALUES ($1, $2, $3, $4)
+	`, projectID, ownerID, orgID, slug)
+	return err
+}
+
+func validateSlug(slug string) error {
+	if !slugPattern.MatchString(slug) || len(slug) > maxSlugLength {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("Slug must be at most %d lowercase letters, digits and dashes", maxSlugLength),
+		}
+	}
+	if _, err := uuid.Parse(slug); err == nil {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Slug cannot be a project ID",
+		}
+	}
+	if reservedSlugs[slug] {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("%q is reserved and cannot be used as a slug", slug),
+		}
+	}
+	return nil
+}
+
+func slugify(title string) string {
+	folded, _, err := transform.String(asciiFold(), letterFold.Replace(strings.ToLower(title)))
+	if err != nil {
+		folded = strings.ToLower(title)
+	}
+	var b strings.Builder
+	dash := false
+	for _, r := range folded {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(truncateSlug(strings.TrimSuffix(b.String(), "-"), maxSlugLength), "-")
+	if slug == "" {
+		slug = "untitled"
+	}
+	return slug
+}
+
+func truncateSlug(slug string, n int) string {
+	if len(slug) > n {
+		return slug[:n]
+	}
+	return slug
+}
+
+// renderNameTemplate fills an organization's naming template, such as
+// "{client}-{campaign}-{date}", from the fields given at creation. {date},
+// {year} and {month} default to the creation date.
+func renderNameTemplate(template string, fields map[string]string, now time.Time) (string, error) {
+	builtin := map[string]string{
+		"date":  now.Format("2006-01-02"),
+		"year":  now.Format("2006"),
+		"month": now.Format("01"),
+	}
+	var missing []string
+	title := templatePlaceholder.ReplaceAllStringFunc(template, func(m string) string {
+		name := m[1 : len(m)-1]
+		if v := strings.TrimSpace(fields[name]); v != "" {
+			return v
+		}
+		if v, ok := builtin[name]; ok {
+			return v
+		}
+		missing = append(missing, name)
+		return m
+	})
+	if len(missing) > 0 {
+		return "", &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Missing naming fields: " + strings.Join(missing, ", "),
+		}
+	}
+	return strings.TrimSpace(title), nil
+}
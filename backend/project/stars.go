@@ -0,0 +1,92 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Users star projects to find them again with ListProjects' starred
+// filter. Anyone may star a public project, as anyone may fork it; other
+// projects need viewer access. Public projects show their star count,
+// which ranks them (sort=stars).
+
+// StarResponse represents a project's star state for the caller
+type StarResponse struct {
+	Starred   bool `json:"starred"`
+	StarCount int  `json:"starCount"`
+}
+
+//encore:api auth method=POST path=/projects/:id/star
+func StarProject(ctx context.Context, id string) (*StarResponse, error) {
+	var isPublic bool
+	err := db.QueryRow(ctx, `
+		SELECT is_public FROM projects WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&isPublic)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if !isPublic {
+		if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &StarResponse{Starred: true}
+	err = db.QueryRow(ctx, `
+		WITH added AS (
+			INSERT INTO project_stars (project_id, user_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+			RETURNING project_id
+		)
+		UPDATE projects SET star_count = star_count + (SELECT COUNT(*) FROM added)
+		WHERE id = $1
+		RETURNING star_count
+	`, id, auth.UserID()).Scan(&resp.StarCount)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to star project", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to star project",
+		}
+	}
+	return resp, nil
+}
+
+// UnstarProject removes the caller's star. It needs no access to the
+// project, so a star outlives losing access until it is removed.
+//
+//encore:api auth method=DELETE path=/projects/:id/star
+func UnstarProject(ctx context.Context, id string) (*StarResponse, error) {
+	resp := &StarResponse{}
+	err := db.QueryRow(ctx, `
+		WITH removed AS (
+			DELETE FROM project_stars WHERE project_id = $1 AND user_id = $2
+			RETURNING project_id
+		)
+		UPDATE projects SET star_count = GREATEST(star_count - (SELECT COUNT(*) FROM removed), 0)
+		WHERE id = $1
+		RETURNING star_count
+	`, id, auth.UserID()).Scan(&resp.StarCount)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to unstar project", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to unstar project",
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,268 @@
+package project
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+	"canvasai/sqlutil"
+)
+
+// Tags label projects within a workspace: the user's personal projects or
+// one organization's. Autocomplete suggests the tags already used there so
+// labels stay consistent, and rename and merge fix them up across every
+// project at once. Personal tags are renamed in the projects the user
+// owns; an organization's, by its admins, in all of its projects.
+
+const (
+	defaultTagSuggestions = 10
+	maxTagSuggestions     = 50
+	maxMergedTags         = 20
+)
+
+// UpdateProjectTagsRequest represents the update project tags request
+type UpdateProjectTagsRequest struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// ProjectTagsResponse represents a project's tags
+type ProjectTagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// ListTagsRequest represents the tag autocomplete request
+type ListTagsRequest struct {
+	// Prefix matches the start of tags, ignoring case
+	Prefix string `query:"prefix"`
+	// OrgID suggests the organization's tags instead of personal ones
+	OrgID string `query:"orgId"`
+	Limit int    `query:"limit"`
+}
+
+// TagCount is a tag and the number of projects using it
+type TagCount struct {
+	Tag      string `json:"tag"`
+	Projects int    `json:"projects"`
+}
+
+// ListTagsResponse represents the tag autocomplete response
+type ListTagsResponse struct {
+	Tags []TagCount `json:"tags"`
+}
+
+// RenameTagRequest represents the rename tag request
+type RenameTagRequest struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	OrgID string `json:"orgId,omitempty"`
+}
+
+// MergeTagsRequest represents the merge tags request
+type MergeTagsRequest struct {
+	// From are the tags replaced by Into
+	From  []string `json:"from"`
+	Into  string   `json:"into"`
+	OrgID string   `json:"orgId,omitempty"`
+}
+
+// RetagResponse reports how many projects a rename or merge changed
+type RetagResponse struct {
+	Projects int `json:"projects"`
+}
+
+// UpdateProjectTags adds and removes tags on a project, keeping the
+// others.
+//
+//encore:api auth method=POST path=/projects/:id/tags
+func UpdateProjectTags(ctx context.Context, id string, req *UpdateProjectTagsRequest) (*ProjectTagsResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	add, err := normalizeTags(req.Add)
+	if err != nil {
+		return nil, err
+	}
+	remove, err := normalizeTags(req.Remove)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update tags",
+		}
+	}
+	defer tx.Rollback()
+
+	var current []string
+	if err := tx.QueryRow(ctx, `SELECT tags FROM projects WHERE id = $1 FOR UPDATE`, id).Scan(&current); err != nil {
+		reqctx.Logger(ctx).Error("failed to load tags", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update tags",
+		}
+	}
+	removed := map[string]bool{}
+	for _, t := range remove {
+		removed[t] = true
+	}
+	var kept []string
+	for _, t := range append(current, add...) {
+		if !removed[t] {
+			kept = append(kept, t)
+		}
+	}
+	tags, err := normalizeTags(kept)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE projects SET tags = $2, updated_at = NOW() WHERE id = $1`, id, tags); err != nil {
+		reqctx.Logger(ctx).Error("failed to update tags", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update tags",
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update tags",
+		}
+	}
+	return &ProjectTagsResponse{Tags: tags}, nil
+}
+
+// ListTags suggests tags used in the user's personal projects, or in an
+// organization's, most used first.
+//
+//encore:api auth method=GET path=/tags
+func ListTags(ctx context.Context, req *ListTagsRequest) (*ListTagsResponse, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > maxTagSuggestions {
+		limit = defaultTagSuggestions
+	}
+	args := []any{auth.UserID()}
+	var scope string
+	if req.OrgID != "" {
+		if err := requireOrgMember(ctx, req.OrgID, "admin", "member", "guest"); err != nil {
+			return nil, err
+		}
+		// The organization's projects the user can see (see projectRole)
+		args = append(args, req.OrgID)
+		scope = `p.org_id::text = $2 AND (c.user_id IS NOT NULL OR m.role IN ('admin', 'member'))`
+	} else {
+		scope = `p.org_id IS NULL AND c.user_id IS NOT NULL`
+	}
+	prefix := strings.ToLower(strings.TrimSpace(req.Prefix))
+	args = append(args, sqlutil.EscapeLike(prefix)+"%", limit)
+
+	rows, err := db.Query(ctx, fmt.Sprintf(`
+		SELECT t.tag, COUNT(*)
+		FROM projects p
+		LEFT JOIN project_collaborators c ON p.id = c.project_id AND c.user_id = $1
+		LEFT JOIN organization_members m ON m.org_id = p.org_id AND m.user_id = $1
+		CROSS JOIN LATERAL unnest(p.tags) AS t(tag)
+		WHERE %s AND p.deleted_at IS NULL AND t.tag LIKE $%d
+		GROUP BY t.tag
+		ORDER BY COUNT(*) DESC, t.tag
+		LIMIT $%d
+	`, scope, len(args)-1, len(args)), args...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list tags", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list tags",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListTagsResponse{Tags: []TagCount{}}
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Tag, &t.Projects); err != nil {
+			continue
+		}
+		resp.Tags = append(resp.Tags, t)
+	}
+	return resp, nil
+}
+
+// RenameTag renames a tag in every project of the workspace. Projects that
+// already have the new tag keep a single copy.
+//
+//encore:api auth method=POST path=/tags/rename
+func RenameTag(ctx context.Context, req *RenameTagRequest) (*RetagResponse, error) {
+	return retag(ctx, []string{req.From}, req.To, req.OrgID)
+}
+
+// MergeTags replaces several tags with one in every project of the
+// workspace.
+//
+//encore:api auth method=POST path=/tags/merge
+func MergeTags(ctx context.Context, req *MergeTagsRequest) (*RetagResponse, error) {
+	if len(req.From) > maxMergedTags {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("At most %d tags can be merged at once", maxMergedTags),
+		}
+	}
+	return retag(ctx, req.From, req.Into, req.OrgID)
+}
+
+// retag replaces the tags from with into, keeping each project's tag
+// order.
+func retag(ctx context.Context, from []string, into, orgID string) (*RetagResponse, error) {
+	sources, err := normalizeTags(from)
+	if err != nil {
+		return nil, err
+	}
+	target, err := normalizeTags([]string{into})
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 || len(target) == 0 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Tags to replace and a new tag are required",
+		}
+	}
+
+	args := []any{sources, target[0], auth.UserID()}
+	scope := `p.owner_id = $3 AND p.org_id IS NULL`
+	if orgID != "" {
+		if err := requireOrgMember(ctx, orgID, "admin"); err != nil {
+			return nil, err
+		}
+		args = append(args, orgID)
+		scope = `p.org_id::text = $4`
+	}
+
+	result, err := db.Exec(ctx, `
+		UPDATE projects p SET tags = ARRAY(
+			SELECT x.tag FROM (
+				SELECT CASE WHEN u.tag = ANY($1) THEN $2 ELSE u.tag END AS tag, MIN(u.n) AS n
+				FROM unnest(p.tags) WITH ORDINALITY AS u(tag, n)
+				GROUP BY 1
+			) x ORDER BY x.n
+		)
+		WHERE p.tags && $1 AND `+scope, args...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to retag projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update tags",
+		}
+	}
+	reqctx.Logger(ctx).Info("tags replaced", "from", sources, "into", target[0], "org_id", orgID, "projects", result.RowsAffected())
+	return &RetagResponse{Projects: int(result.RowsAffected())}, nil
+}
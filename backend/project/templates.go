@@ -0,0 +1,121 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// The template service (see the template package) keeps its own copy of a
+// project's canvas. Taking the copy detaches the canvas's assets from the
+// project, since they would otherwise be deleted with it; instantiating a
+// template copies them again into the new project like a fork does.
+
+// TemplateSnapshotRequest represents the template snapshot request
+type TemplateSnapshotRequest struct {
+	// Public makes the detached assets viewable by any signed-in user, for
+	// templates published to everyone
+	Public bool `json:"public,omitempty"`
+}
+
+// TemplateSnapshot is a copy of a project's canvas for a template
+type TemplateSnapshot struct {
+	Title        string          `json:"title"`
+	Description  string          `json:"description"`
+	Tags         []string        `json:"tags"`
+	CanvasData   json.RawMessage `json:"canvasData"`
+	CanvasWidth  int             `json:"canvasWidth"`
+	CanvasHeight int             `json:"canvasHeight"`
+	ColorProfile string          `json:"colorProfile"`
+	OrgID        *string         `json:"orgId,omitempty"`
+	// AssetIDs are the copies of the canvas's assets, owned by the caller
+	// and in no project. The template deletes them with itself.
+	AssetIDs []string `json:"assetIds"`
+}
+
+// CreateFromTemplateRequest represents an internal request to start a
+// project from a template
+type CreateFromTemplateRequest struct {
+	TemplateID   string          `json:"templateId"`
+	Title        string          `json:"title"`
+	Description  string          `json:"description"`
+	Tags         []string        `json:"tags"`
+	CanvasData   json.RawMessage `json:"canvasData"`
+	CanvasWidth  int             `json:"canvasWidth"`
+	CanvasHeight int             `json:"canvasHeight"`
+	ColorProfile string          `json:"colorProfile"`
+	// OrgID creates the project in an organization the caller belongs to
+	OrgID string `json:"orgId,omitempty"`
+}
+
+// SnapshotForTemplate copies a project's canvas for a template the caller
+// is publishing. The template service checks the caller may publish it.
+//
+//encore:api private method=POST path=/projects/internal/:id/template-snapshot
+func SnapshotForTemplate(ctx context.Context, id string, req *TemplateSnapshotRequest) (*TemplateSnapshot, error) {
+	src, err := loadCopySource(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Copy even the caller's own assets, outside the project, so they
+	// outlive it.
+	target := carryTarget{userID: auth.UserID(), copyAll: true, public: req.Public}
+	canvasData, _, assetIDs, err := carryAssets(ctx, src.canvasData, target)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to detach template assets", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to copy project",
+		}
+	}
+	if len(canvasData) == 0 {
+		canvasData = []byte("{}")
+	}
+	return &TemplateSnapshot{
+		Title:        src.title,
+		Description:  src.description,
+		Tags:         src.tags,
+		CanvasData:   canvasData,
+		CanvasWidth:  src.width,
+		CanvasHeight: src.height,
+		ColorProfile: src.colorProfile,
+		OrgID:        src.orgID,
+		AssetIDs:     assetIDs,
+	}, nil
+}
+
+// CreateFromTemplate creates a project for the caller with a copy of a
+// template's canvas. The template service checks the caller may use it.
+//
+//encore:api private method=POST path=/projects/internal/from-template
+func CreateFromTemplate(ctx context.Context, req *CreateFromTemplateRequest) (*CopyProjectResponse, error) {
+	src := &copySource{
+		title:        req.Title,
+		description:  req.Description,
+		canvasData:   req.CanvasData,
+		width:        req.CanvasWidth,
+		height:       req.CanvasHeight,
+		colorProfile: req.ColorProfile,
+		tags:         req.Tags,
+	}
+	project := src.newProject(auth.UserID(), copyTitle(req.Title, "Untitled"))
+	project.ShareLinksEnabled = true
+	if req.OrgID != "" {
+		if err := applyOrgDefaults(ctx, project, req.OrgID, nil); err != nil {
+			return nil, err
+		}
+		// The template's page setup wins over the organization's defaults.
+		project.CanvasWidth, project.CanvasHeight, project.ColorProfile = src.width, src.height, src.colorProfile
+	}
+
+	report, err := copyProject(ctx, "", src, project, false)
+	if err != nil {
+		return nil, err
+	}
+	reqctx.Logger(ctx).Info("project created from template", "project_id", project.ID, "template_id", req.TemplateID)
+	return copyResponse(ctx, project, report)
+}
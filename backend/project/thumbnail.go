@@ -0,0 +1,39 @@
+package project
+
+import (
+	"context"
+
+	"encore.dev/beta/auth"
+	"encore.dev/pubsub"
+
+	"canvasai/reqctx"
+	"canvasai/webhook"
+)
+
+// CanvasSave announces a new revision of a project's canvas
+type CanvasSave struct {
+	ProjectID string `json:"projectId"`
+	Revision  int    `json:"revision"`
+}
+
+// CanvasSaves is the topic canvas saves are announced on. The export
+// service renders the project's thumbnail from it.
+var CanvasSaves = pubsub.NewTopic[*CanvasSave]("project-canvas-saves", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// announceCanvasSave publishes a canvas save and its canvas.updated webhook
+// event. A failure only leaves the thumbnail stale until the next save, so
+// it is logged, not returned.
+func announceCanvasSave(ctx context.Context, projectID string, revision int) {
+	if _, err := CanvasSaves.Publish(ctx, &CanvasSave{ProjectID: projectID, Revision: revision}); err != nil {
+		reqctx.Logger(ctx).Error("failed to announce canvas save", "project_id", projectID, "error", err)
+	}
+	data := map[string]any{"projectId": projectID, "revision": revision}
+	if userID := auth.UserID(); userID != "" {
+		data["updatedBy"] = userID
+	}
+	if err := webhook.Emit(ctx, &webhook.Event{Type: webhook.EventCanvasUpdated, ProjectID: projectID}, data); err != nil {
+		reqctx.Logger(ctx).Error("failed to emit webhook event", "project_id", projectID, "error", err)
+	}
+}
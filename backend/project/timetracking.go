@@ -0,0 +1,471 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Agencies bill by the hour, so a project's owner can turn on time
+// tracking. While it is on, each save opens or extends the saver's edit
+// session: saves less than sessionIdleGap apart are one session, which
+// starts sessionLead before its first save to count the editing that led
+// to it. Anyone who can edit may also log time by hand. Entries are summed
+// per person for a project and per project for a person, and exported as
+// CSV for invoicing.
+
+// Time entry sources
+const (
+	TimeSourceSession = "session"
+	TimeSourceManual  = "manual"
+)
+
+const (
+	sessionIdleGap   = 15 * time.Minute
+	sessionLead      = time.Minute
+	maxManualEntry   = 24 * time.Hour
+	maxTimeEntryNote = 500
+	maxTimeEntries   = 1000
+)
+
+// TimeEntry is time one person spent on a project
+type TimeEntry struct {
+	ID        string    `json:"id"`
+	ProjectID string    `json:"projectId"`
+	UserID    string    `json:"userId"`
+	UserName  string    `json:"userName"`
+	Source    string    `json:"source"` // session or manual
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Seconds   int       `json:"seconds"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// TimeRange limits entries to those that started in [From, To); either
+// may be omitted
+type TimeRange struct {
+	From time.Time `query:"from"`
+	To   time.Time `query:"to"`
+}
+
+// SetTimeTrackingRequest represents the set time tracking request
+type SetTimeTrackingRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// TimeTrackingResponse represents a project's time tracking state
+type TimeTrackingResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SetTimeTracking turns recording edit sessions on or off. Manual entries
+// can be logged either way.
+//
+//encore:api auth method=PUT path=/projects/:id/time-tracking
+func SetTimeTracking(ctx context.Context, id string, req *SetTimeTrackingRequest) (*TimeTrackingResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectManage); err != nil {
+		return nil, err
+	}
+	_, err := db.Exec(ctx, `UPDATE projects SET time_tracking = $2 WHERE id = $1`, id, req.Enabled)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to set time tracking", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update time tracking",
+		}
+	}
+	return &TimeTrackingResponse{Enabled: req.Enabled}, nil
+}
+
+// recordEditSession extends userID's current edit session on projectID,
+// or starts one, if the project tracks time. A failure only loses the
+// time, so it is logged rather than failing the save.
+func recordEditSession(ctx context.Context, projectID, userID string) {
+	now := time.Now()
+	_, err := db.Exec(ctx, `
+		WITH tracking AS (
+			SELECT 1 FROM projects WHERE id = $1 AND time_tracking
+		), extended AS (
+			UPDATE project_time_entries SET ended_at = $3
+			WHERE id = (
+				SELECT id FROM project_time_entries
+				WHERE project_id = $1 AND user_id = $2 AND source = 'session' AND ended_at > $4
+				ORDER BY ended_at DESC
+				LIMIT 1
+			) AND EXISTS (SELECT 1 FROM tracking)
+			RETURNING id
+		)
+		INSERT INTO project_time_entries (project_id, user_id, source, started_at, ended_at)
+		SELECT $1, $2, 'session', $5, $3
+		WHERE EXISTS (SELECT 1 FROM tracking) AND NOT EXISTS (SELECT 1 FROM extended)
+	`, projectID, userID, now, now.Add(-sessionIdleGap), now.Add(-sessionLead))
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to record edit session", "project_id", projectID, "user_id", userID, "error", err)
+	}
+}
+
+// LogTimeRequest represents a manual time entry
+type LogTimeRequest struct {
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// LogTime records time the caller spent on a project.
+//
+//encore:api auth method=POST path=/projects/:id/time-entries
+func LogTime(ctx context.Context, id string, req *LogTimeRequest) (*TimeEntry, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	note := strings.TrimSpace(req.Note)
+	switch {
+	case req.StartedAt.IsZero() || !req.EndedAt.After(req.StartedAt):
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "endedAt must be after startedAt",
+		}
+	case req.EndedAt.Sub(req.StartedAt) > maxManualEntry:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "An entry can be at most 24 hours",
+		}
+	case req.EndedAt.After(time.Now().Add(time.Minute)):
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Time cannot be logged in the future",
+		}
+	case len([]rune(note)) > maxTimeEntryNote:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("Note must be at most %d characters", maxTimeEntryNote),
+		}
+	}
+
+	var entryID string
+	err := db.QueryRow(ctx, `
+		INSERT INTO project_time_entries (project_id, user_id, source, started_at, ended_at, note)
+		VALUES ($1, $2, 'manual', $3, $4, $5)
+		RETURNING id
+	`, id, auth.UserID(), req.StartedAt.UTC(), req.EndedAt.UTC(), note).Scan(&entryID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to log time", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to log time",
+		}
+	}
+	entries, err := timeEntries(ctx, `e.id = $1`, entryID)
+	if err != nil || len(entries) == 0 {
+		reqctx.Logger(ctx).Error("failed to load time entry", "project_id", id, "entry_id", entryID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to log time",
+		}
+	}
+	return &entries[0], nil
+}
+
+// DeleteTimeEntry deletes an entry of the caller's, or any entry of a
+// project the caller owns.
+//
+//encore:api auth method=DELETE path=/projects/:id/time-entries/:entryID
+func DeleteTimeEntry(ctx context.Context, id string, entryID string) error {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return err
+	}
+	userID := auth.UserID()
+	role, err := permissions.RoleFor(ctx, permissions.Project(id))
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete time entry",
+		}
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM project_time_entries
+		WHERE id::text = $1 AND project_id = $2 AND (user_id = $3 OR $4)
+	`, entryID, id, userID, permissions.Can(role, permissions.ProjectManage))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete time entry", "project_id", id, "entry_id", entryID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete time entry",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Time entry not found",
+		}
+	}
+	return nil
+}
+
+// ListTimeEntriesResponse represents a project's time entries, oldest first
+type ListTimeEntriesResponse struct {
+	Entries []TimeEntry `json:"entries"`
+}
+
+//encore:api auth method=GET path=/projects/:id/time-entries
+func ListTimeEntries(ctx context.Context, id string, req *TimeRange) (*ListTimeEntriesResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	entries, err := timeEntries(ctx, `e.project_id = $1`+rangeFilter(req, 2), rangeArgs(id, req)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list time entries", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch time entries",
+		}
+	}
+	return &ListTimeEntriesResponse{Entries: entries}, nil
+}
+
+// TimeTotal is the time spent by one person, or on one project
+type TimeTotal struct {
+	UserID    string `json:"userId,omitempty"`
+	UserName  string `json:"userName,omitempty"`
+	ProjectID string `json:"projectId,omitempty"`
+	Title     string `json:"title,omitempty"`
+	// SessionSeconds were recorded from edits, ManualSeconds logged by hand
+	SessionSeconds int `json:"sessionSeconds"`
+	ManualSeconds  int `json:"manualSeconds"`
+	TotalSeconds   int `json:"totalSeconds"`
+}
+
+// TimeSummary totals time entries
+type TimeSummary struct {
+	Totals       []TimeTotal `json:"totals"`
+	TotalSeconds int         `json:"totalSeconds"`
+}
+
+// ProjectTimeSummary totals a project's time per person.
+//
+//encore:api auth method=GET path=/projects/:id/time-summary
+func ProjectTimeSummary(ctx context.Context, id string, req *TimeRange) (*TimeSummary, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	summary, err := timeSummary(ctx, true, `e.project_id = $1`+rangeFilter(req, 2), rangeArgs(id, req)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to summarize project time", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to summarize time",
+		}
+	}
+	return summary, nil
+}
+
+// MyTimeSummary totals the caller's time per project.
+//
+//encore:api auth method=GET path=/time-summary
+func MyTimeSummary(ctx context.Context, req *TimeRange) (*TimeSummary, error) {
+	userID := auth.UserID()
+	summary, err := timeSummary(ctx, false, `e.user_id = $1`+rangeFilter(req, 2), rangeArgs(userID, req)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to summarize user time", "user_id", userID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to summarize time",
+		}
+	}
+	return summary, nil
+}
+
+// ExportProjectTime is a CSV of ProjectTimeSummary for invoicing. It
+// takes the same from and to filters, as RFC 3339 times.
+//
+//encore:api auth raw method=GET path=/projects/:id/reports/time
+func ExportProjectTime(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := encore.CurrentRequest().PathParams.Get("id")
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	r, err := parseTimeRange(req)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	summary, err := timeSummary(ctx, true, `e.project_id = $1`+rangeFilter(r, 2), rangeArgs(id, r)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to summarize project time for export", "project_id", id, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeTimeCSV(w, "user", summary)
+}
+
+// ExportMyTime is a CSV of MyTimeSummary.
+//
+//encore:api auth raw method=GET path=/reports/time
+func ExportMyTime(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userID := auth.UserID()
+	r, err := parseTimeRange(req)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	summary, err := timeSummary(ctx, false, `e.user_id = $1`+rangeFilter(r, 2), rangeArgs(userID, r)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to summarize user time for export", "user_id", userID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeTimeCSV(w, "project", summary)
+}
+
+// writeTimeCSV writes summary with one row per total, named in the column
+// first, and hours to two decimals.
+func writeTimeCSV(w http.ResponseWriter, first string, summary *TimeSummary) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="time-%s.csv"`, time.Now().UTC().Format(time.DateOnly)))
+	w.Header().Set("Cache-Control", "no-store")
+	out := csv.NewWriter(w)
+	out.Write([]string{first + "_id", first, "session_hours", "manual_hours", "total_hours"})
+	for _, t := range summary.Totals {
+		id, name := t.UserID, t.UserName
+		if first == "project" {
+			id, name = t.ProjectID, t.Title
+		}
+		out.Write([]string{id, csvCell(name), hours(t.SessionSeconds), hours(t.ManualSeconds), hours(t.TotalSeconds)})
+	}
+	out.Flush()
+}
+
+func hours(seconds int) string {
+	return strconv.FormatFloat(float64(seconds)/3600, 'f', 2, 64)
+}
+
+// parseTimeRange reads the from and to query parameters of a raw
+// request.
+func parseTimeRange(req *http.Request) (*TimeRange, error) {
+	r := &TimeRange{}
+	for name, t := range map[string]*time.Time{"from": &r.From, "to": &r.To} {
+		v := req.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: name + " must be an RFC 3339 time",
+			}
+		}
+		*t = parsed
+	}
+	return r, nil
+}
+
+// rangeFilter is the SQL condition for r, with its parameters numbered
+// from n.
+func rangeFilter(r *TimeRange, n int) string {
+	var filter string
+	if !r.From.IsZero() {
+		filter += fmt.Sprintf(` AND e.started_at >= $%d`, n)
+		n++
+	}
+	if !r.To.IsZero() {
+		filter += fmt.Sprintf(` AND e.started_at < $%d`, n)
+	}
+	return filter
+}
+
+// rangeArgs are the query arguments for first and rangeFilter(r).
+func rangeArgs(first string, r *TimeRange) []any {
+	args := []any{first}
+	if !r.From.IsZero() {
+		args = append(args, r.From.UTC())
+	}
+	if !r.To.IsZero() {
+		args = append(args, r.To.UTC())
+	}
+	return args
+}
+
+// timeEntries lists the entries matching filter, oldest first.
+func timeEntries(ctx context.Context, filter string, args ...any) ([]TimeEntry, error) {
+	rows, err := db.Query(ctx, `
+		SELECT e.id, e.project_id, e.user_id, COALESCE(u.name, ''), e.source, e.started_at, e.ended_at, e.note
+		FROM project_time_entries e
+		LEFT JOIN users u ON u.id = e.user_id
+		WHERE `+filter+`
+		ORDER BY e.started_at, e.id
+		LIMIT `+strconv.Itoa(maxTimeEntries), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []TimeEntry{}
+	for rows.Next() {
+		var e TimeEntry
+		if err := rows.Scan(&e.ID, &e.ProjectID, &e.UserID, &e.UserName, &e.Source, &e.StartedAt, &e.EndedAt, &e.Note); err != nil {
+			return nil, err
+		}
+		e.Seconds = int(e.EndedAt.Sub(e.StartedAt).Seconds())
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// timeSummary totals the entries matching filter per person, or else per
+// project, largest first.
+func timeSummary(ctx context.Context, byUser bool, filter string, args ...any) (*TimeSummary, error) {
+	groupBy := `e.project_id, p.title`
+	if byUser {
+		groupBy = `e.user_id, u.name`
+	}
+	rows, err := db.Query(ctx, `
+		SELECT `+groupBy+`,
+			COALESCE(SUM(EXTRACT(EPOCH FROM e.ended_at - e.started_at)) FILTER (WHERE e.source = 'session'), 0)::bigint,
+			COALESCE(SUM(EXTRACT(EPOCH FROM e.ended_at - e.started_at)) FILTER (WHERE e.source = 'manual'), 0)::bigint
+		FROM project_time_entries e
+		JOIN users u ON u.id = e.user_id
+		JOIN projects p ON p.id = e.project_id
+		WHERE `+filter+`
+		GROUP BY `+groupBy+`
+		ORDER BY SUM(e.ended_at - e.started_at) DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := &TimeSummary{Totals: []TimeTotal{}}
+	for rows.Next() {
+		var t TimeTotal
+		var key string
+		var name sql.NullString
+		if err := rows.Scan(&key, &name, &t.SessionSeconds, &t.ManualSeconds); err != nil {
+			return nil, err
+		}
+		if byUser {
+			t.UserID, t.UserName = key, name.String
+		} else {
+			t.ProjectID, t.Title = key, name.String
+		}
+		t.TotalSeconds = t.SessionSeconds + t.ManualSeconds
+		summary.TotalSeconds += t.TotalSeconds
+		summary.Totals = append(summary.Totals, t)
+	}
+	return summary, rows.Err()
+}
@@ -0,0 +1,207 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Deleting a project moves it to the trash. A trashed project keeps its
+// data, slug and collaborators but grants no access (see projectRole) and
+// is left out of lists, search and share links. Only its owner sees it, in
+// the trash, and can restore it or delete it for good until it is purged.
+
+const trashRetentionDays = 30
+
+// TrashedProject is a project in the trash
+type TrashedProject struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Thumbnail string    `json:"thumbnail,omitempty"`
+	OrgID     *string   `json:"orgId,omitempty"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy *string   `json:"deletedBy,omitempty"`
+	// PurgeAt is when the project is deleted for good
+	PurgeAt time.Time `json:"purgeAt"`
+}
+
+// ListTrashRequest represents the list trash request
+type ListTrashRequest struct {
+	Limit  int `query:"limit"`
+	Offset int `query:"offset"`
+}
+
+// ListTrashResponse represents the list trash response
+type ListTrashResponse struct {
+	Projects []TrashedProject `json:"projects"`
+	Total    int              `json:"total"`
+	Limit    int              `json:"limit"`
+	Offset   int              `json:"offset"`
+}
+
+// ListTrash returns the projects the user owns that are in the trash,
+// most recently deleted first.
+//
+//encore:api auth method=GET path=/projects/trash
+func ListTrash(ctx context.Context, req *ListTrashRequest) (*ListTrashResponse, error) {
+	userID := auth.UserID()
+	limit := req.Limit
+	if limit <= 0 || limit > maxProjectPageSize {
+		limit = defaultProjectPageSize
+	}
+	offset := max(req.Offset, 0)
+
+	resp := &ListTrashResponse{Projects: []TrashedProject{}, Limit: limit, Offset: offset}
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM projects WHERE owner_id = $1 AND deleted_at IS NOT NULL
+	`, userID).Scan(&resp.Total)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to count trashed projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch trash",
+		}
+	}
+	if resp.Total == 0 {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, title, COALESCE(thumbnail, ''), org_id, deleted_at, deleted_by
+		FROM projects
+		WHERE owner_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id
+		LIMIT $2 OFFSET $3
+	`, userID, limit, offset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list trashed projects", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch trash",
+		}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p TrashedProject
+		if err := rows.Scan(&p.ID, &p.Title, &p.Thumbnail, &p.OrgID, &p.DeletedAt, &p.DeletedBy); err != nil {
+			continue
+		}
+		p.PurgeAt = p.DeletedAt.AddDate(0, 0, trashRetentionDays)
+		resp.Projects = append(resp.Projects, p)
+	}
+	return resp, nil
+}
+
+// RestoreProject takes a project out of the trash, with the access,
+// share links and slug it had.
+//
+//encore:api auth method=POST path=/projects/:id/restore
+func RestoreProject(ctx context.Context, id string) (*Project, error) {
+	trashed, err := loadOwnedProject(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !trashed {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project is not in the trash",
+		}
+	}
+	if err := checkProjectQuota(ctx, auth.UserID()); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE projects SET deleted_at = NULL, deleted_by = NULL WHERE id = $1
+	`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to restore project", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to restore project",
+		}
+	}
+	projectaccess.Forget(id)
+	reqctx.Logger(ctx).Info("project restored from trash", "project_id", id)
+	return GetProject(ctx, id)
+}
+
+// DeleteProjectPermanently deletes a project for good, whether or not it
+// is in the trash. It cannot be undone.
+//
+//encore:api auth method=DELETE path=/projects/:id/permanent
+func DeleteProjectPermanently(ctx context.Context, id string) error {
+	trashed, err := loadOwnedProject(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !trashed {
+		if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectDelete); err != nil {
+			return err
+		}
+	}
+
+	// Delete project (cascading deletes will handle collaborators)
+	if _, err := db.Exec(ctx, "DELETE FROM projects WHERE id = $1", id); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete project", "project_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete project",
+		}
+	}
+	reqctx.Logger(ctx).Info("project deleted permanently", "project_id", id)
+	return nil
+}
+
+// loadOwnedProject reports whether a project the user owns is in the
+// trash. Projects owned by someone else are not found, as trashed ones
+// are invisible to everyone but their owner.
+func loadOwnedProject(ctx context.Context, id string) (trashed bool, err error) {
+	var ownerID string
+	var deletedAt sql.NullTime
+	err = db.QueryRow(ctx, `
+		SELECT owner_id, deleted_at FROM projects WHERE id::text = $1
+	`, id).Scan(&ownerID, &deletedAt)
+	if err == sql.ErrNoRows || (err == nil && ownerID != auth.UserID()) {
+		return false, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project", "project_id", id, "error", err)
+		return false, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load project",
+		}
+	}
+	return deletedAt.Valid, nil
+}
+
+// Empty the trash of projects deleted more than 30 days ago.
+var _ = cron.NewJob("purge-trashed-projects", cron.JobConfig{
+	Title:    "Delete projects that have been in the trash for 30 days",
+	Every:    1 * cron.Hour,
+	Endpoint: PurgeTrashedProjects,
+})
+
+//encore:api private
+func PurgeTrashedProjects(ctx context.Context) error {
+	result, err := db.Exec(ctx, `
+		DELETE FROM projects WHERE deleted_at < NOW() - $1 * INTERVAL '1 day'
+	`, trashRetentionDays)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to purge trashed projects", "error", err)
+		return err
+	}
+	reqctx.Logger(ctx).Info("purged trashed projects", "count", result.RowsAffected())
+	return nil
+}
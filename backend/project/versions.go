@@ -0,0 +1,406 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/cron"
+
+	"canvasai/permissions"
+	"canvasai/realtime"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Saves overwrite the canvas, so its history is kept as snapshots in
+// project_versions, each capturing one revision. Users take manual
+// snapshots; saves take an automatic one of the revision they are about to
+// overwrite when the last snapshot is old or the element count changes a
+// lot. Restoring a snapshot saves it as a new revision after snapshotting
+// the current one, so a restore can itself be undone. Automatic snapshots
+// beyond the retention limit are pruned; manual ones are kept.
+
+// Snapshot kinds
+const (
+	SnapshotManual = "manual"
+	SnapshotAuto   = "auto"
+)
+
+// ProjectVersionPolicy configures automatic snapshots
+type ProjectVersionPolicy struct {
+	// IntervalMinutes is the most time a save goes without an automatic
+	// snapshot. Zero uses the default.
+	IntervalMinutes int `json:"intervalMinutes"`
+	// MinElementChange is the change in element count that triggers a
+	// snapshot sooner. Zero uses the default.
+	MinElementChange int `json:"minElementChange"`
+	// KeepAuto is the number of automatic snapshots kept per project. Zero
+	// uses the default.
+	KeepAuto int `json:"keepAuto"`
+}
+
+var versionCfg struct {
+	ProjectVersions ProjectVersionPolicy
+}
+
+var _ = config.Load(context.Background(), &versionCfg)
+
+const (
+	defaultSnapshotInterval  = 10
+	defaultMinElementChange  = 10
+	defaultAutoSnapshotsKept = 100
+	maxSnapshotLabel         = 255
+)
+
+// ProjectVersion is a snapshot of a project
+type ProjectVersion struct {
+	ID string `json:"id"`
+	// Revision is the project revision the snapshot captured
+	Revision     int       `json:"revision"`
+	Kind         string    `json:"kind"`
+	Label        string    `json:"label,omitempty"`
+	Title        string    `json:"title"`
+	ElementCount int       `json:"elementCount"`
+	CreatedBy    string    `json:"createdBy"`
+	CreatedAt    time.Time `json:"createdAt"`
+
+	// Set when fetching a single version
+	CanvasData   any `json:"canvasData,omitempty"`
+	CanvasWidth  int `json:"canvasWidth,omitempty"`
+	CanvasHeight int `json:"canvasHeight,omitempty"`
+}
+
+// ListProjectVersionsRequest represents the list project versions request
+type ListProjectVersionsRequest struct {
+	// Kind limits the list to manual or auto snapshots
+	Kind   string `query:"kind"`
+	Limit  int    `query:"limit"`
+	Offset int    `query:"offset"`
+}
+
+// ListProjectVersionsResponse represents a page of snapshots, newest first
+type ListProjectVersionsResponse struct {
+	Versions []ProjectVersion `json:"versions"`
+	Total    int              `json:"total"`
+	Limit    int              `json:"limit"`
+	Offset   int              `json:"offset"`
+}
+
+// CreateProjectVersionRequest represents the create project version request
+type CreateProjectVersionRequest struct {
+	Label string `json:"label,omitempty"`
+}
+
+// ListProjectVersions lists a project's snapshots, newest first.
+//
+//encore:api auth method=GET path=/projects/:id/versions
+func ListProjectVersions(ctx context.Context, id string, req *ListProjectVersionsRequest) (*ListProjectVersionsResponse, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+	if req.Kind != "" && req.Kind != SnapshotManual && req.Kind != SnapshotAuto {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "kind must be manual or auto",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxProjectPageSize {
+		limit = defaultProjectPageSize
+	}
+	offset := max(req.Offset, 0)
+
+	resp := &ListProjectVersionsResponse{Versions: []ProjectVersion{}, Limit: limit, Offset: offset}
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM project_versions WHERE project_id = $1 AND ($2 = '' OR kind = $2)
+	`, id, req.Kind).Scan(&resp.Total)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to count project versions", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list versions",
+		}
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, version_number, kind, COALESCE(label, ''), COALESCE(title, ''), element_count, created_by, created_at
+		FROM project_versions
+		WHERE project_id = $1 AND ($2 = '' OR kind = $2)
+		ORDER BY version_number DESC
+		LIMIT $3 OFFSET $4
+	`, id, req.Kind, limit, offset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list project versions", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list versions",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v ProjectVersion
+		if err := rows.Scan(&v.ID, &v.Revision, &v.Kind, &v.Label, &v.Title, &v.ElementCount, &v.CreatedBy, &v.CreatedAt); err != nil {
+			continue
+		}
+		resp.Versions = append(resp.Versions, v)
+	}
+	return resp, nil
+}
+
+// CreateProjectVersion takes a manual snapshot of the project's current
+// revision. A revision that already has an automatic snapshot has it
+// promoted instead, so it is kept.
+//
+//encore:api auth method=POST path=/projects/:id/versions
+func CreateProjectVersion(ctx context.Context, id string, req *CreateProjectVersionRequest) (*ProjectVersion, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+	label := strings.TrimSpace(req.Label)
+	if len(label) > maxSnapshotLabel {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Label must be at most 255 characters",
+		}
+	}
+
+	var versionID string
+	err := db.QueryRow(ctx, `
+		INSERT INTO project_versions (project_id, version_number, canvas_data, thumbnail, title, description, created_by,
+			kind, label, canvas_width, canvas_height, element_count)
+		SELECT id, version, COALESCE(canvas_data, '{}'), thumbnail, title, description, $2,
+			$3, NULLIF($4, ''), canvas_width, canvas_height, canvas_element_count(canvas_data)
+		FROM projects WHERE id = $1
+		ON CONFLICT (project_id, version_number) DO UPDATE
+		SET kind = EXCLUDED.kind, label = COALESCE(EXCLUDED.label, project_versions.label)
+		RETURNING id
+	`, id, auth.UserID(), SnapshotManual, label).Scan(&versionID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create project version", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create version",
+		}
+	}
+	reqctx.Logger(ctx).Info("project version created", "project_id", id, "version_id", versionID)
+	return getProjectVersion(ctx, id, versionID, false)
+}
+
+// GetProjectVersion returns a snapshot including its canvas.
+//
+//encore:api auth method=GET path=/projects/:id/versions/:vid
+func GetProjectVersion(ctx context.Context, id string, vid string) (*ProjectVersion, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectView); err != nil {
+		return nil, err
+	}
+	return getProjectVersion(ctx, id, vid, true)
+}
+
+// RestoreProjectVersion saves a snapshot's canvas and page size as a new
+// revision of the project. The revision it replaces is snapshotted first.
+//
+//encore:api auth method=POST path=/projects/:id/versions/:vid/restore
+func RestoreProjectVersion(ctx context.Context, id string, vid string) (*Project, error) {
+	userID := auth.UserID()
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectEdit); err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	var revision int
+	var width, height sql.NullInt64
+	err := db.QueryRow(ctx, `
+		SELECT canvas_data, version_number, canvas_width, canvas_height
+		FROM project_versions WHERE project_id = $1 AND id::text = $2
+	`, id, vid).Scan(&raw, &revision, &width, &height)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Version not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project version", "project_id", id, "version_id", vid, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to restore version",
+		}
+	}
+
+	// Frozen assets stay at the versions the project froze them at now.
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Version canvas data is invalid",
+		}
+	}
+	if doc, err = applyAssetLinks(ctx, id, doc); err == nil {
+		raw, err = json.Marshal(doc)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to apply asset links", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to restore version",
+		}
+	}
+	_, assetRefs, err := buildAssetIndex(raw)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Version canvas data is invalid",
+		}
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to restore version",
+		}
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO project_versions (project_id, version_number, canvas_data, thumbnail, title, description, created_by,
+			kind, canvas_width, canvas_height, element_count)
+		SELECT id, version, canvas_data, thumbnail, title, description, COALESCE(last_saved_by, owner_id),
+			$2, canvas_width, canvas_height, canvas_element_count(canvas_data)
+		FROM projects WHERE id = $1 AND canvas_data IS NOT NULL
+		ON CONFLICT (project_id, version_number) DO NOTHING
+	`, id, SnapshotAuto)
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+			UPDATE projects
+			SET canvas_data = $2, canvas_width = COALESCE($3, canvas_width), canvas_height = COALESCE($4, canvas_height),
+				asset_refs = $5, version = version + 1, updated_at = NOW(), last_saved_by = $6
+			WHERE id = $1
+		`, id, raw, width, height, assetRefs, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to restore project version", "project_id", id, "version_id", vid, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to restore version",
+		}
+	}
+
+	project, err := GetProject(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	event := map[string]any{"versionId": vid, "restoredRevision": revision, "revision": project.Revision, "restoredBy": userID}
+	if err := realtime.Publish(ctx, id, realtime.EventProjectRestored, event); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish project restore", "project_id", id, "error", err)
+	}
+	announceCanvasSave(ctx, id, project.Revision)
+	reqctx.Logger(ctx).Info("project version restored", "project_id", id, "version_id", vid, "restored_revision", revision)
+	return project, nil
+}
+
+func getProjectVersion(ctx context.Context, projectID, versionID string, withCanvas bool) (*ProjectVersion, error) {
+	var v ProjectVersion
+	var raw []byte
+	var width, height sql.NullInt64
+	err := db.QueryRow(ctx, `
+		SELECT id, version_number, kind, COALESCE(label, ''), COALESCE(title, ''), element_count, created_by, created_at,
+			canvas_data, canvas_width, canvas_height
+		FROM project_versions WHERE project_id = $1 AND id::text = $2
+	`, projectID, versionID).Scan(&v.ID, &v.Revision, &v.Kind, &v.Label, &v.Title, &v.ElementCount, &v.CreatedBy, &v.CreatedAt,
+		&raw, &width, &height)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Version not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project version", "project_id", projectID, "version_id", versionID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load version",
+		}
+	}
+	if withCanvas {
+		v.CanvasData = json.RawMessage(raw)
+		v.CanvasWidth, v.CanvasHeight = int(width.Int64), int(height.Int64)
+	}
+	return &v, nil
+}
+
+// snapshotBeforeSave takes an automatic snapshot of the revision a save of
+// canvasData is about to overwrite, if the last snapshot is older than the
+// interval or the element count changes by at least MinElementChange.
+// baseRevision, when set, skips the snapshot if the save will be rejected.
+func snapshotBeforeSave(ctx context.Context, projectID string, baseRevision *int, canvasData []byte) error {
+	p := versionCfg.ProjectVersions
+	if p.IntervalMinutes <= 0 {
+		p.IntervalMinutes = defaultSnapshotInterval
+	}
+	if p.MinElementChange <= 0 {
+		p.MinElementChange = defaultMinElementChange
+	}
+	elements := 0
+	if pages, err := render.ParsePages(canvasData); err == nil {
+		for _, page := range pages {
+			elements += len(page.Objects)
+		}
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO project_versions (project_id, version_number, canvas_data, thumbnail, title, description, created_by,
+			kind, canvas_width, canvas_height, element_count)
+		SELECT p.id, p.version, p.canvas_data, p.thumbnail, p.title, p.description, COALESCE(p.last_saved_by, p.owner_id),
+			$5, p.canvas_width, p.canvas_height, canvas_element_count(p.canvas_data)
+		FROM projects p
+		WHERE p.id = $1 AND p.canvas_data IS NOT NULL AND ($2::int IS NULL OR p.version = $2)
+			AND (
+				NOT EXISTS (
+					SELECT 1 FROM project_versions v
+					WHERE v.project_id = p.id AND v.created_at > NOW() - $3 * INTERVAL '1 minute'
+				)
+				OR abs(canvas_element_count(p.canvas_data) - $4) >= $6
+			)
+		ON CONFLICT (project_id, version_number) DO NOTHING
+	`, projectID, baseRevision, p.IntervalMinutes, elements, SnapshotAuto, p.MinElementChange)
+	return err
+}
+
+// Prune automatic snapshots past retention once a day.
+var _ = cron.NewJob("prune-project-versions", cron.JobConfig{
+	Title:    "Delete automatic project snapshots past retention",
+	Every:    24 * cron.Hour,
+	Endpoint: PruneProjectVersions,
+})
+
+//encore:api private
+func PruneProjectVersions(ctx context.Context) error {
+	keep := versionCfg.ProjectVersions.KeepAuto
+	if keep <= 0 {
+		keep = defaultAutoSnapshotsKept
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM project_versions WHERE id IN (
+			SELECT id FROM (
+				SELECT id, row_number() OVER (PARTITION BY project_id ORDER BY version_number DESC) AS rank
+				FROM project_versions WHERE kind = $2
+			) v
+			WHERE rank > $1
+		)
+	`, keep, SnapshotAuto)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to prune project versions", "error", err)
+		return err
+	}
+	reqctx.Logger(ctx).Info("pruned project versions", "count", result.RowsAffected())
+	return nil
+}
@@ -0,0 +1,188 @@
+package project
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+
+	"canvasai/region"
+	"canvasai/render"
+	"canvasai/reqctx"
+	"canvasai/webpolicy"
+)
+
+// Share link viewers never edit, so instead of the full canvas document they
+// can load a flattened payload: groups dissolved into absolutely positioned
+// elements and editor-only properties dropped (see render.Flatten). It is
+// built once per revision and stored in project_view_payloads, so repeat
+// public traffic costs a single row read.
+
+// SharedView is the viewer payload for a share link. When the link targets
+// a page or element only that page is included.
+type SharedView struct {
+	ProjectID     string            `json:"projectId"`
+	Title         string            `json:"title"`
+	Slug          string            `json:"slug"`
+	Description   string            `json:"description,omitempty"`
+	Role          string            `json:"role"`
+	CanvasWidth   int               `json:"canvasWidth"`
+	CanvasHeight  int               `json:"canvasHeight"`
+	Revision      int               `json:"revision"`
+	PageID        string            `json:"pageId,omitempty"`
+	ElementID     string            `json:"elementId,omitempty"`
+	Pages         []render.ViewPage `json:"pages"`
+	TargetMissing bool              `json:"targetMissing,omitempty"`
+}
+
+//encore:api public method=GET path=/shared/:token/view
+func GetSharedView(ctx context.Context, token string) (*SharedView, error) {
+	target, err := openShareLink(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	projectID, pageID, elementID := target.projectID, target.pageID, target.elementID
+
+	view := &SharedView{ProjectID: projectID, PageID: pageID, ElementID: elementID, Role: target.role}
+	err = db.QueryRow(ctx, `
+		SELECT title, COALESCE(slug, ''), COALESCE(description, ''), canvas_width, canvas_height, version
+		FROM projects WHERE id = $1
+	`, projectID).Scan(&view.Title, &view.Slug, &view.Description, &view.CanvasWidth, &view.CanvasHeight, &view.Revision)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+
+	pages, revision, err := loadViewPages(ctx, projectID, view.Revision)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to build view payload", "project_id", projectID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load shared project",
+		}
+	}
+	view.Revision = revision
+
+	if pageID == "" && elementID == "" {
+		view.Pages = pages
+		return view, nil
+	}
+	page := findViewPage(pages, pageID)
+	if page == nil {
+		view.TargetMissing = true
+		page = &pages[0]
+	}
+	if elementID != "" && !hasViewElement(page, elementID) {
+		view.TargetMissing = true
+	}
+	view.Pages = []render.ViewPage{*page}
+	return view, nil
+}
+
+// GetSharedEmbed serves the same payload as GetSharedView to other sites.
+// Only the configured origins and those of the project's organization may
+// frame it or read it cross-origin (see webpolicy.Embed).
+//
+//encore:api public raw method=GET path=/shared/:token/embed
+func GetSharedEmbed(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	view, err := GetSharedView(ctx, encore.CurrentRequest().PathParams.Get("token"))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	var orgID string
+	err = db.QueryRow(ctx, `SELECT COALESCE(org_id::text, '') FROM projects WHERE id = $1`, view.ProjectID).Scan(&orgID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load project organization", "project_id", view.ProjectID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !webpolicy.Embed(ctx, w, req, orgID) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(view)
+}
+
+// loadViewPages returns the flattened pages of a project and the revision
+// they were built from. A payload stored for revision is served as is;
+// otherwise it is built from the current document and stored.
+func loadViewPages(ctx context.Context, projectID string, revision int) ([]render.ViewPage, int, error) {
+	var raw []byte
+	err := db.QueryRow(ctx, `
+		SELECT payload FROM project_view_payloads WHERE project_id = $1 AND revision = $2
+	`, projectID, revision).Scan(&raw)
+	if err == nil {
+		var pages []render.ViewPage
+		if err := json.Unmarshal(raw, &pages); err == nil && len(pages) > 0 {
+			return pages, revision, nil
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+
+	// A save may have landed since revision was read; build from whatever
+	// is current and store it under that revision.
+	var canvasData []byte
+	err = db.QueryRow(ctx, `SELECT canvas_data, version FROM projects WHERE id = $1`, projectID).Scan(&canvasData, &revision)
+	if err != nil {
+		return nil, 0, err
+	}
+	parsed, err := render.ParsePages(canvasData)
+	if err != nil {
+		return nil, 0, err
+	}
+	pages := render.Flatten(parsed)
+
+	if region.ReadOnly(ctx) {
+		// The payload is stored once the primary builds it.
+		return pages, revision, nil
+	}
+	payload, err := json.Marshal(pages)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO project_view_payloads (project_id, revision, payload)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (project_id) DO UPDATE
+		SET revision = EXCLUDED.revision, payload = EXCLUDED.payload, created_at = NOW()
+		WHERE project_view_payloads.revision < EXCLUDED.revision
+	`, projectID, revision, payload)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to store view payload", "project_id", projectID, "error", err)
+	}
+	return pages, revision, nil
+}
+
+func findViewPage(pages []render.ViewPage, id string) *render.ViewPage {
+	for i := range pages {
+		if id == "" || pages[i].ID == id {
+			return &pages[i]
+		}
+	}
+	return nil
+}
+
+func hasViewElement(page *render.ViewPage, id string) bool {
+	for _, el := range page.Elements {
+		if el.ID == id {
+			return true
+		}
+		for _, group := range el.Groups {
+			if group == id {
+				return true
+			}
+		}
+	}
+	return false
+}
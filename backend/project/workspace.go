@@ -0,0 +1,100 @@
+package project
+
+import (
+	"context"
+	"strings"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// MoveProjectRequest moves a project between workspaces
+type MoveProjectRequest struct {
+	// OrgID is the organization to move the project into; empty makes it a
+	// personal project again
+	OrgID string `json:"orgId"`
+}
+
+// MoveProject files a project, and the assets uploaded to it, under another
+// organization or back under its owner. Only the owner can move a project;
+// taking it out of an organization also needs that organization's admin.
+// The project keeps its slug unless the destination already uses it.
+//
+//encore:api auth method=PUT path=/projects/:id/org
+func MoveProject(ctx context.Context, id string, req *MoveProjectRequest) (*Project, error) {
+	if err := permissions.Authorize(ctx, permissions.Project(id), permissions.ProjectManage); err != nil {
+		return nil, err
+	}
+
+	var current *string
+	var ownerID, slug string
+	err := db.QueryRow(ctx, `
+		SELECT org_id, owner_id, COALESCE(slug, '') FROM projects WHERE id = $1
+	`, id).Scan(&current, &ownerID, &slug)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	if current != nil && *current == req.OrgID {
+		return GetProject(ctx, id)
+	}
+	if current != nil {
+		if err := requireOrgMember(ctx, *current, "admin"); err != nil {
+			return nil, err
+		}
+	}
+	var target *string
+	if req.OrgID != "" {
+		if err := requireOrgMember(ctx, req.OrgID, "admin", "member"); err != nil {
+			return nil, err
+		}
+		target = &req.OrgID
+	}
+
+	// The slug may already be used in the destination workspace.
+	newSlug, err := uniqueSlug(ctx, slugify(slug), ownerID, target, id)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(newSlug, slug) {
+		newSlug = slug
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to move project",
+		}
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `UPDATE projects SET org_id = $2, slug = $3, updated_at = NOW() WHERE id = $1`, id, target, newSlug)
+	if err == nil && slug != "" {
+		// Links using the old slug resolve in the workspace they came from.
+		err = recordSlugRedirect(ctx, tx, id, ownerID, current, slug)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE assets SET org_id = $2 WHERE project_id = $1`, id, target)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to move project", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to move project",
+		}
+	}
+
+	projectaccess.Forget(id)
+	reqctx.Logger(ctx).Info("project moved", "project_id", id, "org_id", req.OrgID)
+	return GetProject(ctx, id)
+}
@@ -0,0 +1,67 @@
+// Package projectaccess is the role hierarchy of projects, owner > editor >
+// commenter > viewer, over the permissions package. The project service
+// checks capabilities with permissions.Authorize; other services' endpoints
+// ask for the least role they need with RequireRole, which checks the
+// capability that role marks. Roles are resolved, and cached briefly, by
+// permissions.RoleOf with the project service's resolver.
+package projectaccess
+
+import (
+	"context"
+
+	"canvasai/permissions"
+)
+
+// rank orders roles from no access up to owner.
+var rank = map[permissions.Role]int{
+	permissions.RoleNone:      0,
+	permissions.RoleViewer:    1,
+	permissions.RoleCommenter: 2,
+	permissions.RoleEditor:    3,
+	permissions.RoleOwner:     4,
+}
+
+// Rank returns role's place in the hierarchy; unknown roles rank as none.
+func Rank(role permissions.Role) int {
+	return rank[role]
+}
+
+// AtLeast reports whether role is minRole or above it.
+func AtLeast(role, minRole permissions.Role) bool {
+	return rank[role] >= rank[minRole]
+}
+
+// Stronger returns the higher of two roles.
+func Stronger(a, b permissions.Role) permissions.Role {
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// Role returns userID's role on a project.
+func Role(ctx context.Context, projectID, userID string) (permissions.Role, error) {
+	return permissions.RoleOf(ctx, permissions.Project(projectID), userID)
+}
+
+// Forget drops a project's cached roles. Services call it after changing
+// who can access the project.
+func Forget(projectID string) {
+	permissions.Forget(permissions.Project(projectID))
+}
+
+// minCapability is the project capability only minRole and the roles above
+// it hold.
+var minCapability = map[permissions.Role]permissions.Capability{
+	permissions.RoleViewer:    permissions.ProjectView,
+	permissions.RoleCommenter: permissions.ProjectComment,
+	permissions.RoleEditor:    permissions.ProjectEdit,
+	permissions.RoleOwner:     permissions.ProjectManage,
+}
+
+// RequireRole returns nil if the current user holds minRole or a higher
+// role on the project. It is permissions.Authorize with the capability
+// that marks minRole, so it fails the same way.
+func RequireRole(ctx context.Context, projectID string, minRole permissions.Role) error {
+	return permissions.Authorize(ctx, permissions.Project(projectID), minCapability[minRole])
+}
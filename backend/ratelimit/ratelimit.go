@@ -0,0 +1,113 @@
+// Package ratelimit provides in-memory token bucket limiters keyed by an
+// arbitrary string (a user ID, IP address or destination host). Limits are
+// per process, which is enough to stop a single client from flooding an
+// instance; they are not a global quota.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limit allows Requests per Per for each key, with bursts of up to Requests.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// Limiter tracks a token bucket per key. A nil *Limiter allows everything.
+type Limiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets bounds memory; full buckets are dropped when it is exceeded.
+const maxBuckets = 4096
+
+// New returns a limiter for the limit, or nil if the limit is zero.
+func New(l Limit) *Limiter {
+	if l.Requests <= 0 || l.Per <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:    float64(l.Requests) / l.Per.Seconds(),
+		burst:   float64(l.Requests),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Status describes a key's bucket after a request was counted against it.
+type Status struct {
+	Allowed bool
+	// Limit is the bucket size and Remaining the whole tokens left in it
+	Limit     int
+	Remaining int
+	// Reset is when the bucket will be full again, and RetryAfter how long
+	// until the next request is allowed (zero when it already is)
+	Reset      time.Time
+	RetryAfter time.Duration
+}
+
+// Allow takes a token for key, reporting false when none are left.
+func (l *Limiter) Allow(key string) bool {
+	return l.Take(key).Allowed
+}
+
+// Take takes a token for key and reports the bucket's state, for callers
+// that expose it (e.g. as X-RateLimit-* headers).
+func (l *Limiter) Take(key string) Status {
+	now := time.Now()
+	if l == nil {
+		return Status{Allowed: true, Reset: now}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	st := Status{Allowed: b.tokens >= 1, Limit: int(l.burst)}
+	if st.Allowed {
+		b.tokens--
+	} else {
+		st.RetryAfter = l.wait(1 - b.tokens)
+	}
+	st.Remaining = int(b.tokens)
+	st.Reset = now.Add(l.wait(l.burst - b.tokens))
+	return st
+}
+
+// wait returns how long the bucket takes to refill n tokens.
+func (l *Limiter) wait(n float64) time.Duration {
+	return time.Duration(n / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, since they behave the
+// same as a fresh bucket.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package realtime
+
+import (
+	"context"
+
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+)
+
+// projectdb is shared with the project service, which owns the schema.
+var projectdb = sqldb.Named("project")
+
+// canAccessProject reports whether userID can at least view the project.
+func canAccessProject(ctx context.Context, projectID, userID string) (bool, error) {
+	role, err := projectaccess.Role(ctx, projectID, userID)
+	return projectaccess.AtLeast(role, permissions.RoleViewer), err
+}
@@ -0,0 +1,72 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+
+	"encore.dev/config"
+	"github.com/redis/go-redis/v9"
+
+	"canvasai/reqctx"
+)
+
+// Encore delivers each message on the realtime-broadcast subscription to one
+// instance, but the editors of a project can be connected to any of them.
+// With RealtimeRedisURL set, the instance that receives an event relays it
+// on a Redis channel every instance listens to, and each delivers it to its
+// own clients. Without it, events reach only the clients of the instance
+// that received them, so the service must run as a single instance.
+
+var secrets struct {
+	// RealtimeRedisURL is the redis:// URL events are relayed through
+	RealtimeRedisURL string
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+// relayChannel is the Redis channel events are relayed on
+const relayChannel = "canvasai:realtime-events"
+
+// relay is the Redis client events are relayed through, nil when events are
+// delivered locally.
+var relay = newRelay()
+
+func newRelay() *redis.Client {
+	if secrets.RealtimeRedisURL == "" {
+		return nil
+	}
+	ctx := context.Background()
+	opts, err := redis.ParseURL(secrets.RealtimeRedisURL)
+	if err != nil {
+		reqctx.Logger(ctx).Error("invalid RealtimeRedisURL, delivering realtime events locally", "error", err)
+		return nil
+	}
+	rdb := redis.NewClient(opts)
+	// The subscription reconnects on its own after Redis drops it.
+	sub := rdb.Subscribe(ctx, relayChannel)
+	go func() {
+		for msg := range sub.Channel() {
+			var ev Event
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				reqctx.Logger(ctx).Warn("dropping malformed relayed realtime event", "error", err)
+				continue
+			}
+			deliver(&ev)
+		}
+	}()
+	return rdb
+}
+
+// fanOut hands an event to every instance. An error leaves the message to
+// be redelivered by the subscription.
+func fanOut(ctx context.Context, ev *Event) error {
+	if relay == nil {
+		deliver(ev)
+		return nil
+	}
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return relay.Publish(ctx, relayChannel, raw).Err()
+}
@@ -0,0 +1,383 @@
+package realtime
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// Follow-mode event types
+const (
+	EventFollowStarted       = "follow.started"
+	EventFollowEnded         = "follow.ended"
+	EventFollowViewport      = "follow.viewport"
+	EventFollowHandRaised    = "follow.hand_raised"
+	EventFollowLeaderChanged = "follow.leader_changed"
+)
+
+// Viewport is the presenter's view of the canvas
+type Viewport struct {
+	PageID string  `json:"pageId,omitempty"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Zoom   float64 `json:"zoom"`
+}
+
+// FollowSession is the presenter state for a project. The leader's viewport
+// is authoritative for everyone following.
+type FollowSession struct {
+	ProjectID   string    `json:"projectId"`
+	LeaderID    string    `json:"leaderId"`
+	Viewport    *Viewport `json:"viewport,omitempty"`
+	RaisedHands []string  `json:"raisedHands"`
+	StartedAt   time.Time `json:"startedAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// HandoffRequest represents the leader handoff request
+type HandoffRequest struct {
+	UserID string `json:"userId"`
+}
+
+const (
+	// viewportInterval caps how often a leader's viewport is broadcast.
+	viewportInterval = 50 * time.Millisecond
+	// viewportPersistInterval caps how often it is stored for late joiners.
+	viewportPersistInterval = time.Second
+	// leaderCacheTTL bounds how long a leadership check is trusted.
+	leaderCacheTTL = 2 * time.Second
+)
+
+//encore:api auth method=GET path=/realtime/projects/:projectID/follow
+func GetFollowSession(ctx context.Context, projectID string) (*FollowSession, error) {
+	if err := requireAccess(ctx, projectID); err != nil {
+		return nil, err
+	}
+	session, err := getFollowSession(ctx, projectID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "No one is presenting",
+		}
+	} else if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch follow session",
+		}
+	}
+	return session, nil
+}
+
+// StartFollowSession makes the caller the presenter. It fails if someone
+// else is already presenting; they must hand off or stop first.
+//
+//encore:api auth method=POST path=/realtime/projects/:projectID/follow/start
+func StartFollowSession(ctx context.Context, projectID string) (*FollowSession, error) {
+	if err := requireAccess(ctx, projectID); err != nil {
+		return nil, err
+	}
+	userID := auth.UserID()
+
+	result, err := projectdb.Exec(ctx, `
+		INSERT INTO follow_sessions (project_id, leader_id) VALUES ($1, $2)
+		ON CONFLICT (project_id) DO NOTHING
+	`, projectID, userID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to start follow session", "project_id", projectID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to start follow session",
+		}
+	}
+
+	session, err := getFollowSession(ctx, projectID)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to start follow session",
+		}
+	}
+	if result.RowsAffected() == 0 && session.LeaderID != userID {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Someone else is already presenting",
+		}
+	}
+
+	leaders.set(projectID, userID)
+	publishFollow(ctx, projectID, EventFollowStarted, session)
+	return session, nil
+}
+
+//encore:api auth method=POST path=/realtime/projects/:projectID/follow/stop
+func StopFollowSession(ctx context.Context, projectID string) error {
+	result, err := projectdb.Exec(ctx, `
+		DELETE FROM follow_sessions WHERE project_id = $1 AND leader_id = $2
+	`, projectID, auth.UserID())
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to stop follow session",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only the presenter can stop the session",
+		}
+	}
+	leaders.set(projectID, "")
+	publishFollow(ctx, projectID, EventFollowEnded, map[string]string{"projectId": projectID})
+	return nil
+}
+
+// RaiseHand asks the presenter for control. Hands are queued in order and
+// the presenter is notified.
+//
+//encore:api auth method=POST path=/realtime/projects/:projectID/follow/hand
+func RaiseHand(ctx context.Context, projectID string) (*FollowSession, error) {
+	if err := requireAccess(ctx, projectID); err != nil {
+		return nil, err
+	}
+	userID := auth.UserID()
+
+	result, err := projectdb.Exec(ctx, `
+		UPDATE follow_sessions
+		SET raised_hands = array_append(raised_hands, $2::uuid), updated_at = NOW()
+		WHERE project_id = $1 AND leader_id <> $2::uuid AND NOT ($2::uuid = ANY(raised_hands))
+	`, projectID, userID)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to raise hand",
+		}
+	}
+
+	session, err := getFollowSession(ctx, projectID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "No one is presenting",
+		}
+	} else if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to raise hand",
+		}
+	}
+	if result.RowsAffected() > 0 {
+		publishFollow(ctx, projectID, EventFollowHandRaised, map[string]string{"userId": userID}, session.LeaderID)
+	}
+	return session, nil
+}
+
+// LowerHand withdraws the caller's request for control.
+//
+//encore:api auth method=DELETE path=/realtime/projects/:projectID/follow/hand
+func LowerHand(ctx context.Context, projectID string) error {
+	_, err := projectdb.Exec(ctx, `
+		UPDATE follow_sessions
+		SET raised_hands = array_remove(raised_hands, $2::uuid), updated_at = NOW()
+		WHERE project_id = $1
+	`, projectID, auth.UserID())
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to lower hand",
+		}
+	}
+	return nil
+}
+
+// HandoffFollowSession passes control to another collaborator. Only the
+// current presenter can hand off; the new leader keeps the last viewport.
+//
+//encore:api auth method=POST path=/realtime/projects/:projectID/follow/handoff
+func HandoffFollowSession(ctx context.Context, projectID string, req *HandoffRequest) (*FollowSession, error) {
+	if req.UserID == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "userId is required",
+		}
+	}
+	if ok, err := canAccessProject(ctx, projectID, req.UserID); err != nil || !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "New presenter must be a project collaborator",
+		}
+	}
+
+	session, err := transferLeadership(ctx, projectID, auth.UserID(), req.UserID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only the presenter can hand off control",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to hand off follow session", "project_id", projectID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to hand off control",
+		}
+	}
+	return session, nil
+}
+
+func transferLeadership(ctx context.Context, projectID, fromUserID, toUserID string) (*FollowSession, error) {
+	result, err := projectdb.Exec(ctx, `
+		UPDATE follow_sessions
+		SET leader_id = $3, raised_hands = array_remove(raised_hands, $3::uuid), updated_at = NOW()
+		WHERE project_id = $1 AND leader_id = $2
+	`, projectID, fromUserID, toUserID)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected() == 0 {
+		return nil, sql.ErrNoRows
+	}
+	session, err := getFollowSession(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	leaders.set(projectID, toUserID)
+	publishFollow(ctx, projectID, EventFollowLeaderChanged, session)
+	return session, nil
+}
+
+// leaderLeft is called when a presenter's last connection closes. Control
+// passes to the first raised hand, or the session ends.
+func leaderLeft(ctx context.Context, projectID, userID string) {
+	session, err := getFollowSession(ctx, projectID)
+	if err != nil || session.LeaderID != userID {
+		return
+	}
+	if len(session.RaisedHands) > 0 {
+		if _, err := transferLeadership(ctx, projectID, userID, session.RaisedHands[0]); err != nil {
+			reqctx.Logger(ctx).Error("failed to pass follow session on", "project_id", projectID, "error", err)
+		}
+		return
+	}
+	result, err := projectdb.Exec(ctx, `DELETE FROM follow_sessions WHERE project_id = $1 AND leader_id = $2`, projectID, userID)
+	if err == nil && result.RowsAffected() > 0 {
+		leaders.set(projectID, "")
+		publishFollow(ctx, projectID, EventFollowEnded, map[string]string{"projectId": projectID})
+	}
+}
+
+// handleViewport broadcasts a viewport update sent by a client over its
+// WebSocket. Updates from anyone but the presenter are ignored.
+func (c *client) handleViewport(ctx context.Context, raw json.RawMessage) {
+	now := time.Now()
+	if now.Sub(c.lastViewport) < viewportInterval {
+		return
+	}
+	var vp Viewport
+	if err := json.Unmarshal(raw, &vp); err != nil || vp.Zoom <= 0 {
+		return
+	}
+	if !leaders.is(ctx, c.projectID, c.userID) {
+		return
+	}
+	c.lastViewport = now
+
+	if now.Sub(c.lastPersisted) >= viewportPersistInterval {
+		c.lastPersisted = now
+		_, err := projectdb.Exec(ctx, `
+			UPDATE follow_sessions SET viewport = $3, page_id = NULLIF($4, ''), updated_at = NOW()
+			WHERE project_id = $1 AND leader_id = $2
+		`, c.projectID, c.userID, raw, vp.PageID)
+		if err != nil {
+			reqctx.Logger(ctx).Warn("failed to persist viewport", "project_id", c.projectID, "error", err)
+		}
+	}
+	publishFollow(ctx, c.projectID, EventFollowViewport, vp)
+}
+
+func publishFollow(ctx context.Context, projectID, eventType string, payload any, targetUserIDs ...string) {
+	if err := Publish(ctx, projectID, eventType, payload, targetUserIDs...); err != nil {
+		reqctx.Logger(ctx).Error("failed to publish follow event", "project_id", projectID, "type", eventType, "error", err)
+	}
+}
+
+func getFollowSession(ctx context.Context, projectID string) (*FollowSession, error) {
+	s := &FollowSession{ProjectID: projectID}
+	var viewport []byte
+	err := projectdb.QueryRow(ctx, `
+		SELECT leader_id, viewport, raised_hands::text[], started_at, updated_at
+		FROM follow_sessions WHERE project_id = $1
+	`, projectID).Scan(&s.LeaderID, &viewport, &s.RaisedHands, &s.StartedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(viewport) > 0 {
+		s.Viewport = &Viewport{}
+		if err := json.Unmarshal(viewport, s.Viewport); err != nil {
+			s.Viewport = nil
+		}
+	}
+	if s.RaisedHands == nil {
+		s.RaisedHands = []string{}
+	}
+	return s, nil
+}
+
+func requireAccess(ctx context.Context, projectID string) error {
+	ok, err := canAccessProject(ctx, projectID, auth.UserID())
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check project access",
+		}
+	}
+	if !ok {
+		return &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Access denied to this project",
+		}
+	}
+	return nil
+}
+
+// leaderCache remembers who presents each project so viewport updates,
+// which arrive many times a second, do not each hit the database.
+type leaderCache struct {
+	mu      sync.Mutex
+	entries map[string]leaderEntry
+}
+
+type leaderEntry struct {
+	userID  string
+	checked time.Time
+}
+
+var leaders = &leaderCache{entries: map[string]leaderEntry{}}
+
+func (l *leaderCache) set(projectID, userID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[projectID] = leaderEntry{userID: userID, checked: time.Now()}
+}
+
+func (l *leaderCache) is(ctx context.Context, projectID, userID string) bool {
+	l.mu.Lock()
+	entry, ok := l.entries[projectID]
+	l.mu.Unlock()
+	if ok && time.Since(entry.checked) < leaderCacheTTL {
+		return entry.userID == userID
+	}
+
+	var leaderID string
+	err := projectdb.QueryRow(ctx, `SELECT leader_id FROM follow_sessions WHERE project_id = $1`, projectID).Scan(&leaderID)
+	if err != nil && err != sql.ErrNoRows {
+		return false
+	}
+	l.set(projectID, leaderID)
+	return leaderID == userID
+}
@@ -0,0 +1,307 @@
+package realtime
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/cron"
+	"encore.dev/storage/sqldb"
+	"github.com/gorilla/websocket"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// ConnectionQuota caps concurrent WebSocket connections so a single user or
+// workspace cannot exhaust the service's capacity. Zero uses the default.
+type ConnectionQuota struct {
+	MaxPerUser int `json:"maxPerUser"`
+	MaxPerOrg  int `json:"maxPerOrg"`
+}
+
+var quotaCfg struct {
+	Connections ConnectionQuota
+}
+
+var _ = config.Load(context.Background(), &quotaCfg)
+
+const (
+	defaultMaxConnectionsPerUser = 10
+	defaultMaxConnectionsPerOrg  = 500
+
+	// A connection whose heartbeat is older than this is treated as gone;
+	// its instance most likely died without releasing it.
+	connectionStaleAfter = 3 * pingInterval
+)
+
+// Quota scopes
+const (
+	QuotaScopeUser = "user"
+	QuotaScopeOrg  = "org"
+)
+
+// EventConnectionLimit is sent to a client whose connection was refused
+// because a quota is full, just before the socket is closed.
+const EventConnectionLimit = "error.connection_limit"
+
+// ConnectionLimit describes the quota a refused connection ran into
+type ConnectionLimit struct {
+	Scope string `json:"scope"`
+	Limit int    `json:"limit"`
+}
+
+// Quota is the effective connection limit for a user or org
+type Quota struct {
+	Scope          string `json:"scope"`
+	SubjectID      string `json:"subjectId"`
+	MaxConnections int    `json:"maxConnections"`
+	Active         int    `json:"active"`
+	Override       bool   `json:"override"`
+}
+
+// SetQuotaRequest represents the set quota request
+type SetQuotaRequest struct {
+	MaxConnections int `json:"maxConnections"`
+}
+
+// admit registers a connection for userID to projectID, returning its id.
+// When the user's or the project's org quota is already full no connection
+// is registered and the exceeded limit is returned instead.
+func admit(ctx context.Context, userID, projectID string) (string, *ConnectionLimit, error) {
+	tx, err := projectdb.Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	var orgID sql.NullString
+	err = tx.QueryRow(ctx, `SELECT org_id FROM projects WHERE id = $1`, projectID).Scan(&orgID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Serialize admissions per user and org so concurrent upgrades on
+	// different instances cannot both take the last slot.
+	subjects := []struct{ scope, id string }{{QuotaScopeUser, userID}}
+	if orgID.Valid {
+		subjects = append(subjects, struct{ scope, id string }{QuotaScopeOrg, orgID.String})
+	}
+	for _, s := range subjects {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('realtime:' || $1 || ':' || $2))`, s.scope, s.id); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, s := range subjects {
+		limit, _, err := quotaLimit(ctx, tx, s.scope, s.id)
+		if err != nil {
+			return "", nil, err
+		}
+		active, err := activeConnections(ctx, tx, s.scope, s.id)
+		if err != nil {
+			return "", nil, err
+		}
+		if active >= limit {
+			return "", &ConnectionLimit{Scope: s.scope, Limit: limit}, nil
+		}
+	}
+
+	var connID string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO realtime_connections (user_id, org_id, project_id)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, userID, orgID, projectID).Scan(&connID)
+	if err != nil {
+		return "", nil, err
+	}
+	return connID, nil, tx.Commit()
+}
+
+// release unregisters a connection once its socket has closed.
+func release(ctx context.Context, connID string) {
+	if connID == "" {
+		return
+	}
+	if _, err := projectdb.Exec(ctx, `DELETE FROM realtime_connections WHERE id = $1`, connID); err != nil {
+		reqctx.Logger(ctx).Error("failed to release realtime connection", "connection_id", connID, "error", err)
+	}
+}
+
+// heartbeat keeps a connection counted against its quotas.
+func heartbeat(ctx context.Context, connID string) {
+	if connID == "" {
+		return
+	}
+	_, err := projectdb.Exec(ctx, `UPDATE realtime_connections SET last_seen_at = NOW() WHERE id = $1`, connID)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to refresh realtime connection", "connection_id", connID, "error", err)
+	}
+}
+
+// rejectConnection tells the client which quota it hit and closes the
+// socket with 1013 (try again later) so it can back off before retrying.
+func rejectConnection(conn *websocket.Conn, limit *ConnectionLimit) {
+	defer conn.Close()
+	payload := []byte(`{}`)
+	if raw, err := json.Marshal(limit); err == nil {
+		payload = raw
+	}
+	deadline := time.Now().Add(writeTimeout)
+	conn.SetWriteDeadline(deadline)
+	conn.WriteJSON(&Event{Type: EventConnectionLimit, Payload: payload, SentAt: time.Now()})
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "connection limit reached"), deadline)
+}
+
+// querier is satisfied by both the database and a transaction.
+type querier interface {
+	QueryRow(ctx context.Context, query string, args ...any) *sqldb.Row
+}
+
+func quotaLimit(ctx context.Context, q querier, scope, subjectID string) (int, bool, error) {
+	var max int
+	err := q.QueryRow(ctx, `
+		SELECT max_connections FROM realtime_quota_overrides WHERE scope = $1 AND subject_id = $2
+	`, scope, subjectID).Scan(&max)
+	if err == nil {
+		return max, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+	if scope == QuotaScopeOrg {
+		if quotaCfg.Connections.MaxPerOrg > 0 {
+			return quotaCfg.Connections.MaxPerOrg, false, nil
+		}
+		return defaultMaxConnectionsPerOrg, false, nil
+	}
+	if quotaCfg.Connections.MaxPerUser > 0 {
+		return quotaCfg.Connections.MaxPerUser, false, nil
+	}
+	return defaultMaxConnectionsPerUser, false, nil
+}
+
+func activeConnections(ctx context.Context, q querier, scope, subjectID string) (int, error) {
+	column := "user_id"
+	if scope == QuotaScopeOrg {
+		column = "org_id"
+	}
+	var n int
+	err := q.QueryRow(ctx, `
+		SELECT COUNT(*) FROM realtime_connections
+		WHERE `+column+` = $1 AND last_seen_at > NOW() - $2 * INTERVAL '1 second'
+	`, subjectID, int(connectionStaleAfter.Seconds())).Scan(&n)
+	return n, err
+}
+
+// Sweep connections whose instance stopped refreshing them.
+var _ = cron.NewJob("sweep-realtime-connections", cron.JobConfig{
+	Title:    "Delete stale realtime connection records",
+	Every:    1 * cron.Hour,
+	Endpoint: SweepStaleConnections,
+})
+
+//encore:api private
+func SweepStaleConnections(ctx context.Context) error {
+	result, err := projectdb.Exec(ctx, `
+		DELETE FROM realtime_connections WHERE last_seen_at < NOW() - $1 * INTERVAL '1 second'
+	`, int(connectionStaleAfter.Seconds()))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to sweep realtime connections", "error", err)
+		return err
+	}
+	reqctx.Logger(ctx).Info("swept stale realtime connections", "count", result.RowsAffected())
+	return nil
+}
+
+//encore:api auth method=GET path=/admin/realtime/quotas/:scope/:id
+func GetQuota(ctx context.Context, scope, id string) (*Quota, error) {
+	if err := requireQuotaAdmin(ctx, scope); err != nil {
+		return nil, err
+	}
+	return loadQuota(ctx, scope, id)
+}
+
+//encore:api auth method=PUT path=/admin/realtime/quotas/:scope/:id
+func SetQuota(ctx context.Context, scope, id string, req *SetQuotaRequest) (*Quota, error) {
+	if err := requireQuotaAdmin(ctx, scope); err != nil {
+		return nil, err
+	}
+	if req.MaxConnections < 0 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "maxConnections cannot be negative",
+		}
+	}
+
+	_, err := projectdb.Exec(ctx, `
+		INSERT INTO realtime_quota_overrides (scope, subject_id, max_connections, set_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (scope, subject_id) DO UPDATE
+		SET max_connections = EXCLUDED.max_connections, set_by = EXCLUDED.set_by, updated_at = NOW()
+	`, scope, id, req.MaxConnections, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to set realtime quota", "scope", scope, "subject_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to set quota",
+		}
+	}
+	reqctx.Logger(ctx).Info("realtime quota override set", "scope", scope, "subject_id", id, "max_connections", req.MaxConnections)
+	return loadQuota(ctx, scope, id)
+}
+
+// DeleteQuota removes an override, restoring the default limit.
+//
+//encore:api auth method=DELETE path=/admin/realtime/quotas/:scope/:id
+func DeleteQuota(ctx context.Context, scope, id string) (*Quota, error) {
+	if err := requireQuotaAdmin(ctx, scope); err != nil {
+		return nil, err
+	}
+	_, err := projectdb.Exec(ctx, `
+		DELETE FROM realtime_quota_overrides WHERE scope = $1 AND subject_id = $2
+	`, scope, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete quota",
+		}
+	}
+	return loadQuota(ctx, scope, id)
+}
+
+func loadQuota(ctx context.Context, scope, id string) (*Quota, error) {
+	q := &Quota{Scope: scope, SubjectID: id}
+	var err error
+	if q.MaxConnections, q.Override, err = quotaLimit(ctx, projectdb, scope, id); err == nil {
+		q.Active, err = activeConnections(ctx, projectdb, scope, id)
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load realtime quota", "scope", scope, "subject_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch quota",
+		}
+	}
+	return q, nil
+}
+
+// requireQuotaAdmin returns an error unless the caller is a platform admin
+// and scope names a quota scope.
+func requireQuotaAdmin(ctx context.Context, scope string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, projectdb); err != nil {
+		return err
+	}
+	if scope != QuotaScopeUser && scope != QuotaScopeOrg {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Scope must be user or org",
+		}
+	}
+	return nil
+}
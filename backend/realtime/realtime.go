@@ -0,0 +1,282 @@
+// Package realtime fans project events out to editors connected over
+// WebSocket so collaborators learn about saves, conflicts and presence
+// changes without polling.
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/pubsub"
+	"github.com/gorilla/websocket"
+
+	"canvasai/reqctx"
+)
+
+// Event is a message delivered to clients connected to a project
+type Event struct {
+	ProjectID string `json:"projectId"`
+	Type      string `json:"type"`
+	// TargetUserIDs limits delivery to the given users; empty means everyone
+	// connected to the project.
+	TargetUserIDs []string        `json:"targetUserIds,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	SentAt        time.Time       `json:"sentAt"`
+}
+
+// Event types published by other services
+const (
+	EventAutosaveConflict = "autosave.conflict"
+	EventAssetUpdated     = "asset.updated"
+	EventAssetLinkChanged = "asset.link.changed"
+	EventProjectRestored  = "project.restored"
+	EventProjectTrashed   = "project.trashed"
+	EventElementsUpdated  = "elements.updated"
+	EventCanvasPatched    = "canvas.patched"
+	EventProjectApproval  = "project.approval"
+	EventProjectSettings  = "project.settings_updated"
+)
+
+// Events is the topic other services publish realtime events to.
+var Events = pubsub.NewTopic[*Event]("realtime-events", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(Events, "realtime-broadcast", pubsub.SubscriptionConfig[*Event]{
+	Handler: broadcast,
+})
+
+// Publish marshals payload and publishes it as an event for projectID.
+func Publish(ctx context.Context, projectID, eventType string, payload any, targetUserIDs ...string) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = Events.Publish(ctx, &Event{
+		ProjectID:     projectID,
+		Type:          eventType,
+		TargetUserIDs: targetUserIDs,
+		Payload:       raw,
+		SentAt:        time.Now(),
+	})
+	return err
+}
+
+const (
+	writeTimeout = 10 * time.Second
+	pongTimeout  = 60 * time.Second
+	pingInterval = 30 * time.Second
+	sendBuffer   = 32
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Connections are authenticated by token, not cookies, so cross-origin
+	// upgrades cannot ride an ambient session.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type client struct {
+	userID    string
+	projectID string
+	conn      *websocket.Conn
+	send      chan *Event
+	// connID is the quota registration; empty if admission failed open
+	connID string
+
+	// Throttling state for follow-mode viewport updates
+	lastViewport  time.Time
+	lastPersisted time.Time
+
+	// Comment threads the client is typing in
+	typing typingState
+}
+
+// clientMessage is a frame sent by a connected client
+type clientMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// hub tracks the clients connected to this instance, keyed by project.
+type hub struct {
+	mu       sync.RWMutex
+	projects map[string]map[*client]struct{}
+}
+
+var clients = &hub{projects: map[string]map[*client]struct{}{}}
+
+func (h *hub) add(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.projects[c.projectID] == nil {
+		h.projects[c.projectID] = map[*client]struct{}{}
+	}
+	h.projects[c.projectID][c] = struct{}{}
+}
+
+func (h *hub) remove(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if set, ok := h.projects[c.projectID]; ok {
+		delete(set, c)
+		if len(set) == 0 {
+			delete(h.projects, c.projectID)
+		}
+	}
+}
+
+// connected reports whether userID still has a connection to projectID on
+// this instance.
+func (h *hub) connected(projectID, userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.projects[projectID] {
+		if c.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hub) deliver(ev *Event) {
+	targets := map[string]bool{}
+	for _, id := range ev.TargetUserIDs {
+		targets[id] = true
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.projects[ev.ProjectID] {
+		if len(targets) > 0 && !targets[c.userID] {
+			continue
+		}
+		select {
+		case c.send <- ev:
+		default:
+			// Slow consumer; drop rather than block the broadcast.
+		}
+	}
+}
+
+// broadcast hands events from the topic to every instance (see fanOut).
+func broadcast(ctx context.Context, ev *Event) error {
+	return fanOut(ctx, ev)
+}
+
+// deliver delivers an event to the clients connected to this instance.
+func deliver(ev *Event) {
+	switch ev.Type {
+	case EventFollowStarted, EventFollowLeaderChanged:
+		var s FollowSession
+		if json.Unmarshal(ev.Payload, &s) == nil {
+			leaders.set(ev.ProjectID, s.LeaderID)
+		}
+	case EventFollowEnded:
+		leaders.set(ev.ProjectID, "")
+	}
+	clients.deliver(ev)
+}
+
+// Connect upgrades to a WebSocket that streams events for a project the
+// caller collaborates on.
+//
+//encore:api auth raw method=GET path=/realtime/projects/:projectID
+func Connect(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	projectID := encore.CurrentRequest().PathParams.Get("projectID")
+	userID := auth.UserID()
+
+	if ok, err := canAccessProject(ctx, projectID, userID); err != nil {
+		reqctx.Logger(ctx).Error("failed to check project access", "project_id", projectID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "access denied to this project", http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("websocket upgrade failed", "project_id", projectID, "error", err)
+		return
+	}
+
+	connID, limit, err := admit(ctx, userID, projectID)
+	if err != nil {
+		// Quota bookkeeping must not take collaboration down with it.
+		reqctx.Logger(ctx).Error("failed to check connection quota", "project_id", projectID, "error", err)
+	} else if limit != nil {
+		reqctx.Logger(ctx).Warn("realtime connection refused", "project_id", projectID, "scope", limit.Scope, "limit", limit.Limit)
+		rejectConnection(conn, limit)
+		return
+	}
+
+	c := &client{userID: userID, projectID: projectID, conn: conn, send: make(chan *Event, sendBuffer), connID: connID}
+	clients.add(c)
+
+	done := make(chan struct{})
+	go c.writeLoop(ctx, done)
+	c.readLoop(ctx)
+	close(done)
+
+	clients.remove(c)
+	c.stopAllTyping(context.WithoutCancel(ctx))
+	release(context.WithoutCancel(ctx), connID)
+	if !clients.connected(projectID, userID) {
+		leaderLeft(context.WithoutCancel(ctx), projectID, userID)
+	}
+}
+
+// readLoop handles client frames until the connection drops. Presenters
+// send viewport updates and commenters typing indicators; any frame keeps
+// the connection alive.
+func (c *client) readLoop(ctx context.Context) {
+	defer c.conn.Close()
+	c.conn.SetReadLimit(64 * 1024)
+	c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	for {
+		var msg clientMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case EventFollowViewport:
+			c.handleViewport(ctx, msg.Payload)
+		case EventCommentTyping:
+			c.handleTyping(ctx, msg.Payload)
+		}
+	}
+}
+
+func (c *client) writeLoop(ctx context.Context, done <-chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case ev := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteJSON(ev); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				c.conn.Close()
+				return
+			}
+			heartbeat(ctx, c.connID)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Comment typing event types
+const (
+	EventCommentTyping        = "comment.typing"
+	EventCommentTypingStopped = "comment.typing_stopped"
+)
+
+// TypingIndicator says a collaborator is writing in a comment thread.
+// Clients hide it at ExpiresAt unless it is refreshed first, so a lost
+// stop event never leaves it showing.
+type TypingIndicator struct {
+	// ThreadID is the root comment of the thread, or "new" for a comment
+	// that starts one
+	ThreadID  string     `json:"threadId"`
+	UserID    string     `json:"userId"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// typingMessage is the payload of a comment.typing frame sent by a client
+type typingMessage struct {
+	ThreadID string `json:"threadId"`
+	Typing   bool   `json:"typing"`
+}
+
+const (
+	// typingRefresh caps how often a client's keystrokes in one thread are
+	// rebroadcast. It must stay well under typingTTL so an indicator is
+	// refreshed before it expires.
+	typingRefresh = 3 * time.Second
+	// typingTTL is how long an indicator lasts without a keystroke.
+	typingTTL = 6 * time.Second
+	// maxTypingThreads bounds the threads one connection can be typing in.
+	maxTypingThreads  = 5
+	maxThreadIDLength = 64
+)
+
+// typingState tracks the threads a client is typing in. Expiry timers
+// fire on their own goroutines, hence the lock.
+type typingState struct {
+	mu      sync.Mutex
+	threads map[string]*typingThread
+	// canComment caches the commenter check for the connection
+	canComment *bool
+}
+
+type typingThread struct {
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+// handleTyping broadcasts that the client started or stopped typing in a
+// comment thread. Keystrokes are debounced to one event per typingRefresh,
+// and the indicator stops on its own typingTTL after the last one.
+func (c *client) handleTyping(ctx context.Context, raw json.RawMessage) {
+	var msg typingMessage
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.ThreadID == "" || len(msg.ThreadID) > maxThreadIDLength {
+		return
+	}
+	if !msg.Typing {
+		c.stopTyping(ctx, msg.ThreadID)
+		return
+	}
+	if !c.mayComment(ctx) {
+		return
+	}
+
+	t := &c.typing
+	now := time.Now()
+	t.mu.Lock()
+	if t.threads == nil {
+		t.threads = map[string]*typingThread{}
+	}
+	th, ok := t.threads[msg.ThreadID]
+	if !ok {
+		if len(t.threads) >= maxTypingThreads {
+			t.mu.Unlock()
+			return
+		}
+		threadID := msg.ThreadID
+		bg := context.WithoutCancel(ctx)
+		th = &typingThread{timer: time.AfterFunc(typingTTL, func() { c.stopTyping(bg, threadID) })}
+		t.threads[msg.ThreadID] = th
+	} else {
+		th.timer.Reset(typingTTL)
+	}
+	send := now.Sub(th.lastSent) >= typingRefresh
+	if send {
+		th.lastSent = now
+	}
+	t.mu.Unlock()
+
+	if send {
+		expiresAt := now.Add(typingTTL)
+		publishTyping(ctx, c.projectID, EventCommentTyping, TypingIndicator{
+			ThreadID:  msg.ThreadID,
+			UserID:    c.userID,
+			ExpiresAt: &expiresAt,
+		})
+	}
+}
+
+// stopTyping ends the client's indicator in a thread, if it shows one.
+func (c *client) stopTyping(ctx context.Context, threadID string) {
+	t := &c.typing
+	t.mu.Lock()
+	th, ok := t.threads[threadID]
+	if ok {
+		th.timer.Stop()
+		delete(t.threads, threadID)
+	}
+	t.mu.Unlock()
+	if ok {
+		publishTyping(ctx, c.projectID, EventCommentTypingStopped, TypingIndicator{
+			ThreadID: threadID,
+			UserID:   c.userID,
+		})
+	}
+}
+
+// stopAllTyping ends every indicator the client shows, when it disconnects.
+func (c *client) stopAllTyping(ctx context.Context) {
+	t := &c.typing
+	t.mu.Lock()
+	threadIDs := make([]string, 0, len(t.threads))
+	for id := range t.threads {
+		threadIDs = append(threadIDs, id)
+	}
+	t.mu.Unlock()
+	for _, id := range threadIDs {
+		c.stopTyping(ctx, id)
+	}
+}
+
+// mayComment reports whether the client can comment on its project. Only
+// the client's read loop calls it.
+func (c *client) mayComment(ctx context.Context) bool {
+	if c.typing.canComment == nil {
+		role, err := projectaccess.Role(ctx, c.projectID, c.userID)
+		if err != nil {
+			return false
+		}
+		ok := projectaccess.AtLeast(role, permissions.RoleCommenter)
+		c.typing.canComment = &ok
+	}
+	return *c.typing.canComment
+}
+
+func publishTyping(ctx context.Context, projectID, eventType string, payload TypingIndicator) {
+	if err := Publish(ctx, projectID, eventType, payload); err != nil {
+		reqctx.Logger(ctx).Warn("failed to publish typing event", "project_id", projectID, "type", eventType, "error", err)
+	}
+}
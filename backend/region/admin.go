@@ -0,0 +1,140 @@
+package region
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Status describes this region as load balancers and admins see it
+type Status struct {
+	Region string `json:"region"`
+	Mode   string `json:"mode"` // primary or standby
+	// Healthy is false when the database is unreachable or a standby has
+	// fallen more than MaxLagSeconds behind
+	Healthy        bool    `json:"healthy"`
+	Writable       bool    `json:"writable"`
+	ReplicationLag float64 `json:"replicationLagSeconds"`
+	// Serves is "all" on the primary and "shared" on a standby, which only
+	// serves share link and embed reads
+	Serves     string `json:"serves"`
+	PrimaryURL string `json:"primaryUrl,omitempty"`
+}
+
+// Health reports whether this region can take its traffic, answering 503
+// when it cannot, for load balancer and DNS failover checks.
+//
+//encore:api public raw method=GET path=/region/health
+func Health(w http.ResponseWriter, req *http.Request) {
+	st := status(req.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !st.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+//encore:api auth method=GET path=/admin/region
+func GetStatus(ctx context.Context) (*Status, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	st := status(ctx)
+	return &st, nil
+}
+
+func status(ctx context.Context) Status {
+	forgetStale()
+	s := load(ctx)
+	maxLag := regionCfg.Region.MaxLagSeconds
+	if maxLag <= 0 {
+		maxLag = defaultMaxLagSeconds
+	}
+	st := Status{
+		Region:         Name(),
+		Mode:           s.mode,
+		Healthy:        s.err == nil && (!s.inRecovery || s.lagSeconds <= float64(maxLag)),
+		Writable:       s.err == nil && s.mode == ModePrimary && !s.inRecovery,
+		ReplicationLag: s.lagSeconds,
+		Serves:         "all",
+	}
+	if s.mode == ModeStandby {
+		st.Serves = "shared"
+		st.PrimaryURL = regionCfg.Region.PrimaryURL
+	}
+	return st
+}
+
+// forgetStale makes health checks see a database that went away, rather
+// than a cached state from before it did.
+func forgetStale() {
+	stateMu.Lock()
+	if current != nil && current.err != nil {
+		current.checkedAt = time.Time{}
+	}
+	stateMu.Unlock()
+}
+
+// PromoteRequest represents the promotion request
+type PromoteRequest struct {
+	// Reason is recorded with the failover
+	Reason string `json:"reason,omitempty"`
+}
+
+// Promote makes this standby region the primary. A database that is
+// still a replica is promoted with pg_promote, which needs the
+// privilege to run it; with a managed database, promote the replica with
+// the provider first. Run it only once the old primary is down or fenced,
+// since both regions take writes after it.
+//
+//encore:api auth method=POST path=/admin/region/promote
+func Promote(ctx context.Context, req *PromoteRequest) (*Status, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	forget()
+	if Mode(ctx) == ModePrimary {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "This region is already the primary",
+		}
+	}
+	log := reqctx.Logger(ctx).With("region", Name())
+
+	s := load(ctx)
+	lag := s.lagSeconds
+	if s.inRecovery {
+		var promoted bool
+		if err := db.QueryRow(ctx, `SELECT pg_promote(true, 60)`).Scan(&promoted); err != nil || !promoted {
+			log.Error("failed to promote database", "error", err)
+			return nil, &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "Failed to promote the database; promote the replica with your database provider and retry",
+			}
+		}
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO region_failovers (region, promoted_by, reason, replication_lag_seconds)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+	`, Name(), auth.UserID(), req.Reason, lag)
+	if err != nil {
+		log.Error("failed to record failover", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "The database was promoted but the failover could not be recorded",
+		}
+	}
+	forget()
+	log.Warn("region promoted to primary", "replication_lag_seconds", lag, "reason", req.Reason)
+	st := status(ctx)
+	return &st, nil
+}
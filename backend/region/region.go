@@ -0,0 +1,219 @@
+// Package region runs the app in an active-passive pair of regions. The
+// primary region serves everything. A standby region runs against a read
+// replica of the primary's database and serves only share link and embed
+// reads, so shared designs stay up during a primary outage; every other
+// call is refused with a hint naming the primary. An admin promotes the
+// standby when the primary is lost (see admin.go), and /region/health
+// tells load balancers and DNS failover which region can take traffic.
+package region
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/middleware"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+)
+
+// Startup modes
+const (
+	// StartupAuto follows the database: read-only while it is a replica
+	StartupAuto = "auto"
+	// StartupPrimary expects a writable database and logs an error if it
+	// is a replica, running read-only until it is promoted
+	StartupPrimary = "primary"
+	// StartupStandby stays read-only, even against a writable database,
+	// until this region is promoted. It keeps a replica promoted by
+	// accident from taking writes alongside the primary.
+	StartupStandby = "standby"
+)
+
+// Modes
+const (
+	ModePrimary = "primary"
+	ModeStandby = "standby"
+)
+
+// Config describes this deployment's region
+type Config struct {
+	// Name identifies the region, e.g. "us-east"
+	Name string
+	// Startup is auto (default), primary or standby
+	Startup string
+	// PrimaryURL is the API base URL of the primary region, returned as a
+	// routing hint by a standby
+	PrimaryURL string
+	// MaxLagSeconds is the replication lag past which a standby reports
+	// itself unhealthy. Zero uses the default of 60.
+	MaxLagSeconds int
+}
+
+var regionCfg struct {
+	Region Config
+}
+
+var _ = config.Load(context.Background(), &regionCfg)
+
+// Failovers are stored alongside the data they move between regions.
+var db = sqldb.Named("project")
+
+const (
+	defaultMaxLagSeconds = 60
+
+	// stateTTL bounds how long an instance takes to notice a promotion
+	// made elsewhere
+	stateTTL = 10 * time.Second
+
+	// HeaderRegion and HeaderPrimary are routing hints set on responses
+	HeaderRegion  = "X-Region"
+	HeaderPrimary = "X-Primary-Region-URL"
+)
+
+// standbyEndpoints are the calls a standby serves
+var standbyEndpoints = map[string]bool{
+	"project.GetSharedProject": true,
+	"project.GetSharedView":    true,
+	"project.GetSharedEmbed":   true,
+	"region.Health":            true,
+	"region.GetStatus":         true,
+	"region.Promote":           true,
+}
+
+// state is what an instance knows about its region
+type state struct {
+	mode       string
+	inRecovery bool    // the database is a replica
+	lagSeconds float64 // replication lag, while in recovery
+	checkedAt  time.Time
+	err        error
+}
+
+var (
+	stateMu sync.Mutex
+	current *state
+)
+
+// Mode returns primary or standby for this instance. If the database
+// cannot be reached the last known mode is kept, and an instance that
+// never reached it assumes its startup mode.
+func Mode(ctx context.Context) string {
+	return load(ctx).mode
+}
+
+// ReadOnly reports whether this instance is a standby, whose database
+// refuses writes. Share and embed reads skip their bookkeeping writes
+// while it is.
+func ReadOnly(ctx context.Context) bool {
+	return Mode(ctx) == ModeStandby
+}
+
+// Name returns the configured region name.
+func Name() string {
+	return regionCfg.Region.Name
+}
+
+func load(ctx context.Context) *state {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if current != nil && time.Since(current.checkedAt) < stateTTL {
+		return current
+	}
+	next := check(ctx)
+	if next.err != nil && current != nil {
+		next.mode = current.mode
+	}
+	if current == nil || next.mode != current.mode {
+		reqctx.Logger(ctx).Info("region mode", "region", Name(), "mode", next.mode, "startup", regionCfg.Region.Startup, "in_recovery", next.inRecovery)
+	}
+	current = next
+	return current
+}
+
+// check asks the database whether it is a replica and, in standby
+// startup mode, whether this region has since been promoted.
+func check(ctx context.Context) *state {
+	s := &state{checkedAt: time.Now()}
+	err := db.QueryRow(ctx, `
+		SELECT pg_is_in_recovery(),
+			COALESCE(EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp()), 0)
+	`).Scan(&s.inRecovery, &s.lagSeconds)
+	if err != nil {
+		s.err = err
+		s.mode = ModePrimary
+		if regionCfg.Region.Startup == StartupStandby {
+			s.mode = ModeStandby
+		}
+		return s
+	}
+	if !s.inRecovery {
+		s.lagSeconds = 0
+	}
+
+	switch {
+	case s.inRecovery:
+		s.mode = ModeStandby
+		if regionCfg.Region.Startup == StartupPrimary {
+			reqctx.Logger(ctx).Error("primary region is running against a read replica", "region", Name())
+		}
+	case regionCfg.Region.Startup == StartupStandby:
+		promoted, err := latestPromotion(ctx)
+		if err != nil {
+			s.err = err
+		}
+		s.mode = ModeStandby
+		if promoted == Name() {
+			s.mode = ModePrimary
+		}
+	default:
+		s.mode = ModePrimary
+	}
+	return s
+}
+
+// latestPromotion returns the region promoted most recently, if any.
+func latestPromotion(ctx context.Context) (string, error) {
+	var name string
+	err := db.QueryRow(ctx, `SELECT region FROM region_failovers ORDER BY promoted_at DESC LIMIT 1`).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// forget drops the cached state after a promotion.
+func forget() {
+	stateMu.Lock()
+	current = nil
+	stateMu.Unlock()
+}
+
+// Routing tags every response with the region that served it and, on a
+// standby, refuses everything but share and embed reads with a hint
+// naming the primary.
+//
+//encore:middleware global target=all
+func Routing(req middleware.Request, next middleware.Next) middleware.Response {
+	data := req.Data()
+	var resp middleware.Response
+	if ReadOnly(req.Context()) && (data == nil || !standbyEndpoints[data.Service+"."+data.Endpoint]) {
+		resp = middleware.Response{Err: &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "This region is on standby; use the primary region",
+		}}
+		if url := regionCfg.Region.PrimaryURL; url != "" {
+			resp.Header().Set(HeaderPrimary, url)
+		}
+	} else {
+		resp = next(req)
+	}
+	if name := Name(); name != "" {
+		resp.Header().Set(HeaderRegion, name)
+	}
+	return resp
+}
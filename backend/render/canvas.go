@@ -0,0 +1,550 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"unicode"
+)
+
+// Canvas is a raster Surface. It exists so renders can be compared pixel by
+// pixel (see Compare): the output is deterministic for a given document, so
+// a change in the picture means a change in how the document was
+// interpreted. Text is drawn as one box per glyph, sized from the same
+// metrics the PDF output uses, which is enough to catch layout regressions
+// without rasterizing fonts.
+type Canvas struct {
+	img *image.RGBA // premultiplied
+	canvasState
+	stack []canvasState
+}
+
+// canvasState is what Save and Restore keep. Clip masks are replaced, never
+// changed in place, so a saved state can share them.
+type canvasState struct {
+	m    Matrix
+	clip *image.Alpha // nil when nothing is clipped
+	mode string       // blend mode, "" for normal
+}
+
+var _ Surface = (*Canvas)(nil)
+
+// samplesPerPixel is the number of scanlines sampled per pixel row.
+// Coverage across a row is computed exactly.
+const samplesPerPixel = 4
+
+// NewCanvas returns a w×h canvas filled with background.
+func NewCanvas(w, h int, background Color) *Canvas {
+	c := &Canvas{img: image.NewRGBA(image.Rect(0, 0, w, h)), canvasState: canvasState{m: Matrix{1, 0, 0, 1, 0, 0}}}
+	if background.Visible() {
+		c.fill([][]Point{{{0, 0}, {float64(w), 0}, {float64(w), float64(h)}, {0, float64(h)}}}, background)
+	}
+	return c
+}
+
+// Pixels returns the rendered image.
+func (c *Canvas) Pixels() *image.RGBA { return c.img }
+
+func (c *Canvas) Save() { c.stack = append(c.stack, c.canvasState) }
+
+func (c *Canvas) Restore() {
+	if n := len(c.stack); n > 0 {
+		c.canvasState = c.stack[n-1]
+		c.stack = c.stack[:n-1]
+	}
+}
+
+func (c *Canvas) Transform(m Matrix) { c.m = c.m.Mul(m) }
+
+func (c *Canvas) Rect(x, y, w, h, radius float64, s Style) {
+	radius = math.Min(radius, math.Min(w, h)/2)
+	var pts []Point
+	if radius <= 0 {
+		pts = []Point{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}}
+	} else {
+		corners := []struct{ cx, cy, start float64 }{
+			{x + w - radius, y + radius, -90},
+			{x + w - radius, y + h - radius, 0},
+			{x + radius, y + h - radius, 90},
+			{x + radius, y + radius, 180},
+		}
+		for _, k := range corners {
+			pts = append(pts, arc(k.cx, k.cy, radius, radius, k.start, 90, 8)...)
+		}
+	}
+	c.shape(pts, true, s)
+}
+
+func (c *Canvas) Ellipse(cx, cy, rx, ry float64, s Style) {
+	c.shape(arc(cx, cy, rx, ry, 0, 360, 64)[:64], true, s)
+}
+
+func (c *Canvas) Polygon(points []Point, closed bool, s Style) {
+	if len(points) < 2 {
+		return
+	}
+	if !closed {
+		s.Fill, s.Gradient = Color{}, nil
+	}
+	c.shape(points, closed, s)
+}
+
+func (c *Canvas) Clip(points []Point) {
+	mask := image.NewAlpha(c.img.Bounds())
+	if len(points) >= 3 {
+		c.rasterize([][]Point{c.device(points)}, func(x, y int, cov float64) {
+			if c.clip != nil {
+				cov *= float64(c.clip.AlphaAt(x, y).A) / 255
+			}
+			mask.SetAlpha(x, y, color.Alpha{A: clamp8(cov * 255)})
+		})
+	}
+	c.clip = mask
+}
+
+func (c *Canvas) SetBlendMode(mode string) bool {
+	if !blendModes[mode] {
+		return false
+	}
+	c.mode = mode
+	return true
+}
+
+// BlurBackdrop blurs the pixels under the polygon. The radius is in local
+// units, so it scales with the element.
+func (c *Canvas) BlurBackdrop(points []Point, radius float64) bool {
+	outline := c.device(points)
+	minX, minY, maxX, maxY := pointBounds(outline)
+	r := int(math.Round(radius * math.Sqrt(math.Abs(c.m[0]*c.m[3]-c.m[1]*c.m[2]))))
+	area := image.Rect(int(math.Floor(minX))-r, int(math.Floor(minY))-r, int(math.Ceil(maxX))+r, int(math.Ceil(maxY))+r).Intersect(c.img.Bounds())
+	if r <= 0 || area.Empty() {
+		return true
+	}
+	blurred := image.NewRGBA(area)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		copy(blurred.Pix[blurred.PixOffset(area.Min.X, y):], c.img.Pix[c.img.PixOffset(area.Min.X, y):c.img.PixOffset(area.Max.X, y)])
+	}
+	blurPixels(blurred.Pix, blurred.Stride, area.Dx(), area.Dy(), r)
+	c.rasterize([][]Point{outline}, func(x, y int, cov float64) {
+		if c.clip != nil {
+			cov *= float64(c.clip.AlphaAt(x, y).A) / 255
+		}
+		if !(image.Point{x, y}).In(area) {
+			return
+		}
+		i, j := c.img.PixOffset(x, y), blurred.PixOffset(x, y)
+		for ch := 0; ch < 4; ch++ {
+			c.img.Pix[i+ch] = clamp8(float64(c.img.Pix[i+ch])*(1-cov) + float64(blurred.Pix[j+ch])*cov)
+		}
+	})
+	return true
+}
+
+// Text draws a box per glyph: x-height for lowercase letters, cap height for
+// everything else that is not a space.
+func (c *Canvas) Text(x, y float64, t TextRun) {
+	if t.Text == "" || !t.Color.Visible() {
+		return
+	}
+	var boxes [][]Point
+	for _, r := range t.Text {
+		adv := t.width(string(r))
+		if !unicode.IsSpace(r) {
+			top := 0.72
+			if unicode.IsLower(r) {
+				top = 0.52
+			}
+			x0, x1 := x+adv*0.1, x+adv*0.9
+			y0 := y - t.Size*top
+			boxes = append(boxes, c.device([]Point{{x0, y0}, {x1, y0}, {x1, y}, {x0, y}}))
+		}
+		x += adv
+	}
+	c.fill(boxes, t.Color)
+}
+
+// Image draws img scaled into the rectangle, sampling the nearest source
+// pixel for each covered canvas pixel.
+func (c *Canvas) Image(img image.Image, x, y, w, h, alpha float64) {
+	b := img.Bounds()
+	inv, ok := c.m.invert()
+	if alpha <= 0 || w <= 0 || h <= 0 || b.Empty() || !ok {
+		return
+	}
+	corners := c.device([]Point{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}})
+	minX, minY, maxX, maxY := pointBounds(corners)
+	bounds := c.img.Bounds()
+	x0, y0 := max(int(math.Floor(minX)), bounds.Min.X), max(int(math.Floor(minY)), bounds.Min.Y)
+	x1, y1 := min(int(math.Ceil(maxX)), bounds.Max.X), min(int(math.Ceil(maxY)), bounds.Max.Y)
+	for py := y0; py < y1; py++ {
+		for px := x0; px < x1; px++ {
+			lx, ly := inv.apply(float64(px)+0.5, float64(py)+0.5)
+			u, v := (lx-x)/w, (ly-y)/h
+			if u < 0 || u >= 1 || v < 0 || v >= 1 {
+				continue
+			}
+			src := color.NRGBAModel.Convert(img.At(b.Min.X+int(u*float64(b.Dx())), b.Min.Y+int(v*float64(b.Dy())))).(color.NRGBA)
+			c.blend(px, py, Color{
+				R: float64(src.R) / 255,
+				G: float64(src.G) / 255,
+				B: float64(src.B) / 255,
+				A: float64(src.A) / 255 * alpha,
+			}, 1)
+		}
+	}
+}
+
+// shape fills and strokes a local-space outline.
+func (c *Canvas) shape(pts []Point, closed bool, s Style) {
+	if s.Gradient != nil && closed {
+		c.fillGradient([][]Point{c.device(pts)}, s.Gradient)
+	} else if s.Fill.Visible() && closed {
+		c.fill([][]Point{c.device(pts)}, s.Fill)
+	}
+	if s.Stroke.Visible() && s.StrokeWidth > 0 {
+		c.fill(c.strokeOutline(pts, closed, s.StrokeWidth), s.Stroke)
+	}
+}
+
+// strokeOutline returns a quad per segment of the outline, widened around
+// the centerline in local space and consistently wound so they merge under
+// the nonzero rule.
+func (c *Canvas) strokeOutline(pts []Point, closed bool, width float64) [][]Point {
+	n := len(pts)
+	segments := n - 1
+	if closed {
+		segments = n
+	}
+	var quads [][]Point
+	half := width / 2
+	for i := 0; i < segments; i++ {
+		a, b := pts[i], pts[(i+1)%n]
+		dx, dy := b.X-a.X, b.Y-a.Y
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			continue
+		}
+		// Extend each segment by half the width so corners are covered.
+		ex, ey := dx/l*half, dy/l*half
+		nx, ny := -ey, ex
+		quad := []Point{
+			{a.X - ex + nx, a.Y - ey + ny},
+			{b.X + ex + nx, b.Y + ey + ny},
+			{b.X + ex - nx, b.Y + ey - ny},
+			{a.X - ex - nx, a.Y - ey - ny},
+		}
+		quads = append(quads, c.device(quad))
+	}
+	for _, q := range quads {
+		if signedArea(q) < 0 {
+			for i, j := 0, len(q)-1; i < j; i, j = i+1, j-1 {
+				q[i], q[j] = q[j], q[i]
+			}
+		}
+	}
+	return quads
+}
+
+// fill paints the union of device-space polygons (nonzero winding) with col.
+func (c *Canvas) fill(polys [][]Point, col Color) {
+	c.rasterize(polys, func(x, y int, cov float64) { c.blend(x, y, col, cov) })
+}
+
+// fillGradient paints device-space polygons with a gradient in the current
+// local coordinates.
+func (c *Canvas) fillGradient(polys [][]Point, g *Gradient) {
+	inv, ok := c.m.invert()
+	if !ok {
+		return
+	}
+	c.rasterize(polys, func(x, y int, cov float64) {
+		lx, ly := inv.apply(float64(x)+0.5, float64(y)+0.5)
+		if t, ok := g.offset(lx, ly); ok {
+			c.blend(x, y, g.ColorAt(math.Min(math.Max(t, 0), 1)), cov)
+		}
+	})
+}
+
+// rasterize calls plot with the coverage of each pixel touched by the union
+// of device-space polygons (nonzero winding).
+func (c *Canvas) rasterize(polys [][]Point, plot func(x, y int, cov float64)) {
+	type edge struct {
+		x0, y0, x1, y1 float64
+		dir            int
+	}
+	var edges []edge
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, p := range polys {
+		for i := range p {
+			a, b := p[i], p[(i+1)%len(p)]
+			if a.Y == b.Y {
+				continue
+			}
+			e := edge{a.X, a.Y, b.X, b.Y, 1}
+			if a.Y > b.Y {
+				e = edge{b.X, b.Y, a.X, a.Y, -1}
+			}
+			edges = append(edges, e)
+			minY, maxY = math.Min(minY, e.y0), math.Max(maxY, e.y1)
+		}
+	}
+	if len(edges) == 0 {
+		return
+	}
+
+	bounds := c.img.Bounds()
+	y0, y1 := max(int(math.Floor(minY)), bounds.Min.Y), min(int(math.Ceil(maxY)), bounds.Max.Y)
+	width := bounds.Dx()
+	coverage := make([]float64, width+1)
+	type crossing struct {
+		x   float64
+		dir int
+	}
+	var xs []crossing
+	for py := y0; py < y1; py++ {
+		for i := range coverage {
+			coverage[i] = 0
+		}
+		touched := false
+		for k := 0; k < samplesPerPixel; k++ {
+			sy := float64(py) + (float64(k)+0.5)/samplesPerPixel
+			xs = xs[:0]
+			for _, e := range edges {
+				if sy < e.y0 || sy >= e.y1 {
+					continue
+				}
+				t := (sy - e.y0) / (e.y1 - e.y0)
+				xs = append(xs, crossing{e.x0 + t*(e.x1-e.x0), e.dir})
+			}
+			sort.Slice(xs, func(i, j int) bool { return xs[i].x < xs[j].x })
+			winding := 0
+			for i := 0; i+1 < len(xs); i++ {
+				winding += xs[i].dir
+				if winding != 0 {
+					addSpan(coverage, xs[i].x-float64(bounds.Min.X), xs[i+1].x-float64(bounds.Min.X), 1.0/samplesPerPixel)
+					touched = true
+				}
+			}
+		}
+		if !touched {
+			continue
+		}
+		for px := 0; px < width; px++ {
+			if coverage[px] > 0 {
+				plot(bounds.Min.X+px, py, math.Min(coverage[px], 1))
+			}
+		}
+	}
+}
+
+// addSpan adds weight times the covered fraction of each pixel in [x0, x1).
+func addSpan(coverage []float64, x0, x1, weight float64) {
+	limit := float64(len(coverage) - 1)
+	x0, x1 = math.Max(x0, 0), math.Min(x1, limit)
+	if x1 <= x0 {
+		return
+	}
+	first, last := int(x0), int(x1)
+	if first == last {
+		coverage[first] += (x1 - x0) * weight
+		return
+	}
+	coverage[first] += (float64(first+1) - x0) * weight
+	for px := first + 1; px < last; px++ {
+		coverage[px] += weight
+	}
+	if last < len(coverage) {
+		coverage[last] += (x1 - float64(last)) * weight
+	}
+}
+
+// blend composites col over the pixel with the given coverage, inside the
+// clip and in the current blend mode.
+func (c *Canvas) blend(x, y int, col Color, coverage float64) {
+	if c.clip != nil {
+		coverage *= float64(c.clip.AlphaAt(x, y).A) / 255
+	}
+	a := col.A * coverage
+	if a <= 0 {
+		return
+	}
+	i := c.img.PixOffset(x, y)
+	p := c.img.Pix[i : i+4 : i+4]
+	if backdrop := float64(p[3]) / 255; c.mode != "" && backdrop > 0 {
+		// The source color is mixed with the blended color in proportion
+		// to how opaque the backdrop is (Compositing and Blending, 5.8).
+		cb := Color{R: float64(p[0]) / 255 / backdrop, G: float64(p[1]) / 255 / backdrop, B: float64(p[2]) / 255 / backdrop}
+		b := blendColors(c.mode, cb, col)
+		col.R = (1-backdrop)*col.R + backdrop*b.R
+		col.G = (1-backdrop)*col.G + backdrop*b.G
+		col.B = (1-backdrop)*col.B + backdrop*b.B
+	}
+	inv := 1 - a
+	p[0] = clamp8(col.R*a*255 + float64(p[0])*inv)
+	p[1] = clamp8(col.G*a*255 + float64(p[1])*inv)
+	p[2] = clamp8(col.B*a*255 + float64(p[2])*inv)
+	p[3] = clamp8(a*255 + float64(p[3])*inv)
+}
+
+// device maps local points through the current transform.
+func (c *Canvas) device(pts []Point) []Point {
+	out := make([]Point, len(pts))
+	for i, p := range pts {
+		out[i].X, out[i].Y = c.m.apply(p.X, p.Y)
+	}
+	return out
+}
+
+// blendColors applies a blend mode to unpremultiplied backdrop and source
+// colors, following the W3C Compositing and Blending definitions.
+func blendColors(mode string, cb, cs Color) Color {
+	switch mode {
+	case "hue":
+		return setLum(setSat(cs, sat(cb)), lum(cb))
+	case "saturation":
+		return setLum(setSat(cb, sat(cs)), lum(cb))
+	case "color":
+		return setLum(cs, lum(cb))
+	case "luminosity":
+		return setLum(cb, lum(cs))
+	}
+	return Color{
+		R: blendChannel(mode, cb.R, cs.R),
+		G: blendChannel(mode, cb.G, cs.G),
+		B: blendChannel(mode, cb.B, cs.B),
+	}
+}
+
+func blendChannel(mode string, cb, cs float64) float64 {
+	switch mode {
+	case "multiply":
+		return cb * cs
+	case "screen":
+		return cb + cs - cb*cs
+	case "overlay":
+		return blendChannel("hard-light", cs, cb)
+	case "darken":
+		return math.Min(cb, cs)
+	case "lighten":
+		return math.Max(cb, cs)
+	case "color-dodge":
+		if cb == 0 {
+			return 0
+		}
+		if cs >= 1 {
+			return 1
+		}
+		return math.Min(1, cb/(1-cs))
+	case "color-burn":
+		if cb >= 1 {
+			return 1
+		}
+		if cs <= 0 {
+			return 0
+		}
+		return 1 - math.Min(1, (1-cb)/cs)
+	case "hard-light":
+		if cs <= 0.5 {
+			return cb * 2 * cs
+		}
+		return blendChannel("screen", cb, 2*cs-1)
+	case "soft-light":
+		if cs <= 0.5 {
+			return cb - (1-2*cs)*cb*(1-cb)
+		}
+		d := math.Sqrt(cb)
+		if cb <= 0.25 {
+			d = ((16*cb-12)*cb + 4) * cb
+		}
+		return cb + (2*cs-1)*(d-cb)
+	case "difference":
+		return math.Abs(cb - cs)
+	case "exclusion":
+		return cb + cs - 2*cb*cs
+	}
+	return cs
+}
+
+func lum(c Color) float64 { return 0.3*c.R + 0.59*c.G + 0.11*c.B }
+
+func setLum(c Color, l float64) Color {
+	d := l - lum(c)
+	c = Color{R: c.R + d, G: c.G + d, B: c.B + d}
+	l = lum(c)
+	n := math.Min(c.R, math.Min(c.G, c.B))
+	x := math.Max(c.R, math.Max(c.G, c.B))
+	if n < 0 {
+		c = Color{R: l + (c.R-l)*l/(l-n), G: l + (c.G-l)*l/(l-n), B: l + (c.B-l)*l/(l-n)}
+	}
+	if x > 1 {
+		c = Color{R: l + (c.R-l)*(1-l)/(x-l), G: l + (c.G-l)*(1-l)/(x-l), B: l + (c.B-l)*(1-l)/(x-l)}
+	}
+	return c
+}
+
+func sat(c Color) float64 {
+	return math.Max(c.R, math.Max(c.G, c.B)) - math.Min(c.R, math.Min(c.G, c.B))
+}
+
+// setSat scales c's channels so the spread between the largest and
+// smallest is s, keeping their order.
+func setSat(c Color, s float64) Color {
+	n := math.Min(c.R, math.Min(c.G, c.B))
+	spread := sat(c)
+	scale := func(v float64) float64 {
+		if spread == 0 {
+			return 0
+		}
+		return (v - n) * s / spread
+	}
+	return Color{R: scale(c.R), G: scale(c.G), B: scale(c.B)}
+}
+
+func (m Matrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+func (m Matrix) invert() (Matrix, bool) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if det == 0 {
+		return Matrix{}, false
+	}
+	return Matrix{
+		m[3] / det,
+		-m[1] / det,
+		-m[2] / det,
+		m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+// arc returns steps+1 points along an elliptical arc, angles in degrees.
+func arc(cx, cy, rx, ry, start, sweep float64, steps int) []Point {
+	pts := make([]Point, 0, steps+1)
+	for i := 0; i <= steps; i++ {
+		a := (start + sweep*float64(i)/float64(steps)) * math.Pi / 180
+		pts = append(pts, Point{cx + rx*math.Cos(a), cy + ry*math.Sin(a)})
+	}
+	return pts
+}
+
+func signedArea(p []Point) float64 {
+	var a float64
+	for i := range p {
+		j := (i + 1) % len(p)
+		a += p[i].X*p[j].Y - p[j].X*p[i].Y
+	}
+	return a / 2
+}
+
+func pointBounds(p []Point) (minX, minY, maxX, maxY float64) {
+	minX, minY = math.Inf(1), math.Inf(1)
+	maxX, maxY = math.Inf(-1), math.Inf(-1)
+	for _, pt := range p {
+		minX, maxX = math.Min(minX, pt.X), math.Max(maxX, pt.X)
+		minY, maxY = math.Min(minY, pt.Y), math.Max(maxY, pt.Y)
+	}
+	return
+}
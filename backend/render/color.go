@@ -0,0 +1,129 @@
+package render
+
+import (
+	"strconv"
+	"strings"
+)
+
+var namedColors = map[string]Color{
+	"black":   {0, 0, 0, 1},
+	"white":   {1, 1, 1, 1},
+	"red":     {1, 0, 0, 1},
+	"green":   {0, 128.0 / 255, 0, 1},
+	"blue":    {0, 0, 1, 1},
+	"yellow":  {1, 1, 0, 1},
+	"orange":  {1, 165.0 / 255, 0, 1},
+	"purple":  {128.0 / 255, 0, 128.0 / 255, 1},
+	"gray":    {128.0 / 255, 128.0 / 255, 128.0 / 255, 1},
+	"grey":    {128.0 / 255, 128.0 / 255, 128.0 / 255, 1},
+	"pink":    {1, 192.0 / 255, 203.0 / 255, 1},
+	"brown":   {165.0 / 255, 42.0 / 255, 42.0 / 255, 1},
+	"cyan":    {0, 1, 1, 1},
+	"magenta": {1, 0, 1, 1},
+}
+
+// ParseColor parses CSS hex, rgb()/rgba() and basic named colors. It
+// returns false for anything else, including "transparent".
+func ParseColor(s string) (Color, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := namedColors[s]; ok {
+		return c, true
+	}
+
+	if strings.HasPrefix(s, "#") {
+		hex := s[1:]
+		if len(hex) == 3 || len(hex) == 4 {
+			var b strings.Builder
+			for _, r := range hex {
+				b.WriteRune(r)
+				b.WriteRune(r)
+			}
+			hex = b.String()
+		}
+		if len(hex) != 6 && len(hex) != 8 {
+			return Color{}, false
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return Color{}, false
+		}
+		if len(hex) == 6 {
+			v = v<<8 | 0xff
+		}
+		return Color{
+			R: float64(v>>24&0xff) / 255,
+			G: float64(v>>16&0xff) / 255,
+			B: float64(v>>8&0xff) / 255,
+			A: float64(v&0xff) / 255,
+		}, true
+	}
+
+	if args, ok := cut(s, "rgba("); ok {
+		return parseRGB(args, true)
+	}
+	if args, ok := cut(s, "rgb("); ok {
+		return parseRGB(args, false)
+	}
+	return Color{}, false
+}
+
+func cut(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) || !strings.HasSuffix(s, ")") {
+		return "", false
+	}
+	return s[len(prefix) : len(s)-1], true
+}
+
+func parseRGB(args string, alpha bool) (Color, bool) {
+	parts := strings.Split(args, ",")
+	if (alpha && len(parts) != 4) || (!alpha && len(parts) != 3) {
+		return Color{}, false
+	}
+	var ch [4]float64
+	ch[3] = 1
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		pct := strings.HasSuffix(p, "%")
+		v, err := strconv.ParseFloat(strings.TrimSuffix(p, "%"), 64)
+		if err != nil {
+			return Color{}, false
+		}
+		switch {
+		case pct:
+			v /= 100
+		case i < 3:
+			v /= 255
+		}
+		ch[i] = clamp(v)
+	}
+	return Color{ch[0], ch[1], ch[2], ch[3]}, true
+}
+
+// paint converts a fill or stroke value to a color. Gradients fall back to
+// their first color stop, for callers that cannot draw them (see
+// parseGradient); patterns are not drawn and are reported as degraded.
+func paint(v any, opacity float64, res *Result) Color {
+	switch p := v.(type) {
+	case string:
+		c, ok := ParseColor(p)
+		if !ok {
+			return Color{}
+		}
+		c.A *= opacity
+		return c
+	case map[string]any:
+		if !isGradient(p) {
+			res.degrade(FeaturePattern)
+			return Color{}
+		}
+		stops, _ := p["colorStops"].([]any)
+		for _, stop := range stops {
+			if m, ok := stop.(map[string]any); ok {
+				if color, ok := m["color"].(string); ok {
+					return paint(color, opacity, res)
+				}
+			}
+		}
+	}
+	return Color{}
+}
@@ -0,0 +1,195 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// ColorSpace is the RGB space a document's colors are authored in. Renders
+// draw colors in the working space unchanged and tag the output with the
+// space's profile; only pixels from other spaces (images carrying their own
+// profile, fixed UI colors) are converted.
+type ColorSpace string
+
+// Working color spaces
+const (
+	SRGB      ColorSpace = "srgb"
+	DisplayP3 ColorSpace = "display-p3"
+)
+
+var (
+	srgbProfile = &Profile{
+		Description: "sRGB IEC61966-2.1",
+		toXYZ: [3][3]float64{
+			{0.4360747, 0.3850649, 0.1430804},
+			{0.2225045, 0.7168786, 0.0606169},
+			{0.0139322, 0.0971045, 0.7141733},
+		},
+		trc: [3]curve{srgbCurve, srgbCurve, srgbCurve},
+	}
+	displayP3Profile = &Profile{
+		Description: "Display P3",
+		toXYZ: [3][3]float64{
+			{0.515121, 0.291977, 0.157104},
+			{0.241196, 0.692245, 0.066574},
+			{-0.001053, 0.041885, 0.784073},
+		},
+		trc: [3]curve{srgbCurve, srgbCurve, srgbCurve},
+	}
+	srgbICC      = srgbProfile.Bytes()
+	displayP3ICC = displayP3Profile.Bytes()
+)
+
+// WorkingSpace maps a project's color profile setting to the space it is
+// rendered in. CMYK projects are designed and rendered in sRGB; separation
+// happens at the print vendor.
+func WorkingSpace(profile string) ColorSpace {
+	if ColorSpace(profile) == DisplayP3 {
+		return DisplayP3
+	}
+	return SRGB
+}
+
+// Profile returns the space's ICC profile.
+func (s ColorSpace) Profile() *Profile {
+	if s == DisplayP3 {
+		return displayP3Profile
+	}
+	return srgbProfile
+}
+
+// ICC returns the space's encoded ICC profile.
+func (s ColorSpace) ICC() []byte {
+	if s == DisplayP3 {
+		return displayP3ICC
+	}
+	return srgbICC
+}
+
+// Space returns the working space the profile describes, or "" when it
+// matches neither. Profiles are compared by their colorants and curves, not
+// their names, which vary between vendors.
+func (p *Profile) Space() ColorSpace {
+	for _, s := range []ColorSpace{SRGB, DisplayP3} {
+		if p.equivalent(s.Profile()) {
+			return s
+		}
+	}
+	return ""
+}
+
+func (p *Profile) equivalent(q *Profile) bool {
+	const tolerance = 0.002
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.Abs(p.toXYZ[i][j]-q.toXYZ[i][j]) > tolerance {
+				return false
+			}
+		}
+		for _, x := range []float64{0.02, 0.2, 0.5, 0.8} {
+			if math.Abs(p.trc[i].eval(x)-q.trc[i].eval(x)) > tolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// transform maps linear RGB in one profile to linear RGB in another through
+// the shared D50 connection space. Colors outside the destination gamut are
+// clipped.
+type transform struct {
+	src, dst *Profile
+	m        [3][3]float64
+}
+
+func newTransform(src, dst *Profile) transform {
+	return transform{src: src, dst: dst, m: mul3(invert3(dst.toXYZ), src.toXYZ)}
+}
+
+func (t transform) linear(r, g, b float64) (float64, float64, float64) {
+	m := &t.m
+	return m[0][0]*r + m[0][1]*g + m[0][2]*b,
+		m[1][0]*r + m[1][1]*g + m[1][2]*b,
+		m[2][0]*r + m[2][1]*g + m[2][2]*b
+}
+
+// Convert maps a color authored in one space to the same appearance in
+// another. Alpha is unchanged.
+func (c Color) Convert(from, to ColorSpace) Color {
+	if from == to {
+		return c
+	}
+	t := newTransform(from.Profile(), to.Profile())
+	r, g, b := t.linear(t.src.trc[0].eval(c.R), t.src.trc[1].eval(c.G), t.src.trc[2].eval(c.B))
+	return Color{
+		R: t.dst.trc[0].invert(clampUnit(r)),
+		G: t.dst.trc[1].invert(clampUnit(g)),
+		B: t.dst.trc[2].invert(clampUnit(b)),
+		A: c.A,
+	}
+}
+
+// ConvertImage returns img converted from the src profile to dst.
+func ConvertImage(img image.Image, src, dst *Profile) *image.NRGBA {
+	t := newTransform(src, dst)
+	var decode [3][256]float64
+	for ch := 0; ch < 3; ch++ {
+		for v := range decode[ch] {
+			decode[ch][v] = src.trc[ch].eval(float64(v) / 255)
+		}
+	}
+	// Linear light needs more precision than 8 bits near black.
+	const steps = 4096
+	var encode [3][steps + 1]uint8
+	for ch := 0; ch < 3; ch++ {
+		for i := range encode[ch] {
+			encode[ch][i] = clamp8(dst.trc[ch].invert(float64(i)/steps) * 255)
+		}
+	}
+	lookup := func(ch int, v float64) uint8 { return encode[ch][int(math.Round(clampUnit(v)*steps))] }
+
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			r, g, bl := t.linear(decode[0][p.R], decode[1][p.G], decode[2][p.B])
+			i := out.PixOffset(x-b.Min.X, y-b.Min.Y)
+			out.Pix[i+0] = lookup(0, r)
+			out.Pix[i+1] = lookup(1, g)
+			out.Pix[i+2] = lookup(2, bl)
+			out.Pix[i+3] = p.A
+		}
+	}
+	return out
+}
+
+func clampUnit(v float64) float64 { return math.Max(0, math.Min(1, v)) }
+
+func mul3(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if det == 0 {
+		return [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	}
+	return [3][3]float64{
+		{(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det, (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det, (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det},
+		{(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det, (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det, (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det},
+		{(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det, (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det, (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det},
+	}
+}
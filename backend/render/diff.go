@@ -0,0 +1,84 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Diff summarises how far two renders are apart perceptually. Pixels are
+// composited over white and compared in CIELAB, so the numbers track what a
+// viewer would notice rather than raw channel values.
+type Diff struct {
+	// SizeMismatch is set when the images have different dimensions; the
+	// other fields are then meaningless
+	SizeMismatch bool `json:"sizeMismatch,omitempty"`
+	// Changed counts pixels whose color difference exceeds the threshold
+	Changed int `json:"changed"`
+	// ChangedRatio is Changed as a fraction of all pixels
+	ChangedRatio float64 `json:"changedRatio"`
+	// MaxDelta is the largest per-pixel difference (CIE76 ΔE)
+	MaxDelta float64 `json:"maxDelta"`
+	// MeanDelta is the average per-pixel difference
+	MeanDelta float64 `json:"meanDelta"`
+}
+
+// JustNoticeableDelta is the ΔE at which most viewers start to see a
+// difference between two flat colors.
+const JustNoticeableDelta = 2.3
+
+// Compare diffs two images, counting pixels that differ by more than
+// threshold ΔE.
+func Compare(a, b image.Image, threshold float64) Diff {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return Diff{SizeMismatch: true, Changed: ab.Dx() * ab.Dy(), ChangedRatio: 1}
+	}
+	var d Diff
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			delta := deltaE(lab(a.At(ab.Min.X+x, ab.Min.Y+y)), lab(b.At(bb.Min.X+x, bb.Min.Y+y)))
+			sum += delta
+			d.MaxDelta = math.Max(d.MaxDelta, delta)
+			if delta > threshold {
+				d.Changed++
+			}
+		}
+	}
+	if n := ab.Dx() * ab.Dy(); n > 0 {
+		d.ChangedRatio = float64(d.Changed) / float64(n)
+		d.MeanDelta = sum / float64(n)
+	}
+	return d
+}
+
+// lab converts a color composited over white to CIELAB (D65).
+func lab(c color.Color) [3]float64 {
+	r, g, b, a := c.RGBA()
+	// RGBA is premultiplied; adding the uncovered share of white composites it.
+	white := 65535 - a
+	lin := func(v uint32) float64 {
+		s := float64(v+white) / 65535
+		if s <= 0.04045 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	lr, lg, lb := lin(r), lin(g), lin(b)
+	x := (0.4124*lr + 0.3576*lg + 0.1805*lb) / 0.95047
+	y := 0.2126*lr + 0.7152*lg + 0.0722*lb
+	z := (0.0193*lr + 0.1192*lg + 0.9505*lb) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func deltaE(p, q [3]float64) float64 {
+	return math.Sqrt((p[0]-q[0])*(p[0]-q[0]) + (p[1]-q[1])*(p[1]-q[1]) + (p[2]-q[2])*(p[2]-q[2]))
+}
@@ -0,0 +1,400 @@
+package render
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Gradient is a linear or radial gradient in an element's local
+// coordinates. Radial gradients run between two circles, as in the canvas
+// API. Colors outside the stops extend the first and last stop.
+type Gradient struct {
+	Radial         bool
+	X1, Y1, X2, Y2 float64
+	R1, R2         float64
+	Stops          []GradientStop
+}
+
+// GradientStop is a color at an offset in [0, 1] along a gradient
+type GradientStop struct {
+	Offset float64
+	Color  Color
+}
+
+// isGradient reports whether a fill or stroke value is a gradient.
+func isGradient(v any) bool {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+	kind, _ := m["type"].(string)
+	return kind == "linear" || kind == "radial"
+}
+
+// parseGradient reads a canvas gradient fill. Coordinates are in pixels
+// from the element's top-left corner, or fractions of its size with
+// gradientUnits "percentage".
+func parseGradient(v any, w, h, opacity float64) *Gradient {
+	if !isGradient(v) {
+		return nil
+	}
+	m := v.(map[string]any)
+	coords, _ := m["coords"].(map[string]any)
+	g := &Gradient{
+		Radial: m["type"] == "radial",
+		X1:     num(coords, "x1", 0),
+		Y1:     num(coords, "y1", 0),
+		X2:     num(coords, "x2", 0),
+		Y2:     num(coords, "y2", 0),
+		R1:     num(coords, "r1", 0),
+		R2:     num(coords, "r2", 0),
+	}
+	if m["gradientUnits"] == "percentage" {
+		g.X1, g.X2, g.Y1, g.Y2 = g.X1*w, g.X2*w, g.Y1*h, g.Y2*h
+		g.R1, g.R2 = g.R1*math.Max(w, h), g.R2*math.Max(w, h)
+	}
+	dx, dy := num(m, "offsetX", 0), num(m, "offsetY", 0)
+	g.X1, g.Y1, g.X2, g.Y2 = g.X1+dx, g.Y1+dy, g.X2+dx, g.Y2+dy
+	if t, ok := matrixValue(m["gradientTransform"]); ok {
+		g.X1, g.Y1 = t.apply(g.X1, g.Y1)
+		g.X2, g.Y2 = t.apply(g.X2, g.Y2)
+		scale := math.Sqrt(math.Abs(t[0]*t[3] - t[1]*t[2]))
+		g.R1, g.R2 = g.R1*scale, g.R2*scale
+	}
+
+	stops, _ := m["colorStops"].([]any)
+	for _, raw := range stops {
+		stop, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		s, _ := stop["color"].(string)
+		c, ok := ParseColor(s)
+		if !ok {
+			continue
+		}
+		c.A *= clamp(num(stop, "opacity", 1)) * opacity
+		g.Stops = append(g.Stops, GradientStop{Offset: clamp(num(stop, "offset", 0)), Color: c})
+	}
+	if len(g.Stops) == 0 {
+		return nil
+	}
+	sort.SliceStable(g.Stops, func(i, j int) bool { return g.Stops[i].Offset < g.Stops[j].Offset })
+	return g
+}
+
+func matrixValue(v any) (Matrix, bool) {
+	raw, ok := v.([]any)
+	if !ok || len(raw) != 6 {
+		return Matrix{}, false
+	}
+	var m Matrix
+	for i, x := range raw {
+		f, ok := x.(float64)
+		if !ok {
+			return Matrix{}, false
+		}
+		m[i] = f
+	}
+	return m, true
+}
+
+// ColorAt returns the gradient color at offset t.
+func (g *Gradient) ColorAt(t float64) Color {
+	stops := g.Stops
+	if t <= stops[0].Offset {
+		return stops[0].Color
+	}
+	for i := 1; i < len(stops); i++ {
+		if t <= stops[i].Offset {
+			a, b := stops[i-1], stops[i]
+			span := b.Offset - a.Offset
+			if span <= 0 {
+				return b.Color
+			}
+			k := (t - a.Offset) / span
+			return Color{
+				R: a.Color.R + (b.Color.R-a.Color.R)*k,
+				G: a.Color.G + (b.Color.G-a.Color.G)*k,
+				B: a.Color.B + (b.Color.B-a.Color.B)*k,
+				A: a.Color.A + (b.Color.A-a.Color.A)*k,
+			}
+		}
+	}
+	return stops[len(stops)-1].Color
+}
+
+// offset returns the gradient position of a local point, and false for
+// points a radial gradient does not cover.
+func (g *Gradient) offset(x, y float64) (float64, bool) {
+	if !g.Radial {
+		dx, dy := g.X2-g.X1, g.Y2-g.Y1
+		l := dx*dx + dy*dy
+		if l == 0 {
+			return 0, true
+		}
+		return ((x-g.X1)*dx + (y-g.Y1)*dy) / l, true
+	}
+	// Find the largest t whose circle, interpolated between the two, passes
+	// through the point with a non-negative radius.
+	cdx, cdy, dr := g.X2-g.X1, g.Y2-g.Y1, g.R2-g.R1
+	pdx, pdy := x-g.X1, y-g.Y1
+	a := cdx*cdx + cdy*cdy - dr*dr
+	b := pdx*cdx + pdy*cdy + g.R1*dr
+	c := pdx*pdx + pdy*pdy - g.R1*g.R1
+	valid := func(t float64) bool { return g.R1+t*dr >= 0 }
+	if math.Abs(a) < 1e-9 {
+		if b == 0 {
+			return 0, false
+		}
+		t := c / (2 * b)
+		return t, valid(t)
+	}
+	disc := b*b - a*c
+	if disc < 0 {
+		return 0, false
+	}
+	root := math.Sqrt(disc)
+	t1, t2 := (b+root)/a, (b-root)/a
+	if t1 < t2 {
+		t1, t2 = t2, t1
+	}
+	if valid(t1) {
+		return t1, true
+	}
+	return t2, valid(t2)
+}
+
+// blendModes are the canvas globalCompositeOperation values that are blend
+// modes. The remaining values are Porter-Duff operators.
+var blendModes = map[string]bool{
+	"multiply": true, "screen": true, "overlay": true, "darken": true, "lighten": true,
+	"color-dodge": true, "color-burn": true, "hard-light": true, "soft-light": true,
+	"difference": true, "exclusion": true, "hue": true, "saturation": true, "color": true, "luminosity": true,
+}
+
+func applyBlendMode(s Surface, obj map[string]any, res *Result) {
+	op, _ := obj["globalCompositeOperation"].(string)
+	switch {
+	case op == "" || op == "source-over":
+	case !blendModes[op]:
+		res.degrade(FeatureCompositing)
+	case !s.SetBlendMode(op):
+		res.degrade(FeatureBlendMode)
+	}
+}
+
+// applyClip clips to an element's clipPath. The clip shape is positioned
+// relative to the element's center, or on the page when it is
+// absolutePositioned; the points handed to the surface are in the parent's
+// coordinates, where drawing currently is.
+func applyClip(s Surface, clip map[string]any, parent, m Matrix, w, h float64, res *Result) {
+	kind, _ := clip["type"].(string)
+	outline := shapeOutline(clip, strings.ToLower(kind), num(clip, "width", 0), num(clip, "height", 0))
+	inverted, _ := clip["inverted"].(bool)
+	if outline == nil || inverted {
+		res.degrade(FeatureClipPath)
+		return
+	}
+	var place Matrix
+	if abs, _ := clip["absolutePositioned"].(bool); abs {
+		inv, ok := parent.invert()
+		if !ok {
+			return
+		}
+		place = inv.Mul(objectMatrix(clip))
+	} else {
+		place = m.Mul(Translate(w/2, h/2)).Mul(objectMatrix(clip))
+	}
+	for i, p := range outline {
+		outline[i].X, outline[i].Y = place.apply(p.X, p.Y)
+	}
+	s.Clip(outline)
+}
+
+// shapeOutline returns a basic shape as a polygon in its local coordinates,
+// with curves flattened, or nil for other elements.
+func shapeOutline(obj map[string]any, kind string, w, h float64) []Point {
+	switch kind {
+	case "rect":
+		r := math.Min(num(obj, "rx", 0), math.Min(w, h)/2)
+		if r <= 0 {
+			return []Point{{0, 0}, {w, 0}, {w, h}, {0, h}}
+		}
+		var pts []Point
+		for _, k := range []struct{ cx, cy, start float64 }{
+			{w - r, r, -90}, {w - r, h - r, 0}, {r, h - r, 90}, {r, r, 180},
+		} {
+			pts = append(pts, arc(k.cx, k.cy, r, r, k.start, 90, 8)...)
+		}
+		return pts
+	case "circle":
+		r := num(obj, "radius", w/2)
+		return arc(r, r, r, r, 0, 360, 64)[:64]
+	case "ellipse":
+		rx, ry := num(obj, "rx", w/2), num(obj, "ry", h/2)
+		return arc(rx, ry, rx, ry, 0, 360, 64)[:64]
+	case "triangle":
+		return []Point{{w / 2, 0}, {w, h}, {0, h}}
+	case "polygon":
+		return localPoints(obj)
+	}
+	return nil
+}
+
+// drawShadow draws a shape's or text's shadow: a copy in the shadow color,
+// offset in the parent's coordinates so it does not turn with the element.
+// Blur is not rendered; the shadow keeps hard edges.
+func drawShadow(s Surface, obj map[string]any, kind string, m Matrix, w, h float64, style Style, font *Font, res *Result) {
+	raw, ok := obj["shadow"]
+	if !ok || raw == nil {
+		return
+	}
+	sh, ok := raw.(map[string]any)
+	if !ok || kind == "image" || kind == "group" {
+		res.degrade(FeatureShadow)
+		return
+	}
+	cs, _ := sh["color"].(string)
+	color, ok := ParseColor(cs)
+	if !ok || !color.Visible() {
+		return
+	}
+	if num(sh, "blur", 0) > 0 {
+		res.degrade(FeatureShadowBlur)
+	}
+	opacity := clamp(num(obj, "opacity", 1))
+
+	s.Save()
+	defer s.Restore()
+	s.Transform(Translate(num(sh, "offsetX", 0), num(sh, "offsetY", 0)))
+	s.Transform(m)
+	switch kind {
+	case "text", "i-text", "textbox":
+		color.A *= opacity
+		drawText(s, obj, w, color, font)
+	default:
+		shadow := Style{StrokeWidth: style.StrokeWidth}
+		if style.Fill.Visible() || style.Gradient != nil {
+			shadow.Fill = Color{color.R, color.G, color.B, color.A * opacity}
+		}
+		if style.Stroke.Visible() {
+			shadow.Stroke = Color{color.R, color.G, color.B, color.A * opacity}
+		}
+		if !drawShape(s, obj, kind, w, h, shadow) {
+			s.Rect(0, 0, w, h, 0, shadow)
+		}
+	}
+}
+
+// applyFilters applies canvas image filters to a copy of img. Unknown
+// filters are skipped and reported.
+func applyFilters(img image.Image, filters []any, res *Result) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	// Pixels are premultiplied; every filter here is linear in the color
+	// channels per pixel (or piecewise so), which keeps them exact.
+	each := func(fn func(r, g, b, a float64) (float64, float64, float64)) {
+		for i := 0; i+3 < len(out.Pix); i += 4 {
+			p := out.Pix[i : i+4 : i+4]
+			r, g, b := fn(float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3]))
+			p[0], p[1], p[2] = clampTo(r, p[3]), clampTo(g, p[3]), clampTo(b, p[3])
+		}
+	}
+	for _, raw := range filters {
+		f, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch kind, _ := f["type"].(string); kind {
+		case "Grayscale":
+			each(func(r, g, b, _ float64) (float64, float64, float64) {
+				l := 0.299*r + 0.587*g + 0.114*b
+				return l, l, l
+			})
+		case "Invert":
+			each(func(r, g, b, a float64) (float64, float64, float64) { return a - r, a - g, a - b })
+		case "Sepia":
+			each(func(r, g, b, _ float64) (float64, float64, float64) {
+				return 0.393*r + 0.769*g + 0.189*b, 0.349*r + 0.686*g + 0.168*b, 0.272*r + 0.534*g + 0.131*b
+			})
+		case "Brightness":
+			d := num(f, "brightness", 0) * 255
+			each(func(r, g, b, a float64) (float64, float64, float64) {
+				k := d * a / 255
+				return r + k, g + k, b + k
+			})
+		case "Contrast":
+			c := num(f, "contrast", 0) * 255
+			k := 259 * (c + 255) / (255 * (259 - c))
+			each(func(r, g, b, a float64) (float64, float64, float64) {
+				mid := 128 * a / 255
+				return k*(r-mid) + mid, k*(g-mid) + mid, k*(b-mid) + mid
+			})
+		case "Saturation":
+			adjust := -num(f, "saturation", 0)
+			each(func(r, g, b, _ float64) (float64, float64, float64) {
+				mx := math.Max(r, math.Max(g, b))
+				return r + (mx-r)*adjust, g + (mx-g)*adjust, b + (mx-b)*adjust
+			})
+		case "Blur":
+			// blur is a fraction of the image's larger side.
+			radius := int(math.Round(num(f, "blur", 0) * float64(max(b.Dx(), b.Dy())) / 2))
+			blurPixels(out.Pix, out.Stride, out.Bounds().Dx(), out.Bounds().Dy(), radius)
+		default:
+			res.degrade(FeatureImageFilter)
+		}
+	}
+	return out
+}
+
+// clampTo rounds a premultiplied channel into [0, a].
+func clampTo(v float64, a uint8) uint8 {
+	return clamp8(math.Min(v, float64(a)))
+}
+
+// blurPixels approximates a gaussian blur of 4-channel premultiplied pixels
+// with three box blurs in each direction.
+func blurPixels(pix []uint8, stride, w, h, radius int) {
+	if radius <= 0 || w == 0 || h == 0 {
+		return
+	}
+	line := make([]float64, max(w, h)*4)
+	out := make([]float64, len(line))
+	box := func(count int, index func(i int) int) {
+		for i := 0; i < count; i++ {
+			for ch := 0; ch < 4; ch++ {
+				line[i*4+ch] = float64(pix[index(i)+ch])
+			}
+		}
+		for k := 0; k < 3; k++ {
+			for ch := 0; ch < 4; ch++ {
+				var sum float64
+				for i := -radius; i <= radius; i++ {
+					sum += line[min(max(i, 0), count-1)*4+ch]
+				}
+				for i := 0; i < count; i++ {
+					out[i*4+ch] = sum / float64(2*radius+1)
+					sum += line[min(i+radius+1, count-1)*4+ch] - line[max(i-radius, 0)*4+ch]
+				}
+			}
+			line, out = out, line
+		}
+		for i := 0; i < count; i++ {
+			for ch := 0; ch < 4; ch++ {
+				pix[index(i)+ch] = clamp8(line[i*4+ch])
+			}
+		}
+	}
+	for y := 0; y < h; y++ {
+		box(w, func(i int) int { return y*stride + i*4 })
+	}
+	for x := 0; x < w; x++ {
+		box(h, func(i int) int { return i*stride + x*4 })
+	}
+}
@@ -0,0 +1,96 @@
+package render
+
+// Canvas features the renderer may have to drop or approximate. They are
+// the keys of Result.Unsupported, next to element types it cannot draw at
+// all (such as "path"), which are drawn as their bounding box.
+const (
+	FeatureGradient     = "gradient"           // gradient strokes and text fills
+	FeaturePattern      = "pattern"            // pattern fills
+	FeatureBlendMode    = "blendMode"          // globalCompositeOperation blend modes
+	FeatureCompositing  = "compositeOperation" // Porter-Duff operators other than source-over
+	FeatureClipPath     = "clipPath"
+	FeatureShadow       = "shadow"
+	FeatureShadowBlur   = "shadowBlur"
+	FeatureImageFilter  = "imageFilter"
+	FeatureBackdropBlur = "backdropBlur"
+	FeatureImage        = "image" // images that could not be loaded
+	FeaturePath         = "path"
+	FeatureBarcode      = "barcode" // barcodes whose value cannot be encoded
+	FeatureFont         = "font"    // uploaded fonts that could not be embedded
+)
+
+// Support levels
+const (
+	SupportFull        = "full"
+	SupportApproximate = "approximate"
+	SupportNone        = "none"
+)
+
+// Capability describes how an output format handles a canvas feature
+type Capability struct {
+	Feature string `json:"feature"`
+	Support string `json:"support"`
+	Note    string `json:"note,omitempty"`
+}
+
+// PDFCapabilities describes what PDF output can reproduce. Keep it in step
+// with PDFPage and drawObject.
+var PDFCapabilities = []Capability{
+	{FeatureGradient, SupportApproximate, "Linear and radial gradient fills on shapes are exact; gradient strokes and text use the first color stop."},
+	{FeaturePattern, SupportNone, "Pattern fills are left empty."},
+	{FeatureBlendMode, SupportFull, "All CSS blend modes."},
+	{FeatureCompositing, SupportNone, "Porter-Duff operators such as destination-out are drawn as source-over."},
+	{FeatureClipPath, SupportApproximate, "Rectangles, circles, ellipses, triangles and polygons; inverted clips and other shapes are ignored."},
+	{FeatureShadow, SupportApproximate, "Shapes and text; shadows on images and groups are dropped."},
+	{FeatureShadowBlur, SupportNone, "Shadows are drawn with hard edges."},
+	{FeatureImageFilter, SupportApproximate, "Grayscale, Invert, Sepia, Brightness, Contrast, Saturation and Blur; other filters are skipped."},
+	{FeatureBackdropBlur, SupportNone, "PDF cannot read back the page; the backdrop is left sharp."},
+	{FeatureImage, SupportFull, "Missing images are drawn as an outline."},
+	{FeaturePath, SupportNone, "Paths are drawn as their bounding box."},
+	{FeatureBarcode, SupportFull, "EAN-13, EAN-8, Code 128 and QR codes are drawn as vector bars; values that cannot be encoded are drawn as an outline."},
+	{FeatureFont, SupportApproximate, "TrueType fonts are embedded with only the glyphs drawn, or whole when their license forbids subsetting. Fonts whose license forbids embedding, fonts with PostScript outlines and fonts that cannot be loaded are replaced by Helvetica."},
+}
+
+// SVGCapabilities describes what SVG output can reproduce. SVG is drawn by
+// the same calls as PDF and differs only in what it cannot read back.
+var SVGCapabilities = svgCapabilities()
+
+func svgCapabilities() []Capability {
+	caps := append([]Capability{}, PDFCapabilities...)
+	for i, c := range caps {
+		if c.Feature == FeatureBackdropBlur {
+			caps[i].Note = "SVG cannot read back the page; the backdrop is left sharp."
+		}
+	}
+	return caps
+}
+
+// RasterCapabilities describes what Canvas output, such as mockups, can
+// reproduce. It differs from PDF output where Canvas can read back its
+// pixels.
+var RasterCapabilities = rasterCapabilities()
+
+func rasterCapabilities() []Capability {
+	caps := append([]Capability{}, PDFCapabilities...)
+	for i, c := range caps {
+		switch c.Feature {
+		case FeatureBackdropBlur:
+			caps[i].Support, caps[i].Note = SupportFull, "Blurred from what is drawn below."
+		case FeatureImage:
+			caps[i].Support, caps[i].Note = SupportApproximate, "Images are sampled at the nearest pixel; missing images are drawn as an outline."
+		case FeatureFont:
+			caps[i].Support, caps[i].Note = SupportNone, "Text is drawn as glyph boxes in Helvetica's metrics; uploaded fonts are not loaded."
+		}
+	}
+	return caps
+}
+
+// LookupCapability returns the capability entry for a feature, if listed.
+func LookupCapability(caps []Capability, feature string) (Capability, bool) {
+	for _, c := range caps {
+		if c.Feature == feature {
+			return c, true
+		}
+	}
+	return Capability{}, false
+}
@@ -0,0 +1,159 @@
+package render
+
+import (
+	"math"
+	"strings"
+)
+
+// ViewPage is a page reduced for read-only viewers: groups are dissolved
+// into a flat list of elements in paint order and everything that only
+// matters to the editor is dropped.
+type ViewPage struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name,omitempty"`
+	Elements []ViewElement `json:"elements"`
+}
+
+// ViewElement is a single drawable element. Transform maps the element's
+// local box, (0,0) to (Width,Height), onto the page, with every enclosing
+// group's transform already applied. Attrs holds the styling needed to
+// paint it, using the canvas document's property names.
+type ViewElement struct {
+	ID        string         `json:"id,omitempty"`
+	Type      string         `json:"type"`
+	Transform Matrix         `json:"transform"`
+	Width     float64        `json:"width"`
+	Height    float64        `json:"height"`
+	Opacity   float64        `json:"opacity,omitempty"`
+	Attrs     map[string]any `json:"attrs,omitempty"`
+	// Groups lists the IDs of the groups the element was nested in,
+	// outermost first, so links to a group can still be resolved.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// viewAttrs are the properties kept for each element type, besides the
+// common paint properties.
+var viewAttrs = map[string][]string{
+	"rect":     {"rx", "ry"},
+	"text":     {"text", "fontSize", "fontFamily", "fontWeight", "fontStyle", "lineHeight", "textAlign", "underline", "linethrough", "charSpacing"},
+	"image":    {"src", "cropX", "cropY", "filters"},
+	"path":     {"path"},
+	"polygon":  {"points"},
+	"polyline": {"points"},
+	"line":     {"points"},
+	"barcode":  {"format", "value", "errorCorrection", "showText", "backgroundColor"},
+}
+
+var paintAttrs = []string{"fill", "stroke", "strokeWidth", "strokeDashArray", "strokeLineCap", "strokeLineJoin", "shadow", "clipPath", "globalCompositeOperation", "backdropBlur"}
+
+// Flatten converts pages into their viewer form. Hidden elements and their
+// children are left out.
+func Flatten(pages []Page) []ViewPage {
+	out := make([]ViewPage, 0, len(pages))
+	for _, page := range pages {
+		vp := ViewPage{ID: page.ID, Name: page.Name, Elements: []ViewElement{}}
+		for _, obj := range page.Objects {
+			vp.Elements = flattenObject(vp.Elements, obj, Matrix{1, 0, 0, 1, 0, 0}, 1, nil)
+		}
+		out = append(out, vp)
+	}
+	return out
+}
+
+// flattenObject shares drawObject's transforms so viewers place elements
+// exactly where exports do.
+func flattenObject(out []ViewElement, obj map[string]any, parent Matrix, parentOpacity float64, groups []string) []ViewElement {
+	if visible, ok := obj["visible"].(bool); ok && !visible {
+		return out
+	}
+
+	w, h := num(obj, "width", 0), num(obj, "height", 0)
+	opacity := clamp(num(obj, "opacity", 1)) * parentOpacity
+	m := parent.Mul(objectMatrix(obj))
+
+	id, _ := obj["id"].(string)
+	kind, _ := obj["type"].(string)
+	kind = strings.ToLower(kind)
+	if kind == "group" {
+		m = m.Mul(Translate(w/2, h/2))
+		if id != "" {
+			groups = append(groups[:len(groups):len(groups)], id)
+		}
+		for _, child := range childObjects(obj) {
+			out = flattenObject(out, child, m, opacity, groups)
+		}
+		return out
+	}
+
+	el := ViewElement{ID: id, Type: kind, Width: round3(w), Height: round3(h), Attrs: map[string]any{}, Groups: groups}
+	if opacity < 1 {
+		el.Opacity = round3(opacity)
+	}
+
+	switch kind {
+	case "i-text", "textbox":
+		// Line breaks are already explicit for plain text; textboxes keep
+		// their width so viewers wrap them the same way.
+		el.Type = "text"
+		if kind == "textbox" {
+			el.Attrs["wrap"] = true
+		}
+	case "circle":
+		r := num(obj, "radius", w/2)
+		el.Type, el.Width, el.Height = "ellipse", round3(2*r), round3(2*r)
+	case "ellipse":
+		el.Width, el.Height = round3(2*num(obj, "rx", w/2)), round3(2*num(obj, "ry", h/2))
+	case "triangle":
+		el.Type = "polygon"
+		el.Attrs["points"] = viewPoints([]Point{{w / 2, 0}, {w, h}, {0, h}})
+	case "polygon", "polyline":
+		el.Attrs["points"] = viewPoints(localPoints(obj))
+	case "line":
+		x1, y1, x2, y2 := num(obj, "x1", 0), num(obj, "y1", 0), num(obj, "x2", w), num(obj, "y2", h)
+		minX, minY := math.Min(x1, x2), math.Min(y1, y2)
+		el.Attrs["points"] = viewPoints([]Point{{x1 - minX, y1 - minY}, {x2 - minX, y2 - minY}})
+	}
+
+	for _, key := range append(viewAttrs[el.Type], paintAttrs...) {
+		if _, set := el.Attrs[key]; set {
+			continue
+		}
+		if v, ok := obj[key]; ok && v != nil {
+			el.Attrs[key] = v
+		}
+	}
+	if len(el.Attrs) == 0 {
+		el.Attrs = nil
+	}
+	for i, v := range m {
+		el.Transform[i] = round3(v)
+	}
+	return append(out, el)
+}
+
+// Mul returns the transform that applies n and then m.
+func (m Matrix) Mul(n Matrix) Matrix {
+	return Matrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+// viewPoints encodes points the way canvas documents do.
+func viewPoints(points []Point) []map[string]float64 {
+	out := make([]map[string]float64, len(points))
+	for i, p := range points {
+		out[i] = map[string]float64{"x": round3(p.X), "y": round3(p.Y)}
+	}
+	return out
+}
+
+// round3 keeps three decimals, well below a pixel at any zoom a viewer
+// offers, which keeps the payload small.
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
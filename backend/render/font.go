@@ -0,0 +1,492 @@
+package render
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Uploaded fonts are embedded in PDF and SVG output so text is drawn the
+// way it was designed. Only TrueType outlines are read. A font is embedded
+// with just the glyphs the document draws unless its OS/2 fsType forbids
+// subsetting, in which case the whole file is embedded. Fonts whose license
+// does not allow embedding are not used at all; their text falls back to
+// Helvetica.
+
+// OS/2 fsType bits
+const (
+	fsTypeRestricted   = 0x0002 // may not be embedded
+	fsTypeUsageMask    = 0x000e // the embedding permission bits; the least restrictive one set applies
+	fsTypeNoSubsetting = 0x0100
+	fsTypeBitmapOnly   = 0x0200 // only bitmaps may be embedded, and outlines are all we embed
+)
+
+// maxCmapChars bounds the characters read from a font's character map
+const maxCmapChars = 0x110000
+
+// subsetTables are the tables a subset keeps: what PDF viewers need to draw
+// the glyphs and browsers need to accept the file.
+var subsetTables = []string{"OS/2", "cmap", "cvt ", "fpgm", "glyf", "head", "hhea", "hmtx", "loca", "maxp", "name", "post", "prep"}
+
+// pdfNameUnsafe matches what may not appear in a font's PDF name
+var pdfNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Font is a parsed TrueType font
+type Font struct {
+	data   []byte
+	tables map[string][]byte
+	// name is the PostScript name, reduced to what a PDF name may hold
+	name        string
+	unitsPerEm  float64
+	ascent      float64
+	descent     float64
+	capHeight   float64
+	bbox        [4]float64
+	italicAngle float64
+	fixedPitch  bool
+	fsType      uint16
+	numGlyphs   int
+	longLoca    bool
+	advances    []uint16
+	glyphs      map[rune]uint16
+}
+
+// ParseFont reads a TrueType font file.
+func ParseFont(data []byte) (*Font, error) {
+	if len(data) < 12 {
+		return nil, errors.New("font file is truncated")
+	}
+	switch binary.BigEndian.Uint32(data) {
+	case 0x00010000, 0x74727565: // 'true'
+	case 0x4f54544f: // 'OTTO'
+		return nil, errors.New("fonts with PostScript outlines are not supported")
+	default:
+		return nil, errors.New("not a TrueType font")
+	}
+	n := int(u16(data, 4))
+	if len(data) < 12+16*n {
+		return nil, errors.New("font file is truncated")
+	}
+	font := &Font{data: data, tables: map[string][]byte{}}
+	for i := 0; i < n; i++ {
+		rec := 12 + 16*i
+		tag := string(data[rec : rec+4])
+		off, length := uint64(u32(data, rec+8)), uint64(u32(data, rec+12))
+		if off+length > uint64(len(data)) {
+			return nil, fmt.Errorf("font table %q is out of bounds", tag)
+		}
+		font.tables[tag] = data[off : off+length]
+	}
+	for _, tag := range []string{"head", "hhea", "maxp", "hmtx", "loca", "glyf", "cmap"} {
+		if font.tables[tag] == nil {
+			return nil, fmt.Errorf("font has no %s table", tag)
+		}
+	}
+
+	head, hhea, maxp, hmtx := font.tables["head"], font.tables["hhea"], font.tables["maxp"], font.tables["hmtx"]
+	if len(head) < 54 || len(hhea) < 36 || len(maxp) < 6 {
+		return nil, errors.New("font tables are truncated")
+	}
+	font.unitsPerEm = float64(u16(head, 18))
+	if font.unitsPerEm == 0 {
+		return nil, errors.New("font has no units per em")
+	}
+	for i := range font.bbox {
+		font.bbox[i] = float64(int16(u16(head, 36+2*i)))
+	}
+	font.longLoca = u16(head, 50) == 1
+	font.ascent = float64(int16(u16(hhea, 4)))
+	font.descent = float64(int16(u16(hhea, 6)))
+	font.capHeight = font.ascent
+	font.numGlyphs = int(u16(maxp, 4))
+	locaEntry := 2
+	if font.longLoca {
+		locaEntry = 4
+	}
+	if font.numGlyphs == 0 || len(font.tables["loca"]) < (font.numGlyphs+1)*locaEntry {
+		return nil, errors.New("font has no glyph locations")
+	}
+	metrics := int(u16(hhea, 34))
+	if metrics == 0 || len(hmtx) < 4*metrics {
+		return nil, errors.New("font has no horizontal metrics")
+	}
+	font.advances = make([]uint16, metrics)
+	for i := range font.advances {
+		font.advances[i] = u16(hmtx, 4*i)
+	}
+	if os2 := font.tables["OS/2"]; len(os2) >= 10 {
+		font.fsType = u16(os2, 8)
+		if u16(os2, 0) >= 2 {
+			if capHeight := int16(u16(os2, 88)); capHeight > 0 {
+				font.capHeight = float64(capHeight)
+			}
+		}
+	}
+	if post := font.tables["post"]; len(post) >= 16 {
+		font.italicAngle = float64(int32(u32(post, 4))) / 65536
+		font.fixedPitch = u32(post, 12) != 0
+	}
+
+	glyphs, err := parseCmap(font.tables["cmap"])
+	if err != nil {
+		return nil, err
+	}
+	font.glyphs = glyphs
+	if font.name = postScriptName(font.tables["name"]); font.name == "" {
+		font.name = "Font"
+	}
+	return font, nil
+}
+
+// Embeddable reports whether the font's license allows embedding its
+// outlines in a document.
+func (font *Font) Embeddable() bool {
+	return font.fsType&fsTypeUsageMask != fsTypeRestricted && font.fsType&fsTypeBitmapOnly == 0
+}
+
+// Subsettable reports whether the font's license allows embedding only the
+// glyphs a document uses.
+func (font *Font) Subsettable() bool {
+	return font.fsType&fsTypeNoSubsetting == 0
+}
+
+// Width returns the advance width of s drawn at size.
+func (font *Font) Width(s string, size float64) float64 {
+	var units int
+	for _, r := range s {
+		if r = textRune(r); r >= 0 {
+			units += int(font.advance(font.glyphIndex(r)))
+		}
+	}
+	return float64(units) * size / font.unitsPerEm
+}
+
+// textRune returns the character drawn for r: tabs are drawn as spaces and
+// other control characters not at all (-1).
+func textRune(r rune) rune {
+	switch {
+	case r == '\t':
+		return ' '
+	case r < 32:
+		return -1
+	}
+	return r
+}
+
+// glyphIndex returns the glyph drawn for r, or .notdef (0) when the font
+// has none.
+func (font *Font) glyphIndex(r rune) uint16 {
+	g := font.glyphs[r]
+	if int(g) >= font.numGlyphs {
+		return 0
+	}
+	return g
+}
+
+// advance returns a glyph's advance width in font units. Glyphs past the
+// last metric share its advance.
+func (font *Font) advance(g uint16) uint16 {
+	if int(g) < len(font.advances) {
+		return font.advances[g]
+	}
+	return font.advances[len(font.advances)-1]
+}
+
+// glyph returns a glyph's outline data, nil for an empty glyph.
+func (font *Font) glyph(g uint16) []byte {
+	loca, glyf := font.tables["loca"], font.tables["glyf"]
+	var start, end int
+	if font.longLoca {
+		start, end = int(u32(loca, 4*int(g))), int(u32(loca, 4*int(g)+4))
+	} else {
+		start, end = 2*int(u16(loca, 2*int(g))), 2*int(u16(loca, 2*int(g)+2))
+	}
+	if start >= end || end > len(glyf) {
+		return nil
+	}
+	return glyf[start:end]
+}
+
+// components returns the glyphs a composite glyph is built from.
+func (font *Font) components(g uint16) []uint16 {
+	data := font.glyph(g)
+	if len(data) < 10 || int16(u16(data, 0)) >= 0 {
+		return nil
+	}
+	var out []uint16
+	for off := 10; off+4 <= len(data); {
+		flags := u16(data, off)
+		out = append(out, u16(data, off+2))
+		off += 4
+		if flags&0x0001 != 0 { // ARG_1_AND_2_ARE_WORDS
+			off += 4
+		} else {
+			off += 2
+		}
+		switch {
+		case flags&0x0008 != 0: // WE_HAVE_A_SCALE
+			off += 2
+		case flags&0x0040 != 0: // WE_HAVE_AN_X_AND_Y_SCALE
+			off += 4
+		case flags&0x0080 != 0: // WE_HAVE_A_TWO_BY_TWO
+			off += 8
+		}
+		if flags&0x0020 == 0 { // MORE_COMPONENTS
+			break
+		}
+	}
+	return out
+}
+
+// Subset returns a font program holding the given glyphs, .notdef and the
+// components of composite glyphs, and reports whether it is a subset. Glyph
+// IDs are kept, so the character map and metrics stay valid; the outlines
+// of every other glyph are dropped, along with tables such as kerning that
+// only matter for text the document does not draw. A font whose license
+// forbids subsetting is returned whole.
+func (font *Font) Subset(glyphs []uint16) ([]byte, bool) {
+	if !font.Subsettable() {
+		return font.data, false
+	}
+	keep := map[uint16]bool{}
+	queue := append([]uint16{0}, glyphs...)
+	for len(queue) > 0 {
+		g := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if keep[g] || int(g) >= font.numGlyphs {
+			continue
+		}
+		keep[g] = true
+		queue = append(queue, font.components(g)...)
+	}
+
+	var glyf []byte
+	offsets := make([]int, font.numGlyphs+1)
+	for g := 0; g < font.numGlyphs; g++ {
+		offsets[g] = len(glyf)
+		if keep[uint16(g)] {
+			glyf = append(glyf, font.glyph(uint16(g))...)
+			for len(glyf)%4 != 0 {
+				glyf = append(glyf, 0)
+			}
+		}
+	}
+	offsets[font.numGlyphs] = len(glyf)
+	// Short offsets count 16-bit words and so reach 128 KiB.
+	long := len(glyf) >= 0x20000
+	var loca []byte
+	for _, off := range offsets {
+		if long {
+			loca = binary.BigEndian.AppendUint32(loca, uint32(off))
+		} else {
+			loca = binary.BigEndian.AppendUint16(loca, uint16(off/2))
+		}
+	}
+	head := append([]byte{}, font.tables["head"]...)
+	binary.BigEndian.PutUint16(head[50:], 0)
+	if long {
+		binary.BigEndian.PutUint16(head[50:], 1)
+	}
+
+	tables := map[string][]byte{"glyf": glyf, "loca": loca, "head": head}
+	for _, tag := range subsetTables {
+		if _, ok := tables[tag]; !ok && font.tables[tag] != nil {
+			tables[tag] = font.tables[tag]
+		}
+	}
+	if post := font.tables["post"]; len(post) >= 32 {
+		// Version 3 carries no glyph names.
+		p := append([]byte{}, post[:32]...)
+		binary.BigEndian.PutUint32(p, 0x00030000)
+		tables["post"] = p
+	}
+	return writeSFNT(tables), true
+}
+
+// subsetTag names a subset after the glyphs it holds, as PDF asks: six
+// uppercase letters, the same for the same glyphs.
+func subsetTag(glyphs []uint16) string {
+	h := fnv.New32a()
+	for _, g := range glyphs {
+		h.Write([]byte{byte(g >> 8), byte(g)})
+	}
+	v := h.Sum32()
+	tag := make([]byte, 6)
+	for i := range tag {
+		tag[i] = 'A' + byte(v%26)
+		v /= 26
+	}
+	return string(tag)
+}
+
+// writeSFNT assembles a TrueType file from its tables.
+func writeSFNT(tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	n := len(tags)
+	pow, log := 1, 0
+	for pow*2 <= n {
+		pow *= 2
+		log++
+	}
+	out := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(out, 0x00010000)
+	binary.BigEndian.PutUint16(out[4:], uint16(n))
+	binary.BigEndian.PutUint16(out[6:], uint16(pow*16))
+	binary.BigEndian.PutUint16(out[8:], uint16(log))
+	binary.BigEndian.PutUint16(out[10:], uint16((n-pow)*16))
+
+	headOff := -1
+	for i, tag := range tags {
+		t := tables[tag]
+		if tag == "head" {
+			// The adjustment is computed over the whole file with it zeroed.
+			binary.BigEndian.PutUint32(t[8:], 0)
+			headOff = len(out)
+		}
+		rec := 12 + 16*i
+		copy(out[rec:], tag)
+		binary.BigEndian.PutUint32(out[rec+4:], sfntChecksum(t))
+		binary.BigEndian.PutUint32(out[rec+8:], uint32(len(out)))
+		binary.BigEndian.PutUint32(out[rec+12:], uint32(len(t)))
+		out = append(out, t...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+	if headOff >= 0 {
+		binary.BigEndian.PutUint32(out[headOff+8:], 0xb1b0afba-sfntChecksum(out))
+	}
+	return out
+}
+
+func sfntChecksum(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(b); i += 4 {
+		var word [4]byte
+		copy(word[:], b[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
+
+// parseCmap reads the font's Unicode character map, preferring the
+// subtable that covers characters beyond the Basic Multilingual Plane.
+func parseCmap(cmap []byte) (map[rune]uint16, error) {
+	best, bestRank := -1, 0
+	for i, n := 0, int(u16(cmap, 2)); i < n; i++ {
+		rec := 4 + 8*i
+		platform, encoding := u16(cmap, rec), u16(cmap, rec+2)
+		off := int(u32(cmap, rec+4))
+		format := u16(cmap, off)
+		rank := 0
+		switch {
+		case format == 12 && (platform == 0 || platform == 3 && encoding == 10):
+			rank = 2
+		case format == 4 && (platform == 0 || platform == 3 && encoding == 1):
+			rank = 1
+		}
+		if rank > bestRank {
+			best, bestRank = off, rank
+		}
+	}
+	if best < 0 {
+		return nil, errors.New("font has no Unicode character map")
+	}
+
+	glyphs := map[rune]uint16{}
+	budget := maxCmapChars
+	if u16(cmap, best) == 4 {
+		segs := int(u16(cmap, best+6)) / 2
+		ends := best + 14
+		starts := ends + 2*segs + 2
+		deltas := starts + 2*segs
+		ranges := deltas + 2*segs
+		for s := 0; s < segs; s++ {
+			start, end := int(u16(cmap, starts+2*s)), int(u16(cmap, ends+2*s))
+			delta, rangeOff := u16(cmap, deltas+2*s), int(u16(cmap, ranges+2*s))
+			for c := start; c <= end && c < 0xffff && budget > 0; c++ {
+				budget--
+				var g uint16
+				if rangeOff == 0 {
+					g = uint16(c) + delta
+				} else if g = u16(cmap, ranges+2*s+rangeOff+2*(c-start)); g != 0 {
+					g += delta
+				}
+				if g != 0 {
+					glyphs[rune(c)] = g
+				}
+			}
+		}
+		return glyphs, nil
+	}
+	for i, n := 0, int(u32(cmap, best+12)); i < n && best+16+12*i+12 <= len(cmap); i++ {
+		grp := best + 16 + 12*i
+		start, end, g := u32(cmap, grp), u32(cmap, grp+4), u32(cmap, grp+8)
+		if end < start || end > unicode.MaxRune || g > 0xffff {
+			continue
+		}
+		for c := start; c <= end && g+(c-start) <= 0xffff && budget > 0; c++ {
+			budget--
+			if id := uint16(g + (c - start)); id != 0 {
+				glyphs[rune(c)] = id
+			}
+		}
+	}
+	return glyphs, nil
+}
+
+// postScriptName returns the font's PostScript name from its name table.
+func postScriptName(name []byte) string {
+	count, storage := int(u16(name, 2)), int(u16(name, 4))
+	for i := 0; i < count; i++ {
+		rec := 6 + 12*i
+		platform, id := u16(name, rec), u16(name, rec+6)
+		length, off := int(u16(name, rec+8)), int(u16(name, rec+10))
+		start := storage + off
+		if id != 6 || start+length > len(name) {
+			continue
+		}
+		raw := name[start : start+length]
+		s := string(raw)
+		if platform == 0 || platform == 3 {
+			units := make([]uint16, len(raw)/2)
+			for j := range units {
+				units[j] = u16(raw, 2*j)
+			}
+			s = string(utf16.Decode(units))
+		}
+		if s = pdfNameUnsafe.ReplaceAllString(s, ""); s != "" {
+			if len(s) > 63 {
+				s = s[:63]
+			}
+			return s
+		}
+	}
+	return ""
+}
+
+// u16 and u32 read big-endian values, returning 0 past the end of b so
+// malformed fonts cannot read out of bounds.
+func u16(b []byte, off int) uint16 {
+	if off < 0 || off+2 > len(b) {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b[off:])
+}
+
+func u32(b []byte, off int) uint32 {
+	if off < 0 || off+4 > len(b) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b[off:])
+}
@@ -0,0 +1,438 @@
+package render
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+)
+
+// Profile is an RGB matrix/TRC ICC profile: a tone curve per channel and the
+// colorants that map linear values to the D50 profile connection space. It
+// covers the display profiles cameras and design tools embed (sRGB, Display
+// P3, Adobe RGB, ProPhoto); LUT-based and CMYK profiles are not supported.
+type Profile struct {
+	Description string
+	toXYZ       [3][3]float64 // columns are the red, green and blue colorants
+	trc         [3]curve
+}
+
+// ErrUnsupportedProfile is returned for ICC profiles that are not RGB
+// matrix/TRC profiles.
+var ErrUnsupportedProfile = errors.New("unsupported ICC profile")
+
+// curve is an ICC tone curve mapping encoded values to linear light.
+type curve struct {
+	gamma  float64   // plain power curve when table and params are empty
+	table  []float64 // sampled curve, evenly spaced over [0, 1]
+	params []float64 // parametric curve: g, a, b, c, d, e, f
+}
+
+// srgbCurve is the sRGB transfer function, shared by Display P3.
+var srgbCurve = curve{params: []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045, 0, 0}}
+
+func (c curve) eval(x float64) float64 {
+	x = math.Max(0, math.Min(1, x))
+	switch {
+	case len(c.table) > 0:
+		if len(c.table) == 1 {
+			return c.table[0]
+		}
+		pos := x * float64(len(c.table)-1)
+		i := int(pos)
+		if i >= len(c.table)-1 {
+			return c.table[len(c.table)-1]
+		}
+		return c.table[i] + (c.table[i+1]-c.table[i])*(pos-float64(i))
+	case len(c.params) > 0:
+		p := c.params
+		g, a, b, cc, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		if x >= d {
+			return math.Pow(math.Max(a*x+b, 0), g) + e
+		}
+		return cc*x + f
+	case c.gamma > 0:
+		return math.Pow(x, c.gamma)
+	}
+	return x
+}
+
+// invert finds the encoded value for linear y. Tone curves are monotonic, so
+// a bisection is exact enough for 16-bit output.
+func (c curve) invert(y float64) float64 {
+	lo, hi := 0.0, 1.0
+	for i := 0; i < 24; i++ {
+		mid := (lo + hi) / 2
+		if c.eval(mid) < y {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// ParseICC reads an RGB matrix/TRC profile.
+func ParseICC(data []byte) (*Profile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, ErrUnsupportedProfile
+	}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	if count > (len(data)-132)/12 {
+		return nil, errors.New("truncated ICC profile")
+	}
+	tags := make(map[string][]byte, count)
+	for i := 0; i < count; i++ {
+		entry := data[132+12*i:]
+		off, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if off < 0 || size < 8 || off+size > len(data) || off+size < off {
+			return nil, errors.New("truncated ICC profile")
+		}
+		tags[string(entry[:4])] = data[off : off+size]
+	}
+
+	p := &Profile{Description: iccText(tags["desc"])}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz := tags[sig]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, ErrUnsupportedProfile
+		}
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row][i] = s15Fixed16(xyz[8+4*row:])
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		c, err := parseCurve(tags[sig])
+		if err != nil {
+			return nil, err
+		}
+		p.trc[i] = c
+	}
+	return p, nil
+}
+
+var paramCounts = map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+
+func parseCurve(tag []byte) (curve, error) {
+	if len(tag) < 12 {
+		return curve{}, ErrUnsupportedProfile
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return curve{gamma: 1}, nil
+		case n == 1 && len(tag) >= 14:
+			return curve{gamma: float64(binary.BigEndian.Uint16(tag[12:])) / 256}, nil
+		case n > 1 && len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return curve{table: table}, nil
+		}
+	case "para":
+		fn := binary.BigEndian.Uint16(tag[8:])
+		n, ok := paramCounts[fn]
+		if !ok || len(tag) < 12+4*n {
+			break
+		}
+		var v [7]float64
+		for i := 0; i < n; i++ {
+			v[i] = s15Fixed16(tag[12+4*i:])
+		}
+		// Normalize every function type to g, a, b, c, d, e, f.
+		g, a, b, c, d, e, f := v[0], 1.0, 0.0, 0.0, 0.0, 0.0, 0.0
+		switch fn {
+		case 1, 2:
+			a, b = v[1], v[2]
+			if fn == 2 {
+				e, f = v[3], v[3]
+			}
+			if a != 0 {
+				d = -b / a
+			}
+		case 3:
+			a, b, c, d = v[1], v[2], v[3], v[4]
+		case 4:
+			a, b, c, d, e, f = v[1], v[2], v[3], v[4], v[5], v[6]
+		}
+		return curve{params: []float64{g, a, b, c, d, e, f}}, nil
+	}
+	return curve{}, ErrUnsupportedProfile
+}
+
+// iccText returns the English text of a desc tag in either the v2
+// (textDescriptionType) or v4 (multiLocalizedUnicodeType) encoding.
+func iccText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > len(tag)-12 {
+			return ""
+		}
+		return string(bytes.TrimRight(tag[12:12+n], "\x00"))
+	case "mluc":
+		records := int(binary.BigEndian.Uint32(tag[8:]))
+		if records < 1 || len(tag) < 28 {
+			return ""
+		}
+		n, off := int(binary.BigEndian.Uint32(tag[20:])), int(binary.BigEndian.Uint32(tag[24:]))
+		if off+n > len(tag) || off+n < off {
+			return ""
+		}
+		runes := make([]rune, 0, n/2)
+		for i := off; i+1 < off+n; i += 2 {
+			runes = append(runes, rune(binary.BigEndian.Uint16(tag[i:])))
+		}
+		return string(runes)
+	}
+	return ""
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// d50 is the profile connection space white point.
+var d50 = [3]float64{0.9642, 1, 0.8249}
+
+// Bytes encodes the profile as a version 2 display profile, which every PDF
+// reader and image decoder understands. Curves are written as 1024-entry
+// tables unless they are a plain gamma.
+func (p *Profile) Bytes() []byte {
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	desc := &bytes.Buffer{}
+	desc.WriteString("desc\x00\x00\x00\x00")
+	binary.Write(desc, binary.BigEndian, uint32(len(p.Description)+1))
+	desc.WriteString(p.Description + "\x00")
+	desc.Write(make([]byte, 4+4+2+1+67)) // empty Unicode and ScriptCode descriptions
+
+	xyz := func(v [3]float64) []byte {
+		b := []byte("XYZ \x00\x00\x00\x00")
+		for _, c := range v {
+			b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(c*65536))))
+		}
+		return b
+	}
+	trc := func(c curve) []byte {
+		b := []byte("curv\x00\x00\x00\x00")
+		if len(c.table) == 0 && len(c.params) == 0 {
+			b = binary.BigEndian.AppendUint32(b, 1)
+			return binary.BigEndian.AppendUint16(b, uint16(math.Round(c.gamma*256)))
+		}
+		const n = 1024
+		b = binary.BigEndian.AppendUint32(b, n)
+		for i := 0; i < n; i++ {
+			b = binary.BigEndian.AppendUint16(b, uint16(math.Round(c.eval(float64(i)/(n-1))*65535)))
+		}
+		return b
+	}
+	column := func(i int) [3]float64 { return [3]float64{p.toXYZ[0][i], p.toXYZ[1][i], p.toXYZ[2][i]} }
+
+	tags := []tag{
+		{"desc", desc.Bytes()},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright, use freely\x00")},
+		{"wtpt", xyz(d50)},
+		{"rXYZ", xyz(column(0))},
+		{"gXYZ", xyz(column(1))},
+		{"bXYZ", xyz(column(2))},
+		{"rTRC", trc(p.trc[0])},
+		{"gTRC", trc(p.trc[1])},
+		{"bTRC", trc(p.trc[2])},
+	}
+
+	var body bytes.Buffer
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	start := 128 + 4 + 12*len(tags)
+	for _, t := range tags {
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(start+body.Len()))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+		body.Write(t.data)
+		for body.Len()%4 != 0 {
+			body.WriteByte(0)
+		}
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(128+len(table)+body.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntrRGB XYZ ")
+	// Creation date 2024-01-01 00:00:00, fixed so output is deterministic.
+	for i, v := range []uint16{2024, 1, 1, 0, 0, 0} {
+		binary.BigEndian.PutUint16(header[24+2*i:], v)
+	}
+	copy(header[36:], "acsp")
+	copy(header[68:], xyz(d50)[8:])
+
+	out := append(header, table...)
+	return append(out, body.Bytes()...)
+}
+
+// EmbeddedProfile returns the ICC profile embedded in a PNG (iCCP chunk) or
+// JPEG (APP2 ICC_PROFILE segments) file, if there is one.
+func EmbeddedProfile(data []byte) ([]byte, bool) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		for off := len(pngSignature); off+12 <= len(data); {
+			n := int(binary.BigEndian.Uint32(data[off:]))
+			if n < 0 || off+12+n > len(data) {
+				return nil, false
+			}
+			typ, chunk := string(data[off+4:off+8]), data[off+8:off+8+n]
+			switch typ {
+			case "iCCP":
+				name := bytes.IndexByte(chunk, 0)
+				if name < 0 || name+2 > len(chunk) || chunk[name+1] != 0 {
+					return nil, false
+				}
+				zr, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+				if err != nil {
+					return nil, false
+				}
+				icc, err := io.ReadAll(io.LimitReader(zr, maxProfileSize))
+				return icc, err == nil
+			case "IDAT", "IEND":
+				return nil, false
+			}
+			off += 12 + n
+		}
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		var parts [][]byte
+		for _, seg := range jpegSegments(data) {
+			if seg.marker == 0xe2 && bytes.HasPrefix(seg.data, iccMarker) && len(seg.data) > len(iccMarker)+2 {
+				parts = append(parts, seg.data[len(iccMarker):])
+			}
+		}
+		if len(parts) == 0 {
+			return nil, false
+		}
+		sort.SliceStable(parts, func(i, j int) bool { return parts[i][0] < parts[j][0] })
+		var icc []byte
+		for _, part := range parts {
+			icc = append(icc, part[2:]...)
+		}
+		return icc, true
+	}
+	return nil, false
+}
+
+// EmbedProfile returns a copy of a PNG or JPEG file tagged with icc,
+// replacing any profile it already carries.
+func EmbedProfile(data, icc []byte, name string) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(icc)
+		zw.Close()
+		chunk := append([]byte(name), 0, 0)
+		chunk = append(chunk, z.Bytes()...)
+
+		out := append([]byte{}, pngSignature...)
+		for off := len(pngSignature); off+12 <= len(data); {
+			n := int(binary.BigEndian.Uint32(data[off:]))
+			if n < 0 || off+12+n > len(data) {
+				return nil, errors.New("truncated PNG")
+			}
+			typ := string(data[off+4 : off+8])
+			if typ != "iCCP" && typ != "sRGB" {
+				out = append(out, data[off:off+12+n]...)
+			}
+			if typ == "IHDR" {
+				out = appendPNGChunk(out, "iCCP", chunk)
+			}
+			off += 12 + n
+		}
+		return out, nil
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		const perSegment = 65519
+		total := (len(icc) + perSegment - 1) / perSegment
+		if total > 255 {
+			return nil, fmt.Errorf("ICC profile too large")
+		}
+		segs := jpegSegments(data)
+		// The profile goes after the JFIF/Exif headers, which must come first.
+		insert := 2
+		for _, seg := range segs {
+			if seg.marker != 0xe0 && seg.marker != 0xe1 {
+				break
+			}
+			insert = seg.end
+		}
+		out := append([]byte{}, data[:insert]...)
+		for i := 0; i < total; i++ {
+			part := icc[i*perSegment : min((i+1)*perSegment, len(icc))]
+			out = append(out, 0xff, 0xe2)
+			out = binary.BigEndian.AppendUint16(out, uint16(2+len(iccMarker)+2+len(part)))
+			out = append(out, iccMarker...)
+			out = append(out, byte(i+1), byte(total))
+			out = append(out, part...)
+		}
+		rest := insert
+		for _, seg := range segs {
+			if seg.start >= insert && seg.marker == 0xe2 && bytes.HasPrefix(seg.data, iccMarker) {
+				out = append(out, data[rest:seg.start]...)
+				rest = seg.end
+			}
+		}
+		return append(out, data[rest:]...), nil
+	}
+	return nil, errors.New("only PNG and JPEG files can carry a profile")
+}
+
+// maxProfileSize bounds decompressed PNG profiles.
+const maxProfileSize = 4 << 20
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	iccMarker    = []byte("ICC_PROFILE\x00")
+)
+
+func appendPNGChunk(out []byte, typ string, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	start := len(out)
+	out = append(out, typ...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+type jpegSegment struct {
+	marker     byte
+	start, end int // span of the whole segment in the file
+	data       []byte
+}
+
+// jpegSegments lists the marker segments before the image data.
+func jpegSegments(data []byte) []jpegSegment {
+	var segs []jpegSegment
+	for off := 2; off+4 <= len(data) && data[off] == 0xff; {
+		marker := data[off+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[off+2:]))
+		if n < 2 || off+2+n > len(data) {
+			break
+		}
+		segs = append(segs, jpegSegment{marker: marker, start: off, end: off + 2 + n, data: data[off+4 : off+2+n]})
+		off += 2 + n
+	}
+	return segs
+}
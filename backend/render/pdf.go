@@ -0,0 +1,614 @@
+package render
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// PDF builds a PDF document page by page. Output is deterministic for the
+// same drawing calls, so renders can be compared byte for byte.
+type PDF struct {
+	objects  [][]byte // object n is objects[n-1]; nil while reserved
+	pages    []*PDFPage
+	images   []int
+	gstates  map[string]int
+	shadings []int
+	iccID    int // 0 while the document is untagged
+	fonts    []*pdfFont
+}
+
+// pdfFont is an uploaded font drawn on the document's pages. It is written
+// out once the pages are done, holding only the glyphs they used.
+type pdfFont struct {
+	font *Font
+	name string // resource name
+	id   int    // object number of the Type 0 font
+	// used maps each glyph drawn to the character it was drawn for
+	used map[uint16]rune
+}
+
+// Fixed object numbers
+const (
+	pdfCatalog = iota + 1
+	pdfPages
+	pdfResources
+	pdfFontRegular
+	pdfFontBold
+)
+
+// NewPDF returns an empty document.
+func NewPDF() *PDF {
+	p := &PDF{gstates: map[string]int{}}
+	for i := 0; i < pdfFontBold; i++ {
+		p.reserve()
+	}
+	p.set(pdfCatalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pdfPages))
+	p.set(pdfFontRegular, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	p.set(pdfFontBold, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	return p
+}
+
+func (p *PDF) reserve() int {
+	p.objects = append(p.objects, nil)
+	return len(p.objects)
+}
+
+func (p *PDF) set(id int, body string) {
+	p.objects[id-1] = []byte(body)
+}
+
+func (p *PDF) add(body []byte) int {
+	p.objects = append(p.objects, body)
+	return len(p.objects)
+}
+
+func (p *PDF) stream(dict string, data []byte) []byte {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(data)
+	zw.Close()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<< %s /Filter /FlateDecode /Length %d >>\nstream\n", dict, z.Len())
+	b.Write(z.Bytes())
+	b.WriteString("\nendstream")
+	return b.Bytes()
+}
+
+// AddPage starts a new page of the given size in canvas pixels, drawn at
+// one PDF point per pixel.
+func (p *PDF) AddPage(w, h float64) *PDFPage {
+	page := &PDFPage{pdf: p, w: w, h: h, id: p.reserve()}
+	// Flip to a top-left origin so surfaces share canvas coordinates.
+	fmt.Fprintf(&page.buf, "1 0 0 -1 0 %s cm\n", f(h))
+	p.pages = append(p.pages, page)
+	return page
+}
+
+// SetColorSpace tags the document with the working space's ICC profile.
+// Every DeviceRGB color and image is then read in that space, so colors
+// drawn unchanged from the document come out as authored.
+func (p *PDF) SetColorSpace(s ColorSpace) {
+	p.iccID = p.add(p.stream("/N 3 /Alternate /DeviceRGB", s.ICC()))
+}
+
+// PageCount returns the number of pages added so far.
+func (p *PDF) PageCount() int { return len(p.pages) }
+
+// Bytes serializes the document. Call it once, after the last page.
+func (p *PDF) Bytes() []byte {
+	kids := make([]string, len(p.pages))
+	for i, page := range p.pages {
+		content := p.add(p.stream("", page.buf.Bytes()))
+		p.set(page.id, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources %d 0 R /Contents %d 0 R >>",
+			pdfPages, f(page.w), f(page.h), pdfResources, content))
+		kids[i] = fmt.Sprintf("%d 0 R", page.id)
+	}
+	p.set(pdfPages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+
+	var res strings.Builder
+	fmt.Fprintf(&res, "<< /Font << /F1 %d 0 R /F2 %d 0 R", pdfFontRegular, pdfFontBold)
+	for _, pf := range p.fonts {
+		p.embedFont(pf)
+		fmt.Fprintf(&res, " /%s %d 0 R", pf.name, pf.id)
+	}
+	res.WriteString(" >>")
+	if len(p.images) > 0 {
+		res.WriteString(" /XObject <<")
+		for i, id := range p.images {
+			fmt.Fprintf(&res, " /Im%d %d 0 R", i+1, id)
+		}
+		res.WriteString(" >>")
+	}
+	if len(p.shadings) > 0 {
+		res.WriteString(" /Shading <<")
+		for i, id := range p.shadings {
+			fmt.Fprintf(&res, " /Sh%d %d 0 R", i+1, id)
+		}
+		res.WriteString(" >>")
+	}
+	if len(p.gstates) > 0 {
+		names := make([]string, 0, len(p.gstates))
+		for name := range p.gstates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		res.WriteString(" /ExtGState <<")
+		for _, name := range names {
+			fmt.Fprintf(&res, " /%s %d 0 R", name, p.gstates[name])
+		}
+		res.WriteString(" >>")
+	}
+	if p.iccID != 0 {
+		fmt.Fprintf(&res, " /ColorSpace << /DefaultRGB [/ICCBased %d 0 R] >>", p.iccID)
+	}
+	res.WriteString(" >>")
+	p.set(pdfResources, res.String())
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(p.objects))
+	for i, body := range p.objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(body)
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(p.objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.objects)+1, pdfCatalog, xref)
+	return out.Bytes()
+}
+
+// font returns the document's entry for an uploaded font, adding it on
+// first use.
+func (p *PDF) font(font *Font) *pdfFont {
+	for _, pf := range p.fonts {
+		if pf.font == font {
+			return pf
+		}
+	}
+	pf := &pdfFont{font: font, name: fmt.Sprintf("F%d", len(p.fonts)+3), id: p.reserve(), used: map[uint16]rune{}}
+	p.fonts = append(p.fonts, pf)
+	return pf
+}
+
+// embedFont writes an uploaded font as a Type 0 font with Identity-H
+// encoding, so text is written as glyph IDs, and a ToUnicode map so the
+// text can still be searched and copied. The font program holds only the
+// glyphs drawn unless the font's license forbids subsetting.
+func (p *PDF) embedFont(pf *pdfFont) {
+	font := pf.font
+	glyphs := make([]uint16, 0, len(pf.used))
+	for g := range pf.used {
+		glyphs = append(glyphs, g)
+	}
+	sort.Slice(glyphs, func(i, j int) bool { return glyphs[i] < glyphs[j] })
+
+	program, subset := font.Subset(glyphs)
+	name := font.name
+	if subset {
+		name = subsetTag(glyphs) + "+" + name
+	}
+	file := p.add(p.stream(fmt.Sprintf("/Length1 %d", len(program)), program))
+
+	// Metrics are in glyph space, a thousandth of the font size.
+	scale := 1000 / font.unitsPerEm
+	flags := 32 // nonsymbolic
+	if font.fixedPitch {
+		flags |= 1
+	}
+	if font.italicAngle != 0 {
+		flags |= 64
+	}
+	descriptor := p.add([]byte(fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags %d /FontBBox [%s %s %s %s] /ItalicAngle %s /Ascent %s /Descent %s /CapHeight %s /StemV 80 /FontFile2 %d 0 R >>",
+		name, flags, f(font.bbox[0]*scale), f(font.bbox[1]*scale), f(font.bbox[2]*scale), f(font.bbox[3]*scale),
+		f(font.italicAngle), f(font.ascent*scale), f(font.descent*scale), f(font.capHeight*scale), file)))
+
+	widths := make([]string, len(glyphs))
+	for i, g := range glyphs {
+		widths[i] = fmt.Sprintf("%d [%s]", g, f(float64(font.advance(g))*scale))
+	}
+	cid := p.add([]byte(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /DW %s /W [%s] /CIDToGIDMap /Identity >>",
+		name, descriptor, f(float64(font.advance(0))*scale), strings.Join(widths, " "))))
+	toUnicode := p.add(p.stream("", toUnicodeCMap(glyphs, pf.used)))
+	p.set(pf.id, fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>",
+		name, cid, toUnicode))
+}
+
+// toUnicodeCMap maps glyph IDs back to the characters they were drawn for.
+func toUnicodeCMap(glyphs []uint16, runes map[uint16]rune) []byte {
+	var entries []string
+	for _, g := range glyphs {
+		if g == 0 {
+			continue
+		}
+		var hex strings.Builder
+		for _, u := range utf16.Encode([]rune{runes[g]}) {
+			fmt.Fprintf(&hex, "%04X", u)
+		}
+		entries = append(entries, fmt.Sprintf("<%04X> <%s>", g, hex.String()))
+	}
+
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	// A bfchar block holds at most 100 entries.
+	for len(entries) > 0 {
+		n := min(len(entries), 100)
+		fmt.Fprintf(&b, "%d beginbfchar\n%s\nendbfchar\n", n, strings.Join(entries[:n], "\n"))
+		entries = entries[n:]
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return b.Bytes()
+}
+
+// encode writes s as the hex glyph IDs of an Identity-H string, recording
+// the glyphs used.
+func (pf *pdfFont) encode(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r = textRune(r); r < 0 {
+			continue
+		}
+		g := pf.font.glyphIndex(r)
+		if _, ok := pf.used[g]; !ok {
+			pf.used[g] = r
+		}
+		fmt.Fprintf(&b, "%04X", g)
+	}
+	return b.String()
+}
+
+// gstate returns the name of a graphics state with the given alphas.
+func (p *PDF) gstate(fill, stroke float64) string {
+	name := fmt.Sprintf("GS%03d%03d", int(math.Round(fill*100)), int(math.Round(stroke*100)))
+	if _, ok := p.gstates[name]; !ok {
+		p.gstates[name] = p.add([]byte(fmt.Sprintf("<< /Type /ExtGState /ca %s /CA %s >>", f(fill), f(stroke))))
+	}
+	return name
+}
+
+// blendState returns the graphics state setting a blend mode.
+func (p *PDF) blendState(mode string) string {
+	name := "BM" + pdfBlendModes[mode]
+	if _, ok := p.gstates[name]; !ok {
+		p.gstates[name] = p.add([]byte(fmt.Sprintf("<< /Type /ExtGState /BM /%s >>", pdfBlendModes[mode])))
+	}
+	return name
+}
+
+// pdfBlendModes maps CSS blend modes to PDF's names for them.
+var pdfBlendModes = map[string]string{
+	"multiply": "Multiply", "screen": "Screen", "overlay": "Overlay",
+	"darken": "Darken", "lighten": "Lighten", "color-dodge": "ColorDodge",
+	"color-burn": "ColorBurn", "hard-light": "HardLight", "soft-light": "SoftLight",
+	"difference": "Difference", "exclusion": "Exclusion", "hue": "Hue",
+	"saturation": "Saturation", "color": "Color", "luminosity": "Luminosity",
+}
+
+// addShading adds a gradient as a shading and returns its resource name.
+// When the stops' alpha varies, the matching soft mask is returned as a
+// graphics state; otherwise alpha is the gradient's constant alpha.
+func (p *PDF) addShading(g *Gradient) (name, mask string, alpha float64) {
+	color := p.add([]byte(shadingDict(g, "DeviceRGB", func(c Color) []float64 { return []float64{c.R, c.G, c.B} })))
+	p.shadings = append(p.shadings, color)
+	name = fmt.Sprintf("Sh%d", len(p.shadings))
+
+	alpha = g.Stops[0].Color.A
+	for _, s := range g.Stops[1:] {
+		if s.Color.A != alpha {
+			alpha = -1
+			break
+		}
+	}
+	if alpha >= 0 {
+		return name, "", alpha
+	}
+	// The mask is a form drawing the same gradient in gray, one luminosity
+	// level per alpha, in the coordinates current when it is applied.
+	gray := p.add([]byte(shadingDict(g, "DeviceGray", func(c Color) []float64 { return []float64{c.A} })))
+	form := p.add(p.stream(fmt.Sprintf("/Type /XObject /Subtype /Form /BBox [-100000 -100000 100000 100000] /Group << /S /Transparency /CS /DeviceGray >> /Resources << /Shading << /Sh0 %d 0 R >> >>", gray), []byte("/Sh0 sh")))
+	mask = fmt.Sprintf("SM%d", form)
+	p.gstates[mask] = p.add([]byte(fmt.Sprintf("<< /Type /ExtGState /SMask << /S /Luminosity /G %d 0 R >> >>", form)))
+	return name, mask, 1
+}
+
+// shadingDict encodes a gradient as an axial or radial shading whose
+// function interpolates the channels of each pair of stops.
+func shadingDict(g *Gradient, space string, channels func(Color) []float64) string {
+	stops := append([]GradientStop{}, g.Stops...)
+	if stops[0].Offset > 0 {
+		stops = append([]GradientStop{{0, stops[0].Color}}, stops...)
+	}
+	if last := stops[len(stops)-1]; last.Offset < 1 || len(stops) == 1 {
+		stops = append(stops, GradientStop{1, last.Color})
+	}
+	nums := func(v []float64) string {
+		s := make([]string, len(v))
+		for i, x := range v {
+			s[i] = f(x)
+		}
+		return strings.Join(s, " ")
+	}
+
+	var fns, bounds, encode []string
+	prev := 0.0
+	for i := 1; i < len(stops); i++ {
+		fns = append(fns, fmt.Sprintf("<< /FunctionType 2 /Domain [0 1] /C0 [%s] /C1 [%s] /N 1 >>",
+			nums(channels(stops[i-1].Color)), nums(channels(stops[i].Color))))
+		encode = append(encode, "0 1")
+		if i < len(stops)-1 {
+			// Bounds must increase strictly.
+			prev = math.Min(math.Max(stops[i].Offset, prev+0.0001), 0.9999)
+			bounds = append(bounds, f(prev))
+		}
+	}
+	fn := fns[0]
+	if len(fns) > 1 {
+		fn = fmt.Sprintf("<< /FunctionType 3 /Domain [0 1] /Functions [%s] /Bounds [%s] /Encode [%s] >>",
+			strings.Join(fns, " "), strings.Join(bounds, " "), strings.Join(encode, " "))
+	}
+
+	kind, coords := 2, nums([]float64{g.X1, g.Y1, g.X2, g.Y2})
+	if g.Radial {
+		kind, coords = 3, nums([]float64{g.X1, g.Y1, g.R1, g.X2, g.Y2, g.R2})
+	}
+	return fmt.Sprintf("<< /ShadingType %d /ColorSpace /%s /Coords [%s] /Function %s /Extend [true true] >>", kind, space, coords, fn)
+}
+
+func (p *PDF) addImage(img image.Image) string {
+	b := img.Bounds()
+	rgb := make([]byte, 0, b.Dx()*b.Dy()*3)
+	alpha := make([]byte, 0, b.Dx()*b.Dy())
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a != 0 && a != 0xffff {
+				// Un-premultiply so the soft mask carries the coverage.
+				r, g, bl = r*0xffff/a, g*0xffff/a, bl*0xffff/a
+			}
+			rgb = append(rgb, byte(r>>8), byte(g>>8), byte(bl>>8))
+			alpha = append(alpha, byte(a>>8))
+			if a != 0xffff {
+				opaque = false
+			}
+		}
+	}
+
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8", b.Dx(), b.Dy())
+	if !opaque {
+		mask := p.add(p.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", b.Dx(), b.Dy()), alpha))
+		dict += fmt.Sprintf(" /SMask %d 0 R", mask)
+	}
+	p.images = append(p.images, p.add(p.stream(dict, rgb)))
+	return fmt.Sprintf("Im%d", len(p.images))
+}
+
+// PDFPage is a Surface that draws onto one page of a PDF
+type PDFPage struct {
+	pdf  *PDF
+	buf  bytes.Buffer
+	w, h float64
+	id   int
+}
+
+var _ Surface = (*PDFPage)(nil)
+
+// Size returns the page size.
+func (pg *PDFPage) Size() (float64, float64) { return pg.w, pg.h }
+
+func (pg *PDFPage) Save()    { pg.buf.WriteString("q\n") }
+func (pg *PDFPage) Restore() { pg.buf.WriteString("Q\n") }
+
+func (pg *PDFPage) Transform(m Matrix) {
+	fmt.Fprintf(&pg.buf, "%s %s %s %s %s %s cm\n", f(m[0]), f(m[1]), f(m[2]), f(m[3]), f(m[4]), f(m[5]))
+}
+
+// begin sets up colors for a shape and returns the painting operator.
+func (pg *PDFPage) begin(s Style) string {
+	fill, stroke := s.Fill.Visible(), s.Stroke.Visible() && s.StrokeWidth > 0
+	if !fill && !stroke {
+		return ""
+	}
+	pg.Save()
+	fa, sa := 1.0, 1.0
+	if fill {
+		fmt.Fprintf(&pg.buf, "%s %s %s rg\n", f(s.Fill.R), f(s.Fill.G), f(s.Fill.B))
+		fa = s.Fill.A
+	}
+	if stroke {
+		fmt.Fprintf(&pg.buf, "%s %s %s RG %s w\n", f(s.Stroke.R), f(s.Stroke.G), f(s.Stroke.B), f(s.StrokeWidth))
+		sa = s.Stroke.A
+	}
+	if fa < 1 || sa < 1 {
+		fmt.Fprintf(&pg.buf, "/%s gs\n", pg.pdf.gstate(fa, sa))
+	}
+	switch {
+	case fill && stroke:
+		return "B"
+	case fill:
+		return "f"
+	}
+	return "S"
+}
+
+func (pg *PDFPage) end(op string) {
+	pg.buf.WriteString(op + "\nQ\n")
+}
+
+// shape paints a path. Gradient fills are painted by clipping to the path
+// and shading the clip; strokes are painted over them as usual.
+func (pg *PDFPage) shape(path string, s Style) {
+	if s.Gradient != nil {
+		name, mask, alpha := pg.pdf.addShading(s.Gradient)
+		pg.Save()
+		pg.buf.WriteString(path + "W n\n")
+		if mask != "" {
+			fmt.Fprintf(&pg.buf, "/%s gs\n", mask)
+		} else if alpha < 1 {
+			fmt.Fprintf(&pg.buf, "/%s gs\n", pg.pdf.gstate(alpha, alpha))
+		}
+		fmt.Fprintf(&pg.buf, "/%s sh\n", name)
+		pg.Restore()
+		s.Fill = Color{}
+	}
+	op := pg.begin(s)
+	if op == "" {
+		return
+	}
+	pg.buf.WriteString(path)
+	pg.end(op)
+}
+
+func (pg *PDFPage) Rect(x, y, w, h, radius float64, s Style) {
+	var path strings.Builder
+	radius = math.Min(radius, math.Min(w, h)/2)
+	if radius <= 0 {
+		fmt.Fprintf(&path, "%s %s %s %s re\n", f(x), f(y), f(w), f(h))
+	} else {
+		k := radius * 0.5523
+		fmt.Fprintf(&path, "%s %s m\n", f(x+radius), f(y))
+		fmt.Fprintf(&path, "%s %s l\n", f(x+w-radius), f(y))
+		fmt.Fprintf(&path, "%s %s %s %s %s %s c\n", f(x+w-radius+k), f(y), f(x+w), f(y+radius-k), f(x+w), f(y+radius))
+		fmt.Fprintf(&path, "%s %s l\n", f(x+w), f(y+h-radius))
+		fmt.Fprintf(&path, "%s %s %s %s %s %s c\n", f(x+w), f(y+h-radius+k), f(x+w-radius+k), f(y+h), f(x+w-radius), f(y+h))
+		fmt.Fprintf(&path, "%s %s l\n", f(x+radius), f(y+h))
+		fmt.Fprintf(&path, "%s %s %s %s %s %s c\n", f(x+radius-k), f(y+h), f(x), f(y+h-radius+k), f(x), f(y+h-radius))
+		fmt.Fprintf(&path, "%s %s l\n", f(x), f(y+radius))
+		fmt.Fprintf(&path, "%s %s %s %s %s %s c h\n", f(x), f(y+radius-k), f(x+radius-k), f(y), f(x+radius), f(y))
+	}
+	pg.shape(path.String(), s)
+}
+
+func (pg *PDFPage) Ellipse(cx, cy, rx, ry float64, s Style) {
+	var path strings.Builder
+	kx, ky := rx*0.5523, ry*0.5523
+	fmt.Fprintf(&path, "%s %s m\n", f(cx+rx), f(cy))
+	fmt.Fprintf(&path, "%s %s %s %s %s %s c\n", f(cx+rx), f(cy+ky), f(cx+kx), f(cy+ry), f(cx), f(cy+ry))
+	fmt.Fprintf(&path, "%s %s %s %s %s %s c\n", f(cx-kx), f(cy+ry), f(cx-rx), f(cy+ky), f(cx-rx), f(cy))
+	fmt.Fprintf(&path, "%s %s %s %s %s %s c\n", f(cx-rx), f(cy-ky), f(cx-kx), f(cy-ry), f(cx), f(cy-ry))
+	fmt.Fprintf(&path, "%s %s %s %s %s %s c h\n", f(cx+kx), f(cy-ry), f(cx+rx), f(cy-ky), f(cx+rx), f(cy))
+	pg.shape(path.String(), s)
+}
+
+func (pg *PDFPage) Polygon(points []Point, closed bool, s Style) {
+	if len(points) < 2 {
+		return
+	}
+	if !closed {
+		s.Fill, s.Gradient = Color{}, nil
+	}
+	pg.shape(polygonPath(points, closed), s)
+}
+
+func polygonPath(points []Point, closed bool) string {
+	var path strings.Builder
+	fmt.Fprintf(&path, "%s %s m\n", f(points[0].X), f(points[0].Y))
+	for _, pt := range points[1:] {
+		fmt.Fprintf(&path, "%s %s l\n", f(pt.X), f(pt.Y))
+	}
+	if closed {
+		path.WriteString("h\n")
+	}
+	return path.String()
+}
+
+func (pg *PDFPage) Clip(points []Point) {
+	if len(points) < 3 {
+		// Nothing is inside a degenerate clip.
+		pg.buf.WriteString("0 0 0 0 re W n\n")
+		return
+	}
+	pg.buf.WriteString(polygonPath(points, true) + "W n\n")
+}
+
+func (pg *PDFPage) SetBlendMode(mode string) bool {
+	if _, ok := pdfBlendModes[mode]; !ok {
+		return false
+	}
+	fmt.Fprintf(&pg.buf, "/%s gs\n", pg.pdf.blendState(mode))
+	return true
+}
+
+// BlurBackdrop is not supported: PDF content cannot read back what is
+// below it.
+func (pg *PDFPage) BlurBackdrop(points []Point, radius float64) bool { return false }
+
+func (pg *PDFPage) Text(x, y float64, t TextRun) {
+	if t.Text == "" || !t.Color.Visible() {
+		return
+	}
+	font, text := "F1", "("+pdfString(t.Text)+")"
+	if t.Font != nil {
+		pf := pg.pdf.font(t.Font)
+		font, text = pf.name, "<"+pf.encode(t.Text)+">"
+	} else if t.Bold {
+		font = "F2"
+	}
+	pg.Save()
+	if t.Color.A < 1 {
+		fmt.Fprintf(&pg.buf, "/%s gs\n", pg.pdf.gstate(t.Color.A, t.Color.A))
+	}
+	// The text matrix flips y back so glyphs are upright on the flipped page.
+	fmt.Fprintf(&pg.buf, "BT /%s %s Tf %s %s %s rg 1 0 0 -1 %s %s Tm %s Tj ET\nQ\n",
+		font, f(t.Size), f(t.Color.R), f(t.Color.G), f(t.Color.B), f(x), f(y), text)
+}
+
+func (pg *PDFPage) Image(img image.Image, x, y, w, h, alpha float64) {
+	if alpha <= 0 {
+		return
+	}
+	name := pg.pdf.addImage(img)
+	pg.Save()
+	if alpha < 1 {
+		fmt.Fprintf(&pg.buf, "/%s gs\n", pg.pdf.gstate(alpha, alpha))
+	}
+	// Image space is a unit square with a bottom-left origin.
+	fmt.Fprintf(&pg.buf, "%s 0 0 %s %s %s cm /%s Do\nQ\n", f(w), f(-h), f(x), f(y+h), name)
+}
+
+// pdfString escapes s as a WinAnsi literal string. Characters outside
+// Latin-1 are replaced since the standard fonts cannot draw them.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteByte(' ')
+		case r < 32:
+			continue
+		case r < 128:
+			b.WriteRune(r)
+		case r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// f formats a number compactly for content streams.
+func f(v float64) string {
+	if math.Abs(v) < 1e-9 {
+		return "0"
+	}
+	s := fmt.Sprintf("%.3f", v)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
@@ -0,0 +1,592 @@
+package render
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Annotation is a markup annotation read back from a PDF, such as a sticky
+// note or highlight added in Acrobat. Rect is in top-left page coordinates,
+// which for exported pages are canvas coordinates.
+type Annotation struct {
+	Ref       int // object number, 0 when the annotation is not an indirect object
+	Page      int // zero-based page index
+	Subtype   string
+	Rect      Box
+	Contents  string
+	Author    string
+	Name      string // the annotation's unique name (NM), if any
+	InReplyTo int    // object number of the annotation this one replies to
+	Modified  string // raw PDF date string
+}
+
+// ErrEncryptedPDF is returned for PDFs whose strings are encrypted.
+var ErrEncryptedPDF = errors.New("encrypted PDFs are not supported")
+
+// skippedAnnotations are annotation subtypes that carry no review content:
+// popups belong to another annotation, links and widgets are interactive.
+var skippedAnnotations = map[string]bool{"Popup": true, "Link": true, "Widget": true}
+
+// ReadAnnotations returns the markup annotations of every page of a PDF, in
+// page order. It reads the object bodies directly rather than through the
+// cross-reference table, so incrementally updated files (as Acrobat saves
+// them) resolve to their latest revision of each object.
+func ReadAnnotations(data []byte) ([]Annotation, error) {
+	r := &pdfReader{objects: map[int]any{}}
+	if err := r.scan(data); err != nil {
+		return nil, err
+	}
+	if r.encrypted {
+		return nil, ErrEncryptedPDF
+	}
+	pages, err := r.pages()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Annotation
+	for i, page := range pages {
+		top, left := 0.0, 0.0
+		if mb, ok := r.resolve(page["MediaBox"]).([]any); ok && len(mb) == 4 {
+			left, _ = r.resolve(mb[0]).(float64)
+			top, _ = r.resolve(mb[3]).(float64)
+		}
+		annots, _ := r.resolve(page["Annots"]).([]any)
+		for _, a := range annots {
+			ref := 0
+			if pr, ok := a.(pdfRef); ok {
+				ref = pr.num
+			}
+			dict, ok := r.resolve(a).(map[string]any)
+			if !ok {
+				continue
+			}
+			subtype, _ := r.resolve(dict["Subtype"]).(pdfName)
+			if subtype == "" || skippedAnnotations[string(subtype)] {
+				continue
+			}
+			rect, ok := r.resolve(dict["Rect"]).([]any)
+			if !ok || len(rect) != 4 {
+				continue
+			}
+			var c [4]float64
+			for j := range c {
+				c[j], _ = r.resolve(rect[j]).(float64)
+			}
+			x1, x2 := minMax(c[0], c[2])
+			y1, y2 := minMax(c[1], c[3])
+			an := Annotation{
+				Ref:      ref,
+				Page:     i,
+				Subtype:  string(subtype),
+				Rect:     Box{X: x1 - left, Y: top - y2, W: x2 - x1, H: y2 - y1},
+				Contents: r.text(dict["Contents"]),
+				Author:   r.text(dict["T"]),
+				Name:     r.text(dict["NM"]),
+				Modified: r.text(dict["M"]),
+			}
+			if irt, ok := dict["IRT"].(pdfRef); ok {
+				an.InReplyTo = irt.num
+			}
+			out = append(out, an)
+		}
+	}
+	return out, nil
+}
+
+func minMax(a, b float64) (float64, float64) {
+	if a > b {
+		return b, a
+	}
+	return a, b
+}
+
+// PDF object values: nil, bool, float64, pdfBytes, pdfName, []any,
+// map[string]any (dictionary keys without the slash), pdfRef and pdfStream.
+type (
+	pdfName   string
+	pdfBytes  []byte
+	pdfRef    struct{ num, gen int }
+	pdfStream struct {
+		dict map[string]any
+		data []byte
+	}
+)
+
+type pdfReader struct {
+	objects   map[int]any
+	encrypted bool
+}
+
+var objHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// scan parses every indirect object in file order, later definitions
+// replacing earlier ones, and unpacks object streams where they appear.
+func (r *pdfReader) scan(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\n\f\r "), []byte("%PDF-")) {
+		return fmt.Errorf("not a PDF file")
+	}
+	r.encrypted = bytes.Contains(data, []byte("/Encrypt"))
+	pos := 0
+	for {
+		m := objHeader.FindSubmatchIndex(data[pos:])
+		if m == nil {
+			break
+		}
+		num, _ := strconv.Atoi(string(data[pos+m[2] : pos+m[3]]))
+		l := &pdfLexer{data: data, pos: pos + m[1]}
+		v, err := l.value()
+		if err != nil {
+			// A false match, e.g. inside a stream; move past it.
+			pos += m[1]
+			continue
+		}
+		if dict, ok := v.(map[string]any); ok {
+			if l.skipSpace(); l.keyword("stream") {
+				s, err := l.stream(dict)
+				if err != nil {
+					return err
+				}
+				v = s
+				if t, _ := dict["Type"].(pdfName); t == "ObjStm" {
+					if err := r.unpack(s); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		r.objects[num] = v
+		pos = l.pos
+	}
+	if len(r.objects) == 0 {
+		return fmt.Errorf("no PDF objects found")
+	}
+	return nil
+}
+
+// unpack adds the objects compressed in an object stream.
+func (r *pdfReader) unpack(s *pdfStream) error {
+	data, err := r.decode(s)
+	if err != nil {
+		return err
+	}
+	n, _ := r.resolve(s.dict["N"]).(float64)
+	first, _ := r.resolve(s.dict["First"]).(float64)
+	if int(first) > len(data) {
+		return fmt.Errorf("malformed object stream")
+	}
+	header := &pdfLexer{data: data[:int(first)]}
+	for i := 0; i < int(n); i++ {
+		num, err1 := header.value()
+		off, err2 := header.value()
+		numF, ok1 := num.(float64)
+		offF, ok2 := off.(float64)
+		if err1 != nil || err2 != nil || !ok1 || !ok2 {
+			return fmt.Errorf("malformed object stream")
+		}
+		start := int(first) + int(offF)
+		if start < 0 || start >= len(data) {
+			continue
+		}
+		l := &pdfLexer{data: data, pos: start}
+		if v, err := l.value(); err == nil {
+			r.objects[int(numF)] = v
+		}
+	}
+	return nil
+}
+
+func (r *pdfReader) decode(s *pdfStream) ([]byte, error) {
+	switch f := r.resolve(s.dict["Filter"]).(type) {
+	case nil:
+		return s.data, nil
+	case pdfName:
+		if f == "FlateDecode" {
+			return inflate(s.data)
+		}
+	case []any:
+		if len(f) == 1 && f[0] == pdfName("FlateDecode") {
+			return inflate(s.data)
+		}
+	}
+	return nil, fmt.Errorf("unsupported stream filter")
+}
+
+func inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(io.LimitReader(zr, 64<<20))
+}
+
+// resolve follows indirect references.
+func (r *pdfReader) resolve(v any) any {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			break
+		}
+		v = r.objects[ref.num]
+	}
+	if s, ok := v.(*pdfStream); ok {
+		return s.dict
+	}
+	return v
+}
+
+// text decodes a PDF text string: UTF-16BE with a byte order mark, UTF-8
+// with one, or PDFDocEncoding, read as Latin-1.
+func (r *pdfReader) text(v any) string {
+	s, ok := r.resolve(v).(pdfBytes)
+	if !ok {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(s, []byte{0xfe, 0xff}):
+		u := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			u = append(u, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(u))
+	case bytes.HasPrefix(s, []byte{0xef, 0xbb, 0xbf}):
+		return string(s[3:])
+	}
+	runes := make([]rune, len(s))
+	for i, b := range s {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// pages returns the page dictionaries in document order, with inheritable
+// attributes copied down from the page tree.
+func (r *pdfReader) pages() ([]map[string]any, error) {
+	var root map[string]any
+	for _, v := range r.objects {
+		if d, ok := v.(map[string]any); ok && d["Type"] == pdfName("Catalog") {
+			root = d
+			break
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("PDF has no document catalog")
+	}
+	var out []map[string]any
+	var walk func(node map[string]any, inherited map[string]any, depth int)
+	walk = func(node map[string]any, inherited map[string]any, depth int) {
+		if node == nil || depth > 32 {
+			return
+		}
+		attrs := map[string]any{}
+		for k, v := range inherited {
+			attrs[k] = v
+		}
+		for _, k := range []string{"MediaBox", "CropBox", "Rotate"} {
+			if v, ok := node[k]; ok {
+				attrs[k] = v
+			}
+		}
+		if node["Type"] == pdfName("Page") {
+			page := map[string]any{}
+			for k, v := range attrs {
+				page[k] = v
+			}
+			for k, v := range node {
+				page[k] = v
+			}
+			out = append(out, page)
+			return
+		}
+		kids, _ := r.resolve(node["Kids"]).([]any)
+		for _, k := range kids {
+			kid, _ := r.resolve(k).(map[string]any)
+			walk(kid, attrs, depth+1)
+		}
+	}
+	pagesRoot, _ := r.resolve(root["Pages"]).(map[string]any)
+	walk(pagesRoot, nil, 0)
+	if len(out) == 0 {
+		return nil, fmt.Errorf("PDF has no pages")
+	}
+	return out, nil
+}
+
+// pdfLexer parses PDF object syntax.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelim(c byte) bool {
+	return isPDFSpace(c) || bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// keyword consumes kw if it is next in the input.
+func (l *pdfLexer) keyword(kw string) bool {
+	end := l.pos + len(kw)
+	if end > len(l.data) || string(l.data[l.pos:end]) != kw {
+		return false
+	}
+	if end < len(l.data) && !isPDFDelim(l.data[end]) {
+		return false
+	}
+	l.pos = end
+	return true
+}
+
+var errPDFSyntax = errors.New("malformed PDF object")
+
+func (l *pdfLexer) value() (any, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, errPDFSyntax
+	}
+	switch c := l.data[l.pos]; {
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		dict := map[string]any{}
+		for {
+			l.skipSpace()
+			if l.pos+1 < len(l.data) && l.data[l.pos] == '>' && l.data[l.pos+1] == '>' {
+				l.pos += 2
+				return dict, nil
+			}
+			key, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, errPDFSyntax
+			}
+			v, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			dict[string(name)] = v
+		}
+	case c == '<':
+		return l.hexString()
+	case c == '(':
+		return l.literalString()
+	case c == '[':
+		l.pos++
+		arr := []any{}
+		for {
+			l.skipSpace()
+			if l.pos < len(l.data) && l.data[l.pos] == ']' {
+				l.pos++
+				return arr, nil
+			}
+			v, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+	case c == '/':
+		l.pos++
+		var name []byte
+		for l.pos < len(l.data) && !isPDFDelim(l.data[l.pos]) {
+			b := l.data[l.pos]
+			if b == '#' && l.pos+2 < len(l.data) {
+				if h, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+					name = append(name, byte(h))
+					l.pos += 3
+					continue
+				}
+			}
+			name = append(name, b)
+			l.pos++
+		}
+		return pdfName(name), nil
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return l.number()
+	case l.keyword("true"):
+		return true, nil
+	case l.keyword("false"):
+		return false, nil
+	case l.keyword("null"):
+		return nil, nil
+	}
+	return nil, errPDFSyntax
+}
+
+// number parses a number, or an indirect reference "num gen R".
+func (l *pdfLexer) number() (any, error) {
+	n, isInt, ok := l.scanNumber()
+	if !ok {
+		return nil, errPDFSyntax
+	}
+	if isInt {
+		save := l.pos
+		l.skipSpace()
+		if gen, genInt, ok := l.scanNumber(); ok && genInt {
+			l.skipSpace()
+			if l.keyword("R") {
+				return pdfRef{num: int(n), gen: int(gen)}, nil
+			}
+		}
+		l.pos = save
+	}
+	return n, nil
+}
+
+func (l *pdfLexer) scanNumber() (float64, bool, bool) {
+	start := l.pos
+	isInt := true
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '.' {
+			isInt = false
+		} else if !(c >= '0' && c <= '9') && !((c == '+' || c == '-') && l.pos == start) {
+			break
+		}
+		l.pos++
+	}
+	n, err := strconv.ParseFloat(string(l.data[start:l.pos]), 64)
+	if err != nil {
+		l.pos = start
+		return 0, false, false
+	}
+	return n, isInt, true
+}
+
+func (l *pdfLexer) hexString() (any, error) {
+	l.pos++
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.data) {
+		return nil, errPDFSyntax
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	for i := range out {
+		b, err := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		if err != nil {
+			return nil, errPDFSyntax
+		}
+		out[i] = byte(b)
+	}
+	return pdfBytes(out), nil
+}
+
+func (l *pdfLexer) literalString() (any, error) {
+	l.pos++
+	var out []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return pdfBytes(out), nil
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return nil, errPDFSyntax
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, errPDFSyntax
+}
+
+// stream reads a stream's data after the "stream" keyword. A direct
+// /Length is trusted when it lands on "endstream"; otherwise the data runs
+// to the next "endstream".
+func (l *pdfLexer) stream(dict map[string]any) (*pdfStream, error) {
+	if l.pos < len(l.data) && l.data[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+		l.pos++
+	}
+	start := l.pos
+	if n, ok := dict["Length"].(float64); ok && n >= 0 && start+int(n) <= len(l.data) {
+		end := start + int(n)
+		rest := bytes.TrimLeft(l.data[end:], "\r\n ")
+		if bytes.HasPrefix(rest, []byte("endstream")) {
+			l.pos = len(l.data) - len(rest) + len("endstream")
+			return &pdfStream{dict: dict, data: l.data[start:end]}, nil
+		}
+	}
+	i := bytes.Index(l.data[start:], []byte("endstream"))
+	if i < 0 {
+		return nil, errPDFSyntax
+	}
+	end := start + i
+	l.pos = end + len("endstream")
+	return &pdfStream{dict: dict, data: bytes.TrimRight(l.data[start:end], "\r\n")}, nil
+}
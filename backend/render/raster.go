@@ -0,0 +1,75 @@
+package render
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Thumbnail center-crops src to a square and scales it to size×size using
+// an area-averaging filter. Downscaling averages every covered source pixel;
+// upscaling replicates pixels.
+func Thumbnail(src image.Image, size int) *image.NRGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+	return Resize(src, crop, size, size)
+}
+
+// Resize scales the rect region of src to w×h.
+func Resize(src image.Image, rect image.Rectangle, w, h int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if rect.Empty() || w <= 0 || h <= 0 {
+		return dst
+	}
+
+	// Work in premultiplied RGBA so transparent pixels don't bleed color.
+	in := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(in, in.Bounds(), src, rect.Min, draw.Src)
+
+	sx := float64(rect.Dx()) / float64(w)
+	sy := float64(rect.Dy()) / float64(h)
+	for y := 0; y < h; y++ {
+		y0, y1 := float64(y)*sy, float64(y+1)*sy
+		for x := 0; x < w; x++ {
+			x0, x1 := float64(x)*sx, float64(x+1)*sx
+			var r, g, bl, a, area float64
+			for py := int(y0); py < int(math.Ceil(y1)) && py < rect.Dy(); py++ {
+				wy := math.Min(y1, float64(py+1)) - math.Max(y0, float64(py))
+				for px := int(x0); px < int(math.Ceil(x1)) && px < rect.Dx(); px++ {
+					wx := math.Min(x1, float64(px+1)) - math.Max(x0, float64(px))
+					weight := wx * wy
+					i := in.PixOffset(px, py)
+					r += float64(in.Pix[i]) * weight
+					g += float64(in.Pix[i+1]) * weight
+					bl += float64(in.Pix[i+2]) * weight
+					a += float64(in.Pix[i+3]) * weight
+					area += weight
+				}
+			}
+			if area == 0 || a == 0 {
+				continue
+			}
+			// Un-premultiply for NRGBA
+			o := dst.PixOffset(x, y)
+			dst.Pix[o] = clamp8(r / a * 255)
+			dst.Pix[o+1] = clamp8(g / a * 255)
+			dst.Pix[o+2] = clamp8(bl / a * 255)
+			dst.Pix[o+3] = clamp8(a / area)
+		}
+	}
+	return dst
+}
+
+func clamp8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
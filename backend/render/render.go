@@ -0,0 +1,511 @@
+// Package render draws canvas documents onto output surfaces. It walks the
+// canvas object tree once and issues drawing calls against a Surface, so
+// every output format (PDF and SVG today) shares the same interpretation of
+// positions, transforms, colors and text.
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Page is one page of a canvas document
+type Page struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name,omitempty"`
+	Objects []map[string]any `json:"objects"`
+}
+
+// DefaultPageID identifies the implicit single page of a canvas document
+// that keeps its elements in a top-level "objects" list.
+const DefaultPageID = "default"
+
+// ParsePages returns the pages of a canvas document. Multi-page documents
+// carry a "pages" list; older documents are treated as a single page.
+func ParsePages(raw []byte) ([]Page, error) {
+	if len(raw) == 0 {
+		return []Page{{ID: DefaultPageID, Objects: []map[string]any{}}}, nil
+	}
+
+	var doc struct {
+		Pages   []Page           `json:"pages"`
+		Objects []map[string]any `json:"objects"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("canvas data must be a JSON object")
+	}
+	if len(doc.Pages) == 0 {
+		if doc.Objects == nil {
+			doc.Objects = []map[string]any{}
+		}
+		return []Page{{ID: DefaultPageID, Objects: doc.Objects}}, nil
+	}
+	return doc.Pages, nil
+}
+
+// FindPage returns the page with the given ID, or the first page when id is
+// empty.
+func FindPage(pages []Page, id string) *Page {
+	for i := range pages {
+		if id == "" || pages[i].ID == id {
+			return &pages[i]
+		}
+	}
+	return nil
+}
+
+// Box is an axis-aligned rectangle in canvas coordinates
+type Box struct {
+	X, Y, W, H float64
+}
+
+// Center returns the midpoint of the box.
+func (b Box) Center() (float64, float64) {
+	return b.X + b.W/2, b.Y + b.H/2
+}
+
+// FindElement searches objects, including those nested in groups, for the
+// element with the given ID.
+func FindElement(objects []map[string]any, id string) map[string]any {
+	obj, _, ok := Locate(objects, id)
+	if !ok {
+		return nil
+	}
+	return obj
+}
+
+// Locate finds an element and its bounding box on the page. Group offsets
+// are applied; rotation is ignored, so the box is approximate for rotated
+// elements.
+func Locate(objects []map[string]any, id string) (map[string]any, Box, bool) {
+	return locate(objects, id, 0, 0)
+}
+
+func locate(objects []map[string]any, id string, dx, dy float64) (map[string]any, Box, bool) {
+	for _, obj := range objects {
+		b := bounds(obj)
+		b.X += dx
+		b.Y += dy
+		if objID, _ := obj["id"].(string); objID == id {
+			return obj, b, true
+		}
+		if children := childObjects(obj); len(children) > 0 {
+			// Group children are positioned relative to the group's center.
+			cx, cy := b.Center()
+			if found, fb, ok := locate(children, id, cx, cy); ok {
+				return found, fb, true
+			}
+		}
+	}
+	return nil, Box{}, false
+}
+
+// Placement is an element's bounding box on its page
+type Placement struct {
+	ID  string `json:"id"`
+	Box Box    `json:"box"`
+}
+
+// Layout lists every element with an ID, group children included, with
+// its bounding box, in paint order. Boxes are approximate in the same way
+// as Locate's.
+func Layout(objects []map[string]any) []Placement {
+	return layout(objects, 0, 0, nil)
+}
+
+func layout(objects []map[string]any, dx, dy float64, out []Placement) []Placement {
+	for _, obj := range objects {
+		b := bounds(obj)
+		b.X += dx
+		b.Y += dy
+		if id, _ := obj["id"].(string); id != "" {
+			out = append(out, Placement{ID: id, Box: b})
+		}
+		if children := childObjects(obj); len(children) > 0 {
+			cx, cy := b.Center()
+			out = layout(children, cx, cy, out)
+		}
+	}
+	return out
+}
+
+func bounds(obj map[string]any) Box {
+	r := num(obj, "radius", 0)
+	w := num(obj, "width", 2*r) * num(obj, "scaleX", 1)
+	h := num(obj, "height", 2*r) * num(obj, "scaleY", 1)
+	x, y := num(obj, "left", 0), num(obj, "top", 0)
+	ox, oy := originOffset(obj)
+	return Box{X: x - ox*w, Y: y - oy*h, W: w, H: h}
+}
+
+// Color is a non-premultiplied RGBA color with components in [0, 1]
+type Color struct {
+	R, G, B, A float64
+}
+
+// Visible reports whether drawing with the color has any effect.
+func (c Color) Visible() bool { return c.A > 0 }
+
+// Style describes how a shape is filled and stroked
+type Style struct {
+	Fill        Color
+	Stroke      Color
+	StrokeWidth float64
+	// Gradient, when set, fills the shape instead of Fill
+	Gradient *Gradient
+}
+
+// Point is a location in the current coordinate space
+type Point struct {
+	X, Y float64
+}
+
+// TextRun is a single line of text
+type TextRun struct {
+	Text  string
+	Size  float64
+	Bold  bool
+	Color Color
+	// Font is the uploaded font to draw with; nil draws in Helvetica
+	Font *Font
+}
+
+// Matrix is a 2D affine transform [a b c d e f], as used by PDF's cm
+// operator: x' = a*x + c*y + e, y' = b*x + d*y + f.
+type Matrix [6]float64
+
+// Translate returns a translation matrix.
+func Translate(x, y float64) Matrix { return Matrix{1, 0, 0, 1, x, y} }
+
+// Scale returns a scaling matrix.
+func Scale(sx, sy float64) Matrix { return Matrix{sx, 0, 0, sy, 0, 0} }
+
+// Rotate returns a rotation by deg degrees clockwise in a y-down space.
+func Rotate(deg float64) Matrix {
+	r := deg * math.Pi / 180
+	c, s := math.Cos(r), math.Sin(r)
+	return Matrix{c, s, -s, c, 0, 0}
+}
+
+// Surface is an output target. Coordinates are in canvas pixels with the
+// origin at the top-left and y growing downwards.
+type Surface interface {
+	Save()
+	Restore()
+	Transform(m Matrix)
+	Rect(x, y, w, h, radius float64, s Style)
+	Ellipse(cx, cy, rx, ry float64, s Style)
+	Polygon(points []Point, closed bool, s Style)
+	Text(x, y float64, t TextRun)
+	Image(img image.Image, x, y, w, h, alpha float64)
+	// Clip restricts drawing to the polygon until the matching Restore.
+	Clip(points []Point)
+	// SetBlendMode blends later drawing with what is below it until the
+	// matching Restore. Modes use the CSS names (multiply, screen, ...). It
+	// reports false when the surface cannot blend in that mode.
+	SetBlendMode(mode string) bool
+	// BlurBackdrop blurs what has already been drawn inside the polygon.
+	// It reports false when the surface cannot read back its output.
+	BlurBackdrop(points []Point, radius float64) bool
+}
+
+// ImageLoader resolves an image element's src to decoded pixels.
+type ImageLoader func(ctx context.Context, src string) (image.Image, error)
+
+// FontLoader resolves a text element's fontUrl, or its bare fontAssetId,
+// to a parsed font.
+type FontLoader func(ctx context.Context, src string) (*Font, error)
+
+// Result summarises a render. Unsupported counts elements by type that
+// could not be drawn or were drawn approximately.
+type Result struct {
+	Elements    int            `json:"elements"`
+	Unsupported map[string]int `json:"unsupported,omitempty"`
+}
+
+func (r *Result) degrade(kind string) {
+	if r.Unsupported == nil {
+		r.Unsupported = map[string]int{}
+	}
+	r.Unsupported[kind]++
+}
+
+// DrawPage renders a page's elements onto s in document order. Without a
+// font loader, all text is drawn in Helvetica.
+func DrawPage(ctx context.Context, s Surface, page Page, images ImageLoader, fonts FontLoader) (*Result, error) {
+	res := &Result{}
+	for _, obj := range page.Objects {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		drawObject(ctx, s, obj, Matrix{1, 0, 0, 1, 0, 0}, images, fonts, res)
+	}
+	return res, nil
+}
+
+// objectMatrix maps an element's local box, (0,0) to (width,height), into
+// its parent's coordinates.
+func objectMatrix(obj map[string]any) Matrix {
+	w, h := num(obj, "width", 0), num(obj, "height", 0)
+	ox, oy := originOffset(obj)
+	m := Translate(num(obj, "left", 0), num(obj, "top", 0))
+	if angle := num(obj, "angle", 0); angle != 0 {
+		m = m.Mul(Rotate(angle))
+	}
+	m = m.Mul(Scale(num(obj, "scaleX", 1), num(obj, "scaleY", 1)))
+	if flipX, _ := obj["flipX"].(bool); flipX {
+		m = m.Mul(Matrix{-1, 0, 0, 1, w * (1 - 2*ox), 0})
+	}
+	if flipY, _ := obj["flipY"].(bool); flipY {
+		m = m.Mul(Matrix{1, 0, 0, -1, 0, h * (1 - 2*oy)})
+	}
+	return m.Mul(Translate(-ox*w, -oy*h))
+}
+
+// drawObject draws an element and its effects. parent is the transform from
+// the surface's page coordinates to the coordinates obj is positioned in.
+func drawObject(ctx context.Context, s Surface, obj map[string]any, parent Matrix, images ImageLoader, fonts FontLoader, res *Result) {
+	if visible, ok := obj["visible"].(bool); ok && !visible {
+		return
+	}
+	res.Elements++
+
+	w, h := num(obj, "width", 0), num(obj, "height", 0)
+	opacity := clamp(num(obj, "opacity", 1))
+	m := objectMatrix(obj)
+	kind, _ := obj["type"].(string)
+	kind = strings.ToLower(kind)
+
+	style := Style{
+		Fill:        paint(obj["fill"], opacity, res),
+		Stroke:      paint(obj["stroke"], opacity, res),
+		StrokeWidth: num(obj, "strokeWidth", 1),
+		Gradient:    parseGradient(obj["fill"], w, h, opacity),
+	}
+	if isGradient(obj["stroke"]) {
+		res.degrade(FeatureGradient)
+	}
+	var font *Font
+	if isText(kind) {
+		font = textFont(ctx, obj, fonts, res)
+	}
+
+	s.Save()
+	defer s.Restore()
+	applyBlendMode(s, obj, res)
+	if clip, ok := obj["clipPath"].(map[string]any); ok {
+		applyClip(s, clip, parent, m, w, h, res)
+	}
+	drawShadow(s, obj, kind, m, w, h, style, font, res)
+	s.Transform(m)
+	if radius := num(obj, "backdropBlur", 0); radius > 0 {
+		if outline := shapeOutline(obj, kind, w, h); outline == nil || !s.BlurBackdrop(outline, radius) {
+			res.degrade(FeatureBackdropBlur)
+		}
+	}
+
+	switch kind {
+	case "text", "i-text", "textbox":
+		if isGradient(obj["fill"]) {
+			res.degrade(FeatureGradient)
+		}
+		color := style.Fill
+		if _, ok := obj["fill"]; !ok {
+			color = Color{A: opacity}
+		}
+		drawText(s, obj, w, color, font)
+	case "image":
+		drawImage(ctx, s, obj, w, h, opacity, images, res)
+	case "barcode":
+		drawBarcode(s, obj, w, h, opacity, res)
+	case "group":
+		s.Transform(Translate(w/2, h/2))
+		for _, child := range childObjects(obj) {
+			drawObject(ctx, s, child, parent.Mul(m).Mul(Translate(w/2, h/2)), images, fonts, res)
+		}
+	default:
+		if !drawShape(s, obj, kind, w, h, style) {
+			// Paths and custom elements are drawn as their bounding box so
+			// the layout is still legible.
+			res.degrade(kind)
+			if style.Fill.Visible() || style.Stroke.Visible() || style.Gradient != nil {
+				s.Rect(0, 0, w, h, 0, style)
+			}
+		}
+	}
+}
+
+// drawShape draws the basic shapes in local coordinates and reports whether
+// kind is one of them.
+func drawShape(s Surface, obj map[string]any, kind string, w, h float64, style Style) bool {
+	switch kind {
+	case "rect":
+		s.Rect(0, 0, w, h, num(obj, "rx", 0), style)
+	case "circle":
+		r := num(obj, "radius", w/2)
+		s.Ellipse(r, r, r, r, style)
+	case "ellipse":
+		rx, ry := num(obj, "rx", w/2), num(obj, "ry", h/2)
+		s.Ellipse(rx, ry, rx, ry, style)
+	case "triangle":
+		s.Polygon([]Point{{w / 2, 0}, {w, h}, {0, h}}, true, style)
+	case "polygon", "polyline":
+		s.Polygon(localPoints(obj), kind == "polygon", style)
+	case "line":
+		x1, y1, x2, y2 := num(obj, "x1", 0), num(obj, "y1", 0), num(obj, "x2", w), num(obj, "y2", h)
+		minX, minY := math.Min(x1, x2), math.Min(y1, y2)
+		s.Polygon([]Point{{x1 - minX, y1 - minY}, {x2 - minX, y2 - minY}}, false, Style{Stroke: style.Stroke, StrokeWidth: style.StrokeWidth})
+	default:
+		return false
+	}
+	return true
+}
+
+// isText reports whether an element type is drawn as text.
+func isText(kind string) bool {
+	return kind == "text" || kind == "i-text" || kind == "textbox"
+}
+
+// textFont loads a text element's uploaded font. Text without one, or whose
+// font cannot be loaded or may not be embedded, is drawn in Helvetica.
+func textFont(ctx context.Context, obj map[string]any, fonts FontLoader, res *Result) *Font {
+	src, _ := obj["fontUrl"].(string)
+	if src == "" {
+		src, _ = obj["fontAssetId"].(string)
+	}
+	if src == "" || fonts == nil {
+		return nil
+	}
+	font, err := fonts(ctx, src)
+	if err != nil || font == nil || !font.Embeddable() {
+		res.degrade(FeatureFont)
+		return nil
+	}
+	return font
+}
+
+func drawText(s Surface, obj map[string]any, width float64, color Color, font *Font) {
+	text, _ := obj["text"].(string)
+	size := num(obj, "fontSize", 40)
+	lineHeight := num(obj, "lineHeight", 1.16) * size
+	weight := fmt.Sprint(obj["fontWeight"])
+	bold := weight == "bold" || weight == "700" || weight == "800" || weight == "900"
+	align, _ := obj["textAlign"].(string)
+	run := TextRun{Size: size, Bold: bold, Color: color, Font: font}
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if obj["type"] == "textbox" && width > 0 {
+			lines = append(lines, wrapText(line, width, run.width)...)
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	for i, line := range lines {
+		x := 0.0
+		switch align {
+		case "center":
+			x = (width - run.width(line)) / 2
+		case "right":
+			x = width - run.width(line)
+		}
+		// Place the baseline roughly where browsers do for the first line.
+		y := float64(i)*lineHeight + size*0.89
+		run.Text = line
+		s.Text(x, y, run)
+	}
+}
+
+func drawImage(ctx context.Context, s Surface, obj map[string]any, w, h, opacity float64, images ImageLoader, res *Result) {
+	src, _ := obj["src"].(string)
+	if src == "" || images == nil {
+		res.degrade(FeatureImage)
+		return
+	}
+	img, err := images(ctx, src)
+	if err != nil || img == nil {
+		res.degrade(FeatureImage)
+		s.Rect(0, 0, w, h, 0, Style{Stroke: Color{0.6, 0.6, 0.6, 1}, StrokeWidth: 1})
+		return
+	}
+	if w == 0 || h == 0 {
+		b := img.Bounds()
+		w, h = float64(b.Dx()), float64(b.Dy())
+	}
+	if filters, ok := obj["filters"].([]any); ok && len(filters) > 0 {
+		img = applyFilters(img, filters, res)
+	}
+	s.Image(img, 0, 0, w, h, opacity)
+}
+
+// localPoints returns a polygon's points relative to its bounding box.
+func localPoints(obj map[string]any) []Point {
+	raw, _ := obj["points"].([]any)
+	points := make([]Point, 0, len(raw))
+	minX, minY := math.Inf(1), math.Inf(1)
+	for _, p := range raw {
+		m, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		pt := Point{num(m, "x", 0), num(m, "y", 0)}
+		minX, minY = math.Min(minX, pt.X), math.Min(minY, pt.Y)
+		points = append(points, pt)
+	}
+	for i := range points {
+		points[i].X -= minX
+		points[i].Y -= minY
+	}
+	return points
+}
+
+func childObjects(obj map[string]any) []map[string]any {
+	raw, ok := obj["objects"].([]any)
+	if !ok {
+		return nil
+	}
+	children := make([]map[string]any, 0, len(raw))
+	for _, c := range raw {
+		if m, ok := c.(map[string]any); ok {
+			children = append(children, m)
+		}
+	}
+	return children
+}
+
+// originOffset returns the fraction of the element's size its left/top
+// position refers to, from originX/originY.
+func originOffset(obj map[string]any) (float64, float64) {
+	frac := func(v any) float64 {
+		switch v {
+		case "center":
+			return 0.5
+		case "right", "bottom":
+			return 1
+		}
+		return 0
+	}
+	return frac(obj["originX"]), frac(obj["originY"])
+}
+
+func num(obj map[string]any, key string, def float64) float64 {
+	switch v := obj[key].(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,312 @@
+package render
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"sort"
+	"strings"
+)
+
+// SVG is a Surface that draws one page as an SVG document. Each element
+// carries its full transform, clip and blend mode, so Save and Restore need
+// no nesting in the output. Uploaded fonts are embedded as @font-face rules
+// holding only the glyphs drawn.
+type SVG struct {
+	w, h   float64
+	body   bytes.Buffer
+	defs   bytes.Buffer
+	state  svgState
+	stack  []svgState
+	nextID int
+	fonts  []*svgFont
+}
+
+type svgState struct {
+	m    Matrix
+	clip string // ID of the clip path in effect
+	mode string // blend mode, "" for normal
+}
+
+// svgFont is an uploaded font drawn on the page
+type svgFont struct {
+	font   *Font
+	family string
+	used   map[uint16]bool
+}
+
+var _ Surface = (*SVG)(nil)
+
+// NewSVG returns an empty page of the given size in canvas pixels.
+func NewSVG(w, h float64) *SVG {
+	return &SVG{w: w, h: h, state: svgState{m: Matrix{1, 0, 0, 1, 0, 0}}}
+}
+
+// Bytes serializes the page. Call it once, after drawing.
+func (s *SVG) Bytes() []byte {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%s" height="%s" viewBox="0 0 %s %s">`+"\n",
+		f(s.w), f(s.h), f(s.w), f(s.h))
+	if len(s.fonts) > 0 || s.defs.Len() > 0 {
+		out.WriteString("<defs>\n")
+		if len(s.fonts) > 0 {
+			out.WriteString("<style>\n")
+			for _, sf := range s.fonts {
+				glyphs := make([]uint16, 0, len(sf.used))
+				for g := range sf.used {
+					glyphs = append(glyphs, g)
+				}
+				sort.Slice(glyphs, func(i, j int) bool { return glyphs[i] < glyphs[j] })
+				program, _ := sf.font.Subset(glyphs)
+				fmt.Fprintf(&out, "@font-face { font-family: %q; src: url(data:font/ttf;base64,%s) format(\"truetype\"); }\n",
+					sf.family, base64.StdEncoding.EncodeToString(program))
+			}
+			out.WriteString("</style>\n")
+		}
+		out.Write(s.defs.Bytes())
+		out.WriteString("</defs>\n")
+	}
+	out.Write(s.body.Bytes())
+	out.WriteString("</svg>\n")
+	return out.Bytes()
+}
+
+func (s *SVG) Save() { s.stack = append(s.stack, s.state) }
+
+func (s *SVG) Restore() {
+	if n := len(s.stack); n > 0 {
+		s.state = s.stack[n-1]
+		s.stack = s.stack[:n-1]
+	}
+}
+
+func (s *SVG) Transform(m Matrix) { s.state.m = s.state.m.Mul(m) }
+
+func (s *SVG) Rect(x, y, w, h, radius float64, st Style) {
+	paint := s.paint(st)
+	if paint == "" {
+		return
+	}
+	radius = math.Min(radius, math.Min(w, h)/2)
+	attrs := fmt.Sprintf(` x="%s" y="%s" width="%s" height="%s"`, f(x), f(y), f(w), f(h))
+	if radius > 0 {
+		attrs += fmt.Sprintf(` rx="%s"`, f(radius))
+	}
+	s.element("rect", attrs+paint, "")
+}
+
+func (s *SVG) Ellipse(cx, cy, rx, ry float64, st Style) {
+	if paint := s.paint(st); paint != "" {
+		s.element("ellipse", fmt.Sprintf(` cx="%s" cy="%s" rx="%s" ry="%s"`, f(cx), f(cy), f(rx), f(ry))+paint, "")
+	}
+}
+
+func (s *SVG) Polygon(points []Point, closed bool, st Style) {
+	if len(points) < 2 {
+		return
+	}
+	tag := "polygon"
+	if !closed {
+		tag = "polyline"
+		st.Fill, st.Gradient = Color{}, nil
+	}
+	if paint := s.paint(st); paint != "" {
+		s.element(tag, fmt.Sprintf(` points="%s"`, svgPoints(points))+paint, "")
+	}
+}
+
+func (s *SVG) Clip(points []Point) {
+	id := s.id("clip")
+	fmt.Fprintf(&s.defs, `<clipPath id="%s" clipPathUnits="userSpaceOnUse"`, id)
+	if s.state.clip != "" {
+		// A clip inside a clip keeps their intersection.
+		fmt.Fprintf(&s.defs, ` clip-path="url(#%s)"`, s.state.clip)
+	}
+	s.defs.WriteString(">")
+	// Nothing is inside a degenerate clip, which an empty path gives.
+	if len(points) >= 3 {
+		page := make([]Point, len(points))
+		for i, pt := range points {
+			page[i].X, page[i].Y = s.state.m.apply(pt.X, pt.Y)
+		}
+		fmt.Fprintf(&s.defs, `<polygon points="%s"/>`, svgPoints(page))
+	}
+	s.defs.WriteString("</clipPath>\n")
+	s.state.clip = id
+}
+
+func (s *SVG) SetBlendMode(mode string) bool {
+	if _, ok := pdfBlendModes[mode]; !ok {
+		return false
+	}
+	s.state.mode = mode
+	return true
+}
+
+// BlurBackdrop is not supported: SVG has no way to filter what is below an
+// element.
+func (s *SVG) BlurBackdrop(points []Point, radius float64) bool { return false }
+
+func (s *SVG) Text(x, y float64, t TextRun) {
+	if t.Text == "" || !t.Color.Visible() {
+		return
+	}
+	family, weight := "Helvetica, Arial, sans-serif", ""
+	if t.Font != nil {
+		family = s.font(t.Font, t.Text) + ", " + family
+	} else if t.Bold {
+		weight = ` font-weight="bold"`
+	}
+	var text strings.Builder
+	for _, r := range t.Text {
+		if r = textRune(r); r >= 0 {
+			text.WriteRune(r)
+		}
+	}
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(text.String()))
+	attrs := fmt.Sprintf(` x="%s" y="%s" font-family="%s" font-size="%s"%s`, f(x), f(y), family, f(t.Size), weight) +
+		fillAttrs(t.Color) + ` xml:space="preserve"`
+	s.element("text", attrs, escaped.String())
+}
+
+func (s *SVG) Image(img image.Image, x, y, w, h, alpha float64) {
+	if alpha <= 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return
+	}
+	attrs := fmt.Sprintf(` x="%s" y="%s" width="%s" height="%s" preserveAspectRatio="none" xlink:href="data:image/png;base64,%s"`,
+		f(x), f(y), f(w), f(h), base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if alpha < 1 {
+		attrs += fmt.Sprintf(` opacity="%s"`, f(alpha))
+	}
+	s.element("image", attrs, "")
+}
+
+// element writes a drawing element in the current transform, wrapped in a
+// group when a clip or blend mode is in effect.
+func (s *SVG) element(tag, attrs, content string) {
+	group := s.state.clip != "" || s.state.mode != ""
+	if group {
+		s.body.WriteString("<g")
+		if s.state.clip != "" {
+			fmt.Fprintf(&s.body, ` clip-path="url(#%s)"`, s.state.clip)
+		}
+		if s.state.mode != "" {
+			fmt.Fprintf(&s.body, ` style="mix-blend-mode: %s"`, s.state.mode)
+		}
+		s.body.WriteString(">")
+	}
+	fmt.Fprintf(&s.body, "<%s", tag)
+	if m := s.state.m; m != (Matrix{1, 0, 0, 1, 0, 0}) {
+		fmt.Fprintf(&s.body, ` transform="matrix(%s %s %s %s %s %s)"`, f(m[0]), f(m[1]), f(m[2]), f(m[3]), f(m[4]), f(m[5]))
+	}
+	s.body.WriteString(attrs)
+	if content == "" {
+		s.body.WriteString("/>")
+	} else {
+		fmt.Fprintf(&s.body, ">%s</%s>", content, tag)
+	}
+	if group {
+		s.body.WriteString("</g>")
+	}
+	s.body.WriteByte('\n')
+}
+
+// paint returns the fill and stroke attributes of a shape, or "" when it
+// paints nothing.
+func (s *SVG) paint(st Style) string {
+	stroke := st.Stroke.Visible() && st.StrokeWidth > 0
+	var b strings.Builder
+	switch {
+	case st.Gradient != nil:
+		fmt.Fprintf(&b, ` fill="url(#%s)"`, s.gradient(st.Gradient))
+	case st.Fill.Visible():
+		b.WriteString(fillAttrs(st.Fill))
+	case !stroke:
+		return ""
+	default:
+		b.WriteString(` fill="none"`)
+	}
+	if stroke {
+		fmt.Fprintf(&b, ` stroke="%s" stroke-width="%s"`, svgColor(st.Stroke), f(st.StrokeWidth))
+		if st.Stroke.A < 1 {
+			fmt.Fprintf(&b, ` stroke-opacity="%s"`, f(st.Stroke.A))
+		}
+	}
+	return b.String()
+}
+
+func fillAttrs(c Color) string {
+	attrs := fmt.Sprintf(` fill="%s"`, svgColor(c))
+	if c.A < 1 {
+		attrs += fmt.Sprintf(` fill-opacity="%s"`, f(c.A))
+	}
+	return attrs
+}
+
+// gradient defines a gradient in the user space of the element using it and
+// returns its ID.
+func (s *SVG) gradient(g *Gradient) string {
+	id := s.id("grad")
+	tag := "linearGradient"
+	if g.Radial {
+		fmt.Fprintf(&s.defs, `<radialGradient id="%s" gradientUnits="userSpaceOnUse" fx="%s" fy="%s" fr="%s" cx="%s" cy="%s" r="%s">`,
+			id, f(g.X1), f(g.Y1), f(g.R1), f(g.X2), f(g.Y2), f(g.R2))
+		tag = "radialGradient"
+	} else {
+		fmt.Fprintf(&s.defs, `<linearGradient id="%s" gradientUnits="userSpaceOnUse" x1="%s" y1="%s" x2="%s" y2="%s">`,
+			id, f(g.X1), f(g.Y1), f(g.X2), f(g.Y2))
+	}
+	for _, stop := range g.Stops {
+		fmt.Fprintf(&s.defs, `<stop offset="%s" stop-color="%s" stop-opacity="%s"/>`, f(stop.Offset), svgColor(stop.Color), f(stop.Color.A))
+	}
+	fmt.Fprintf(&s.defs, "</%s>\n", tag)
+	return id
+}
+
+// font returns the family name an uploaded font is embedded under, adding
+// it on first use, and records the glyphs text draws with it.
+func (s *SVG) font(font *Font, text string) string {
+	var sf *svgFont
+	for _, existing := range s.fonts {
+		if existing.font == font {
+			sf = existing
+		}
+	}
+	if sf == nil {
+		sf = &svgFont{font: font, family: fmt.Sprintf("embedded-font-%d", len(s.fonts)+1), used: map[uint16]bool{}}
+		s.fonts = append(s.fonts, sf)
+	}
+	for _, r := range text {
+		if r = textRune(r); r >= 0 {
+			sf.used[font.glyphIndex(r)] = true
+		}
+	}
+	return sf.family
+}
+
+func (s *SVG) id(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%d", prefix, s.nextID)
+}
+
+func svgColor(c Color) string {
+	b := func(v float64) int { return int(math.Round(clamp(v) * 255)) }
+	return fmt.Sprintf("#%02x%02x%02x", b(c.R), b(c.G), b(c.B))
+}
+
+func svgPoints(points []Point) string {
+	parts := make([]string, len(points))
+	for i, pt := range points {
+		parts[i] = f(pt.X) + "," + f(pt.Y)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,82 @@
+package render
+
+import "strings"
+
+// helveticaWidths holds the advance widths of printable ASCII in Helvetica,
+// in thousandths of the font size (from the standard AFM metrics).
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // space-/
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556, // 0-?
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778, // @-O
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556, // P-_
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556, // `-o
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, // p-~
+}
+
+// TextWidth estimates the rendered width of s. Text without an uploaded
+// font is drawn in the standard Helvetica faces, so this matches what is
+// drawn; bold is approximated.
+func TextWidth(s string, size float64, bold bool) float64 {
+	var units int
+	for _, r := range s {
+		if r >= 32 && r < 127 {
+			units += helveticaWidths[r-32]
+		} else {
+			units += 556
+		}
+	}
+	w := float64(units) * size / 1000
+	if bold {
+		w *= 1.06
+	}
+	return w
+}
+
+// width returns the advance width of s drawn as the run.
+func (t TextRun) width(s string) float64 {
+	if t.Font != nil {
+		return t.Font.Width(s, t.Size)
+	}
+	return TextWidth(s, t.Size, t.Bold)
+}
+
+// WrapText breaks s into lines no wider than maxWidth, splitting on spaces
+// and hard-breaking words that do not fit on a line of their own.
+func WrapText(s string, size float64, bold bool, maxWidth float64) []string {
+	return wrapText(s, maxWidth, func(s string) float64 { return TextWidth(s, size, bold) })
+}
+
+// wrapText is WrapText for text measured by width.
+func wrapText(s string, maxWidth float64, width func(string) float64) []string {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return []string{""}
+	}
+
+	var lines []string
+	line := ""
+	for _, word := range words {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if width(candidate) <= maxWidth {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		for width(word) > maxWidth && len([]rune(word)) > 1 {
+			runes := []rune(word)
+			n := len(runes) - 1
+			for n > 1 && width(string(runes[:n])) > maxWidth {
+				n--
+			}
+			lines = append(lines, string(runes[:n]))
+			word = string(runes[n:])
+		}
+		line = word
+	}
+	return append(lines, line)
+}
@@ -0,0 +1,272 @@
+package render
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Warp places a flat design on a surface in a photo, for mockups: a
+// perspective quad for flat surfaces such as screens and billboards, or a
+// mesh that bends the design over curved ones such as fabric. Points are
+// pixels of the photo.
+type Warp struct {
+	// Corners are where the design's top-left, top-right, bottom-right and
+	// bottom-left corners land.
+	Corners []Point
+	// Mesh is a grid of (Columns+1)×(Rows+1) points, row by row from the
+	// top-left, over which the design is stretched cell by cell. It is used
+	// when Corners is empty.
+	Columns, Rows int
+	Mesh          []Point
+}
+
+const (
+	// MaxMeshCells bounds the columns and rows of a warp mesh
+	MaxMeshCells = 32
+	// warpSamples is the number of samples per pixel along each axis
+	warpSamples = 3
+	// warpBins is the number of lookup bins along each axis of a mesh
+	warpBins = 64
+)
+
+// Validate reports whether the warp describes a usable surface.
+func (w Warp) Validate() error {
+	for _, p := range append(append([]Point{}, w.Corners...), w.Mesh...) {
+		if math.IsNaN(p.X) || math.IsNaN(p.Y) || math.IsInf(p.X, 0) || math.IsInf(p.Y, 0) {
+			return errors.New("points must be finite")
+		}
+	}
+	if len(w.Corners) > 0 {
+		if len(w.Corners) != 4 {
+			return errors.New("a perspective warp needs four corners")
+		}
+		// The quad must be convex, with its corners in order.
+		sign := 0.0
+		for i := range w.Corners {
+			a, b, c := w.Corners[i], w.Corners[(i+1)%4], w.Corners[(i+2)%4]
+			cross := (b.X-a.X)*(c.Y-b.Y) - (b.Y-a.Y)*(c.X-b.X)
+			if math.Abs(cross) < 1e-6 || sign*cross < 0 {
+				return errors.New("corners must form a convex quadrilateral")
+			}
+			sign = cross
+		}
+		return nil
+	}
+	if w.Columns < 1 || w.Rows < 1 || w.Columns > MaxMeshCells || w.Rows > MaxMeshCells {
+		return errors.New("a mesh needs between 1 and 32 columns and rows")
+	}
+	if len(w.Mesh) != (w.Columns+1)*(w.Rows+1) {
+		return errors.New("a mesh needs (columns+1)×(rows+1) points")
+	}
+	return nil
+}
+
+// Bounds returns the box the warp covers.
+func (w Warp) Bounds() Box {
+	pts := w.Corners
+	if len(pts) == 0 {
+		pts = w.Mesh
+	}
+	if len(pts) == 0 {
+		return Box{}
+	}
+	minX, minY, maxX, maxY := pointBounds(pts)
+	return Box{X: minX, Y: minY, W: maxX - minX, H: maxY - minY}
+}
+
+// Warp draws src onto the canvas through the warp, in device pixels,
+// antialiasing its edges. It is composited in the current blend mode, so a
+// multiply blend lets the folds and shading of the photo show through.
+func (c *Canvas) Warp(src image.Image, w Warp, alpha float64) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+	sb := src.Bounds()
+	if alpha <= 0 || sb.Empty() {
+		return nil
+	}
+	// Sample from premultiplied pixels so transparent areas do not bleed.
+	design := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(design, design.Bounds(), src, sb.Min, draw.Src)
+
+	var lookup func(x, y float64) (u, v float64, ok bool)
+	if len(w.Corners) > 0 {
+		lookup = perspectiveLookup(w.Corners)
+	} else {
+		lookup = meshLookup(w)
+	}
+
+	box := w.Bounds()
+	bounds := c.img.Bounds()
+	x0, y0 := max(int(math.Floor(box.X)), bounds.Min.X), max(int(math.Floor(box.Y)), bounds.Min.Y)
+	x1, y1 := min(int(math.Ceil(box.X+box.W)), bounds.Max.X), min(int(math.Ceil(box.Y+box.H)), bounds.Max.Y)
+	const samples = warpSamples * warpSamples
+	for py := y0; py < y1; py++ {
+		for px := x0; px < x1; px++ {
+			var r, g, b, a float64
+			inside := 0
+			for sy := 0; sy < warpSamples; sy++ {
+				for sx := 0; sx < warpSamples; sx++ {
+					u, v, ok := lookup(float64(px)+(float64(sx)+0.5)/warpSamples, float64(py)+(float64(sy)+0.5)/warpSamples)
+					if !ok {
+						continue
+					}
+					sr, sg, sb, sa := sampleBilinear(design, u, v)
+					r, g, b, a = r+sr, g+sg, b+sb, a+sa
+					inside++
+				}
+			}
+			if inside == 0 || a <= 0 {
+				continue
+			}
+			c.blend(px, py, Color{R: r / a, G: g / a, B: b / a, A: a / float64(inside) * alpha}, float64(inside)/samples)
+		}
+	}
+	return nil
+}
+
+// perspectiveLookup maps points of the quad back to the unit square of the
+// design through the inverse of the square-to-quad projection (Heckbert,
+// Fundamentals of Texture Mapping, 2.2.3).
+func perspectiveLookup(q []Point) func(x, y float64) (float64, float64, bool) {
+	sx := q[0].X - q[1].X + q[2].X - q[3].X
+	sy := q[0].Y - q[1].Y + q[2].Y - q[3].Y
+	var g, h float64
+	if math.Abs(sx) > 1e-9 || math.Abs(sy) > 1e-9 {
+		dx1, dx2 := q[1].X-q[2].X, q[3].X-q[2].X
+		dy1, dy2 := q[1].Y-q[2].Y, q[3].Y-q[2].Y
+		den := dx1*dy2 - dx2*dy1
+		g = (sx*dy2 - dx2*sy) / den
+		h = (dx1*sy - sx*dy1) / den
+	}
+	a, b, c := q[1].X-q[0].X+g*q[1].X, q[3].X-q[0].X+h*q[3].X, q[0].X
+	d, e, f := q[1].Y-q[0].Y+g*q[1].Y, q[3].Y-q[0].Y+h*q[3].Y, q[0].Y
+
+	// Adjugate of [a b c; d e f; g h 1]; the determinant cancels out.
+	A, B, C := e-f*h, c*h-b, b*f-c*e
+	D, E, F := f*g-d, a-c*g, c*d-a*f
+	G, H, I := d*h-e*g, b*g-a*h, a*e-b*d
+	return func(x, y float64) (float64, float64, bool) {
+		w := G*x + H*y + I
+		if w == 0 {
+			return 0, 0, false
+		}
+		u, v := (A*x+B*y+C)/w, (D*x+E*y+F)/w
+		return u, v, u >= 0 && u <= 1 && v >= 0 && v <= 1
+	}
+}
+
+// warpTriangle is one half of a mesh cell with the design coordinates of
+// its corners
+type warpTriangle struct {
+	p, uv [3]Point
+	inv   float64 // reciprocal of twice the signed area
+
+	minX, minY, maxX, maxY float64
+}
+
+func newWarpTriangle(p, uv [3]Point) (warpTriangle, bool) {
+	area := (p[1].X-p[0].X)*(p[2].Y-p[0].Y) - (p[2].X-p[0].X)*(p[1].Y-p[0].Y)
+	if math.Abs(area) < 1e-9 {
+		return warpTriangle{}, false
+	}
+	t := warpTriangle{p: p, uv: uv, inv: 1 / area}
+	t.minX, t.minY, t.maxX, t.maxY = pointBounds(p[:])
+	return t, true
+}
+
+// at returns the design coordinates of a point inside the triangle.
+func (t *warpTriangle) at(x, y float64) (float64, float64, bool) {
+	if x < t.minX || x > t.maxX || y < t.minY || y > t.maxY {
+		return 0, 0, false
+	}
+	p := t.p
+	l1 := ((p[1].X-x)*(p[2].Y-y) - (p[2].X-x)*(p[1].Y-y)) * t.inv
+	l2 := ((p[2].X-x)*(p[0].Y-y) - (p[0].X-x)*(p[2].Y-y)) * t.inv
+	l3 := 1 - l1 - l2
+	const eps = -1e-9
+	if l1 < eps || l2 < eps || l3 < eps {
+		return 0, 0, false
+	}
+	return l1*t.uv[0].X + l2*t.uv[1].X + l3*t.uv[2].X, l1*t.uv[0].Y + l2*t.uv[1].Y + l3*t.uv[2].Y, true
+}
+
+// meshLookup maps points of a mesh back to the design. Each cell is split
+// into two triangles mapped affinely; the triangles are binned on a grid
+// so a lookup only tests the few near the point.
+func meshLookup(w Warp) func(x, y float64) (float64, float64, bool) {
+	cols := w.Columns + 1
+	var tris []warpTriangle
+	for j := 0; j < w.Rows; j++ {
+		for i := 0; i < w.Columns; i++ {
+			p00, p10 := w.Mesh[j*cols+i], w.Mesh[j*cols+i+1]
+			p01, p11 := w.Mesh[(j+1)*cols+i], w.Mesh[(j+1)*cols+i+1]
+			u0, u1 := float64(i)/float64(w.Columns), float64(i+1)/float64(w.Columns)
+			v0, v1 := float64(j)/float64(w.Rows), float64(j+1)/float64(w.Rows)
+			if t, ok := newWarpTriangle([3]Point{p00, p10, p11}, [3]Point{{u0, v0}, {u1, v0}, {u1, v1}}); ok {
+				tris = append(tris, t)
+			}
+			if t, ok := newWarpTriangle([3]Point{p00, p11, p01}, [3]Point{{u0, v0}, {u1, v1}, {u0, v1}}); ok {
+				tris = append(tris, t)
+			}
+		}
+	}
+
+	box := w.Bounds()
+	binW, binH := math.Max(box.W/warpBins, 1e-9), math.Max(box.H/warpBins, 1e-9)
+	bin := func(x, y float64) (int, int) {
+		return min(max(int((x-box.X)/binW), 0), warpBins-1), min(max(int((y-box.Y)/binH), 0), warpBins-1)
+	}
+	bins := make([][]int, warpBins*warpBins)
+	for k, t := range tris {
+		bx0, by0 := bin(t.minX, t.minY)
+		bx1, by1 := bin(t.maxX, t.maxY)
+		for by := by0; by <= by1; by++ {
+			for bx := bx0; bx <= bx1; bx++ {
+				bins[by*warpBins+bx] = append(bins[by*warpBins+bx], k)
+			}
+		}
+	}
+
+	return func(x, y float64) (float64, float64, bool) {
+		if x < box.X || x > box.X+box.W || y < box.Y || y > box.Y+box.H {
+			return 0, 0, false
+		}
+		bx, by := bin(x, y)
+		for _, k := range bins[by*warpBins+bx] {
+			if u, v, ok := tris[k].at(x, y); ok {
+				return u, v, true
+			}
+		}
+		return 0, 0, false
+	}
+}
+
+// sampleBilinear returns the premultiplied color of img at design
+// coordinates u, v in [0, 1], with components in [0, 1].
+func sampleBilinear(img *image.RGBA, u, v float64) (r, g, b, a float64) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	fx := math.Min(math.Max(u*float64(w)-0.5, 0), float64(w-1))
+	fy := math.Min(math.Max(v*float64(h)-0.5, 0), float64(h-1))
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := min(x0+1, w-1), min(y0+1, h-1)
+	tx, ty := fx-float64(x0), fy-float64(y0)
+	for _, s := range [4]struct {
+		x, y   int
+		weight float64
+	}{
+		{x0, y0, (1 - tx) * (1 - ty)},
+		{x1, y0, tx * (1 - ty)},
+		{x0, y1, (1 - tx) * ty},
+		{x1, y1, tx * ty},
+	} {
+		i := img.PixOffset(s.x, s.y)
+		r += float64(img.Pix[i]) * s.weight
+		g += float64(img.Pix[i+1]) * s.weight
+		b += float64(img.Pix[i+2]) * s.weight
+		a += float64(img.Pix[i+3]) * s.weight
+	}
+	return r / 255, g / 255, b / 255, a / 255
+}
@@ -0,0 +1,164 @@
+// Package reqctx carries per-request metadata (request ID, user, org and
+// client version) through service calls so that log lines and audit entries
+// produced while handling a single operation can be correlated end to end.
+package reqctx
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+)
+
+// Headers clients may set to attach metadata to a request.
+const (
+	HeaderRequestID     = "X-Request-ID"
+	HeaderOrgID         = "X-Org-ID"
+	HeaderClientVersion = "X-Client-Version"
+)
+
+// Info is the metadata propagated alongside a request.
+type Info struct {
+	RequestID     string `json:"requestId"`
+	UserID        string `json:"userId,omitempty"`
+	OrgID         string `json:"orgId,omitempty"`
+	ClientVersion string `json:"clientVersion,omitempty"`
+	IP            string `json:"ip,omitempty"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	Country       string `json:"country,omitempty"` // ISO 3166 code resolved by the edge
+	// ImpersonatorID is the staff admin acting as UserID, if any
+	ImpersonatorID string `json:"impersonatorId,omitempty"`
+	// Service is the internal service calling with a machine token, if any
+	Service string `json:"service,omitempty"`
+}
+
+type ctxKey struct{}
+
+// With returns a copy of ctx carrying info.
+func With(ctx context.Context, info Info) context.Context {
+	return context.WithValue(ctx, ctxKey{}, info)
+}
+
+// From returns the request metadata stored in ctx. If none was attached
+// (e.g. background jobs), it is derived from the current Encore request.
+func From(ctx context.Context) Info {
+	if info, ok := ctx.Value(ctxKey{}).(Info); ok {
+		if info.UserID == "" {
+			info.UserID = auth.UserID()
+		}
+		return info
+	}
+	return FromRequest(encore.CurrentRequest())
+}
+
+// FromRequest builds request metadata from the incoming request headers,
+// generating a request ID when the client did not send one.
+func FromRequest(req *encore.Request) Info {
+	info := Info{UserID: auth.UserID()}
+	if req != nil && req.Headers != nil {
+		info.RequestID = sanitize(req.Headers.Get(HeaderRequestID))
+		info.OrgID = sanitize(req.Headers.Get(HeaderOrgID))
+		info.ClientVersion = sanitize(req.Headers.Get(HeaderClientVersion))
+		info.IP = clientIP(req.Headers)
+		info.UserAgent = sanitize(req.Headers.Get("User-Agent"))
+		info.Country = clientCountry(req.Headers)
+	}
+	if info.RequestID == "" {
+		info.RequestID = uuid.New().String()
+	}
+	return info
+}
+
+// Fields returns the metadata as key/value pairs suitable for rlog.
+func (i Info) Fields() []any {
+	fields := []any{"request_id", i.RequestID}
+	if i.UserID != "" {
+		fields = append(fields, "user_id", i.UserID)
+	}
+	if i.OrgID != "" {
+		fields = append(fields, "org_id", i.OrgID)
+	}
+	if i.ClientVersion != "" {
+		fields = append(fields, "client_version", i.ClientVersion)
+	}
+	if i.ImpersonatorID != "" {
+		fields = append(fields, "impersonator_id", i.ImpersonatorID)
+	}
+	if i.Service != "" {
+		fields = append(fields, "service", i.Service)
+	}
+	return fields
+}
+
+// AuditMetadata returns the metadata in the shape stored on audit entries.
+func (i Info) AuditMetadata() map[string]string {
+	meta := map[string]string{"requestId": i.RequestID}
+	if i.OrgID != "" {
+		meta["orgId"] = i.OrgID
+	}
+	if i.ClientVersion != "" {
+		meta["clientVersion"] = i.ClientVersion
+	}
+	if i.IP != "" {
+		meta["ip"] = i.IP
+	}
+	if i.Country != "" {
+		meta["country"] = i.Country
+	}
+	if i.ImpersonatorID != "" {
+		meta["impersonatorId"] = i.ImpersonatorID
+	}
+	if i.Service != "" {
+		meta["service"] = i.Service
+	}
+	return meta
+}
+
+// Logger returns an rlog logger annotated with the request metadata in ctx.
+func Logger(ctx context.Context) rlog.Ctx {
+	return rlog.With(From(ctx).Fields()...)
+}
+
+// clientIP returns the originating client address as reported by the
+// gateway. Clients can send X-Forwarded-For themselves, so only its last
+// hop, the one the edge appended, is trusted.
+func clientIP(h http.Header) string {
+	if fwd := h.Values("X-Forwarded-For"); len(fwd) > 0 {
+		hops := strings.Split(fwd[len(fwd)-1], ",")
+		return sanitize(hops[len(hops)-1])
+	}
+	return sanitize(h.Get("X-Real-IP"))
+}
+
+// clientCountry returns the client's country as geolocated by the edge
+// proxy, or "" when it is unknown.
+func clientCountry(h http.Header) string {
+	c := h.Get("CF-IPCountry")
+	if c == "" {
+		c = h.Get("X-Country-Code")
+	}
+	c = strings.ToUpper(strings.TrimSpace(c))
+	// XX and T1 are Cloudflare's unknown and Tor markers
+	if len(c) != 2 || c == "XX" || c == "T1" {
+		return ""
+	}
+	return c
+}
+
+// sanitize bounds client-supplied header values before they end up in logs.
+func sanitize(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) > 128 {
+		v = v[:128]
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, v)
+}
@@ -0,0 +1,130 @@
+package settings
+
+import (
+	"context"
+	"fmt"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/reqctx"
+)
+
+// Organizations under records-keeping rules can have every project
+// snapshotted on a schedule. The export service renders the snapshots and
+// stores them under a retention lock; these settings only say when, in
+// which formats and for how long.
+
+// Snapshot frequencies
+const (
+	SnapshotWeekly    = "weekly"
+	SnapshotMonthly   = "monthly"
+	SnapshotQuarterly = "quarterly"
+)
+
+// Snapshot formats
+const (
+	// SnapshotFormatPDF is a review PDF of every page
+	SnapshotFormatPDF = "pdf"
+	// SnapshotFormatArchive is a project archive, as ExportProject returns
+	SnapshotFormatArchive = "archive"
+)
+
+const (
+	defaultSnapshotRetentionDays = 7 * 365
+	minSnapshotRetentionDays     = 1
+	maxSnapshotRetentionDays     = 25 * 365
+)
+
+// Compliance holds an organization's records-keeping settings
+type Compliance struct {
+	Snapshots SnapshotSchedule `json:"snapshots"`
+}
+
+// SnapshotSchedule configures scheduled project snapshots
+type SnapshotSchedule struct {
+	Enabled bool `json:"enabled"`
+	// Frequency is weekly, monthly (default) or quarterly
+	Frequency string `json:"frequency"`
+	// Formats are the files kept per project: pdf and/or archive
+	Formats []string `json:"formats"`
+	// RetentionDays is how long each snapshot is locked against deletion.
+	// Changing it only affects snapshots taken afterwards.
+	RetentionDays int `json:"retentionDays"`
+}
+
+func validateSnapshots(s *SnapshotSchedule) error {
+	switch s.Frequency {
+	case SnapshotWeekly, SnapshotMonthly, SnapshotQuarterly:
+	default:
+		return fmt.Errorf("compliance.snapshots.frequency must be weekly, monthly or quarterly")
+	}
+	if len(s.Formats) == 0 {
+		return fmt.Errorf("compliance.snapshots.formats must list at least one format")
+	}
+	seen := map[string]bool{}
+	for _, f := range s.Formats {
+		if f != SnapshotFormatPDF && f != SnapshotFormatArchive {
+			return fmt.Errorf("compliance.snapshots.formats must be pdf or archive")
+		}
+		if seen[f] {
+			return fmt.Errorf("compliance.snapshots.formats lists %s twice", f)
+		}
+		seen[f] = true
+	}
+	if d := s.RetentionDays; d < minSnapshotRetentionDays || d > maxSnapshotRetentionDays {
+		return fmt.Errorf("compliance.snapshots.retentionDays must be between %d and %d", minSnapshotRetentionDays, maxSnapshotRetentionDays)
+	}
+	return nil
+}
+
+// OrgSnapshotSchedule is an organization's enabled snapshot schedule
+type OrgSnapshotSchedule struct {
+	OrgID    string           `json:"orgId"`
+	Schedule SnapshotSchedule `json:"schedule"`
+}
+
+// SnapshotSchedulesResponse represents the snapshot schedules response
+type SnapshotSchedulesResponse struct {
+	Schedules []OrgSnapshotSchedule `json:"schedules"`
+}
+
+// SnapshotSchedules lists the organizations that have scheduled snapshots
+// enabled, for the export service's snapshot job.
+//
+//encore:api private
+func SnapshotSchedules(ctx context.Context) (*SnapshotSchedulesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT org_id FROM org_settings
+		WHERE (data->'compliance'->'snapshots'->>'enabled')::boolean
+	`)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list snapshot schedules", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list snapshot schedules",
+		}
+	}
+	var orgIDs []string
+	for rows.Next() {
+		var orgID string
+		if err := rows.Scan(&orgID); err == nil {
+			orgIDs = append(orgIDs, orgID)
+		}
+	}
+	rows.Close()
+
+	resp := &SnapshotSchedulesResponse{Schedules: []OrgSnapshotSchedule{}}
+	for _, orgID := range orgIDs {
+		// Read through loadOrg so old documents are upgraded and invalid
+		// ones fall back to the defaults, which are disabled.
+		org, err := loadOrg(ctx, db.QueryRow(ctx, `SELECT schema_version, data, updated_at FROM org_settings WHERE org_id = $1`, orgID))
+		if err != nil {
+			reqctx.Logger(ctx).Error("failed to load org settings", "org_id", orgID, "error", err)
+			continue
+		}
+		if org.Compliance.Snapshots.Enabled {
+			resp.Schedules = append(resp.Schedules, OrgSnapshotSchedule{OrgID: orgID, Schedule: org.Compliance.Snapshots})
+		}
+	}
+	return resp, nil
+}
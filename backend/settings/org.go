@@ -0,0 +1,352 @@
+package settings
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Organizations keep defaults that every project created in them starts
+// with. They are stored like user settings: a versioned JSONB document in
+// org_settings, upgraded on read.
+
+// OrgSchemaVersion is the version of the OrgSettings document written today
+const OrgSchemaVersion = 1
+
+// Color profiles
+const (
+	ColorProfileSRGB      = "srgb"
+	ColorProfileDisplayP3 = "display-p3"
+	ColorProfileCMYK      = "cmyk"
+)
+
+// OrgSettings are an organization's settings
+type OrgSettings struct {
+	Projects   ProjectDefaults `json:"projects"`
+	Branding   Branding        `json:"branding"`
+	Compliance Compliance      `json:"compliance"`
+}
+
+// Branding is the white-label look of the organization's client-facing
+// pages, such as its client portal
+type Branding struct {
+	// DisplayName is shown instead of the organization's name
+	DisplayName string `json:"displayName,omitempty"`
+	LogoURL     string `json:"logoUrl,omitempty"` // https
+	// PrimaryColor and AccentColor are #rrggbb
+	PrimaryColor string `json:"primaryColor,omitempty"`
+	AccentColor  string `json:"accentColor,omitempty"`
+	// HidePoweredBy removes the CanvasAI attribution
+	HidePoweredBy bool `json:"hidePoweredBy"`
+}
+
+// ProjectDefaults are applied to projects created in the organization
+type ProjectDefaults struct {
+	Canvas       CanvasSize `json:"canvas"`
+	ColorProfile string     `json:"colorProfile"`
+	// AutosaveInterval is in seconds; 0 leaves it to each user's settings
+	AutosaveInterval int           `json:"autosaveInterval"`
+	Sharing          ShareDefaults `json:"sharing"`
+	Naming           NamingRules   `json:"naming"`
+}
+
+// ShareDefaults control how new projects can be shared
+type ShareDefaults struct {
+	// Public makes new projects visible to anyone with their URL
+	Public bool `json:"public"`
+	// ShareLinks allows share links to be created for new projects
+	ShareLinks bool `json:"shareLinks"`
+}
+
+// NamingRules constrain the titles of new projects
+type NamingRules struct {
+	// TitlePattern is a regular expression titles must match; empty allows
+	// any title
+	TitlePattern string `json:"titlePattern,omitempty"`
+	// TitleHint explains the convention to people whose title is rejected
+	TitleHint string `json:"titleHint,omitempty"`
+	// Template names projects created without a title, e.g.
+	// "{client}-{campaign}-{date}". Placeholders are filled from the fields
+	// given at creation; {date}, {year} and {month} are filled in
+	// automatically.
+	Template string `json:"template,omitempty"`
+}
+
+// OrgSettingsResponse is an organization's settings with their schema version
+type OrgSettingsResponse struct {
+	OrgSettings
+	SchemaVersion int       `json:"schemaVersion"`
+	UpdatedAt     time.Time `json:"updatedAt,omitempty"`
+}
+
+// UpdateOrgSettingsRequest changes the fields that are set and keeps the rest
+type UpdateOrgSettingsRequest struct {
+	Projects *ProjectDefaultsPatch `json:"projects,omitempty"`
+	// Branding replaces the branding as a whole
+	Branding *Branding `json:"branding,omitempty"`
+	// Compliance replaces the compliance settings as a whole
+	Compliance *Compliance `json:"compliance,omitempty"`
+}
+
+// ProjectDefaultsPatch changes the project defaults that are set
+type ProjectDefaultsPatch struct {
+	Canvas           *CanvasSize    `json:"canvas,omitempty"`
+	ColorProfile     *string        `json:"colorProfile,omitempty"`
+	AutosaveInterval *int           `json:"autosaveInterval,omitempty"`
+	Sharing          *ShareDefaults `json:"sharing,omitempty"`
+	Naming           *NamingRules   `json:"naming,omitempty"`
+}
+
+// OrgDefaults are the settings of an organization that has not changed
+// anything
+var OrgDefaults = OrgSettings{
+	Projects: ProjectDefaults{
+		Canvas:       Defaults.DefaultCanvas,
+		ColorProfile: ColorProfileSRGB,
+		Sharing:      ShareDefaults{Public: false, ShareLinks: true},
+	},
+	Compliance: Compliance{
+		Snapshots: SnapshotSchedule{
+			Frequency:     SnapshotMonthly,
+			Formats:       []string{SnapshotFormatPDF},
+			RetentionDays: defaultSnapshotRetentionDays,
+		},
+	},
+}
+
+// orgUpgrades[v] turns a version v document into a version v+1 document
+var orgUpgrades = map[int]func(doc map[string]any){}
+
+const maxTitlePattern = 200
+
+var templatePlaceholder = regexp.MustCompile(`\{[a-zA-Z][a-zA-Z0-9_]*\}`)
+
+var brandColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+//encore:api auth method=GET path=/orgs/:orgID/settings
+func GetOrgSettings(ctx context.Context, orgID string) (*OrgSettingsResponse, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member", "guest"); err != nil {
+		return nil, err
+	}
+
+	resp, err := loadOrg(ctx, db.QueryRow(ctx, `SELECT schema_version, data, updated_at FROM org_settings WHERE org_id = $1`, orgID))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load org settings", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch organization settings",
+		}
+	}
+	return resp, nil
+}
+
+//encore:api auth method=PATCH path=/orgs/:orgID/settings
+func UpdateOrgSettings(ctx context.Context, orgID string, req *UpdateOrgSettingsRequest) (*OrgSettingsResponse, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin"); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update organization settings",
+		}
+	}
+	defer tx.Rollback()
+
+	current, err := loadOrg(ctx, tx.QueryRow(ctx, `SELECT schema_version, data, updated_at FROM org_settings WHERE org_id = $1 FOR UPDATE`, orgID))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load org settings", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update organization settings",
+		}
+	}
+
+	s := current.OrgSettings
+	applyOrg(&s, req)
+	if err := validateOrg(&s); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: err.Error(),
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update organization settings",
+		}
+	}
+	resp := &OrgSettingsResponse{OrgSettings: s, SchemaVersion: OrgSchemaVersion}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO org_settings (org_id, schema_version, data, updated_by, updated_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (org_id) DO UPDATE
+		SET schema_version = EXCLUDED.schema_version, data = EXCLUDED.data,
+			updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at
+	`, orgID, OrgSchemaVersion, data, auth.UserID()).Scan(&resp.UpdatedAt)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to save org settings", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update organization settings",
+		}
+	}
+	return resp, nil
+}
+
+// loadOrg reads an org_settings row the way load reads user settings.
+func loadOrg(ctx context.Context, row *sqldb.Row) (*OrgSettingsResponse, error) {
+	var version int
+	var data []byte
+	var updatedAt time.Time
+	err := row.Scan(&version, &data, &updatedAt)
+	if err == sql.ErrNoRows {
+		return &OrgSettingsResponse{OrgSettings: OrgDefaults, SchemaVersion: OrgSchemaVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if version < OrgSchemaVersion {
+		if data, err = upgrade(orgUpgrades, version, OrgSchemaVersion, data); err != nil {
+			return nil, err
+		}
+	}
+
+	s := OrgDefaults
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if err := validateOrg(&s); err != nil {
+		reqctx.Logger(ctx).Warn("stored org settings are invalid, using defaults", "error", err)
+		s = OrgDefaults
+	}
+	return &OrgSettingsResponse{OrgSettings: s, SchemaVersion: OrgSchemaVersion, UpdatedAt: updatedAt}, nil
+}
+
+func applyOrg(s *OrgSettings, req *UpdateOrgSettingsRequest) {
+	if req.Branding != nil {
+		s.Branding = *req.Branding
+	}
+	if req.Compliance != nil {
+		s.Compliance = *req.Compliance
+	}
+	p := req.Projects
+	if p == nil {
+		return
+	}
+	if p.Canvas != nil {
+		s.Projects.Canvas = *p.Canvas
+	}
+	if p.ColorProfile != nil {
+		s.Projects.ColorProfile = *p.ColorProfile
+	}
+	if p.AutosaveInterval != nil {
+		s.Projects.AutosaveInterval = *p.AutosaveInterval
+	}
+	if p.Sharing != nil {
+		s.Projects.Sharing = *p.Sharing
+	}
+	if p.Naming != nil {
+		s.Projects.Naming = *p.Naming
+	}
+}
+
+func validateOrg(s *OrgSettings) error {
+	p := &s.Projects
+	if w, h := p.Canvas.Width, p.Canvas.Height; w < 1 || h < 1 || w > maxCanvasSide || h > maxCanvasSide {
+		return fmt.Errorf("projects.canvas must be between 1 and %d pixels on each side", maxCanvasSide)
+	}
+	switch p.ColorProfile {
+	case ColorProfileSRGB, ColorProfileDisplayP3, ColorProfileCMYK:
+	default:
+		return fmt.Errorf("projects.colorProfile must be srgb, display-p3 or cmyk")
+	}
+	if i := p.AutosaveInterval; i != 0 && (i < minAutosaveInterval || i > maxAutosaveInterval) {
+		return fmt.Errorf("projects.autosaveInterval must be 0 or between %d and %d seconds", minAutosaveInterval, maxAutosaveInterval)
+	}
+	if len(p.Naming.TitlePattern) > maxTitlePattern {
+		return fmt.Errorf("projects.naming.titlePattern must be at most %d characters", maxTitlePattern)
+	}
+	if _, err := regexp.Compile(p.Naming.TitlePattern); err != nil {
+		return fmt.Errorf("projects.naming.titlePattern is not a valid regular expression")
+	}
+	if len(p.Naming.TitleHint) > 500 {
+		return fmt.Errorf("projects.naming.titleHint must be at most 500 characters")
+	}
+	if t := p.Naming.Template; len(t) > maxTitlePattern || strings.Count(t, "{") != len(templatePlaceholder.FindAllString(t, -1)) {
+		return fmt.Errorf("projects.naming.template must be at most %d characters with placeholders like {client}", maxTitlePattern)
+	}
+	b := &s.Branding
+	if len([]rune(b.DisplayName)) > 100 {
+		return fmt.Errorf("branding.displayName must be at most 100 characters")
+	}
+	if b.LogoURL != "" {
+		if u, err := url.Parse(b.LogoURL); err != nil || u.Scheme != "https" || u.Host == "" || len(b.LogoURL) > 2048 {
+			return fmt.Errorf("branding.logoUrl must be an https URL")
+		}
+	}
+	if c := b.PrimaryColor; c != "" && !brandColorPattern.MatchString(c) {
+		return fmt.Errorf("branding.primaryColor must be a color like #1a2b3c")
+	}
+	if c := b.AccentColor; c != "" && !brandColorPattern.MatchString(c) {
+		return fmt.Errorf("branding.accentColor must be a color like #1a2b3c")
+	}
+	return validateSnapshots(&s.Compliance.Snapshots)
+}
+
+// GetOrgBranding returns an organization's branding. Unlike its settings,
+// the organization's clients can read it.
+//
+//encore:api auth method=GET path=/orgs/:orgID/branding
+func GetOrgBranding(ctx context.Context, orgID string) (*Branding, error) {
+	if _, err := permissions.RequireOrgRole(ctx, db, orgID, "admin", "member", "guest", "client"); err != nil {
+		return nil, err
+	}
+	resp, err := loadOrg(ctx, db.QueryRow(ctx, `SELECT schema_version, data, updated_at FROM org_settings WHERE org_id = $1`, orgID))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load org settings", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch organization branding",
+		}
+	}
+	return &resp.Branding, nil
+}
+
+// LoadOrgBranding returns an organization's branding to other services,
+// such as the export service for the pages it generates.
+//
+//encore:api private method=GET path=/settings/internal/orgs/:orgID/branding
+func LoadOrgBranding(ctx context.Context, orgID string) (*Branding, error) {
+	resp, err := loadOrg(ctx, db.QueryRow(ctx, `SELECT schema_version, data, updated_at FROM org_settings WHERE org_id = $1`, orgID))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load org settings", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch organization branding",
+		}
+	}
+	return &resp.Branding, nil
+}
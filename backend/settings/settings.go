@@ -0,0 +1,304 @@
+// Package settings stores each user's preferences (theme, canvas and editor
+// defaults, locale) so the client restores the same setup on every device.
+// Preferences are kept as a JSONB document tagged with the schema version it
+// was written with; older documents are upgraded when they are read.
+package settings
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+)
+
+// SchemaVersion is the version of the Settings document written today
+const SchemaVersion = 1
+
+// Themes
+const (
+	ThemeSystem = "system"
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+)
+
+// Settings are a user's preferences
+type Settings struct {
+	Theme         string     `json:"theme"`
+	DefaultCanvas CanvasSize `json:"defaultCanvas"`
+	// AutosaveInterval is in seconds; 0 turns autosave off
+	AutosaveInterval int            `json:"autosaveInterval"`
+	Editor           EditorDefaults `json:"editor"`
+	Locale           string         `json:"locale"`
+	// TranslationLanguage is the language comments are translated into;
+	// empty uses Locale
+	TranslationLanguage string `json:"translationLanguage,omitempty"`
+}
+
+// CanvasSize is the size of new canvases
+type CanvasSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// EditorDefaults configure the editor for new sessions
+type EditorDefaults struct {
+	SnapToGrid bool   `json:"snapToGrid"`
+	GridSize   int    `json:"gridSize"`
+	ShowRulers bool   `json:"showRulers"`
+	FontFamily string `json:"fontFamily"`
+	FontSize   int    `json:"fontSize"`
+}
+
+// SettingsResponse is a user's settings with their schema version
+type SettingsResponse struct {
+	Settings
+	SchemaVersion int       `json:"schemaVersion"`
+	UpdatedAt     time.Time `json:"updatedAt,omitempty"`
+}
+
+// UpdateSettingsRequest changes the fields that are set and keeps the rest
+type UpdateSettingsRequest struct {
+	Theme            *string              `json:"theme,omitempty"`
+	DefaultCanvas    *CanvasSize          `json:"defaultCanvas,omitempty"`
+	AutosaveInterval *int                 `json:"autosaveInterval,omitempty"`
+	Editor           *EditorDefaultsPatch `json:"editor,omitempty"`
+	Locale           *string              `json:"locale,omitempty"`
+	// TranslationLanguage is cleared with an empty string
+	TranslationLanguage *string `json:"translationLanguage,omitempty"`
+}
+
+// EditorDefaultsPatch changes the editor defaults that are set
+type EditorDefaultsPatch struct {
+	SnapToGrid *bool   `json:"snapToGrid,omitempty"`
+	GridSize   *int    `json:"gridSize,omitempty"`
+	ShowRulers *bool   `json:"showRulers,omitempty"`
+	FontFamily *string `json:"fontFamily,omitempty"`
+	FontSize   *int    `json:"fontSize,omitempty"`
+}
+
+// Defaults are the settings of a user who has not changed anything
+var Defaults = Settings{
+	Theme:            ThemeSystem,
+	DefaultCanvas:    CanvasSize{Width: 800, Height: 600},
+	AutosaveInterval: 30,
+	Editor: EditorDefaults{
+		SnapToGrid: true,
+		GridSize:   8,
+		ShowRulers: true,
+		FontFamily: "Inter",
+		FontSize:   16,
+	},
+	Locale: "en",
+}
+
+// upgrades[v] turns a version v document into a version v+1 document. Add a
+// step here whenever Settings changes shape, then bump SchemaVersion.
+var upgrades = map[int]func(doc map[string]any){}
+
+const (
+	maxCanvasSide       = 10000
+	maxAutosaveInterval = 600
+	minAutosaveInterval = 5
+)
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+var db = sqldb.NewDatabase("settings", sqldb.DatabaseConfig{
+	Migrations: "../migrations",
+})
+
+//encore:api auth method=GET path=/settings
+func GetSettings(ctx context.Context) (*SettingsResponse, error) {
+	resp, err := load(ctx, db.QueryRow(ctx, `SELECT schema_version, data, updated_at FROM user_settings WHERE user_id = $1`, auth.UserID()))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load settings", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch settings",
+		}
+	}
+	return resp, nil
+}
+
+//encore:api auth method=PATCH path=/settings
+func UpdateSettings(ctx context.Context, req *UpdateSettingsRequest) (*SettingsResponse, error) {
+	userID := auth.UserID()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update settings",
+		}
+	}
+	defer tx.Rollback()
+
+	current, err := load(ctx, tx.QueryRow(ctx, `SELECT schema_version, data, updated_at FROM user_settings WHERE user_id = $1 FOR UPDATE`, userID))
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load settings", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update settings",
+		}
+	}
+
+	s := current.Settings
+	apply(&s, req)
+	if err := validate(&s); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: err.Error(),
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update settings",
+		}
+	}
+	resp := &SettingsResponse{Settings: s, SchemaVersion: SchemaVersion}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO user_settings (user_id, schema_version, data, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (user_id) DO UPDATE
+		SET schema_version = EXCLUDED.schema_version, data = EXCLUDED.data, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at
+	`, userID, SchemaVersion, data).Scan(&resp.UpdatedAt)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to save settings", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update settings",
+		}
+	}
+	return resp, nil
+}
+
+// load reads a settings row, upgrading it to the current schema and filling
+// in defaults for anything the stored document does not set. A missing row
+// yields the defaults.
+func load(ctx context.Context, row *sqldb.Row) (*SettingsResponse, error) {
+	var version int
+	var data []byte
+	var updatedAt time.Time
+	err := row.Scan(&version, &data, &updatedAt)
+	if err == sql.ErrNoRows {
+		return &SettingsResponse{Settings: Defaults, SchemaVersion: SchemaVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if version < SchemaVersion {
+		if data, err = upgrade(upgrades, version, SchemaVersion, data); err != nil {
+			return nil, err
+		}
+	}
+
+	s := Defaults
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	// Stored values may predate a tightened rule; fall back rather than
+	// hand the client something it has to reject.
+	if err := validate(&s); err != nil {
+		reqctx.Logger(ctx).Warn("stored settings are invalid, using defaults", "error", err)
+		s = Defaults
+	}
+	return &SettingsResponse{Settings: s, SchemaVersion: SchemaVersion, UpdatedAt: updatedAt}, nil
+}
+
+// upgrade applies steps to bring a stored document from version to target.
+func upgrade(steps map[int]func(doc map[string]any), version, target int, data []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for v := version; v < target; v++ {
+		step, ok := steps[v]
+		if !ok {
+			return nil, fmt.Errorf("no settings upgrade from schema version %d", v)
+		}
+		step(doc)
+	}
+	return json.Marshal(doc)
+}
+
+func apply(s *Settings, req *UpdateSettingsRequest) {
+	if req.Theme != nil {
+		s.Theme = *req.Theme
+	}
+	if req.DefaultCanvas != nil {
+		s.DefaultCanvas = *req.DefaultCanvas
+	}
+	if req.AutosaveInterval != nil {
+		s.AutosaveInterval = *req.AutosaveInterval
+	}
+	if req.Locale != nil {
+		s.Locale = *req.Locale
+	}
+	if req.TranslationLanguage != nil {
+		s.TranslationLanguage = *req.TranslationLanguage
+	}
+	if e := req.Editor; e != nil {
+		if e.SnapToGrid != nil {
+			s.Editor.SnapToGrid = *e.SnapToGrid
+		}
+		if e.GridSize != nil {
+			s.Editor.GridSize = *e.GridSize
+		}
+		if e.ShowRulers != nil {
+			s.Editor.ShowRulers = *e.ShowRulers
+		}
+		if e.FontFamily != nil {
+			s.Editor.FontFamily = *e.FontFamily
+		}
+		if e.FontSize != nil {
+			s.Editor.FontSize = *e.FontSize
+		}
+	}
+}
+
+func validate(s *Settings) error {
+	switch s.Theme {
+	case ThemeSystem, ThemeLight, ThemeDark:
+	default:
+		return fmt.Errorf("theme must be system, light or dark")
+	}
+	if w, h := s.DefaultCanvas.Width, s.DefaultCanvas.Height; w < 1 || h < 1 || w > maxCanvasSide || h > maxCanvasSide {
+		return fmt.Errorf("defaultCanvas must be between 1 and %d pixels on each side", maxCanvasSide)
+	}
+	if i := s.AutosaveInterval; i != 0 && (i < minAutosaveInterval || i > maxAutosaveInterval) {
+		return fmt.Errorf("autosaveInterval must be 0 or between %d and %d seconds", minAutosaveInterval, maxAutosaveInterval)
+	}
+	if g := s.Editor.GridSize; g < 1 || g > 200 {
+		return fmt.Errorf("editor.gridSize must be between 1 and 200")
+	}
+	if f := s.Editor.FontFamily; f == "" || len(f) > 100 {
+		return fmt.Errorf("editor.fontFamily must be between 1 and 100 characters")
+	}
+	if f := s.Editor.FontSize; f < 1 || f > 500 {
+		return fmt.Errorf("editor.fontSize must be between 1 and 500")
+	}
+	if !localePattern.MatchString(s.Locale) {
+		return fmt.Errorf("locale must be a language tag such as en or pt-BR")
+	}
+	if l := s.TranslationLanguage; l != "" && !localePattern.MatchString(l) {
+		return fmt.Errorf("translationLanguage must be a language tag such as en or pt-BR")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package sheets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"canvasai/outbound"
+	"canvasai/ratelimit"
+)
+
+const (
+	sheetsAPI = "https://sheets.googleapis.com/v4/spreadsheets/"
+	// rangesPerRequest keeps batchGet URLs well under Google's length limit
+	rangesPerRequest = 50
+)
+
+// sheetsClient reads spreadsheets from the Google Sheets API, which is the
+// only host it may reach.
+var sheetsClient = outbound.NewClient(outbound.Policy{
+	Timeout:          15 * time.Second,
+	MaxResponseBytes: 4 << 20,
+	AllowedHosts:     []string{"sheets.googleapis.com"},
+	RateLimit:        ratelimit.Limit{Requests: 50, Per: time.Second},
+})
+
+var errNotConfigured = errors.New("sheets: Google Sheets is not configured")
+
+// apiError is an error response from the Sheets API
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("sheets: HTTP %d: %s", e.status, e.message)
+}
+
+// unavailable reports whether the spreadsheet itself cannot be read, because
+// it was deleted or is no longer shared by link, rather than the request
+// failing.
+func unavailable(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && (e.status == http.StatusNotFound || e.status == http.StatusForbidden)
+}
+
+// badRange reports whether the Sheets API rejected a range.
+func badRange(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.status == http.StatusBadRequest
+}
+
+// spreadsheetTitle returns a spreadsheet's title, checking it can be read.
+func spreadsheetTitle(ctx context.Context, spreadsheetID string) (string, error) {
+	var meta struct {
+		Properties struct {
+			Title string `json:"title"`
+		} `json:"properties"`
+	}
+	err := get(ctx, spreadsheetID, url.Values{"fields": {"properties.title"}}, &meta)
+	return meta.Properties.Title, err
+}
+
+// fetchRanges reads the formatted values of ranges. Ranges the API rejects,
+// such as those on a deleted sheet tab, are returned in bad with the reason
+// instead of failing the others.
+func fetchRanges(ctx context.Context, spreadsheetID string, ranges []string) (values map[string][][]string, bad map[string]string, err error) {
+	values = map[string][][]string{}
+	bad = map[string]string{}
+	for start := 0; start < len(ranges); start += rangesPerRequest {
+		chunk := ranges[start:min(start+rangesPerRequest, len(ranges))]
+		got, err := batchGet(ctx, spreadsheetID, chunk)
+		if badRange(err) && len(chunk) > 1 {
+			// One bad range fails the whole batch; read them one at a time
+			// to tell which.
+			for _, r := range chunk {
+				got, err := batchGet(ctx, spreadsheetID, []string{r})
+				if badRange(err) {
+					bad[r] = err.(*apiError).message
+					continue
+				} else if err != nil {
+					return nil, nil, err
+				}
+				values[r] = got[0]
+			}
+			continue
+		} else if badRange(err) {
+			bad[chunk[0]] = err.(*apiError).message
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		for i, r := range chunk {
+			values[r] = got[i]
+		}
+	}
+	return values, bad, nil
+}
+
+// batchGet reads ranges, returning their values in the same order.
+func batchGet(ctx context.Context, spreadsheetID string, ranges []string) ([][][]string, error) {
+	var resp struct {
+		ValueRanges []struct {
+			Values [][]any `json:"values"`
+		} `json:"valueRanges"`
+	}
+	query := url.Values{
+		"ranges":               ranges,
+		"majorDimension":       {"ROWS"},
+		"valueRenderOption":    {"FORMATTED_VALUE"},
+		"dateTimeRenderOption": {"FORMATTED_STRING"},
+	}
+	if err := get(ctx, spreadsheetID+"/values:batchGet", query, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.ValueRanges) != len(ranges) {
+		return nil, fmt.Errorf("sheets: got %d ranges, want %d", len(resp.ValueRanges), len(ranges))
+	}
+	out := make([][][]string, len(ranges))
+	for i, vr := range resp.ValueRanges {
+		for _, row := range vr.Values {
+			cells := make([]string, len(row))
+			for j, cell := range row {
+				cells[j] = fmt.Sprint(cell)
+			}
+			out[i] = append(out[i], cells)
+		}
+	}
+	return out, nil
+}
+
+func get(ctx context.Context, path string, query url.Values, out any) error {
+	if secrets.GoogleSheetsAPIKey == "" {
+		return errNotConfigured
+	}
+	query.Set("key", secrets.GoogleSheetsAPIKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sheetsAPI+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := sheetsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &body) != nil || body.Error.Message == "" {
+			body.Error.Message = resp.Status
+		}
+		return &apiError{status: resp.StatusCode, message: body.Error.Message}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// cellText turns a range's values into element text: rows on separate
+// lines, the cells of a row separated by spaces. Empty trailing cells and
+// rows are dropped.
+func cellText(rows [][]string) string {
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		lines = append(lines, strings.TrimRight(strings.Join(row, " "), " "))
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
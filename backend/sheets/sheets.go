@@ -0,0 +1,628 @@
+// Package sheets binds canvas text elements to cells of Google Sheets, so
+// price lists, schedules and scores on a design stay current with the
+// spreadsheet they come from. A project connects a spreadsheet shared by
+// link, and each bound text element shows the formatted values of an A1
+// range. A sync job copies changed values into the canvas on each
+// connection's schedule, and editors can sync on demand (see sync.go).
+// Every change is recorded, and bindings whose element, sheet tab or
+// spreadsheet has gone are marked broken instead of being dropped.
+package sheets
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+var secrets struct {
+	// GoogleSheetsAPIKey is a Google Cloud API key with the Sheets API
+	// enabled. It can read any spreadsheet shared with anyone with the link.
+	GoogleSheetsAPIKey string
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+// Connections and bindings are stored alongside the projects they fill.
+var db = sqldb.Named("project")
+
+const (
+	defaultSyncInterval = 60
+	minSyncInterval     = 15
+	maxSyncInterval     = 7 * 24 * 60
+
+	maxConnectionsPerProject = 10
+	maxBindingsPerProject    = 200
+
+	defaultChangesLimit = 50
+	maxChangesLimit     = 200
+)
+
+// Binding statuses
+const (
+	StatusPending = "pending"
+	StatusOK      = "ok"
+	StatusBroken  = "broken"
+)
+
+var (
+	// spreadsheetURL matches the spreadsheet ID in a Google Sheets URL
+	spreadsheetURL = regexp.MustCompile(`^https://docs\.google\.com/spreadsheets/d/([A-Za-z0-9_-]+)`)
+	spreadsheetID  = regexp.MustCompile(`^[A-Za-z0-9_-]{20,128}$`)
+	// a1Range matches a cell or a rectangular range, optionally on a named
+	// sheet tab: B2, Prices!B2:D4, 'Q3 Sales'!A1
+	a1Range = regexp.MustCompile(`^(?:(?:'(?:[^']|'')+'|[^'!:]+)!)?[A-Za-z]{1,3}[1-9][0-9]{0,6}(?::[A-Za-z]{1,3}[1-9][0-9]{0,6})?$`)
+)
+
+// SheetConnection is a spreadsheet connected to a project
+type SheetConnection struct {
+	ID            string `json:"id"`
+	ProjectID     string `json:"projectId"`
+	SpreadsheetID string `json:"spreadsheetId"`
+	Title         string `json:"title"`
+	URL           string `json:"url"`
+	// SyncIntervalMinutes is how often the sync job refreshes the bindings
+	SyncIntervalMinutes int        `json:"syncIntervalMinutes"`
+	Bindings            int        `json:"bindings"`
+	BrokenBindings      int        `json:"brokenBindings"`
+	LastSyncedAt        *time.Time `json:"lastSyncedAt,omitempty"`
+	NextSyncAt          time.Time  `json:"nextSyncAt"`
+	// Failures counts consecutive syncs that could not read the spreadsheet
+	Failures  int       `json:"failures,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SheetBinding binds a text element to a range of a connected spreadsheet
+type SheetBinding struct {
+	ID           string `json:"id"`
+	ConnectionID string `json:"connectionId"`
+	ElementID    string `json:"elementId"`
+	Range        string `json:"range"`
+	// Value is the text last copied into the element
+	Value *string `json:"value,omitempty"`
+	// Status is pending until the first sync, then ok or broken
+	Status    string     `json:"status"`
+	LastError string     `json:"lastError,omitempty"`
+	SyncedAt  *time.Time `json:"syncedAt,omitempty"`
+	ChangedAt *time.Time `json:"changedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// BindingChange is a value a sync copied into a bound element
+type BindingChange struct {
+	ID       int64   `json:"id"`
+	OldValue *string `json:"oldValue,omitempty"`
+	NewValue string  `json:"newValue"`
+	// Source is schedule for the sync job and manual for on-demand syncs
+	Source string `json:"source"`
+	// Revision is the project revision the change was saved in, if the
+	// element's text changed
+	Revision  *int      `json:"revision,omitempty"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// ConnectSheetRequest represents the connect sheet request
+type ConnectSheetRequest struct {
+	// Spreadsheet is the spreadsheet's URL or ID
+	Spreadsheet         string `json:"spreadsheet"`
+	SyncIntervalMinutes int    `json:"syncIntervalMinutes,omitempty"`
+}
+
+// UpdateSheetConnectionRequest represents the update sheet connection request
+type UpdateSheetConnectionRequest struct {
+	SyncIntervalMinutes int `json:"syncIntervalMinutes"`
+}
+
+// ListSheetConnectionsResponse represents the list sheet connections response
+type ListSheetConnectionsResponse struct {
+	Connections []SheetConnection `json:"connections"`
+}
+
+// BindElementRequest represents the bind element request
+type BindElementRequest struct {
+	ConnectionID string `json:"connectionId"`
+	ElementID    string `json:"elementId"`
+	// Range is an A1 range such as Prices!B2 or Sheet1!A1:C3
+	Range string `json:"range"`
+}
+
+// ListSheetBindingsResponse represents the list sheet bindings response
+type ListSheetBindingsResponse struct {
+	Bindings []SheetBinding `json:"bindings"`
+}
+
+// ListBindingChangesRequest represents the list binding changes request
+type ListBindingChangesRequest struct {
+	Limit  int `query:"limit"`
+	Offset int `query:"offset"`
+}
+
+// ListBindingChangesResponse represents the list binding changes response
+type ListBindingChangesResponse struct {
+	Changes []BindingChange `json:"changes"`
+	Total   int             `json:"total"`
+}
+
+// ConnectSheet connects a spreadsheet shared by link to a project. The
+// spreadsheet is read once to check it is reachable.
+//
+//encore:api auth method=POST path=/projects/:id/sheets
+func ConnectSheet(ctx context.Context, id string, req *ConnectSheetRequest) (*SheetConnection, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	sid, err := parseSpreadsheet(req.Spreadsheet)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := syncInterval(req.SyncIntervalMinutes)
+	if err != nil {
+		return nil, err
+	}
+	var connections int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM sheet_connections WHERE project_id = $1`, id).Scan(&connections); err != nil {
+		reqctx.Logger(ctx).Error("failed to count sheet connections", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect spreadsheet",
+		}
+	}
+	if connections >= maxConnectionsPerProject {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: fmt.Sprintf("A project can connect at most %d spreadsheets", maxConnectionsPerProject),
+		}
+	}
+
+	title, err := spreadsheetTitle(ctx, sid)
+	if err != nil {
+		return nil, spreadsheetError(ctx, sid, err)
+	}
+	if r := []rune(title); len(r) > 255 {
+		title = string(r[:255])
+	}
+
+	var connID string
+	err = db.QueryRow(ctx, `
+		INSERT INTO sheet_connections (project_id, spreadsheet_id, title, created_by, sync_interval_minutes, next_sync_at)
+		VALUES ($1, $2, $3, $4, $5, NOW() + $5 * INTERVAL '1 minute')
+		ON CONFLICT (project_id, spreadsheet_id) DO NOTHING
+		RETURNING id
+	`, id, sid, title, auth.UserID(), interval).Scan(&connID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "The spreadsheet is already connected to this project",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to connect spreadsheet", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect spreadsheet",
+		}
+	}
+	reqctx.Logger(ctx).Info("spreadsheet connected", "project_id", id, "connection_id", connID, "spreadsheet_id", sid)
+	return getConnection(ctx, id, connID)
+}
+
+//encore:api auth method=GET path=/projects/:id/sheets
+func ListSheetConnections(ctx context.Context, id string) (*ListSheetConnectionsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, connectionColumns+` WHERE c.project_id = $1 ORDER BY c.created_at`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list sheet connections", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list spreadsheets",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListSheetConnectionsResponse{Connections: []SheetConnection{}}
+	for rows.Next() {
+		c, err := scanConnection(rows)
+		if err != nil {
+			continue
+		}
+		resp.Connections = append(resp.Connections, *c)
+	}
+	return resp, nil
+}
+
+// UpdateSheetConnection changes how often a spreadsheet is synced.
+//
+//encore:api auth method=PATCH path=/projects/:id/sheets/:connectionId
+func UpdateSheetConnection(ctx context.Context, id, connectionId string, req *UpdateSheetConnectionRequest) (*SheetConnection, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	interval, err := syncInterval(req.SyncIntervalMinutes)
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.Exec(ctx, `
+		UPDATE sheet_connections
+		SET sync_interval_minutes = $3,
+			next_sync_at = COALESCE(last_synced_at, created_at) + $3 * INTERVAL '1 minute'
+		WHERE id::text = $2 AND project_id = $1
+	`, id, connectionId, interval)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update sheet connection", "connection_id", connectionId, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update spreadsheet",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Spreadsheet not found",
+		}
+	}
+	return getConnection(ctx, id, connectionId)
+}
+
+// DisconnectSheet disconnects a spreadsheet and removes its bindings. The
+// elements keep the text they last showed.
+//
+//encore:api auth method=DELETE path=/projects/:id/sheets/:connectionId
+func DisconnectSheet(ctx context.Context, id, connectionId string) error {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM sheet_connections WHERE id::text = $2 AND project_id = $1
+	`, id, connectionId)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to disconnect spreadsheet", "connection_id", connectionId, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to disconnect spreadsheet",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Spreadsheet not found",
+		}
+	}
+	reqctx.Logger(ctx).Info("spreadsheet disconnected", "project_id", id, "connection_id", connectionId)
+	return nil
+}
+
+// BindElement binds a text element to a range of a connected spreadsheet,
+// replacing any binding the element had, and syncs the spreadsheet so the
+// element shows the range's value straight away.
+//
+//encore:api auth method=POST path=/projects/:id/sheet-bindings
+func BindElement(ctx context.Context, id string, req *BindElementRequest) (*SheetBinding, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	cellRange := strings.TrimSpace(req.Range)
+	if !a1Range.MatchString(cellRange) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Range must be a cell or range in A1 notation, such as Sheet1!B2 or Sheet1!A1:C3",
+		}
+	}
+	if req.ElementID == "" || len(req.ElementID) > 255 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Element ID is required",
+		}
+	}
+	if err := checkTextElement(ctx, id, req.ElementID); err != nil {
+		return nil, err
+	}
+	conn, err := getConnection(ctx, id, req.ConnectionID)
+	if err != nil {
+		return nil, err
+	}
+	var bindings int
+	err = db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM sheet_bindings WHERE project_id = $1 AND element_id <> $2
+	`, id, req.ElementID).Scan(&bindings)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to count sheet bindings", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to bind element",
+		}
+	}
+	if bindings >= maxBindingsPerProject {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: fmt.Sprintf("A project can bind at most %d elements", maxBindingsPerProject),
+		}
+	}
+
+	var bindingID string
+	err = db.QueryRow(ctx, `
+		INSERT INTO sheet_bindings (connection_id, project_id, element_id, cell_range, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (project_id, element_id) DO UPDATE
+		SET connection_id = EXCLUDED.connection_id, cell_range = EXCLUDED.cell_range,
+			created_by = EXCLUDED.created_by, status = 'pending', last_error = NULL
+		RETURNING id
+	`, conn.ID, id, req.ElementID, cellRange, auth.UserID()).Scan(&bindingID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to bind element", "project_id", id, "element_id", req.ElementID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to bind element",
+		}
+	}
+	reqctx.Logger(ctx).Info("element bound to spreadsheet", "project_id", id, "binding_id", bindingID, "range", cellRange)
+
+	if _, err := syncConnection(ctx, conn.connection(), SourceManual); err != nil {
+		reqctx.Logger(ctx).Warn("failed to sync new binding", "binding_id", bindingID, "error", err)
+	}
+	return getBinding(ctx, id, bindingID)
+}
+
+//encore:api auth method=GET path=/projects/:id/sheet-bindings
+func ListSheetBindings(ctx context.Context, id string) (*ListSheetBindingsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, bindingColumns+` WHERE project_id = $1 ORDER BY created_at`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list sheet bindings", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list bindings",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListSheetBindingsResponse{Bindings: []SheetBinding{}}
+	for rows.Next() {
+		b, err := scanBinding(rows)
+		if err != nil {
+			continue
+		}
+		resp.Bindings = append(resp.Bindings, *b)
+	}
+	return resp, nil
+}
+
+// UnbindElement removes a binding. The element keeps the text it last
+// showed.
+//
+//encore:api auth method=DELETE path=/projects/:id/sheet-bindings/:bindingId
+func UnbindElement(ctx context.Context, id, bindingId string) error {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM sheet_bindings WHERE id::text = $2 AND project_id = $1
+	`, id, bindingId)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to unbind element", "binding_id", bindingId, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to unbind element",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Binding not found",
+		}
+	}
+	return nil
+}
+
+// ListBindingChanges returns the values syncs copied into a bound element,
+// newest first.
+//
+//encore:api auth method=GET path=/projects/:id/sheet-bindings/:bindingId/changes
+func ListBindingChanges(ctx context.Context, id, bindingId string, req *ListBindingChangesRequest) (*ListBindingChangesResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	if _, err := getBinding(ctx, id, bindingId); err != nil {
+		return nil, err
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxChangesLimit {
+		limit = defaultChangesLimit
+	}
+	offset := max(req.Offset, 0)
+
+	resp := &ListBindingChangesResponse{Changes: []BindingChange{}}
+	if err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM sheet_binding_changes WHERE binding_id::text = $1
+	`, bindingId).Scan(&resp.Total); err != nil {
+		reqctx.Logger(ctx).Error("failed to count binding changes", "binding_id", bindingId, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list changes",
+		}
+	}
+	rows, err := db.Query(ctx, `
+		SELECT id, old_value, new_value, source, revision, changed_at
+		FROM sheet_binding_changes
+		WHERE binding_id::text = $1
+		ORDER BY changed_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`, bindingId, limit, offset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list binding changes", "binding_id", bindingId, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list changes",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c BindingChange
+		if err := rows.Scan(&c.ID, &c.OldValue, &c.NewValue, &c.Source, &c.Revision, &c.ChangedAt); err != nil {
+			continue
+		}
+		resp.Changes = append(resp.Changes, c)
+	}
+	return resp, nil
+}
+
+// parseSpreadsheet returns the spreadsheet ID in a Google Sheets URL, or
+// the value itself when it is an ID.
+func parseSpreadsheet(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if m := spreadsheetURL.FindStringSubmatch(value); m != nil {
+		value = m[1]
+	}
+	if !spreadsheetID.MatchString(value) {
+		return "", &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Spreadsheet must be a Google Sheets URL or spreadsheet ID",
+		}
+	}
+	return value, nil
+}
+
+func syncInterval(minutes int) (int, error) {
+	if minutes == 0 {
+		return defaultSyncInterval, nil
+	}
+	if minutes < minSyncInterval || minutes > maxSyncInterval {
+		return 0, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("Sync interval must be between %d minutes and %d days", minSyncInterval, maxSyncInterval/(24*60)),
+		}
+	}
+	return minutes, nil
+}
+
+// checkTextElement checks the project's canvas has a text element with the
+// ID.
+func checkTextElement(ctx context.Context, projectID, elementID string) error {
+	var canvasData []byte
+	if err := db.QueryRow(ctx, `SELECT canvas_data FROM projects WHERE id = $1`, projectID).Scan(&canvasData); err != nil {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Project not found",
+		}
+	}
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Project canvas is invalid",
+		}
+	}
+	switch elementProblem(pages, elementID) {
+	case "":
+		return nil
+	case errElementNotText:
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Only text elements can be bound to a spreadsheet",
+		}
+	default:
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Element not found; save the project before binding new elements",
+		}
+	}
+}
+
+// spreadsheetError describes why a spreadsheet could not be read.
+func spreadsheetError(ctx context.Context, spreadsheetID string, err error) error {
+	switch {
+	case err == errNotConfigured:
+		return &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Google Sheets is not configured",
+		}
+	case unavailable(err):
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "The spreadsheet was not found; share it with anyone with the link",
+		}
+	}
+	reqctx.Logger(ctx).Warn("failed to read spreadsheet", "spreadsheet_id", spreadsheetID, "error", err)
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "Could not reach Google Sheets, try again",
+	}
+}
+
+const connectionColumns = `
+	SELECT c.id, c.project_id, c.spreadsheet_id, c.title, c.sync_interval_minutes,
+		(SELECT COUNT(*) FROM sheet_bindings b WHERE b.connection_id = c.id),
+		(SELECT COUNT(*) FROM sheet_bindings b WHERE b.connection_id = c.id AND b.status = 'broken'),
+		c.last_synced_at, c.next_sync_at, c.failures, COALESCE(c.last_error, ''),
+		COALESCE(c.created_by::text, ''), c.created_at
+	FROM sheet_connections c`
+
+func scanConnection(row interface{ Scan(...any) error }) (*SheetConnection, error) {
+	c := &SheetConnection{}
+	err := row.Scan(&c.ID, &c.ProjectID, &c.SpreadsheetID, &c.Title, &c.SyncIntervalMinutes,
+		&c.Bindings, &c.BrokenBindings, &c.LastSyncedAt, &c.NextSyncAt, &c.Failures, &c.LastError,
+		&c.CreatedBy, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.URL = "https://docs.google.com/spreadsheets/d/" + c.SpreadsheetID
+	return c, nil
+}
+
+// connection returns what a sync needs to know about the connection.
+func (c *SheetConnection) connection() connection {
+	return connection{id: c.ID, projectID: c.ProjectID, spreadsheetID: c.SpreadsheetID, createdBy: c.CreatedBy, title: c.Title}
+}
+
+func getConnection(ctx context.Context, projectID, connectionID string) (*SheetConnection, error) {
+	c, err := scanConnection(db.QueryRow(ctx, connectionColumns+` WHERE c.id::text = $1 AND c.project_id = $2`, connectionID, projectID))
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Spreadsheet not found",
+		}
+	}
+	return c, nil
+}
+
+const bindingColumns = `
+	SELECT id, connection_id, element_id, cell_range, value, status, COALESCE(last_error, ''),
+		synced_at, changed_at, created_at
+	FROM sheet_bindings`
+
+func scanBinding(row interface{ Scan(...any) error }) (*SheetBinding, error) {
+	b := &SheetBinding{}
+	err := row.Scan(&b.ID, &b.ConnectionID, &b.ElementID, &b.Range, &b.Value, &b.Status, &b.LastError,
+		&b.SyncedAt, &b.ChangedAt, &b.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func getBinding(ctx context.Context, projectID, bindingID string) (*SheetBinding, error) {
+	b, err := scanBinding(db.QueryRow(ctx, bindingColumns+` WHERE id::text = $1 AND project_id = $2`, bindingID, projectID))
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Binding not found",
+		}
+	}
+	return b, nil
+}
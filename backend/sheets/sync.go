@@ -0,0 +1,430 @@
+package sheets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/notification"
+	"canvasai/permissions"
+	"canvasai/project"
+	"canvasai/projectaccess"
+	"canvasai/ratelimit"
+	"canvasai/render"
+	"canvasai/reqctx"
+)
+
+// Sync sources, recorded with each change
+const (
+	SourceSchedule = "schedule"
+	SourceManual   = "manual"
+)
+
+const (
+	syncBatchSize = 50
+	// maxBoundTextLength bounds the text a range can put into an element
+	maxBoundTextLength = 10000
+
+	errElementMissing = "The element is no longer on the canvas"
+	errElementNotText = "The element is no longer a text element"
+	errSheetGone      = "The spreadsheet was deleted or is no longer shared by link"
+)
+
+var syncLimiter = ratelimit.New(ratelimit.Limit{Requests: 6, Per: time.Minute})
+
+// connection is what a sync needs to know about a connected spreadsheet
+type connection struct {
+	id, projectID, spreadsheetID, createdBy, title string
+}
+
+// syncStats counts what a sync did
+type syncStats struct {
+	updated int
+	// broken counts bindings that broke in this sync
+	broken int
+}
+
+// SyncSheetsResponse represents the sync sheets response
+type SyncSheetsResponse struct {
+	// Updated counts the bindings whose value changed
+	Updated int `json:"updated"`
+	// Broken counts the bindings that broke in this sync
+	Broken int `json:"broken"`
+	// Failed counts the spreadsheets that could not be read; their
+	// connections carry the error
+	Failed   int            `json:"failed"`
+	Bindings []SheetBinding `json:"bindings"`
+}
+
+// SyncSheets refreshes every binding of a project now, instead of waiting
+// for the sync job.
+//
+//encore:api auth method=POST path=/projects/:id/sheets/sync
+func SyncSheets(ctx context.Context, id string) (*SyncSheetsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	if !syncLimiter.Allow(id) {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "Spreadsheets were synced moments ago, try again shortly",
+		}
+	}
+	rows, err := db.Query(ctx, `
+		SELECT id, project_id, spreadsheet_id, COALESCE(created_by::text, ''), title
+		FROM sheet_connections WHERE project_id = $1 ORDER BY created_at
+	`, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load sheet connections", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to sync spreadsheets",
+		}
+	}
+	connections, err := scanConnections(rows)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load sheet connections", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to sync spreadsheets",
+		}
+	}
+
+	resp := &SyncSheetsResponse{}
+	for _, c := range connections {
+		stats, err := syncConnection(ctx, c, SourceManual)
+		if err == errNotConfigured {
+			return nil, spreadsheetError(ctx, c.spreadsheetID, err)
+		} else if err != nil {
+			resp.Failed++
+			continue
+		}
+		resp.Updated += stats.updated
+		resp.Broken += stats.broken
+	}
+	bindings, err := ListSheetBindings(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	resp.Bindings = bindings.Bindings
+	return resp, nil
+}
+
+// Sync connected spreadsheets every five minutes; each is synced once per
+// its SyncIntervalMinutes.
+var _ = cron.NewJob("sync-google-sheets", cron.JobConfig{
+	Title:    "Sync text elements bound to Google Sheets",
+	Every:    5 * cron.Minute,
+	Endpoint: SyncDueSheets,
+})
+
+//encore:api private
+func SyncDueSheets(ctx context.Context) error {
+	if secrets.GoogleSheetsAPIKey == "" {
+		return nil
+	}
+	// Moving next_sync_at as connections are claimed keeps overlapping runs
+	// from syncing the same spreadsheet.
+	rows, err := db.Query(ctx, `
+		UPDATE sheet_connections c
+		SET next_sync_at = NOW() + c.sync_interval_minutes * INTERVAL '1 minute'
+		WHERE c.id IN (
+			SELECT s.id FROM sheet_connections s
+			JOIN projects p ON p.id = s.project_id
+			WHERE s.next_sync_at <= NOW() AND p.deleted_at IS NULL
+			ORDER BY s.next_sync_at
+			LIMIT $1
+			FOR UPDATE OF s SKIP LOCKED
+		)
+		RETURNING c.id, c.project_id, c.spreadsheet_id, COALESCE(c.created_by::text, ''), c.title
+	`, syncBatchSize)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find spreadsheets to sync", "error", err)
+		return err
+	}
+	connections, err := scanConnections(rows)
+	if err != nil {
+		return err
+	}
+
+	updated, broken, failed := 0, 0, 0
+	for _, c := range connections {
+		stats, err := syncConnection(ctx, c, SourceSchedule)
+		if err != nil {
+			failed++
+			continue
+		}
+		updated += stats.updated
+		broken += stats.broken
+	}
+	reqctx.Logger(ctx).Info("spreadsheets synced", "connections", len(connections), "updated", updated, "broken", broken, "failed", failed)
+	return nil
+}
+
+// syncConnection reads the ranges of a connection's bindings and copies
+// changed values into their elements. Bindings whose element or range has
+// gone are marked broken; they recover on their own if it comes back, for
+// instance when an edit is undone.
+func syncConnection(ctx context.Context, c connection, source string) (*syncStats, error) {
+	log := reqctx.Logger(ctx)
+	bindings, err := loadBindings(ctx, c.id)
+	if err != nil {
+		log.Error("failed to load sheet bindings", "connection_id", c.id, "error", err)
+		return nil, err
+	}
+	if len(bindings) == 0 {
+		recordSync(ctx, c, nil)
+		return &syncStats{}, nil
+	}
+
+	var canvasData []byte
+	if err := db.QueryRow(ctx, `SELECT canvas_data FROM projects WHERE id = $1`, c.projectID).Scan(&canvasData); err != nil {
+		log.Error("failed to load project canvas", "project_id", c.projectID, "error", err)
+		return nil, err
+	}
+	pages, err := render.ParsePages(canvasData)
+	if err != nil {
+		recordSync(ctx, c, err)
+		return nil, err
+	}
+
+	var ranges []string
+	requested := map[string]bool{}
+	for _, b := range bindings {
+		if b.problem = elementProblem(pages, b.elementID); b.problem == "" && !requested[b.cellRange] {
+			requested[b.cellRange] = true
+			ranges = append(ranges, b.cellRange)
+		}
+	}
+	values, bad, err := fetchRanges(ctx, c.spreadsheetID, ranges)
+	if err != nil {
+		recordSync(ctx, c, err)
+		if !unavailable(err) {
+			log.Warn("failed to read spreadsheet", "connection_id", c.id, "error", err)
+			return nil, err
+		}
+		for _, b := range bindings {
+			b.problem = errSheetGone
+		}
+		stats := &syncStats{}
+		saveBindings(ctx, c, bindings, source, nil, stats)
+		return stats, err
+	}
+
+	text := map[string]string{}
+	for _, b := range bindings {
+		if b.problem != "" {
+			continue
+		}
+		if reason, ok := bad[b.cellRange]; ok {
+			b.problem = "Google Sheets cannot read the range: " + reason
+			continue
+		}
+		value := cellText(values[b.cellRange])
+		if len(value) > maxBoundTextLength {
+			b.problem = fmt.Sprintf("The range holds more than %d characters", maxBoundTextLength)
+			continue
+		}
+		b.next = value
+		text[b.elementID] = value
+	}
+
+	var written *project.SetElementTextResponse
+	if len(text) > 0 {
+		written, err = project.SetElementText(ctx, c.projectID, &project.SetElementTextRequest{Text: text, Source: "sheets"})
+		if err != nil {
+			log.Error("failed to write bound text", "project_id", c.projectID, "connection_id", c.id, "error", err)
+			recordSync(ctx, c, err)
+			return nil, err
+		}
+		missing := map[string]bool{}
+		for _, elementID := range written.Missing {
+			missing[elementID] = true
+		}
+		for _, b := range bindings {
+			if b.problem == "" && missing[b.elementID] {
+				b.problem = errElementMissing
+			}
+		}
+	}
+
+	stats := &syncStats{}
+	saveBindings(ctx, c, bindings, source, written, stats)
+	recordSync(ctx, c, nil)
+	return stats, nil
+}
+
+// boundElement is a binding being synced
+type boundElement struct {
+	id, elementID, cellRange, status string
+	value                            *string
+	// problem is why the binding is broken, and next the value it shows
+	// when it is not
+	problem, next string
+}
+
+func loadBindings(ctx context.Context, connectionID string) ([]*boundElement, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, element_id, cell_range, status, value FROM sheet_bindings WHERE connection_id = $1
+	`, connectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bindings []*boundElement
+	for rows.Next() {
+		b := &boundElement{}
+		if err := rows.Scan(&b.id, &b.elementID, &b.cellRange, &b.status, &b.value); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, rows.Err()
+}
+
+// saveBindings records the outcome of a sync for each binding, and a
+// change for each new value. A binding rebound to another range while the
+// sync ran is left for the next one.
+func saveBindings(ctx context.Context, c connection, bindings []*boundElement, source string, written *project.SetElementTextResponse, stats *syncStats) {
+	log := reqctx.Logger(ctx)
+	var revision *int
+	changed := map[string]bool{}
+	if written != nil {
+		for _, elementID := range written.Changed {
+			changed[elementID] = true
+		}
+		revision = &written.Revision
+	}
+
+	for _, b := range bindings {
+		if b.problem != "" {
+			_, err := db.Exec(ctx, `
+				UPDATE sheet_bindings SET status = 'broken', last_error = $3, synced_at = NOW()
+				WHERE id = $1 AND cell_range = $2
+			`, b.id, b.cellRange, b.problem)
+			if err != nil {
+				log.Error("failed to update sheet binding", "binding_id", b.id, "error", err)
+				continue
+			}
+			if b.status != StatusBroken {
+				stats.broken++
+			}
+			continue
+		}
+
+		valueChanged := b.value == nil || *b.value != b.next
+		err := func() error {
+			tx, err := db.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			result, err := tx.Exec(ctx, `
+				UPDATE sheet_bindings
+				SET status = 'ok', last_error = NULL, value = $3, synced_at = NOW(),
+					changed_at = CASE WHEN $4 THEN NOW() ELSE changed_at END
+				WHERE id = $1 AND cell_range = $2
+			`, b.id, b.cellRange, b.next, valueChanged)
+			if err != nil {
+				return err
+			}
+			if valueChanged && result.RowsAffected() > 0 {
+				var rev *int
+				if changed[b.elementID] {
+					rev = revision
+				}
+				_, err = tx.Exec(ctx, `
+					INSERT INTO sheet_binding_changes (binding_id, old_value, new_value, source, revision)
+					VALUES ($1, $2, $3, $4, $5)
+				`, b.id, b.value, b.next, source, rev)
+				if err != nil {
+					return err
+				}
+				stats.updated++
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			log.Error("failed to update sheet binding", "binding_id", b.id, "error", err)
+		}
+	}
+
+	if stats.broken > 0 && c.createdBy != "" {
+		notifyBroken(ctx, c, stats.broken)
+	}
+}
+
+// recordSync records a sync of the connection and, if it failed, why.
+func recordSync(ctx context.Context, c connection, syncErr error) {
+	var err error
+	if syncErr == nil {
+		_, err = db.Exec(ctx, `
+			UPDATE sheet_connections
+			SET last_synced_at = NOW(), next_sync_at = NOW() + sync_interval_minutes * INTERVAL '1 minute',
+				failures = 0, last_error = NULL
+			WHERE id = $1
+		`, c.id)
+	} else {
+		_, err = db.Exec(ctx, `
+			UPDATE sheet_connections
+			SET next_sync_at = NOW() + sync_interval_minutes * INTERVAL '1 minute',
+				failures = failures + 1, last_error = $2
+			WHERE id = $1
+		`, c.id, syncErr.Error())
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to record spreadsheet sync", "connection_id", c.id, "error", err)
+	}
+}
+
+// elementProblem returns why an element cannot be bound, or "" if it is a
+// text element on one of the pages.
+func elementProblem(pages []render.Page, elementID string) string {
+	for _, page := range pages {
+		if obj := render.FindElement(page.Objects, elementID); obj != nil {
+			switch obj["type"] {
+			case "text", "i-text", "textbox":
+				return ""
+			}
+			return errElementNotText
+		}
+	}
+	return errElementMissing
+}
+
+func notifyBroken(ctx context.Context, c connection, broken int) {
+	data, _ := json.Marshal(map[string]string{"projectId": c.projectID, "connectionId": c.id})
+	body := fmt.Sprintf("%d text elements bound to %s can no longer be updated.", broken, c.title)
+	if broken == 1 {
+		body = fmt.Sprintf("A text element bound to %s can no longer be updated.", c.title)
+	}
+	err := notification.Send(ctx, &notification.Message{
+		UserID: c.createdBy,
+		Kind:   "sheets.binding.broken",
+		Title:  "Spreadsheet bindings broke",
+		Body:   body,
+		Link:   fmt.Sprintf("/projects/%s", c.projectID),
+		Data:   data,
+	})
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to send broken binding notification", "connection_id", c.id, "error", err)
+	}
+}
+
+func scanConnections(rows *sqldb.Rows) ([]connection, error) {
+	defer rows.Close()
+	var connections []connection
+	for rows.Next() {
+		var c connection
+		if err := rows.Scan(&c.id, &c.projectID, &c.spreadsheetID, &c.createdBy, &c.title); err != nil {
+			return nil, err
+		}
+		connections = append(connections, c)
+	}
+	return connections, rows.Err()
+}
@@ -0,0 +1,186 @@
+package shopify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/outbound"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// apiVersion is the Admin REST API version the client speaks
+const apiVersion = "2024-07"
+
+// shopifyClient calls the stores' Admin APIs, which are the only hosts it
+// may reach. Shopify allows two REST requests a second per store.
+var shopifyClient = outbound.NewClient(outbound.Policy{
+	Timeout:          60 * time.Second,
+	MaxResponseBytes: 4 << 20,
+	AllowedHosts:     []string{".myshopify.com"},
+	RateLimit:        ratelimit.Limit{Requests: 2, Per: time.Second},
+})
+
+// apiError is an error response from a store
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("shopify: HTTP %d: %s", e.status, e.message)
+}
+
+// notFound reports whether the store answered that something does not
+// exist.
+func notFound(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.status == http.StatusNotFound
+}
+
+// apiErrorResponse turns a failed store call into an API error, passing on
+// Shopify's reason when it rejected the request.
+func apiErrorResponse(ctx context.Context, msg string, err error) error {
+	var e *apiError
+	if errors.As(err, &e) && e.status < 500 {
+		if e.status == http.StatusUnauthorized || e.status == http.StatusForbidden {
+			return &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "Shopify rejected the access token; check it has the read_products and write_products scopes",
+			}
+		}
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Shopify rejected the request: " + e.message,
+		}
+	}
+	reqctx.Logger(ctx).Error(msg, "error", err)
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "Shopify could not be reached",
+	}
+}
+
+// shopName returns the store's name, checking the token works.
+func shopName(ctx context.Context, c *connection) (string, error) {
+	var resp struct {
+		Shop struct {
+			Name string `json:"name"`
+		} `json:"shop"`
+	}
+	err := call(ctx, c, http.MethodGet, "/shop.json?fields=name", nil, &resp)
+	return resp.Shop.Name, err
+}
+
+// productTitle returns a product's title, checking it exists.
+func productTitle(ctx context.Context, c *connection, productID string) (string, error) {
+	var resp struct {
+		Product struct {
+			Title string `json:"title"`
+		} `json:"product"`
+	}
+	err := call(ctx, c, http.MethodGet, "/products/"+productID+".json?fields=id,title", nil, &resp)
+	return resp.Product.Title, err
+}
+
+// createProduct creates a draft product for the images to go on.
+func createProduct(ctx context.Context, c *connection, title string) (string, error) {
+	var resp struct {
+		Product struct {
+			ID int64 `json:"id"`
+		} `json:"product"`
+	}
+	body := map[string]any{"product": map[string]string{"title": title, "status": "draft"}}
+	if err := call(ctx, c, http.MethodPost, "/products.json", body, &resp); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(resp.Product.ID, 10), nil
+}
+
+// addImage uploads an image as a product's first image.
+func addImage(ctx context.Context, c *connection, productID, filename, alt string, data []byte) (string, error) {
+	var resp struct {
+		Image struct {
+			ID int64 `json:"id"`
+		} `json:"image"`
+	}
+	body := map[string]any{"image": map[string]any{
+		"attachment": base64.StdEncoding.EncodeToString(data),
+		"filename":   filename,
+		"alt":        alt,
+		"position":   1,
+	}}
+	if err := call(ctx, c, http.MethodPost, "/products/"+productID+"/images.json", body, &resp); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(resp.Image.ID, 10), nil
+}
+
+// deleteImage deletes a product image; images already gone are ignored.
+func deleteImage(ctx context.Context, c *connection, productID, imageID string) error {
+	err := call(ctx, c, http.MethodDelete, "/products/"+productID+"/images/"+imageID+".json", nil, nil)
+	if notFound(err) {
+		return nil
+	}
+	return err
+}
+
+func call(ctx context.Context, c *connection, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	endpoint := "https://" + c.ShopDomain + "/admin/api/" + apiVersion + path
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Shopify-Access-Token", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := shopifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// errors is a string or an object of messages per field.
+		var e struct {
+			Errors json.RawMessage `json:"errors"`
+		}
+		msg := resp.Status
+		if json.Unmarshal(data, &e) == nil && len(e.Errors) > 0 {
+			var s string
+			if json.Unmarshal(e.Errors, &s) == nil {
+				msg = s
+			} else {
+				msg = string(e.Errors)
+			}
+		}
+		return &apiError{status: resp.StatusCode, message: msg}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
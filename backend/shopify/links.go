@@ -0,0 +1,425 @@
+package shopify
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+
+	"canvasai/asset"
+	"canvasai/export"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+const maxLinksPerProject = 50
+
+// Link statuses
+const (
+	StatusPending = "pending"
+	StatusSynced  = "synced"
+	StatusFailed  = "failed"
+)
+
+// productID matches a Shopify product ID
+var productID = regexp.MustCompile(`^[0-9]{1,20}$`)
+
+// Link publishes a project's exports of a preset to a store's product
+type Link struct {
+	ID           string `json:"id"`
+	ProjectID    string `json:"projectId"`
+	ConnectionID string `json:"connectionId"`
+	ShopDomain   string `json:"shopDomain"`
+	ProductID    string `json:"productId"`
+	ProductTitle string `json:"productTitle"`
+	Preset       string `json:"preset"`
+	// AutoSync publishes each new export of the preset as it completes
+	AutoSync bool `json:"autoSync"`
+	// ImageIDs are the product images the last sync added
+	ImageIDs       []string   `json:"imageIds"`
+	SyncedExportID string     `json:"syncedExportId,omitempty"`
+	Status         string     `json:"status"`
+	LastError      string     `json:"lastError,omitempty"`
+	SyncedAt       *time.Time `json:"syncedAt,omitempty"`
+	CreatedBy      string     `json:"createdBy,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+// CreateLinkRequest represents the create link request. It names an
+// existing product, or a title for a new draft product.
+type CreateLinkRequest struct {
+	ConnectionID    string `json:"connectionId"`
+	ProductID       string `json:"productId,omitempty"`
+	NewProductTitle string `json:"newProductTitle,omitempty"`
+	Preset          string `json:"preset"`
+	// AutoSync defaults to true
+	AutoSync *bool `json:"autoSync,omitempty"`
+}
+
+// ListLinksResponse represents the list links response
+type ListLinksResponse struct {
+	Links []Link `json:"links"`
+}
+
+// CreateLink links a project to a product of one of the caller's stores.
+// When the preset already has a completed image export it is published
+// straight away.
+//
+//encore:api auth method=POST path=/projects/:id/shopify-links
+func CreateLink(ctx context.Context, id string, req *CreateLinkRequest) (*Link, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	userID := auth.UserID()
+	preset := strings.TrimSpace(req.Preset)
+	if preset == "" || len(preset) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Preset is required and must be at most 100 characters",
+		}
+	}
+	title := strings.TrimSpace(req.NewProductTitle)
+	if (req.ProductID == "") == (title == "") {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Provide either a product ID or a title for a new product",
+		}
+	}
+	if req.ProductID != "" && !productID.MatchString(req.ProductID) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid product ID",
+		}
+	}
+	if len(title) > 255 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Product title must be at most 255 characters",
+		}
+	}
+
+	c, err := getConnection(ctx, req.ConnectionID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM shopify_product_links WHERE project_id = $1`, id).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count shopify links", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to link product",
+		}
+	}
+	if count >= maxLinksPerProject {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "A project can be linked to up to 50 products",
+		}
+	}
+
+	l := &Link{
+		ProjectID:    id,
+		ConnectionID: c.ID,
+		ShopDomain:   c.ShopDomain,
+		ProductID:    req.ProductID,
+		ProductTitle: title,
+		Preset:       preset,
+		AutoSync:     req.AutoSync == nil || *req.AutoSync,
+		ImageIDs:     []string{},
+		Status:       StatusPending,
+		CreatedBy:    userID,
+	}
+	if l.ProductID != "" {
+		l.ProductTitle, err = productTitle(ctx, c, l.ProductID)
+		if notFound(err) {
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "Product not found in this store",
+			}
+		} else if err != nil {
+			return nil, apiErrorResponse(ctx, "failed to fetch shopify product", err)
+		}
+	} else if l.ProductID, err = createProduct(ctx, c, title); err != nil {
+		return nil, apiErrorResponse(ctx, "failed to create shopify product", err)
+	}
+
+	err = db.QueryRow(ctx, `
+		INSERT INTO shopify_product_links (project_id, connection_id, product_id, product_title, preset, auto_sync, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (project_id, connection_id, product_id, preset) DO NOTHING
+		RETURNING id, created_at
+	`, id, c.ID, l.ProductID, l.ProductTitle, l.Preset, l.AutoSync, userID).Scan(&l.ID, &l.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "This product is already linked to the preset",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create shopify link", "project_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to link product",
+		}
+	}
+	reqctx.Logger(ctx).Info("shopify product linked", "link_id", l.ID, "project_id", id, "product_id", l.ProductID)
+
+	exportID, assetID, err := latestExport(ctx, id, preset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find shopify link export", "link_id", l.ID, "error", err)
+	} else if exportID != "" {
+		// A failed first sync is recorded on the link and can be retried.
+		syncLink(ctx, c, l, exportID, assetID)
+	}
+	return l, nil
+}
+
+//encore:api auth method=GET path=/projects/:id/shopify-links
+func ListLinks(ctx context.Context, id string) (*ListLinksResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, linkColumns+` WHERE l.project_id = $1 ORDER BY l.created_at`, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch links",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListLinksResponse{Links: []Link{}}
+	for rows.Next() {
+		l, err := scanLink(rows)
+		if err != nil {
+			continue
+		}
+		resp.Links = append(resp.Links, *l)
+	}
+	return resp, nil
+}
+
+// SyncLink publishes the preset's latest completed image export to the
+// product now. Only the person who connected the store can sync to it.
+//
+//encore:api auth method=POST path=/projects/:id/shopify-links/:linkID/sync
+func SyncLink(ctx context.Context, id, linkID string) (*Link, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	l, err := getLink(ctx, id, linkID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := getConnection(ctx, l.ConnectionID, auth.UserID())
+	if errs.Code(err) == errs.NotFound {
+		return nil, &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only the person who connected this store can sync to it",
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	exportID, assetID, err := latestExport(ctx, id, l.Preset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to find shopify link export", "link_id", l.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to sync product",
+		}
+	}
+	if exportID == "" {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "The preset has no completed image export to publish",
+		}
+	}
+	if err := syncLink(ctx, c, l, exportID, assetID); err != nil {
+		return nil, apiErrorResponse(ctx, "failed to sync shopify product", err)
+	}
+	return l, nil
+}
+
+// DeleteLink unlinks a product. Images already published are left on it.
+//
+//encore:api auth method=DELETE path=/projects/:id/shopify-links/:linkID
+func DeleteLink(ctx context.Context, id, linkID string) error {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return err
+	}
+	result, err := db.Exec(ctx, `
+		DELETE FROM shopify_product_links WHERE id::text = $1 AND project_id = $2
+	`, linkID, id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete shopify link", "link_id", linkID, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to unlink product",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Link not found",
+		}
+	}
+	return nil
+}
+
+var _ = pubsub.NewSubscription(export.Completions, "sync-shopify-on-export", pubsub.SubscriptionConfig[*export.CompletedExport]{
+	Handler: syncCompletedExport,
+})
+
+// syncCompletedExport publishes a completed image export, including a
+// regenerated one, to the products linked to its preset with auto-sync on.
+// Failures are recorded on each link rather than retried, since retrying
+// would publish again to the links that succeeded.
+func syncCompletedExport(ctx context.Context, msg *export.CompletedExport) error {
+	if msg.Preset == "" || !publishable(msg.MimeType) {
+		return nil
+	}
+	rows, err := db.Query(ctx, linkColumns+`
+		WHERE l.project_id = $1 AND l.preset = $2 AND l.auto_sync
+			AND l.synced_export_id IS DISTINCT FROM $3::uuid
+	`, msg.ProjectID, msg.Preset, msg.JobID)
+	if err != nil {
+		return err
+	}
+	var links []*Link
+	for rows.Next() {
+		l, err := scanLink(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+
+	for _, l := range links {
+		log := reqctx.Logger(ctx).With("link_id", l.ID, "export_id", msg.JobID)
+		c, err := getConnection(ctx, l.ConnectionID, "")
+		if err != nil {
+			log.Error("failed to load shopify connection for sync", "error", err)
+			continue
+		}
+		if err := syncLink(ctx, c, l, msg.JobID, msg.AssetID); err != nil {
+			log.Warn("shopify auto-sync failed", "error", err)
+		}
+	}
+	return nil
+}
+
+// syncLink adds an export's image to the product, then removes the images
+// the previous sync added, and records the outcome on l.
+func syncLink(ctx context.Context, c *connection, l *Link, exportID, assetID string) error {
+	log := reqctx.Logger(ctx).With("link_id", l.ID, "export_id", exportID)
+	imageID, err := publishImage(ctx, c, l, assetID)
+	if err != nil {
+		l.Status, l.LastError = StatusFailed, err.Error()
+		if _, dbErr := db.Exec(ctx, `
+			UPDATE shopify_product_links SET status = $2, last_error = $3 WHERE id = $1
+		`, l.ID, l.Status, l.LastError); dbErr != nil {
+			log.Error("failed to record shopify sync failure", "error", dbErr)
+		}
+		return err
+	}
+
+	// A stale image left behind is only untidy, so keep going.
+	for _, old := range l.ImageIDs {
+		if err := deleteImage(ctx, c, l.ProductID, old); err != nil {
+			log.Warn("failed to remove previous shopify image", "image_id", old, "error", err)
+		}
+	}
+	now := time.Now()
+	l.ImageIDs, l.SyncedExportID, l.Status, l.LastError, l.SyncedAt = []string{imageID}, exportID, StatusSynced, "", &now
+	_, err = db.Exec(ctx, `
+		UPDATE shopify_product_links
+		SET image_ids = $2, synced_export_id = $3, status = $4, last_error = NULL, synced_at = $5
+		WHERE id = $1
+	`, l.ID, l.ImageIDs, exportID, l.Status, now)
+	if err != nil {
+		// Without the image ID the next sync cannot replace this image.
+		log.Error("failed to record shopify sync", "image_id", imageID, "error", err)
+		return err
+	}
+	log.Info("shopify product synced", "product_id", l.ProductID, "image_id", imageID)
+	return nil
+}
+
+// publishImage uploads an export's artifact as the product's first image.
+func publishImage(ctx context.Context, c *connection, l *Link, assetID string) (string, error) {
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		return "", err
+	}
+	filename := l.Preset + path.Ext(data.Asset.Filename)
+	return addImage(ctx, c, l.ProductID, filename, l.ProductTitle, data.Data)
+}
+
+// latestExport returns the project's most recent completed image export of
+// a preset whose artifact is still kept, or empty IDs if there is none.
+func latestExport(ctx context.Context, projectID, preset string) (exportID, assetID string, err error) {
+	err = db.QueryRow(ctx, `
+		SELECT j.id, j.artifact_asset_id
+		FROM export_jobs j
+		JOIN assets a ON a.id = j.artifact_asset_id
+		WHERE j.project_id = $1 AND j.preset = $2 AND j.status = 'completed' AND j.purged_at IS NULL
+			AND a.mime_type IN ('image/png', 'image/jpeg')
+		ORDER BY j.completed_at DESC
+		LIMIT 1
+	`, projectID, preset).Scan(&exportID, &assetID)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return exportID, assetID, err
+}
+
+// publishable reports whether Shopify accepts the MIME type as a product
+// image.
+func publishable(mimeType string) bool {
+	return mimeType == "image/png" || mimeType == "image/jpeg"
+}
+
+const linkColumns = `
+	SELECT l.id, l.project_id, l.connection_id, c.shop_domain, l.product_id, l.product_title, l.preset,
+		l.auto_sync, l.image_ids, COALESCE(l.synced_export_id::text, ''), l.status, COALESCE(l.last_error, ''),
+		l.synced_at, COALESCE(l.created_by::text, ''), l.created_at
+	FROM shopify_product_links l
+	JOIN shopify_connections c ON c.id = l.connection_id`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanLink(row scanner) (*Link, error) {
+	l := &Link{}
+	err := row.Scan(&l.ID, &l.ProjectID, &l.ConnectionID, &l.ShopDomain, &l.ProductID, &l.ProductTitle, &l.Preset,
+		&l.AutoSync, &l.ImageIDs, &l.SyncedExportID, &l.Status, &l.LastError,
+		&l.SyncedAt, &l.CreatedBy, &l.CreatedAt)
+	return l, err
+}
+
+func getLink(ctx context.Context, projectID, linkID string) (*Link, error) {
+	l, err := scanLink(db.QueryRow(ctx, linkColumns+` WHERE l.id::text = $1 AND l.project_id = $2`, linkID, projectID))
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Link not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load shopify link", "link_id", linkID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load link",
+		}
+	}
+	return l, nil
+}
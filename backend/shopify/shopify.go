@@ -0,0 +1,243 @@
+// Package shopify publishes exported product imagery to Shopify stores. A
+// user connects a store with an Admin API access token from a custom app;
+// a project is then linked to products of that store, each through an
+// export preset. Syncing a link adds the preset's latest export to the
+// product's images and removes the image the previous sync added. Links
+// sync on their own whenever a new export of their preset completes, such
+// as when it is regenerated (see links.go).
+package shopify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+	"canvasai/tokenbox"
+)
+
+var secrets struct {
+	// ShopifyTokenKey is a base64-encoded 32-byte key that seals the stores'
+	// access tokens at rest.
+	ShopifyTokenKey string
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+// Connections and links are stored alongside the projects they publish.
+var db = sqldb.Named("project")
+
+// maxConnectionsPerUser bounds the stores a user can connect
+const maxConnectionsPerUser = 10
+
+// shopDomain matches a store's myshopify.com domain
+var shopDomain = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}\.myshopify\.com$`)
+
+// Connection is a Shopify store a user has connected
+type Connection struct {
+	ID         string    `json:"id"`
+	ShopDomain string    `json:"shopDomain"`
+	ShopName   string    `json:"shopName"`
+	Links      int       `json:"links"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ConnectStoreRequest represents the connect store request
+type ConnectStoreRequest struct {
+	// Shop is the store's myshopify.com domain or admin URL, or just its
+	// handle
+	Shop string `json:"shop"`
+	// AccessToken is an Admin API access token with the read_products and
+	// write_products scopes. It is never returned.
+	AccessToken string `json:"accessToken"`
+}
+
+// ListConnectionsResponse represents the list connections response
+type ListConnectionsResponse struct {
+	Connections []Connection `json:"connections"`
+}
+
+//encore:api auth method=POST path=/shopify/connections
+func ConnectStore(ctx context.Context, req *ConnectStoreRequest) (*Connection, error) {
+	userID := auth.UserID()
+	domain, ok := normalizeShop(req.Shop)
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Shop must be a myshopify.com domain, such as example.myshopify.com",
+		}
+	}
+	token := strings.TrimSpace(req.AccessToken)
+	if token == "" || len(token) > 512 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "An access token is required",
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM shopify_connections WHERE user_id = $1`, userID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count shopify connections", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect store",
+		}
+	}
+	if count >= maxConnectionsPerUser {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "You can connect up to 10 stores",
+		}
+	}
+
+	c := &connection{Connection: Connection{ShopDomain: domain}, token: token}
+	name, err := shopName(ctx, c)
+	if err != nil {
+		return nil, apiErrorResponse(ctx, "failed to verify shopify store", err)
+	}
+	c.ShopName = name
+
+	sealed, err := tokenbox.Seal(secrets.ShopifyTokenKey, token)
+	if errors.Is(err, tokenbox.ErrNoKey) {
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Shopify is not configured",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to seal shopify token", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect store",
+		}
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO shopify_connections (user_id, shop_domain, shop_name, token_ciphertext)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, shop_domain) DO UPDATE
+		SET shop_name = EXCLUDED.shop_name, token_ciphertext = EXCLUDED.token_ciphertext
+		RETURNING id, created_at
+	`, userID, c.ShopDomain, c.ShopName, sealed).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create shopify connection", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect store",
+		}
+	}
+
+	reqctx.Logger(ctx).Info("shopify store connected", "connection_id", c.ID, "shop", c.ShopDomain)
+	return &c.Connection, nil
+}
+
+//encore:api auth method=GET path=/shopify/connections
+func ListConnections(ctx context.Context) (*ListConnectionsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.shop_domain, c.shop_name, c.created_at,
+			(SELECT COUNT(*) FROM shopify_product_links l WHERE l.connection_id = c.id)
+		FROM shopify_connections c
+		WHERE c.user_id = $1
+		ORDER BY c.created_at
+	`, auth.UserID())
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch connections",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListConnectionsResponse{Connections: []Connection{}}
+	for rows.Next() {
+		var c Connection
+		if err := rows.Scan(&c.ID, &c.ShopDomain, &c.ShopName, &c.CreatedAt, &c.Links); err != nil {
+			continue
+		}
+		resp.Connections = append(resp.Connections, c)
+	}
+	return resp, nil
+}
+
+// DisconnectStore removes a connection and its product links. Images
+// already published are left on the products.
+//
+//encore:api auth method=DELETE path=/shopify/connections/:id
+func DisconnectStore(ctx context.Context, id string) error {
+	result, err := db.Exec(ctx, `
+		DELETE FROM shopify_connections WHERE id::text = $1 AND user_id = $2
+	`, id, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete shopify connection", "connection_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to disconnect store",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Connection not found",
+		}
+	}
+	reqctx.Logger(ctx).Info("shopify store disconnected", "connection_id", id)
+	return nil
+}
+
+// connection is a Connection with the token to call the store
+type connection struct {
+	Connection
+	token string
+}
+
+// getConnection loads a connection owned by userID, or any connection when
+// userID is empty.
+func getConnection(ctx context.Context, id, userID string) (*connection, error) {
+	c := &connection{}
+	var sealed []byte
+	err := db.QueryRow(ctx, `
+		SELECT id, shop_domain, shop_name, token_ciphertext, created_at
+		FROM shopify_connections
+		WHERE id::text = $1 AND ($2 = '' OR user_id::text = $2)
+	`, id, userID).Scan(&c.ID, &c.ShopDomain, &c.ShopName, &sealed, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Connection not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load shopify connection", "connection_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load connection",
+		}
+	}
+	if c.token, err = tokenbox.Open(secrets.ShopifyTokenKey, sealed); err != nil {
+		reqctx.Logger(ctx).Error("failed to open shopify token", "connection_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load connection",
+		}
+	}
+	return c, nil
+}
+
+// normalizeShop turns a shop handle, domain or admin URL into its
+// myshopify.com domain.
+func normalizeShop(shop string) (string, bool) {
+	shop = strings.ToLower(strings.TrimSpace(shop))
+	if u, err := url.Parse(shop); err == nil && u.Host != "" {
+		shop = u.Host
+	}
+	if !strings.Contains(shop, ".") {
+		shop += ".myshopify.com"
+	}
+	return shop, shopDomain.MatchString(shop)
+}
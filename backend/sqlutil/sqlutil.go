@@ -0,0 +1,13 @@
+// Package sqlutil holds helpers for building SQL from user input that are
+// shared by services querying their own databases.
+package sqlutil
+
+import "strings"
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes the LIKE wildcards in user input, so that it matches
+// only itself inside a pattern.
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,126 @@
+package template
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Template categories are managed by platform admins.
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// CreateCategoryRequest represents the create category request
+type CreateCategoryRequest struct {
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+}
+
+// UpdateCategoryRequest represents the update category request
+type UpdateCategoryRequest struct {
+	Name     *string `json:"name,omitempty"`
+	Position *int    `json:"position,omitempty"`
+}
+
+//encore:api auth method=POST path=/admin/templates/categories
+func CreateCategory(ctx context.Context, req *CreateCategoryRequest) (*Category, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	c := &Category{Slug: strings.TrimSpace(req.Slug), Name: strings.TrimSpace(req.Name), Position: req.Position}
+	if !slugPattern.MatchString(c.Slug) || len(c.Slug) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Slug must be lowercase letters, digits and hyphens",
+		}
+	}
+	if c.Name == "" || len([]rune(c.Name)) > 100 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Name must be between 1 and 100 characters",
+		}
+	}
+	err := db.QueryRow(ctx, `
+		INSERT INTO template_categories (slug, name, position)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (slug) DO NOTHING
+		RETURNING id
+	`, c.Slug, c.Name, c.Position).Scan(&c.ID)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "A category with this slug already exists",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to create template category", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create category",
+		}
+	}
+	return c, nil
+}
+
+//encore:api auth method=PATCH path=/admin/templates/categories/:id
+func UpdateCategory(ctx context.Context, id string, req *UpdateCategoryRequest) (*Category, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len([]rune(name)) > 100 {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Name must be between 1 and 100 characters",
+			}
+		}
+		req.Name = &name
+	}
+
+	var c Category
+	err := db.QueryRow(ctx, `
+		UPDATE template_categories
+		SET name = COALESCE($2, name), position = COALESCE($3, position)
+		WHERE id::text = $1
+		RETURNING id, slug, name, position,
+			(SELECT COUNT(*) FROM templates WHERE category_id = template_categories.id AND visibility = 'public')
+	`, id, req.Name, req.Position).Scan(&c.ID, &c.Slug, &c.Name, &c.Position, &c.Templates)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Category not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to update template category", "category_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update category",
+		}
+	}
+	return &c, nil
+}
+
+// DeleteCategory removes a category; its templates stay in the library
+// without one.
+//
+//encore:api auth method=DELETE path=/admin/templates/categories/:id
+func DeleteCategory(ctx context.Context, id string) error {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM template_categories WHERE id::text = $1`, id); err != nil {
+		reqctx.Logger(ctx).Error("failed to delete template category", "category_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete category",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package template
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/asset"
+	"canvasai/permissions"
+	"canvasai/project"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Users publish templates from projects they can share. Publishing takes a
+// copy of the project's canvas and assets, so later edits to the project or
+// its deletion leave the template as it was. A template is either public or
+// visible to the members of the project's organization. Marking a template
+// curated, which features it in the library, is up to platform admins.
+
+const (
+	maxTitleLength       = 255
+	maxDescriptionLength = 2000
+	maxTags              = 20
+	maxTagLength         = 50
+)
+
+// thumbnailTypes are the image types a template preview can be
+var thumbnailTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+}
+
+// PublishTemplateRequest represents the publish template request
+type PublishTemplateRequest struct {
+	ProjectID string `json:"projectId"`
+	// Title, Description and Tags default to the project's
+	Title       string   `json:"title,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	CategoryID  string   `json:"categoryId,omitempty"`
+	// Visibility is public (the default) or org, for the members of the
+	// project's organization
+	Visibility string `json:"visibility,omitempty"`
+	// ThumbnailAssetID is an image the user can view, shown as the preview
+	ThumbnailAssetID string `json:"thumbnailAssetId,omitempty"`
+	// Curated features the template; platform admins only
+	Curated bool `json:"curated,omitempty"`
+}
+
+// UpdateTemplateRequest represents the update template request. Fields
+// left out are unchanged.
+type UpdateTemplateRequest struct {
+	Title       *string   `json:"title,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Tags        *[]string `json:"tags,omitempty"`
+	CategoryID  *string   `json:"categoryId,omitempty"` // empty removes the category
+	Curated     *bool     `json:"curated,omitempty"`
+}
+
+// PublishTemplate publishes a template from a project the user can share.
+//
+//encore:api auth method=POST path=/templates
+func PublishTemplate(ctx context.Context, req *PublishTemplateRequest) (*Template, error) {
+	userID := auth.UserID()
+	if err := projectaccess.RequireRole(ctx, req.ProjectID, permissions.RoleOwner); err != nil {
+		return nil, err
+	}
+	visibility := req.Visibility
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	if visibility != VisibilityPublic && visibility != VisibilityOrg {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "visibility must be public or org",
+		}
+	}
+	if req.Curated {
+		if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCategory(ctx, req.CategoryID); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := project.SnapshotForTemplate(ctx, req.ProjectID, &project.TemplateSnapshotRequest{
+		Public: visibility == VisibilityPublic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Everything copied so far is dropped if publishing fails.
+	published := false
+	var thumbnailID *string
+	defer func() {
+		if !published {
+			deleteAssets(ctx, snapshot.AssetIDs, thumbnailID)
+		}
+	}()
+
+	var orgID *string
+	if visibility == VisibilityOrg {
+		if snapshot.OrgID == nil {
+			return nil, &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "Only organization projects can be published to an organization",
+			}
+		}
+		if _, err := permissions.RequireOrgRole(ctx, db, *snapshot.OrgID, "admin", "member"); err != nil {
+			return nil, err
+		}
+		orgID = snapshot.OrgID
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = snapshot.Title
+	}
+	if err := validateTitle(title); err != nil {
+		return nil, err
+	}
+	description := snapshot.Description
+	if req.Description != nil {
+		description = strings.TrimSpace(*req.Description)
+	}
+	if len([]rune(description)) > maxDescriptionLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Description must be at most 2000 characters",
+		}
+	}
+	if req.Tags == nil {
+		if tags, err = normalizeTags(snapshot.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.ThumbnailAssetID != "" {
+		if thumbnailID, err = copyThumbnail(ctx, req.ThumbnailAssetID); err != nil {
+			return nil, err
+		}
+	}
+
+	var id string
+	err = db.QueryRow(ctx, `
+		INSERT INTO templates (category_id, title, description, tags, curated, visibility, org_id, canvas_data,
+			canvas_width, canvas_height, color_profile, asset_ids, thumbnail_asset_id, source_project_id, created_by)
+		VALUES (NULLIF($1, '')::uuid, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING id
+	`, req.CategoryID, title, description, tags, req.Curated, visibility, orgID, []byte(snapshot.CanvasData),
+		snapshot.CanvasWidth, snapshot.CanvasHeight, snapshot.ColorProfile, snapshot.AssetIDs, thumbnailID,
+		req.ProjectID, userID).Scan(&id)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to publish template", "project_id", req.ProjectID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to publish template",
+		}
+	}
+	published = true
+	reqctx.Logger(ctx).Info("template published", "template_id", id, "project_id", req.ProjectID, "visibility", visibility)
+	return getTemplate(ctx, id)
+}
+
+// UpdateTemplate changes a template's details. Its creator and platform
+// admins can update it; only admins can change whether it is curated.
+//
+//encore:api auth method=PATCH path=/templates/:id
+func UpdateTemplate(ctx context.Context, id string, req *UpdateTemplateRequest) (*Template, error) {
+	t, err := getTemplate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if req.Curated != nil || t.CreatedBy == nil || *t.CreatedBy != auth.UserID() {
+		if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if err := validateTitle(title); err != nil {
+			return nil, err
+		}
+		req.Title = &title
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if len([]rune(description)) > maxDescriptionLength {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Description must be at most 2000 characters",
+			}
+		}
+		req.Description = &description
+	}
+	var tags []string
+	if req.Tags != nil {
+		if tags, err = normalizeTags(*req.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if req.CategoryID != nil {
+		if err := checkCategory(ctx, *req.CategoryID); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE templates SET
+			title = COALESCE($2, title),
+			description = COALESCE($3, description),
+			tags = CASE WHEN $4 THEN $5 ELSE tags END,
+			category_id = CASE WHEN $6::text IS NULL THEN category_id ELSE NULLIF($6, '')::uuid END,
+			curated = COALESCE($7, curated),
+			updated_at = NOW()
+		WHERE id = $1
+	`, t.ID, req.Title, req.Description, req.Tags != nil, tags, req.CategoryID, req.Curated)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update template", "template_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update template",
+		}
+	}
+	return getTemplate(ctx, t.ID)
+}
+
+// DeleteTemplate removes a template and its copies of the assets. Projects
+// started from it are unaffected. Its creator, admins of its organization
+// and platform admins can delete it.
+//
+//encore:api auth method=DELETE path=/templates/:id
+func DeleteTemplate(ctx context.Context, id string) error {
+	t, err := getTemplate(ctx, id)
+	if err != nil {
+		return err
+	}
+	if t.CreatedBy == nil || *t.CreatedBy != auth.UserID() {
+		allowed := false
+		if t.OrgID != nil {
+			_, err := permissions.RequireOrgRole(ctx, db, *t.OrgID, "admin")
+			allowed = err == nil
+		}
+		if !allowed {
+			if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+				return err
+			}
+		}
+	}
+
+	var assetIDs []string
+	var thumbnailID *string
+	err = db.QueryRow(ctx, `
+		DELETE FROM templates WHERE id = $1 RETURNING asset_ids, thumbnail_asset_id
+	`, t.ID).Scan(&assetIDs, &thumbnailID)
+	if err != nil && err != sql.ErrNoRows {
+		reqctx.Logger(ctx).Error("failed to delete template", "template_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete template",
+		}
+	}
+	deleteAssets(ctx, assetIDs, thumbnailID)
+	reqctx.Logger(ctx).Info("template deleted", "template_id", t.ID)
+	return nil
+}
+
+// copyThumbnail stores a public copy of an image the user can view, so
+// everyone who can see the template can see its preview.
+func copyThumbnail(ctx context.Context, assetID string) (*string, error) {
+	if err := permissions.Authorize(ctx, permissions.Asset(assetID), permissions.AssetView); err != nil {
+		return nil, err
+	}
+	src, err := asset.Read(ctx, assetID)
+	if err != nil {
+		return nil, err
+	}
+	if !thumbnailTypes[src.Asset.MimeType] {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Thumbnail must be a PNG, JPEG or WebP image",
+		}
+	}
+	stored, err := asset.Store(ctx, &asset.StoreRequest{
+		UserID:   auth.UserID(),
+		Filename: src.Asset.Filename,
+		MimeType: src.Asset.MimeType,
+		Data:     src.Data,
+		Width:    src.Asset.Width,
+		Height:   src.Asset.Height,
+		AltText:  src.Asset.AltText,
+		Public:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stored.ID, nil
+}
+
+// deleteAssets deletes a template's copies of its assets. Failures are
+// logged; the copies are no longer referenced.
+func deleteAssets(ctx context.Context, assetIDs []string, thumbnailID *string) {
+	if thumbnailID != nil {
+		assetIDs = append(assetIDs, *thumbnailID)
+	}
+	for _, id := range assetIDs {
+		if err := asset.Delete(ctx, id); err != nil {
+			reqctx.Logger(ctx).Warn("failed to delete template asset", "asset_id", id, "error", err)
+		}
+	}
+}
+
+// checkCategory returns an error unless id is empty or a category.
+func checkCategory(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+	var exists bool
+	err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM template_categories WHERE id::text = $1)`, id).Scan(&exists)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to check template category", "category_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check category",
+		}
+	}
+	if !exists {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Category not found",
+		}
+	}
+	return nil
+}
+
+func validateTitle(title string) error {
+	if title == "" || len([]rune(title)) > maxTitleLength {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Title must be between 1 and 255 characters",
+		}
+	}
+	return nil
+}
+
+// normalizeTags trims, lowercases and dedupes tags.
+func normalizeTags(tags []string) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len([]rune(tag)) > maxTagLength {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Tags must be at most 50 characters",
+			}
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	if len(out) > maxTags {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "A template can have at most 20 tags",
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,339 @@
+// Package template serves the project templates library: curated templates
+// managed by platform admins and templates users publish from their own
+// projects, to everyone or to their organization (see publish.go). Users
+// browse templates by category, preview them by their thumbnail, and start
+// new projects from them.
+package template
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/canvasrefs"
+	"canvasai/project"
+	"canvasai/reqctx"
+)
+
+// Templates are stored alongside the projects they are made from.
+var db = sqldb.Named("project")
+
+// Template visibilities
+const (
+	VisibilityPublic = "public"
+	VisibilityOrg    = "org"
+)
+
+const (
+	defaultPageSize      = 24
+	maxPageSize          = 100
+	maxSearchQueryLength = 100
+)
+
+// Category groups templates
+type Category struct {
+	ID       string `json:"id"`
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+	// Templates counts the public templates in the category
+	Templates int `json:"templates"`
+}
+
+// Template is a starting point for new projects
+type Template struct {
+	ID           string   `json:"id"`
+	Title        string   `json:"title"`
+	Description  string   `json:"description,omitempty"`
+	CategoryID   *string  `json:"categoryId,omitempty"`
+	Tags         []string `json:"tags"`
+	Curated      bool     `json:"curated"`
+	Visibility   string   `json:"visibility"`
+	OrgID        *string  `json:"orgId,omitempty"`
+	CanvasWidth  int      `json:"canvasWidth"`
+	CanvasHeight int      `json:"canvasHeight"`
+	ColorProfile string   `json:"colorProfile"`
+	// ThumbnailURL serves the preview image, if the template has one
+	ThumbnailURL string    `json:"thumbnailUrl,omitempty"`
+	CreatedBy    *string   `json:"createdBy,omitempty"`
+	Uses         int       `json:"uses"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+
+	// CanvasData is only returned for a single template
+	CanvasData json.RawMessage `json:"canvasData,omitempty"`
+}
+
+// ListCategoriesResponse represents the list categories response
+type ListCategoriesResponse struct {
+	Categories []Category `json:"categories"`
+}
+
+// ListTemplatesRequest represents a template browse or search
+type ListTemplatesRequest struct {
+	// Query searches titles, tags and descriptions
+	Query    string `query:"q"`
+	Category string `query:"category"` // category slug
+	// Source is curated, community or mine
+	Source string `query:"source"`
+	// OrgID lists only an organization's templates
+	OrgID string `query:"orgId"`
+	// Sort is popular (the default) or recent
+	Sort   string `query:"sort"`
+	Limit  int    `query:"limit"`
+	Offset int    `query:"offset"`
+}
+
+// ListTemplatesResponse represents a page of templates
+type ListTemplatesResponse struct {
+	Templates []Template `json:"templates"`
+	Total     int        `json:"total"`
+	Limit     int        `json:"limit"`
+	Offset    int        `json:"offset"`
+}
+
+// UseTemplateRequest represents the use template request
+type UseTemplateRequest struct {
+	// Title defaults to the template's title
+	Title string `json:"title,omitempty"`
+	// OrgID creates the project in an organization the user belongs to
+	OrgID string `json:"orgId,omitempty"`
+}
+
+// ListCategories returns the template categories in display order.
+//
+//encore:api auth method=GET path=/templates/categories
+func ListCategories(ctx context.Context) (*ListCategoriesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.slug, c.name, c.position, COUNT(t.id)
+		FROM template_categories c
+		LEFT JOIN templates t ON t.category_id = c.id AND t.visibility = 'public'
+		GROUP BY c.id
+		ORDER BY c.position, c.name
+	`)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list template categories", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list categories",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListCategoriesResponse{Categories: []Category{}}
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Slug, &c.Name, &c.Position, &c.Templates); err != nil {
+			continue
+		}
+		resp.Categories = append(resp.Categories, c)
+	}
+	return resp, nil
+}
+
+// ListTemplates browses the templates the user can use: public templates
+// and those of the user's organizations. With q set it searches them, best
+// matches first.
+//
+//encore:api auth method=GET path=/templates
+func ListTemplates(ctx context.Context, req *ListTemplatesRequest) (*ListTemplatesResponse, error) {
+	userID := auth.UserID()
+	q := strings.TrimSpace(req.Query)
+	if len(q) > maxSearchQueryLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Search query is too long",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxPageSize {
+		limit = defaultPageSize
+	}
+	offset := max(req.Offset, 0)
+
+	args := []any{userID}
+	filter := `WHERE ` + visibleTo(1)
+	switch req.Source {
+	case "":
+	case "curated":
+		filter += ` AND t.curated`
+	case "community":
+		filter += ` AND NOT t.curated`
+	case "mine":
+		filter += ` AND t.created_by = $1`
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "source must be curated, community or mine",
+		}
+	}
+	if req.OrgID != "" {
+		args = append(args, req.OrgID)
+		filter += fmt.Sprintf(` AND t.org_id::text = $%d`, len(args))
+	}
+	if req.Category != "" {
+		args = append(args, req.Category)
+		filter += fmt.Sprintf(` AND c.slug = $%d`, len(args))
+	}
+	var order string
+	switch req.Sort {
+	case "", "popular":
+		order = `t.uses DESC, t.created_at DESC, t.id`
+	case "recent":
+		order = `t.created_at DESC, t.id`
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "sort must be popular or recent",
+		}
+	}
+	if q != "" {
+		args = append(args, q)
+		filter += fmt.Sprintf(` AND t.search_vector @@ websearch_to_tsquery('english', $%d)`, len(args))
+		order = fmt.Sprintf(`ts_rank_cd(t.search_vector, websearch_to_tsquery('english', $%d)) DESC, `, len(args)) + order
+	}
+	from := `
+		FROM templates t
+		LEFT JOIN template_categories c ON c.id = t.category_id
+		` + filter
+
+	resp := &ListTemplatesResponse{Templates: []Template{}, Limit: limit, Offset: offset}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*)`+from, args...).Scan(&resp.Total); err != nil {
+		reqctx.Logger(ctx).Error("failed to count templates", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list templates",
+		}
+	}
+	if resp.Total == 0 {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, fmt.Sprintf(`
+		SELECT %s %s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, templateColumns, from, order, len(args)+1, len(args)+2), append(args, limit, offset)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list templates", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to list templates",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			continue
+		}
+		resp.Templates = append(resp.Templates, *t)
+	}
+	return resp, nil
+}
+
+// GetTemplate returns a template the user can use, with its canvas.
+//
+//encore:api auth method=GET path=/templates/:id
+func GetTemplate(ctx context.Context, id string) (*Template, error) {
+	t, err := getTemplate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow(ctx, `SELECT canvas_data FROM templates WHERE id = $1`, t.ID).Scan(&t.CanvasData)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to load template canvas", "template_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load template",
+		}
+	}
+	return t, nil
+}
+
+// UseTemplate starts a new project for the user from a template. The
+// canvas and its assets are copied, so the project is unaffected by later
+// changes to the template or its removal.
+//
+//encore:api auth method=POST path=/projects/from-template/:id
+func UseTemplate(ctx context.Context, id string, req *UseTemplateRequest) (*project.CopyProjectResponse, error) {
+	t, err := GetTemplate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = t.Title
+	}
+
+	resp, err := project.CreateFromTemplate(ctx, &project.CreateFromTemplateRequest{
+		TemplateID:   t.ID,
+		Title:        title,
+		Description:  t.Description,
+		Tags:         t.Tags,
+		CanvasData:   t.CanvasData,
+		CanvasWidth:  t.CanvasWidth,
+		CanvasHeight: t.CanvasHeight,
+		ColorProfile: t.ColorProfile,
+		OrgID:        req.OrgID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(ctx, `UPDATE templates SET uses = uses + 1 WHERE id = $1`, t.ID); err != nil {
+		reqctx.Logger(ctx).Warn("failed to count template use", "template_id", t.ID, "error", err)
+	}
+	return resp, nil
+}
+
+// visibleTo is the condition for templates the user in parameter n can
+// use.
+func visibleTo(n int) string {
+	return fmt.Sprintf(`(t.visibility = 'public' OR t.org_id IN (
+		SELECT org_id FROM organization_members WHERE user_id = $%d))`, n)
+}
+
+const templateColumns = `t.id, t.title, t.description, t.category_id, t.tags, t.curated, t.visibility, t.org_id,
+	t.canvas_width, t.canvas_height, t.color_profile, t.thumbnail_asset_id, t.created_by, t.uses, t.created_at, t.updated_at`
+
+// getTemplate loads a template the user can use, without its canvas.
+func getTemplate(ctx context.Context, id string) (*Template, error) {
+	t, err := scanTemplate(db.QueryRow(ctx, `
+		SELECT `+templateColumns+` FROM templates t WHERE t.id::text = $2 AND `+visibleTo(1),
+		auth.UserID(), id))
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Template not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load template", "template_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load template",
+		}
+	}
+	return t, nil
+}
+
+func scanTemplate(row interface{ Scan(...any) error }) (*Template, error) {
+	var t Template
+	var thumbnailID *string
+	err := row.Scan(&t.ID, &t.Title, &t.Description, &t.CategoryID, &t.Tags, &t.Curated, &t.Visibility, &t.OrgID,
+		&t.CanvasWidth, &t.CanvasHeight, &t.ColorProfile, &thumbnailID, &t.CreatedBy, &t.Uses, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if thumbnailID != nil {
+		t.ThumbnailURL = canvasrefs.AssetURL(*thumbnailID)
+	}
+	return &t, nil
+}
@@ -0,0 +1,55 @@
+// Package tokenbox seals credentials for third-party services, such as the
+// API tokens integrations are connected with, so they are stored
+// encrypted. Each service seals with its own key, a base64-encoded 32-byte
+// secret, using AES-GCM.
+package tokenbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrNoKey is returned when the key is missing or is not 32 bytes.
+var ErrNoKey = errors.New("tokenbox: key is not configured")
+
+// Seal encrypts token with key, prefixed with its nonce.
+func Seal(key, token string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(token), nil), nil
+}
+
+// Open decrypts a token sealed with key.
+func Open(key string, sealed []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("tokenbox: sealed token is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, nil)
+	return string(plain), err
+}
+
+func newAEAD(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, ErrNoKey
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,223 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"encore.dev/pubsub"
+
+	"canvasai/outbound"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// maxAttempts is how many times a delivery is tried before it is marked
+// failed. Retries back off from 30 seconds up to an hour.
+const maxAttempts = 8
+
+// DeliveryMessage asks the delivery worker to send one delivery
+type DeliveryMessage struct {
+	DeliveryID string `json:"deliveryId"`
+}
+
+// Deliveries is the queue of webhook deliveries waiting to be sent.
+var Deliveries = pubsub.NewTopic[*DeliveryMessage]("webhook-deliveries", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(Deliveries, "send-webhook", pubsub.SubscriptionConfig[*DeliveryMessage]{
+	Handler:        deliver,
+	MaxConcurrency: 20,
+	RetryPolicy: &pubsub.RetryPolicy{
+		MinBackoff: 30 * time.Second,
+		MaxBackoff: time.Hour,
+		MaxRetries: maxAttempts,
+	},
+})
+
+// webhookPolicy bounds deliveries to integrator-controlled URLs.
+var webhookPolicy = outbound.Policy{
+	Timeout:          10 * time.Second,
+	MaxResponseBytes: 64 << 10,
+	RateLimit:        ratelimit.Limit{Requests: 50, Per: time.Second},
+}
+
+var webhookClient = outbound.NewClient(webhookPolicy)
+
+// payload is the JSON body POSTed to endpoints
+type payload struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schemaVersion"`
+	OrgID         *string         `json:"orgId,omitempty"`
+	ProjectID     *string         `json:"projectId,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// enqueuePending publishes every pending, never-attempted delivery matching
+// the condition, in event order.
+func enqueuePending(ctx context.Context, where string, arg string) error {
+	rows, err := db.Query(ctx, `
+		SELECT d.id FROM webhook_deliveries d
+		JOIN webhook_events ev ON ev.id = d.event_id
+		WHERE `+where+` AND d.status = 'pending' AND d.attempts = 0
+		ORDER BY ev.created_at, ev.id
+	`, arg)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := Deliveries.Publish(ctx, &DeliveryMessage{DeliveryID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends a delivery to its endpoint. Non-2xx responses and transport
+// errors are retried by returning an error until maxAttempts is reached.
+func deliver(ctx context.Context, msg *DeliveryMessage) error {
+	log := reqctx.Logger(ctx).With("delivery_id", msg.DeliveryID)
+
+	var status, url, secret string
+	var attempts int
+	var enabled bool
+	var replayID sql.NullString
+	var p payload
+	var data []byte
+	err := db.QueryRow(ctx, `
+		SELECT d.status, d.attempts, d.replay_id, ep.url, ep.secret, ep.enabled,
+			ev.id, ev.type, ev.schema_version, ev.org_id, ev.project_id, ev.created_at, ev.data
+		FROM webhook_deliveries d
+		JOIN webhook_endpoints ep ON ep.id = d.endpoint_id
+		JOIN webhook_events ev ON ev.id = d.event_id
+		WHERE d.id = $1
+	`, msg.DeliveryID).Scan(&status, &attempts, &replayID, &url, &secret, &enabled,
+		&p.ID, &p.Type, &p.SchemaVersion, &p.OrgID, &p.ProjectID, &p.CreatedAt, &data)
+	if err == sql.ErrNoRows {
+		// Endpoint or event deleted since the delivery was queued
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status != DeliveryPending {
+		return nil
+	}
+	if !enabled {
+		finishDelivery(ctx, msg.DeliveryID, DeliveryFailed, nil, "endpoint disabled")
+		return nil
+	}
+	p.Data = data
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	code, sendErr := send(ctx, url, secret, msg.DeliveryID, p.Type, replayID.Valid, body)
+	attempts++
+
+	if sendErr == nil {
+		finishDelivery(ctx, msg.DeliveryID, DeliverySucceeded, &code, "")
+		return nil
+	}
+	var statusCode *int
+	if code != 0 {
+		statusCode = &code
+	}
+	if attempts >= maxAttempts {
+		log.Warn("webhook delivery failed permanently", "attempts", attempts, "error", sendErr)
+		finishDelivery(ctx, msg.DeliveryID, DeliveryFailed, statusCode, sendErr.Error())
+		return nil
+	}
+	_, err = db.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET attempts = attempts + 1, last_attempt_at = NOW(), response_status = $2, error = $3
+		WHERE id = $1
+	`, msg.DeliveryID, statusCode, sendErr.Error())
+	if err != nil {
+		log.Error("failed to record webhook attempt", "error", err)
+	}
+	return sendErr
+}
+
+// send POSTs a signed payload and returns the response status.
+func send(ctx context.Context, url, secret, deliveryID, eventType string, replay bool, body []byte) (int, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "CanvasAI-Webhooks/1.0")
+	req.Header.Set("X-CanvasAI-Event", eventType)
+	req.Header.Set("X-CanvasAI-Delivery", deliveryID)
+	req.Header.Set("X-CanvasAI-Signature", "t="+ts+",v1="+sign(secret, ts, body))
+	if replay {
+		req.Header.Set("X-CanvasAI-Replay", "true")
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// sign computes the v1 signature: hex HMAC-SHA256 of "<timestamp>.<body>".
+func sign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func finishDelivery(ctx context.Context, id, status string, code *int, reason string) {
+	_, err := db.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = attempts + 1, last_attempt_at = NOW(), response_status = $3,
+			error = NULLIF($4, ''), delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() END
+		WHERE id = $1
+	`, id, status, code, reason)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update webhook delivery", "delivery_id", id, "error", err)
+	}
+}
@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Delivery is one attempt-tracked send of an event to an endpoint, as shown
+// in the delivery log
+type Delivery struct {
+	ID             string     `json:"id"`
+	EventID        string     `json:"eventId"`
+	EventType      string     `json:"eventType"`
+	ReplayID       *string    `json:"replayId,omitempty"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus *int       `json:"responseStatus,omitempty"`
+	Error          *string    `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LastAttemptAt  *time.Time `json:"lastAttemptAt,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// ListDeliveriesRequest represents the delivery log request
+type ListDeliveriesRequest struct {
+	Status    string `query:"status"` // pending, succeeded or failed; empty for all
+	EventType string `query:"eventType"`
+	Limit     int    `query:"limit"`
+	Offset    int    `query:"offset"`
+}
+
+// ListDeliveriesResponse represents a page of the delivery log, newest first
+type ListDeliveriesResponse struct {
+	Deliveries []Delivery `json:"deliveries"`
+	Limit      int        `json:"limit"`
+	Offset     int        `json:"offset"`
+}
+
+// ListDeliveries lists an org endpoint's recent deliveries.
+//
+//encore:api auth method=GET path=/orgs/:orgID/webhooks/:id/deliveries
+func ListDeliveries(ctx context.Context, orgID string, id string, req *ListDeliveriesRequest) (*ListDeliveriesResponse, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	return listDeliveries(ctx, `org_id = $1`, orgID, id, req)
+}
+
+// ListProjectDeliveries lists a project endpoint's recent deliveries.
+//
+//encore:api auth method=GET path=/projects/:id/webhooks/:webhookID/deliveries
+func ListProjectDeliveries(ctx context.Context, id string, webhookID string, req *ListDeliveriesRequest) (*ListDeliveriesResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleOwner); err != nil {
+		return nil, err
+	}
+	return listDeliveries(ctx, `project_id = $1`, id, webhookID, req)
+}
+
+// listDeliveries pages through the deliveries of endpointID, which must
+// match the owner condition on webhook_endpoints.
+func listDeliveries(ctx context.Context, owner, ownerID, endpointID string, req *ListDeliveriesRequest) (*ListDeliveriesResponse, error) {
+	switch req.Status {
+	case "", DeliveryPending, DeliverySucceeded, DeliveryFailed:
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Status must be pending, succeeded or failed",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	var exists bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM webhook_endpoints WHERE `+owner+` AND id::text = $2)
+	`, ownerID, endpointID).Scan(&exists)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch deliveries",
+		}
+	}
+	if !exists {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Webhook not found",
+		}
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT d.id, d.event_id, ev.type, d.replay_id, d.status, d.attempts, d.response_status,
+			d.error, d.created_at, d.last_attempt_at, d.delivered_at
+		FROM webhook_deliveries d
+		JOIN webhook_events ev ON ev.id = d.event_id
+		WHERE d.endpoint_id = $1
+			AND ($2 = '' OR d.status = $2)
+			AND ($3 = '' OR ev.type = $3)
+		ORDER BY d.created_at DESC, d.id
+		LIMIT $4 OFFSET $5
+	`, endpointID, req.Status, req.EventType, limit, offset)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list webhook deliveries", "endpoint_id", endpointID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch deliveries",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListDeliveriesResponse{Deliveries: []Delivery{}, Limit: limit, Offset: offset}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.ReplayID, &d.Status, &d.Attempts, &d.ResponseStatus,
+			&d.Error, &d.CreatedAt, &d.LastAttemptAt, &d.DeliveredAt); err != nil {
+			continue
+		}
+		resp.Deliveries = append(resp.Deliveries, d)
+	}
+	return resp, nil
+}
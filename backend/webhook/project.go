@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"context"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+)
+
+// Project owners register their own endpoints, which receive the events of
+// that one project whether or not it belongs to an organization. Org
+// endpoints keep receiving the events of the org's projects as well.
+
+// CreateProjectEndpoint registers an endpoint for a project's events.
+//
+//encore:api auth method=POST path=/projects/:id/webhooks
+func CreateProjectEndpoint(ctx context.Context, id string, req *CreateEndpointRequest) (*Endpoint, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleOwner); err != nil {
+		return nil, err
+	}
+	return createEndpoint(ctx, &Endpoint{ProjectID: id}, req)
+}
+
+//encore:api auth method=GET path=/projects/:id/webhooks
+func ListProjectEndpoints(ctx context.Context, id string) (*ListEndpointsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleOwner); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, project_id, url, event_types, enabled, created_at
+		FROM webhook_endpoints WHERE project_id = $1 ORDER BY created_at
+	`, id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch webhooks",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListEndpointsResponse{Endpoints: []Endpoint{}}
+	for rows.Next() {
+		var ep Endpoint
+		if err := rows.Scan(&ep.ID, &ep.ProjectID, &ep.URL, &ep.EventTypes, &ep.Enabled, &ep.CreatedAt); err != nil {
+			continue
+		}
+		resp.Endpoints = append(resp.Endpoints, ep)
+	}
+	return resp, nil
+}
+
+//encore:api auth method=DELETE path=/projects/:id/webhooks/:webhookID
+func DeleteProjectEndpoint(ctx context.Context, id string, webhookID string) error {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleOwner); err != nil {
+		return err
+	}
+
+	result, err := db.Exec(ctx, `DELETE FROM webhook_endpoints WHERE id = $1 AND project_id = $2`, webhookID, id)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete webhook",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Webhook not found",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Replay limits
+const (
+	maxReplayWindow = 30 * 24 * time.Hour
+	maxReplayEvents = 10000
+)
+
+// ReplayRequest represents the replay request. Events of the given types
+// (or all the endpoint's types) recorded in [Since, Until) are re-delivered.
+type ReplayRequest struct {
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+	EventTypes []string  `json:"eventTypes,omitempty"`
+}
+
+// Replay is a re-delivery of historical events to an endpoint
+type Replay struct {
+	ID         string    `json:"id"`
+	EndpointID string    `json:"endpointId"`
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+	EventTypes []string  `json:"eventTypes"`
+	EventCount int       `json:"eventCount"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ReplayEvents re-delivers recorded events to an endpoint. Deliveries are
+// queued oldest first but may arrive out of order; replayed deliveries carry an X-CanvasAI-Replay header and the original
+// event ID, so receivers can deduplicate.
+//
+//encore:api auth method=POST path=/orgs/:orgID/webhooks/:id/replay
+func ReplayEvents(ctx context.Context, orgID string, id string, req *ReplayRequest) (*Replay, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	if req.Since.IsZero() || req.Until.IsZero() || !req.Since.Before(req.Until) {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "since must be before until",
+		}
+	}
+	if req.Until.Sub(req.Since) > maxReplayWindow {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Replay window cannot exceed 30 days",
+		}
+	}
+	for _, t := range req.EventTypes {
+		if _, ok := latestSchema(t); !ok {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Unknown event type " + t,
+			}
+		}
+	}
+
+	var subscribed []string
+	err := db.QueryRow(ctx, `
+		SELECT event_types FROM webhook_endpoints WHERE id = $1 AND org_id = $2
+	`, id, orgID).Scan(&subscribed)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Webhook not found",
+		}
+	}
+
+	// Only replay types the endpoint subscribes to
+	types := req.EventTypes
+	if len(subscribed) > 0 {
+		if len(types) == 0 {
+			types = subscribed
+		} else {
+			types = intersect(types, subscribed)
+			if len(types) == 0 {
+				return nil, &errs.Error{
+					Code:    errs.InvalidArgument,
+					Message: "Webhook is not subscribed to the requested event types",
+				}
+			}
+		}
+	}
+	if types == nil {
+		types = []string{}
+	}
+
+	var count int
+	err = db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM webhook_events
+		WHERE org_id = $1 AND created_at >= $2 AND created_at < $3
+			AND (cardinality($4::text[]) = 0 OR type = ANY($4))
+	`, orgID, req.Since, req.Until, types).Scan(&count)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to count replay events", "endpoint_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to replay events",
+		}
+	}
+	if count > maxReplayEvents {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "Too many events in range, narrow the time window",
+		}
+	}
+
+	replay := &Replay{
+		EndpointID: id,
+		Since:      req.Since,
+		Until:      req.Until,
+		EventTypes: types,
+		EventCount: count,
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to replay events",
+		}
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO webhook_replays (endpoint_id, requested_by, since, until, event_types, event_count)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, id, auth.UserID(), req.Since, req.Until, types, count).Scan(&replay.ID, &replay.CreatedAt)
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO webhook_deliveries (event_id, endpoint_id, replay_id)
+			SELECT ev.id, $2, $3
+			FROM webhook_events ev
+			WHERE ev.org_id = $1 AND ev.created_at >= $4 AND ev.created_at < $5
+				AND (cardinality($6::text[]) = 0 OR ev.type = ANY($6))
+		`, orgID, id, replay.ID, req.Since, req.Until, types)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create replay", "endpoint_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to replay events",
+		}
+	}
+
+	if err := enqueuePending(ctx, `d.replay_id = $1`, replay.ID); err != nil {
+		reqctx.Logger(ctx).Error("failed to enqueue replay", "replay_id", replay.ID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "Failed to queue replay",
+		}
+	}
+	reqctx.Logger(ctx).Info("webhook replay queued", "replay_id", replay.ID, "events", count)
+	return replay, nil
+}
+
+func intersect(a, b []string) []string {
+	in := map[string]bool{}
+	for _, s := range b {
+		in[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if in[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
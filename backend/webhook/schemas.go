@@ -0,0 +1,255 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"encore.dev/beta/errs"
+)
+
+// Event types delivered to webhooks
+const (
+	EventAssetUpdated        = "asset.updated"
+	EventCanvasUpdated       = "canvas.updated"
+	EventCollaboratorAdded   = "collaborator.added"
+	EventCollaboratorRemoved = "collaborator.removed"
+	EventCommentResolved     = "comment.resolved"
+	EventCommentReopened     = "comment.reopened"
+	EventExportCompleted     = "export.completed"
+	EventMemberProvisioned   = "member.provisioned"
+	EventMemberJoined        = "member.joined"
+)
+
+// Schema is a versioned JSON Schema describing an event's data payload.
+// Versions are append-only: a breaking change to a payload is published as a
+// new version and events record the version they were produced with.
+type Schema struct {
+	Type        string          `json:"type"`
+	Version     int             `json:"version"`
+	Description string          `json:"description"`
+	Schema      json.RawMessage `json:"schema"`
+}
+
+// ListSchemasResponse represents the list schemas response
+type ListSchemasResponse struct {
+	Schemas []Schema `json:"schemas"`
+}
+
+// registry lists every published schema version, oldest first per type.
+var registry = []Schema{
+	{
+		Type:        EventAssetUpdated,
+		Version:     1,
+		Description: "An asset's file was replaced or rolled back to an earlier version.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["assetId", "version", "previousVersion", "checksum", "updatedBy"],
+			"properties": {
+				"assetId": {"type": "string", "format": "uuid"},
+				"projectId": {"type": "string", "format": "uuid"},
+				"version": {"type": "integer"},
+				"previousVersion": {"type": "integer"},
+				"restoredFrom": {"type": "integer"},
+				"checksum": {"type": "string"},
+				"url": {"type": "string"},
+				"updatedBy": {"type": "string", "format": "uuid"}
+			}
+		}`),
+	},
+	{
+		Type:        EventCommentResolved,
+		Version:     1,
+		Description: "A comment thread was resolved.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["projectId", "commentId", "resolvedBy", "resolvedAt"],
+			"properties": {
+				"projectId": {"type": "string", "format": "uuid"},
+				"commentId": {"type": "string", "format": "uuid"},
+				"resolvedBy": {"type": "string", "format": "uuid"},
+				"resolvedAt": {"type": "string", "format": "date-time"}
+			}
+		}`),
+	},
+	{
+		Type:        EventCommentReopened,
+		Version:     1,
+		Description: "A resolved comment thread was reopened.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["projectId", "commentId", "reopenedBy"],
+			"properties": {
+				"projectId": {"type": "string", "format": "uuid"},
+				"commentId": {"type": "string", "format": "uuid"},
+				"reopenedBy": {"type": "string", "format": "uuid"}
+			}
+		}`),
+	},
+	{
+		Type:        EventExportCompleted,
+		Version:     1,
+		Description: "An export finished rendering and is ready to download.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["projectId", "exportId", "kind", "assetId", "url"],
+			"properties": {
+				"projectId": {"type": "string", "format": "uuid"},
+				"exportId": {"type": "string", "format": "uuid"},
+				"kind": {"type": "string"},
+				"assetId": {"type": "string", "format": "uuid"},
+				"url": {"type": "string"}
+			}
+		}`),
+	},
+	{
+		Type:        EventMemberProvisioned,
+		Version:     1,
+		Description: "A user joined the organization through SSO just-in-time provisioning.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["userId", "email", "provisionedBy"],
+			"properties": {
+				"userId": {"type": "string", "format": "uuid"},
+				"email": {"type": "string", "format": "email"},
+				"provisionedBy": {"type": "string", "enum": ["saml"]}
+			}
+		}`),
+	},
+	{
+		Type:        EventMemberJoined,
+		Version:     1,
+		Description: "A user accepted an invitation to the organization.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["userId", "email", "role"],
+			"properties": {
+				"userId": {"type": "string", "format": "uuid"},
+				"email": {"type": "string", "format": "email"},
+				"role": {"type": "string", "enum": ["admin", "member", "guest"]},
+				"invitedBy": {"type": "string", "format": "uuid"}
+			}
+		}`),
+	},
+	{
+		Type:        EventMemberJoined,
+		Version:     2,
+		Description: "A user accepted an invitation to the organization. Adds the client role.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["userId", "email", "role"],
+			"properties": {
+				"userId": {"type": "string", "format": "uuid"},
+				"email": {"type": "string", "format": "email"},
+				"role": {"type": "string", "enum": ["admin", "member", "guest", "client"]},
+				"invitedBy": {"type": "string", "format": "uuid"}
+			}
+		}`),
+	},
+	{
+		Type:        EventCanvasUpdated,
+		Version:     1,
+		Description: "A new revision of a project's canvas was saved.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["projectId", "revision"],
+			"properties": {
+				"projectId": {"type": "string", "format": "uuid"},
+				"revision": {"type": "integer"},
+				"updatedBy": {"type": "string", "format": "uuid"}
+			}
+		}`),
+	},
+	{
+		Type:        EventCollaboratorAdded,
+		Version:     1,
+		Description: "A user was added to a project directly or by accepting an invite.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["projectId", "userId", "role"],
+			"properties": {
+				"projectId": {"type": "string", "format": "uuid"},
+				"userId": {"type": "string", "format": "uuid"},
+				"role": {"type": "string", "enum": ["editor", "commenter", "viewer"]},
+				"addedBy": {"type": "string", "format": "uuid"}
+			}
+		}`),
+	},
+	{
+		Type:        EventCollaboratorRemoved,
+		Version:     1,
+		Description: "A collaborator was removed from a project or left it.",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"required": ["projectId", "userId", "role", "removedBy"],
+			"properties": {
+				"projectId": {"type": "string", "format": "uuid"},
+				"userId": {"type": "string", "format": "uuid"},
+				"role": {"type": "string", "enum": ["editor", "commenter", "viewer"]},
+				"removedBy": {"type": "string", "format": "uuid"}
+			}
+		}`),
+	},
+}
+
+// ListSchemas lists every event schema version.
+//
+//encore:api auth method=GET path=/webhooks/schemas
+func ListSchemas(ctx context.Context) (*ListSchemasResponse, error) {
+	schemas := append([]Schema(nil), registry...)
+	sort.SliceStable(schemas, func(i, j int) bool {
+		if schemas[i].Type != schemas[j].Type {
+			return schemas[i].Type < schemas[j].Type
+		}
+		return schemas[i].Version < schemas[j].Version
+	})
+	return &ListSchemasResponse{Schemas: schemas}, nil
+}
+
+// GetSchema returns one version of an event type's schema.
+//
+//encore:api auth method=GET path=/webhooks/schemas/:eventType/versions/:version
+func GetSchema(ctx context.Context, eventType string, version int) (*Schema, error) {
+	for _, s := range registry {
+		if s.Type == eventType && s.Version == version {
+			return &s, nil
+		}
+	}
+	return nil, &errs.Error{
+		Code:    errs.NotFound,
+		Message: "Schema not found",
+	}
+}
+
+// latestSchema returns the current schema for an event type.
+func latestSchema(eventType string) (*Schema, bool) {
+	var latest *Schema
+	for i := range registry {
+		if s := &registry[i]; s.Type == eventType && (latest == nil || s.Version > latest.Version) {
+			latest = s
+		}
+	}
+	return latest, latest != nil
+}
+
+// checkData verifies that data is an object carrying the schema's required
+// fields. It is a guard against emitter bugs, not a full validator.
+func checkData(s *Schema, data json.RawMessage) error {
+	var def struct {
+		Required []string `json:"required"`
+	}
+	if err := json.Unmarshal(s.Schema, &def); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%s data must be an object: %w", s.Type, err)
+	}
+	for _, name := range def.Required {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("%s v%d data is missing %q", s.Type, s.Version, name)
+		}
+	}
+	return nil
+}
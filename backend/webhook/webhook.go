@@ -0,0 +1,287 @@
+// Package webhook delivers organization and project events to integrator
+// endpoints. Services emit events through the Events topic; the webhook
+// service records each one in an event log, fans it out to the subscribed
+// endpoints of the org and of the project it concerns, and delivers signed
+// payloads with retries. Recorded events can be replayed to an org endpoint
+// after an outage, and every endpoint's deliveries can be listed for
+// debugging.
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+
+	"canvasai/outbound"
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// Endpoint is a URL an organization or a project receives webhook events at
+type Endpoint struct {
+	ID         string    `json:"id"`
+	OrgID      string    `json:"orgId,omitempty"`
+	ProjectID  string    `json:"projectId,omitempty"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"eventTypes"` // empty subscribes to all events
+	Enabled    bool      `json:"enabled"`
+	Secret     string    `json:"secret,omitempty"` // only returned on creation
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// CreateEndpointRequest represents the create endpoint request
+type CreateEndpointRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes,omitempty"`
+}
+
+// ListEndpointsResponse represents the list endpoints response
+type ListEndpointsResponse struct {
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// Event is published by services that want to notify webhooks. OrgID may
+// be left empty when ProjectID is set; events for projects outside an
+// organization reach only the project's own endpoints.
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	OrgID      string          `json:"orgId,omitempty"`
+	ProjectID  string          `json:"projectId,omitempty"`
+	Data       json.RawMessage `json:"data"`
+	OccurredAt time.Time       `json:"occurredAt"`
+}
+
+// Events is the topic other services publish webhook events to.
+var Events = pubsub.NewTopic[*Event]("webhook-events", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(Events, "record-webhook-event", pubsub.SubscriptionConfig[*Event]{
+	Handler: record,
+})
+
+// Webhooks are stored alongside the orgs and projects they describe.
+var db = sqldb.Named("project")
+
+// Emit publishes a webhook event. data is marshalled to JSON and must match
+// the latest schema registered for eventType.
+func Emit(ctx context.Context, e *Event, data any) error {
+	s, ok := latestSchema(e.Type)
+	if !ok {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Unknown webhook event type " + e.Type,
+		}
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := checkData(s, raw); err != nil {
+		return err
+	}
+
+	e.ID = uuid.New().String()
+	e.Data = raw
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now()
+	}
+	_, err = Events.Publish(ctx, e)
+	return err
+}
+
+//encore:api auth method=POST path=/orgs/:orgID/webhooks
+func CreateEndpoint(ctx context.Context, orgID string, req *CreateEndpointRequest) (*Endpoint, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	return createEndpoint(ctx, &Endpoint{OrgID: orgID}, req)
+}
+
+//encore:api auth method=GET path=/orgs/:orgID/webhooks
+func ListEndpoints(ctx context.Context, orgID string) (*ListEndpointsResponse, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, org_id, url, event_types, enabled, created_at
+		FROM webhook_endpoints WHERE org_id = $1 ORDER BY created_at
+	`, orgID)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch webhooks",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListEndpointsResponse{Endpoints: []Endpoint{}}
+	for rows.Next() {
+		var ep Endpoint
+		if err := rows.Scan(&ep.ID, &ep.OrgID, &ep.URL, &ep.EventTypes, &ep.Enabled, &ep.CreatedAt); err != nil {
+			continue
+		}
+		resp.Endpoints = append(resp.Endpoints, ep)
+	}
+	return resp, nil
+}
+
+//encore:api auth method=DELETE path=/orgs/:orgID/webhooks/:id
+func DeleteEndpoint(ctx context.Context, orgID string, id string) error {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return err
+	}
+
+	result, err := db.Exec(ctx, `DELETE FROM webhook_endpoints WHERE id = $1 AND org_id = $2`, id, orgID)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to delete webhook",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Webhook not found",
+		}
+	}
+	return nil
+}
+
+// createEndpoint validates req and stores it as an endpoint of ep's org or
+// project, filling in the rest of ep.
+func createEndpoint(ctx context.Context, ep *Endpoint, req *CreateEndpointRequest) (*Endpoint, error) {
+	if err := validateEndpointURL(ctx, req.URL); err != nil {
+		return nil, err
+	}
+	for _, t := range req.EventTypes {
+		if _, ok := latestSchema(t); !ok {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Unknown event type " + t,
+			}
+		}
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create webhook",
+		}
+	}
+	ep.URL = req.URL
+	ep.EventTypes = req.EventTypes
+	ep.Enabled = true
+	ep.Secret = secret
+	if ep.EventTypes == nil {
+		ep.EventTypes = []string{}
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO webhook_endpoints (org_id, project_id, url, secret, event_types, created_by)
+		VALUES (NULLIF($1, '')::uuid, NULLIF($2, '')::uuid, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, ep.OrgID, ep.ProjectID, ep.URL, secret, ep.EventTypes, auth.UserID()).Scan(&ep.ID, &ep.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create webhook endpoint", "org_id", ep.OrgID, "project_id", ep.ProjectID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to create webhook",
+		}
+	}
+	return ep, nil
+}
+
+// record stores an emitted event and queues a delivery to every subscribed
+// endpoint of its org and project. Redelivered messages re-queue the
+// deliveries that never ran.
+func record(ctx context.Context, e *Event) error {
+	orgID := e.OrgID
+	if orgID == "" && e.ProjectID != "" {
+		var org sql.NullString
+		err := db.QueryRow(ctx, `SELECT org_id FROM projects WHERE id = $1`, e.ProjectID).Scan(&org)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		orgID = org.String
+	}
+	if orgID == "" && e.ProjectID == "" {
+		return nil
+	}
+	s, ok := latestSchema(e.Type)
+	if !ok {
+		reqctx.Logger(ctx).Error("dropping webhook event of unknown type", "type", e.Type)
+		return nil
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(ctx, `
+		INSERT INTO webhook_events (id, org_id, project_id, type, schema_version, data, created_at)
+		VALUES ($1, NULLIF($2, '')::uuid, NULLIF($3, '')::uuid, $4, $5, $6, $7)
+		ON CONFLICT (id) DO NOTHING
+	`, e.ID, orgID, e.ProjectID, e.Type, s.Version, []byte(e.Data), e.OccurredAt)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO webhook_deliveries (event_id, endpoint_id)
+			SELECT $1, id FROM webhook_endpoints
+			WHERE (org_id::text = $2 OR project_id::text = $4) AND enabled
+				AND (cardinality(event_types) = 0 OR $3 = ANY(event_types))
+		`, e.ID, orgID, e.Type, e.ProjectID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return enqueuePending(ctx, `d.event_id = $1 AND d.replay_id IS NULL`, e.ID)
+}
+
+func validateEndpointURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Webhook URL must be an absolute https URL",
+		}
+	}
+	if err := outbound.CheckURL(ctx, webhookPolicy, raw); err != nil {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Webhook URL must resolve to a public address",
+		}
+	}
+	return nil
+}
+
+func newSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}
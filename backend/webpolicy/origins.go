@@ -0,0 +1,160 @@
+package webpolicy
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// maxEmbedOrigins bounds an organization's allowlist
+const maxEmbedOrigins = 50
+
+// EmbedOrigin is an origin an organization's projects may be embedded on
+type EmbedOrigin struct {
+	Origin    string    `json:"origin"`
+	AddedBy   string    `json:"addedBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ListEmbedOriginsResponse represents the list embed origins response
+type ListEmbedOriginsResponse struct {
+	Origins []EmbedOrigin `json:"origins"`
+	// Defaults are the origins every project may be embedded on
+	Defaults []string `json:"defaults"`
+}
+
+// SetEmbedOriginsRequest represents the set embed origins request
+type SetEmbedOriginsRequest struct {
+	// Origins replaces the allowlist, e.g. ["https://www.example.com",
+	// "https://*.example.org"]
+	Origins []string `json:"origins"`
+}
+
+//encore:api auth method=GET path=/orgs/:orgID/embed-origins
+func ListEmbedOrigins(ctx context.Context, orgID string) (*ListEmbedOriginsResponse, error) {
+	if _, err := orgRole(ctx, orgID); err != nil {
+		return nil, err
+	}
+	return listEmbedOrigins(ctx, orgID)
+}
+
+// SetEmbedOrigins replaces an organization's embed allowlist.
+//
+//encore:api auth method=PUT path=/orgs/:orgID/embed-origins
+func SetEmbedOrigins(ctx context.Context, orgID string, req *SetEmbedOriginsRequest) (*ListEmbedOriginsResponse, error) {
+	if err := permissions.RequireOrgAdmin(ctx, db, orgID); err != nil {
+		return nil, err
+	}
+	if len(req.Origins) > maxEmbedOrigins {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "An organization can allow up to 50 origins",
+		}
+	}
+	origins := make([]string, 0, len(req.Origins))
+	seen := map[string]bool{}
+	for _, raw := range req.Origins {
+		o, err := normalizeOrigin(raw)
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "Invalid origin " + raw + ": must be like https://example.com or https://*.example.com",
+			}
+		}
+		if !seen[o] {
+			seen[o] = true
+			origins = append(origins, o)
+		}
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to begin transaction", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update embed origins",
+		}
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `DELETE FROM org_embed_origins WHERE org_id = $1 AND NOT (origin = ANY($2))`, orgID, origins)
+	for _, o := range origins {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO org_embed_origins (org_id, origin, added_by) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, origin) DO NOTHING
+		`, orgID, o, auth.UserID())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to update embed origins", "org_id", orgID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to update embed origins",
+		}
+	}
+	forget(orgID)
+
+	reqctx.Logger(ctx).Info("embed origins updated", "org_id", orgID, "count", len(origins))
+	return listEmbedOrigins(ctx, orgID)
+}
+
+func listEmbedOrigins(ctx context.Context, orgID string) (*ListEmbedOriginsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT origin, COALESCE(added_by::text, ''), created_at
+		FROM org_embed_origins WHERE org_id = $1 ORDER BY origin
+	`, orgID)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch embed origins",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListEmbedOriginsResponse{Origins: []EmbedOrigin{}, Defaults: []string{}}
+	for rows.Next() {
+		var o EmbedOrigin
+		if err := rows.Scan(&o.Origin, &o.AddedBy, &o.CreatedAt); err != nil {
+			continue
+		}
+		resp.Origins = append(resp.Origins, o)
+	}
+	for _, o := range policyCfg.Web.EmbedOrigins {
+		if n, err := normalizeOrigin(o); err == nil {
+			resp.Defaults = append(resp.Defaults, n)
+		}
+	}
+	return resp, nil
+}
+
+// orgRole returns the caller's role in orgID, or NotFound if they are not a
+// member.
+func orgRole(ctx context.Context, orgID string) (string, error) {
+	var role string
+	err := db.QueryRow(ctx, `
+		SELECT role FROM organization_members WHERE org_id::text = $1 AND user_id = $2
+	`, orgID, auth.UserID()).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Organization not found",
+		}
+	} else if err != nil {
+		return "", &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to check organization membership",
+		}
+	}
+	return role, nil
+}
@@ -0,0 +1,210 @@
+// Package webpolicy owns the browser security headers of responses that
+// leave the app: the Content-Security-Policy of served files, and for
+// embeddable responses which sites may frame them (frame-ancestors) and
+// read them cross-origin (CORS). Handlers set them through UserContent,
+// StaticSite and Embed instead of writing headers themselves. The defaults
+// come from config; each organization adds the origins its projects may be
+// embedded on (see origins.go).
+package webpolicy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+)
+
+// Policy configures the headers
+type Policy struct {
+	// EmbedOrigins may embed any project, e.g. the app's own sites. Each is
+	// an origin such as "https://example.com" or "https://*.example.com".
+	EmbedOrigins []string
+	// UserContentCSP is the Content-Security-Policy of served SVGs and
+	// other files a browser could run script from. Empty uses the default.
+	UserContentCSP string
+}
+
+var policyCfg struct {
+	Web Policy
+}
+
+var _ = config.Load(context.Background(), &policyCfg)
+
+// Embed origins are stored alongside the organizations they belong to.
+var db = sqldb.Named("project")
+
+const (
+	defaultUserContentCSP = "default-src 'none'; style-src 'unsafe-inline'"
+
+	// staticSiteCSP lets a generated site link its own pages and show its
+	// own and https images, but not run script or be framed.
+	staticSiteCSP = "default-src 'none'; style-src 'self' 'unsafe-inline'; img-src 'self' https: data:; frame-ancestors 'none'"
+
+	// originCacheTTL bounds how long an allowlist change can go unnoticed
+	// by instances that did not make it.
+	originCacheTTL = 30 * time.Second
+	maxCachedOrgs  = 10000
+)
+
+// UserContent sets the headers of a served file that must not run script,
+// such as an SVG from the icon or clipart library.
+func UserContent(w http.ResponseWriter) {
+	csp := policyCfg.Web.UserContentCSP
+	if csp == "" {
+		csp = defaultUserContentCSP
+	}
+	w.Header().Set("Content-Security-Policy", csp)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+// StaticSite sets the headers of a page of a generated static site, such
+// as an organization's design system docs.
+func StaticSite(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", staticSiteCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+}
+
+// Embed sets the headers of a response other sites may embed, for a project
+// of orgID (empty for personal projects). Only the configured origins and
+// the organization's own may frame it, and a cross-origin read from one of
+// them is allowed. It reports whether the request's origin, if it has one,
+// is allowed; callers refuse the request when it is not.
+func Embed(ctx context.Context, w http.ResponseWriter, req *http.Request, orgID string) bool {
+	origins := append([]string{}, policyCfg.Web.EmbedOrigins...)
+	if orgID != "" {
+		own, err := orgOrigins(ctx, orgID)
+		if err != nil {
+			// Fall back to the defaults rather than failing the embed.
+			reqctx.Logger(ctx).Error("failed to load embed origins", "org_id", orgID, "error", err)
+		}
+		origins = append(origins, own...)
+	}
+
+	sources := []string{"'self'"}
+	for _, o := range origins {
+		if n, err := normalizeOrigin(o); err == nil {
+			sources = append(sources, n)
+		}
+	}
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+strings.Join(sources, " "))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Vary", "Origin")
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !originAllowed(origin, sources[1:]) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	return true
+}
+
+// originAllowed reports whether origin matches one of the normalized
+// allowed origins, which may start with a "*." subdomain wildcard.
+func originAllowed(origin string, allowed []string) bool {
+	origin, err := normalizeOrigin(origin)
+	if err != nil || strings.Contains(origin, "*") {
+		return false
+	}
+	for _, a := range allowed {
+		if a == origin {
+			return true
+		}
+		scheme, host, ok := strings.Cut(a, "://*.")
+		if ok && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeOrigin returns raw as a lowercase "scheme://host[:port]"
+// origin. Origins must be https, except for local development hosts, and
+// a host may start with a "*." wildcard for its subdomains.
+func normalizeOrigin(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" ||
+		(u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("not an origin")
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname())
+	switch {
+	case scheme == "https":
+	case scheme == "http" && (host == "localhost" || host == "127.0.0.1"):
+	default:
+		return "", fmt.Errorf("origin must use https")
+	}
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || len(name) > 253 || strings.Contains(name, "*") || (net.ParseIP(name) == nil && !strings.Contains(name, ".") && name != "localhost") {
+		return "", fmt.Errorf("invalid host")
+	}
+	if port := u.Port(); port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host, nil
+}
+
+type cachedOrigins struct {
+	origins    []string
+	resolvedAt time.Time
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[string]cachedOrigins{}
+)
+
+// orgOrigins returns an organization's embed origins, from the cache when
+// it is fresh.
+func orgOrigins(ctx context.Context, orgID string) ([]string, error) {
+	cacheMu.Lock()
+	c, ok := cache[orgID]
+	cacheMu.Unlock()
+	if ok && time.Since(c.resolvedAt) < originCacheTTL {
+		return c.origins, nil
+	}
+
+	rows, err := db.Query(ctx, `SELECT origin FROM org_embed_origins WHERE org_id::text = $1`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var origins []string
+	for rows.Next() {
+		var o string
+		if err := rows.Scan(&o); err != nil {
+			return nil, err
+		}
+		origins = append(origins, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cacheMu.Lock()
+	if len(cache) >= maxCachedOrgs {
+		cache = map[string]cachedOrigins{}
+	}
+	cache[orgID] = cachedOrigins{origins: origins, resolvedAt: time.Now()}
+	cacheMu.Unlock()
+	return origins, nil
+}
+
+// forget drops an organization's cached origins after they change.
+func forget(orgID string) {
+	cacheMu.Lock()
+	delete(cache, orgID)
+	cacheMu.Unlock()
+}
@@ -0,0 +1,219 @@
+package wideevent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+
+	"canvasai/permissions"
+	"canvasai/reqctx"
+)
+
+// StoredEvent is a sampled wide event
+type StoredEvent struct {
+	ID         int64              `json:"id"`
+	Kind       string             `json:"kind"`
+	RequestID  string             `json:"requestId,omitempty"`
+	DurationMs float64            `json:"durationMs"`
+	Outcome    string             `json:"outcome"`
+	Error      string             `json:"error,omitempty"`
+	Steps      map[string]float64 `json:"steps"`
+	Fields     map[string]any     `json:"fields"`
+	// SampleRate is the rate the event was kept at; 1 for failed and slow
+	// events
+	SampleRate float64   `json:"sampleRate"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ListEventsRequest represents the admin wide event query
+type ListEventsRequest struct {
+	Kind          string    `query:"kind"`
+	Outcome       string    `query:"outcome"`
+	MinDurationMs float64   `query:"minDurationMs"`
+	ProjectID     string    `query:"projectId"`
+	RequestID     string    `query:"requestId"`
+	Since         time.Time `query:"since"`
+	Until         time.Time `query:"until"`
+	Sort          string    `query:"sort"` // "recent" (default) or "duration", slowest first
+	Limit         int       `query:"limit"`
+	Offset        int       `query:"offset"`
+}
+
+// ListEventsResponse represents a page of wide events
+type ListEventsResponse struct {
+	Events []StoredEvent `json:"events"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+}
+
+//encore:api auth method=GET path=/admin/wide-events
+func ListEvents(ctx context.Context, req *ListEventsRequest) (*ListEventsResponse, error) {
+	if err := permissions.RequirePlatformAdmin(ctx, db); err != nil {
+		return nil, err
+	}
+	if req.Outcome != "" && req.Outcome != OutcomeOK && req.Outcome != OutcomeError {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "outcome must be ok or error",
+		}
+	}
+	order := "created_at DESC"
+	switch req.Sort {
+	case "", "recent":
+	case "duration":
+		order = "duration_ms DESC"
+	default:
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "sort must be recent or duration",
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	var since, until any
+	if !req.Since.IsZero() {
+		since = req.Since
+	}
+	if !req.Until.IsZero() {
+		until = req.Until
+	}
+
+	const filter = `
+		WHERE ($1 = '' OR kind = $1)
+			AND ($2 = '' OR outcome = $2)
+			AND duration_ms >= $3
+			AND ($4 = '' OR fields->>'project_id' = $4)
+			AND ($5 = '' OR request_id = $5)
+			AND ($6::timestamp IS NULL OR created_at >= $6)
+			AND ($7::timestamp IS NULL OR created_at < $7)
+	`
+	args := []any{req.Kind, req.Outcome, req.MinDurationMs, req.ProjectID, req.RequestID, since, until}
+
+	resp := &ListEventsResponse{Events: []StoredEvent{}, Limit: limit, Offset: offset}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM wide_events`+filter, args...).Scan(&resp.Total); err != nil {
+		reqctx.Logger(ctx).Error("failed to count wide events", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch events",
+		}
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, kind, COALESCE(request_id, ''), duration_ms, outcome, COALESCE(error, ''), steps, fields, sample_rate, created_at
+		FROM wide_events`+filter+`
+		ORDER BY `+order+`
+		LIMIT $8 OFFSET $9
+	`, append(args, limit, offset)...)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to list wide events", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch events",
+		}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e StoredEvent
+		var steps, fields []byte
+		if err := rows.Scan(&e.ID, &e.Kind, &e.RequestID, &e.DurationMs, &e.Outcome, &e.Error, &steps, &fields, &e.SampleRate, &e.CreatedAt); err != nil {
+			continue
+		}
+		_ = json.Unmarshal(steps, &e.Steps)
+		_ = json.Unmarshal(fields, &e.Fields)
+		resp.Events = append(resp.Events, e)
+	}
+	return resp, nil
+}
+
+// RecordEventRequest represents a wide event reported by an internal
+// service, such as an AI job run by the AI service
+type RecordEventRequest struct {
+	Kind       string             `json:"kind"`
+	DurationMs float64            `json:"durationMs"`
+	Error      string             `json:"error,omitempty"` // empty if the job succeeded
+	Steps      map[string]float64 `json:"steps"`
+	Fields     map[string]any     `json:"fields"`
+}
+
+// RecordEvent stores a wide event for work done outside this API. Only
+// machine tokens may call it (see auth/machine.go).
+//
+//encore:api auth method=POST path=/wide-events
+func RecordEvent(ctx context.Context, req *RecordEventRequest) error {
+	service, ok := strings.CutPrefix(auth.UserID(), permissions.ServicePrefix)
+	if !ok {
+		return &errs.Error{
+			Code:    errs.PermissionDenied,
+			Message: "Only internal services may record events",
+		}
+	}
+	if req.Kind != KindAI {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "kind must be ai",
+		}
+	}
+	if req.DurationMs < 0 || len(req.Steps) > maxStepNames || len(req.Fields) > maxFields {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Invalid event",
+		}
+	}
+
+	rec := &record{
+		Kind:       req.Kind,
+		RequestID:  reqctx.From(ctx).RequestID,
+		DurationMs: req.DurationMs,
+		Outcome:    OutcomeOK,
+		Steps:      req.Steps,
+		Fields:     map[string]any{},
+	}
+	if rec.Steps == nil {
+		rec.Steps = map[string]float64{}
+	}
+	for k, v := range req.Fields {
+		rec.Fields[k] = v
+	}
+	rec.Fields["service"] = service
+	if req.Error != "" {
+		rec.Outcome, rec.Error = OutcomeError, req.Error
+	}
+	emit(ctx, rec)
+	return nil
+}
+
+// Stored events are only useful while the latency they describe is recent.
+var _ = cron.NewJob("prune-wide-events", cron.JobConfig{
+	Title:    "Delete old wide events",
+	Every:    24 * cron.Hour,
+	Endpoint: PruneWideEvents,
+})
+
+//encore:api private
+func PruneWideEvents(ctx context.Context) error {
+	days := wideCfg.WideEvents.RetentionDays
+	if days <= 0 {
+		days = defaultRetentionDays
+	}
+	result, err := db.Exec(ctx, `DELETE FROM wide_events WHERE created_at < NOW() - $1 * INTERVAL '1 day'`, days)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to prune wide events", "error", err)
+		return err
+	}
+	reqctx.Logger(ctx).Info("pruned wide events", "deleted", result.RowsAffected())
+	return nil
+}
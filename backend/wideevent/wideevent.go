@@ -0,0 +1,194 @@
+// Package wideevent records one wide, structured event per unit of work —
+// a canvas save, an export job, an AI job — with the time each step took
+// and whatever context the handler attached. Every event is logged; a
+// sample is also stored so admins can query slow and failed work through
+// the admin API when chasing tail latency. Handlers build an event with
+// Start, mark steps as they finish and call Finish once:
+//
+//	ev := wideevent.Start(wideevent.KindSave)
+//	defer func() { ev.Finish(ctx, err) }()
+//	validate()
+//	ev.Step("validation")
+//	write()
+//	ev.Step("db_write")
+package wideevent
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+)
+
+// Event kinds
+const (
+	KindSave   = "save"
+	KindExport = "export"
+	KindAI     = "ai"
+)
+
+// Outcomes
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// Sampling configures which events are stored. Failed events and those at
+// least SlowMs long are always kept; the rest are kept at SampleRate.
+type Sampling struct {
+	// SampleRate is the fraction of ordinary events stored, 0 to 1.
+	// Zero uses the default of 0.05.
+	SampleRate float64 `json:"sampleRate"`
+	// SlowMs is the duration from which every event is stored. Zero uses
+	// the default of 1000.
+	SlowMs int `json:"slowMs"`
+	// RetentionDays is how long stored events are kept. Zero keeps them
+	// for 14 days.
+	RetentionDays int `json:"retentionDays"`
+}
+
+var wideCfg struct {
+	WideEvents Sampling
+}
+
+var _ = config.Load(context.Background(), &wideCfg)
+
+// Events are stored alongside the projects whose work they describe.
+var db = sqldb.Named("project")
+
+const (
+	defaultSampleRate    = 0.05
+	defaultSlowMs        = 1000
+	defaultRetentionDays = 14
+
+	maxFields    = 50
+	maxStepNames = 30
+)
+
+// Event is a wide event being built. A nil *Event ignores every call, so
+// optional instrumentation needs no checks.
+type Event struct {
+	kind   string
+	start  time.Time
+	last   time.Time
+	steps  map[string]float64 // milliseconds
+	fields map[string]any
+}
+
+// Start begins an event of kind, timing from now.
+func Start(kind string) *Event {
+	now := time.Now()
+	return &Event{kind: kind, start: now, last: now, steps: map[string]float64{}, fields: map[string]any{}}
+}
+
+// Set attaches a field to the event, e.g. the project ID or payload size.
+func (e *Event) Set(key string, value any) {
+	if e == nil || (len(e.fields) >= maxFields && e.fields[key] == nil) {
+		return
+	}
+	e.fields[key] = value
+}
+
+// Step records the time since the previous step, or since Start, as the
+// duration of name. A step recorded twice adds up.
+func (e *Event) Step(name string) {
+	if e == nil {
+		return
+	}
+	now := time.Now()
+	if _, ok := e.steps[name]; ok || len(e.steps) < maxStepNames {
+		e.steps[name] += ms(now.Sub(e.last))
+	}
+	e.last = now
+}
+
+// Finish ends the event with the work's result, logs it and stores it
+// when it is sampled. It never fails the work it describes.
+func (e *Event) Finish(ctx context.Context, err error) {
+	if e == nil {
+		return
+	}
+	rec := &record{
+		Kind:       e.kind,
+		RequestID:  reqctx.From(ctx).RequestID,
+		DurationMs: ms(time.Since(e.start)),
+		Outcome:    OutcomeOK,
+		Steps:      e.steps,
+		Fields:     e.fields,
+	}
+	if err != nil {
+		rec.Outcome, rec.Error = OutcomeError, err.Error()
+	}
+	emit(ctx, rec)
+}
+
+// record is a finished event
+type record struct {
+	Kind       string
+	RequestID  string
+	DurationMs float64
+	Outcome    string
+	Error      string
+	Steps      map[string]float64
+	Fields     map[string]any
+}
+
+// emit logs an event and stores it if it is sampled.
+func emit(ctx context.Context, rec *record) {
+	kv := []any{"kind", rec.Kind, "duration_ms", rec.DurationMs, "outcome", rec.Outcome}
+	if rec.Error != "" {
+		kv = append(kv, "error", rec.Error)
+	}
+	for name, d := range rec.Steps {
+		kv = append(kv, "step."+name+"_ms", d)
+	}
+	for k, v := range rec.Fields {
+		kv = append(kv, k, v)
+	}
+	reqctx.Logger(ctx).Info("wide event", kv...)
+
+	rate, keep := sample(rec)
+	if !keep {
+		return
+	}
+	steps, _ := json.Marshal(rec.Steps)
+	fields, err := json.Marshal(rec.Fields)
+	if err != nil {
+		fields = []byte("{}")
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO wide_events (kind, request_id, duration_ms, outcome, error, steps, fields, sample_rate)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), $6, $7, $8)
+	`, rec.Kind, rec.RequestID, rec.DurationMs, rec.Outcome, rec.Error, steps, fields, rate)
+	if err != nil {
+		reqctx.Logger(ctx).Warn("failed to store wide event", "kind", rec.Kind, "error", err)
+	}
+}
+
+// sample decides whether to store an event, and the rate it was kept at,
+// which stored events carry so counts can be scaled back up.
+func sample(rec *record) (float64, bool) {
+	c := wideCfg.WideEvents
+	slow := c.SlowMs
+	if slow <= 0 {
+		slow = defaultSlowMs
+	}
+	if rec.Outcome != OutcomeOK || rec.DurationMs >= float64(slow) {
+		return 1, true
+	}
+	rate := c.SampleRate
+	if rate <= 0 {
+		rate = defaultSampleRate
+	}
+	rate = min(rate, 1)
+	return rate, rand.Float64() < rate
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
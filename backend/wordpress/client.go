@@ -0,0 +1,186 @@
+package wordpress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"canvasai/outbound"
+	"canvasai/ratelimit"
+	"canvasai/reqctx"
+)
+
+// wpClient calls sites' REST APIs. Sites are user-supplied, so it may only
+// reach public addresses.
+var wpClient = outbound.NewClient(outbound.Policy{
+	Timeout:          60 * time.Second,
+	MaxResponseBytes: 2 << 20,
+	RateLimit:        ratelimit.Limit{Requests: 5, Per: time.Second},
+})
+
+// apiError is an error response from a site
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("wordpress: HTTP %d: %s: %s", e.status, e.code, e.message)
+}
+
+// apiErrorResponse turns a failed site call into an API error, passing on
+// WordPress's reason when it rejected the request.
+func apiErrorResponse(ctx context.Context, msg string, err error) error {
+	var e *apiError
+	if errors.As(err, &e) && e.status < 500 {
+		switch {
+		case e.status == http.StatusUnauthorized:
+			return &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "WordPress rejected the username or application password",
+			}
+		case e.status == http.StatusNotFound && e.code == "":
+			return &errs.Error{
+				Code:    errs.FailedPrecondition,
+				Message: "The site's REST API was not found; check the URL and that the API is enabled",
+			}
+		}
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "WordPress rejected the request: " + e.message,
+		}
+	}
+	reqctx.Logger(ctx).Warn(msg, "error", err)
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: "The WordPress site could not be reached",
+	}
+}
+
+// checkCredentials checks the user can sign in and upload media.
+func checkCredentials(ctx context.Context, s *site) error {
+	var me struct {
+		Capabilities map[string]bool `json:"capabilities"`
+	}
+	if err := call(ctx, s, http.MethodGet, "/users/me?context=edit", nil, "", &me); err != nil {
+		return err
+	}
+	if !me.Capabilities["upload_files"] {
+		return &apiError{status: http.StatusForbidden, code: "upload_files", message: "the user cannot upload media"}
+	}
+	return nil
+}
+
+// siteName returns the site's title, or its URL if it cannot be read.
+func siteName(ctx context.Context, s *site) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/wp-json/", nil)
+	if err != nil {
+		return s.URL
+	}
+	resp, err := wpClient.Do(req)
+	if err != nil {
+		return s.URL
+	}
+	defer resp.Body.Close()
+	var index struct {
+		Name string `json:"name"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&index) != nil || index.Name == "" {
+		return s.URL
+	}
+	if len(index.Name) > 255 {
+		return index.Name[:255]
+	}
+	return index.Name
+}
+
+// media is an item in a site's media library
+type media struct {
+	ID        int64  `json:"id"`
+	SourceURL string `json:"source_url"`
+}
+
+// uploadMedia adds a file to the media library with its alt text and
+// caption.
+func uploadMedia(ctx context.Context, s *site, filename, mimeType string, data []byte, altText, caption string) (*media, error) {
+	m := &media{}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	if err := call(ctx, s, http.MethodPost, "/media", bytes.NewReader(data), mimeType, m, "Content-Disposition", disposition); err != nil {
+		return nil, err
+	}
+	fields, _ := json.Marshal(map[string]string{"alt_text": altText, "caption": caption})
+	if err := call(ctx, s, http.MethodPost, fmt.Sprintf("/media/%d", m.ID), bytes.NewReader(fields), "application/json", m); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// post is a post on a site
+type post struct {
+	ID   int64  `json:"id"`
+	Link string `json:"link"`
+}
+
+// createDraft creates a draft post with the given block content and
+// featured image.
+func createDraft(ctx context.Context, s *site, title, content string, mediaID int64) (*post, error) {
+	p := &post{}
+	body, _ := json.Marshal(map[string]any{
+		"title":          title,
+		"content":        content,
+		"status":         "draft",
+		"featured_media": mediaID,
+	})
+	err := call(ctx, s, http.MethodPost, "/posts", bytes.NewReader(body), "application/json", p)
+	return p, err
+}
+
+// call makes an authenticated request to the site's wp/v2 API. headers are
+// extra header name and value pairs.
+func call(ctx context.Context, s *site, method, path string, body io.Reader, contentType string, out any, headers ...string) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.URL+"/wp-json/wp/v2"+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.Username, s.password)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := wpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &apiError{status: resp.StatusCode, message: resp.Status}
+		var wpErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &wpErr) == nil && wpErr.Code != "" {
+			e.code, e.message = wpErr.Code, wpErr.Message
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,286 @@
+package wordpress
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"canvasai/asset"
+	"canvasai/permissions"
+	"canvasai/projectaccess"
+	"canvasai/reqctx"
+)
+
+// Publication statuses
+const (
+	StatusPublished = "published"
+	StatusFailed    = "failed"
+)
+
+const (
+	maxAltTextLength = 1000
+	maxCaptionLength = 2000
+	maxPostBody      = 20000
+)
+
+// publishableTypes are the export formats a media library accepts by
+// default
+var publishableTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// Publication is an attempt to publish an export to a site
+type Publication struct {
+	ID          string `json:"id"`
+	ProjectID   string `json:"projectId"`
+	SiteID      string `json:"siteId,omitempty"`
+	SiteURL     string `json:"siteUrl"`
+	ExportJobID string `json:"exportJobId,omitempty"`
+	AltText     string `json:"altText"`
+	MediaID     int64  `json:"mediaId,omitempty"`
+	MediaURL    string `json:"mediaUrl,omitempty"`
+	// PostID and PostURL are the draft post, when one was requested
+	PostID      int64     `json:"postId,omitempty"`
+	PostURL     string    `json:"postUrl,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	PublishedBy string    `json:"publishedBy,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// DraftPost asks for a draft post featuring the published media
+type DraftPost struct {
+	Title string `json:"title"`
+	// Body is plain text placed after the image, one paragraph per blank
+	// line-separated block
+	Body string `json:"body,omitempty"`
+}
+
+// PublishRequest represents the publish request
+type PublishRequest struct {
+	SiteID      string `json:"siteId"`
+	ExportJobID string `json:"exportJobId"`
+	// AltText describes the graphic for screen readers; it defaults to the
+	// project's title
+	AltText string     `json:"altText,omitempty"`
+	Caption string     `json:"caption,omitempty"`
+	Post    *DraftPost `json:"post,omitempty"`
+}
+
+// ListPublicationsRequest represents the list publications request
+type ListPublicationsRequest struct {
+	Limit  int `query:"limit"`
+	Offset int `query:"offset"`
+}
+
+// ListPublicationsResponse represents the list publications response
+type ListPublicationsResponse struct {
+	Publications []Publication `json:"publications"`
+	Total        int           `json:"total"`
+}
+
+const (
+	defaultPublicationsLimit = 50
+	maxPublicationsLimit     = 200
+)
+
+// Publish uploads a completed export of the project to one of the caller's
+// sites. The attempt is recorded in the project's publish history whether
+// or not it succeeds.
+//
+//encore:api auth method=POST path=/projects/:id/wordpress-publications
+func Publish(ctx context.Context, id string, req *PublishRequest) (*Publication, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleEditor); err != nil {
+		return nil, err
+	}
+	userID := auth.UserID()
+	altText := strings.TrimSpace(req.AltText)
+	caption := strings.TrimSpace(req.Caption)
+	if len(altText) > maxAltTextLength || len(caption) > maxCaptionLength {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Alt text must be at most 1000 characters and captions at most 2000",
+		}
+	}
+	if req.Post != nil {
+		req.Post.Title = strings.TrimSpace(req.Post.Title)
+		if req.Post.Title == "" || len(req.Post.Title) > 255 || len(req.Post.Body) > maxPostBody {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "A post needs a title of at most 255 characters and a body of at most 20000",
+			}
+		}
+	}
+
+	s, err := getSite(ctx, req.SiteID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var assetID, title string
+	err = db.QueryRow(ctx, `
+		SELECT j.artifact_asset_id, p.title
+		FROM export_jobs j
+		JOIN projects p ON p.id = j.project_id
+		WHERE j.id::text = $1 AND j.project_id = $2 AND j.status = 'completed'
+			AND j.purged_at IS NULL AND j.artifact_asset_id IS NOT NULL
+	`, req.ExportJobID, id).Scan(&assetID, &title)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Completed export not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load export for wordpress", "export_id", req.ExportJobID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to publish",
+		}
+	}
+	data, err := asset.Read(ctx, assetID)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to read export for wordpress", "asset_id", assetID, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to publish",
+		}
+	}
+	if !publishableTypes[data.Asset.MimeType] {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Only PNG, JPEG, GIF, WebP and PDF exports can be published",
+		}
+	}
+	if altText == "" {
+		altText = title
+	}
+
+	pub := &Publication{
+		ProjectID:   id,
+		SiteID:      s.ID,
+		SiteURL:     s.URL,
+		ExportJobID: req.ExportJobID,
+		AltText:     altText,
+		Status:      StatusPublished,
+		PublishedBy: userID,
+	}
+	publishErr := publish(ctx, s, pub, data, caption, req.Post)
+	if publishErr != nil {
+		pub.Status, pub.Error = StatusFailed, publishErr.Error()
+	}
+	if err := recordPublication(ctx, pub); err != nil {
+		reqctx.Logger(ctx).Error("failed to record wordpress publication", "project_id", id, "media_id", pub.MediaID, "error", err)
+	}
+	if publishErr != nil {
+		return nil, apiErrorResponse(ctx, "failed to publish to wordpress", publishErr)
+	}
+	reqctx.Logger(ctx).Info("published to wordpress", "project_id", id, "site_id", s.ID, "media_id", pub.MediaID, "post_id", pub.PostID)
+	return pub, nil
+}
+
+// publish uploads the media and drafts the post, filling in pub as it
+// goes so a partial success is recorded.
+func publish(ctx context.Context, s *site, pub *Publication, data *asset.AssetData, caption string, draft *DraftPost) error {
+	m, err := uploadMedia(ctx, s, data.Asset.Filename, data.Asset.MimeType, data.Data, pub.AltText, caption)
+	if m != nil {
+		pub.MediaID, pub.MediaURL = m.ID, m.SourceURL
+	}
+	if err != nil || draft == nil {
+		return err
+	}
+	p, err := createDraft(ctx, s, draft.Title, postContent(pub, data.Asset.MimeType, draft.Body), m.ID)
+	if err != nil {
+		return err
+	}
+	pub.PostID, pub.PostURL = p.ID, p.Link
+	return nil
+}
+
+// postContent is a draft post's block markup: the image, or a link to a
+// PDF, followed by the body's paragraphs.
+func postContent(pub *Publication, mimeType, body string) string {
+	var b strings.Builder
+	src := html.EscapeString(pub.MediaURL)
+	if strings.HasPrefix(mimeType, "image/") {
+		fmt.Fprintf(&b, "<!-- wp:image {\"id\":%d} -->\n<figure class=\"wp-block-image\"><img src=\"%s\" alt=\"%s\" class=\"wp-image-%d\"/></figure>\n<!-- /wp:image -->\n",
+			pub.MediaID, src, html.EscapeString(pub.AltText), pub.MediaID)
+	} else {
+		fmt.Fprintf(&b, "<!-- wp:file {\"id\":%d,\"href\":\"%s\"} -->\n<div class=\"wp-block-file\"><a href=\"%s\">%s</a></div>\n<!-- /wp:file -->\n",
+			pub.MediaID, src, src, html.EscapeString(pub.AltText))
+	}
+	for _, para := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n\n") {
+		if para = strings.TrimSpace(para); para == "" {
+			continue
+		}
+		text := strings.ReplaceAll(html.EscapeString(para), "\n", "<br>")
+		fmt.Fprintf(&b, "\n<!-- wp:paragraph -->\n<p>%s</p>\n<!-- /wp:paragraph -->\n", text)
+	}
+	return b.String()
+}
+
+func recordPublication(ctx context.Context, pub *Publication) error {
+	return db.QueryRow(ctx, `
+		INSERT INTO wordpress_publications (project_id, site_id, site_url, export_job_id, alt_text,
+			media_id, media_url, post_id, post_url, status, error, published_by)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), NULLIF($7, ''), NULLIF($8, 0), NULLIF($9, ''), $10, NULLIF($11, ''), $12)
+		RETURNING id, created_at
+	`, pub.ProjectID, pub.SiteID, pub.SiteURL, pub.ExportJobID, pub.AltText,
+		pub.MediaID, pub.MediaURL, pub.PostID, pub.PostURL, pub.Status, pub.Error, pub.PublishedBy).Scan(&pub.ID, &pub.CreatedAt)
+}
+
+// ListPublications lists a project's publish history, newest first.
+//
+//encore:api auth method=GET path=/projects/:id/wordpress-publications
+func ListPublications(ctx context.Context, id string, req *ListPublicationsRequest) (*ListPublicationsResponse, error) {
+	if err := projectaccess.RequireRole(ctx, id, permissions.RoleViewer); err != nil {
+		return nil, err
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxPublicationsLimit {
+		limit = defaultPublicationsLimit
+	}
+	offset := max(req.Offset, 0)
+
+	resp := &ListPublicationsResponse{Publications: []Publication{}}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM wordpress_publications WHERE project_id = $1`, id).Scan(&resp.Total); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch publications",
+		}
+	}
+	rows, err := db.Query(ctx, `
+		SELECT id, project_id, COALESCE(site_id::text, ''), site_url, COALESCE(export_job_id::text, ''), alt_text,
+			COALESCE(media_id, 0), COALESCE(media_url, ''), COALESCE(post_id, 0), COALESCE(post_url, ''),
+			status, COALESCE(error, ''), COALESCE(published_by::text, ''), created_at
+		FROM wordpress_publications
+		WHERE project_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2 OFFSET $3
+	`, id, limit, offset)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch publications",
+		}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Publication
+		if err := rows.Scan(&p.ID, &p.ProjectID, &p.SiteID, &p.SiteURL, &p.ExportJobID, &p.AltText,
+			&p.MediaID, &p.MediaURL, &p.PostID, &p.PostURL,
+			&p.Status, &p.Error, &p.PublishedBy, &p.CreatedAt); err != nil {
+			continue
+		}
+		resp.Publications = append(resp.Publications, p)
+	}
+	return resp, nil
+}
@@ -0,0 +1,243 @@
+// Package wordpress publishes exported graphics to WordPress sites. A user
+// connects a site with a username and an application password, which
+// WordPress issues per user under Users > Profile; the password is sealed
+// before it is stored. Publishing uploads a completed export to the site's
+// media library with alt text and can also draft a post around it. Every
+// attempt is kept in the project's publish history (see publish.go).
+package wordpress
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/config"
+	"encore.dev/storage/sqldb"
+
+	"canvasai/reqctx"
+	"canvasai/tokenbox"
+)
+
+var secrets struct {
+	// WordPressCredentialKey is a base64-encoded 32-byte key that seals the
+	// sites' application passwords at rest.
+	WordPressCredentialKey string
+}
+
+var _ = config.Load(context.Background(), &secrets)
+
+// Sites and publications are stored alongside the projects they publish.
+var db = sqldb.Named("project")
+
+// maxSitesPerUser bounds the sites a user can connect
+const maxSitesPerUser = 20
+
+// Site is a WordPress site a user has connected
+type Site struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ConnectSiteRequest represents the connect site request
+type ConnectSiteRequest struct {
+	// URL is the site's address, e.g. https://blog.example.com. It must use
+	// HTTPS, since the password is sent with every request.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	// ApplicationPassword is never returned. The user needs to be able to
+	// upload files, and to create posts to draft them.
+	ApplicationPassword string `json:"applicationPassword"`
+}
+
+// ListSitesResponse represents the list sites response
+type ListSitesResponse struct {
+	Sites []Site `json:"sites"`
+}
+
+//encore:api auth method=POST path=/wordpress/sites
+func ConnectSite(ctx context.Context, req *ConnectSiteRequest) (*Site, error) {
+	userID := auth.UserID()
+	siteURL, ok := normalizeSiteURL(req.URL)
+	if !ok {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "URL must be the site's https:// address",
+		}
+	}
+	username := strings.TrimSpace(req.Username)
+	// Application passwords are shown grouped by spaces, which are ignored.
+	password := strings.ReplaceAll(strings.TrimSpace(req.ApplicationPassword), " ", "")
+	if username == "" || len(username) > 255 || password == "" || len(password) > 255 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "A username and application password are required",
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM wordpress_sites WHERE user_id = $1`, userID).Scan(&count); err != nil {
+		reqctx.Logger(ctx).Error("failed to count wordpress sites", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect site",
+		}
+	}
+	if count >= maxSitesPerUser {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "You can connect up to 20 sites",
+		}
+	}
+
+	s := &site{Site: Site{URL: siteURL, Username: username}, password: password}
+	if err := checkCredentials(ctx, s); err != nil {
+		return nil, apiErrorResponse(ctx, "failed to verify wordpress site", err)
+	}
+	s.Name = siteName(ctx, s)
+
+	sealed, err := tokenbox.Seal(secrets.WordPressCredentialKey, password)
+	if errors.Is(err, tokenbox.ErrNoKey) {
+		return nil, &errs.Error{
+			Code:    errs.Unavailable,
+			Message: "WordPress publishing is not configured",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to seal wordpress password", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect site",
+		}
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO wordpress_sites (user_id, site_url, site_name, username, password_ciphertext)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, site_url, username) DO UPDATE
+		SET site_name = EXCLUDED.site_name, password_ciphertext = EXCLUDED.password_ciphertext
+		RETURNING id, created_at
+	`, userID, s.URL, s.Name, s.Username, sealed).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to create wordpress site", "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to connect site",
+		}
+	}
+
+	reqctx.Logger(ctx).Info("wordpress site connected", "site_id", s.ID, "site_url", s.URL)
+	return &s.Site, nil
+}
+
+//encore:api auth method=GET path=/wordpress/sites
+func ListSites(ctx context.Context) (*ListSitesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, site_url, site_name, username, created_at
+		FROM wordpress_sites
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, auth.UserID())
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to fetch sites",
+		}
+	}
+	defer rows.Close()
+
+	resp := &ListSitesResponse{Sites: []Site{}}
+	for rows.Next() {
+		var s Site
+		if err := rows.Scan(&s.ID, &s.URL, &s.Name, &s.Username, &s.CreatedAt); err != nil {
+			continue
+		}
+		resp.Sites = append(resp.Sites, s)
+	}
+	return resp, nil
+}
+
+// DisconnectSite removes a site and its password. Its publish history is
+// kept; media already uploaded stays on the site.
+//
+//encore:api auth method=DELETE path=/wordpress/sites/:id
+func DisconnectSite(ctx context.Context, id string) error {
+	result, err := db.Exec(ctx, `
+		DELETE FROM wordpress_sites WHERE id::text = $1 AND user_id = $2
+	`, id, auth.UserID())
+	if err != nil {
+		reqctx.Logger(ctx).Error("failed to delete wordpress site", "site_id", id, "error", err)
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to disconnect site",
+		}
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Site not found",
+		}
+	}
+	reqctx.Logger(ctx).Info("wordpress site disconnected", "site_id", id)
+	return nil
+}
+
+// site is a Site with the password to call it
+type site struct {
+	Site
+	password string
+}
+
+// getSite loads a site the user connected.
+func getSite(ctx context.Context, id, userID string) (*site, error) {
+	s := &site{}
+	var sealed []byte
+	err := db.QueryRow(ctx, `
+		SELECT id, site_url, site_name, username, password_ciphertext, created_at
+		FROM wordpress_sites
+		WHERE id::text = $1 AND user_id = $2
+	`, id, userID).Scan(&s.ID, &s.URL, &s.Name, &s.Username, &sealed, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "Site not found",
+		}
+	} else if err != nil {
+		reqctx.Logger(ctx).Error("failed to load wordpress site", "site_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load site",
+		}
+	}
+	if s.password, err = tokenbox.Open(secrets.WordPressCredentialKey, sealed); err != nil {
+		reqctx.Logger(ctx).Error("failed to open wordpress password", "site_id", id, "error", err)
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "Failed to load site",
+		}
+	}
+	return s, nil
+}
+
+// normalizeSiteURL reduces a site or dashboard address to the site's
+// scheme, host and path, without a trailing slash. A missing scheme is taken
+// to be https.
+func normalizeSiteURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || len(raw) > 500 {
+		return "", false
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/wp-admin")
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	return u.String(), true
+}
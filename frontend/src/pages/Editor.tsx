@@ -1,4 +1,4 @@
-import React, { useState, useCallback, useEffect } from 'react'
+import React, { useState, useCallback, useEffect, useRef } from 'react'
 import { useParams } from 'react-router-dom'
 import { fabric } from 'fabric'
 import { toast } from 'react-hot-toast'
@@ -27,6 +27,9 @@ const Editor: React.FC = () => {
   const [projectName, setProjectName] = useState('Untitled Project')
   const [isSaving, setIsSaving] = useState(false)
   const [lastSaved, setLastSaved] = useState<Date | null>(null)
+  // Revision the canvas is based on; saves send it so the server can
+  // reject them if someone else saved in the meantime
+  const revisionRef = useRef<number | null>(null)
 
   // Load project data
   useEffect(() => {
@@ -132,6 +135,7 @@ const Editor: React.FC = () => {
       if (response.ok) {
         const project = await response.json()
         setProjectName(project.title)
+        revisionRef.current = project.revision
         
         // Load canvas data if available
         if (project.canvasData && canvas) {
@@ -147,7 +151,7 @@ const Editor: React.FC = () => {
   }
 
   const saveProject = async () => {
-    if (!canvas || !projectId) return
+    if (!canvas || !projectId || revisionRef.current === null) return
 
     setIsSaving(true)
     try {
@@ -161,13 +165,17 @@ const Editor: React.FC = () => {
         },
         body: JSON.stringify({
           canvasData,
-          updatedAt: new Date().toISOString()
+          baseRevision: revisionRef.current
         })
       })
 
       if (response.ok) {
+        const project = await response.json()
+        revisionRef.current = project.revision
         setLastSaved(new Date())
         toast.success('Project saved')
+      } else if (response.status === 400 && (await response.json()).code === 'failed_precondition') {
+        toast.error('Someone else saved this project. Reload to see their changes.')
       } else {
         throw new Error('Failed to save')
       }